@@ -0,0 +1,343 @@
+// Package apikey lets a public reflector take uploads only from vetted publishers. Each publisher gets an api key, which
+// its client sends as the auth token of the reflector handshake. Keys are kept in the reflector db, and each has its own
+// daily upload quota and upload rate. What was uploaded with each key is kept in the db too, so the quota holds across
+// restarts and over all the reflectors sharing the db. Operators create and revoke keys through the Handler.
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/db"
+	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/internal/ratelimit"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultRefreshInterval is how often keys are read from the store again by default
+const DefaultRefreshInterval = time.Minute
+
+var (
+	ErrMissingKey    = errors.Base("an api key is required to upload")
+	ErrUnknownKey    = errors.Base("unknown api key")
+	ErrRevoked       = errors.Base("api key was revoked")
+	ErrQuotaExceeded = errors.Base("daily upload quota of the api key reached")
+)
+
+// Reasons an upload with a known key is rejected, for the metrics
+const (
+	reasonRevoked = "revoked"
+	reasonQuota   = "quota_exceeded"
+)
+
+// Store is where the keys are kept, like the reflector db
+type Store interface {
+	AddAPIKey(k *db.APIKey) error
+	APIKeys() ([]db.APIKey, error)
+	RevokeAPIKey(id int64) error
+	AddAPIKeyUsage(day string, usage map[int64]db.APIKeyUsage) error
+	APIKeyUsage(day string) (map[int64]db.APIKeyUsage, error)
+}
+
+// Keys checks the keys clients upload with, and counts what was uploaded with each key today (UTC). What was uploaded
+// is written to the store and read back with the keys, so uploads through other reflectors count against the quota
+// once both have refreshed. Until then they can go over it together by what each took in a RefreshInterval. It is safe
+// to use from several goroutines.
+type Keys struct {
+	// RefreshInterval is how often the keys and their usage are read from the store again, to see keys that were created
+	// or revoked and what was uploaded through another reflector. Keys are only read on Start if it's 0, and usage is
+	// only written when keys are created or revoked and on Shutdown
+	RefreshInterval time.Duration
+
+	store  Store
+	grp    *stop.Group
+	now    func() time.Time
+	loadMu sync.Mutex // one load at a time, so usage that's being written isn't missed by another load
+
+	mu      sync.Mutex
+	keys    map[string]*Key // by hash
+	day     string
+	unsaved map[string]map[int64]db.APIKeyUsage // uploads that aren't in the store yet, by day and key id
+}
+
+// Key is a key a client uploads with
+type Key struct {
+	db.APIKey
+
+	limiter  *ratelimit.Limiter // the key's rate. It's kept when the key is read again
+	bytes    int64              // uploaded today, through all reflectors as of the last load and through this one since
+	blobs    int64
+	reserved int64 // held by uploads that are going on. It's not reset when the day changes, the uploads aren't done
+}
+
+// Usage is a key and what was uploaded with it today
+type Usage struct {
+	db.APIKey
+	BytesToday int64 `json:"bytes_today"`
+	BlobsToday int64 `json:"blobs_today"`
+}
+
+// New returns keys kept in store. Call Start to read them
+func New(store Store) *Keys {
+	return &Keys{
+		RefreshInterval: DefaultRefreshInterval,
+		store:           store,
+		grp:             stop.New(),
+		now:             time.Now,
+		keys:            make(map[string]*Key),
+		unsaved:         make(map[string]map[int64]db.APIKeyUsage),
+	}
+}
+
+// Start reads the keys, and keeps reading them every RefreshInterval
+func (k *Keys) Start() error {
+	err := k.load()
+	if err != nil {
+		return err
+	}
+	if k.RefreshInterval <= 0 {
+		return nil
+	}
+	k.grp.Add(1)
+	go func() {
+		defer k.grp.Done()
+		t := time.NewTicker(k.RefreshInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-k.grp.Ch():
+				return
+			case <-t.C:
+				err := k.load()
+				if err != nil {
+					log.Errorf("error reading api keys: %s", errors.FullTrace(err))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops reading the keys, ends the waits of uploads that are over their key's rate, and writes what was
+// uploaded to the store
+func (k *Keys) Shutdown() {
+	k.grp.StopAndWait()
+	k.loadMu.Lock()
+	defer k.loadMu.Unlock()
+	err := k.save()
+	if err != nil {
+		log.Errorf("error saving api key usage: %s", errors.FullTrace(err))
+	}
+}
+
+// save writes the uploads that aren't in the store yet. If that fails, they're kept to be written with the next load
+func (k *Keys) save() error {
+	k.mu.Lock()
+	unsaved := k.unsaved
+	k.unsaved = make(map[string]map[int64]db.APIKeyUsage)
+	k.mu.Unlock()
+
+	for day, usage := range unsaved {
+		err := k.store.AddAPIKeyUsage(day, usage)
+		if err != nil {
+			k.mu.Lock()
+			for d, left := range unsaved {
+				for id, u := range left {
+					k.addUnsaved(d, id, u)
+				}
+			}
+			k.mu.Unlock()
+			return err
+		}
+		delete(unsaved, day)
+	}
+	return nil
+}
+
+// addUnsaved counts an upload that isn't in the store yet. k.mu must be held
+func (k *Keys) addUnsaved(day string, id int64, u db.APIKeyUsage) {
+	usage, ok := k.unsaved[day]
+	if !ok {
+		usage = make(map[int64]db.APIKeyUsage)
+		k.unsaved[day] = usage
+	}
+	total := usage[id]
+	total.Bytes += u.Bytes
+	total.Blobs += u.Blobs
+	usage[id] = total
+}
+
+// load writes what was uploaded to the store, and reads the keys and what was uploaded with them today. Keys that were
+// known before are updated in place, so uploads that are going on with them are counted
+func (k *Keys) load() error {
+	k.loadMu.Lock()
+	defer k.loadMu.Unlock()
+	err := k.save()
+	if err != nil {
+		return err
+	}
+
+	stored, err := k.store.APIKeys()
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.rollover()
+	day := k.day
+	k.mu.Unlock()
+	usage, err := k.store.APIKeyUsage(day)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	byID := make(map[int64]*Key, len(k.keys))
+	for _, key := range k.keys {
+		byID[key.ID] = key
+	}
+	k.keys = make(map[string]*Key, len(stored))
+	for _, s := range stored {
+		key, ok := byID[s.ID]
+		if !ok {
+			key = &Key{limiter: ratelimit.NewBurst(s.MaxRate, stream.MaxBlobSize, k.grp.Ch())}
+		} else if key.MaxRate != s.MaxRate {
+			key.limiter.SetRate(s.MaxRate, stream.MaxBlobSize)
+		}
+		key.APIKey = s
+		k.keys[s.Hash] = key
+	}
+	k.rollover()
+	if k.day == day {
+		// uploads since save are in the store's usage only once they're saved too
+		for _, key := range k.keys {
+			key.bytes = usage[key.ID].Bytes + k.unsaved[day][key.ID].Bytes
+			key.blobs = usage[key.ID].Blobs + k.unsaved[day][key.ID].Blobs
+		}
+	}
+	return nil
+}
+
+// Check returns the key for the token a client sent, if a blob of this size may be uploaded with it. The size is held
+// against the key's quota until the upload is counted with Uploaded or given back with Release, so uploads that go on at
+// the same time can't get past the quota together
+func (k *Keys) Check(token string, size int) (*Key, error) {
+	if token == "" {
+		return nil, errors.Err(ErrMissingKey)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.rollover()
+	key, ok := k.keys[hash(token)]
+	if !ok {
+		return nil, errors.Err(ErrUnknownKey)
+	}
+	if key.RevokedAt != nil {
+		metrics.APIKeyRejectedCount.WithLabelValues(key.Name, reasonRevoked).Inc()
+		return nil, errors.Prefix(key.Name, ErrRevoked)
+	}
+	if key.DailyQuota > 0 && key.bytes+key.reserved+int64(size) > key.DailyQuota {
+		metrics.APIKeyRejectedCount.WithLabelValues(key.Name, reasonQuota).Inc()
+		return nil, errors.Prefix(key.Name, ErrQuotaExceeded)
+	}
+	key.reserved += int64(size)
+	return key, nil
+}
+
+// Release gives back the size Check held for an upload that didn't happen
+func (k *Keys) Release(key *Key, reserved int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key.reserved -= int64(reserved)
+}
+
+// Wait sleeps until n more bytes fit in the upload rate of the key
+func (key *Key) Wait(n int) error {
+	return key.limiter.Wait(n)
+}
+
+// Uploaded counts a blob of n bytes that was uploaded with key, in place of the size Check held for it
+func (k *Keys) Uploaded(key *Key, reserved, n int) {
+	k.mu.Lock()
+	k.rollover()
+	key.reserved -= int64(reserved)
+	key.bytes += int64(n)
+	key.blobs++
+	k.addUnsaved(k.day, key.ID, db.APIKeyUsage{Bytes: int64(n), Blobs: 1})
+	name := key.Name
+	k.mu.Unlock()
+	metrics.APIKeyUploadCount.WithLabelValues(name).Inc()
+	metrics.APIKeyUploadBytes.WithLabelValues(name).Add(float64(n))
+}
+
+// rollover starts counting from 0 when the day changes. What wasn't saved of the day before is still saved for that day
+func (k *Keys) rollover() {
+	day := k.now().UTC().Format("2006-01-02")
+	if day == k.day {
+		return
+	}
+	k.day = day
+	for _, key := range k.keys {
+		key.bytes, key.blobs = 0, 0
+	}
+}
+
+// Create makes a new key and returns it. Only its hash is stored, so it can't be shown again
+func (k *Keys) Create(name string, dailyQuota, maxRate int64) (string, *db.APIKey, error) {
+	if name == "" {
+		return "", nil, errors.Err("api key name is empty")
+	}
+	if dailyQuota < 0 || maxRate < 0 {
+		return "", nil, errors.Err("api key limits can't be negative")
+	}
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", nil, errors.Err(err)
+	}
+	token := hex.EncodeToString(raw)
+
+	stored := &db.APIKey{Name: name, Hash: hash(token), DailyQuota: dailyQuota, MaxRate: maxRate}
+	err = k.store.AddAPIKey(stored)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, stored, k.load()
+}
+
+// Revoke stops the key with this id from being accepted. Other reflectors see it when they read the keys again
+func (k *Keys) Revoke(id int64) error {
+	err := k.store.RevokeAPIKey(id)
+	if err != nil {
+		return err
+	}
+	return k.load()
+}
+
+// List returns all keys, with what was uploaded with them today
+func (k *Keys) List() []Usage {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.rollover()
+	list := make([]Usage, 0, len(k.keys))
+	for _, key := range k.keys {
+		list = append(list, Usage{APIKey: key.APIKey, BytesToday: key.bytes, BlobsToday: key.blobs})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// hash returns what's stored of a key
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
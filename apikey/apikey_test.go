@@ -0,0 +1,193 @@
+package apikey
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/db"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testDB(t *testing.T) *db.SQL {
+	if !db.SQLiteSupported {
+		t.Skip("sqlite needs cgo")
+	}
+	s := &db.SQL{}
+	require.NoError(t, s.Connect(db.SQLitePrefix+filepath.Join(t.TempDir(), "reflector.db")))
+	return s
+}
+
+func TestKeys(t *testing.T) {
+	store := testDB(t)
+	keys := New(store)
+	require.NoError(t, keys.Start())
+	defer keys.Shutdown()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	keys.now = func() time.Time { return now }
+
+	_, err := keys.Check("", 100)
+	assert.True(t, errors.Is(err, ErrMissingKey))
+	_, err = keys.Check("nope", 100)
+	assert.True(t, errors.Is(err, ErrUnknownKey))
+
+	token, created, err := keys.Create("publisher", 1000, 0)
+	require.NoError(t, err)
+	key, err := keys.Check(token, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, created.ID, key.ID)
+	keys.Uploaded(key, 1000, 600)
+	_, err = keys.Check(token, 500)
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	_, err = keys.Check(token, 400)
+	assert.NoError(t, err)
+	// the upload that is going on holds the rest of the quota
+	_, err = keys.Check(token, 100)
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	keys.Release(key, 400)
+
+	list := keys.List()
+	require.Len(t, list, 1)
+	assert.Equal(t, "publisher", list[0].Name)
+	assert.EqualValues(t, 600, list[0].BytesToday)
+	assert.EqualValues(t, 1, list[0].BlobsToday)
+
+	// usage is kept when the keys are read again, and starts over the next day
+	require.NoError(t, keys.load())
+	assert.EqualValues(t, 600, keys.List()[0].BytesToday)
+	now = now.Add(24 * time.Hour)
+	_, err = keys.Check(token, 1000)
+	assert.NoError(t, err)
+	assert.Zero(t, keys.List()[0].BytesToday)
+
+	// another reflector sees the revocation when it reads the keys again
+	other := New(store)
+	other.RefreshInterval = 0
+	require.NoError(t, other.Start())
+	defer other.Shutdown()
+	_, err = other.Check(token, 100)
+	require.NoError(t, err)
+	require.NoError(t, keys.Revoke(created.ID))
+	_, err = keys.Check(token, 100)
+	assert.True(t, errors.Is(err, ErrRevoked))
+	require.NoError(t, other.load())
+	_, err = other.Check(token, 100)
+	assert.True(t, errors.Is(err, ErrRevoked))
+
+	assert.True(t, errors.Is(keys.Revoke(created.ID), db.ErrAPIKeyNotFound))
+}
+
+func TestKeys_SharedUsage(t *testing.T) {
+	store := testDB(t)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	start := func() *Keys {
+		keys := New(store)
+		keys.RefreshInterval = 0
+		keys.now = func() time.Time { return now }
+		require.NoError(t, keys.Start())
+		return keys
+	}
+
+	keys := start()
+	token, _, err := keys.Create("publisher", 1000, 0)
+	require.NoError(t, err)
+	other := start()
+	defer other.Shutdown()
+
+	key, err := keys.Check(token, 600)
+	require.NoError(t, err)
+	keys.Uploaded(key, 600, 600)
+	key, err = other.Check(token, 300)
+	require.NoError(t, err)
+	other.Uploaded(key, 300, 300)
+
+	// each reflector sees what the other uploaded once both have refreshed
+	require.NoError(t, keys.load())
+	require.NoError(t, other.load())
+	require.NoError(t, keys.load())
+	for _, k := range []*Keys{keys, other} {
+		assert.EqualValues(t, 900, k.List()[0].BytesToday)
+		assert.EqualValues(t, 2, k.List()[0].BlobsToday)
+		_, err = k.Check(token, 200)
+		assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	}
+
+	// and the usage is still there after a restart
+	keys.Shutdown()
+	restarted := start()
+	defer restarted.Shutdown()
+	assert.EqualValues(t, 900, restarted.List()[0].BytesToday)
+	_, err = restarted.Check(token, 100)
+	assert.NoError(t, err)
+	_, err = restarted.Check(token, 100)
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+
+	// usage is kept by day
+	now = now.Add(24 * time.Hour)
+	require.NoError(t, restarted.load())
+	assert.Zero(t, restarted.List()[0].BytesToday)
+}
+
+func TestHandler(t *testing.T) {
+	keys := New(testDB(t))
+	require.NoError(t, keys.Start())
+	defer keys.Shutdown()
+	srv := httptest.NewServer(NewHandler(keys, "secret"))
+	defer srv.Close()
+
+	do := func(token, method, path string, form url.Values) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(form.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := do("wrong", http.MethodGet, Path, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = do("secret", http.MethodPost, Path+"/create", url.Values{"name": {"publisher"}, "daily_quota": {"lots"}})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = do("secret", http.MethodPost, Path+"/create", url.Values{"name": {"publisher"}, "daily_quota": {"50GB"}, "max_rate": {"10MB"}})
+	var c created
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&c))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, c.Key, 64)
+	assert.EqualValues(t, 50<<30, c.DailyQuota)
+	assert.EqualValues(t, 10<<20, c.MaxRate)
+	_, err := keys.Check(c.Key, 100)
+	assert.NoError(t, err)
+
+	resp = do("secret", http.MethodGet, Path, nil)
+	var list []Usage
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	resp.Body.Close()
+	require.Len(t, list, 1)
+	assert.Equal(t, "publisher", list[0].Name)
+	assert.Nil(t, list[0].RevokedAt)
+
+	resp = do("secret", http.MethodPost, Path+"/revoke", url.Values{"id": {"1"}})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = keys.Check(c.Key, 100)
+	assert.True(t, errors.Is(err, ErrRevoked))
+
+	resp = do("secret", http.MethodPost, Path+"/revoke", url.Values{"id": {"1"}})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
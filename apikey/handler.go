@@ -0,0 +1,124 @@
+package apikey
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/db"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/c2h5oh/datasize"
+	log "github.com/sirupsen/logrus"
+)
+
+// Path is where the Handler is served. Creating and revoking keys are below it
+const Path = "/apikeys"
+
+// Handler lets an operator manage the api keys, to clients that send the admin token as a bearer token:
+//
+//	curl -H 'Authorization: Bearer TOKEN' localhost:2112/apikeys
+//	curl -H 'Authorization: Bearer TOKEN' -d name=PUBLISHER -d daily_quota=50GB -d max_rate=10MB localhost:2112/apikeys/create
+//	curl -H 'Authorization: Bearer TOKEN' -d id=ID localhost:2112/apikeys/revoke
+//
+// The list has what was uploaded with each key today. Quotas and rates are optional, and unlimited if they're missing
+// or 0. The key itself is only in the answer to create
+type Handler struct {
+	keys  *Keys
+	token string
+}
+
+// NewHandler returns a handler for keys. Requests must carry token
+func NewHandler(keys *Keys, token string) *Handler {
+	return &Handler{keys: keys, token: token}
+}
+
+// created is the answer to create
+type created struct {
+	*db.APIKey
+	Key string `json:"key"`
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !auth.HasToken(r, h.token) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var result interface{}
+	op := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, Path), "/")
+	if op == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result = h.keys.List()
+	} else {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch op {
+		case "create":
+			var quota, rate datasize.ByteSize
+			if err := parseSize(r.PostFormValue("daily_quota"), &quota); err != nil {
+				http.Error(w, "daily_quota must be a size like 50GB", http.StatusBadRequest)
+				return
+			}
+			if err := parseSize(r.PostFormValue("max_rate"), &rate); err != nil {
+				http.Error(w, "max_rate must be a size like 10MB", http.StatusBadRequest)
+				return
+			}
+			name := strings.TrimSpace(r.PostFormValue("name"))
+			if name == "" {
+				http.Error(w, "name is required", http.StatusBadRequest)
+				return
+			}
+			token, key, err := h.keys.Create(name, int64(quota), int64(rate))
+			if err != nil {
+				log.Errorf("creating api key %s: %s", name, errors.FullTrace(err))
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Infof("created api key %d for %s", key.ID, name)
+			result = created{APIKey: key, Key: token}
+		case "revoke":
+			id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+			if err != nil {
+				http.Error(w, "id must be the id of a key", http.StatusBadRequest)
+				return
+			}
+			err = h.keys.Revoke(id)
+			if errors.Is(err, db.ErrAPIKeyNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				log.Errorf("revoking api key %d: %s", id, errors.FullTrace(err))
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Infof("revoked api key %d", id)
+			result = h.keys.List()
+		default:
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// parseSize parses a size like 10MB. A missing size is 0
+func parseSize(s string, size *datasize.ByteSize) error {
+	if s == "" {
+		return nil
+	}
+	return size.UnmarshalText([]byte(s))
+}
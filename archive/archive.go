@@ -0,0 +1,246 @@
+// Package archive writes blobs to tar archives and reads them back, to move blobs between reflectors that can't reach
+// each other. Each blob is a file named after its hash in the blobs dir of the archive. The archive ends with a
+// manifest that lists the blobs it should have, so an archive that was cut short is noticed when it's imported.
+package archive
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/lbryio/reflector.go/shared"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+)
+
+// ErrInvalid is returned when an archive is damaged or incomplete
+var ErrInvalid = errors.Base("invalid blob archive")
+
+const (
+	manifestName    = "manifest.json"
+	blobsDir        = "blobs"
+	manifestVersion = 1
+)
+
+// Manifest describes the blobs in an archive
+type Manifest struct {
+	Version int            `json:"version"`
+	Created time.Time      `json:"created"`
+	Blobs   []ManifestBlob `json:"blobs"`
+	// Missing are blobs that were asked for but the source didn't have
+	Missing []string `json:"missing,omitempty"`
+}
+
+// ManifestBlob is a blob in the archive
+type ManifestBlob struct {
+	Hash string `json:"hash"`
+	Size int    `json:"size"`
+	SD   bool   `json:"sd,omitempty"`
+}
+
+// Writer writes blobs to a tar archive. Close must be called to write the manifest
+type Writer struct {
+	tw       *tar.Writer
+	manifest Manifest
+	seen     map[string]bool
+}
+
+// NewWriter returns a writer that writes an archive to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		tw:       tar.NewWriter(w),
+		manifest: Manifest{Version: manifestVersion, Created: time.Now().UTC()},
+		seen:     make(map[string]bool),
+	}
+}
+
+// Add writes a blob to the archive. Blobs that were already added are skipped
+func (w *Writer) Add(hash string, blob stream.Blob, sd bool) error {
+	if w.seen[hash] {
+		return nil
+	}
+	if blob.HashHex() != hash {
+		return errors.Err("blob %s does not match its hash", hash)
+	}
+	err := w.writeFile(path.Join(blobsDir, hash), blob)
+	if err != nil {
+		return err
+	}
+	w.seen[hash] = true
+	w.manifest.Blobs = append(w.manifest.Blobs, ManifestBlob{Hash: hash, Size: len(blob), SD: sd})
+	return nil
+}
+
+// Missing records that a blob was asked for but not found
+func (w *Writer) Missing(hash string) {
+	w.manifest.Missing = append(w.manifest.Missing, hash)
+}
+
+// Manifest returns what was written so far
+func (w *Writer) Manifest() Manifest {
+	return w.manifest
+}
+
+// Close writes the manifest and finishes the archive. It does not close the underlying writer
+func (w *Writer) Close() error {
+	manifest, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return errors.Err(err)
+	}
+	err = w.writeFile(manifestName, manifest)
+	if err != nil {
+		return err
+	}
+	return errors.Err(w.tw.Close())
+}
+
+func (w *Writer) writeFile(name string, data []byte) error {
+	err := w.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: w.manifest.Created,
+	})
+	if err != nil {
+		return errors.Err(err)
+	}
+	_, err = w.tw.Write(data)
+	return errors.Err(err)
+}
+
+// Export writes the blobs to w. The streams of sd blobs are included: sdHashes are the sd blobs whose content blobs
+// are exported with them. Blobs src doesn't have are listed as missing in the manifest
+func Export(w io.Writer, src store.BlobStore, hashes, sdHashes []string) (Manifest, error) {
+	aw := NewWriter(w)
+	add := func(hash string, sd bool) (stream.Blob, error) {
+		blob, _, err := src.Get(hash)
+		if errors.Is(err, store.ErrBlobNotFound) {
+			aw.Missing(hash)
+			return nil, nil
+		} else if err != nil {
+			return nil, errors.Prefix(hash, err)
+		}
+		return blob, aw.Add(hash, blob, sd)
+	}
+
+	for _, hash := range hashes {
+		_, err := add(hash, false)
+		if err != nil {
+			return aw.Manifest(), err
+		}
+	}
+	for _, sdHash := range sdHashes {
+		blob, err := add(sdHash, true)
+		if err != nil {
+			return aw.Manifest(), err
+		}
+		if blob == nil {
+			continue
+		}
+		sd, err := shared.ParseSDBlob(blob)
+		if err != nil {
+			return aw.Manifest(), errors.Prefix(sdHash, err)
+		}
+		for _, info := range sd.ContentBlobs() {
+			_, err = add(hex.EncodeToString(info.BlobHash), false)
+			if err != nil {
+				return aw.Manifest(), err
+			}
+		}
+	}
+	return aw.Manifest(), aw.Close()
+}
+
+// ImportResult counts what an import did
+type ImportResult struct {
+	Manifest Manifest
+	Imported int
+	Bytes    int64
+}
+
+// Import reads an archive and stores its blobs in dst. Every blob is checked against its hash, and the archive against
+// its manifest. Blobs are stored as they're read, so an archive that turns out to be broken may be partly imported.
+// With a nil dst, the archive is only checked
+func Import(r io.Reader, dst store.BlobStore) (ImportResult, error) {
+	var result ImportResult
+	seen := make(map[string]int)
+	var manifest *Manifest
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return result, errors.Prefix(err.Error(), ErrInvalid)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if manifest != nil {
+			return result, errors.Prefix("files after the manifest", ErrInvalid)
+		}
+		if hdr.Size > stream.MaxBlobSize+1<<20 {
+			return result, errors.Prefix(hdr.Name+" is too big", ErrInvalid)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return result, errors.Prefix(err.Error(), ErrInvalid)
+		}
+
+		name := path.Clean(hdr.Name)
+		if name == manifestName {
+			manifest = &Manifest{}
+			err = json.Unmarshal(data, manifest)
+			if err != nil {
+				return result, errors.Prefix("manifest: "+err.Error(), ErrInvalid)
+			}
+			continue
+		}
+		if path.Dir(name) != blobsDir {
+			continue
+		}
+
+		hash := path.Base(name)
+		blob := stream.Blob(data)
+		if blob.HashHex() != hash {
+			return result, errors.Prefix(hash+" does not match its hash", ErrInvalid)
+		}
+		seen[hash] = len(blob)
+		if dst != nil {
+			if _, sdErr := shared.ParseSDBlob(blob); sdErr == nil {
+				err = dst.PutSD(hash, blob)
+			} else {
+				err = dst.Put(hash, blob)
+			}
+			if err != nil {
+				return result, errors.Prefix(hash, err)
+			}
+		}
+		result.Imported++
+		result.Bytes += int64(len(blob))
+	}
+
+	if manifest == nil {
+		return result, errors.Prefix("no manifest, the archive may be cut short", ErrInvalid)
+	}
+	result.Manifest = *manifest
+	var missing []string
+	for _, b := range manifest.Blobs {
+		if size, ok := seen[b.Hash]; !ok || size != b.Size {
+			missing = append(missing, b.Hash)
+		}
+	}
+	if len(missing) > 0 {
+		return result, errors.Prefix(fmt.Sprintf("%d blobs in the manifest are missing from the archive, like %s",
+			len(missing), missing[0]), ErrInvalid)
+	}
+	return result, nil
+}
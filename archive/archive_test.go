@@ -0,0 +1,98 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStream(t *testing.T, src *store.MemStore) stream.Stream {
+	data := make([]byte, 3*stream.MaxBlobSize/2)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	s, err := stream.New(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, src.PutSD(s[0].HashHex(), s[0]))
+	for _, b := range s[1:] {
+		require.NoError(t, src.Put(b.HashHex(), b))
+	}
+	return s
+}
+
+func TestExportImport(t *testing.T) {
+	src := store.NewMemStore()
+	s := testStream(t, src)
+	extra := stream.Blob("just a blob")
+	require.NoError(t, src.Put(extra.HashHex(), extra))
+
+	var buf bytes.Buffer
+	manifest, err := Export(&buf, src, []string{extra.HashHex(), "missing"}, []string{s[0].HashHex()})
+	require.NoError(t, err)
+	assert.Len(t, manifest.Blobs, len(s)+1)
+	assert.Equal(t, []string{"missing"}, manifest.Missing)
+
+	dst := store.NewMemStore()
+	result, err := Import(bytes.NewReader(buf.Bytes()), dst)
+	require.NoError(t, err)
+	assert.Equal(t, len(s)+1, result.Imported)
+	assert.Equal(t, src.Debug(), dst.Debug())
+	assert.Equal(t, manifest.Missing, result.Manifest.Missing)
+}
+
+func TestImport_VerifyOnly(t *testing.T) {
+	src := store.NewMemStore()
+	s := testStream(t, src)
+	var buf bytes.Buffer
+	_, err := Export(&buf, src, nil, []string{s[0].HashHex()})
+	require.NoError(t, err)
+
+	result, err := Import(&buf, nil)
+	require.NoError(t, err)
+	assert.Equal(t, len(s), result.Imported)
+}
+
+func TestImport_Invalid(t *testing.T) {
+	src := store.NewMemStore()
+	s := testStream(t, src)
+	var buf bytes.Buffer
+	_, err := Export(&buf, src, nil, []string{s[0].HashHex()})
+	require.NoError(t, err)
+	archive := buf.Bytes()
+
+	// cut short before the manifest
+	_, err = Import(bytes.NewReader(archive[:len(archive)/2]), nil)
+	assert.True(t, errors.Is(err, ErrInvalid), "got %v", err)
+
+	// a blob that doesn't match its name
+	var bad bytes.Buffer
+	w := NewWriter(&bad)
+	require.NoError(t, w.writeFile(blobsDir+"/"+s[1].HashHex(), []byte("something else")))
+	require.NoError(t, w.Close())
+	_, err = Import(&bad, nil)
+	assert.True(t, errors.Is(err, ErrInvalid), "got %v", err)
+
+	// a blob listed in the manifest but not in the archive
+	var short bytes.Buffer
+	w = NewWriter(&short)
+	w.manifest.Blobs = append(w.manifest.Blobs, ManifestBlob{Hash: s[1].HashHex(), Size: len(s[1])})
+	require.NoError(t, w.Close())
+	_, err = Import(&short, nil)
+	assert.True(t, errors.Is(err, ErrInvalid), "got %v", err)
+
+	// files after the manifest
+	var after bytes.Buffer
+	w = NewWriter(&after)
+	require.NoError(t, w.writeFile(manifestName, []byte(`{"version":1}`)))
+	require.NoError(t, w.writeFile(blobsDir+"/"+s[1].HashHex(), s[1]))
+	require.NoError(t, w.tw.Close())
+	_, err = Import(&after, nil)
+	assert.True(t, errors.Is(err, ErrInvalid), "got %v", err)
+}
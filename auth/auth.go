@@ -0,0 +1,175 @@
+// Package auth decides whether a client may download or upload a blob. The peer, http, http3 and reflector servers
+// call an Authorizer before serving or accepting each blob, so operators can plug in their own access control.
+package auth
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// ErrForbidden is returned when a request is not allowed
+var ErrForbidden = errors.Base("forbidden")
+
+// Action is what a client wants to do with a blob, or with the server's blobs
+type Action string
+
+const (
+	ActionDownload Action = "download"
+	ActionUpload   Action = "upload"
+	// ActionList is listing the blobs a server has. The request has no hash
+	ActionList Action = "list"
+)
+
+// Protocols the servers use in requests
+const (
+	ProtocolPeer      = "peer"
+	ProtocolHTTP      = "http"
+	ProtocolHTTP3     = "http3"
+	ProtocolReflector = "reflector"
+	ProtocolS3        = "s3"
+)
+
+// Request is what an authorizer gets to make its decision
+type Request struct {
+	Action     Action      `json:"action"`
+	Hash       string      `json:"hash"`
+	RemoteAddr string      `json:"remote_addr"`
+	Protocol   string      `json:"protocol"`
+	Token      string      `json:"token,omitempty"`
+	Header     http.Header `json:"header,omitempty"` // only set for http and http3 requests
+}
+
+// IP returns the client's ip, or nil if the remote address can't be parsed
+func (r Request) IP() net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// Authorizer returns nil if the request is allowed. Denials should wrap ErrForbidden. Any other error also denies the
+// request, but is reported as a server error.
+type Authorizer interface {
+	Authorize(r Request) error
+}
+
+// Func lets a plain function be used as an Authorizer
+type Func func(r Request) error
+
+func (f Func) Authorize(r Request) error { return f(r) }
+
+// All returns an authorizer that allows a request only if every one of the authorizers allows it
+func All(authorizers ...Authorizer) Authorizer {
+	return Func(func(r Request) error {
+		for _, a := range authorizers {
+			err := a.Authorize(r)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Check authorizes the request with a, which may be nil to allow everything
+func Check(a Authorizer, r Request) error {
+	if a == nil {
+		return nil
+	}
+	return a.Authorize(r)
+}
+
+// TokenFromHTTP returns the bearer token of an http request, or the token query param if there is no Authorization
+// header
+func TokenFromHTTP(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if strings.HasPrefix(strings.ToLower(h), "bearer ") {
+		return strings.TrimSpace(h[len("bearer "):])
+	}
+	return r.URL.Query().Get("token")
+}
+
+// HasToken returns whether an http request carries token, the way TokenFromHTTP reads it. The comparison takes as long
+// wherever the tokens differ, so it doesn't give the token away. An empty token is never carried, so endpoints without
+// one stay closed
+func HasToken(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(TokenFromHTTP(r)), []byte(token)) == 1
+}
+
+// RequireToken only passes requests that carry token on to h, and refuses all of them if token is empty
+func RequireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !HasToken(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// FromHTTP returns the authorization request for an http request
+func FromHTTP(r *http.Request, action Action, hash, protocol string) Request {
+	return Request{
+		Action:     action,
+		Hash:       hash,
+		RemoteAddr: r.RemoteAddr,
+		Protocol:   protocol,
+		Token:      TokenFromHTTP(r),
+		Header:     r.Header,
+	}
+}
+
+// IPAllowlist allows requests only from the listed networks
+type IPAllowlist struct {
+	nets []*net.IPNet
+}
+
+// NewIPAllowlist parses a list of CIDRs or single ips
+func NewIPAllowlist(cidrs []string) (*IPAllowlist, error) {
+	l := &IPAllowlist{}
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, errors.Err("invalid ip %s", c)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			l.nets = append(l.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		l.nets = append(l.nets, n)
+	}
+	return l, nil
+}
+
+func (l *IPAllowlist) Authorize(r Request) error {
+	ip := r.IP()
+	if ip != nil {
+		for _, n := range l.nets {
+			if n.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	return errors.Prefix(r.RemoteAddr+" is not in the allowlist", ErrForbidden)
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+func signJWT(t *testing.T, secret string, claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestIPAllowlist(t *testing.T) {
+	l, err := NewIPAllowlist([]string{"10.0.0.0/8", "192.168.1.5", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, allowed := range map[string]bool{
+		"10.1.2.3:5000":    true,
+		"192.168.1.5:80":   true,
+		"192.168.1.6:80":   false,
+		"[::1]:3333":       true,
+		"8.8.8.8:1234":     false,
+		"not an address:1": false,
+	} {
+		err := l.Authorize(Request{RemoteAddr: addr})
+		if allowed && err != nil {
+			t.Errorf("%s should be allowed, got %v", addr, err)
+		} else if !allowed && !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s should be forbidden, got %v", addr, err)
+		}
+	}
+
+	_, err = NewIPAllowlist([]string{"10.0.0.0/33"})
+	if err == nil {
+		t.Error("expected an invalid CIDR to fail")
+	}
+}
+
+func TestJWT(t *testing.T) {
+	j := NewJWT("secret")
+	now := time.Unix(1000000, 0)
+	j.now = func() time.Time { return now }
+
+	cases := []struct {
+		name    string
+		token   string
+		req     Request
+		allowed bool
+	}{
+		{"no claims", signJWT(t, "secret", nil), Request{Action: ActionDownload}, true},
+		{"no token", "", Request{Action: ActionDownload}, false},
+		{"wrong secret", signJWT(t, "other", nil), Request{Action: ActionDownload}, false},
+		{"malformed", "abc.def", Request{Action: ActionDownload}, false},
+		{"expired", signJWT(t, "secret", map[string]interface{}{"exp": now.Unix()}), Request{Action: ActionDownload}, false},
+		{"not expired", signJWT(t, "secret", map[string]interface{}{"exp": now.Unix() + 1}), Request{Action: ActionDownload}, true},
+		{"not valid yet", signJWT(t, "secret", map[string]interface{}{"nbf": now.Unix() + 1}), Request{Action: ActionDownload}, false},
+		{"in scope", signJWT(t, "secret", map[string]interface{}{"scope": "upload download"}), Request{Action: ActionUpload}, true},
+		{"out of scope", signJWT(t, "secret", map[string]interface{}{"scope": "download"}), Request{Action: ActionUpload}, false},
+		{"listed blob", signJWT(t, "secret", map[string]interface{}{"blobs": []string{"a", "b"}}), Request{Action: ActionDownload, Hash: "b"}, true},
+		{"unlisted blob", signJWT(t, "secret", map[string]interface{}{"blobs": []string{"a"}}), Request{Action: ActionDownload, Hash: "b"}, false},
+	}
+	for _, c := range cases {
+		c.req.Token = c.token
+		err := j.Authorize(c.req)
+		if c.allowed && err != nil {
+			t.Errorf("%s: expected the request to be allowed, got %v", c.name, err)
+		} else if !c.allowed && !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s: expected the request to be forbidden, got %v", c.name, err)
+		}
+	}
+}
+
+func TestRemote(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch req.Hash {
+		case "allowed":
+			w.WriteHeader(http.StatusNoContent)
+		case "denied":
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("no thanks"))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	a := NewRemote(server.URL, time.Second)
+	if err := a.Authorize(Request{Hash: "allowed"}); err != nil {
+		t.Errorf("expected the request to be allowed, got %v", err)
+	}
+	if err := a.Authorize(Request{Hash: "denied"}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("expected the request to be forbidden, got %v", err)
+	}
+	if err := a.Authorize(Request{Hash: "broken"}); err == nil || errors.Is(err, ErrForbidden) {
+		t.Errorf("expected an authorizer error, got %v", err)
+	}
+}
+
+func TestAll(t *testing.T) {
+	allow := Func(func(Request) error { return nil })
+	deny := Func(func(Request) error { return errors.Err(ErrForbidden) })
+
+	if err := All(allow, allow).Authorize(Request{}); err != nil {
+		t.Errorf("expected the request to be allowed, got %v", err)
+	}
+	if err := All(allow, deny).Authorize(Request{}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("expected the request to be forbidden, got %v", err)
+	}
+	if err := Check(nil, Request{}); err != nil {
+		t.Errorf("a nil authorizer should allow everything, got %v", err)
+	}
+}
+
+func TestHasToken(t *testing.T) {
+	for _, c := range []struct {
+		header, query, token string
+		has                  bool
+	}{
+		{header: "Bearer secret", token: "secret", has: true},
+		{header: "bearer secret", token: "secret", has: true},
+		{query: "secret", token: "secret", has: true},
+		{header: "Bearer secre", token: "secret"},
+		{header: "Bearer secrets", token: "secret"},
+		{header: "secret", token: "secret"},
+		{token: "secret"},
+		{header: "Bearer ", token: ""},
+		{},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/?token="+c.query, nil)
+		if c.header != "" {
+			r.Header.Set("Authorization", c.header)
+		}
+		if HasToken(r, c.token) != c.has {
+			t.Errorf("header %q, query %q, token %q: expected %v", c.header, c.query, c.token, c.has)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	calls := 0
+	c := NewCache(Func(func(r Request) error {
+		calls++
+		switch r.Hash {
+		case "allowed":
+			return nil
+		case "denied":
+			return errors.Err(ErrForbidden)
+		default:
+			return errors.Err("authorizer is down")
+		}
+	}), 2)
+
+	for i := 0; i < 3; i++ {
+		if err := c.Authorize(Request{Action: ActionDownload, Hash: "allowed"}); err != nil {
+			t.Errorf("expected the request to be allowed, got %v", err)
+		}
+		if err := c.Authorize(Request{Action: ActionDownload, Hash: "denied"}); !errors.Is(err, ErrForbidden) {
+			t.Errorf("expected the request to be forbidden, got %v", err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected each decision to be made once, got %d calls", calls)
+	}
+
+	// errors aren't remembered, and neither is anything once the cache is full
+	_ = c.Authorize(Request{Action: ActionDownload, Hash: "broken"})
+	_ = c.Authorize(Request{Action: ActionDownload, Hash: "broken"})
+	_ = c.Authorize(Request{Action: ActionUpload, Hash: "allowed"})
+	_ = c.Authorize(Request{Action: ActionUpload, Hash: "allowed"})
+	if calls != 6 {
+		t.Errorf("expected 6 calls, got %d", calls)
+	}
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"sync"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Cache remembers the decisions of an authorizer by action and hash, so asking again about the same blob doesn't ask
+// the authorizer again. It ignores every other field of the request, so it's only safe for requests that differ in
+// nothing else, like the ones from a single peer connection. Errors other than ErrForbidden aren't remembered.
+type Cache struct {
+	a    Authorizer
+	size int
+
+	mu        sync.Mutex
+	decisions map[cacheKey]error
+}
+
+type cacheKey struct {
+	action Action
+	hash   string
+}
+
+// NewCache returns a cache of at most size decisions of a. Once it's full, new requests go straight to a
+func NewCache(a Authorizer, size int) *Cache {
+	return &Cache{a: a, size: size, decisions: make(map[cacheKey]error)}
+}
+
+func (c *Cache) Authorize(r Request) error {
+	key := cacheKey{action: r.Action, hash: r.Hash}
+	c.mu.Lock()
+	err, ok := c.decisions[key]
+	c.mu.Unlock()
+	if ok {
+		return err
+	}
+
+	err = c.a.Authorize(r)
+	if err == nil || errors.Is(err, ErrForbidden) {
+		c.mu.Lock()
+		if len(c.decisions) < c.size {
+			c.decisions[key] = err
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
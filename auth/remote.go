@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Remote asks an external http service whether to allow each request. The request is POSTed to the url as json. A
+// 2xx status allows it, 401 or 403 denies it, and anything else is an error, which denies it too.
+type Remote struct {
+	url    string
+	client *http.Client
+}
+
+// NewRemote returns an authorizer that asks the service at url, waiting at most timeout for an answer
+func NewRemote(url string, timeout time.Duration) *Remote {
+	return &Remote{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func (a *Remote) Authorize(r Request) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return errors.Err(err)
+	}
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Prefix("authorizer", err)
+	}
+	defer resp.Body.Close()
+	reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		if len(reason) > 0 {
+			return errors.Prefix(string(bytes.TrimSpace(reason)), ErrForbidden)
+		}
+		return errors.Err(ErrForbidden)
+	default:
+		return errors.Err("authorizer returned %s", resp.Status)
+	}
+}
@@ -0,0 +1,106 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxRequestAge is how old a signed request between members may be, so a request that was seen can't be sent again
+// much later
+const MaxRequestAge = time.Minute
+
+// maxSignedBody is the largest request body that is signed. A replicate request lists at most a queue's worth of
+// hashes, which is well below it
+const maxSignedBody = 32 << 20
+
+// SignRequest signs a request to another member in store.RoutedHeader, with the key the gossip is encrypted with. The
+// signature covers the body, which is read and put back. Requests are not signed if the cluster has no keyring
+func (c *Cluster) SignRequest(req *http.Request) {
+	if c.keyring == nil {
+		return
+	}
+	body, err := bodyHash(req)
+	if err != nil {
+		log.Warnf("not signing request to %s: %s", req.URL.Host, err.Error())
+		return
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(store.RoutedHeader, ts+"."+requestSignature(c.keyring.GetPrimaryKey(), req, ts, body))
+}
+
+// VerifyRequest returns true if a request was signed by a member. Members that are switching to a new key may sign
+// with any key in the keyring
+func (c *Cluster) VerifyRequest(req *http.Request) bool {
+	if c.keyring == nil {
+		return false
+	}
+	parts := strings.SplitN(req.Header.Get(store.RoutedHeader), ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	unix, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(unix, 0))
+	if age > MaxRequestAge || age < -MaxRequestAge {
+		return false
+	}
+	given, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	body, err := bodyHash(req)
+	if err != nil {
+		return false
+	}
+	for _, key := range c.keyring.GetKeys() {
+		expected, _ := hex.DecodeString(requestSignature(key, req, parts[0], body))
+		if hmac.Equal(given, expected) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestSignature is the hex HMAC of the method, the uri, the time and the hex sha256 of the body of a request. The
+// HMAC key is derived from the gossip key, so the gossip key itself is only used for the gossip
+func requestSignature(gossipKey []byte, req *http.Request, ts, bodyHash string) string {
+	derive := hmac.New(sha256.New, gossipKey)
+	derive.Write([]byte("reflector member request"))
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write([]byte(req.Method + "\n" + req.URL.RequestURI() + "\n" + ts + "\n" + bodyHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bodyHash returns the hex sha256 of the body of a request, and puts the body back so it can be read again. A request
+// without a body hashes like an empty body
+func bodyHash(req *http.Request) (string, error) {
+	h := sha256.New()
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxSignedBody+1))
+		req.Body.Close()
+		if err != nil {
+			return "", errors.Err(err)
+		}
+		if len(body) > maxSignedBody {
+			return "", errors.Err("request body is larger than %d bytes", maxSignedBody)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		h.Write(body)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,88 @@
+package cluster
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/store"
+)
+
+func keyedMember(t *testing.T, keys ...string) *Cluster {
+	keyring, err := loadKeyring(testKeyring(t, keys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Cluster{keyring: keyring}
+}
+
+func TestCluster_SignRequest(t *testing.T) {
+	key, _ := GenerateKey()
+	next, _ := GenerateKey()
+	sender := keyedMember(t, key)
+	receiver := keyedMember(t, key)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://10.0.0.1:5569/blob?hash=abcd", nil)
+	sender.SignRequest(req)
+	if !receiver.VerifyRequest(req) {
+		t.Error("expected a signed request to be verified")
+	}
+
+	// the signature only fits the request it was made for
+	other, _ := http.NewRequest(http.MethodGet, "http://10.0.0.1:5569/blob?hash=ef01", nil)
+	other.Header.Set(store.RoutedHeader, req.Header.Get(store.RoutedHeader))
+	if receiver.VerifyRequest(other) {
+		t.Error("expected the signature of another request not to be verified")
+	}
+
+	// clients can't pass for a member
+	for _, header := range []string{"", "1", strconv.FormatInt(time.Now().Unix(), 10) + ".00"} {
+		req.Header.Set(store.RoutedHeader, header)
+		if receiver.VerifyRequest(req) {
+			t.Errorf("expected header %q not to be verified", header)
+		}
+	}
+	if keyedMember(t, next).VerifyRequest(signed(sender)) {
+		t.Error("expected a member with another key not to verify the request")
+	}
+	if (&Cluster{}).VerifyRequest(signed(sender)) {
+		t.Error("expected a member without a keyring not to verify the request")
+	}
+
+	// while the key is rotated, members that use the new key are verified by the ones that only installed it
+	if !keyedMember(t, key, next).VerifyRequest(signed(keyedMember(t, next, key))) {
+		t.Error("expected a request signed with an installed key to be verified")
+	}
+
+	// old requests can't be sent again
+	req = signed(sender)
+	ts := strconv.FormatInt(time.Now().Add(-2*MaxRequestAge).Unix(), 10)
+	body, _ := bodyHash(req)
+	req.Header.Set(store.RoutedHeader, ts+"."+requestSignature(sender.keyring.GetPrimaryKey(), req, ts, body))
+	if receiver.VerifyRequest(req) {
+		t.Error("expected an old request not to be verified")
+	}
+
+	// the signature covers the body, which can still be read after signing and verifying
+	req = signed(sender)
+	if !receiver.VerifyRequest(req) {
+		t.Error("expected a signed request with a body to be verified")
+	}
+	if body, _ := io.ReadAll(req.Body); string(body) != `["abcd"]` {
+		t.Errorf("expected the body to be readable after verifying, got %q", body)
+	}
+	tampered := signed(sender)
+	tampered.Body = io.NopCloser(strings.NewReader(`["ef01"]`))
+	if receiver.VerifyRequest(tampered) {
+		t.Error("expected a request with another body not to be verified")
+	}
+}
+
+func signed(c *Cluster) *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, "http://10.0.0.1:5569"+ReplicatePath, strings.NewReader(`["abcd"]`))
+	c.SignRequest(req)
+	return req
+}
@@ -4,12 +4,16 @@ import (
 	"io/ioutil"
 	baselog "log"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/lbryio/lbry.go/v2/extras/crypto"
 	"github.com/lbryio/lbry.go/v2/extras/errors"
 	"github.com/lbryio/lbry.go/v2/extras/stop"
 
+	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/serf/serf"
 	log "github.com/sirupsen/logrus"
 )
@@ -17,17 +21,55 @@ import (
 const (
 	DefaultPort                  = 17946
 	MembershipChangeBufferWindow = 1 * time.Second
+
+	// TagHTTPAddr is the tag with the address of a member's http blob server. Only cache members with it are in the
+	// ring
+	TagHTTPAddr = "http_addr"
+	// TagRegion is the tag with the region of a member. Each region has its own ring
+	TagRegion = "region"
 )
 
 // Cluster maintains cluster membership and notifies on certain events
 type Cluster struct {
 	OnMembershipChange func(n, total int)
 
+	// Tags are gossiped to the other members. Set them before calling Connect
+	Tags map[string]string
+
+	// KeyringFile is a json list of base64 encoded keys to encrypt the gossip with. Members without the keys can't
+	// join. Key changes are saved to it. Gossip is not encrypted if it's empty. Set it before calling Connect
+	KeyringFile string
+
+	// Region is the region of this member, gossiped in TagRegion. Blobs are partitioned between the members of the
+	// same region. Set it before calling Connect
+	Region string
+
+	// Roles are the roles of this member, gossiped in TagRoles. All roles if empty. Set them before calling Connect
+	Roles []string
+	// Capacity is how much work this member takes compared to the others, gossiped in TagCapacity. 1 if 0
+	Capacity int
+
+	// OnAnnounceShareChange is called with this member's share of the hashes to announce after members join or leave.
+	// The share is empty if this member isn't an announcer
+	OnAnnounceShareChange func(share Share)
+
+	// How many members hold each blob. Defaults to 1
+	Replicas int
+
+	// OnRingChange is called with the old and the new hash ring after members join or leave
+	OnRingChange func(previous, current *Ring)
+
 	name     string
 	port     int
 	seedAddr string
 
+	ringMu sync.RWMutex
+	ring   *Ring
+	// the rings of all regions, this one's included
+	rings map[string]*Ring
+
 	s       *serf.Serf
+	keyring *memberlist.Keyring // the gossip keys, which also sign the requests between members
 	eventCh chan serf.Event
 	stop    *stop.Group
 }
@@ -38,6 +80,7 @@ func New(port int, seedAddr string) *Cluster {
 		name:     crypto.RandString(12),
 		port:     port,
 		seedAddr: seedAddr,
+		ring:     NewRing(DefaultVirtualNodes),
 		stop:     stop.New(),
 	}
 }
@@ -51,6 +94,15 @@ func (c *Cluster) Connect() error {
 	conf.MemberlistConfig.BindPort = c.port
 	conf.MemberlistConfig.AdvertisePort = c.port
 	conf.NodeName = c.name
+	conf.Tags = c.tags()
+	if c.KeyringFile != "" {
+		conf.MemberlistConfig.Keyring, err = loadKeyring(c.KeyringFile)
+		if err != nil {
+			return err
+		}
+		conf.KeyringFile = c.KeyringFile
+		c.keyring = conf.MemberlistConfig.Keyring
+	}
 
 	nullLogger := baselog.New(ioutil.Discard, "", 0)
 	conf.Logger = nullLogger
@@ -66,10 +118,13 @@ func (c *Cluster) Connect() error {
 	if c.seedAddr != "" {
 		_, err = c.s.Join([]string{c.seedAddr}, true)
 		if err != nil {
+			_ = c.s.Shutdown()
 			return err
 		}
 	}
 
+	c.updateRing()
+
 	c.stop.Add(1)
 	go func() {
 		c.listen()
@@ -101,7 +156,7 @@ func (c *Cluster) listen() {
 			return
 		case event := <-c.eventCh:
 			switch event.EventType() {
-			case serf.EventMemberJoin, serf.EventMemberFailed, serf.EventMemberLeave:
+			case serf.EventMemberJoin, serf.EventMemberFailed, serf.EventMemberLeave, serf.EventMemberUpdate:
 				//	// ignore event from my own joining of the cluster
 				//memberEvent := event.(serf.MemberEvent)
 				//if event.EventType() == serf.EventMemberJoin && len(memberEvent.Members) == 1 && memberEvent.Members[0].Name == c.name {
@@ -114,15 +169,127 @@ func (c *Cluster) listen() {
 				}
 			}
 		case <-timerCh:
+			c.updateRing()
 			if c.OnMembershipChange != nil {
 				alive := getAliveMembers(c.s.Members())
 				c.OnMembershipChange(getHashInterval(c.name, alive), len(alive))
 			}
+			if c.OnAnnounceShareChange != nil {
+				c.OnAnnounceShareChange(shareOf(c.name, RoleAnnouncer, c.Members()))
+			}
 			timerCh = nil
 		}
 	}
 }
 
+// Name returns the name of this member
+func (c *Cluster) Name() string {
+	return c.name
+}
+
+// Members returns the live members, this one included
+func (c *Cluster) Members() []Member {
+	var members []Member
+	for _, m := range getAliveMembers(c.s.Members()) {
+		members = append(members, memberFromSerf(m))
+	}
+	return members
+}
+
+// tags are the Tags, with the roles and capacity
+func (c *Cluster) tags() map[string]string {
+	tags := make(map[string]string, len(c.Tags)+2)
+	for k, v := range c.Tags {
+		tags[k] = v
+	}
+	if len(c.Roles) > 0 {
+		tags[TagRoles] = strings.Join(c.Roles, ",")
+	}
+	if c.Capacity > 0 {
+		tags[TagCapacity] = strconv.Itoa(c.Capacity)
+	}
+	if c.Region != "" {
+		tags[TagRegion] = c.Region
+	}
+	return tags
+}
+
+// Ring returns the hash ring of the members of this region that serve blobs
+func (c *Cluster) Ring() *Ring {
+	c.ringMu.RLock()
+	defer c.ringMu.RUnlock()
+	return c.ring
+}
+
+func (c *Cluster) replicas() int {
+	if c.Replicas < 1 {
+		return 1
+	}
+	return c.Replicas
+}
+
+// BlobOwners returns the http addresses of the other members that hold a blob, and whether this member holds it.
+// If no member serves blobs, this member holds all of them
+func (c *Cluster) BlobOwners(hash string) ([]string, bool) {
+	owners := c.Ring().Owners(hash, c.replicas())
+	if len(owners) == 0 {
+		return nil, true
+	}
+	local := false
+	addrs := make([]string, 0, len(owners))
+	for _, o := range owners {
+		if o.Name == c.name {
+			local = true
+		} else {
+			addrs = append(addrs, o.Addr)
+		}
+	}
+	return addrs, local
+}
+
+func (c *Cluster) updateRing() {
+	nodes := make(map[string][]Node)
+	for _, m := range getAliveMembers(c.s.Members()) {
+		if addr := m.Tags[TagHTTPAddr]; addr != "" && memberFromSerf(m).HasRole(RoleCache) {
+			region := m.Tags[TagRegion]
+			nodes[region] = append(nodes[region], Node{Name: m.Name, Addr: addr, Region: region})
+		}
+	}
+	rings := make(map[string]*Ring, len(nodes))
+	for region, n := range nodes {
+		rings[region] = NewRing(DefaultVirtualNodes)
+		rings[region].Set(n)
+	}
+	ring, ok := rings[c.Region]
+	if !ok {
+		ring = NewRing(DefaultVirtualNodes)
+	}
+	log.Debugf("cluster hash ring has %d members, %d regions", ring.Len(), len(rings))
+
+	c.ringMu.Lock()
+	previous := c.ring
+	c.ring = ring
+	c.rings = rings
+	c.ringMu.Unlock()
+
+	if c.OnRingChange != nil {
+		c.OnRingChange(previous, ring)
+	}
+}
+
+// RegionOwner returns the http address of the member of region that owns a blob. It returns false if no member of
+// the region serves blobs
+func (c *Cluster) RegionOwner(region, hash string) (string, bool) {
+	c.ringMu.RLock()
+	ring, ok := c.rings[region]
+	c.ringMu.RUnlock()
+	if !ok {
+		return "", false
+	}
+	owner, ok := ring.Owner(hash)
+	return owner.Addr, ok
+}
+
 func getHashInterval(myName string, members []serf.Member) int {
 	var names []string
 	for _, m := range members {
@@ -0,0 +1,186 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/lbryio/reflector.go/auth"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+	log "github.com/sirupsen/logrus"
+)
+
+// KeysPath is where the KeysHandler is served. Installing, using and removing a key are below it
+const KeysPath = "/cluster/keys"
+
+// GenerateKey returns a new random gossip encryption key, base64 encoded like the keys in a keyring file
+func GenerateKey() (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", errors.Err(err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// loadKeyring reads a keyring file: a json list of base64 encoded keys, the first of which encrypts the gossip. The
+// other keys are only used to decrypt, so members can switch to a new key one by one
+func loadKeyring(path string) (*memberlist.Keyring, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Prefix("reading the cluster keyring", err)
+	}
+	var encoded []string
+	err = json.Unmarshal(raw, &encoded)
+	if err != nil {
+		return nil, errors.Prefix("cluster keyring "+path+" is not a json list of keys", err)
+	}
+	if len(encoded) == 0 {
+		return nil, errors.Err("cluster keyring %s has no keys", path)
+	}
+	keys := make([][]byte, len(encoded))
+	for i, k := range encoded {
+		keys[i], err = base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, errors.Prefix("cluster keyring "+path, err)
+		}
+	}
+	keyring, err := memberlist.NewKeyring(keys, keys[0])
+	if err != nil {
+		return nil, errors.Prefix("cluster keyring "+path, err)
+	}
+	return keyring, nil
+}
+
+// KeyStatus is how many members have each key installed, and as their primary key
+type KeyStatus struct {
+	Members     int               `json:"members"`
+	Keys        map[string]int    `json:"keys"`
+	PrimaryKeys map[string]int    `json:"primary_keys"`
+	Errors      map[string]string `json:"errors,omitempty"`
+}
+
+// keyOp runs a key operation on all members. The status is returned even if some of them failed
+func (c *Cluster) keyOp(op func(km *serf.KeyManager) (*serf.KeyResponse, error)) (*KeyStatus, error) {
+	if !c.s.EncryptionEnabled() {
+		return nil, errors.Err("gossip encryption is not enabled, start the members with a keyring")
+	}
+	resp, err := op(c.s.KeyManager())
+	if resp == nil {
+		return nil, errors.Err(err)
+	}
+	status := &KeyStatus{Members: resp.NumNodes, Keys: resp.Keys, PrimaryKeys: resp.PrimaryKeys}
+	for name, msg := range resp.Messages {
+		if msg != "" {
+			if status.Errors == nil {
+				status.Errors = make(map[string]string)
+			}
+			status.Errors[name] = msg
+		}
+	}
+	return status, errors.Err(err)
+}
+
+// ListKeys returns the keys the members have installed
+func (c *Cluster) ListKeys() (*KeyStatus, error) {
+	return c.keyOp(func(km *serf.KeyManager) (*serf.KeyResponse, error) { return km.ListKeys() })
+}
+
+// InstallKey adds a key to the keyrings of all members, so they can decrypt gossip encrypted with it
+func (c *Cluster) InstallKey(key string) (*KeyStatus, error) {
+	return c.keyOp(func(km *serf.KeyManager) (*serf.KeyResponse, error) { return km.InstallKey(key) })
+}
+
+// UseKey makes an installed key the one all members encrypt gossip with
+func (c *Cluster) UseKey(key string) (*KeyStatus, error) {
+	return c.keyOp(func(km *serf.KeyManager) (*serf.KeyResponse, error) { return km.UseKey(key) })
+}
+
+// RemoveKey removes a key from the keyrings of all members. The primary key can't be removed
+func (c *Cluster) RemoveKey(key string) (*KeyStatus, error) {
+	return c.keyOp(func(km *serf.KeyManager) (*serf.KeyResponse, error) { return km.RemoveKey(key) })
+}
+
+// KeysHandler lets an operator rotate the gossip encryption key of a running cluster, to clients that send the token
+// as a bearer token. A rotation installs the new key, uses it, and removes the old one:
+//
+//	curl -H 'Authorization: Bearer TOKEN' localhost:2112/cluster/keys
+//	curl -H 'Authorization: Bearer TOKEN' -d key=NEWKEY localhost:2112/cluster/keys/install
+//	curl -H 'Authorization: Bearer TOKEN' -d key=NEWKEY localhost:2112/cluster/keys/use
+//	curl -H 'Authorization: Bearer TOKEN' -d key=OLDKEY localhost:2112/cluster/keys/remove
+//
+// Each change is sent to all members, and saved to their keyring files
+type KeysHandler struct {
+	cluster *Cluster
+	token   string
+}
+
+// NewKeysHandler returns a handler for the keys of c. Requests must carry token
+func NewKeysHandler(c *Cluster, token string) *KeysHandler {
+	return &KeysHandler{cluster: c, token: token}
+}
+
+func (h *KeysHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !auth.HasToken(r, h.token) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var status *KeyStatus
+	var err error
+	op := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, KeysPath), "/")
+	if op == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status, err = h.cluster.ListKeys()
+	} else {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		key := r.PostFormValue("key")
+		raw, decodeErr := base64.StdEncoding.DecodeString(key)
+		if key == "" || decodeErr != nil || memberlist.ValidateKey(raw) != nil {
+			http.Error(w, "key must be a base64 encoded 16, 24 or 32 byte key", http.StatusBadRequest)
+			return
+		}
+		switch op {
+		case "install":
+			status, err = h.cluster.InstallKey(key)
+		case "use":
+			status, err = h.cluster.UseKey(key)
+		case "remove":
+			status, err = h.cluster.RemoveKey(key)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	if err != nil {
+		log.Warnf("cluster keys %s: %s", op, err.Error())
+		if status == nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		// some members failed. the status says which
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		_ = json.NewEncoder(w).Encode(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
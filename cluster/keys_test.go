@@ -0,0 +1,106 @@
+package cluster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/phayes/freeport"
+)
+
+func testKeyring(t *testing.T, keys ...string) string {
+	raw, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	err = os.WriteFile(path, raw, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testMember(t *testing.T, seed, keyring string) (*Cluster, string, error) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(port, seed)
+	c.KeyringFile = keyring
+	return c, "127.0.0.1:" + strconv.Itoa(port), c.Connect()
+}
+
+func TestCluster_Keys(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, addr, err := testMember(t, "", testKeyring(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Shutdown()
+	second, _, err := testMember(t, addr, testKeyring(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Shutdown()
+
+	// members without the key can't join
+	other, _ := GenerateKey()
+	if _, _, err := testMember(t, addr, testKeyring(t, other)); err == nil {
+		t.Error("expected a member with another key not to be able to join")
+	}
+	if _, _, err := testMember(t, addr, ""); err == nil {
+		t.Error("expected a member without a key not to be able to join")
+	}
+
+	h := NewKeysHandler(first, "secret")
+	post := func(op, key string) int {
+		r := httptest.NewRequest(http.MethodPost, KeysPath+"/"+op, strings.NewReader(url.Values{"key": {key}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	newKey, _ := GenerateKey()
+	for _, step := range []struct{ op, key string }{{"install", newKey}, {"use", newKey}, {"remove", key}} {
+		if code := post(step.op, step.key); code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", step.op, code)
+		}
+	}
+	status, err := second.ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.PrimaryKeys[newKey] != 2 || len(status.Keys) != 1 {
+		t.Errorf("expected both members to have only the new key, got %+v", status)
+	}
+	// the rotation is saved, for the next start
+	keyring, err := loadKeyring(second.KeyringFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyring.GetKeys()) != 1 {
+		t.Errorf("expected the keyring file to have only the new key, got %d keys", len(keyring.GetKeys()))
+	}
+
+	if code := post("install", "not a key"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid key, got %d", code)
+	}
+	r := httptest.NewRequest(http.MethodGet, KeysPath, nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the token, got %d", w.Code)
+	}
+}
@@ -0,0 +1,184 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplicatePath is the http endpoint that takes a json list of blob hashes that the member should start holding
+const ReplicatePath = "/replicate"
+
+// how many hashes are sent in one replicate request
+const replicateBatchSize = 1000
+
+// Replicator keeps each blob on Replicas members when the membership changes. After a change, every member goes
+// through the blobs it holds. For each blob that gained owners, the first member that already held it tells the new
+// owners to fetch it. Blobs that were only on a member that died are fetched from the origin by their new owners
+// the first time they are requested.
+type Replicator struct {
+	cluster *Cluster
+	blobs   store.BlobStore
+	client  *http.Client
+	grp     *stop.Group
+	changes chan ringChange
+}
+
+type ringChange struct {
+	previous, current *Ring
+}
+
+// NewReplicator returns a replicator for the blobs in the store. The store must be able to list its blobs
+func NewReplicator(c *Cluster, blobs store.BlobStore) *Replicator {
+	return &Replicator{
+		cluster: c,
+		blobs:   blobs,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		grp:     stop.New(),
+		changes: make(chan ringChange, 1),
+	}
+}
+
+// RingChanged queues a replication pass. Use it as the cluster's OnRingChange
+func (r *Replicator) RingChanged(previous, current *Ring) {
+	change := ringChange{previous: previous, current: current}
+	for {
+		select {
+		case r.changes <- change:
+			return
+		case pending := <-r.changes:
+			// a pass hasn't started yet. compare against the ring from before both changes
+			change.previous = pending.previous
+		}
+	}
+}
+
+// Start runs replication passes in the background
+func (r *Replicator) Start() {
+	r.grp.Add(1)
+	go func() {
+		defer r.grp.Done()
+		for {
+			select {
+			case <-r.grp.Ch():
+				return
+			case change := <-r.changes:
+				err := r.replicate(change.previous, change.current)
+				if err != nil {
+					log.Errorf("replication failed: %s", errors.FullTrace(err))
+				}
+			}
+		}
+	}()
+}
+
+// Shutdown stops the current pass
+func (r *Replicator) Shutdown() {
+	r.grp.StopAndWait()
+}
+
+func (r *Replicator) replicate(previous, current *Ring) error {
+	if previous == nil || previous.Len() == 0 {
+		return nil // just joined, nothing to hand over
+	}
+	hashes, err := store.List(r.blobs)
+	if err != nil {
+		return err
+	}
+
+	replicas := r.cluster.replicas()
+	batches := make(map[string][]string) // addr -> hashes
+	for _, hash := range hashes {
+		before := previous.Owners(hash, replicas)
+		after := current.Owners(hash, replicas)
+		if !r.isSender(before, after) {
+			continue
+		}
+		for _, n := range after {
+			if !containsNode(before, n.Name) {
+				batches[n.Addr] = append(batches[n.Addr], hash)
+			}
+		}
+	}
+
+	pending := 0
+	for _, b := range batches {
+		pending += len(b)
+	}
+	metrics.ClusterReplicationPending.Set(float64(pending))
+	log.Infof("handing %d blobs to new replicas on %d members", pending, len(batches))
+
+	for addr, batch := range batches {
+		for i := 0; i < len(batch); i += replicateBatchSize {
+			select {
+			case <-r.grp.Ch():
+				return nil
+			default:
+			}
+			j := i + replicateBatchSize
+			if j > len(batch) {
+				j = len(batch)
+			}
+			err := r.send(addr, batch[i:j])
+			if err != nil {
+				metrics.ClusterReplicationErrorCount.Inc()
+				log.Warnf("asking %s to replicate blobs failed: %s", addr, err.Error())
+			} else {
+				metrics.ClusterReplicatedCount.Add(float64(j - i))
+			}
+			metrics.ClusterReplicationPending.Sub(float64(j - i))
+		}
+	}
+	return nil
+}
+
+// isSender returns true if this member is the first one that held the blob before the change and still holds it
+func (r *Replicator) isSender(before, after []Node) bool {
+	for _, n := range after {
+		if containsNode(before, n.Name) {
+			return n.Name == r.cluster.name
+		}
+	}
+	return false
+}
+
+func (r *Replicator) send(addr string, hashes []string) error {
+	body, err := json.Marshal(hashes)
+	if err != nil {
+		return errors.Err(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+ReplicatePath, bytes.NewReader(body))
+	if err != nil {
+		return errors.Err(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	r.cluster.SignRequest(req)
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		return errors.Err("replicate request failed with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func containsNode(nodes []Node, name string) bool {
+	for _, n := range nodes {
+		if n.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,20 @@
+package cluster
+
+import "testing"
+
+func TestReplicator_IsSender(t *testing.T) {
+	nodes := testNodes(4)
+	r := &Replicator{cluster: &Cluster{name: "node1"}}
+
+	// node0 died. node1 held the blob before and still does, so it hands the blob to node3
+	before := []Node{nodes[0], nodes[1]}
+	after := []Node{nodes[1], nodes[3]}
+	if !r.isSender(before, after) {
+		t.Error("node1 should hand the blob to the new replica")
+	}
+
+	r.cluster.name = "node3"
+	if r.isSender(before, after) {
+		t.Error("node3 is the new replica, it should not send")
+	}
+}
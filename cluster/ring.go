@@ -0,0 +1,122 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultVirtualNodes is how many points each member gets on the ring. More points spread blobs more evenly
+const DefaultVirtualNodes = 128
+
+// Node is a member of the hash ring
+type Node struct {
+	Name string
+	// Address of the node's http blob server
+	Addr string
+	// Region of the node. Empty if it didn't say
+	Region string
+}
+
+// Ring is a consistent hash ring. Each blob hash belongs to the first node found walking the ring clockwise from
+// the hash, so when a node joins or leaves only the blobs next to its points change owners. All members build the
+// same ring from the same member list, so they agree on the owners without talking to each other.
+type Ring struct {
+	vnodes int
+
+	mu      sync.RWMutex
+	points  []uint64
+	owners  map[uint64]Node
+	members []Node
+}
+
+// NewRing returns an empty ring
+func NewRing(vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	return &Ring{vnodes: vnodes, owners: make(map[uint64]Node)}
+}
+
+// Set replaces the members of the ring
+func (r *Ring) Set(nodes []Node) {
+	points := make([]uint64, 0, len(nodes)*r.vnodes)
+	owners := make(map[uint64]Node, len(nodes)*r.vnodes)
+	for _, n := range nodes {
+		for i := 0; i < r.vnodes; i++ {
+			p := ringPosition(n.Name + "#" + strconv.Itoa(i))
+			if existing, ok := owners[p]; ok && existing.Name < n.Name {
+				continue // collisions are resolved the same way on every member
+			}
+			if _, ok := owners[p]; !ok {
+				points = append(points, p)
+			}
+			owners[p] = n
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.points = points
+	r.owners = owners
+	r.members = append([]Node(nil), nodes...)
+}
+
+// Len returns the number of members in the ring
+func (r *Ring) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.members)
+}
+
+// Nodes returns the members of the ring
+func (r *Ring) Nodes() []Node {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Node(nil), r.members...)
+}
+
+// Owner returns the node a blob belongs to. It returns false if the ring is empty
+func (r *Ring) Owner(hash string) (Node, bool) {
+	owners := r.Owners(hash, 1)
+	if len(owners) == 0 {
+		return Node{}, false
+	}
+	return owners[0], true
+}
+
+// Owners returns up to n different nodes for a blob, in order of preference
+func (r *Ring) Owners(hash string, n int) []Node {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(r.members) {
+		n = len(r.members)
+	}
+
+	p := ringPosition(hash)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= p })
+
+	owners := make([]Node, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		node := r.owners[r.points[(start+i)%len(r.points)]]
+		if seen[node.Name] {
+			continue
+		}
+		seen[node.Name] = true
+		owners = append(owners, node)
+	}
+	return owners
+}
+
+func ringPosition(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,69 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+)
+
+func testNodes(n int) []Node {
+	nodes := make([]Node, n)
+	for i := range nodes {
+		nodes[i] = Node{Name: "node" + strconv.Itoa(i), Addr: "10.0.0." + strconv.Itoa(i) + ":5569"}
+	}
+	return nodes
+}
+
+func TestRing_Owner(t *testing.T) {
+	r := NewRing(DefaultVirtualNodes)
+	if _, ok := r.Owner("abc"); ok {
+		t.Fatal("empty ring should not have owners")
+	}
+
+	r.Set(testNodes(4))
+	counts := make(map[string]int)
+	owners := make(map[string]string)
+	for i := 0; i < 10000; i++ {
+		hash := strconv.Itoa(i)
+		owner, ok := r.Owner(hash)
+		if !ok {
+			t.Fatal("expected an owner")
+		}
+		counts[owner.Name]++
+		owners[hash] = owner.Name
+	}
+	for name, c := range counts {
+		if c < 1500 || c > 3500 {
+			t.Errorf("%s owns %d of 10000 blobs, the ring is unbalanced", name, c)
+		}
+	}
+
+	// removing a node only moves the blobs it owned
+	r.Set(testNodes(3))
+	for hash, before := range owners {
+		after, _ := r.Owner(hash)
+		if before != "node3" && after.Name != before {
+			t.Fatalf("blob %s moved from %s to %s", hash, before, after.Name)
+		}
+	}
+}
+
+func TestRing_Owners(t *testing.T) {
+	r := NewRing(DefaultVirtualNodes)
+	r.Set(testNodes(3))
+
+	owners := r.Owners("abc", 5)
+	if len(owners) != 3 {
+		t.Fatalf("expected 3 owners, got %d", len(owners))
+	}
+	seen := make(map[string]bool)
+	for _, o := range owners {
+		if seen[o.Name] {
+			t.Errorf("%s is listed twice", o.Name)
+		}
+		seen[o.Name] = true
+	}
+	first, _ := r.Owner("abc")
+	if owners[0] != first {
+		t.Errorf("the first owner should be the owner, got %v and %v", owners[0], first)
+	}
+}
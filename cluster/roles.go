@@ -0,0 +1,134 @@
+package cluster
+
+import (
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// Roles a member can have
+const (
+	// RoleCache members hold a part of the blobs. Only they are in the hash ring
+	RoleCache = "cache"
+	// RoleOrigin members have all the blobs, in the db and the origin store
+	RoleOrigin = "origin"
+	// RoleAnnouncer members announce a part of the hashes in the dht
+	RoleAnnouncer = "announcer"
+)
+
+// AllRoles are the roles of members that don't say which ones they have
+var AllRoles = []string{RoleCache, RoleOrigin, RoleAnnouncer}
+
+const (
+	// TagRoles is the tag with the comma separated roles of a member. Members without it have all roles
+	TagRoles = "roles"
+	// TagCapacity is the tag with how much work a member takes compared to the others. Members without it take 1
+	TagCapacity = "capacity"
+)
+
+// ParseRoles parses a comma separated list of roles
+func ParseRoles(list string) ([]string, error) {
+	var roles []string
+	for _, r := range strings.Split(list, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		if r != RoleCache && r != RoleOrigin && r != RoleAnnouncer {
+			return nil, errors.Err("unknown cluster role '%s'", r)
+		}
+		roles = append(roles, r)
+	}
+	return roles, nil
+}
+
+// Member is a live member of the cluster
+type Member struct {
+	Name     string   `json:"name"`
+	Region   string   `json:"region,omitempty"`
+	Roles    []string `json:"roles"`
+	Capacity int      `json:"capacity"`
+}
+
+// HasRole returns whether the member has the role
+func (m Member) HasRole(role string) bool {
+	for _, r := range m.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func memberFromSerf(m serf.Member) Member {
+	member := Member{Name: m.Name, Region: m.Tags[TagRegion], Roles: AllRoles, Capacity: 1}
+	if tag, ok := m.Tags[TagRoles]; ok {
+		// an unknown role from a newer member is no reason to ignore the ones we know
+		member.Roles = nil
+		for _, r := range strings.Split(tag, ",") {
+			if r != "" {
+				member.Roles = append(member.Roles, r)
+			}
+		}
+	}
+	if c, err := strconv.Atoi(m.Tags[TagCapacity]); err == nil && c > 0 {
+		member.Capacity = c
+	}
+	return member
+}
+
+// Share is the part of the work a member takes: Size out of Total, starting at Offset. The members that have a role
+// split the work for it in the order of their names, each taking as much as its capacity
+type Share struct {
+	Offset int
+	Size   int
+	Total  int
+}
+
+// None returns whether the share is empty, because the member doesn't have the role
+func (s Share) None() bool {
+	return s.Size == 0 || s.Total == 0
+}
+
+// Of returns the member's part of the range r. The last member's part ends where r ends
+func (s Share) Of(r bits.Range) bits.Range {
+	start, end := r.Start.Big(), r.End.Big()
+	size := new(big.Int).Sub(end, start)
+	size.Add(size, big.NewInt(1))
+
+	at := func(units int) *big.Int {
+		n := new(big.Int).Mul(size, big.NewInt(int64(units)))
+		n.Div(n, big.NewInt(int64(s.Total)))
+		return n.Add(n, start)
+	}
+	partEnd := at(s.Offset + s.Size)
+	partEnd.Sub(partEnd, big.NewInt(1))
+	return bits.Range{Start: bits.FromBigP(at(s.Offset)), End: bits.FromBigP(partEnd)}
+}
+
+// shareOf returns the share of the member name among the members with the role
+func shareOf(name, role string, members []Member) Share {
+	var with []Member
+	for _, m := range members {
+		if m.HasRole(role) {
+			with = append(with, m)
+		}
+	}
+	sort.Slice(with, func(i, j int) bool { return with[i].Name < with[j].Name })
+
+	var share Share
+	for _, m := range with {
+		if m.Name == name {
+			share.Offset = share.Total
+			share.Size = m.Capacity
+		}
+		share.Total += m.Capacity
+	}
+	return share
+}
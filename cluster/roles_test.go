@@ -0,0 +1,72 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestShareOf(t *testing.T) {
+	members := []Member{
+		memberFromSerf(serf.Member{Name: "c", Tags: map[string]string{TagCapacity: "2"}}),
+		memberFromSerf(serf.Member{Name: "a", Tags: map[string]string{TagRoles: RoleAnnouncer}}),
+		memberFromSerf(serf.Member{Name: "b", Tags: map[string]string{TagRoles: RoleCache + "," + RoleOrigin}}),
+		memberFromSerf(serf.Member{Name: "d", Tags: map[string]string{TagRoles: RoleAnnouncer, TagCapacity: "1"}}),
+	}
+
+	expected := map[string]Share{
+		"a": {Offset: 0, Size: 1, Total: 4},
+		"b": {Offset: 0, Size: 0, Total: 4},
+		"c": {Offset: 1, Size: 2, Total: 4},
+		"d": {Offset: 3, Size: 1, Total: 4},
+	}
+	for name, want := range expected {
+		if got := shareOf(name, RoleAnnouncer, members); got != want {
+			t.Errorf("%s: expected share %+v, got %+v", name, want, got)
+		}
+	}
+	if !shareOf("b", RoleAnnouncer, members).None() {
+		t.Error("expected no share for a member that isn't an announcer")
+	}
+}
+
+func TestShare_Of(t *testing.T) {
+	full := bits.MaxRange()
+	shares := []Share{{0, 1, 4}, {1, 2, 4}, {3, 1, 4}}
+
+	var previous *bits.Range
+	for _, s := range shares {
+		r := s.Of(full)
+		if previous == nil {
+			if r.Start != full.Start {
+				t.Errorf("expected the first share to start at the start of the range, got %s", r.Start.Hex())
+			}
+		} else if r.Start.Sub(previous.End) != bits.FromShortHexP("1") {
+			t.Errorf("expected %+v to start right after the previous share", s)
+		}
+		previous = &r
+	}
+	if previous.End != full.End {
+		t.Errorf("expected the last share to end at the end of the range, got %s", previous.End.Hex())
+	}
+
+	half := Share{Offset: 1, Size: 2, Total: 4}.Of(full)
+	if half.Start.Hex()[:2] != "40" || half.End.Hex()[:2] != "bf" {
+		t.Errorf("expected the middle half, got %s to %s", half.Start.HexShort(), half.End.HexShort())
+	}
+}
+
+func TestParseRoles(t *testing.T) {
+	roles, err := ParseRoles("cache, announcer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 2 || roles[0] != RoleCache || roles[1] != RoleAnnouncer {
+		t.Errorf("unexpected roles %v", roles)
+	}
+	if _, err := ParseRoles("cache,seeder"); err == nil {
+		t.Error("expected an error for an unknown role")
+	}
+}
@@ -0,0 +1,262 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/bloom"
+	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/shared"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SiblingsPath is the prefix of the http endpoints that members use to share their caches
+	SiblingsPath = "/cluster/"
+
+	summaryPath     = SiblingsPath + "summary"
+	siblingBlobPath = SiblingsPath + "blob"
+
+	// false positive rate of the cache summaries. a false positive costs one request to a sibling
+	summaryFalsePositiveRate = 0.01
+)
+
+// Siblings lets members serve each other's cache misses. Every interval, each member builds a Bloom filter of the
+// blobs in its caches and downloads the filters of the other members. On a miss, the members whose filter has the
+// blob are asked for it over the LAN before the origin is. The requests are signed like the other requests between
+// members, and unsigned ones are refused, so clients can't skip the download checks or read the summaries.
+type Siblings struct {
+	// Caches are the local caches to share. Only their blobs are served to siblings, never blobs from the origin
+	Caches []store.BlobStore
+
+	cluster  *Cluster
+	interval time.Duration
+	client   *http.Client
+	grp      *stop.Group
+
+	mu        sync.RWMutex
+	summary   []byte
+	summaries map[string]*siblingSummary // member name -> summary
+}
+
+type siblingSummary struct {
+	addr   string
+	filter *bloom.Filter
+}
+
+// NewSiblings returns a Siblings that exchanges summaries every interval
+func NewSiblings(c *Cluster, interval time.Duration) *Siblings {
+	return &Siblings{
+		cluster:   c,
+		interval:  interval,
+		client:    &http.Client{Timeout: 5 * time.Second},
+		grp:       stop.New(),
+		summaries: make(map[string]*siblingSummary),
+	}
+}
+
+// Start exchanges summaries in the background
+func (s *Siblings) Start() {
+	s.grp.Add(1)
+	go func() {
+		defer s.grp.Done()
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			s.exchange()
+			select {
+			case <-s.grp.Ch():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Shutdown stops exchanging summaries
+func (s *Siblings) Shutdown() {
+	s.grp.StopAndWait()
+}
+
+func (s *Siblings) exchange() {
+	err := s.buildSummary()
+	if err != nil {
+		log.Errorf("building cache summary failed: %s", errors.FullTrace(err))
+	}
+
+	summaries := make(map[string]*siblingSummary)
+	for _, n := range s.cluster.Ring().Nodes() {
+		if n.Name == s.cluster.Name() {
+			continue
+		}
+		filter, err := s.fetchSummary(n.Addr)
+		if err != nil {
+			log.Warnf("getting the cache summary of %s failed: %s", n.Addr, err.Error())
+			continue
+		}
+		summaries[n.Name] = &siblingSummary{addr: n.Addr, filter: filter}
+	}
+
+	s.mu.Lock()
+	s.summaries = summaries
+	s.mu.Unlock()
+}
+
+func (s *Siblings) buildSummary() error {
+	var hashes []string
+	for _, c := range s.Caches {
+		h, err := store.List(c)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, h...)
+	}
+
+	filter := bloom.New(len(hashes), summaryFalsePositiveRate)
+	for _, h := range hashes {
+		filter.Add(h)
+	}
+	data, err := filter.MarshalBinary()
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	s.mu.Lock()
+	s.summary = data
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Siblings) fetchSummary(addr string) (*bloom.Filter, error) {
+	res, err := s.request(addr, summaryPath)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Err("status %d", res.StatusCode)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	filter := &bloom.Filter{}
+	err = filter.UnmarshalBinary(data)
+	return filter, err
+}
+
+// request sends a signed GET request to the member at addr
+func (s *Siblings) request(addr, uri string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+uri, nil)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	s.cluster.SignRequest(req)
+	res, err := s.client.Do(req)
+	return res, errors.Err(err)
+}
+
+// ServeHTTP serves this member's summary and its cached blobs to the other members. Requests that no member signed
+// are forbidden
+func (s *Siblings) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.cluster.VerifyRequest(r) {
+		http.Error(w, "only cluster members may ask for this", http.StatusForbidden)
+		return
+	}
+	switch r.URL.Path {
+	case summaryPath:
+		s.mu.RLock()
+		summary := s.summary
+		s.mu.RUnlock()
+		if summary == nil {
+			http.Error(w, "summary is not ready yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(summary)
+	case siblingBlobPath:
+		hash := r.URL.Query().Get("hash")
+		for _, c := range s.Caches {
+			blob, _, err := c.Get(hash)
+			if err == nil {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				_, _ = w.Write(blob)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Store returns a store that asks siblings for blobs before asking the origin
+func (s *Siblings) Store(origin store.BlobStore) store.BlobStore {
+	return &siblingStore{BlobStore: origin, siblings: s}
+}
+
+func (s *Siblings) candidates(hash string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var addrs []string
+	for _, summary := range s.summaries {
+		if summary.filter.Test(hash) {
+			addrs = append(addrs, summary.addr)
+		}
+	}
+	return addrs
+}
+
+func (s *Siblings) get(addr, hash string) (stream.Blob, error) {
+	res, err := s.request(addr, siblingBlobPath+"?hash="+url.QueryEscape(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Err("status %d", res.StatusCode)
+	}
+	blob, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	// a sibling that sends other data than the blob is a miss, so it's never cached or served as the blob
+	if stream.Blob(blob).HashHex() != hash {
+		return nil, errors.Err("sibling sent the wrong blob")
+	}
+	return blob, nil
+}
+
+type siblingStore struct {
+	store.BlobStore
+	siblings *Siblings
+}
+
+const nameSiblings = "siblings"
+
+func (s *siblingStore) Name() string { return nameSiblings }
+
+// Get tries the siblings that probably have the blob, then the origin
+func (s *siblingStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
+	start := time.Now()
+	for _, addr := range s.siblings.candidates(hash) {
+		blob, err := s.siblings.get(addr, hash)
+		if err == nil {
+			metrics.ClusterSiblingHitCount.Inc()
+			return blob, shared.NewBlobTrace(time.Since(start), s.Name()), nil
+		}
+		metrics.ClusterSiblingMissCount.Inc()
+		log.Debugf("getting %s from sibling %s failed: %s", hash, addr, err.Error())
+	}
+	blob, trace, err := s.BlobStore.Get(hash)
+	return blob, trace.Stack(time.Since(start), s.Name()), err
+}
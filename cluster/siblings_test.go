@@ -0,0 +1,125 @@
+package cluster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/stream"
+)
+
+// keyedSiblings returns siblings of a new member that signs its requests with key
+func keyedSiblings(t *testing.T, key string) *Siblings {
+	c := New(0, "")
+	c.keyring = keyedMember(t, key).keyring
+	return NewSiblings(c, time.Minute)
+}
+
+// siblingServer serves the blobs of cache to the other members, and returns its address
+func siblingServer(t *testing.T, key string, cache store.BlobStore) string {
+	sibling := keyedSiblings(t, key)
+	sibling.Caches = []store.BlobStore{cache}
+	err := sibling.buildSummary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(sibling)
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// withSibling returns siblings of a member whose only sibling is at addr
+func withSibling(t *testing.T, key, addr string) *Siblings {
+	local := keyedSiblings(t, key)
+	local.cluster.Ring().Set([]Node{
+		{Name: local.cluster.Name()},
+		{Name: "sibling", Addr: addr},
+	})
+	local.exchange()
+	return local
+}
+
+func TestSiblings_ServeMissFromSibling(t *testing.T) {
+	key, _ := GenerateKey()
+	blob := stream.Blob("a blob that only the sibling has")
+
+	siblingCache := store.NewMemStore()
+	err := siblingCache.Put(blob.HashHex(), blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := withSibling(t, key, siblingServer(t, key, siblingCache))
+
+	s := local.Store(store.NewMemStore())
+	got, _, err := s.Get(blob.HashHex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(blob) {
+		t.Error("got the wrong blob from the sibling")
+	}
+
+	_, _, err = s.Get(stream.Blob("nobody has this").HashHex())
+	if err == nil {
+		t.Error("expected an error for a blob that neither the sibling nor the origin has")
+	}
+}
+
+func TestSiblings_RefuseUnsigned(t *testing.T) {
+	key, _ := GenerateKey()
+	other, _ := GenerateKey()
+	blob := stream.Blob("a blob that only members may get")
+	siblingCache := store.NewMemStore()
+	err := siblingCache.Put(blob.HashHex(), blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := siblingServer(t, key, siblingCache)
+
+	for _, uri := range []string{summaryPath, siblingBlobPath + "?hash=" + blob.HashHex()} {
+		res, err := http.Get("http://" + addr + uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("expected %d for an unsigned request to %s, got %d", http.StatusForbidden, uri, res.StatusCode)
+		}
+	}
+
+	// a member with another key gets no summary, so it doesn't ask the sibling at all
+	local := withSibling(t, other, addr)
+	if len(local.candidates(blob.HashHex())) != 0 {
+		t.Error("expected no summary from a sibling with another key")
+	}
+}
+
+func TestSiblings_WrongBlobIsAMiss(t *testing.T) {
+	key, _ := GenerateKey()
+	blob := stream.Blob("the blob that was asked for")
+
+	// the sibling has other data under the hash of the blob
+	siblingCache := store.NewMemStore()
+	err := siblingCache.Put(blob.HashHex(), []byte("something else"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := withSibling(t, key, siblingServer(t, key, siblingCache))
+
+	origin := store.NewMemStore()
+	err = origin.Put(blob.HashHex(), blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := local.Store(origin).Get(blob.HashHex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(blob) {
+		t.Error("expected the blob from the origin, not the data the sibling sent")
+	}
+}
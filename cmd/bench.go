@@ -0,0 +1,343 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/reflector"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/c2h5oh/datasize"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"go.uber.org/atomic"
+)
+
+var (
+	benchProtocol    string
+	benchUploadAddr  string
+	benchAuthToken   string
+	benchConcurrency int
+	benchDuration    time.Duration
+	benchRequests    int
+	benchPutRatio    float64
+	benchHitRatio    float64
+	benchBlobSizes   string
+	benchSeedBlobs   int
+	benchHashesFile  string
+	benchTimeout     time.Duration
+	benchMaxP99      time.Duration
+)
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "bench ADDRESS:PORT",
+		Short: "Load test a reflector with synthetic blob requests",
+		Long: `Gets blobs from the reflector at ADDRESS:PORT and uploads random blobs to its receiver from many workers at once,
+and prints the throughput and latency percentiles of each kind of request. Gets either ask for blobs the reflector has
+(uploaded by the bench, or listed in --hashes) or for random hashes it doesn't have, in the --hit-ratio.
+Exits with status 1 if any p99 latency is above --max-p99, so it can gate deploys.`,
+		Args: cobra.ExactArgs(1),
+		Run:  benchCmd,
+	}
+	cmd.Flags().StringVar(&benchProtocol, "protocol", "http", "Protocol to get the blobs with (tcp/http3/http)")
+	cmd.Flags().StringVar(&benchUploadAddr, "upload-addr", "", "host:port of the reflector receiver to upload blobs to. Needed for --put-ratio and --seed-blobs")
+	cmd.Flags().StringVar(&benchAuthToken, "auth-token", "", "Token for servers that authorize uploads")
+	cmd.Flags().IntVar(&benchConcurrency, "concurrency", 50, "How many workers send requests at once")
+	cmd.Flags().DurationVar(&benchDuration, "duration", time.Minute, "How long to run for")
+	cmd.Flags().IntVar(&benchRequests, "requests", 0, "Stop after this many requests, if it comes before --duration")
+	cmd.Flags().Float64Var(&benchPutRatio, "put-ratio", 0, "Share of the requests that are uploads, from 0 to 1")
+	cmd.Flags().Float64Var(&benchHitRatio, "hit-ratio", 0.9, "Share of the gets that ask for blobs the reflector has, from 0 to 1")
+	cmd.Flags().StringVar(&benchBlobSizes, "blob-sizes", "2MB", `Sizes of the uploaded blobs, with their weights, like "2MB:90,100KB:10"`)
+	cmd.Flags().IntVar(&benchSeedBlobs, "seed-blobs", 100, "How many blobs to upload before the bench, for the gets that hit. Needs --upload-addr")
+	cmd.Flags().StringVar(&benchHashesFile, "hashes", "", "File with a hash per line of blobs the reflector has, for the gets that hit")
+	cmd.Flags().DurationVar(&benchTimeout, "timeout", 30*time.Second, "Timeout of each get over tcp and http3")
+	cmd.Flags().DurationVar(&benchMaxP99, "max-p99", 0, "Fail if the p99 latency of any kind of request is above this. Disabled if 0")
+	rootCmd.AddCommand(cmd)
+}
+
+// Kinds of bench requests
+const (
+	benchGetHit  = "get hit"
+	benchGetMiss = "get miss"
+	benchPut     = "put"
+)
+
+// blobSize is a size of the uploaded blobs, and how often it's picked
+type blobSize struct {
+	size, weight int
+}
+
+// parseBlobSizes parses a comma separated list of SIZE[:WEIGHT]
+func parseBlobSizes(spec string) ([]blobSize, error) {
+	var sizes []blobSize
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		spec := strings.SplitN(part, ":", 2)
+		sizeSpec := spec[0]
+		var size datasize.ByteSize
+		err := size.UnmarshalText([]byte(sizeSpec))
+		if err != nil || size == 0 || size > stream.MaxBlobSize {
+			return nil, errors.Err("blob sizes must be from 1B to 2MB, not '%s'", sizeSpec)
+		}
+		weight := 1
+		if len(spec) == 2 {
+			weight, err = strconv.Atoi(spec[1])
+			if err != nil || weight < 1 {
+				return nil, errors.Err("blob size weights must be positive numbers, not '%s'", spec[1])
+			}
+		}
+		sizes = append(sizes, blobSize{size: int(size), weight: weight})
+	}
+	if len(sizes) == 0 {
+		return nil, errors.Err("no blob sizes")
+	}
+	return sizes, nil
+}
+
+// pickBlobSize returns one of the sizes, as often as its weight
+func pickBlobSize(sizes []blobSize, r *rand.Rand) int {
+	total := 0
+	for _, s := range sizes {
+		total += s.weight
+	}
+	n := r.Intn(total)
+	for _, s := range sizes {
+		if n < s.weight {
+			return s.size
+		}
+		n -= s.weight
+	}
+	return sizes[len(sizes)-1].size
+}
+
+// benchStats are the results of one kind of request
+type benchStats struct {
+	requests  int
+	errors    int
+	bytes     int64
+	latencies []time.Duration
+}
+
+// benchReport collects the results of the bench, and the hashes of the blobs the reflector has
+type benchReport struct {
+	mu     sync.Mutex
+	stats  map[string]*benchStats
+	hashes []string
+}
+
+func (r *benchReport) add(kind string, latency time.Duration, size int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.stats[kind]
+	if s == nil {
+		s = &benchStats{}
+		r.stats[kind] = s
+	}
+	s.requests++
+	// a miss is expected to be not found
+	if err != nil && !(kind == benchGetMiss && errors.Is(err, store.ErrBlobNotFound)) {
+		s.errors++
+		log.Debugf("bench %s: %s", kind, err)
+		return
+	}
+	s.bytes += int64(size)
+	s.latencies = append(s.latencies, latency)
+}
+
+func (r *benchReport) addHash(hash string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hashes = append(r.hashes, hash)
+}
+
+// randomHash returns one of the hashes of the blobs the reflector has, or "" if there are none
+func (r *benchReport) randomHash(rnd *rand.Rand) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	return r.hashes[rnd.Intn(len(r.hashes))]
+}
+
+// print prints the results, and returns false if a p99 latency is above max
+func (r *benchReport) print(elapsed time.Duration, max time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ok := true
+	for _, kind := range []string{benchGetHit, benchGetMiss, benchPut} {
+		s := r.stats[kind]
+		if s == nil {
+			continue
+		}
+		fmt.Printf("%-8s %d requests (%.1f/s), %d errors, %s (%s/s)\n", kind, s.requests,
+			float64(s.requests)/elapsed.Seconds(), s.errors, datasize.ByteSize(s.bytes).HR(),
+			datasize.ByteSize(float64(s.bytes)/elapsed.Seconds()).HR())
+		if len(s.latencies) == 0 {
+			continue
+		}
+		fmt.Printf("%-8s %s\n", "", latencySummary(s.latencies))
+		if max > 0 && percentile(s.latencies, 0.99) > max {
+			fmt.Printf("%-8s p99 is above %s\n", "", max)
+			ok = false
+		}
+	}
+	return ok
+}
+
+func benchCmd(cmd *cobra.Command, args []string) {
+	sizes, err := parseBlobSizes(benchBlobSizes)
+	checkErr(err)
+	if benchPutRatio < 0 || benchPutRatio > 1 || benchHitRatio < 0 || benchHitRatio > 1 {
+		log.Fatal("--put-ratio and --hit-ratio must be from 0 to 1")
+	}
+	if benchConcurrency < 1 {
+		log.Fatal("--concurrency must be at least 1")
+	}
+	if benchUploadAddr == "" {
+		if benchPutRatio > 0 {
+			log.Fatal("--upload-addr is needed to upload blobs")
+		}
+		benchSeedBlobs = 0
+	}
+
+	report := &benchReport{stats: make(map[string]*benchStats)}
+	if benchHashesFile != "" {
+		hashes, err := readHashes(benchHashesFile)
+		checkErr(err)
+		report.hashes = hashes
+	}
+	if benchSeedBlobs > 0 {
+		log.Infof("uploading %d blobs", benchSeedBlobs)
+		u := &benchUploader{}
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for i := 0; i < benchSeedBlobs; i++ {
+			hash, err := u.put(pickBlobSize(sizes, rnd), rnd)
+			checkErr(err)
+			report.addHash(hash)
+		}
+		u.close()
+	}
+	if benchHitRatio > 0 && len(report.hashes) == 0 && benchPutRatio == 0 {
+		log.Fatal("gets can't hit without --seed-blobs, --hashes or --put-ratio")
+	}
+
+	target := downloadStore(benchProtocol, args[0], benchTimeout, benchConcurrency)
+	requests := atomic.NewInt64(0)
+	deadline := time.Now().Add(benchDuration)
+	wg := &sync.WaitGroup{}
+	start := time.Now()
+	for i := 0; i < benchConcurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			u := &benchUploader{}
+			defer u.close()
+			for time.Now().Before(deadline) {
+				if benchRequests > 0 && requests.Inc() > int64(benchRequests) {
+					return
+				}
+				reqStart := time.Now()
+				if rnd.Float64() < benchPutRatio {
+					size := pickBlobSize(sizes, rnd)
+					hash, err := u.put(size, rnd)
+					report.add(benchPut, time.Since(reqStart), size, err)
+					if err == nil {
+						report.addHash(hash)
+					}
+					continue
+				}
+				kind, hash := benchGetHit, ""
+				if rnd.Float64() < benchHitRatio {
+					hash = report.randomHash(rnd)
+				}
+				if hash == "" {
+					kind, hash = benchGetMiss, randomBlobHash(rnd)
+				}
+				blob, _, err := target.Get(hash)
+				report.add(kind, time.Since(reqStart), len(blob), err)
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	target.Shutdown()
+
+	if !report.print(time.Since(start), benchMaxP99) {
+		os.Exit(1)
+	}
+}
+
+// benchUploader uploads random blobs over its own connection to the receiver, reconnecting after errors
+type benchUploader struct {
+	c *reflector.Client
+}
+
+func (u *benchUploader) put(size int, rnd *rand.Rand) (string, error) {
+	if u.c == nil {
+		c := &reflector.Client{AuthToken: benchAuthToken}
+		err := c.Connect(benchUploadAddr)
+		if err != nil {
+			return "", errors.Err(err)
+		}
+		u.c = c
+	}
+	blob := make(stream.Blob, size)
+	_, _ = rnd.Read(blob)
+	err := u.c.SendBlob(blob)
+	if err != nil {
+		u.close()
+		return "", err
+	}
+	return blob.HashHex(), nil
+}
+
+func (u *benchUploader) close() {
+	if u.c != nil {
+		_ = u.c.Close()
+		u.c = nil
+	}
+}
+
+// randomBlobHash returns a hash no blob has
+func randomBlobHash(rnd *rand.Rand) string {
+	hash := make([]byte, stream.BlobHashSize)
+	_, _ = rnd.Read(hash)
+	return hex.EncodeToString(hash)
+}
+
+// readHashes reads a file of a blob hash per line
+func readHashes(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer f.Close()
+	var hashes []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		hash := strings.TrimSpace(s.Text())
+		if hash == "" {
+			continue
+		}
+		if len(hash) != stream.BlobHashHexLength {
+			return nil, errors.Err("'%s' in %s is not a blob hash", hash, path)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, errors.Err(s.Err())
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
 	"strconv"
@@ -16,9 +17,9 @@ import (
 
 func init() {
 	var cmd = &cobra.Command{
-		Use:       "cluster [start|join]",
-		Short:     "Start(join) to or Start a new cluster",
-		ValidArgs: []string{"start", "join"},
+		Use:       "cluster [start|join|keygen]",
+		Short:     "Start(join) to or Start a new cluster, or print a new gossip encryption key",
+		ValidArgs: []string{"start", "join", "keygen"},
 		Args:      argFuncs(cobra.ExactArgs(1), cobra.OnlyValidArgs),
 		Run:       clusterCmd,
 	}
@@ -26,6 +27,13 @@ func init() {
 }
 
 func clusterCmd(cmd *cobra.Command, args []string) {
+	if args[0] == "keygen" {
+		key, err := cluster.GenerateKey()
+		checkErr(err)
+		fmt.Println(key)
+		return
+	}
+
 	port := 17946
 	var c *cluster.Cluster
 	if args[0] == "start" {
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"github.com/lbryio/reflector.go/db"
+	"github.com/lbryio/reflector.go/events"
+	"github.com/lbryio/reflector.go/store"
+	"github.com/lbryio/reflector.go/webhook"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "delete-stream SDHASH...",
+		Short: "Delete streams with the blobs no other stream has",
+		Long: `Deletes each stream from the db, with its sd blob and the content blobs that are not part of another stream.
+Blobs that other streams share are kept. Run refcounts first if the counts of shared blobs may be off.`,
+		Run:  deleteStreamCmd,
+		Args: cobra.MinimumNArgs(1),
+	}
+	rootCmd.AddCommand(cmd)
+}
+
+func deleteStreamCmd(cmd *cobra.Command, args []string) {
+	db := &db.SQL{
+		LogQueries: log.GetLevel() == log.DebugLevel,
+	}
+	err := db.Connect(globalConfig.DBConn)
+	checkErr(err)
+
+	st := store.NewDBBackedStore(newS3Store(globalConfig.BucketName), db, false)
+	webhooks := newWebhooks()
+	if webhooks != nil {
+		defer webhooks.Shutdown()
+	}
+	bus := newEventBus()
+	if bus != nil {
+		defer bus.Shutdown()
+	}
+	st.OnDelete = func(hash string) {
+		if webhooks != nil {
+			webhooks.Send(webhook.EventBlobDeleted, hash)
+		}
+		if bus != nil {
+			bus.Send(events.BlobDeleted, hash)
+		}
+	}
+
+	failed := false
+	for _, sdHash := range args {
+		deleted, err := st.DeleteStream(sdHash)
+		if err != nil {
+			log.Errorf("deleting stream %s: %s", sdHash, errors.FullTrace(err))
+			failed = true
+			continue
+		}
+		log.Printf("deleted %d blobs of stream %s", len(deleted), sdHash)
+	}
+	if failed {
+		log.Fatal("some streams were not deleted")
+	}
+}
@@ -8,8 +8,15 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/lbryio/reflector.go/internal/dhtguard"
+	"github.com/lbryio/reflector.go/internal/dhtnode"
+	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/internal/nodeid"
+	"github.com/lbryio/reflector.go/internal/routingtable"
+
 	"github.com/lbryio/lbry.go/v2/dht"
 	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -19,48 +26,114 @@ var dhtNodeID string
 var dhtPort int
 var dhtRPCPort int
 var dhtSeeds []string
+var dhtAdminPort int
+var dhtNodeIDFile string
+var dhtNodeIDRange string
+var dhtRoutingTableFile string
+var dhtPacketRate float64
+var dhtBanTime time.Duration
+var dhtTokenRotation time.Duration
+var dhtPeerStoreFile string
+var dhtPeerTTL time.Duration
+var dhtIPv6 bool
 
 func init() {
 	var cmd = &cobra.Command{
-		Use:       "dht [connect|bootstrap]",
-		Short:     "Run dht node",
-		ValidArgs: []string{"connect", "bootstrap"},
+		Use:   "dht [connect|bootstrap|storage]",
+		Short: "Run dht node",
+		Long: `Run dht node. connect runs a node of the dht package, and bootstrap a bootstrap node. storage runs a
+node of this repo that takes announces: it rotates its write tokens every token-rotation, and only takes an announce
+from the node id, ip and port it gave the token to. The announces are kept for peer-ttl, in peer-store-file if it's set
+so a restart doesn't lose them. It listens on ipv6 too unless ipv6 is false, so ipv6-only hosts can join the dht. It doesn't have the rpc server and the routing table file of connect.`,
+		ValidArgs: []string{"connect", "bootstrap", "storage"},
 		Args:      argFuncs(cobra.ExactArgs(1), cobra.OnlyValidArgs),
 		Run:       dhtCmd,
 	}
 	cmd.PersistentFlags().StringVar(&dhtNodeID, "nodeID", "", "nodeID in hex")
+	cmd.PersistentFlags().StringVar(&dhtNodeIDFile, "node-id-file", "", "Keep the node id in this file, so the node has the same id after a restart. Ignored if nodeID is set")
+	cmd.PersistentFlags().StringVar(&dhtNodeIDRange, "node-id-range", "", "Generate the node id within this range: a hex prefix like a3, or N/M for the Nth of M equal parts of the id space")
 	cmd.PersistentFlags().IntVar(&dhtPort, "port", 4567, "Port to start DHT on")
 	cmd.PersistentFlags().IntVar(&dhtRPCPort, "rpcPort", 0, "Port to listen for rpc commands on")
+	cmd.PersistentFlags().IntVar(&dhtAdminPort, "admin-port", 0, "Port to serve the rpc commands on under /dht/, to clients with the admin_token from the config. Needs rpcPort")
+	cmd.PersistentFlags().StringVar(&dhtRoutingTableFile, "routing-table-file", "", "Save the routing table to this file every few minutes and on shutdown, and rejoin the dht through the saved nodes after a restart. Needs rpcPort")
 	cmd.PersistentFlags().StringSliceVar(&dhtSeeds, "seeds", []string{}, "Addresses of seed nodes")
+	cmd.PersistentFlags().Float64Var(&dhtPacketRate, "max-packet-rate", dhtguard.DefaultRate, "Packets per second each ip may send to a bootstrap or storage node. IPs that send more, or send malformed packets, are banned for ban-time. Not limited if 0")
+	cmd.PersistentFlags().DurationVar(&dhtBanTime, "ban-time", dhtguard.DefaultBanTime, "How long an ip that went over the limits of a bootstrap or storage node is banned")
+	cmd.PersistentFlags().DurationVar(&dhtTokenRotation, "token-rotation", dhtnode.DefaultTokenRotation, "How often a storage node rotates the secret of its write tokens. A token is good for one to two rotations")
+	cmd.PersistentFlags().StringVar(&dhtPeerStoreFile, "peer-store-file", "", "Keep the announces of a storage node in this file, so they're still there after a restart. They're kept in memory if it's empty")
+	cmd.PersistentFlags().DurationVar(&dhtPeerTTL, "peer-ttl", dhtnode.DefaultPeerTTL, "How long a storage node keeps an announce that isn't announced again")
+	cmd.PersistentFlags().BoolVar(&dhtIPv6, "ipv6", true, "Have a storage node listen on ipv6 too, on the same port")
 	rootCmd.AddCommand(cmd)
 }
 
 func dhtCmd(cmd *cobra.Command, args []string) {
 	if args[0] == "bootstrap" {
 		node := dht.NewBootstrapNode(bits.Rand(), 1*time.Millisecond, 1*time.Minute)
-		listener, err := net.ListenPacket(dht.Network, "127.0.0.1:"+strconv.Itoa(dhtPort))
-		checkErr(err)
-		conn := listener.(*net.UDPConn)
-		err = node.Connect(conn)
+		err := node.Connect(listenDHT(dht.Network, "127.0.0.1:"+strconv.Itoa(dhtPort), nil))
 		checkErr(err)
 		interruptChan := make(chan os.Signal, 1)
 		signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM)
 		<-interruptChan
 		node.Shutdown()
-	} else {
-		nodeID := bits.Rand()
-		if dhtNodeID != "" {
-			nodeID = bits.FromHexP(dhtNodeID)
+	} else if args[0] == "storage" {
+		nodeID := dhtFlagNodeID()
+		log.Println(nodeID.String())
+		conf := dhtnode.Config{TokenRotation: dhtTokenRotation, Store: dhtnode.NewMemStore(dhtPeerTTL)}
+		var peerStore *dhtnode.BoltStore
+		if dhtPeerStoreFile != "" {
+			var err error
+			peerStore, err = dhtnode.OpenBoltStore(dhtPeerStoreFile, dhtPeerTTL)
+			checkErr(err)
+			conf.Store = peerStore
+		}
+		node := dhtnode.New(nodeID, conf)
+		var conn6 dht.UDPConn
+		if dhtIPv6 {
+			conn6 = listenDHT("udp6", "[::]:"+strconv.Itoa(dhtPort), dhtnode.WellFormed)
+		}
+		node.Connect(listenDHT(dht.Network, "0.0.0.0:"+strconv.Itoa(dhtPort), dhtnode.WellFormed), conn6)
+		seeds, err := resolveSeeds(dhtSeeds, dhtIPv6)
+		checkErr(err)
+		err = node.Join(seeds)
+		if err != nil {
+			log.Errorf("joining the dht: %s", err.Error())
+		}
+		go logExternalIPs(node)
+		interruptChan := make(chan os.Signal, 1)
+		signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+		<-interruptChan
+		node.Shutdown()
+		if peerStore != nil {
+			err = peerStore.Close()
+			if err != nil {
+				log.Errorf("closing the peer store: %s", err.Error())
+			}
 		}
+	} else {
+		nodeID := dhtFlagNodeID()
 		log.Println(nodeID.String())
 
 		dhtConf := dht.NewStandardConfig()
+		dhtConf.NodeID = nodeID.Hex()
 		dhtConf.Address = "0.0.0.0:" + strconv.Itoa(dhtPort)
 		dhtConf.RPCPort = dhtRPCPort
 		if len(dhtSeeds) > 0 {
 			dhtConf.SeedNodes = dhtSeeds
 		}
 
+		var saved []dht.Contact
+		if dhtRoutingTableFile != "" {
+			if dhtRPCPort == 0 {
+				log.Fatal("routing-table-file needs rpcPort")
+			}
+			contacts, err := routingtable.Load(dhtRoutingTableFile)
+			checkErr(err)
+			var seeds []string
+			seeds, saved = routingtable.Seeds(contacts)
+			dhtConf.SeedNodes = append(seeds, dhtConf.SeedNodes...)
+			log.Infof("rejoining the dht through %d saved nodes", len(contacts))
+		}
+
 		d := dht.New(dhtConf)
 		err := d.Start()
 		if err != nil {
@@ -68,9 +141,121 @@ func dhtCmd(cmd *cobra.Command, args []string) {
 			return
 		}
 
+		var saver *routingtable.Saver
+		if dhtRoutingTableFile != "" {
+			rpcAddr := "127.0.0.1:" + strconv.Itoa(dhtRPCPort)
+			err = routingtable.Restore(rpcAddr, saved)
+			if err != nil {
+				log.Errorf("restoring the routing table: %s", err.Error())
+			}
+			saver = routingtable.NewSaver(rpcAddr, dhtRoutingTableFile)
+			saver.Start()
+		}
+
+		if dhtAdminPort > 0 && dhtRPCPort > 0 {
+			adminServer := metrics.NewServer(":"+strconv.Itoa(dhtAdminPort), "/metrics")
+			registerDHTAdmin(adminServer, dhtRPCPort)
+			adminServer.Start()
+			defer adminServer.Shutdown()
+		}
+
 		interruptChan := make(chan os.Signal, 1)
 		signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 		<-interruptChan
+		// the routing table is read through the rpc server, so it's saved before the node shuts down
+		if saver != nil {
+			saver.Shutdown()
+		}
 		d.Shutdown()
 	}
 }
+
+// resolveSeeds resolves the seed addresses to an address for each of their ips, so a seed with both A and AAAA records
+// bootstraps both families. IPv6 addresses are left out unless ipv6 is true
+func resolveSeeds(seeds []string, ipv6 bool) ([]*net.UDPAddr, error) {
+	var addrs []*net.UDPAddr
+	for _, s := range seeds {
+		host, portStr, err := net.SplitHostPort(s)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, errors.Err("invalid port in seed %s", s)
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		for _, ip := range ips {
+			if ip.To4() == nil && !ipv6 {
+				continue
+			}
+			addrs = append(addrs, &net.UDPAddr{IP: ip, Port: port})
+		}
+	}
+	return addrs, nil
+}
+
+// logExternalIPs logs the ips the other storage nodes see the node at, for each family it listens on
+func logExternalIPs(node *dhtnode.Node) {
+	for _, ipv6 := range []bool{false, true} {
+		if ipv6 && !dhtIPv6 {
+			continue
+		}
+		ip, err := node.DetectExternalIP(ipv6)
+		if err != nil {
+			log.Debugf("detecting the external ip: %s", err.Error())
+			continue
+		}
+		log.Infof("other storage nodes see this node at %s", ip)
+	}
+}
+
+// dhtFlagNodeID returns the node id from the nodeID flag, the node id file or the node id range, or a random one
+func dhtFlagNodeID() bits.Bitmap {
+	if dhtNodeID != "" {
+		return bits.FromHexP(dhtNodeID)
+	} else if id := loadDHTNodeID(dhtNodeIDFile, dhtNodeIDRange); id != "" {
+		return bits.FromHexP(id)
+	}
+	return bits.Rand()
+}
+
+// listenDHT listens on addr, and drops the packets of ips that go over max-packet-rate. wellFormed is the check for
+// malformed packets, the one for the messages of the dht package if nil
+func listenDHT(network, addr string, wellFormed func(packet []byte) bool) dht.UDPConn {
+	listener, err := net.ListenPacket(network, addr)
+	checkErr(err)
+	var conn dht.UDPConn = listener.(*net.UDPConn)
+	if dhtPacketRate > 0 {
+		guard := dhtguard.New(conn)
+		guard.Rate = dhtPacketRate
+		guard.BanTime = dhtBanTime
+		guard.WellFormed = wellFormed
+		conn = guard
+	}
+	return conn
+}
+
+// loadDHTNodeID returns the id to start a dht node with, in hex: the one saved in idFile, or a new one within idRange.
+// It returns "" if both are empty, for the dht to pick a random id
+func loadDHTNodeID(idFile, idRange string) string {
+	var r *bits.Range
+	if idRange != "" {
+		parsed, err := nodeid.ParseRange(idRange)
+		checkErr(err)
+		r = &parsed
+	}
+	switch {
+	case idFile != "":
+		id, err := nodeid.Load(idFile, r)
+		checkErr(err)
+		return id.Hex()
+	case r != nil:
+		id, err := nodeid.Generate(*r)
+		checkErr(err)
+		return id.Hex()
+	}
+	return ""
+}
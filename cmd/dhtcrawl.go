@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/lbryio/reflector.go/crawler"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	crawlSeeds       []string
+	crawlFormat      string
+	crawlOutput      string
+	crawlConcurrency int
+	crawlTimeout     time.Duration
+	crawlQueries     int
+	crawlMaxNodes    int
+)
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "dht-crawl",
+		Short: "Walk the dht from the seed nodes and write a report of all nodes found",
+		Args:  cobra.NoArgs,
+		Run:   dhtCrawlCmd,
+	}
+	cmd.Flags().StringSliceVar(&crawlSeeds, "seeds", dht.NewStandardConfig().SeedNodes, "Addresses of seed nodes to start the crawl from")
+	cmd.Flags().StringVar(&crawlFormat, "format", "json", "Report format (json or csv)")
+	cmd.Flags().StringVarP(&crawlOutput, "output", "o", "", "Write the report to this file instead of stdout")
+	cmd.Flags().IntVar(&crawlConcurrency, "concurrency", crawler.DefaultConcurrency, "Number of nodes to query at the same time")
+	cmd.Flags().DurationVar(&crawlTimeout, "timeout", crawler.DefaultTimeout, "How long to wait for a node to respond")
+	cmd.Flags().IntVar(&crawlQueries, "queries", crawler.DefaultQueriesPerNode, "Number of random lookups to send to each node")
+	cmd.Flags().IntVar(&crawlMaxNodes, "max-nodes", 0, "Stop after discovering this many nodes (0 for no limit)")
+	rootCmd.AddCommand(cmd)
+}
+
+type crawlReport struct {
+	Started   time.Time       `json:"started"`
+	Duration  string          `json:"duration"`
+	Total     int             `json:"total"`
+	Reachable int             `json:"reachable"`
+	Nodes     []*crawler.Node `json:"nodes"`
+}
+
+func dhtCrawlCmd(cmd *cobra.Command, args []string) {
+	if crawlFormat != "json" && crawlFormat != "csv" {
+		log.Fatalf("unknown format %q", crawlFormat)
+	}
+
+	c := crawler.New()
+	c.Concurrency = crawlConcurrency
+	c.Timeout = crawlTimeout
+	c.QueriesPerNode = crawlQueries
+	c.MaxNodes = crawlMaxNodes
+
+	// on interrupt, stop crawling and write out what was found so far
+	stopper := stop.New()
+	interruptChan := make(chan os.Signal, 1)
+	signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interruptChan
+		log.Println("stopping crawl")
+		stopper.Stop()
+	}()
+
+	started := time.Now()
+	nodes, err := c.Crawl(crawlSeeds, stopper.Ch())
+	checkErr(err)
+
+	report := crawlReport{
+		Started:  started,
+		Duration: time.Since(started).String(),
+		Total:    len(nodes),
+		Nodes:    nodes,
+	}
+	for _, n := range nodes {
+		if n.Reachable {
+			report.Reachable++
+		}
+	}
+	log.Printf("found %d nodes (%d reachable) in %s", report.Total, report.Reachable, report.Duration)
+
+	var out io.Writer = os.Stdout
+	if crawlOutput != "" {
+		f, err := os.Create(crawlOutput)
+		checkErr(err)
+		defer f.Close()
+		out = f
+	}
+
+	if crawlFormat == "csv" {
+		err = writeCrawlCSV(out, nodes)
+	} else {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	}
+	checkErr(err)
+}
+
+func writeCrawlCSV(out io.Writer, nodes []*crawler.Node) error {
+	w := csv.NewWriter(out)
+	err := w.Write([]string{"id", "ip", "port", "protocol_version", "reachable", "rtt_ms", "referrals"})
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		err = w.Write([]string{
+			n.ID,
+			n.IP,
+			strconv.Itoa(n.Port),
+			strconv.Itoa(n.ProtocolVersion),
+			strconv.FormatBool(n.Reachable),
+			strconv.FormatInt(n.RTTMs, 10),
+			strconv.Itoa(n.Referrals),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,298 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/dhtadmin"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/phayes/freeport"
+	"github.com/spf13/cobra"
+)
+
+var (
+	dhtShellPort     int
+	dhtShellSeeds    []string
+	dhtShellPeerPort int
+)
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "dht-shell",
+		Short: "Start a dht node and probe the dht by hand",
+		Long: `Start a dht node and read commands from stdin to ping nodes, look up hashes, announce hashes and dump the
+routing table. Type help for the list of commands.
+
+The node answers rpc calls on a random port while the shell runs, on all interfaces.`,
+		Args: cobra.NoArgs,
+		Run:  dhtShellCmd,
+	}
+	cmd.Flags().IntVar(&dhtShellPort, "port", 0, "Port to start the dht node on (0 for a free port)")
+	cmd.Flags().StringSliceVar(&dhtShellSeeds, "seeds", dht.NewStandardConfig().SeedNodes, "Addresses of seed nodes to join the dht through")
+	cmd.Flags().IntVar(&dhtShellPeerPort, "peer-port", dht.DefaultPeerPort, "Peer port to announce hashes with")
+	rootCmd.AddCommand(cmd)
+
+	dhtShellCommands = []dhtShellCommand{
+		{"ping", "ping HOST:PORT", "ping a node", (*dhtShell).ping, 1},
+		{"findnode", "findnode HASH NODE_ID HOST:PORT", "ask one node for the nodes closest to a hash", (*dhtShell).findNode, 3},
+		{"findvalue", "findvalue HASH NODE_ID HOST:PORT", "ask one node for the peers of a hash, or the closest nodes", (*dhtShell).findValue, 3},
+		{"get", "get HASH", "look up the peers of a hash through the dht", (*dhtShell).get, 1},
+		{"announce", "announce HASH", "announce that the peer port has a hash, for as long as the shell runs", (*dhtShell).announce, 1},
+		{"rt-dump", "rt-dump", "print the routing table", (*dhtShell).rtDump, 0},
+		{"bootstrap", "bootstrap [HOST:PORT...]", "join the dht again through the given nodes, or the seeds", (*dhtShell).bootstrap, -1},
+		{"help", "help", "print this list", (*dhtShell).help, 0},
+		{"quit", "quit", "shut the node down and exit", nil, 0},
+	}
+}
+
+func dhtShellCmd(cmd *cobra.Command, args []string) {
+	port := dhtShellPort
+	if port == 0 {
+		var err error
+		port, err = freeport.GetFreePort()
+		checkErr(err)
+	}
+	rpcPort, err := freeport.GetFreePort()
+	checkErr(err)
+
+	conf := dht.NewStandardConfig()
+	conf.Address = "0.0.0.0:" + strconv.Itoa(port)
+	conf.SeedNodes = dhtShellSeeds
+	conf.PeerProtocolPort = dhtShellPeerPort
+	conf.RPCPort = rpcPort
+	node := dht.New(conf)
+	err = node.Start()
+	checkErr(err)
+	defer node.Shutdown()
+
+	s := &dhtShell{
+		node:  node,
+		rpc:   dhtadmin.NewClient("127.0.0.1:" + strconv.Itoa(rpcPort)),
+		seeds: dhtShellSeeds,
+		out:   os.Stdout,
+	}
+	s.run(os.Stdin)
+}
+
+// dhtShell runs the commands of the dht shell against a node. The lookups the node doesn't export are made through its
+// rpc server
+type dhtShell struct {
+	node  *dht.DHT
+	rpc   *dhtadmin.Client
+	seeds []string
+	out   io.Writer
+}
+
+type dhtShellCommand struct {
+	name  string
+	usage string
+	help  string
+	run   func(s *dhtShell, args []string) error
+	// nargs is the number of arguments the command takes, or -1 for any number
+	nargs int
+}
+
+var dhtShellCommands []dhtShellCommand
+
+func (s *dhtShell) run(in io.Reader) {
+	fmt.Fprintf(s.out, "dht node %s. type help for the commands\n", s.node.ID().Hex())
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(s.out, "dht> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(s.out)
+			return
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "exit" {
+			return
+		}
+		err := s.exec(fields[0], fields[1:])
+		if err != nil {
+			fmt.Fprintf(s.out, "error: %s\n", err.Error())
+		}
+	}
+}
+
+func (s *dhtShell) exec(name string, args []string) error {
+	for _, c := range dhtShellCommands {
+		if c.name != name || c.run == nil {
+			continue
+		}
+		if c.nargs >= 0 && len(args) != c.nargs {
+			return errors.Err("usage: %s", c.usage)
+		}
+		return c.run(s, args)
+	}
+	return errors.Err("unknown command '%s'. type help for the commands", name)
+}
+
+func (s *dhtShell) help(args []string) error {
+	for _, c := range dhtShellCommands {
+		fmt.Fprintf(s.out, "  %-36s %s\n", c.usage, c.help)
+	}
+	return nil
+}
+
+func (s *dhtShell) ping(args []string) error {
+	start := time.Now()
+	err := s.node.Ping(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "%s answered in %s\n", args[0], time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// dhtShellFindArgs are the arguments of findnode and findvalue: the hash, and the node that is asked
+func dhtShellFindArgs(args []string) (dht.RpcFindArgs, error) {
+	for _, hex := range args[:2] {
+		_, err := bits.FromHex(hex)
+		if err != nil {
+			return dht.RpcFindArgs{}, errors.Err("'%s' is not a hash", hex)
+		}
+	}
+	addr, err := net.ResolveUDPAddr(dht.Network, args[2])
+	if err != nil {
+		return dht.RpcFindArgs{}, errors.Err(err)
+	}
+	return dht.RpcFindArgs{Key: args[0], NodeID: args[1], IP: addr.IP.String(), Port: addr.Port}, nil
+}
+
+func (s *dhtShell) findNode(args []string) error {
+	find, err := dhtShellFindArgs(args)
+	if err != nil {
+		return err
+	}
+	var contacts []dht.Contact
+	err = s.rpc.CallInto("rpc.FindNode", find, &contacts)
+	if err != nil {
+		return err
+	}
+	if len(contacts) == 0 {
+		fmt.Fprintln(s.out, "no answer")
+	}
+	s.printContacts(contacts)
+	return nil
+}
+
+func (s *dhtShell) findValue(args []string) error {
+	find, err := dhtShellFindArgs(args)
+	if err != nil {
+		return err
+	}
+	var result dht.RpcFindValueResult
+	err = s.rpc.CallInto("rpc.FindValue", find, &result)
+	if err != nil {
+		return err
+	}
+	if result.Value != "" {
+		fmt.Fprintf(s.out, "the node has peers for %s\n", result.Value)
+		return nil
+	}
+	fmt.Fprintln(s.out, "no peers, the closest nodes are:")
+	s.printContacts(result.Contacts)
+	return nil
+}
+
+func (s *dhtShell) get(args []string) error {
+	hash, err := bits.FromHex(args[0])
+	if err != nil {
+		return errors.Err("'%s' is not a hash", args[0])
+	}
+	peers, err := s.node.Get(hash)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "%d peers\n", len(peers))
+	s.printContacts(peers)
+	return nil
+}
+
+func (s *dhtShell) announce(args []string) error {
+	hash, err := bits.FromHex(args[0])
+	if err != nil {
+		return errors.Err("'%s' is not a hash", args[0])
+	}
+	s.node.Add(hash)
+	fmt.Fprintf(s.out, "announcing %s. check with get after a few seconds\n", hash.HexShort())
+	return nil
+}
+
+func (s *dhtShell) rtDump(args []string) error {
+	var rt dht.RpcRoutingTableResponse
+	err := s.rpc.CallInto("rpc.GetRoutingTable", struct{}{}, &rt)
+	if err != nil {
+		return err
+	}
+	contacts := 0
+	for _, b := range rt.Buckets {
+		contacts += b.NumContacts
+	}
+	fmt.Fprintf(s.out, "node %s: %d buckets, %d contacts\n", rt.NodeID, rt.NumBuckets, contacts)
+	for i, b := range rt.Buckets {
+		fmt.Fprintf(s.out, "bucket %d: %s-%s, %d contacts\n", i, shortHex(b.Start), shortHex(b.End), b.NumContacts)
+		s.printContacts(b.Contacts)
+	}
+	return nil
+}
+
+// bootstrap joins the dht the way the node did when it started: it pings the seeds, which adds them to the routing
+// table, and looks up its own id to find its neighbours
+func (s *dhtShell) bootstrap(args []string) error {
+	seeds := args
+	if len(seeds) == 0 {
+		seeds = s.seeds
+	}
+	answered := 0
+	for _, addr := range seeds {
+		err := s.node.Ping(addr)
+		if err != nil {
+			fmt.Fprintf(s.out, "%s: %s\n", addr, err.Error())
+			continue
+		}
+		answered++
+	}
+	if answered == 0 {
+		return errors.Err("none of the nodes answered")
+	}
+
+	var result dht.RpcIterativeFindValueResult
+	err := s.rpc.CallInto("rpc.IterativeFindValue", dht.RpcIterativeFindValueArgs{Key: s.node.ID().Hex()}, &result)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "%d of %d nodes answered, found %d neighbours\n", answered, len(seeds), len(result.Contacts))
+	return nil
+}
+
+func (s *dhtShell) printContacts(contacts []dht.Contact) {
+	for _, c := range contacts {
+		line := fmt.Sprintf("  %s %s", c.ID.Hex(), c.Addr().String())
+		if c.PeerPort != 0 {
+			line += " peer port " + strconv.Itoa(c.PeerPort)
+		}
+		fmt.Fprintln(s.out, line)
+	}
+}
+
+// shortHex shortens the hex of a bucket bound, which has far too many digits to read
+func shortHex(hex string) string {
+	if len(hex) <= 16 {
+		return hex
+	}
+	return hex[:16] + "…"
+}
@@ -0,0 +1,365 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/lbryio/reflector.go/db"
+	"github.com/lbryio/reflector.go/meta"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/extras/crypto"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/c2h5oh/datasize"
+	"github.com/phayes/freeport"
+	"github.com/spf13/cobra"
+)
+
+var (
+	doctorS3Write   bool
+	doctorSkipDHT   bool
+	doctorDHTSeeds  []string
+	doctorMinFreeGB int
+)
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the config, db, s3, ports, disk space and dht and print a report",
+		Long: `Runs a series of checks against the config file and the environment and prints what it finds.
+Exits with status 1 if any check failed. Takes the same port and disk cache flags as the reflector command.`,
+		// the config is loaded and checked by the doctor itself, so a broken one doesn't stop it
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+		Run:              doctorCmd,
+		Args:             cobra.NoArgs,
+	}
+	cmd.Flags().IntVar(&tcpPeerPort, "tcp-peer-port", 5567, "The port reflector will distribute content from for the TCP (LBRY) protocol")
+	cmd.Flags().IntVar(&http3PeerPort, "http3-peer-port", 5568, "The port reflector will distribute content from over HTTP3 protocol")
+	cmd.Flags().IntVar(&httpPeerPort, "http-peer-port", 5569, "The port reflector will distribute content from over HTTP protocol")
+	cmd.Flags().IntVar(&receiverPort, "receiver-port", 5566, "The port reflector will receive content from")
+	cmd.Flags().IntVar(&metricsPort, "metrics-port", 2112, "The port reflector will use for prometheus metrics")
+	cmd.Flags().StringVar(&diskCache, "disk-cache", "100GB:/tmp/downloaded_blobs:localdb", "Disk cache to check, in the format of the reflector command")
+	cmd.Flags().StringVar(&secondaryDiskCache, "optional-disk-cache", "", "Secondary disk cache to check, in the format of the reflector command")
+	cmd.Flags().IntVar(&doctorMinFreeGB, "min-free-gb", 10, "Warn when a disk cache's file system has less free space than this")
+	cmd.Flags().BoolVar(&doctorS3Write, "s3-write", false, "Also check that a test object can be written to and deleted from the bucket")
+	cmd.Flags().BoolVar(&doctorSkipDHT, "skip-dht", false, "Don't check whether the dht bootstrap nodes answer")
+	cmd.Flags().StringSliceVar(&doctorDHTSeeds, "dht-seeds", dht.NewStandardConfig().SeedNodes, "DHT bootstrap nodes to check")
+	rootCmd.AddCommand(cmd)
+}
+
+const (
+	checkOK   = "OK"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+	checkSkip = "SKIP"
+)
+
+// doctorReport prints check results as they come in, and remembers whether any failed
+type doctorReport struct {
+	failed bool
+}
+
+func (r *doctorReport) add(status, check, format string, a ...interface{}) {
+	if status == checkFail {
+		r.failed = true
+	}
+	fmt.Printf("[%-4s] %-8s %s\n", status, check, fmt.Sprintf(format, a...))
+}
+
+func doctorCmd(cmd *cobra.Command, args []string) {
+	fmt.Printf("prism doctor, reflector %s\n\n", meta.VersionString())
+	r := &doctorReport{}
+
+	c, ok := doctorConfig(r)
+	if ok {
+		doctorDB(r, c)
+		doctorS3(r, c)
+	}
+	doctorPorts(r)
+	doctorDisk(r)
+	if doctorSkipDHT {
+		r.add(checkSkip, "dht", "--skip-dht is set")
+	} else {
+		doctorDHT(r)
+	}
+
+	fmt.Println()
+	if r.failed {
+		fmt.Println("some checks failed")
+		os.Exit(1)
+	}
+	fmt.Println("all checks passed")
+}
+
+// doctorConfig loads the config strictly, so typos in key names show up. It returns false if there is no usable config
+func doctorConfig(r *doctorReport) (Config, bool) {
+	var c Config
+	if conf == "none" {
+		r.add(checkSkip, "config", "--conf is none, the db and s3 checks are skipped")
+		return c, false
+	}
+
+	raw, err := ioutil.ReadFile(conf)
+	if err != nil {
+		r.add(checkFail, "config", "reading %s: %s", conf, err.Error())
+		return c, false
+	}
+	strict := json.NewDecoder(bytes.NewReader(raw))
+	strict.DisallowUnknownFields()
+	err = strict.Decode(&c)
+	if err != nil {
+		// maybe it's only an unknown key. a lenient parse tells them apart
+		if json.Unmarshal(raw, &c) != nil {
+			r.add(checkFail, "config", "%s is not valid: %s", conf, err.Error())
+			return c, false
+		}
+		r.add(checkWarn, "config", "%s: %s", conf, err.Error())
+	} else {
+		r.add(checkOK, "config", "%s parsed", conf)
+	}
+
+	awsFields := 0
+	for _, f := range []string{c.AwsID, c.AwsSecret, c.BucketRegion, c.BucketName} {
+		if f != "" {
+			awsFields++
+		}
+	}
+	if awsFields > 0 && awsFields < 4 {
+		r.add(checkFail, "config", "aws_id, aws_secret, bucket_region and bucket_name must all be set to use s3")
+	}
+	if c.DBReplicaMaxLag < 0 {
+		r.add(checkFail, "config", "db_replica_max_lag can't be negative")
+	}
+	if len(c.DBReadConns) > 0 && c.DBConn == "" {
+		r.add(checkWarn, "config", "db_read_conns is set but db_conn isn't")
+	}
+	if c.UpdateBinURL != "" && c.UpdateCmd == "" {
+		r.add(checkWarn, "config", "update_bin_url is set but update_cmd is empty")
+	}
+	return c, true
+}
+
+func doctorDB(r *doctorReport, c Config) {
+	if c.DBConn == "" {
+		r.add(checkSkip, "db", "db_conn is not set")
+		return
+	}
+
+	sql := &db.SQL{
+		SkipSchemaCheck: true,
+		ReadDSNs:        c.DBReadConns,
+		ReplicaMaxLag:   time.Duration(c.DBReplicaMaxLag) * time.Second,
+	}
+	err := sql.Connect(c.DBConn)
+	if err != nil {
+		r.add(checkFail, "db", "connecting: %s", err.Error())
+		return
+	}
+	defer sql.Shutdown()
+	r.add(checkOK, "db", "connected")
+
+	version, dirty, err := sql.SchemaVersion()
+	if err != nil {
+		r.add(checkFail, "db", "reading the schema version: %s", err.Error())
+		return
+	}
+	latest, err := sql.LatestSchemaVersion()
+	if err != nil {
+		r.add(checkFail, "db", "listing migrations: %s", err.Error())
+		return
+	}
+	switch {
+	case dirty:
+		r.add(checkFail, "db", "schema version %d is dirty, a migration failed halfway. Fix it and run `prism migrate force N`", version)
+	case version < latest:
+		r.add(checkFail, "db", "schema version %d is behind %d, run `prism migrate up`", version, latest)
+	case version > latest:
+		r.add(checkWarn, "db", "schema version %d is newer than this binary knows (%d)", version, latest)
+	default:
+		r.add(checkOK, "db", "schema version %d is up to date", version)
+	}
+}
+
+func doctorS3(r *doctorReport, c Config) {
+	if c.AwsID == "" || c.AwsSecret == "" || c.BucketRegion == "" || c.BucketName == "" {
+		r.add(checkSkip, "s3", "s3 is not configured")
+		return
+	}
+
+	client, err := store.NewS3Client(c.AwsID, c.AwsSecret, c.BucketRegion, c.BucketName, c.s3Opts())
+	if err != nil {
+		r.add(checkFail, "s3", "creating client: %s", err.Error())
+		return
+	}
+
+	_, err = client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(c.BucketName)})
+	if err != nil {
+		r.add(checkFail, "s3", "bucket %s: %s", c.BucketName, err.Error())
+		return
+	}
+	r.add(checkOK, "s3", "bucket %s exists and the credentials work", c.BucketName)
+
+	_, err = client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(c.BucketName), MaxKeys: aws.Int64(1)})
+	if err != nil {
+		r.add(checkWarn, "s3", "listing the bucket failed: %s", err.Error())
+	} else {
+		r.add(checkOK, "s3", "bucket can be listed")
+	}
+
+	if !doctorS3Write {
+		r.add(checkSkip, "s3", "write check, use --s3-write to run it")
+		return
+	}
+	key := "prism-doctor-" + crypto.RandString(8)
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(c.BucketName),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader([]byte("prism doctor write check")),
+	})
+	if err != nil {
+		r.add(checkFail, "s3", "writing %s: %s", key, err.Error())
+		return
+	}
+	_, err = client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(c.BucketName), Key: aws.String(key)})
+	if err != nil {
+		r.add(checkFail, "s3", "deleting %s: %s. Delete it by hand", key, err.Error())
+		return
+	}
+	r.add(checkOK, "s3", "test object written and deleted")
+}
+
+func doctorPorts(r *doctorReport) {
+	tcpPorts := []struct {
+		name string
+		port int
+	}{
+		{"tcp peer", tcpPeerPort},
+		{"http peer", httpPeerPort},
+		{"receiver", receiverPort},
+		{"metrics", metricsPort},
+	}
+	for _, p := range tcpPorts {
+		addr := ":" + strconv.Itoa(p.port)
+		l, err := net.Listen("tcp", addr)
+		if err == nil {
+			_ = l.Close()
+			r.add(checkOK, "ports", "%s port %d is free", p.name, p.port)
+			continue
+		}
+		conn, dialErr := net.DialTimeout("tcp", "localhost"+addr, 2*time.Second)
+		if dialErr == nil {
+			_ = conn.Close()
+			r.add(checkWarn, "ports", "%s port %d is in use. Is a reflector already running?", p.name, p.port)
+			continue
+		}
+		r.add(checkFail, "ports", "%s port %d can't be used: %s", p.name, p.port, err.Error())
+	}
+
+	// http3 runs over udp, where a port in use can't be told apart from one we may not bind
+	l, err := net.ListenPacket("udp", ":"+strconv.Itoa(http3PeerPort))
+	if err != nil {
+		r.add(checkWarn, "ports", "http3 peer port %d (udp) is in use or can't be used: %s", http3PeerPort, err.Error())
+		return
+	}
+	_ = l.Close()
+	r.add(checkOK, "ports", "http3 peer port %d (udp) is free", http3PeerPort)
+}
+
+func doctorDisk(r *doctorReport) {
+	for _, params := range []string{diskCache, secondaryDiskCache} {
+		if params == "" {
+			continue
+		}
+		spec, err := parseDiskCacheParams(params)
+		if err != nil {
+			r.add(checkFail, "disk", err.Error())
+			continue
+		}
+		path, size := spec.path, spec.size
+
+		// the cache dir may not exist yet, the reflector creates it. check the closest dir that exists
+		dir := path
+		for {
+			if _, err := os.Stat(dir); err == nil || dir == "/" {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+
+		var st syscall.Statfs_t
+		err = syscall.Statfs(dir, &st)
+		if err != nil {
+			r.add(checkFail, "disk", "checking %s: %s", path, err.Error())
+			continue
+		}
+		free := datasize.ByteSize(uint64(st.Bavail) * uint64(st.Bsize))
+		minFree := datasize.ByteSize(doctorMinFreeGB) * datasize.GB
+
+		if dir == path {
+			probe, err := ioutil.TempFile(path, ".doctor")
+			if err != nil {
+				r.add(checkFail, "disk", "%s is not writable: %s", path, err.Error())
+				continue
+			}
+			_ = probe.Close()
+			_ = os.Remove(probe.Name())
+		}
+
+		switch {
+		case free < minFree:
+			r.add(checkWarn, "disk", "%s has %s free, less than %s", path, free.HR(), minFree.HR())
+		default:
+			r.add(checkOK, "disk", "%s has %s free (cache size %s)", path, free.HR(), datasize.ByteSize(size).HR())
+		}
+	}
+}
+
+func doctorDHT(r *doctorReport) {
+	if len(doctorDHTSeeds) == 0 {
+		r.add(checkSkip, "dht", "no bootstrap nodes given")
+		return
+	}
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		r.add(checkFail, "dht", "finding a free port: %s", err.Error())
+		return
+	}
+
+	conf := dht.NewStandardConfig()
+	conf.Address = "0.0.0.0:" + strconv.Itoa(port)
+	conf.SeedNodes = doctorDHTSeeds
+	node := dht.New(conf)
+	err = node.Start()
+	if err != nil {
+		r.add(checkFail, "dht", "starting a dht node: %s", errors.FullTrace(err))
+		return
+	}
+	defer node.Shutdown()
+
+	reachable := 0
+	for _, seed := range doctorDHTSeeds {
+		err := node.Ping(seed)
+		if err != nil {
+			r.add(checkWarn, "dht", "bootstrap node %s: %s", seed, err.Error())
+			continue
+		}
+		reachable++
+	}
+	if reachable == 0 {
+		r.add(checkFail, "dht", "none of the %d bootstrap nodes answered", len(doctorDHTSeeds))
+		return
+	}
+	r.add(checkOK, "dht", "%d of %d bootstrap nodes answered", reachable, len(doctorDHTSeeds))
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"bufio"
+	"os"
+
+	"github.com/lbryio/reflector.go/archive"
+	"github.com/lbryio/reflector.go/meta"
+	"github.com/lbryio/reflector.go/migrator"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/c2h5oh/datasize"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportFrom       string
+	exportHashesFile string
+	exportSDHashes   []string
+	exportOut        string
+)
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "export",
+		Short: "Write blobs to a tar archive, to carry them to another reflector",
+		Long: `Writes the blobs listed in --hashes-file, and the streams of the sd blobs given with --sd-hash, from the
+--from store to a tar archive. The archive ends with a manifest of the blobs in it, which import uses to check that
+the archive is complete. See migrate-store for how stores are given.
+
+Blobs the store doesn't have are listed as missing in the manifest, and the command exits with an error.`,
+		Run:  exportCmd,
+		Args: cobra.NoArgs,
+	}
+	cmd.Flags().StringVar(&exportFrom, "from", "s3", "store to read the blobs from")
+	cmd.Flags().StringVar(&exportHashesFile, "hashes-file", "", "file with the hashes to export, one per line")
+	cmd.Flags().StringSliceVar(&exportSDHashes, "sd-hash", nil, "sd hash of a stream to export, with all its blobs. Can be repeated")
+	cmd.Flags().StringVar(&exportOut, "out", "", "archive to write, or - for stdout")
+	rootCmd.AddCommand(cmd)
+}
+
+func exportCmd(cmd *cobra.Command, args []string) {
+	log.Printf("reflector %s", meta.VersionString())
+	if exportOut == "" {
+		log.Fatal("--out is required")
+	}
+	if exportHashesFile == "" && len(exportSDHashes) == 0 {
+		log.Fatal("nothing to export, use --hashes-file or --sd-hash")
+	}
+
+	src, err := storeFromSpec(exportFrom)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var hashes []string
+	if exportHashesFile != "" {
+		hashes, err = migrator.ReadHashes(exportHashesFile)
+		if err != nil {
+			log.Fatal(errors.FullTrace(err))
+		}
+	}
+
+	out := os.Stdout
+	if exportOut != "-" {
+		out, err = os.Create(exportOut)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	w := bufio.NewWriterSize(out, 1<<20)
+
+	manifest, err := archive.Export(w, src, hashes, exportSDHashes)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && out != os.Stdout {
+		err = out.Sync()
+	}
+	if out != os.Stdout {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Fatal(errors.FullTrace(err))
+	}
+
+	var size int64
+	for _, b := range manifest.Blobs {
+		size += int64(b.Size)
+	}
+	log.Infof("exported %d blobs (%s)", len(manifest.Blobs), datasize.ByteSize(size).HR())
+	if len(manifest.Missing) > 0 {
+		for _, hash := range manifest.Missing {
+			log.Warnf("missing %s", hash)
+		}
+		log.Errorf("%d blobs were not found in %s", len(manifest.Missing), exportFrom)
+		os.Exit(1)
+	}
+}
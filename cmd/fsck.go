@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/lbryio/reflector.go/meta"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// exit codes of the fsck command. they follow fsck(8), so cron and monitoring treat them the usual way
+const (
+	fsckClean       = 0
+	fsckFixed       = 1
+	fsckUnfixed     = 4
+	fsckOperational = 8
+)
+
+var (
+	fsckPrefixLength int
+	fsckRepairFrom   string
+	fsckWorkers      int
+	fsckTmpMaxAge    time.Duration
+	fsckDryRun       bool
+)
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "fsck",
+		Short: "Check the blobs of a disk store and fix what can be fixed",
+		Long: `Checks that every blob in a disk store matches its hash. Corrupt blobs are removed, and downloaded again
+if --repair-from is set. Good blobs in the wrong prefix dir are moved, and stale tmp files and empty prefix dirs
+are removed. If blobs were removed or moved, the disk index is removed too, and the reflector builds it again from
+the blob dir when it next starts. The reflector should not be using the store while this runs.
+
+Exit codes: 0 nothing was wrong, 1 problems were found and fixed, 4 problems are left, 8 the check could not run.`,
+		Run:  fsckCmd,
+		Args: cobra.NoArgs,
+	}
+	cmd.Flags().StringVar(&diskStorePath, "store-path", "", "path of the store where all blobs are cached")
+	cmd.Flags().IntVar(&fsckPrefixLength, "prefix-length", 2, "length of the prefix dirs blobs are kept in. 0 if the store has none")
+	cmd.Flags().StringVar(&fsckRepairFrom, "repair-from", "", "where to download corrupt blobs from again: 's3' (uses the config), 'https://...' for an edge endpoint, or host:port of a reflector's http server. If not set, corrupt blobs are only removed")
+	cmd.Flags().IntVar(&fsckWorkers, "workers", runtime.NumCPU(), "number of blobs to check at once")
+	cmd.Flags().DurationVar(&fsckTmpMaxAge, "tmp-max-age", time.Hour, "tmp files older than this are left over from interrupted writes and are removed")
+	cmd.Flags().BoolVar(&fsckDryRun, "dry-run", false, "only report problems, don't change anything")
+	rootCmd.AddCommand(cmd)
+}
+
+func fsckCmd(cmd *cobra.Command, args []string) {
+	log.Printf("reflector %s", meta.VersionString())
+	if diskStorePath == "" {
+		log.Error("store-path must be defined")
+		os.Exit(fsckOperational)
+	}
+
+	repair, err := fsckRepairStore(fsckRepairFrom)
+	if err != nil {
+		log.Error(err)
+		os.Exit(fsckOperational)
+	}
+
+	d := store.NewDiskStore(diskStorePath, fsckPrefixLength)
+	result, err := d.Fsck(store.FsckOpts{
+		Repair:    repair,
+		TmpMaxAge: fsckTmpMaxAge,
+		Workers:   fsckWorkers,
+		DryRun:    fsckDryRun,
+	})
+	if err != nil {
+		log.Error(errors.FullTrace(err))
+		os.Exit(fsckOperational)
+	}
+
+	fmt.Printf("checked %d blobs: %d corrupt (%d removed, %d repaired), %d moved to the right dir, %d unreadable\n",
+		result.Checked, result.Corrupt, result.Removed, result.Repaired, result.Moved, result.Unreadable)
+	fmt.Printf("removed %d stale tmp files and %d empty dirs, left %d unknown files alone\n",
+		result.TmpRemoved, result.DirsRemoved, result.UnknownFiles)
+
+	problems := result.Corrupt + result.Moved + result.Unreadable + result.TmpRemoved + result.DirsRemoved
+	switch {
+	case problems == 0:
+		os.Exit(fsckClean)
+	case fsckDryRun || result.Unfixed() > 0:
+		os.Exit(fsckUnfixed)
+	default:
+		os.Exit(fsckFixed)
+	}
+}
+
+func fsckRepairStore(from string) (store.BlobStore, error) {
+	switch {
+	case from == "":
+		return nil, nil
+	case from == "s3":
+		if globalConfig.AwsID == "" || globalConfig.BucketName == "" {
+			return nil, errors.Err("repairing from s3 needs the aws settings in the config")
+		}
+		return newS3Store(globalConfig.BucketName), nil
+	case strings.HasPrefix(from, "https://") || strings.HasPrefix(from, "http://"):
+		return store.NewCloudFrontROStore(from), nil
+	default:
+		return store.NewHttpStore(from), nil
+	}
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/lbryio/reflector.go/db"
+	"github.com/lbryio/reflector.go/events"
+	"github.com/lbryio/reflector.go/prism"
+	"github.com/lbryio/reflector.go/store"
+	"github.com/lbryio/reflector.go/webhook"
+
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	gcGracePeriod time.Duration
+	gcBatchSize   int
+	gcDryRun      bool
+	gcPendingTTL  time.Duration
+)
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "gc",
+		Short: "Delete blobs that are not part of any stream",
+		Run:   gcCmd,
+		Args:  cobra.NoArgs,
+	}
+	cmd.PersistentFlags().DurationVar(&gcGracePeriod, "grace-period", prism.DefaultGCGracePeriod, "Only delete blobs older than this")
+	cmd.PersistentFlags().IntVar(&gcBatchSize, "batch-size", 1000, "How many blobs to fetch from the db at a time")
+	cmd.PersistentFlags().DurationVar(&gcPendingTTL, "pending-stream-ttl", 0, "First abort uploads of streams that are missing blobs and got none of them for this long, like 24h, which deletes their sd blobs. Their other blobs are then deleted like any blob that belongs to no stream. Disabled if 0")
+	cmd.PersistentFlags().BoolVar(&gcDryRun, "dry-run", false, "Only list the blobs that would be deleted")
+	rootCmd.AddCommand(cmd)
+}
+
+func gcCmd(cmd *cobra.Command, args []string) {
+	db := &db.SQL{
+		LogQueries: log.GetLevel() == log.DebugLevel,
+	}
+	err := db.Connect(globalConfig.DBConn)
+	checkErr(err)
+
+	st := store.NewDBBackedStore(
+		newS3Store(globalConfig.BucketName),
+		db, false)
+	if !gcDryRun {
+		webhooks := newWebhooks()
+		if webhooks != nil {
+			defer webhooks.Shutdown()
+		}
+		bus := newEventBus()
+		if bus != nil {
+			defer bus.Shutdown()
+		}
+		st.OnDelete = func(hash string) {
+			if webhooks != nil {
+				webhooks.Send(webhook.EventBlobDeleted, hash)
+			}
+			if bus != nil {
+				bus.Send(events.BlobDeleted, hash)
+			}
+		}
+	}
+
+	stopper := stop.New()
+	interruptChan := make(chan os.Signal, 1)
+	signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interruptChan
+		stopper.Stop()
+	}()
+
+	if gcPendingTTL > 0 && !gcDryRun {
+		aborted, err := prism.ExpirePendingStreams(db, st, gcPendingTTL)
+		checkErr(err)
+		log.Printf("aborted %d abandoned stream uploads", aborted)
+	}
+
+	deleted, err := prism.CollectGarbage(db, st, prism.GCOpts{
+		GracePeriod: gcGracePeriod,
+		BatchSize:   gcBatchSize,
+		DryRun:      gcDryRun,
+	}, stopper.Ch())
+	checkErr(err)
+
+	if gcDryRun {
+		log.Printf("%d blobs would be deleted", deleted)
+	} else {
+		log.Printf("deleted %d blobs", deleted)
+	}
+}
@@ -41,10 +41,11 @@ func getStreamCmd(cmd *cobra.Command, args []string) {
 
 	var sd stream.SDBlob
 
-	sdb, _, err := s.Get(sdHash)
+	sdb, trace, err := s.Get(sdHash)
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Debugf("sd blob trace:\n%s", trace.Waterfall())
 
 	err = sd.FromBlob(sdb)
 	if err != nil {
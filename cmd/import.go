@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"github.com/lbryio/reflector.go/archive"
+	"github.com/lbryio/reflector.go/meta"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/c2h5oh/datasize"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	importTo         string
+	importVerifyOnly bool
+)
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "import ARCHIVE",
+		Short: "Store the blobs in a tar archive written by export",
+		Long: `Reads an archive written by export, or stdin if ARCHIVE is -, and stores its blobs in the --to store. Every
+blob is checked against its hash, and the archive against its manifest. Blobs are stored as they are read, so some
+blobs of a damaged archive may be stored before the damage is found. They're valid blobs, and importing a good copy
+of the archive afterwards stores the rest.`,
+		Run:  importCmd,
+		Args: cobra.ExactArgs(1),
+	}
+	cmd.Flags().StringVar(&importTo, "to", "s3", "store to put the blobs in")
+	cmd.Flags().BoolVar(&importVerifyOnly, "verify-only", false, "only check the archive, don't store anything")
+	rootCmd.AddCommand(cmd)
+}
+
+func importCmd(cmd *cobra.Command, args []string) {
+	log.Printf("reflector %s", meta.VersionString())
+
+	var dst store.BlobStore
+	if !importVerifyOnly {
+		var err error
+		dst, err = storeFromSpec(importTo)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var in io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	result, err := archive.Import(bufio.NewReaderSize(in, 1<<20), dst)
+	if err != nil {
+		log.Fatalf("after %d blobs: %s", result.Imported, errors.FullTrace(err))
+	}
+	verb := "imported"
+	if importVerifyOnly {
+		verb = "verified"
+	}
+	log.Infof("%s %d blobs (%s), archive created %s", verb, result.Imported, datasize.ByteSize(result.Bytes).HR(),
+		result.Manifest.Created.Format("2006-01-02 15:04:05"))
+	if len(result.Manifest.Missing) > 0 {
+		log.Warnf("%d blobs were missing when the archive was exported", len(result.Manifest.Missing))
+	}
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/lbryio/reflector.go/db"
+	"github.com/lbryio/reflector.go/events"
+	"github.com/lbryio/reflector.go/meta"
+	"github.com/lbryio/reflector.go/publish"
+	"github.com/lbryio/reflector.go/store"
+	"github.com/lbryio/reflector.go/streamhook"
+	"github.com/lbryio/reflector.go/webhook"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/c2h5oh/datasize"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ingestTo    string
+	ingestUseDB bool
+)
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "ingest FILE...",
+		Short: "Make streams from files and store their blobs",
+		Long: `Chunks and encrypts each file into a stream, and stores its blobs in the --to store, the sd blob last. With
+--use-db the blobs and streams are also recorded in the db from the config, like blobs uploaded to the reflector
+server. The sd hash of each stream is printed, with its blobs and claim metadata as json. With --stream-hook-url or
+--stream-hook-cmd, the hook is run for each stream once it's stored.`,
+		Run:  ingestCmd,
+		Args: cobra.MinimumNArgs(1),
+	}
+	cmd.Flags().StringVar(&ingestTo, "to", "s3", "store to put the blobs in")
+	cmd.Flags().BoolVar(&ingestUseDB, "use-db", false, "record the blobs and streams in the db")
+	addStreamHookFlags(cmd)
+	rootCmd.AddCommand(cmd)
+}
+
+func ingestCmd(cmd *cobra.Command, args []string) {
+	log.Printf("reflector %s", meta.VersionString())
+
+	dst, err := storeFromSpec(ingestTo)
+	checkErr(err)
+	if ingestUseDB {
+		sql := &db.SQL{
+			LogQueries: log.GetLevel() == log.DebugLevel,
+		}
+		err = sql.Connect(globalConfig.DBConn)
+		checkErr(err)
+		dst = store.NewDBBackedStore(dst, sql, false)
+	}
+
+	err = ingestFiles(args, dst)
+	if err != nil {
+		// exiting only now lets ingestFiles deliver the webhooks and events of the streams that were stored
+		log.Error(errors.FullTrace(err))
+		os.Exit(1)
+	}
+}
+
+// ingestFiles stores the stream of each file in dst and announces it, until one of them fails
+func ingestFiles(paths []string, dst store.BlobStore) error {
+	hook := newStreamHook(dst)
+	webhooks := newWebhooks()
+	if webhooks != nil {
+		defer webhooks.Shutdown()
+	}
+	bus := newEventBus()
+	if bus != nil {
+		defer bus.Shutdown()
+	}
+	for _, path := range paths {
+		result, err := publish.IngestFile(path, dst)
+		if err != nil {
+			return errors.Prefix(path, err)
+		}
+		log.Infof("%s: stream %s with %d blobs (%s)", path, result.SDHash, len(result.Blobs),
+			datasize.ByteSize(result.Size).HR())
+		out, err := json.Marshal(result)
+		if err != nil {
+			return errors.Err(err)
+		}
+		fmt.Println(string(out))
+		if webhooks != nil {
+			webhooks.Send(webhook.EventStreamIngested, result.SDHash)
+		}
+		if bus != nil {
+			for _, hash := range result.Blobs {
+				bus.Send(events.BlobStored, hash)
+			}
+			bus.Send(events.BlobStored, result.SDHash)
+			bus.Send(events.StreamIngested, result.SDHash)
+		}
+		if hook != nil {
+			err = hook.Run(result.SDHash)
+			if err != nil {
+				return errors.Prefix(path+": stream hook", err)
+			}
+		}
+	}
+	return nil
+}
+
+func addStreamHookFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&streamHookURL, "stream-hook-url", "", "POST the sd hash and the path of the reassembled file as json to this url when all the blobs of a stream are stored, like to start a transcoder")
+	cmd.Flags().StringVar(&streamHookCmd, "stream-hook-cmd", "", "Run this command with the sd hash and the path of the reassembled file as arguments when all the blobs of a stream are stored")
+	cmd.Flags().StringVar(&streamHookDir, "stream-hook-dir", "", "Where streams are reassembled for the stream hook. The file is deleted once the hook returns. Uses the temp dir if not set")
+}
+
+// newStreamHook returns the stream hook the flags ask for, or nil if there's none
+func newStreamHook(st store.BlobStore) *streamhook.Hook {
+	if streamHookURL == "" && streamHookCmd == "" {
+		return nil
+	}
+	hook := streamhook.New(st)
+	hook.URL = streamHookURL
+	hook.Command = streamHookCmd
+	hook.Dir = streamHookDir
+	return hook
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"strconv"
+
+	"github.com/lbryio/reflector.go/db"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var migrateDropAll bool
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "migrate up|down|version|force [N]",
+		Short: "Apply or roll back db schema migrations",
+		Long: `up [N]       apply the next N migrations, or all of them
+down N       roll back the last N migrations. Rolling back the first one drops the blob tables, and needs --drop-all
+version      print the current schema version
+force N      set the schema version to N without running anything, and clear the dirty flag`,
+		Run:       migrateCmd,
+		Args:      cobra.RangeArgs(1, 2),
+		ValidArgs: []string{"up", "down", "version", "force"},
+	}
+	cmd.Flags().BoolVar(&migrateDropAll, "drop-all", false, "Let down roll back the first migration, which drops the blob, stream and stream_blob tables with everything in them")
+	rootCmd.AddCommand(cmd)
+}
+
+func migrateCmd(cmd *cobra.Command, args []string) {
+	sql := &db.SQL{
+		LogQueries:      log.GetLevel() == log.DebugLevel,
+		SkipSchemaCheck: true,
+	}
+	err := sql.Connect(globalConfig.DBConn)
+	checkErr(err)
+
+	n := 0
+	if len(args) > 1 {
+		n, err = strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			log.Fatalf("invalid number: %s", args[1])
+		}
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := sql.MigrateUp(n)
+		checkErr(err)
+		log.Printf("applied %d migrations", applied)
+	case "down":
+		if n < 1 {
+			log.Fatal("down needs the number of migrations to roll back")
+		}
+		rolledBack, err := sql.MigrateDown(n, migrateDropAll)
+		if errors.Is(err, db.ErrDropAll) {
+			log.Fatal("rolling back the first migration drops the blob, stream and stream_blob tables. pass --drop-all if you mean it")
+		}
+		checkErr(err)
+		log.Printf("rolled back %d migrations", rolledBack)
+	case "force":
+		if len(args) != 2 {
+			log.Fatal("force needs a version")
+		}
+		checkErr(sql.ForceSchemaVersion(n))
+	case "version":
+	default:
+		log.Fatalf("unknown migrate command: %s", args[0])
+	}
+
+	version, dirty, err := sql.SchemaVersion()
+	checkErr(err)
+	latest, err := sql.LatestSchemaVersion()
+	checkErr(err)
+	log.Printf("schema version %d (dirty: %t), latest is %d", version, dirty, latest)
+}
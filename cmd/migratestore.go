@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/lbryio/reflector.go/meta"
+	"github.com/lbryio/reflector.go/migrator"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/c2h5oh/datasize"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	migrateFrom       string
+	migrateTo         string
+	migrateHashesFile string
+	migrateWorkers    int
+	migrateMaxRate    string
+	migrateVerify     bool
+	migrateOverwrite  bool
+	migrateCheckpoint string
+)
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "migrate-store",
+		Short: "Copy all blobs from one store to another",
+		Long: `Copies blobs from --from to --to. Stores are given as:
+  s3             the bucket in the config
+  s3:BUCKET      another bucket, with the credentials in the config
+  disk:PATH      a disk store, like the reflector's disk cache
+  http:HOST:PORT the http server of a reflector (read only)
+  edge:URL       an http edge endpoint (read only)
+
+The blobs to copy are listed from the source, or read from --hashes-file for stores that can't be listed. With
+--checkpoint, progress is saved and an interrupted migration continues where it stopped. Blobs that failed are
+written to the checkpoint file with a .failed suffix, which can be passed as --hashes-file to retry them.`,
+		Run:  migrateStoreCmd,
+		Args: cobra.NoArgs,
+	}
+	cmd.Flags().StringVar(&migrateFrom, "from", "", "store to copy from")
+	cmd.Flags().StringVar(&migrateTo, "to", "", "store to copy to")
+	cmd.Flags().StringVar(&migrateHashesFile, "hashes-file", "", "file with the hashes to copy, one per line, instead of listing the source")
+	cmd.Flags().IntVar(&migrateWorkers, "workers", 8, "number of blobs to copy at once")
+	cmd.Flags().StringVar(&migrateMaxRate, "max-rate", "0", "max bytes per second to copy, like 50MB. 0 for no limit")
+	cmd.Flags().BoolVar(&migrateVerify, "verify", true, "read every blob back from the destination and check its hash")
+	cmd.Flags().BoolVar(&migrateOverwrite, "overwrite", false, "copy blobs the destination already has")
+	cmd.Flags().StringVar(&migrateCheckpoint, "checkpoint", "", "file to save progress to, to resume an interrupted migration")
+	rootCmd.AddCommand(cmd)
+}
+
+func migrateStoreCmd(cmd *cobra.Command, args []string) {
+	log.Printf("reflector %s", meta.VersionString())
+
+	src, err := storeFromSpec(migrateFrom)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dst, err := storeFromSpec(migrateTo)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var maxRate datasize.ByteSize
+	err = maxRate.UnmarshalText([]byte(migrateMaxRate))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var hashes []string
+	if migrateHashesFile != "" {
+		hashes, err = migrator.ReadHashes(migrateHashesFile)
+	} else {
+		log.Infof("listing the blobs in %s", migrateFrom)
+		hashes, err = store.List(src)
+	}
+	if err != nil {
+		log.Fatal(errors.FullTrace(err))
+	}
+	log.Infof("copying %d blobs from %s to %s", len(hashes), migrateFrom, migrateTo)
+
+	m := migrator.New(src, dst, migrator.Opts{
+		Workers:        migrateWorkers,
+		MaxBytesPerSec: int64(maxRate),
+		Verify:         migrateVerify,
+		Overwrite:      migrateOverwrite,
+		Checkpoint:     migrateCheckpoint,
+	})
+
+	interruptChan := make(chan os.Signal, 1)
+	signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interruptChan
+		log.Info("stopping after the blobs in flight")
+		m.Shutdown()
+	}()
+
+	result, err := m.Run(hashes)
+	if err != nil {
+		log.Fatal(errors.FullTrace(err))
+	}
+	log.Infof("copied %d blobs (%s), skipped %d, %d failed", result.Copied, datasize.ByteSize(result.Bytes).HR(),
+		result.Skipped, result.Failed)
+	if result.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// storeFromSpec returns the store described by a --from or --to flag
+func storeFromSpec(spec string) (store.BlobStore, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+
+	switch kind {
+	case "s3":
+		if globalConfig.AwsID == "" || globalConfig.AwsSecret == "" || globalConfig.BucketRegion == "" {
+			return nil, errors.Err("s3 stores need the aws settings in the config")
+		}
+		bucket := globalConfig.BucketName
+		if arg != "" {
+			bucket = arg
+		}
+		if bucket == "" {
+			return nil, errors.Err("no bucket given and bucket_name is not set in the config")
+		}
+		return newS3Store(bucket), nil
+	case "disk":
+		if arg == "" {
+			return nil, errors.Err("disk stores need a path")
+		}
+		return store.NewDiskStore(arg, 2), nil
+	case "http":
+		if arg == "" {
+			return nil, errors.Err("http stores need a host:port")
+		}
+		return store.NewHttpStore(arg), nil
+	case "edge":
+		if arg == "" {
+			return nil, errors.Err("edge stores need a url")
+		}
+		return store.NewCloudFrontROStore(arg), nil
+	case "":
+		return nil, errors.Err("--from and --to are required")
+	default:
+		return nil, errors.Err("unknown store %s", spec)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"os/signal"
 	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/lbryio/reflector.go/db"
 	"github.com/lbryio/reflector.go/server/peer"
@@ -29,12 +30,14 @@ func init() {
 func peerCmd(cmd *cobra.Command, args []string) {
 	var err error
 
-	s3 := store.NewS3Store(globalConfig.AwsID, globalConfig.AwsSecret, globalConfig.BucketRegion, globalConfig.BucketName)
+	s3 := newS3Store(globalConfig.BucketName)
 	peerServer := peer.NewServer(s3)
 
 	if !peerNoDB {
 		db := &db.SQL{
-			LogQueries: log.GetLevel() == log.DebugLevel,
+			LogQueries:    log.GetLevel() == log.DebugLevel,
+			ReadDSNs:      globalConfig.DBReadConns,
+			ReplicaMaxLag: time.Duration(globalConfig.DBReplicaMaxLag) * time.Second,
 		}
 		err = db.Connect(globalConfig.DBConn)
 		checkErr(err)
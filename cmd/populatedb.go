@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"time"
+
 	"github.com/lbryio/reflector.go/db"
 	"github.com/lbryio/reflector.go/meta"
 	"github.com/lbryio/reflector.go/store/speedwalk"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -40,10 +43,16 @@ func populateDbCmd(cmd *cobra.Command, args []string) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	blobs, err := speedwalk.AllFiles(diskStorePath, true)
+	hashes, err := speedwalk.AllFiles(diskStorePath, true)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// the real sizes don't matter for the local db, and walking the files again to stat them would be slow
+	dayAgo := time.Now().AddDate(0, 0, -1)
+	blobs := make([]db.BlobInfo, len(hashes))
+	for i, hash := range hashes {
+		blobs[i] = db.BlobInfo{Hash: hash, Length: stream.MaxBlobSize, IsStored: true, LastAccessedAt: dayAgo}
+	}
 	err = localDb.AddBlobs(blobs)
 	if err != nil {
 		log.Errorf("error while storing to db: %s", errors.FullTrace(err))
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/lbryio/reflector.go/db"
+	"github.com/lbryio/reflector.go/prism"
+
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	refCountsBatchSize int
+	refCountsDryRun    bool
+)
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "refcounts",
+		Short: "Recount how many streams each blob is part of",
+		Long: `Recounts the streams each blob in the db is a content blob of, and fixes the counts that are off. Deleting a
+stream only deletes the blobs no other stream has, by these counts. They only go wrong when the same stream is
+uploaded several times at once, or when the db is changed by hand.`,
+		Run:  refCountsCmd,
+		Args: cobra.NoArgs,
+	}
+	cmd.PersistentFlags().IntVar(&refCountsBatchSize, "batch-size", 10000, "How many blob ids to recount at a time")
+	cmd.PersistentFlags().BoolVar(&refCountsDryRun, "dry-run", false, "Only count the blobs whose count is off")
+	rootCmd.AddCommand(cmd)
+}
+
+func refCountsCmd(cmd *cobra.Command, args []string) {
+	db := &db.SQL{
+		LogQueries: log.GetLevel() == log.DebugLevel,
+	}
+	err := db.Connect(globalConfig.DBConn)
+	checkErr(err)
+
+	stopper := stop.New()
+	interruptChan := make(chan os.Signal, 1)
+	signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interruptChan
+		stopper.Stop()
+	}()
+
+	off, err := prism.RepairRefCounts(db, prism.RefCountOpts{
+		BatchSize: refCountsBatchSize,
+		DryRun:    refCountsDryRun,
+	}, stopper.Ch())
+	checkErr(err)
+
+	if refCountsDryRun {
+		log.Printf("%d counts are off", off)
+	} else {
+		log.Printf("fixed %d counts", off)
+	}
+}
@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"encoding/json"
+	"fmt"
+	nethttp "net/http"
 	"os"
 	"os/signal"
 	"strconv"
@@ -9,15 +12,34 @@ import (
 	"time"
 
 	"github.com/lbryio/lbry.go/v2/extras/util"
+	"github.com/lbryio/reflector.go/apikey"
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/cluster"
 	"github.com/lbryio/reflector.go/db"
+	"github.com/lbryio/reflector.go/events"
+	"github.com/lbryio/reflector.go/internal/capture"
+	"github.com/lbryio/reflector.go/internal/dashboard"
+	"github.com/lbryio/reflector.go/internal/dhtadmin"
+	"github.com/lbryio/reflector.go/internal/geo"
+	"github.com/lbryio/reflector.go/internal/membudget"
 	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/internal/profiling"
+	"github.com/lbryio/reflector.go/internal/ratelimit"
+	"github.com/lbryio/reflector.go/internal/schedule"
+	"github.com/lbryio/reflector.go/internal/shadow"
 	"github.com/lbryio/reflector.go/meta"
+	"github.com/lbryio/reflector.go/prefetch"
+	"github.com/lbryio/reflector.go/prism"
 	"github.com/lbryio/reflector.go/reflector"
 	"github.com/lbryio/reflector.go/server/http"
 	"github.com/lbryio/reflector.go/server/http3"
 	"github.com/lbryio/reflector.go/server/peer"
+	"github.com/lbryio/reflector.go/server/s3gw"
 	"github.com/lbryio/reflector.go/store"
+	"github.com/lbryio/reflector.go/streamhook"
+	"github.com/lbryio/reflector.go/webhook"
 
+	"github.com/lbryio/lbry.go/v2/dht"
 	"github.com/lbryio/lbry.go/v2/extras/errors"
 	"github.com/lbryio/lbry.go/v2/extras/stop"
 	"github.com/lbryio/lbry.go/v2/stream"
@@ -25,6 +47,7 @@ import (
 	"github.com/c2h5oh/datasize"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"go.uber.org/atomic"
 )
 
 var (
@@ -39,23 +62,138 @@ var (
 	disableUploads   bool
 	disableBlocklist bool
 	useDB            bool
+	pendingStreamTTL time.Duration
+	enableDashboard  bool
+	useDiskIndex     bool
+	cacheAdmission   bool
+	httpInventory    bool
+	uploadHaveFilter bool
+	enablePprof      bool
+
+	//heap profiles
+	heapProfileDir       string
+	heapProfileWatermark string
 
 	//upstream configuration
-	upstreamReflector string
-	upstreamProtocol  string
+	upstreamReflector   string
+	upstreamProtocol    string
+	upstreamDhtPort     int
+	upstreamDhtRPC      int
+	upstreamDhtIDFile   string
+	upstreamDhtIDRange  string
+	upstreamDht         *dht.DHT
+	upstreamMaxConns    int
+	upstreamIdleTimeout time.Duration
 
 	//downstream configuration
-	requestQueueSize int
+	requestQueueSize   int
+	requestQueueMax    int
+	requestQueueTarget time.Duration
 
 	//upstream edge configuration (to "cold" storage)
 	originEndpoint         string
 	originEndpointFallback string
+	mirrorTo               string
+	mirrorStore            *store.MirrorStore
+	originMiddleware       string
+	tierPolicySpec         string
+	tierPolicy             *store.TierPolicy
+	s3GatewayPort          int
+	s3GatewayBucket        string
 
 	//cache configuration
 	diskCache          string
 	secondaryDiskCache string
 	memCache           int
+	memCacheSize       string
+	memCacheShards     int
+	maxMemory          string
+	shadowCacheSpec    string
+	shadowCaches       *shadow.Simulator
+
+	//access tracking configuration
+	accessFlushInterval time.Duration
+	statsDB             *db.SQL
+
+	//prefetch configuration
+	prefetchStreams  int
+	prefetchURL      string
+	prefetchHours    string
+	prefetchMaxRate  string
+	prefetchInterval time.Duration
+	readAheadBlobs   int
+
+	//cold start configuration
+	coldStartBlobs    int
+	coldStartManifest string
+
+	//cluster configuration
+	clusterPort     int
+	clusterSeedAddr string
+	clusterHTTPAddr string
+	clusterRedirect bool
+	clusterReplicas int
+	clusterRoles    string
+	clusterKeyring  string
+	clusterSummary  time.Duration
+	clusterRegion   string
+
+	// where clients are, for sending them to the cluster members of their region
+	clientRegionNetworks string
+	clientCountryHeader  string
+	clientCountryRegions string
+	regionRedirect       bool
+
+	// the disk caches, shared with the other cluster members
+	diskCaches []store.BlobStore
+	// checks the blobs the disk caches serve after serving them, if enabled
+	verifyWorkers int
+	diskVerifier  *store.Verifier
+
+	//upload integrity
+	banFailures int
+	banWindow   time.Duration
+	banDuration time.Duration
+
+	//upload limits
+	maxBlobSize    string
+	maxStreamBlobs int
+	maxDailyUpload string
+	uploadAPIKeys  bool
+
+	//stream hook
+	streamHookURL string
+	streamHookCmd string
+	streamHookDir string
+
+	//bandwidth shaping
+	connMaxRate  string
+	totalMaxRate string
+
+	// settings that change with the time of day
+	scheduleSpec     string
+	diskEvictPercent int
+
+	//authorization
+	authAllowIPs    []string
+	authJWTSecret   string
+	authURL         string
+	authURLTimeout  time.Duration
+	authUploadsOnly bool
+
+	// countries of clients, from a MaxMind database
+	geoIPDB             string
+	geoIPAllowCountries []string
+	geoIPBlockCountries []string
+	geoIPBlockUnknown   bool
+
+	// request capture for prism replay
+	captureFile string
 )
+
+// evictPercent is how much of a full localdb disk cache is evicted at once. The schedule changes it
+var evictPercent = atomic.NewInt32(10)
+
 var cacheManagers = []string{"localdb", "lfu", "arc", "lru", "simple"}
 
 var cacheMangerToGcache = map[string]store.EvictionStrategy{
@@ -76,23 +214,97 @@ func init() {
 	cmd.Flags().IntVar(&http3PeerPort, "http3-peer-port", 5568, "The port reflector will distribute content from over HTTP3 protocol")
 	cmd.Flags().IntVar(&httpPeerPort, "http-peer-port", 5569, "The port reflector will distribute content from over HTTP protocol")
 	cmd.Flags().IntVar(&receiverPort, "receiver-port", 5566, "The port reflector will receive content from")
+	cmd.Flags().IntVar(&s3GatewayPort, "s3-gateway-port", 0, "The port reflector will serve blobs from over an s3 compatible api. Disabled if 0")
+	cmd.Flags().StringVar(&s3GatewayBucket, "s3-gateway-bucket", s3gw.DefaultBucket, "Name of the bucket the s3 gateway serves blobs in")
 	cmd.Flags().IntVar(&metricsPort, "metrics-port", 2112, "The port reflector will use for prometheus metrics")
+	cmd.Flags().BoolVar(&enableDashboard, "dashboard", true, "Serve a status page for operators at /dashboard/?token=ADMIN_TOKEN on the metrics port")
+	cmd.Flags().BoolVar(&enablePprof, "pprof", false, "Serve pprof profiles at /debug/pprof/ on the metrics port, and let the GC percent, memory limit and GOMAXPROCS be changed at /debug/runtime")
+	cmd.Flags().StringVar(&heapProfileDir, "heap-profile-dir", "", "Write heap profiles to this dir when the heap in use grows past --heap-profile-watermark")
+	cmd.Flags().StringVar(&heapProfileWatermark, "heap-profile-watermark", "0", "Heap in use, like 8GB, past which a heap profile is written to --heap-profile-dir, at most every 10 minutes. Disabled if 0")
 
 	cmd.Flags().BoolVar(&disableUploads, "disable-uploads", false, "Disable uploads to this reflector server")
 	cmd.Flags().BoolVar(&disableBlocklist, "disable-blocklist", false, "Disable blocklist watching/updating")
+	cmd.Flags().BoolVar(&uploadHaveFilter, "upload-have-filter", false, "Let uploading clients ask which of their blobs this reflector has with a Bloom filter. Each answer walks every blob in the store")
 	cmd.Flags().BoolVar(&useDB, "use-db", true, "Whether to connect to the reflector db or not")
+	cmd.Flags().DurationVar(&pendingStreamTTL, "pending-stream-ttl", 0, "Abort uploads of streams that are missing blobs and got none of them for this long, like 24h, so they are no longer hidden as pending. This deletes their sd blobs from the upstream store where it can. Needs --use-db. Disabled if 0")
+	cmd.Flags().BoolVar(&httpInventory, "http-inventory", false, "Serve the list of blobs this reflector has on the http server at /inventory and /blobs, for sync and other tools")
+	cmd.Flags().IntVar(&verifyWorkers, "verify-workers", 0, "Check the blobs the disk caches serve against their hash in this many workers after serving them, and quarantine the corrupt ones, instead of checking them before. Disabled if 0")
+	cmd.Flags().BoolVar(&cacheAdmission, "cache-admission", false, "Only keep blobs in the disk caches once they were requested twice in a while (TinyLFU), so blobs that are requested once don't evict popular ones")
+	cmd.Flags().StringVar(&shadowCacheSpec, "shadow-caches", "", `Simulate other disk caches on the requests of the real one, as POLICY:SIZE pairs like "lru:500GB,lru:1TB,tinylfu:1TB", and report the hit rate each would have in the metrics and at /stats/shadow on the metrics port. Policies are lru, fifo, lfu and tinylfu`)
+	cmd.Flags().BoolVar(&useDiskIndex, "disk-index", true, "Keep an index of the blobs in disk caches instead of walking the cache dirs on startup (lfuda/lru cache managers only)")
 
 	cmd.Flags().StringVar(&upstreamReflector, "upstream-reflector", "", "host:port of a reflector server where blobs are fetched from")
-	cmd.Flags().StringVar(&upstreamProtocol, "upstream-protocol", "http", "protocol used to fetch blobs from another upstream reflector server (tcp/http3/http)")
+	cmd.Flags().StringVar(&upstreamProtocol, "upstream-protocol", "http", "protocol used to fetch blobs from another upstream reflector server (tcp/http3/http), or dht to fetch blobs from any peers that announced them")
+	cmd.Flags().IntVar(&upstreamDhtPort, "upstream-dht-port", dht.DefaultPort, "Port the dht node listens on when upstream-protocol is dht")
+	cmd.Flags().StringVar(&upstreamDhtIDFile, "upstream-dht-node-id-file", "", "Keep the id of the dht node in this file when upstream-protocol is dht, so the node has the same id after a restart")
+	cmd.Flags().StringVar(&upstreamDhtIDRange, "upstream-dht-node-id-range", "", "Generate the id of the dht node within this range when upstream-protocol is dht: a hex prefix like a3, or N/M for the Nth of M equal parts of the id space")
+	cmd.Flags().IntVar(&upstreamDhtRPC, "upstream-dht-rpc-port", 0, "Port the dht node answers json-rpc debugging calls on when upstream-protocol is dht, which are served to clients with the admin_token under /dht/ on the metrics port. Keep the port itself firewalled. Disabled if 0")
+	cmd.Flags().IntVar(&upstreamMaxConns, "upstream-max-conns", peer.DefaultMaxConnsPerHost, "How many connections to each upstream peer can be in use at once when upstream-protocol is tcp or dht")
+	cmd.Flags().DurationVar(&upstreamIdleTimeout, "upstream-idle-timeout", peer.DefaultIdleTimeout, "How long unused connections to upstream peers are kept open to be reused when upstream-protocol is tcp or dht")
 
 	cmd.Flags().IntVar(&requestQueueSize, "request-queue-size", 200, "How many concurrent requests from downstream should be handled at once (the rest will wait)")
+	cmd.Flags().IntVar(&requestQueueMax, "request-queue-max", 20000, "How many requests from downstream can wait to be handled. More are told to retry later")
+	cmd.Flags().DurationVar(&requestQueueTarget, "request-queue-target", 0, "Tell new requests to retry later once requests wait longer than this to be handled. Disabled if 0")
 
 	cmd.Flags().StringVar(&originEndpoint, "origin-endpoint", "", "HTTP edge endpoint for standard HTTP retrieval")
 	cmd.Flags().StringVar(&originEndpointFallback, "origin-endpoint-fallback", "", "HTTP edge endpoint for standard HTTP retrieval if first origin fails")
+	cmd.Flags().StringVar(&originMiddleware, "origin-middleware", "", "Comma separated middlewares to wrap the store blobs are fetched from in: metrics, logging, retry[:ATTEMPTS[:MIN_BACKOFF]], timeout:DURATION, singleflight, breaker, faults[:NAME=VALUE...] (staging only). The first one is the outermost")
+	cmd.Flags().StringVar(&tierPolicySpec, "tier-policy", "", "What a failed get from a cache or the origin does, as CLASS=ACTION pairs like timeout=retry,5xx=next,not_found=next,corrupt=next,other=fail. Classes are timeout, 5xx, not_found, corrupt and other; actions are retry (the same store, see attempts=N and backoff=DURATION), next (the next tier) and fail. By default caches go to the next tier only for missing blobs, and the origin fallback and mirror for any error")
+	cmd.Flags().StringVar(&mirrorTo, "mirror-to", "", "Also write uploaded blobs to this store, and read from it when the origin doesn't have a blob. Stores are given like in migrate-store, like s3:BUCKET or disk:PATH")
 
-	cmd.Flags().StringVar(&diskCache, "disk-cache", "100GB:/tmp/downloaded_blobs:localdb", "Where to cache blobs on the file system. format is 'sizeGB:CACHE_PATH:cachemanager' (cachemanagers: localdb/lfu/arc/lru)")
-	cmd.Flags().StringVar(&secondaryDiskCache, "optional-disk-cache", "", "Optional secondary file system cache for blobs. format is 'sizeGB:CACHE_PATH:cachemanager' (cachemanagers: localdb/lfu/arc/lru) (this would get hit before the one specified in disk-cache)")
+	cmd.Flags().StringVar(&diskCache, "disk-cache", "100GB:/tmp/downloaded_blobs:localdb", "Where to cache blobs on the file system. format is 'sizeGB:CACHE_PATH:cachemanager[:TMP_PATH]' (cachemanagers: localdb/lfu/arc/lru). TMP_PATH is where blobs are written before they're moved into place, or 'shard' for a tmp dir next to each blob dir")
+	cmd.Flags().StringVar(&secondaryDiskCache, "optional-disk-cache", "", "Optional secondary file system cache for blobs. format is 'sizeGB:CACHE_PATH:cachemanager[:TMP_PATH]' (cachemanagers: localdb/lfu/arc/lru) (this would get hit before the one specified in disk-cache)")
 	cmd.Flags().IntVar(&memCache, "mem-cache", 0, "enable in-memory cache with a max size of this many blobs")
+	cmd.Flags().StringVar(&memCacheSize, "mem-cache-size", "0", "enable in-memory cache with a max size in bytes, like 4GB. Takes precedence over --mem-cache")
+	cmd.Flags().IntVar(&memCacheShards, "mem-cache-shards", 16, "How many parts the in-memory cache of --mem-cache-size is split into, each with its own lock")
+	cmd.Flags().StringVar(&maxMemory, "max-memory", "0", "Memory budget of the reflector, like 4GB. Sizes the in-memory cache and --request-queue-size unless they're set, and turns requests away when memory goes over it. Disabled if 0")
+
+	cmd.Flags().DurationVar(&accessFlushInterval, "access-flush-interval", 0, "Count blob accesses and write the counts to the db this often, like 1m. Disables access counting if 0")
+
+	cmd.Flags().IntVar(&prefetchStreams, "prefetch-streams", 0, "Download this many of the most popular streams into the cache ahead of time. Disabled if 0")
+	cmd.Flags().StringVar(&prefetchURL, "prefetch-url", "", "URL of a json list of popular sd hashes to prefetch. Uses the access counts in the db if not set")
+	cmd.Flags().StringVar(&prefetchHours, "prefetch-hours", "2-6", "Hours of the day (start-end, local time) when prefetching may run")
+	cmd.Flags().StringVar(&prefetchMaxRate, "prefetch-max-rate", "10MB", "Max download rate per second while prefetching. 0 for no limit")
+	cmd.Flags().DurationVar(&prefetchInterval, "prefetch-interval", 24*time.Hour, "Minimum time between two prefetch passes")
+	cmd.Flags().IntVar(&clusterPort, "cluster-port", 0, "Port to gossip with other reflectors on. Blobs are partitioned between the members of the cluster. Disabled if 0")
+	cmd.Flags().StringVar(&clusterSeedAddr, "cluster-seed-addr", "", "host:port of a cluster member to join")
+	cmd.Flags().StringVar(&clusterHTTPAddr, "cluster-http-addr", "", "host:port that other cluster members reach this node's http peer server on")
+	cmd.Flags().IntVar(&clusterReplicas, "cluster-replicas", 1, "How many cluster members cache each blob")
+	cmd.Flags().StringVar(&clusterKeyring, "cluster-keyring", "", "Json list of base64 keys to encrypt the cluster gossip and sign the requests between members with. Required with --cluster-port. Members without the keys can't join. Key rotations through /cluster/keys on the metrics port are saved to it")
+	cmd.Flags().StringVar(&clusterRoles, "cluster-roles", "", "Comma-separated roles of this node in the cluster: cache, origin and announcer. All of them if empty. Only cache members hold a part of the blobs")
+	cmd.Flags().DurationVar(&clusterSummary, "cluster-summary-interval", 5*time.Minute, "How often cluster members exchange summaries of their caches, so misses can be served from another member's cache")
+	cmd.Flags().StringVar(&clusterRegion, "cluster-region", "", "Region of this node. Blobs are partitioned between the cluster members of each region, and clients are sent to the members of their region")
+	cmd.Flags().StringVar(&clientRegionNetworks, "client-region-networks", "", "File with a NETWORK,REGION line for each client network, like 203.0.113.0/24,ap. It can be made from a GeoIP database")
+	cmd.Flags().StringVar(&clientCountryHeader, "client-country-header", "", "Request header with the client's country code, set by a CDN or load balancer in front of the http peer server, like CF-IPCountry")
+	cmd.Flags().StringVar(&clientCountryRegions, "client-country-regions", "", "Comma-separated COUNTRY=REGION list mapping the countries in --client-country-header to regions, like US=us,DE=eu")
+	cmd.Flags().BoolVar(&regionRedirect, "region-redirect", false, "Redirect http blob requests from clients of another region to the member of that region that holds the blob instead of proxying them")
+	cmd.Flags().BoolVar(&clusterRedirect, "cluster-redirect", false, "Redirect http blob requests to the cluster member that owns the blob instead of proxying them")
+	cmd.Flags().IntVar(&coldStartBlobs, "cold-start-blobs", 0, "When the disk caches are empty on startup, fill them with this many of the most popular streams before reporting ready on /ready. Disabled if 0")
+	cmd.Flags().StringVar(&coldStartManifest, "cold-start-manifest", "", "URL or file with the json list of popular hashes to fill empty caches with, like another reflector's /stats/popular?token=ADMIN_TOKEN. Uses the access counts in the db if not set")
+	cmd.Flags().IntVar(&readAheadBlobs, "read-ahead-blobs", 0, "When a blob of a stream is requested, prefetch this many of the blobs after it into the cache. Disabled if 0")
+	cmd.Flags().IntVar(&banFailures, "ban-failures", 10, "Ban uploading clients that send this many corrupt blobs or protocol errors within --ban-window. Disabled if 0")
+	cmd.Flags().DurationVar(&banWindow, "ban-window", 10*time.Minute, "Window in which --ban-failures failures get a client banned")
+	cmd.Flags().DurationVar(&banDuration, "ban-duration", time.Hour, "How long clients are banned from uploading")
+	cmd.Flags().StringVar(&maxBlobSize, "max-blob-size", "0", "Largest blob uploads accept, like 1MB. 0 for the protocol's limit")
+	cmd.Flags().IntVar(&maxStreamBlobs, "max-stream-blobs", 0, "Reject uploaded streams with more blobs than this. Disabled if 0")
+	cmd.Flags().StringVar(&maxDailyUpload, "max-daily-upload", "0", "How much each client ip may upload per day (UTC), like 50GB. 0 for no limit")
+	cmd.Flags().BoolVar(&uploadAPIKeys, "upload-api-keys", false, "Only accept uploads from clients with an api key from the db, each with its own daily quota and rate. Keys are created and revoked at /apikeys on the metrics port with the admin_token")
+	addStreamHookFlags(cmd)
+	cmd.Flags().StringVar(&connMaxRate, "conn-max-rate", "0", "Max rate per second blobs are sent to each client by the peer and http servers. 0 for no limit")
+	cmd.Flags().StringVar(&totalMaxRate, "total-max-rate", "0", "Max rate per second blobs are sent to all clients together by the peer and http servers. 0 for no limit")
+	cmd.Flags().IntVar(&diskEvictPercent, "disk-evict-percent", 10, "Percentage of the localdb disk cache evicted at once when it's full")
+	cmd.Flags().StringVar(&scheduleSpec, "schedule", "", `Time windows with their own total-max-rate, prefetch-streams, prefetch-max-rate and disk-evict-percent, like "18-23 max_rate=50MB,prefetch_streams=0,evict_percent=2; 1-6 max_rate=0,prefetch_streams=500,evict_percent=20". The flags apply outside of them`)
+	cmd.Flags().StringSliceVar(&authAllowIPs, "auth-allow-ips", nil, "Only serve and accept blobs for clients in these comma separated ips or CIDRs")
+	cmd.Flags().StringVar(&authJWTSecret, "auth-jwt-secret", "", "Only serve and accept blobs for clients with a token (HS256 JWT) signed with this secret")
+	cmd.Flags().StringVar(&authURL, "auth-url", "", "Ask this url whether to serve or accept each blob. The request is POSTed as json, a 2xx response allows it")
+	cmd.Flags().DurationVar(&authURLTimeout, "auth-url-timeout", 2*time.Second, "How long to wait for the auth-url to answer")
+	cmd.Flags().BoolVar(&authUploadsOnly, "auth-uploads-only", false, "Only authorize uploads, and serve blobs to everyone")
+	cmd.Flags().StringVar(&geoIPDB, "geoip-db", "", "MaxMind country or city database (.mmdb) to count the blobs served and bytes sent by country of the client")
+	cmd.Flags().StringSliceVar(&geoIPAllowCountries, "geoip-allow-countries", nil, "Only serve blobs to clients in these comma separated two letter country codes. Needs --geoip-db")
+	cmd.Flags().StringSliceVar(&geoIPBlockCountries, "geoip-block-countries", nil, "Don't serve blobs to clients in these comma separated two letter country codes. Needs --geoip-db")
+	cmd.Flags().BoolVar(&geoIPBlockUnknown, "geoip-block-unknown", false, "Don't serve blobs to clients whose country is not in the geoip database, like clients on private networks")
+
+	cmd.Flags().StringVar(&captureFile, "capture-requests", "", "Append the blobs served to this file, with their time, size and client class (protocol and country) but not the client address, to replay them with prism replay")
 
 	rootCmd.AddCommand(cmd)
 }
@@ -100,30 +312,195 @@ func init() {
 func reflectorCmd(cmd *cobra.Command, args []string) {
 	log.Printf("reflector %s", meta.VersionString())
 
+	var board *dashboard.Dashboard
+	if enableDashboard {
+		board = dashboard.New() // created first so it sees the errors logged during startup
+	}
+
+	budget := initMemoryBudget(cmd)
+	if budget != nil {
+		defer budget.Shutdown()
+	}
+
+	if diskEvictPercent < 1 || diskEvictPercent > 100 {
+		log.Fatalf("--disk-evict-percent must be from 1 to 100, got %d", diskEvictPercent)
+	}
+	evictPercent.Store(int32(diskEvictPercent))
+
 	// the blocklist logic requires the db backed store to be the outer-most store
 	underlyingStore := initStores()
-	underlyingStoreWithCaches, cleanerStopper := initCaches(underlyingStore)
+	webhooks := newWebhooks()
+	if webhooks != nil {
+		defer webhooks.Shutdown()
+	}
+	bus := newEventBus()
+	if bus != nil {
+		defer bus.Shutdown()
+	}
+	if dbStore, ok := underlyingStore.(*store.DBBackedStore); ok && (webhooks != nil || bus != nil) {
+		dbStore.OnDelete = func(hash string) {
+			if webhooks != nil {
+				webhooks.Send(webhook.EventBlobDeleted, hash)
+			}
+			if bus != nil {
+				bus.Send(events.BlobDeleted, hash)
+			}
+		}
+		dbStore.OnBlocklistHit = func(hash string) {
+			if webhooks != nil {
+				webhooks.Send(webhook.EventBlocklistHit, hash)
+			}
+			if bus != nil {
+				bus.Send(events.BlocklistHit, hash)
+			}
+		}
+	}
+
+	// cache misses are served by the other cluster members' caches when they have the blob
+	var c *cluster.Cluster
+	var siblings *cluster.Siblings
+	cacheOrigin := underlyingStore
+	if clusterPort > 0 {
+		c = newCluster()
+		siblings = cluster.NewSiblings(c, clusterSummary)
+		cacheOrigin = siblings.Store(underlyingStore)
+	}
+	underlyingStoreWithCaches, cleanerStopper := initCaches(cacheOrigin)
+	if diskVerifier != nil {
+		defer diskVerifier.Shutdown()
+	}
 
+	connRate, limiter := initShaping()
+	authorizer := initAuthorizer()
+	var downloadAuthorizer auth.Authorizer
+	if !authUploadsOnly {
+		downloadAuthorizer = authorizer
+	}
+	geoIP, countryRules := initGeoIP()
+	if countryRules != nil {
+		if downloadAuthorizer == nil {
+			downloadAuthorizer = countryRules
+		} else {
+			downloadAuthorizer = auth.All(downloadAuthorizer, countryRules)
+		}
+	}
+	var recorder *capture.Recorder
+	if captureFile != "" {
+		var err error
+		recorder, err = capture.Open(captureFile)
+		checkErr(err)
+		recorder.GeoIP = geoIP
+		recorder.Start()
+		defer recorder.Shutdown()
+	}
+
+	var offenders *reflector.Offenders
+	var apiKeys *apikey.Keys
+	var reflectorServer *reflector.Server
 	if !disableUploads {
-		reflectorServer := reflector.NewServer(underlyingStore, underlyingStoreWithCaches)
+		reflectorServer = reflector.NewServer(underlyingStore, underlyingStoreWithCaches)
 		reflectorServer.Timeout = 3 * time.Minute
 		reflectorServer.EnableBlocklist = !disableBlocklist
+		reflectorServer.EnableHaveFilter = uploadHaveFilter
+		reflectorServer.Authorizer = authorizer
+		setUploadLimits(reflectorServer)
+		if uploadAPIKeys {
+			apiKeys = initAPIKeys()
+			defer apiKeys.Shutdown()
+			reflectorServer.APIKeys = apiKeys
+		}
+		if banFailures > 0 {
+			offenders = reflector.NewOffenders(banFailures, banWindow, banDuration)
+			offenders.AdminToken = globalConfig.AdminToken
+			reflectorServer.Offenders = offenders
+		}
+		hook := newStreamHook(underlyingStoreWithCaches)
+		if hook != nil {
+			err := hook.Start()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer hook.Shutdown()
+		}
+		if hook != nil || webhooks != nil || bus != nil {
+			tracker := streamhook.NewTracker(underlyingStoreWithCaches)
+			tracker.OnComplete = func(sdHash string) {
+				if hook != nil {
+					hook.Enqueue(sdHash)
+				}
+				if webhooks != nil {
+					webhooks.Send(webhook.EventStreamIngested, sdHash)
+				}
+				if bus != nil {
+					bus.Send(events.StreamIngested, sdHash)
+				}
+			}
+			defer tracker.Shutdown()
+			reflectorServer.OnBlobReceived = func(hash string, isSdBlob bool) {
+				if bus != nil {
+					bus.Send(events.BlobStored, hash)
+				}
+				tracker.BlobReceived(hash, isSdBlob)
+			}
+		}
 
 		err := reflectorServer.Start(":" + strconv.Itoa(receiverPort))
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer reflectorServer.Shutdown()
+
+		if pendingStreamTTL > 0 && statsDB != nil {
+			expiryStopper := stop.New()
+			expiryStopper.Add(1)
+			go func() {
+				defer expiryStopper.Done()
+				prism.RunPendingStreamExpiry(statsDB, underlyingStore, pendingStreamTTL, expiryStopper.Ch())
+			}()
+			defer expiryStopper.StopAndWait()
+		}
+	}
+
+	var router store.BlobRouter
+	var memberAuth store.MemberAuth
+	servedStore := underlyingStoreWithCaches
+	if c != nil {
+		replicator := initCluster(c, underlyingStoreWithCaches)
+		defer c.Shutdown()
+		defer replicator.Shutdown()
+		siblings.Caches = diskCaches
+		siblings.Start()
+		defer siblings.Shutdown()
+		router = c
+		memberAuth = c
+		servedStore = store.NewRoutedStore(underlyingStoreWithCaches, c, c)
 	}
 
-	peerServer := peer.NewServer(underlyingStoreWithCaches)
+	peerServer := peer.NewServer(servedStore)
+	peerServer.Authorizer = downloadAuthorizer
+	peerServer.GeoIP = geoIP
+	peerServer.Capture = recorder
+	peerServer.ConnBytesPerSec = connRate
+	peerServer.Limiter = limiter
+	peerServer.Workers = requestQueueSize
+	peerServer.MaxQueued = requestQueueMax
+	peerServer.QueueTarget = requestQueueTarget
+	if authURL != "" && !authUploadsOnly {
+		// every hash of an availability request is a call to the auth-url the first time the connection asks about it
+		peerServer.MaxAvailabilityHashes = remoteAuthAvailabilityHashes
+	}
+	if budget != nil {
+		peerServer.Admit = budget.Admit
+	}
 	err := peerServer.Start(":" + strconv.Itoa(tcpPeerPort))
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer peerServer.Shutdown()
 
-	http3PeerServer := http3.NewServer(underlyingStoreWithCaches, requestQueueSize)
+	http3PeerServer := http3.NewServer(servedStore, requestQueueSize)
+	http3PeerServer.Authorizer = downloadAuthorizer
+	http3PeerServer.Capture = recorder
 	err = http3PeerServer.Start(":" + strconv.Itoa(http3PeerPort))
 	if err != nil {
 		log.Fatal(err)
@@ -131,17 +508,141 @@ func reflectorCmd(cmd *cobra.Command, args []string) {
 	defer http3PeerServer.Shutdown()
 
 	httpServer := http.NewServer(underlyingStoreWithCaches, requestQueueSize)
+	httpServer.Router = router
+	httpServer.MemberAuth = memberAuth
+	httpServer.RedirectToOwner = clusterRedirect
+	httpServer.Authorizer = downloadAuthorizer
+	httpServer.GeoIP = geoIP
+	httpServer.Capture = recorder
+	httpServer.ConnBytesPerSec = connRate
+	httpServer.Limiter = limiter
+	httpServer.MaxQueued = requestQueueMax
+	httpServer.QueueTarget = requestQueueTarget
+	if budget != nil {
+		httpServer.Admit = budget.Admit
+	}
+	httpServer.Inventory = httpInventory
+	if c != nil && clusterRegion != "" {
+		httpServer.Regions = c
+		httpServer.Region = clusterRegion
+		httpServer.Locate = newClientLocator()
+		httpServer.RedirectToRegion = regionRedirect
+	}
+	if siblings != nil {
+		httpServer.ClusterHandler = siblings
+	}
 	err = httpServer.Start(":" + strconv.Itoa(httpPeerPort))
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer httpServer.Shutdown()
 
+	if s3GatewayPort > 0 {
+		gateway := s3gw.NewServer(underlyingStore, underlyingStoreWithCaches)
+		gateway.Bucket = s3GatewayBucket
+		gateway.AccessKey = globalConfig.S3GatewayAccessKey
+		gateway.SecretKey = globalConfig.S3GatewaySecretKey
+		gateway.ReadOnly = disableUploads
+		if authorizer != nil || downloadAuthorizer != nil {
+			// downloads get the same checks as on the peer servers, country rules included, and the rest those of
+			// uploads
+			gateway.Authorizer = auth.Func(func(r auth.Request) error {
+				if r.Action == auth.ActionDownload {
+					return auth.Check(downloadAuthorizer, r)
+				}
+				return auth.Check(authorizer, r)
+			})
+		}
+		if reflectorServer != nil {
+			// puts get the same checks and limits as reflector uploads
+			gateway.Upload = reflectorServer.Accept
+		}
+		if gateway.AccessKey == "" {
+			log.Warnln("s3_gateway_access_key is not set in the config, the s3 gateway is read only and anyone can read blobs over it")
+			gateway.ReadOnly = true
+		}
+		err = gateway.Start(":" + strconv.Itoa(s3GatewayPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer gateway.Shutdown()
+	}
+
+	var warmer *prefetch.Warmer
+	if prefetchStreams > 0 {
+		warmer = initWarmer(underlyingStoreWithCaches)
+		warmer.Start()
+		defer warmer.Shutdown()
+	}
+	if scheduleSpec != "" {
+		scheduler := initScheduler(limiter, warmer)
+		scheduler.Start()
+		defer scheduler.Shutdown()
+	}
+
+	ready := atomic.NewBool(false)
+	if coldStartBlobs > 0 {
+		coldStarter := initColdStart(underlyingStoreWithCaches)
+		go coldStart(coldStarter, ready)
+		defer coldStarter.Shutdown()
+	} else {
+		ready.Store(true)
+	}
+
 	metricsServer := metrics.NewServer(":"+strconv.Itoa(metricsPort), "/metrics")
+	metricsServer.Handle("/ready", readyHandler(ready))
+	// the stats and the dashboard show what clients fetch and where from, so only the admin sees them
+	adminOnly := func(h nethttp.Handler) nethttp.Handler { return auth.RequireToken(globalConfig.AdminToken, h) }
+	if globalConfig.AdminToken == "" && (statsDB != nil || offenders != nil || mirrorStore != nil || shadowCaches != nil || board != nil) {
+		log.Warnf("the /stats and dashboard endpoints refuse all requests: admin_token is not set in the config")
+	}
+	if statsDB != nil {
+		metricsServer.Handle("/stats/popular", adminOnly(popularBlobsHandler(statsDB)))
+	}
+	if offenders != nil {
+		metricsServer.Handle("/stats/offenders", offenders)
+	}
+	if mirrorStore != nil {
+		metricsServer.Handle("/stats/mirror", adminOnly(mirrorStore))
+	}
+	if shadowCaches != nil {
+		shadowCaches.Start()
+		defer shadowCaches.Shutdown()
+		metricsServer.Handle("/stats/shadow", adminOnly(shadowCaches))
+	}
+	if board != nil {
+		board.Cluster = c
+		if upstreamDht != nil {
+			board.WatchDHT(upstreamDht)
+		}
+		metricsServer.Handle(dashboard.Path, adminOnly(board))
+	}
+	if enablePprof {
+		if globalConfig.AdminToken == "" {
+			log.Warnf("pprof endpoints are off: admin_token is not set in the config")
+		}
+		metricsServer.ExtendWriteTimeout(profiling.WriteTimeout)
+		profiling.Register(metricsServer, globalConfig.AdminToken)
+	}
+	if upstreamDht != nil && upstreamDhtRPC > 0 {
+		registerDHTAdmin(metricsServer, upstreamDhtRPC)
+	}
+	if c != nil && clusterKeyring != "" {
+		registerClusterKeys(metricsServer, c)
+	}
+	if apiKeys != nil {
+		registerAPIKeys(metricsServer, apiKeys)
+	}
+	if heapWatcher := initHeapWatcher(); heapWatcher != nil {
+		defer heapWatcher.Shutdown()
+	}
 	metricsServer.Start()
 	defer metricsServer.Shutdown()
 	defer underlyingStoreWithCaches.Shutdown()
 	defer underlyingStore.Shutdown() //do we actually need this? Oo
+	if upstreamDht != nil {
+		defer upstreamDht.Shutdown()
+	}
 
 	interruptChan := make(chan os.Signal, 1)
 	signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM)
@@ -152,14 +653,16 @@ func reflectorCmd(cmd *cobra.Command, args []string) {
 
 func initUpstreamStore() store.BlobStore {
 	var s store.BlobStore
-	if upstreamReflector == "" {
+	if upstreamReflector == "" && upstreamProtocol != "dht" {
 		return nil
 	}
 	switch upstreamProtocol {
 	case "tcp":
 		s = peer.NewStore(peer.StoreOpts{
-			Address: upstreamReflector,
-			Timeout: 30 * time.Second,
+			Address:     upstreamReflector,
+			Timeout:     30 * time.Second,
+			MaxConns:    upstreamMaxConns,
+			IdleTimeout: upstreamIdleTimeout,
 		})
 	case "http3":
 		s = http3.NewStore(http3.StoreOpts{
@@ -168,20 +671,41 @@ func initUpstreamStore() store.BlobStore {
 		})
 	case "http":
 		s = store.NewHttpStore(upstreamReflector)
+	case "dht":
+		dhtConf := dht.NewStandardConfig()
+		dhtConf.Address = "0.0.0.0:" + strconv.Itoa(upstreamDhtPort)
+		dhtConf.PeerProtocolPort = tcpPeerPort
+		dhtConf.RPCPort = upstreamDhtRPC
+		dhtConf.NodeID = loadDHTNodeID(upstreamDhtIDFile, upstreamDhtIDRange)
+		upstreamDht = dht.New(dhtConf)
+		err := upstreamDht.Start()
+		if err != nil {
+			log.Fatal(err)
+		}
+		s = peer.NewPeerSwarmStore(upstreamDht, peer.SwarmStoreOpts{
+			Timeout:         30 * time.Second,
+			UseV2:           true,
+			MaxConnsPerPeer: upstreamMaxConns,
+			IdleTimeout:     upstreamIdleTimeout,
+		})
 	default:
 		log.Fatalf("protocol is not recognized: %s", upstreamProtocol)
 	}
-	return s
+	return store.NewCircuitBreakerStore("upstream", s)
 }
 func initEdgeStore() store.BlobStore {
 	var s3Store *store.S3Store
 	var s store.BlobStore
 
 	if conf != "none" {
-		s3Store = store.NewS3Store(globalConfig.AwsID, globalConfig.AwsSecret, globalConfig.BucketRegion, globalConfig.BucketName)
+		s3Store = newS3Store(globalConfig.BucketName)
 	}
 	if originEndpointFallback != "" && originEndpoint != "" {
-		ittt := store.NewITTTStore(store.NewCloudFrontROStore(originEndpoint), store.NewCloudFrontROStore(originEndpointFallback))
+		ittt := store.NewITTTStore(
+			store.NewCircuitBreakerStore("origin", store.NewCloudFrontROStore(originEndpoint)),
+			store.NewCircuitBreakerStore("origin-fallback", store.NewCloudFrontROStore(originEndpointFallback)),
+		)
+		ittt.Policy = getTierPolicy()
 		if s3Store != nil {
 			s = store.NewCloudFrontRWStore(ittt, s3Store)
 		} else {
@@ -192,19 +716,32 @@ func initEdgeStore() store.BlobStore {
 	} else {
 		log.Fatalf("this configuration does not include a valid upstream source")
 	}
+	if mirrorTo != "" {
+		secondary, err := storeFromSpec(mirrorTo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mirrorStore = store.NewMirrorStore(s, secondary)
+		mirrorStore.Policy = getTierPolicy()
+		s = mirrorStore
+	}
 	return s
 }
 
 func initDBStore(s store.BlobStore) store.BlobStore {
 	if useDB {
 		dbInst := &db.SQL{
-			TrackAccess: db.TrackAccessStreams,
-			LogQueries:  log.GetLevel() == log.DebugLevel,
+			TrackAccess:         db.TrackAccessStreams,
+			LogQueries:          log.GetLevel() == log.DebugLevel,
+			ReadDSNs:            globalConfig.DBReadConns,
+			ReplicaMaxLag:       time.Duration(globalConfig.DBReplicaMaxLag) * time.Second,
+			AccessFlushInterval: accessFlushInterval,
 		}
 		err := dbInst.Connect(globalConfig.DBConn)
 		if err != nil {
 			log.Fatal(err)
 		}
+		statsDB = dbInst
 		s = store.NewDBBackedStore(s, dbInst, false)
 	}
 	return s
@@ -215,6 +752,11 @@ func initStores() store.BlobStore {
 	if s == nil {
 		s = initEdgeStore()
 	}
+	middlewares, err := store.ParseMiddlewares(originMiddleware, "origin")
+	if err != nil {
+		log.Fatal(err)
+	}
+	s = store.Chain(s, middlewares...)
 	s = initDBStore(s)
 	return s
 }
@@ -225,18 +767,44 @@ func initCaches(s store.BlobStore) (store.BlobStore, *stop.Group) {
 	diskStore := initDiskStore(s, diskCache, stopper)
 	finalStore := initDiskStore(diskStore, secondaryDiskCache, stopper)
 	stop.New()
-	if memCache > 0 {
-		finalStore = store.NewCachingStore(
+	if shadowCacheSpec != "" {
+		initShadowCaches(finalStore)
+	}
+	var memCacheBytes datasize.ByteSize
+	err := memCacheBytes.UnmarshalText([]byte(memCacheSize))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if memCacheBytes > 0 {
+		memCachingStore := store.NewCachingStore(
+			"reflector",
+			finalStore,
+			store.NewMemStoreWithOpts(store.MemStoreOpts{
+				MaxBytes:  int64(memCacheBytes),
+				Shards:    memCacheShards,
+				Component: "reflector",
+			}),
+		)
+		memCachingStore.Policy = getTierPolicy()
+		finalStore = memCachingStore
+	} else if memCache > 0 {
+		memCachingStore := store.NewCachingStore(
 			"reflector",
 			finalStore,
 			store.NewGcacheStore("mem", store.NewMemStore(), memCache, store.LRU),
 		)
+		memCachingStore.Policy = getTierPolicy()
+		finalStore = memCachingStore
+	}
+	if readAheadBlobs > 0 {
+		finalStore = store.NewReadAheadStore(finalStore, readAheadBlobs)
 	}
 	return finalStore, stopper
 }
 
 func initDiskStore(upstreamStore store.BlobStore, diskParams string, stopper *stop.Group) store.BlobStore {
-	diskCacheMaxSize, diskCachePath, cacheManager := diskCacheParams(diskParams)
+	spec := diskCacheParams(diskParams)
+	diskCacheMaxSize, diskCachePath, cacheManager := spec.size, spec.path, spec.cacheManager
 	//we are tracking blobs in memory with a 1 byte long boolean, which means that for each 2MB (a blob) we need 1Byte
 	// so if the underlying cache holds 10MB, 10MB/2MB=5Bytes which is also the exact count of objects to restore on startup
 	realCacheSize := float64(diskCacheMaxSize) / float64(stream.MaxBlobSize)
@@ -248,65 +816,489 @@ func initDiskStore(upstreamStore store.BlobStore, diskParams string, stopper *st
 		log.Fatal(err)
 	}
 
-	diskStore := store.NewDiskStore(diskCachePath, 2)
+	diskStore := withVerifier(spec.withTmp(store.NewDiskStore(diskCachePath, 2)))
 	var unwrappedStore store.BlobStore
 	cleanerStopper := stop.New(stopper)
 
 	if cacheManager == "localdb" {
 		localDb := &db.SQL{
-			SoftDelete:  true,
-			TrackAccess: db.TrackAccessBlobs,
-			LogQueries:  log.GetLevel() == log.DebugLevel,
+			SoftDelete:          true,
+			TrackAccess:         db.TrackAccessBlobs,
+			LogQueries:          log.GetLevel() == log.DebugLevel,
+			AccessFlushInterval: accessFlushInterval,
+			EvictionGracePeriod: db.DefaultEvictionGracePeriod,
 		}
 		err = localDb.Connect("reflector:reflector@tcp(localhost:3306)/reflector")
 		if err != nil {
 			log.Fatal(err)
 		}
+		if statsDB == nil {
+			statsDB = localDb
+		}
 		unwrappedStore = store.NewDBBackedStore(diskStore, localDb, true)
 		go cleanOldestBlobs(int(realCacheSize), localDb, unwrappedStore, cleanerStopper)
 	} else {
-		unwrappedStore = store.NewGcacheStore("nvme", store.NewDiskStore(diskCachePath, 2), int(realCacheSize), cacheMangerToGcache[cacheManager])
+		if useDiskIndex {
+			diskStore = withVerifier(spec.withTmp(store.NewIndexedDiskStore(diskCachePath, 2)))
+		}
+		unwrappedStore = store.NewGcacheStore("nvme", diskStore, int(realCacheSize), cacheMangerToGcache[cacheManager])
 	}
+	diskCaches = append(diskCaches, unwrappedStore)
 
 	wrapped := store.NewCachingStore(
 		"reflector",
 		upstreamStore,
 		unwrappedStore,
 	)
+	wrapped.Policy = getTierPolicy()
+	if cacheAdmission {
+		wrapped.EnableAdmission(int(realCacheSize))
+	}
 	return wrapped
 }
 
-func diskCacheParams(diskParams string) (int, string, string) {
+// initShadowCaches simulates the --shadow-caches on the requests of the outer disk cache
+func initShadowCaches(s store.BlobStore) {
+	caching, ok := s.(*store.CachingStore)
+	if !ok {
+		log.Fatal("--shadow-caches needs a disk cache")
+	}
+	var err error
+	shadowCaches, err = shadow.Parse(shadowCacheSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	caching.Shadow = shadowCaches
+}
+
+// initMemoryBudget starts the memory budget if there's a max memory, or returns nil. The in-memory cache and the
+// request queues are sized from it unless their flags were given
+func initMemoryBudget(cmd *cobra.Command) *membudget.Budget {
+	var total datasize.ByteSize
+	err := total.UnmarshalText([]byte(maxMemory))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if total == 0 {
+		return nil
+	}
+	b := membudget.New(int64(total))
+	if !cmd.Flags().Changed("mem-cache-size") && !cmd.Flags().Changed("mem-cache") {
+		memCacheSize = strconv.FormatInt(b.MemCacheBytes(), 10)
+	}
+	if !cmd.Flags().Changed("request-queue-size") {
+		// the tcp, http3 and http peer servers share the transfers
+		requestQueueSize = b.Transfers() / 3
+		if requestQueueSize < 1 {
+			requestQueueSize = 1
+		}
+	}
+	b.Start()
+	return b
+}
+
+// initHeapWatcher starts writing heap profiles if there's a heap profile watermark, or returns nil
+func initHeapWatcher() *profiling.HeapWatcher {
+	var watermark datasize.ByteSize
+	err := watermark.UnmarshalText([]byte(heapProfileWatermark))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if watermark == 0 {
+		return nil
+	}
+	if heapProfileDir == "" {
+		log.Fatal("--heap-profile-watermark needs --heap-profile-dir")
+	}
+	w := profiling.NewHeapWatcher(heapProfileDir, uint64(watermark))
+	err = w.Start()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return w
+}
+
+// setUploadLimits applies the upload limit flags to the reflector server
+func setUploadLimits(s *reflector.Server) {
+	var blobSize, dailyUpload datasize.ByteSize
+	err := blobSize.UnmarshalText([]byte(maxBlobSize))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = dailyUpload.UnmarshalText([]byte(maxDailyUpload))
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.MaxBlobSize = int(blobSize)
+	s.MaxStreamBlobs = maxStreamBlobs
+	s.MaxDailyUpload = int64(dailyUpload)
+}
+
+// initShaping returns the rate limit for each connection, and the limiter shared by all of them if there is a total
+// limit
+func initShaping() (int64, *ratelimit.Limiter) {
+	var connRate, totalRate datasize.ByteSize
+	err := connRate.UnmarshalText([]byte(connMaxRate))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = totalRate.UnmarshalText([]byte(totalMaxRate))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var limiter *ratelimit.Limiter
+	if totalRate > 0 || scheduleSpec != "" {
+		// the schedule may set a total limit at some times of the day
+		limiter = ratelimit.NewBurst(int64(totalRate), int64(totalRate), nil)
+	}
+	return int64(connRate), limiter
+}
+
+// initScheduler returns a scheduler that changes the total rate limit, the prefetch passes and the eviction batch size
+// with the time of day. The flags are the default settings
+func initScheduler(limiter *ratelimit.Limiter, warmer *prefetch.Warmer) *schedule.Scheduler {
+	windows, err := schedule.Parse(scheduleSpec)
+	checkErr(err)
+	var totalRate, prefetchRate datasize.ByteSize
+	checkErr(totalRate.UnmarshalText([]byte(totalMaxRate)))
+	checkErr(prefetchRate.UnmarshalText([]byte(prefetchMaxRate)))
+
+	s := schedule.New(windows)
+	s.Default = schedule.Settings{
+		MaxRate:         int64(totalRate),
+		PrefetchStreams: prefetchStreams,
+		PrefetchMaxRate: int64(prefetchRate),
+		EvictPercent:    diskEvictPercent,
+	}
+	s.OnChange = func(window string, settings schedule.Settings) {
+		limiter.SetRate(settings.MaxRate, settings.MaxRate)
+		if warmer != nil {
+			warmer.SetLimits(settings.PrefetchStreams, settings.PrefetchMaxRate)
+		}
+		evictPercent.Store(int32(settings.EvictPercent))
+	}
+	return s
+}
+
+// initAuthorizer returns the authorizer for the configured access controls, or nil if there are none. A request must
+// pass all of them
+func initAuthorizer() auth.Authorizer {
+	var authorizers []auth.Authorizer
+	if len(authAllowIPs) > 0 {
+		allowlist, err := auth.NewIPAllowlist(authAllowIPs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		authorizers = append(authorizers, allowlist)
+	}
+	if authJWTSecret != "" {
+		authorizers = append(authorizers, auth.NewJWT(authJWTSecret))
+	}
+	if authURL != "" {
+		authorizers = append(authorizers, auth.NewRemote(authURL, authURLTimeout))
+	}
+	if len(authorizers) == 0 {
+		return nil
+	}
+	return auth.All(authorizers...)
+}
+
+// initGeoIP opens the geoip database, and returns the rules for the countries blobs may be served to, or nil if there
+// are none
+func initGeoIP() (*geo.Database, *geo.CountryRules) {
+	if geoIPDB == "" {
+		if len(geoIPAllowCountries) > 0 || len(geoIPBlockCountries) > 0 || geoIPBlockUnknown {
+			log.Fatal("--geoip-db is needed to allow or block countries")
+		}
+		return nil, nil
+	}
+	db, err := geo.OpenDatabase(geoIPDB)
+	checkErr(err)
+	if len(geoIPAllowCountries) == 0 && len(geoIPBlockCountries) == 0 && !geoIPBlockUnknown {
+		return db, nil
+	}
+	rules := geo.NewCountryRules(db, geoIPAllowCountries, geoIPBlockCountries)
+	rules.BlockUnknown = geoIPBlockUnknown
+	return db, rules
+}
+
+func newCluster() *cluster.Cluster {
+	if clusterHTTPAddr == "" {
+		log.Fatal("--cluster-http-addr is needed to join a cluster")
+	}
+	if clusterKeyring == "" {
+		log.Fatal("--cluster-keyring is needed to join a cluster: members sign the requests they send each other with it")
+	}
+	c := cluster.New(clusterPort, clusterSeedAddr)
+	c.Tags = map[string]string{cluster.TagHTTPAddr: clusterHTTPAddr}
+	c.Replicas = clusterReplicas
+	roles, err := cluster.ParseRoles(clusterRoles)
+	checkErr(err)
+	c.Roles = roles
+	c.KeyringFile = clusterKeyring
+	c.Region = clusterRegion
+	c.OnMembershipChange = func(n, total int) {
+		log.Infof("cluster membership changed, %d members", total)
+	}
+	return c
+}
+
+// newClientLocator returns what finds the region of http clients, from --client-region-networks and the country header.
+// It returns nil if neither is set
+func newClientLocator() func(r *nethttp.Request) string {
+	if clientRegionNetworks == "" && clientCountryHeader == "" {
+		return nil
+	}
+	locator := &geo.Locator{CountryHeader: clientCountryHeader}
+	countries, err := geo.ParseCountries(clientCountryRegions)
+	checkErr(err)
+	locator.Countries = countries
+	if clientRegionNetworks != "" {
+		checkErr(locator.LoadNetworks(clientRegionNetworks))
+	}
+	return locator.Locate
+}
+
+// initCluster starts replicating blobs of s and joins the cluster
+func initCluster(c *cluster.Cluster, s store.BlobStore) *cluster.Replicator {
+	replicator := cluster.NewReplicator(c, s)
+	c.OnRingChange = replicator.RingChanged
+	replicator.Start()
+
+	err := c.Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return replicator
+}
+
+func initWarmer(s store.BlobStore) *prefetch.Warmer {
+	var source prefetch.Source
+	if prefetchURL != "" {
+		source = prefetch.URLSource(prefetchURL)
+	} else if statsDB != nil && accessFlushInterval > 0 {
+		source = prefetch.DBSource(statsDB)
+	} else {
+		log.Fatal("prefetching needs --prefetch-url or access counts in the db (--access-flush-interval)")
+	}
+
+	var startHour, endHour int
+	_, err := fmt.Sscanf(prefetchHours, "%d-%d", &startHour, &endHour)
+	if err != nil || startHour < 0 || startHour > 23 || endHour < 0 || endHour > 23 {
+		log.Fatalf("prefetch hours must look like 2-6, got %s", prefetchHours)
+	}
+
+	var maxRate datasize.ByteSize
+	err = maxRate.UnmarshalText([]byte(prefetchMaxRate))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return prefetch.NewWarmer(s, source, prefetch.WarmerOpts{
+		Limit:          prefetchStreams,
+		StartHour:      startHour,
+		EndHour:        endHour,
+		Interval:       prefetchInterval,
+		MaxBytesPerSec: int64(maxRate),
+	})
+}
+
+func initColdStart(s store.BlobStore) *prefetch.Warmer {
+	var source prefetch.Source
+	if coldStartManifest != "" {
+		source = prefetch.ManifestSource(coldStartManifest)
+	} else if statsDB != nil && accessFlushInterval > 0 {
+		source = prefetch.DBSource(statsDB)
+	} else {
+		log.Fatal("a cold start needs --cold-start-manifest or access counts in the db (--access-flush-interval)")
+	}
+	// no time window or rate limit. the node isn't serving much until it's done
+	return prefetch.NewWarmer(s, source, prefetch.WarmerOpts{Limit: coldStartBlobs})
+}
+
+// coldStart fills the disk caches if they are empty, then marks the node ready
+func coldStart(w *prefetch.Warmer, ready *atomic.Bool) {
+	defer ready.Store(true)
+	for _, c := range diskCaches {
+		hashes, err := store.List(c)
+		if err != nil {
+			log.Warnf("skipping the cold start, can't tell if the %s cache is empty: %s", c.Name(), err.Error())
+			return
+		}
+		if len(hashes) > 0 {
+			return
+		}
+	}
+
+	log.Infof("disk caches are empty, fetching the %d most popular streams before reporting ready", coldStartBlobs)
+	start := time.Now()
+	fetched, err := w.Pass()
+	if err != nil {
+		log.Errorf("cold start failed: %s", errors.FullTrace(err))
+		return
+	}
+	log.Infof("cold start fetched %d blobs in %s", fetched, time.Since(start).Round(time.Second))
+}
+
+func readyHandler(ready *atomic.Bool) nethttp.HandlerFunc {
+	return func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if !ready.Load() {
+			nethttp.Error(w, "warming up", nethttp.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ready\n"))
+	}
+}
+
+// diskCacheSpec is a parsed disk cache flag
+type diskCacheSpec struct {
+	size         int
+	path         string
+	cacheManager string
+	// tmp is where blobs are written before they're moved into the cache. It's a path, "shard" for a tmp dir in each
+	// prefix dir, or empty for the default of CACHE_PATH/tmp
+	tmp string
+}
+
+// remoteAuthAvailabilityHashes is how many hashes a peer availability request may ask about when the auth-url decides
+// downloads
+const remoteAuthAvailabilityHashes = 32
+
+// tmpShard is the tmp location that puts a tmp dir in each prefix dir of the disk cache
+const tmpShard = "shard"
+
+func diskCacheParams(diskParams string) diskCacheSpec {
+	spec, err := parseDiskCacheParams(diskParams)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return spec
+}
+
+// parseDiskCacheParams parses a disk cache flag. It returns a size of 0 if the flag is empty
+func parseDiskCacheParams(diskParams string) (diskCacheSpec, error) {
 	if diskParams == "" {
-		return 0, "", ""
+		return diskCacheSpec{}, nil
 	}
 
 	parts := strings.Split(diskParams, ":")
-	if len(parts) != 3 {
-		log.Fatalf("%s does is formatted incorrectly. Expected format: 'sizeGB:CACHE_PATH:cachemanager' for example: '100GB:/tmp/downloaded_blobs:localdb'", diskParams)
+	if len(parts) != 3 && len(parts) != 4 {
+		return diskCacheSpec{}, errors.Err("%s does is formatted incorrectly. Expected format: 'sizeGB:CACHE_PATH:cachemanager[:TMP_PATH]' for example: '100GB:/tmp/downloaded_blobs:localdb'", diskParams)
 	}
 
 	diskCacheSize := parts[0]
-	path := parts[1]
-	cacheManager := parts[2]
+	spec := diskCacheSpec{path: parts[1], cacheManager: parts[2]}
+	if len(parts) == 4 {
+		spec.tmp = parts[3]
+	}
 
-	if len(path) == 0 || path[0] != '/' {
-		log.Fatalf("disk cache paths must start with '/'")
+	if len(spec.path) == 0 || spec.path[0] != '/' {
+		return diskCacheSpec{}, errors.Err("disk cache paths must start with '/'")
+	}
+	if spec.tmp != "" && spec.tmp != tmpShard && spec.tmp[0] != '/' {
+		return diskCacheSpec{}, errors.Err("disk cache tmp paths must start with '/' or be '%s'", tmpShard)
 	}
 
-	if !util.InSlice(cacheManager, cacheManagers) {
-		log.Fatalf("specified cache manager '%s' is not supported. Use one of the following: %v", cacheManager, cacheManagers)
+	if !util.InSlice(spec.cacheManager, cacheManagers) {
+		return diskCacheSpec{}, errors.Err("specified cache manager '%s' is not supported. Use one of the following: %v", spec.cacheManager, cacheManagers)
 	}
 
 	var maxSize datasize.ByteSize
 	err := maxSize.UnmarshalText([]byte(diskCacheSize))
 	if err != nil {
-		log.Fatal(err)
+		return diskCacheSpec{}, errors.Err(err)
 	}
 	if maxSize <= 0 {
-		log.Fatal("disk cache size must be more than 0")
+		return diskCacheSpec{}, errors.Err("disk cache size must be more than 0")
 	}
-	return int(maxSize), path, cacheManager
+	spec.size = int(maxSize)
+	return spec, nil
+}
+
+// withTmp applies the tmp location of the spec to a disk store
+func (spec diskCacheSpec) withTmp(d *store.DiskStore) *store.DiskStore {
+	switch spec.tmp {
+	case "":
+		return d
+	case tmpShard:
+		return d.WithShardTmpDirs()
+	default:
+		return d.WithTmpDir(spec.tmp)
+	}
+}
+
+// withVerifier has the disk store verify blobs after serving them if --verify-workers is set
+func withVerifier(d *store.DiskStore) *store.DiskStore {
+	if verifyWorkers <= 0 {
+		return d
+	}
+	if diskVerifier == nil {
+		diskVerifier = store.NewVerifier(verifyWorkers, store.DefaultVerifyQueue)
+		diskVerifier.Start()
+	}
+	return d.WithVerifier(diskVerifier)
+}
+
+// registerClusterKeys serves the rotation of the cluster's gossip keys under /cluster/keys, to clients with the admin
+// token
+func registerClusterKeys(mux dhtadmin.Mux, c *cluster.Cluster) {
+	if globalConfig.AdminToken == "" {
+		log.Warnf("cluster key endpoints are off: admin_token is not set in the config")
+		return
+	}
+	h := cluster.NewKeysHandler(c, globalConfig.AdminToken)
+	mux.Handle(cluster.KeysPath, h)
+	mux.Handle(cluster.KeysPath+"/", h)
+}
+
+// initAPIKeys reads the api keys uploads need from the db
+func initAPIKeys() *apikey.Keys {
+	if statsDB == nil {
+		log.Fatal("--upload-api-keys needs the db, the keys are kept there")
+	}
+	keys := apikey.New(statsDB)
+	err := keys.Start()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return keys
+}
+
+// registerAPIKeys serves the creation and revocation of upload api keys under /apikeys, to clients with the admin token
+func registerAPIKeys(mux dhtadmin.Mux, keys *apikey.Keys) {
+	if globalConfig.AdminToken == "" {
+		log.Warnf("api key endpoints are off: admin_token is not set in the config")
+		return
+	}
+	h := apikey.NewHandler(keys, globalConfig.AdminToken)
+	mux.Handle(apikey.Path, h)
+	mux.Handle(apikey.Path+"/", h)
+}
+
+// registerDHTAdmin serves the operations of the dht node whose rpc server is on rpcPort under /dht/, to clients with
+// the admin token
+func registerDHTAdmin(server *metrics.Server, rpcPort int) {
+	if globalConfig.AdminToken == "" {
+		log.Warnf("dht admin endpoints are off: admin_token is not set in the config")
+		return
+	}
+	h := dhtadmin.New("127.0.0.1:"+strconv.Itoa(rpcPort), globalConfig.AdminToken)
+	// lookups through the node take up to the timeout of the client, longer than the metrics take to write
+	server.ExtendWriteTimeout(h.Timeout + 5*time.Second)
+	h.Register(server)
+}
+
+// getTierPolicy returns the --tier-policy, or nil for the default fallbacks of each store
+func getTierPolicy() *store.TierPolicy {
+	if tierPolicySpec == "" || tierPolicy != nil {
+		return tierPolicy
+	}
+	p, err := store.ParseTierPolicy(tierPolicySpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tierPolicy = p
+	return tierPolicy
 }
 
 func cleanOldestBlobs(maxItems int, db *db.SQL, store store.BlobStore, stopper *stop.Group) {
@@ -337,8 +1329,8 @@ func doClean(maxItems int, db *db.SQL, store store.BlobStore, stopper *stop.Grou
 	}
 
 	if blobsCount >= maxItems {
-		itemsToDelete := blobsCount / 10
-		blobs, err := db.LeastRecentlyAccessedHashes(itemsToDelete)
+		itemsToDelete := blobsCount * int(evictPercent.Load()) / 100
+		blobs, err := db.EvictionCandidates(itemsToDelete)
 		if err != nil {
 			return err
 		}
@@ -377,3 +1369,30 @@ func doClean(maxItems int, db *db.SQL, store store.BlobStore, stopper *stop.Grou
 	}
 	return nil
 }
+
+// popularBlobsHandler lists the most requested blobs or streams. The number of results is set with ?limit=
+func popularBlobsHandler(sql *db.SQL) nethttp.HandlerFunc {
+	return func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		limit := 100
+		if l := r.URL.Query().Get("limit"); l != "" {
+			var err error
+			limit, err = strconv.Atoi(l)
+			if err != nil || limit <= 0 || limit > 10000 {
+				nethttp.Error(w, "limit must be between 1 and 10000", nethttp.StatusBadRequest)
+				return
+			}
+		}
+
+		stats, err := sql.MostAccessed(limit)
+		if err != nil {
+			log.Errorf("error getting popular blobs: %s", errors.FullTrace(err))
+			nethttp.Error(w, err.Error(), nethttp.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(stats)
+		if err != nil {
+			log.Errorf("error writing popular blobs: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/capture"
+	"github.com/lbryio/reflector.go/server/http3"
+	"github.com/lbryio/reflector.go/server/peer"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/c2h5oh/datasize"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	replayProtocol    string
+	replaySpeed       float64
+	replayConcurrency int
+	replayClasses     []string
+	replayTimeout     time.Duration
+)
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "replay CAPTURE ADDRESS:PORT",
+		Short: "Replay the requests of a capture against a reflector",
+		Long: `Requests the blobs of a capture made with reflector --capture-requests from the reflector at ADDRESS:PORT,
+at the pace they were captured, and prints the hit counts and latencies. Use it to benchmark a change on real traffic.`,
+		Args: cobra.ExactArgs(2),
+		Run:  replayCmd,
+	}
+	cmd.Flags().StringVar(&replayProtocol, "protocol", "http", "Protocol to request the blobs with (tcp/http3/http)")
+	cmd.Flags().Float64Var(&replaySpeed, "speed", 1, "How many times faster than captured to replay the requests. 0 replays them as fast as the concurrency allows")
+	cmd.Flags().IntVar(&replayConcurrency, "concurrency", 100, "How many requests can be in flight at once. Requests that have to wait for one are late, which the report counts")
+	cmd.Flags().StringSliceVar(&replayClasses, "classes", nil, "Only replay the requests of these client classes, like http/US, or peer for the peer requests of every country")
+	cmd.Flags().DurationVar(&replayTimeout, "timeout", 30*time.Second, "Timeout of each request over tcp and http3")
+	rootCmd.AddCommand(cmd)
+}
+
+// replayReport sums up the results of the replayed requests
+type replayReport struct {
+	mu        sync.Mutex
+	requests  int
+	notFound  int
+	errors    int
+	bytes     int64
+	late      int
+	maxLag    time.Duration
+	latencies []time.Duration
+}
+
+func (r *replayReport) add(latency time.Duration, size int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	switch {
+	case errors.Is(err, store.ErrBlobNotFound):
+		r.notFound++
+	case err != nil:
+		r.errors++
+		log.Debugf("replay: %s", err)
+	default:
+		r.bytes += int64(size)
+		r.latencies = append(r.latencies, latency)
+	}
+}
+
+func (r *replayReport) lag(lag time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.late++
+	if lag > r.maxLag {
+		r.maxLag = lag
+	}
+}
+
+func (r *replayReport) print(elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Printf("requests:  %d in %s (%.1f/s)\n", r.requests, elapsed.Round(time.Second), float64(r.requests)/elapsed.Seconds())
+	fmt.Printf("served:    %d, %s (%s/s)\n", len(r.latencies), datasize.ByteSize(r.bytes).HR(), datasize.ByteSize(float64(r.bytes)/elapsed.Seconds()).HR())
+	fmt.Printf("not found: %d\n", r.notFound)
+	fmt.Printf("errors:    %d\n", r.errors)
+	fmt.Printf("late:      %d (at most %s)\n", r.late, r.maxLag.Round(time.Millisecond))
+	if len(r.latencies) > 0 {
+		fmt.Printf("latency:   %s\n", latencySummary(r.latencies))
+	}
+}
+
+// latencySummary sorts the latencies and returns their percentiles
+func latencySummary(latencies []time.Duration) string {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return fmt.Sprintf("p50 %s, p90 %s, p99 %s, max %s", percentile(latencies, 0.5), percentile(latencies, 0.9),
+		percentile(latencies, 0.99), percentile(latencies, 1))
+}
+
+// percentile returns the latency at p (0 to 1) of the sorted latencies
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	return latencies[int(p*float64(len(latencies)-1))].Round(time.Microsecond)
+}
+
+func replayCmd(cmd *cobra.Command, args []string) {
+	if replaySpeed < 0 {
+		log.Fatal("--speed can't be negative")
+	}
+	if replayConcurrency < 1 {
+		log.Fatal("--concurrency must be at least 1")
+	}
+	f, err := os.Open(args[0])
+	checkErr(err)
+	defer f.Close()
+	target := downloadStore(replayProtocol, args[1], replayTimeout, replayConcurrency)
+
+	interruptChan := make(chan os.Signal, 1)
+	signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM)
+
+	report := &replayReport{}
+	slots := make(chan struct{}, replayConcurrency)
+	wg := &sync.WaitGroup{}
+	start := time.Now()
+	var first int64
+	reader := capture.NewReader(f)
+
+replay:
+	for {
+		req, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		checkErr(err)
+		if !replayClass(req.Class) {
+			continue
+		}
+
+		if replaySpeed > 0 {
+			if first == 0 {
+				first = req.Time
+			}
+			at := start.Add(time.Duration(float64(time.Duration(req.Time-first)*time.Millisecond) / replaySpeed))
+			select {
+			case <-interruptChan:
+				break replay
+			case <-time.After(time.Until(at)):
+			}
+			select {
+			case slots <- struct{}{}:
+			default:
+				select {
+				case <-interruptChan:
+					break replay
+				case slots <- struct{}{}:
+				}
+				report.lag(time.Since(at))
+			}
+		} else {
+			select {
+			case <-interruptChan:
+				break replay
+			case slots <- struct{}{}:
+			}
+		}
+
+		wg.Add(1)
+		go func(hash string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			reqStart := time.Now()
+			blob, _, err := target.Get(hash)
+			report.add(time.Since(reqStart), len(blob), err)
+		}(req.Hash)
+	}
+	wg.Wait()
+	target.Shutdown()
+
+	report.print(time.Since(start))
+}
+
+// downloadStore returns the store that requests blobs from the reflector at addr over protocol, with up to conns
+// connections at once
+func downloadStore(protocol, addr string, timeout time.Duration, conns int) store.BlobStore {
+	switch protocol {
+	case "tcp":
+		return peer.NewStore(peer.StoreOpts{Address: addr, Timeout: timeout, MaxConns: conns})
+	case "http3":
+		return http3.NewStore(http3.StoreOpts{Address: addr, Timeout: timeout})
+	case "http":
+		return store.NewHttpStore(addr)
+	}
+	log.Fatalf("protocol is not recognized: %s", protocol)
+	return nil
+}
+
+// replayClass returns whether requests of the client class are replayed
+func replayClass(class string) bool {
+	if len(replayClasses) == 0 {
+		return true
+	}
+	for _, c := range replayClasses {
+		if class == c || strings.HasPrefix(class, c+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -1,38 +1,68 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/lbryio/reflector.go/wallet"
 
 	"github.com/spf13/cobra"
 )
 
+var (
+	resolveTimeout time.Duration
+	resolveQuorum  int
+	resolveProxy   string
+	resolveTLS     bool
+	resolvePins    []string
+	resolveCAFile  string
+)
+
 func init() {
 	var cmd = &cobra.Command{
-		Use:   "resolve ADDRESS:PORT URL",
+		Use:   "resolve ADDRESS:PORT[,ADDRESS:PORT...] URL",
 		Short: "Resolve a URL",
 		Args:  cobra.ExactArgs(2),
 		Run:   resolveCmd,
 	}
+	cmd.Flags().DurationVar(&resolveTimeout, "timeout", wallet.DefaultTimeout, "how long to wait for each response from the wallet server")
+	cmd.Flags().IntVar(&resolveQuorum, "quorum", 1, "how many of the wallet servers must return the same claim")
+	cmd.Flags().StringVar(&resolveProxy, "proxy", "", "connect through a proxy, e.g. socks5://127.0.0.1:9050 or http://proxy:3128")
+	cmd.Flags().BoolVar(&resolveTLS, "tls", false, "connect to the wallet servers with TLS")
+	cmd.Flags().StringSliceVar(&resolvePins, "pin", nil, "hex sha256 of a server certificate's public key to accept (implies --tls)")
+	cmd.Flags().StringVar(&resolveCAFile, "ca-file", "", "PEM file of the CAs that sign the servers' certificates (implies --tls)")
 	rootCmd.AddCommand(cmd)
 }
 
 func resolveCmd(cmd *cobra.Command, args []string) {
-	addr := args[0]
+	addrs := strings.Split(args[0], ",")
 	url := args[1]
 
-	node := wallet.NewNode()
-	defer node.Shutdown()
-	err := node.Connect([]string{addr}, nil)
+	var config *tls.Config
+	if resolveTLS || len(resolvePins) > 0 || resolveCAFile != "" {
+		var err error
+		config, err = wallet.PinnedTLSConfig(resolvePins, resolveCAFile)
+		checkErr(err)
+	}
+
+	node := wallet.NewNodePool(resolveQuorum)
+	if resolveProxy != "" {
+		checkErr(node.SetProxy(resolveProxy))
+	}
+	err := node.Connect(addrs, config)
 	checkErr(err)
+	defer node.Shutdown()
+	node.SetTimeout(resolveTimeout)
 
-	output, err := node.Resolve(url)
+	output, err := node.Resolve(context.Background(), url)
 	checkErr(err)
 
-	claim, err := node.GetClaimInTx(hex.EncodeToString(rev(output.GetTxHash())), int(output.GetNout()))
+	claim, err := node.GetClaimInTx(context.Background(), hex.EncodeToString(rev(output.GetTxHash())), int(output.GetNout()))
 	checkErr(err)
 
 	jsonClaim, err := json.MarshalIndent(claim, "", "  ")
@@ -5,8 +5,13 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/lbryio/reflector.go/events"
+	"github.com/lbryio/reflector.go/shared"
+	"github.com/lbryio/reflector.go/store"
 	"github.com/lbryio/reflector.go/updater"
+	"github.com/lbryio/reflector.go/webhook"
 
 	"github.com/lbryio/lbry.go/v2/dht"
 	"github.com/lbryio/lbry.go/v2/extras/errors"
@@ -27,6 +32,110 @@ type Config struct {
 	SlackHookURL string `json:"slack_hook_url"`
 	UpdateBinURL string `json:"update_bin_url"`
 	UpdateCmd    string `json:"update_cmd"`
+
+	// the name this host goes by in blob traces. defaults to the hostname
+	HostID string `json:"host_id"`
+
+	// credentials s3 clients of the s3 gateway sign their requests with
+	S3GatewayAccessKey string `json:"s3_gateway_access_key"`
+	S3GatewaySecretKey string `json:"s3_gateway_secret_key"`
+
+	// read replicas of the db, and how many seconds they may lag behind before they are skipped
+	DBReadConns     []string `json:"db_read_conns"`
+	DBReplicaMaxLag int      `json:"db_replica_max_lag"`
+
+	// settings for the connection to s3 and the objects uploaded to it. see store.S3Opts
+	S3Endpoint         string            `json:"s3_endpoint"`
+	S3Region           string            `json:"s3_region"`
+	S3PathStyle        bool              `json:"s3_path_style"`
+	S3SignatureVersion string            `json:"s3_signature_version"`
+	S3SSE              string            `json:"s3_sse"`
+	S3KMSKeyID         string            `json:"s3_kms_key_id"`
+	S3StorageClass     string            `json:"s3_storage_class"`
+	S3Tags             map[string]string `json:"s3_tags"`
+	S3RestoreDays      int               `json:"s3_restore_days"`
+	S3RestoreTier      string            `json:"s3_restore_tier"`
+
+	// webhook that is told about ingested streams, deleted blobs and blocked uploads. see the webhook package
+	WebhookURL    string   `json:"webhook_url"`
+	WebhookSecret string   `json:"webhook_secret"`
+	WebhookEvents []string `json:"webhook_events"`
+
+	// nats or kafka bus that stored, deleted and blocked blobs and ingested streams are published to. see events.Open
+	EventBusURL   string   `json:"event_bus_url"`
+	EventBusTypes []string `json:"event_bus_types"`
+
+	// bearer token for the admin endpoints, like the dht operations. they are off without it
+	AdminToken string `json:"admin_token"`
+
+	// how failed s3 requests are retried. 0 uses the defaults
+	S3RetryMaxAttempts  int `json:"s3_retry_max_attempts"`
+	S3RetryMinBackoffMs int `json:"s3_retry_min_backoff_ms"`
+	S3RetryMaxBackoffMs int `json:"s3_retry_max_backoff_ms"`
+}
+
+func (c Config) s3Opts() store.S3Opts {
+	return store.S3Opts{
+		Endpoint:         c.S3Endpoint,
+		Region:           c.S3Region,
+		PathStyle:        c.S3PathStyle,
+		SignatureVersion: c.S3SignatureVersion,
+		SSE:              c.S3SSE,
+		KMSKeyID:         c.S3KMSKeyID,
+		StorageClass:     c.S3StorageClass,
+		Tags:             c.S3Tags,
+		RestoreDays:      c.S3RestoreDays,
+		RestoreTier:      c.S3RestoreTier,
+		Retry: store.S3RetryPolicy{
+			MaxAttempts: c.S3RetryMaxAttempts,
+			MinBackoff:  time.Duration(c.S3RetryMinBackoffMs) * time.Millisecond,
+			MaxBackoff:  time.Duration(c.S3RetryMaxBackoffMs) * time.Millisecond,
+		},
+	}
+}
+
+// newS3Store returns an s3 store for the bucket, with the aws settings from the config
+func newS3Store(bucket string) *store.S3Store {
+	return store.NewS3StoreWithOpts(globalConfig.AwsID, globalConfig.AwsSecret, globalConfig.BucketRegion, bucket,
+		globalConfig.s3Opts())
+}
+
+// newWebhooks returns a started webhook dispatcher if the config has a webhook, or nil
+func newWebhooks() *webhook.Dispatcher {
+	if globalConfig.WebhookURL == "" {
+		return nil
+	}
+	d := webhook.NewDispatcher(globalConfig.WebhookURL, globalConfig.WebhookSecret)
+	for _, e := range globalConfig.WebhookEvents {
+		t := webhook.EventType(e)
+		if !t.Valid() {
+			logrus.Fatalf("unknown webhook event '%s'", e)
+		}
+		d.Events = append(d.Events, t)
+	}
+	d.Start()
+	return d
+}
+
+// newEventBus returns a started event bus if the config has one, or nil
+func newEventBus() *events.Bus {
+	if globalConfig.EventBusURL == "" {
+		return nil
+	}
+	p, err := events.Open(globalConfig.EventBusURL)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	b := events.NewBus(p)
+	for _, e := range globalConfig.EventBusTypes {
+		t := events.Type(e)
+		if !t.Valid() {
+			logrus.Fatalf("unknown event bus type '%s'", e)
+		}
+		b.Types = append(b.Types, t)
+	}
+	b.Start()
+	return b
 }
 
 var verbose []string
@@ -98,6 +207,10 @@ func preRun(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	if globalConfig.HostID != "" {
+		shared.SetHostName(globalConfig.HostID)
+	}
+
 	if globalConfig.SlackHookURL != "" {
 		hook := &slackrus.SlackrusHook{
 			HookURL:        globalConfig.SlackHookURL,
@@ -150,7 +263,11 @@ func loadConfig(path string) (Config, error) {
 	}
 
 	err = json.Unmarshal(raw, &c)
-	return c, errors.Err(err)
+	if err != nil {
+		return c, errors.Err(err)
+	}
+	err = c.s3Opts().Validate()
+	return c, errors.Prefix("s3 settings in "+path, err)
 }
 
 func mustGetFlagString(cmd *cobra.Command, name string) string {
@@ -27,6 +27,7 @@ func init() {
 		Run:   sendCmd,
 	}
 	cmd.PersistentFlags().String("sd-cache", "", "path to dir where sd blobs will be cached")
+	cmd.PersistentFlags().StringVar(&hackyReflector.AuthToken, "auth-token", "", "Token for servers that authorize uploads, like an api key")
 	rootCmd.AddCommand(cmd)
 }
 
@@ -12,6 +12,8 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var sendBlobAuthToken string
+
 func init() {
 	var cmd = &cobra.Command{
 		Use:   "sendblob ADDRESS:PORT [PATH]",
@@ -19,6 +21,7 @@ func init() {
 		Args:  cobra.RangeArgs(1, 2),
 		Run:   sendBlobCmd,
 	}
+	cmd.Flags().StringVar(&sendBlobAuthToken, "auth-token", "", "Token for servers that authorize uploads")
 	rootCmd.AddCommand(cmd)
 }
 
@@ -29,7 +32,7 @@ func sendBlobCmd(cmd *cobra.Command, args []string) {
 		path = args[1]
 	}
 
-	c := reflector.Client{}
+	c := reflector.Client{AuthToken: sendBlobAuthToken}
 	err := c.Connect(addr)
 	if err != nil {
 		log.Fatal("error connecting client to server: ", err)
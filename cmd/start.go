@@ -6,9 +6,12 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/lbryio/reflector.go/cluster"
 	"github.com/lbryio/reflector.go/db"
+	"github.com/lbryio/reflector.go/internal/dhtlookup"
+	"github.com/lbryio/reflector.go/internal/routingtable"
 	"github.com/lbryio/reflector.go/prism"
 	"github.com/lbryio/reflector.go/reflector"
 	"github.com/lbryio/reflector.go/server/peer"
@@ -27,11 +30,34 @@ const (
 
 var (
 	startClusterPort   int
+	startClusterRoles  string
+	startCapacity      int
+	startKeyring       string
 	startPeerPort      int
+	startExtPeerPort   int
+	startExternalIP    string
+	startDetectIP      bool
 	startReflectorPort int
 	startDhtPort       int
 	startDhtSeeds      []string
 	startHashRange     string
+	startNodeIDFile    string
+	startNodeIDRange   string
+	startDhtRPCPort    int
+	startRoutingTable  string
+	startLookupAlpha   int
+	startLookupTimeout time.Duration
+	startLookupMode    string
+	startRefresh       time.Duration
+	startPingInterval  time.Duration
+	startPingBackoff   time.Duration
+
+	startAnnounceRate   int
+	startReannounceTime time.Duration
+	startNAT            bool
+	startGCInterval     time.Duration
+	startGCGracePeriod  time.Duration
+	startPendingTTL     time.Duration
 )
 
 func init() {
@@ -42,23 +68,47 @@ func init() {
 		Args:  cobra.ExactArgs(1),
 	}
 	cmd.PersistentFlags().IntVar(&startClusterPort, "cluster-port", cluster.DefaultPort, "Port that cluster listens on")
+	cmd.PersistentFlags().StringVar(&startClusterRoles, "cluster-roles", "", "Comma-separated roles of this node in the cluster: cache, origin and announcer. All of them if empty. Only announcers split the hashes to announce")
+	cmd.PersistentFlags().StringVar(&startKeyring, "cluster-keyring", "", "Json list of base64 keys to encrypt the cluster gossip with. Members without the keys can't join")
+	cmd.PersistentFlags().IntVar(&startCapacity, "cluster-capacity", 1, "How big this node's share of the hashes to announce is compared to the other announcers")
 	cmd.PersistentFlags().IntVar(&startPeerPort, "peer-port", peer.DefaultPort, "Port to start peer protocol on")
+	cmd.PersistentFlags().IntVar(&startExtPeerPort, "external-peer-port", 0, "Peer port to announce in the dht, for a NAT that forwards another port to peer-port. peer-port is announced if 0")
+	cmd.PersistentFlags().StringVar(&startExternalIP, "external-ip", "", "IPv4 address peers download from, for a static NAT or a host with several addresses. Announces are sent from it if it's an address of this host")
+	cmd.PersistentFlags().BoolVar(&startDetectIP, "detect-external-ip", false, "Ask the dht nodes of this repo, and the gateway with --nat, which ip the announces come from, and log an error if it's not --external-ip")
 	cmd.PersistentFlags().IntVar(&startReflectorPort, "reflector-port", reflector.DefaultPort, "Port to start reflector protocol on")
 	cmd.PersistentFlags().IntVar(&startDhtPort, "dht-port", dht.DefaultPort, "Port that dht will listen on")
+	cmd.PersistentFlags().StringVar(&startNodeIDFile, "dht-node-id-file", "", "Keep the dht node id in this file, so the node has the same id after a restart")
+	cmd.PersistentFlags().StringVar(&startNodeIDRange, "dht-node-id-range", "", "Generate the dht node id within this range: a hex prefix like a3, or N/M for the Nth of M equal parts of the id space")
+	cmd.PersistentFlags().IntVar(&startDhtRPCPort, "dht-rpc-port", 0, "Port of the json-rpc server of the dht node. Off if 0")
+	cmd.PersistentFlags().StringVar(&startRoutingTable, "dht-routing-table-file", "", "Save the dht routing table to this file, and rejoin the dht through the saved nodes after a restart. Needs dht-rpc-port")
+	cmd.PersistentFlags().IntVar(&startLookupAlpha, "dht-lookup-alpha", dhtlookup.DefaultAlpha, "How many dht nodes a lookup for the nodes to announce to asks at once")
+	cmd.PersistentFlags().DurationVar(&startLookupTimeout, "dht-lookup-timeout", dhtlookup.DefaultTimeout, "How long a dht lookup waits for a node to answer")
+	cmd.PersistentFlags().StringVar(&startLookupMode, "dht-lookup-mode", string(dhtlookup.Loose), "loose asks the next dht node as soon as one answers or times out, strict asks them in rounds of dht-lookup-alpha")
+	cmd.PersistentFlags().DurationVar(&startRefresh, "dht-refresh-interval", routingtable.DefaultRefreshInterval, "Look up a random id in a bucket of the announcer's dht routing table that had no news of its nodes for this long")
+	cmd.PersistentFlags().DurationVar(&startPingInterval, "dht-ping-interval", routingtable.DefaultPingInterval, "Ping the nodes in the announcer's dht routing table that weren't heard from for this long")
+	cmd.PersistentFlags().DurationVar(&startPingBackoff, "dht-ping-backoff", routingtable.DefaultPingBackoff, "Ping a dht node that missed a request again after this long, twice as long for each request it missed. It's replaced after 3")
 	cmd.PersistentFlags().StringSliceVar(&startDhtSeeds, "dht-seeds", []string{}, "Comma-separated list of dht seed nodes (addr:port,addr:port,...)")
 
 	cmd.PersistentFlags().StringVar(&startHashRange, "hash-range", "", "Limit on range of hashes to announce (start-end)")
+	cmd.PersistentFlags().IntVar(&startAnnounceRate, "announce-rate", dht.DefaultAnnounceRate, "Send at most this many dht announces per second")
+	cmd.PersistentFlags().BoolVar(&startNAT, "nat", false, "Map the dht and peer ports on the local gateway using NAT-PMP or UPnP")
+	cmd.PersistentFlags().DurationVar(&startGCInterval, "gc-interval", 0, "Delete blobs that belong to no stream this often. Disabled if 0")
+	cmd.PersistentFlags().DurationVar(&startGCGracePeriod, "gc-grace-period", prism.DefaultGCGracePeriod, "Only garbage collect blobs older than this")
+	cmd.PersistentFlags().DurationVar(&startPendingTTL, "pending-stream-ttl", 0, "Abort uploads of streams that are missing blobs and got none of them for this long, like 24h. This deletes their sd blobs from the blob store, and their other blobs once they are garbage collected. Disabled if 0")
+	cmd.PersistentFlags().DurationVar(&startReannounceTime, "reannounce-time", dht.DefaultReannounceTime, "Spread announces over this window. Should be a bit less than the hash expiration time")
 
 	rootCmd.AddCommand(cmd)
 }
 
 func startCmd(cmd *cobra.Command, args []string) {
 	db := &db.SQL{
-		LogQueries: log.GetLevel() == log.DebugLevel,
+		LogQueries:    log.GetLevel() == log.DebugLevel,
+		ReadDSNs:      globalConfig.DBReadConns,
+		ReplicaMaxLag: time.Duration(globalConfig.DBReplicaMaxLag) * time.Second,
 	}
 	err := db.Connect(globalConfig.DBConn)
 	checkErr(err)
-	s3 := store.NewS3Store(globalConfig.AwsID, globalConfig.AwsSecret, globalConfig.BucketRegion, globalConfig.BucketName)
+	s3 := newS3Store(globalConfig.BucketName)
 	comboStore := store.NewDBBackedStore(s3, db, false)
 
 	conf := prism.DefaultConf()
@@ -76,9 +126,32 @@ func startCmd(cmd *cobra.Command, args []string) {
 	conf.Blobs = comboStore
 	conf.DhtAddress = "0.0.0.0:" + strconv.Itoa(startDhtPort)
 	conf.DhtSeedNodes = startDhtSeeds
+	conf.DhtNodeID = loadDHTNodeID(startNodeIDFile, startNodeIDRange)
+	conf.DhtRPCPort = startDhtRPCPort
+	conf.DhtRoutingTableFile = startRoutingTable
+	conf.DhtLookup.Alpha = startLookupAlpha
+	conf.DhtLookup.Timeout = startLookupTimeout
+	conf.DhtLookup.Mode, err = dhtlookup.ParseMode(startLookupMode)
+	checkErr(err)
+	conf.DhtRoutingTable.RefreshInterval = startRefresh
+	conf.DhtRoutingTable.PingInterval = startPingInterval
+	conf.DhtRoutingTable.PingBackoff = startPingBackoff
 	conf.ClusterPort = startClusterPort
+	conf.ClusterRoles, err = cluster.ParseRoles(startClusterRoles)
+	checkErr(err)
+	conf.ClusterCapacity = startCapacity
+	conf.ClusterKeyringFile = startKeyring
 	conf.PeerPort = startPeerPort
+	conf.ExternalPeerPort = startExtPeerPort
+	conf.ExternalIP = startExternalIP
+	conf.DetectExternalIP = startDetectIP
 	conf.ReflectorPort = startReflectorPort
+	conf.AnnounceRate = startAnnounceRate
+	conf.ReannounceTime = startReannounceTime
+	conf.NAT = startNAT
+	conf.GCInterval = startGCInterval
+	conf.GCGracePeriod = startGCGracePeriod
+	conf.PendingStreamTTL = startPendingTTL
 
 	if startHashRange != "" {
 		hashRange := strings.Split(startHashRange, "-")
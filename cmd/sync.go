@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/lbryio/reflector.go/meta"
+	"github.com/lbryio/reflector.go/migrator"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/c2h5oh/datasize"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	syncLocal      string
+	syncRemote     string
+	syncToken      string
+	syncPrefix     string
+	syncWorkers    int
+	syncMaxRate    string
+	syncVerify     bool
+	syncCheckpoint string
+	syncDryRun     bool
+)
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "sync",
+		Short: "Fetch the blobs a remote reflector has and a local store doesn't",
+		Long: `Compares the blobs in the --local store with the inventory of the reflector at --remote, and copies the blobs
+only the remote has over its http server. The remote must run with --http-inventory. The local store is given like
+in migrate-store and must be one that can list its blobs, like disk:PATH or s3:BUCKET.
+
+Blobs only the local store has are counted but not sent: to sync the other way, run sync on the other node. With
+--prefix, only the hashes that start with it are compared, to split a big sync into parts.`,
+		Run:  syncCmd,
+		Args: cobra.NoArgs,
+	}
+	cmd.Flags().StringVar(&syncLocal, "local", "", "store to copy the missing blobs to")
+	cmd.Flags().StringVar(&syncRemote, "remote", "", "host:port of the http server of the reflector to copy from")
+	cmd.Flags().StringVar(&syncToken, "token", "", "bearer token to send to the remote, if it checks them")
+	cmd.Flags().StringVar(&syncPrefix, "prefix", "", "only sync blobs whose hashes start with this")
+	cmd.Flags().IntVar(&syncWorkers, "workers", 8, "number of blobs to copy at once")
+	cmd.Flags().StringVar(&syncMaxRate, "max-rate", "0", "max bytes per second to copy, like 50MB. 0 for no limit")
+	cmd.Flags().BoolVar(&syncVerify, "verify", true, "read every blob back from the local store and check its hash")
+	cmd.Flags().StringVar(&syncCheckpoint, "checkpoint", "", "file to save progress to, to resume an interrupted sync")
+	cmd.Flags().BoolVar(&syncDryRun, "dry-run", false, "only count the blobs that would be copied")
+	rootCmd.AddCommand(cmd)
+}
+
+func syncCmd(cmd *cobra.Command, args []string) {
+	log.Printf("reflector %s", meta.VersionString())
+	if syncRemote == "" {
+		log.Fatal("--remote is required")
+	}
+
+	local, err := storeFromSpec(syncLocal)
+	if err != nil {
+		log.Fatal(err)
+	}
+	remote := store.NewHttpStore(syncRemote)
+	if syncToken != "" {
+		remote.Header = http.Header{"Authorization": []string{"Bearer " + syncToken}}
+	}
+
+	var maxRate datasize.ByteSize
+	err = maxRate.UnmarshalText([]byte(syncMaxRate))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("listing the blobs in %s", syncLocal)
+	have, err := store.List(local)
+	if err != nil {
+		log.Fatal(errors.FullTrace(err))
+	}
+	if syncPrefix != "" {
+		filtered := have[:0]
+		for _, h := range have {
+			if strings.HasPrefix(h, syncPrefix) {
+				filtered = append(filtered, h)
+			}
+		}
+		have = filtered
+	}
+	log.Infof("fetching the inventory of %s", syncRemote)
+	want, err := remote.Inventory(syncPrefix)
+	if err != nil {
+		log.Fatal(errors.FullTrace(err))
+	}
+
+	missing := migrator.Missing(have, want)
+	log.Infof("%s has %d blobs, %s has %d. %d are missing locally, %d only exist locally", syncLocal, len(have),
+		syncRemote, len(want), len(missing), len(migrator.Missing(want, have)))
+	if syncDryRun || len(missing) == 0 {
+		return
+	}
+
+	m := migrator.New(remote, local, migrator.Opts{
+		Workers:        syncWorkers,
+		MaxBytesPerSec: int64(maxRate),
+		Verify:         syncVerify,
+		Overwrite:      true, // the inventories were compared already
+		Checkpoint:     syncCheckpoint,
+	})
+
+	interruptChan := make(chan os.Signal, 1)
+	signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interruptChan
+		log.Info("stopping after the blobs in flight")
+		m.Shutdown()
+	}()
+
+	result, err := m.Run(missing)
+	if err != nil {
+		log.Fatal(errors.FullTrace(err))
+	}
+	log.Infof("copied %d blobs (%s), skipped %d, %d failed", result.Copied, datasize.ByteSize(result.Bytes).HR(),
+		result.Skipped, result.Failed)
+	if result.Failed > 0 {
+		os.Exit(1)
+	}
+}
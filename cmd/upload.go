@@ -16,6 +16,9 @@ import (
 var uploadWorkers int
 var uploadSkipExistsCheck bool
 var uploadDeleteBlobsAfterUpload bool
+var uploadRetries int
+var uploadQueue string
+var uploadWatch bool
 
 func init() {
 	var cmd = &cobra.Command{
@@ -27,6 +30,9 @@ func init() {
 	cmd.PersistentFlags().IntVar(&uploadWorkers, "workers", 1, "How many worker threads to run at once")
 	cmd.PersistentFlags().BoolVar(&uploadSkipExistsCheck, "skipExistsCheck", false, "Dont check if blobs exist before uploading")
 	cmd.PersistentFlags().BoolVar(&uploadDeleteBlobsAfterUpload, "deleteBlobsAfterUpload", false, "Delete blobs after uploading them")
+	cmd.PersistentFlags().IntVar(&uploadRetries, "retries", 0, "How many times to retry blobs that fail to upload")
+	cmd.PersistentFlags().StringVar(&uploadQueue, "queue", "", "File to keep the blobs left to upload in, so an interrupted upload of the same PATH resumes where it stopped")
+	cmd.PersistentFlags().BoolVar(&uploadWatch, "watch", false, "Keep watching PATH and upload new blob files as they appear, like the blob dir of an lbrynet node")
 	rootCmd.AddCommand(cmd)
 }
 
@@ -38,10 +44,17 @@ func uploadCmd(cmd *cobra.Command, args []string) {
 	checkErr(err)
 
 	st := store.NewDBBackedStore(
-		store.NewS3Store(globalConfig.AwsID, globalConfig.AwsSecret, globalConfig.BucketRegion, globalConfig.BucketName),
+		newS3Store(globalConfig.BucketName),
 		db, false)
 
 	uploader := reflector.NewUploader(db, st, uploadWorkers, uploadSkipExistsCheck, uploadDeleteBlobsAfterUpload)
+	uploader.Retries = uploadRetries
+	if uploadQueue != "" {
+		queue, err := reflector.OpenUploadQueue(uploadQueue)
+		checkErr(err)
+		defer queue.Close()
+		uploader.Queue = queue
+	}
 
 	interruptChan := make(chan os.Signal, 1)
 	signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM)
@@ -50,6 +63,10 @@ func uploadCmd(cmd *cobra.Command, args []string) {
 		uploader.Stop()
 	}()
 
-	err = uploader.Upload(args[0])
+	if uploadWatch {
+		err = uploader.Watch(args[0])
+	} else {
+		err = uploader.Upload(args[0])
+	}
 	checkErr(err)
 }
@@ -0,0 +1,225 @@
+package crawler
+
+import (
+	"crypto/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultConcurrency    = 64
+	DefaultTimeout        = 5 * time.Second
+	DefaultQueriesPerNode = 4
+
+	// same as the dht's udpMaxMessageLength
+	maxMessageLength = 4096
+)
+
+// Node is a dht node found during the crawl
+type Node struct {
+	ID              string `json:"id"`
+	IP              string `json:"ip"`
+	Port            int    `json:"port"`
+	ProtocolVersion int    `json:"protocol_version"`
+	Reachable       bool   `json:"reachable"`
+	RTTMs           int64  `json:"rtt_ms,omitempty"`
+	// number of other nodes that had this node in their routing table
+	Referrals int `json:"referrals"`
+
+	addr *net.UDPAddr
+}
+
+// Crawler walks the dht from a set of seed nodes, asking every node it finds for the contents of its routing table
+type Crawler struct {
+	// number of nodes queried at the same time
+	Concurrency int
+	// how long to wait for a node to answer a query
+	Timeout time.Duration
+	// how many random lookups to send to each node. more lookups uncover more of the node's routing table
+	QueriesPerNode int
+	// stop discovering new nodes after this many. 0 means no limit
+	MaxNodes int
+	// Listen opens the socket that a node is queried from. Defaults to a udp socket on a random port
+	Listen func() (dht.UDPConn, error)
+
+	id bits.Bitmap
+}
+
+// New returns a crawler with default settings
+func New() *Crawler {
+	return &Crawler{
+		Concurrency:    DefaultConcurrency,
+		Timeout:        DefaultTimeout,
+		QueriesPerNode: DefaultQueriesPerNode,
+		Listen: func() (dht.UDPConn, error) {
+			return net.ListenUDP(dht.Network, nil)
+		},
+		id: bits.Rand(),
+	}
+}
+
+// Crawl starts at the seed nodes and queries every node it learns about until no new nodes are found or stopCh is
+// closed. It returns all nodes found so far, sorted by ID.
+func (c *Crawler) Crawl(seeds []string, stopCh stop.Chan) ([]*Node, error) {
+	var (
+		mu    sync.Mutex
+		nodes = make(map[string]*Node)
+		wg    sync.WaitGroup
+		sem   = make(chan struct{}, c.Concurrency)
+	)
+
+	var visit func(addr *net.UDPAddr, id string)
+	visit = func(addr *net.UDPAddr, id string) {
+		key := addr.String()
+
+		mu.Lock()
+		if n, ok := nodes[key]; ok {
+			n.Referrals++
+			mu.Unlock()
+			return
+		}
+		if c.MaxNodes > 0 && len(nodes) >= c.MaxNodes {
+			mu.Unlock()
+			return
+		}
+		n := &Node{ID: id, IP: addr.IP.String(), Port: addr.Port, addr: addr}
+		nodes[key] = n
+		if len(nodes)%1000 == 0 {
+			log.Infof("crawled %d nodes so far", len(nodes))
+		}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-stopCh:
+				return
+			case sem <- struct{}{}:
+			}
+			contacts := c.query(n, &mu)
+			<-sem
+
+			for _, contact := range contacts {
+				visit(contact.Addr(), contact.ID.Hex())
+			}
+		}()
+	}
+
+	found := 0
+	for _, seed := range seeds {
+		addr, err := net.ResolveUDPAddr(dht.Network, seed)
+		if err != nil {
+			log.Warnf("skipping seed %s: %s", seed, err.Error())
+			continue
+		}
+		found++
+		visit(addr, "")
+	}
+	if found == 0 {
+		return nil, errors.Err("none of the seed nodes could be resolved")
+	}
+
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	list := make([]*Node, 0, len(nodes))
+	for _, n := range nodes {
+		list = append(list, n)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+// query sends QueriesPerNode findValue requests for random hashes to the node and returns all contacts it replied
+// with. findValue is used instead of findNode because only findValue responses carry the protocol version.
+func (c *Crawler) query(n *Node, mu *sync.Mutex) []dht.Contact {
+	conn, err := c.Listen()
+	if err != nil {
+		log.Debugf("%s: %s", n.addr, err.Error())
+		return nil
+	}
+	defer conn.Close()
+
+	var contacts []dht.Contact
+	for i := 0; i < c.QueriesPerNode; i++ {
+		target := bits.Rand()
+		req := dht.Request{NodeID: c.id, Method: "findValue", Arg: &target}
+		_, err = rand.Read(req.ID[:])
+		if err != nil {
+			log.Error(errors.Prefix("making message id", err))
+			return contacts
+		}
+		data, err := req.MarshalBencode()
+		if err != nil {
+			log.Error(errors.Prefix("encoding request", err))
+			return contacts
+		}
+
+		start := time.Now()
+		_, err = conn.WriteToUDP(data, n.addr)
+		if err != nil {
+			log.Debugf("%s: %s", n.addr, err.Error())
+			return contacts
+		}
+		err = conn.SetReadDeadline(start.Add(c.Timeout))
+		if err != nil {
+			return contacts
+		}
+		res, err := readResponse(conn, n.addr, req)
+		if err != nil {
+			// a node that doesn't answer the first query is not going to answer the rest either
+			log.Debugf("%s: %s", n.addr, err.Error())
+			return contacts
+		}
+		rtt := time.Since(start)
+
+		mu.Lock()
+		if !n.Reachable {
+			n.Reachable = true
+			n.RTTMs = rtt.Milliseconds()
+			n.ProtocolVersion = res.ProtocolVersion
+			if n.ID == "" {
+				n.ID = res.NodeID.Hex()
+			}
+		}
+		mu.Unlock()
+
+		// if the node happens to store the random hash, the contacts are peers rather than dht nodes
+		if res.FindValueKey == "" {
+			contacts = append(contacts, res.Contacts...)
+		}
+	}
+	return contacts
+}
+
+// readResponse reads packets until the response to req arrives from addr. Anything else is skipped: the requests
+// nodes send back to check on the crawler, late responses to earlier queries, and packets from other addresses
+func readResponse(conn dht.UDPConn, addr *net.UDPAddr, req dht.Request) (dht.Response, error) {
+	buf := make([]byte, maxMessageLength)
+	for {
+		read, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return dht.Response{}, err
+		}
+		if !from.IP.Equal(addr.IP) || from.Port != addr.Port {
+			continue
+		}
+		var res dht.Response
+		err = res.UnmarshalBencode(buf[:read])
+		if err != nil || res.ID != req.ID {
+			continue
+		}
+		return res, nil
+	}
+}
@@ -0,0 +1,95 @@
+package crawler
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/dhtsim"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// liar answers every request with a response that has the wrong message id, and has another address send a response
+// with the right id, both with a contact that is not in the dht, before the real response
+func liar(t *testing.T, network *dhtsim.Network, addr, other *net.UDPAddr, bogus dht.Contact) {
+	conn, err := network.Listen(addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	spoofer, err := network.Listen(other)
+	require.NoError(t, err)
+	t.Cleanup(func() { spoofer.Close() })
+
+	id := bits.Rand()
+	send := func(c *dhtsim.Conn, res dht.Response, to *net.UDPAddr) {
+		data, err := res.MarshalBencode()
+		require.NoError(t, err)
+		_, err = c.WriteToUDP(data, to)
+		require.NoError(t, err)
+	}
+	go func() {
+		buf := make([]byte, maxMessageLength)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var req dht.Request
+			if req.UnmarshalBencode(buf[:n]) != nil {
+				continue
+			}
+
+			forged := dht.Response{NodeID: id, Contacts: []dht.Contact{bogus}}
+			send(conn, forged, from)
+			forged.ID = req.ID
+			send(spoofer, forged, from)
+			res := dht.Response{NodeID: id}
+			res.ID = req.ID
+			send(conn, res, from)
+		}
+	}()
+}
+
+func TestCrawler_Crawl(t *testing.T) {
+	network := dhtsim.NewNetwork(1)
+	sim, err := dhtsim.New(network, 30)
+	require.NoError(t, err)
+	defer sim.Shutdown()
+
+	liarAddr := &net.UDPAddr{IP: net.IPv4(10, 1, 0, 1), Port: 4444}
+	bogus := dht.Contact{ID: bits.Rand(), IP: net.IPv4(10, 9, 9, 9), Port: 4444}
+	liar(t, network, liarAddr, &net.UDPAddr{IP: net.IPv4(10, 2, 0, 1), Port: 4444}, bogus)
+
+	c := New()
+	c.Timeout = time.Second
+	port := 0
+	c.Listen = func() (dht.UDPConn, error) {
+		port++
+		return network.Listen(&net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: port})
+	}
+	// the ports are handed out one query at a time
+	c.Concurrency = 1
+
+	nodes, err := c.Crawl([]string{sim.Contacts[0].Addr().String(), liarAddr.String()}, nil)
+	require.NoError(t, err)
+
+	found := make(map[string]*Node)
+	for _, n := range nodes {
+		found[n.IP] = n
+	}
+	_, trusted := found[bogus.IP.String()]
+	assert.False(t, trusted, "the forged responses were trusted")
+	assert.Len(t, nodes, len(sim.Contacts)+1)
+	for _, contact := range sim.Contacts {
+		n, ok := found[contact.IP.String()]
+		if assert.True(t, ok, "node %s was not found", contact.IP) {
+			assert.True(t, n.Reachable)
+			assert.Equal(t, contact.ID.Hex(), n.ID)
+		}
+	}
+	assert.True(t, found[liarAddr.IP.String()].Reachable)
+}
@@ -0,0 +1,318 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	qt "github.com/lbryio/lbry.go/v2/extras/query"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/volatiletech/null"
+)
+
+const (
+	// flush early if this many different hashes were accessed since the last flush
+	maxPendingAccesses = 100000
+	// access counts are halved this often, so they show how popular a blob is now rather than how popular it ever was
+	accessDecayInterval = 24 * time.Hour
+	// how often the tracker checks whether the counts are due to be halved. another process sharing the db may have
+	// halved them in the meantime
+	accessDecayCheckInterval = time.Hour
+
+	// DefaultEvictionGracePeriod is how long a new blob is kept from eviction before it was requested
+	DefaultEvictionGracePeriod = time.Hour
+)
+
+// AccessStat is how often and how recently a blob or stream was requested
+type AccessStat struct {
+	Hash           string    `json:"hash"`
+	Count          uint64    `json:"count"`
+	LastAccessedAt time.Time `json:"last_accessed_at"`
+}
+
+// accessTracker counts accesses in memory and writes them to the db in batches, so that serving a blob doesn't
+// need a write query
+type accessTracker struct {
+	db   *SQL
+	grp  *stop.Group
+	full chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]pendingAccess
+}
+
+// pendingAccess is how often a blob was accessed since the last flush, and when it was last accessed
+type pendingAccess struct {
+	count uint64
+	at    time.Time
+}
+
+func newAccessTracker(db *SQL, flushInterval time.Duration) *accessTracker {
+	t := &accessTracker{
+		db:      db,
+		grp:     stop.New(),
+		full:    make(chan struct{}, 1),
+		pending: make(map[string]pendingAccess),
+	}
+	t.grp.Add(1)
+	go func() {
+		defer t.grp.Done()
+		t.run(flushInterval)
+	}()
+	return t
+}
+
+func (t *accessTracker) record(hash string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a := t.pending[hash]
+	a.count++
+	a.at = time.Now()
+	t.pending[hash] = a
+	if len(t.pending) >= maxPendingAccesses {
+		select {
+		case t.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *accessTracker) run(flushInterval time.Duration) {
+	flushTicker := time.NewTicker(flushInterval)
+	defer flushTicker.Stop()
+	decayTicker := time.NewTicker(accessDecayCheckInterval)
+	defer decayTicker.Stop()
+
+	for {
+		select {
+		case <-t.grp.Ch():
+			t.flush()
+			return
+		case <-flushTicker.C:
+			t.flush()
+		case <-t.full:
+			t.flush()
+		case <-decayTicker.C:
+			_, err := t.db.decayAccessCountsIfDue(accessDecayInterval)
+			if err != nil {
+				log.Errorf("error decaying access counts: %s", errors.FullTrace(err))
+			}
+		}
+	}
+}
+
+func (t *accessTracker) flush() {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[string]pendingAccess)
+	t.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	start := time.Now()
+	err := t.db.addAccesses(pending)
+	if err != nil {
+		log.Errorf("error writing %d blob accesses: %s", len(pending), errors.FullTrace(err))
+		return
+	}
+	log.Debugf("wrote accesses of %d blobs in %s", len(pending), time.Since(start))
+}
+
+func (t *accessTracker) shutdown() {
+	t.grp.StopAndWait()
+}
+
+// Shutdown writes accesses that were not written yet
+func (s *SQL) Shutdown() {
+	if s.tracker != nil {
+		s.tracker.shutdown()
+	}
+}
+
+// addAccesses adds to the access counts of the blobs, or of the streams that the blobs are part of, and sets their last
+// access times. Hashes with the same count that were last accessed in the same second are updated together. The
+// earliest accesses are written first, so a stream that several of the blobs are part of ends up with the latest time
+func (s *SQL) addAccesses(accesses map[string]pendingAccess) error {
+	byAccess := make(map[pendingAccess][]string)
+	for hash, a := range accesses {
+		a.at = a.at.Truncate(time.Second)
+		byAccess[a] = append(byAccess[a], hash)
+	}
+	groups := make([]pendingAccess, 0, len(byAccess))
+	for a := range byAccess {
+		groups = append(groups, a)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].at.Before(groups[j].at) })
+
+	return withTx(s.conn, func(tx *sql.Tx) error {
+		for _, a := range groups {
+			hashes := byAccess[a]
+			for i := 0; i < len(hashes); i += addBlobsBatchSize {
+				j := i + addBlobsBatchSize
+				if j > len(hashes) {
+					j = len(hashes)
+				}
+				batch := hashes[i:j]
+
+				args := []interface{}{a.count, a.at}
+				for _, h := range batch {
+					args = append(args, h)
+				}
+
+				var query string
+				if s.TrackAccess == TrackAccessStreams {
+					args = append(args, args[2:]...)
+					query = `UPDATE stream SET access_count = access_count + ?, last_accessed_at = ?
+						WHERE sd_blob_id IN (SELECT id FROM blob_ WHERE hash IN (` + qt.Qs(len(batch)) + `))
+						OR id IN (SELECT sb.stream_id FROM stream_blob sb INNER JOIN blob_ b ON b.id = sb.blob_id
+						WHERE b.hash IN (` + qt.Qs(len(batch)) + `))`
+				} else {
+					query = "UPDATE blob_ SET access_count = access_count + ?, last_accessed_at = ? WHERE hash IN (" + qt.Qs(len(batch)) + ")"
+				}
+
+				s.logQuery(query, args...)
+				_, err := tx.Exec(query, args...)
+				if err != nil {
+					return errors.Err(err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// DecayAccessCounts halves all access counts
+func (s *SQL) DecayAccessCounts() error {
+	if s.conn == nil {
+		return errors.Err("not connected")
+	}
+	_, err := s.exec(s.decayQuery())
+	return err
+}
+
+func (s *SQL) decayQuery() string {
+	table := "blob_"
+	if s.TrackAccess == TrackAccessStreams {
+		table = "stream"
+	}
+	return "UPDATE " + table + " SET access_count = access_count >> 1 WHERE access_count > 0"
+}
+
+// decayAccessCountsIfDue halves all access counts if they were last halved at least interval ago, and returns whether
+// it did. The time is kept in the db, so the processes that share a db halve the counts once between them. The first
+// call only starts the clock
+func (s *SQL) decayAccessCountsIfDue(interval time.Duration) (bool, error) {
+	if s.conn == nil {
+		return false, errors.Err("not connected")
+	}
+	now := time.Now().UTC()
+	decayed := false
+	err := withTx(s.conn, func(tx *sql.Tx) error {
+		query := s.insertIgnore() + " INTO access_decay (id, decayed_at) VALUES (1, ?)"
+		s.logQuery(query, now)
+		_, err := tx.Exec(query, now)
+		if err != nil {
+			return errors.Err(err)
+		}
+
+		// only one of the processes that check at the same time gets to move the time forward
+		query = "UPDATE access_decay SET decayed_at = ? WHERE id = 1 AND decayed_at <= ?"
+		s.logQuery(query, now, now.Add(-interval))
+		res, err := tx.Exec(query, now, now.Add(-interval))
+		if err != nil {
+			return errors.Err(err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil || n == 0 {
+			return errors.Err(err)
+		}
+
+		query = s.decayQuery()
+		s.logQuery(query)
+		_, err = tx.Exec(query)
+		decayed = err == nil
+		return errors.Err(err)
+	})
+	return decayed, err
+}
+
+// MostAccessed returns the most requested stored blobs, or the most requested streams (by sd hash) if accesses are
+// tracked per stream
+func (s *SQL) MostAccessed(limit int) ([]AccessStat, error) {
+	if s.conn == nil {
+		return nil, errors.Err("not connected")
+	}
+
+	var query string
+	switch s.TrackAccess {
+	case TrackAccessBlobs:
+		query = "SELECT hash, access_count, last_accessed_at FROM blob_ WHERE is_stored = 1 ORDER BY access_count DESC LIMIT ?"
+	case TrackAccessStreams:
+		query = `SELECT b.hash, s.access_count, s.last_accessed_at FROM stream s
+			INNER JOIN blob_ b ON b.id = s.sd_blob_id
+			ORDER BY s.access_count DESC LIMIT ?`
+	default:
+		return nil, errors.Err("access tracking is disabled")
+	}
+
+	rows, _, err := s.readQuery(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+
+	stats := make([]AccessStat, 0, limit)
+	for rows.Next() {
+		var stat AccessStat
+		var lastAccessedAt null.Time
+		err := rows.Scan(&stat.Hash, &stat.Count, &lastAccessedAt)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		stat.LastAccessedAt = lastAccessedAt.Time
+		stats = append(stats, stat)
+	}
+	return stats, errors.Err(rows.Err())
+}
+
+// EvictionCandidates returns the stored blobs that are least worth keeping: the least requested ones, and among those
+// the least recently requested. Without access counts this is the same as LeastRecentlyAccessedHashes. Blobs that
+// were never requested are skipped for EvictionGracePeriod after they were added.
+func (s *SQL) EvictionCandidates(maxBlobs int) ([]string, error) {
+	if s.conn == nil {
+		return nil, errors.Err("not connected")
+	}
+
+	if s.TrackAccess != TrackAccessBlobs {
+		return nil, errors.Err("blob access tracking is disabled")
+	}
+
+	query := `SELECT hash FROM blob_ WHERE is_stored = 1
+		AND (access_count > 0 OR created_at IS NULL OR created_at < ?)
+		ORDER BY access_count, last_accessed_at LIMIT ?`
+	args := []interface{}{time.Now().UTC().Add(-s.EvictionGracePeriod), maxBlobs}
+	s.logQuery(query, args...)
+
+	rows, err := s.conn.Query(query, args...)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer closeRows(rows)
+
+	blobs := make([]string, 0, maxBlobs)
+	for rows.Next() {
+		var hash string
+		err := rows.Scan(&hash)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		blobs = append(blobs, hash)
+	}
+	return blobs, errors.Err(rows.Err())
+}
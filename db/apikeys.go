@@ -0,0 +1,152 @@
+package db
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/volatiletech/null"
+)
+
+// ErrAPIKeyNotFound is returned when revoking a key that doesn't exist or is already revoked
+var ErrAPIKeyNotFound = errors.Base("api key not found")
+
+// APIKey lets a publisher upload to the reflector. Only the sha256 hash of the key itself is kept
+type APIKey struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Hash       string     `json:"-"`
+	DailyQuota int64      `json:"daily_quota"` // bytes per day (UTC). 0 means no limit
+	MaxRate    int64      `json:"max_rate"`    // bytes per second. 0 means no limit
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// AddAPIKey saves a new key, and sets its id and creation time
+func (s *SQL) AddAPIKey(k *APIKey) error {
+	if s.conn == nil {
+		return errors.Err("not connected")
+	}
+	k.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	id, err := s.exec("INSERT INTO api_key (name, key_hash, daily_quota, max_rate, created_at) VALUES (?, ?, ?, ?, ?)",
+		k.Name, k.Hash, k.DailyQuota, k.MaxRate, k.CreatedAt)
+	if err != nil {
+		return err
+	}
+	k.ID = id
+	return nil
+}
+
+// APIKeys returns all keys, including the revoked ones. They're read from the primary so a revocation is seen right
+// away
+func (s *SQL) APIKeys() ([]APIKey, error) {
+	if s.conn == nil {
+		return nil, errors.Err("not connected")
+	}
+	query := "SELECT id, name, key_hash, daily_quota, max_rate, created_at, revoked_at FROM api_key ORDER BY id"
+	s.logQuery(query)
+	rows, err := s.conn.Query(query)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer closeRows(rows)
+
+	var keys []APIKey
+	for rows.Next() {
+		var k APIKey
+		var revokedAt null.Time
+		err := rows.Scan(&k.ID, &k.Name, &k.Hash, &k.DailyQuota, &k.MaxRate, &k.CreatedAt, &revokedAt)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		if revokedAt.Valid {
+			k.RevokedAt = &revokedAt.Time
+		}
+		keys = append(keys, k)
+	}
+	return keys, errors.Err(rows.Err())
+}
+
+// RevokeAPIKey stops a key from being accepted. The key is kept, so its name still shows up in the list
+func (s *SQL) RevokeAPIKey(id int64) error {
+	if s.conn == nil {
+		return errors.Err("not connected")
+	}
+	query := "UPDATE api_key SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL"
+	args := []interface{}{time.Now().UTC().Truncate(time.Second), id}
+	s.logQuery(query, args...)
+	res, err := s.conn.Exec(query, args...)
+	if err != nil {
+		return errors.Err(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Err(err)
+	}
+	if n == 0 {
+		return errors.Prefix("api key "+strconv.FormatInt(id, 10), ErrAPIKeyNotFound)
+	}
+	return nil
+}
+
+// APIKeyUsage is what was uploaded with a key on a day
+type APIKeyUsage struct {
+	Bytes int64
+	Blobs int64
+}
+
+// AddAPIKeyUsage adds what was uploaded with each key, by key id, to what the db has for the day (YYYY-MM-DD, UTC)
+func (s *SQL) AddAPIKeyUsage(day string, usage map[int64]APIKeyUsage) error {
+	if s.conn == nil {
+		return errors.Err("not connected")
+	}
+	if len(usage) == 0 {
+		return nil
+	}
+	query := "INSERT INTO api_key_usage (api_key_id, day, bytes, blobs) VALUES (?, ?, ?, ?)"
+	if s.dialect == dialectSQLite {
+		query += " ON CONFLICT (api_key_id, day) DO UPDATE SET bytes = bytes + excluded.bytes, blobs = blobs + excluded.blobs"
+	} else {
+		query += " ON DUPLICATE KEY UPDATE bytes = bytes + VALUES(bytes), blobs = blobs + VALUES(blobs)"
+	}
+	return withTx(s.conn, func(tx *sql.Tx) error {
+		for id, u := range usage {
+			args := []interface{}{id, day, u.Bytes, u.Blobs}
+			s.logQuery(query, args...)
+			_, err := tx.Exec(query, args...)
+			if err != nil {
+				return errors.Err(err)
+			}
+		}
+		return nil
+	})
+}
+
+// APIKeyUsage returns what was uploaded with each key on the day (YYYY-MM-DD, UTC), by key id. It's read from the
+// primary, like the keys
+func (s *SQL) APIKeyUsage(day string) (map[int64]APIKeyUsage, error) {
+	if s.conn == nil {
+		return nil, errors.Err("not connected")
+	}
+	query := "SELECT api_key_id, bytes, blobs FROM api_key_usage WHERE day = ?"
+	s.logQuery(query, day)
+	rows, err := s.conn.Query(query, day)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer closeRows(rows)
+
+	usage := make(map[int64]APIKeyUsage)
+	for rows.Next() {
+		var id int64
+		var u APIKeyUsage
+		err := rows.Scan(&id, &u.Bytes, &u.Blobs)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		usage[id] = u
+	}
+	return usage, errors.Err(rows.Err())
+}
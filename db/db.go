@@ -3,7 +3,6 @@ package db
 import (
 	"context"
 	"database/sql"
-	"fmt"
 	"runtime"
 	"strings"
 	"time"
@@ -12,7 +11,6 @@ import (
 	"github.com/lbryio/lbry.go/v2/extras/errors"
 	qt "github.com/lbryio/lbry.go/v2/extras/query"
 	"github.com/lbryio/lbry.go/v2/extras/stop"
-	"github.com/lbryio/lbry.go/v2/stream"
 
 	"github.com/go-sql-driver/mysql"
 	_ "github.com/go-sql-driver/mysql" // blank import for db driver ensures its imported even if its not used
@@ -56,6 +54,28 @@ type SQL struct {
 
 	// Log executed queries. qt.InterpolateParams is cpu-heavy. This avoids that call if not needed.
 	LogQueries bool
+
+	// Don't check that all migrations were applied when connecting
+	SkipSchemaCheck bool
+
+	// Connection strings of read replicas. Has-blob checks and other lookups that can be a little stale go to these
+	ReadDSNs []string
+
+	// Don't read from a replica that is more than this far behind the primary. Lag is not checked if this is 0
+	ReplicaMaxLag time.Duration
+
+	// Count accesses in memory and write them to the db this often. If this is 0, accesses are not counted and the
+	// last access time is only updated when it is more than 6 hours old
+	AccessFlushInterval time.Duration
+
+	// EvictionCandidates skips blobs that were never requested and were added less than this long ago, so a new blob
+	// isn't evicted before it could be requested
+	EvictionGracePeriod time.Duration
+
+	tracker     *accessTracker
+	dialect     dialect
+	replicas    []*replica
+	nextReplica atomic.Uint32
 }
 
 func (s SQL) logQuery(query string, args ...interface{}) {
@@ -71,8 +91,26 @@ func (s SQL) logQuery(query string, args ...interface{}) {
 	}
 }
 
-// Connect will create a connection to the database
+// Connect will create a connection to the database. If the dsn starts with SQLitePrefix, the rest of it is the path
+// of an SQLite database, which is created if it doesn't exist.
 func (s *SQL) Connect(dsn string) error {
+	var err error
+	if strings.HasPrefix(dsn, SQLitePrefix) {
+		err = s.connectSQLite(strings.TrimPrefix(dsn, SQLitePrefix))
+	} else {
+		err = s.connectMySQL(dsn)
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.AccessFlushInterval > 0 {
+		s.tracker = newAccessTracker(s, s.AccessFlushInterval)
+	}
+	return nil
+}
+
+func (s *SQL) connectMySQL(dsn string) error {
 	var err error
 	// interpolateParams is necessary. otherwise uploading a stream with thousands of blobs
 	// will hit MySQL's max_prepared_stmt_count limit because the prepared statements are all
@@ -85,7 +123,18 @@ func (s *SQL) Connect(dsn string) error {
 
 	s.conn.SetMaxIdleConns(12)
 
-	return errors.Err(s.conn.Ping())
+	err = s.conn.Ping()
+	if err != nil {
+		return errors.Err(err)
+	}
+	err = s.connectReplicas()
+	if err != nil {
+		return err
+	}
+	if s.SkipSchemaCheck {
+		return nil
+	}
+	return s.CheckSchema()
 }
 
 // AddBlob adds a blob to the database.
@@ -95,31 +144,51 @@ func (s *SQL) AddBlob(hash string, length int, isStored bool) error {
 	}
 
 	_, err := s.insertBlob(hash, length, isStored)
-	return err
+	if err != nil || !isStored {
+		return err
+	}
+	return s.progressStreams([]string{hash})
+}
+
+// BlobInfo describes a blob for AddBlobs
+type BlobInfo struct {
+	Hash     string
+	Length   int
+	IsStored bool
+	// only used when tracking blob access. defaults to now
+	LastAccessedAt time.Time
 }
 
-//AddBlobs adds blobs to the database.
-func (s *SQL) AddBlobs(hash []string) error {
+// addBlobsBatchSize is how many rows go into a single INSERT
+const addBlobsBatchSize = 1000
+
+// AddBlobs adds blobs to the database using multi-row INSERTs, one transaction per batch. Large lists are split
+// between several workers.
+func (s *SQL) AddBlobs(blobs []BlobInfo) error {
 	if s.conn == nil {
 		return errors.Err("not connected")
 	}
 
-	batch := 10000
-	totalBlobs := int64(len(hash))
-	work := make(chan []string, 1000)
+	if len(blobs) <= addBlobsBatchSize {
+		return s.insertBlobs(blobs)
+	}
+
+	totalBlobs := int64(len(blobs))
+	work := make(chan []BlobInfo, 1000)
 	stopper := stop.New()
 	var totalInserted atomic.Int64
+	var failedBatches atomic.Int64
 	start := time.Now()
 
 	go func() {
-		for i := 0; i < len(hash); i += batch {
-			j := i + batch
-			if j > len(hash) {
-				j = len(hash)
+		for i := 0; i < len(blobs); i += addBlobsBatchSize {
+			j := i + addBlobsBatchSize
+			if j > len(blobs) {
+				j = len(blobs)
 			}
-			work <- hash[i:j]
+			work <- blobs[i:j]
 		}
-		log.Infof("done loading %d hashes in the work queue", len(hash))
+		log.Infof("done loading %d blobs in the work queue", len(blobs))
 		close(work)
 	}()
 
@@ -128,49 +197,120 @@ func (s *SQL) AddBlobs(hash []string) error {
 		go func(worker int) {
 			log.Infof("starting worker %d", worker)
 			defer stopper.Done()
-			for hashes := range work {
+			for batch := range work {
 				inserted := totalInserted.Load()
 				remaining := totalBlobs - inserted
 				if inserted > 0 {
 					timePerBlob := time.Since(start).Microseconds() / inserted
 					remainingTime := time.Duration(remaining*timePerBlob) * time.Microsecond
-					log.Infof("[T%d] processing batch of %d items. ETA: %s", worker, len(hashes), remainingTime.String())
+					log.Infof("[T%d] processing batch of %d items. ETA: %s", worker, len(batch), remainingTime.String())
 				}
-				err := s.insertBlobs(hashes) // Process the batch.
+				err := s.insertBlobs(batch) // Process the batch.
 				if err != nil {
 					log.Errorf("error while inserting batch: %s", errors.FullTrace(err))
+					failedBatches.Inc()
 				}
-				totalInserted.Add(int64(len(hashes)))
+				totalInserted.Add(int64(len(batch)))
 			}
 		}(i)
 	}
 
 	stopper.Wait()
+	if failed := failedBatches.Load(); failed > 0 {
+		return errors.Err("%d batches of blobs could not be inserted", failed)
+	}
 	return nil
 }
 
-func (s *SQL) insertBlobs(hashes []string) error {
-	var (
-		q string
-		//args []interface{}
-	)
-	dayAgo := time.Now().AddDate(0, 0, -1).Format("2006-01-02 15:04:05")
-	q = "insert into blob_ (hash, is_stored, length, last_accessed_at) values "
-	for _, hash := range hashes {
-		// prepared statements slow everything down by a lot due to reflection
-		// for this specific instance we'll go ahead and hardcode the query to make it go faster
-		q += fmt.Sprintf("('%s',1,%d,'%s'),", hash, stream.MaxBlobSize, dayAgo)
-		//args = append(args, hash, true, stream.MaxBlobSize, dayAgo)
-	}
-	q = strings.TrimSuffix(q, ",")
-	_, err := s.exec(q)
+// insertBlobs inserts the blobs in one transaction and updates the pending streams that they are part of
+func (s *SQL) insertBlobs(blobs []BlobInfo) error {
+	if len(blobs) == 0 {
+		return nil
+	}
+
+	err := withTx(s.conn, func(tx *sql.Tx) error {
+		return s.insertBlobsTx(tx, blobs)
+	})
 	if err != nil {
 		return err
 	}
 
+	var stored []string
+	for _, b := range blobs {
+		if b.IsStored {
+			stored = append(stored, b.Hash)
+		}
+	}
+	return s.progressStreams(stored)
+}
+
+// insertBlobsTx inserts blobs with one multi-row INSERT per addBlobsBatchSize blobs
+func (s *SQL) insertBlobsTx(tx *sql.Tx, blobs []BlobInfo) error {
+	trackAccess := s.TrackAccess == TrackAccessBlobs
+	columns := 3
+	if trackAccess {
+		columns = 4
+	}
+
+	for i := 0; i < len(blobs); i += addBlobsBatchSize {
+		j := i + addBlobsBatchSize
+		if j > len(blobs) {
+			j = len(blobs)
+		}
+		batch := blobs[i:j]
+
+		var q strings.Builder
+		args := make([]interface{}, 0, len(batch)*columns)
+		if trackAccess {
+			q.WriteString("INSERT INTO blob_ (hash, is_stored, length, last_accessed_at) VALUES ")
+		} else {
+			q.WriteString("INSERT INTO blob_ (hash, is_stored, length) VALUES ")
+		}
+		now := time.Now()
+		for k, b := range batch {
+			if b.Length <= 0 {
+				return errors.Err("length must be positive for blob %s", b.Hash)
+			}
+			if k > 0 {
+				q.WriteString(",")
+			}
+			q.WriteString("(" + qt.Qs(columns) + ")")
+			args = append(args, b.Hash, b.IsStored, b.Length)
+			if trackAccess {
+				accessed := b.LastAccessedAt
+				if accessed.IsZero() {
+					accessed = now
+				}
+				args = append(args, accessed)
+			}
+		}
+		q.WriteString(s.blobUpsertClause())
+
+		query := q.String()
+		s.logQuery(query, args...)
+		_, err := tx.Exec(query, args...)
+		if err != nil {
+			return errors.Err(err)
+		}
+	}
 	return nil
 }
 
+// blobUpsertClause makes inserting a blob that's already in the db mark it as stored if the new row is stored, and
+// update its access time if access is tracked
+func (s *SQL) blobUpsertClause() string {
+	if s.dialect == dialectSQLite {
+		if s.TrackAccess == TrackAccessBlobs {
+			return " ON CONFLICT (hash) DO UPDATE SET is_stored = (is_stored or excluded.is_stored), last_accessed_at = excluded.last_accessed_at"
+		}
+		return " ON CONFLICT (hash) DO UPDATE SET is_stored = (is_stored or excluded.is_stored)"
+	}
+	if s.TrackAccess == TrackAccessBlobs {
+		return " ON DUPLICATE KEY UPDATE is_stored = (is_stored or VALUES(is_stored)), last_accessed_at = VALUES(last_accessed_at)"
+	}
+	return " ON DUPLICATE KEY UPDATE is_stored = (is_stored or VALUES(is_stored))"
+}
+
 func (s *SQL) insertBlob(hash string, length int, isStored bool) (int64, error) {
 	if length <= 0 {
 		return 0, errors.Err("length must be positive")
@@ -182,16 +322,21 @@ func (s *SQL) insertBlob(hash string, length int, isStored bool) (int64, error)
 	)
 	if s.TrackAccess == TrackAccessBlobs {
 		args = []interface{}{hash, isStored, length, time.Now()}
-		q = "INSERT INTO blob_ (hash, is_stored, length, last_accessed_at) VALUES (" + qt.Qs(len(args)) + ") ON DUPLICATE KEY UPDATE is_stored = (is_stored or VALUES(is_stored)), last_accessed_at = VALUES(last_accessed_at)"
+		q = "INSERT INTO blob_ (hash, is_stored, length, last_accessed_at) VALUES (" + qt.Qs(len(args)) + ")"
 	} else {
 		args = []interface{}{hash, isStored, length}
-		q = "INSERT INTO blob_ (hash, is_stored, length) VALUES (" + qt.Qs(len(args)) + ") ON DUPLICATE KEY UPDATE is_stored = (is_stored or VALUES(is_stored))"
+		q = "INSERT INTO blob_ (hash, is_stored, length) VALUES (" + qt.Qs(len(args)) + ")"
 	}
+	q += s.blobUpsertClause()
 
 	blobID, err := s.exec(q, args...)
 	if err != nil {
 		return 0, err
 	}
+	if s.dialect == dialectSQLite {
+		// sqlite keeps returning the id of the last inserted row when an insert updates an existing row instead
+		blobID = 0
+	}
 
 	if blobID == 0 {
 		err = s.conn.QueryRow("SELECT id FROM blob_ WHERE hash = ?", hash).Scan(&blobID)
@@ -219,18 +364,24 @@ func (s *SQL) insertStream(hash string, sdBlobID int64) (int64, error) {
 		args []interface{}
 	)
 
+	// new streams start out pending. they are committed once all their blobs are stored
+	now := time.Now()
 	if s.TrackAccess == TrackAccessStreams {
-		args = []interface{}{hash, sdBlobID, time.Now()}
-		q = "INSERT IGNORE INTO stream (hash, sd_blob_id, last_accessed_at) VALUES (" + qt.Qs(len(args)) + ")"
+		args = []interface{}{hash, sdBlobID, true, now, now}
+		q = s.insertIgnore() + " INTO stream (hash, sd_blob_id, is_pending, last_progress_at, last_accessed_at) VALUES (" + qt.Qs(len(args)) + ")"
 	} else {
-		args = []interface{}{hash, sdBlobID}
-		q = "INSERT IGNORE INTO stream (hash, sd_blob_id) VALUES (" + qt.Qs(len(args)) + ")"
+		args = []interface{}{hash, sdBlobID, true, now}
+		q = s.insertIgnore() + " INTO stream (hash, sd_blob_id, is_pending, last_progress_at) VALUES (" + qt.Qs(len(args)) + ")"
 	}
 
 	streamID, err := s.exec(q, args...)
 	if err != nil {
 		return 0, errors.Err(err)
 	}
+	if s.dialect == dialectSQLite {
+		// same as in insertBlob, the id is stale if the stream already existed
+		streamID = 0
+	}
 
 	if streamID == 0 {
 		err = s.conn.QueryRow("SELECT id FROM stream WHERE sd_blob_id = ?", sdBlobID).Scan(&streamID)
@@ -264,7 +415,11 @@ func (s *SQL) HasBlob(hash string, touch bool) (bool, error) {
 func (s *SQL) HasBlobs(hashes []string, touch bool) (map[string]bool, error) {
 	exists, idsNeedingTouch, err := s.hasBlobs(hashes)
 
-	if touch {
+	if touch && s.tracker != nil && s.TrackAccess != TrackAccessNone {
+		for hash := range exists {
+			s.tracker.record(hash)
+		}
+	} else if touch {
 		if s.TrackAccess == TrackAccessBlobs {
 			_ = s.touchBlobs(idsNeedingTouch)
 		} else if s.TrackAccess == TrackAccessStreams {
@@ -312,11 +467,41 @@ func (s *SQL) touchStreams(streamIDs []uint64) error {
 }
 
 func (s *SQL) hasBlobs(hashes []string) (map[string]bool, []uint64, error) {
+	exists, needsTouch, fromReplica, err := s.queryHasBlobs(hashes, true)
+	if err != nil || !fromReplica || len(exists) == len(hashes) {
+		return exists, needsTouch, err
+	}
+
+	// the replica may not have caught up with blobs that were just added
+	var missing []string
+	for _, h := range hashes {
+		if !exists[h] {
+			missing = append(missing, h)
+		}
+	}
+	existsOnPrimary, needsTouchOnPrimary, _, err := s.queryHasBlobs(missing, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	for h := range existsOnPrimary {
+		exists[h] = true
+	}
+	return exists, append(needsTouch, needsTouchOnPrimary...), nil
+}
+
+// notPendingSdBlob leaves out the sd blobs of pending streams in queries on blob_ b, so that a stream is only served
+// once all of its blobs are stored
+const notPendingSdBlob = "NOT EXISTS (SELECT 1 FROM stream ps WHERE ps.sd_blob_id = b.id AND ps.is_pending = 1)"
+
+// queryHasBlobs looks up which blobs are stored, on a replica if useReplica is set and one is available. It returns
+// whether any of the lookups was answered by a replica.
+func (s *SQL) queryHasBlobs(hashes []string, useReplica bool) (map[string]bool, []uint64, bool, error) {
 	if s.conn == nil {
-		return nil, nil, errors.Err("not connected")
+		return nil, nil, false, errors.Err("not connected")
 	}
 
 	var (
+		fromReplica    bool
 		hash           string
 		blobID         uint64
 		streamID       null.Uint64
@@ -342,17 +527,17 @@ func (s *SQL) hasBlobs(hashes []string) (map[string]bool, []uint64, error) {
 		if s.TrackAccess == TrackAccessBlobs {
 			query = `SELECT b.hash, b.id, NULL, b.last_accessed_at
 FROM blob_ b
-WHERE b.is_stored = 1 and b.hash IN (` + qt.Qs(len(batch)) + `)`
+WHERE b.is_stored = 1 and b.hash IN (` + qt.Qs(len(batch)) + `) AND ` + notPendingSdBlob
 		} else if s.TrackAccess == TrackAccessStreams {
 			query = `SELECT b.hash, b.id, s.id, s.last_accessed_at
 FROM blob_ b
 LEFT JOIN stream_blob sb ON b.id = sb.blob_id
 INNER JOIN stream s on (sb.stream_id = s.id or s.sd_blob_id = b.id)
-WHERE b.is_stored = 1 and b.hash IN (` + qt.Qs(len(batch)) + `)`
+WHERE b.is_stored = 1 and b.hash IN (` + qt.Qs(len(batch)) + `) AND ` + notPendingSdBlob
 		} else {
 			query = `SELECT b.hash, b.id, NULL, NULL
 FROM blob_ b
-WHERE b.is_stored = 1 and b.hash IN (` + qt.Qs(len(batch)) + `)`
+WHERE b.is_stored = 1 and b.hash IN (` + qt.Qs(len(batch)) + `) AND ` + notPendingSdBlob
 		}
 
 		args := make([]interface{}, len(batch))
@@ -360,11 +545,18 @@ WHERE b.is_stored = 1 and b.hash IN (` + qt.Qs(len(batch)) + `)`
 			args[i] = batch[i]
 		}
 
-		s.logQuery(query, args...)
-
 		err := func() error {
 			startTime := time.Now()
-			rows, err := s.conn.Query(query, args...)
+			var rows *sql.Rows
+			var err error
+			if useReplica {
+				var replicaRows bool
+				rows, replicaRows, err = s.readQuery(query, args...)
+				fromReplica = fromReplica || replicaRows
+			} else {
+				s.logQuery(query, args...)
+				rows, err = s.conn.Query(query, args...)
+			}
 			log.Debugf("hashes query took %s", time.Since(startTime))
 			if err != nil {
 				return errors.Err(err)
@@ -395,11 +587,11 @@ WHERE b.is_stored = 1 and b.hash IN (` + qt.Qs(len(batch)) + `)`
 			return nil
 		}()
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, false, err
 		}
 	}
 
-	return exists, needsTouch, nil
+	return exists, needsTouch, fromReplica, nil
 }
 
 // Delete will remove (or soft-delete) the blob from the db
@@ -410,10 +602,21 @@ func (s *SQL) Delete(hash string) error {
 		return errors.Err(err)
 	}
 
-	_, err := s.exec("DELETE FROM stream WHERE sd_blob_id = (SELECT id FROM blob_ WHERE hash = ?)", hash)
-	if err != nil {
+	// the stream of an sd blob goes with it, and its content blobs are released
+	var streamID int64
+	err := s.conn.QueryRow("SELECT s.id FROM stream s INNER JOIN blob_ b ON b.id = s.sd_blob_id WHERE b.hash = ?", hash).Scan(&streamID)
+	if err != nil && err != sql.ErrNoRows {
 		return errors.Err(err)
 	}
+	if err == nil {
+		err = withTx(s.conn, func(tx *sql.Tx) error {
+			_, _, err := s.deleteStreamTx(tx, streamID, false)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
 
 	_, err = s.exec("DELETE FROM blob_ WHERE hash = ?", hash)
 	return errors.Err(err)
@@ -469,7 +672,7 @@ func (s *SQL) Count() (int, error) {
 
 // Block will mark a blob as blocked
 func (s *SQL) Block(hash string) error {
-	query := "INSERT IGNORE INTO blocked SET hash = ?"
+	query := s.insertIgnore() + " INTO blocked (hash) VALUES (?)"
 	args := []interface{}{hash}
 	s.logQuery(query, args...)
 	_, err := s.conn.Exec(query, args...)
@@ -479,8 +682,7 @@ func (s *SQL) Block(hash string) error {
 // GetBlocked will return a list of blocked hashes
 func (s *SQL) GetBlocked() (map[string]bool, error) {
 	query := "SELECT hash FROM blocked"
-	s.logQuery(query)
-	rows, err := s.conn.Query(query)
+	rows, _, err := s.readQuery(query)
 	if err != nil {
 		return nil, errors.Err(err)
 	}
@@ -505,9 +707,10 @@ func (s *SQL) GetBlocked() (map[string]bool, error) {
 	return blocked, nil
 }
 
-// MissingBlobsForKnownStream returns missing blobs for an existing stream
+// MissingBlobsForKnownStream returns missing blobs for an existing stream. Pending streams are included, so that an
+// upload can resume even when a store in front of the db already has the sd blob
 // WARNING: if the stream does NOT exist, no blob hashes will be returned, which looks
-// like no blobs are missing
+// like no blobs are missing. This is why it never reads from a replica
 func (s *SQL) MissingBlobsForKnownStream(sdHash string) ([]string, error) {
 	if s.conn == nil {
 		return nil, errors.Err("not connected")
@@ -567,27 +770,252 @@ func (s *SQL) AddSDBlob(sdHash string, sdBlobLength int, sdBlob SdBlob) error {
 	}
 
 	// insert content blobs and connect them to stream
+	var contentBlobs []BlobInfo
+	nums := make(map[string]int, len(sdBlob.Blobs))
 	for _, contentBlob := range sdBlob.Blobs {
 		if contentBlob.BlobHash == "" {
 			// null terminator blob
 			continue
 		}
+		contentBlobs = append(contentBlobs, BlobInfo{Hash: contentBlob.BlobHash, Length: contentBlob.Length})
+		nums[contentBlob.BlobHash] = contentBlob.BlobNum
+	}
+
+	for i := 0; i < len(contentBlobs); i += addBlobsBatchSize {
+		j := i + addBlobsBatchSize
+		if j > len(contentBlobs) {
+			j = len(contentBlobs)
+		}
+		batch := contentBlobs[i:j]
+
+		err = withTx(s.conn, func(tx *sql.Tx) error {
+			err := s.insertBlobsTx(tx, batch)
+			if err != nil {
+				return err
+			}
+			ids, err := s.blobIDs(tx, batch)
+			if err != nil {
+				return err
+			}
+
+			blobIDs := make([]interface{}, 0, len(batch))
+			for _, b := range batch {
+				id, ok := ids[b.Hash]
+				if !ok {
+					return errors.Err("blob %s is missing after inserting it", b.Hash)
+				}
+				blobIDs = append(blobIDs, id)
+			}
+			// blobs that are in the stream already, when the sd blob is uploaded again, are not counted again
+			linked, err := s.linkedBlobs(tx, streamID, blobIDs)
+			if err != nil {
+				return err
+			}
 
-		blobID, err := s.insertBlob(contentBlob.BlobHash, contentBlob.Length, false)
+			args := make([]interface{}, 0, len(batch)*3)
+			added := make([]interface{}, 0, len(batch))
+			for _, b := range batch {
+				id := ids[b.Hash]
+				if linked[id] {
+					continue
+				}
+				linked[id] = true
+				args = append(args, streamID, id, nums[b.Hash])
+				added = append(added, id)
+			}
+			if len(added) == 0 {
+				return nil
+			}
+			query := s.insertIgnore() + " INTO stream_blob (stream_id, blob_id, num) VALUES " +
+				strings.TrimSuffix(strings.Repeat("("+qt.Qs(3)+"),", len(added)), ",")
+			s.logQuery(query, args...)
+			_, err = tx.Exec(query, args...)
+			if err != nil {
+				return errors.Err(err)
+			}
+			return s.addRefs(tx, added)
+		})
 		if err != nil {
 			return err
 		}
+	}
+
+	// all the content blobs may be stored already. if the sd blob was sent again to resume an upload, that's progress
+	return s.progressStream(streamID)
+}
 
-		args := []interface{}{streamID, blobID, contentBlob.BlobNum}
-		_, err = s.exec(
-			"INSERT IGNORE INTO stream_blob (stream_id, blob_id, num) VALUES ("+qt.Qs(len(args))+")",
-			args...,
-		)
+// blobIDs returns the ids of the blobs, by hash
+func (s *SQL) blobIDs(tx *sql.Tx, blobs []BlobInfo) (map[string]int64, error) {
+	args := make([]interface{}, len(blobs))
+	for i := range blobs {
+		args[i] = blobs[i].Hash
+	}
+	query := "SELECT hash, id FROM blob_ WHERE hash IN (" + qt.Qs(len(blobs)) + ")"
+	s.logQuery(query, args...)
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer closeRows(rows)
+
+	ids := make(map[string]int64, len(blobs))
+	for rows.Next() {
+		var hash string
+		var id int64
+		err := rows.Scan(&hash, &id)
 		if err != nil {
-			return errors.Err(err)
+			return nil, errors.Err(err)
 		}
+		ids[hash] = id
 	}
-	return nil
+	return ids, errors.Err(rows.Err())
+}
+
+// pendingStreamsWith is a condition on stream that matches the pending streams with a content blob b that matches where
+func pendingStreamsWith(where string) string {
+	return `is_pending = 1 AND id IN (
+			SELECT sb.stream_id FROM stream_blob sb
+			INNER JOIN blob_ b ON b.id = sb.blob_id
+			WHERE ` + where + `)`
+}
+
+// streamComplete is a condition on stream that matches the streams with all of their content blobs stored
+const streamComplete = `NOT EXISTS (
+			SELECT 1 FROM stream_blob sb
+			INNER JOIN blob_ b ON b.id = sb.blob_id
+			WHERE sb.stream_id = stream.id AND b.is_stored = 0)`
+
+// progressStreams bumps last_progress_at of the pending streams that the stored blobs are part of, and commits the
+// ones that got their last missing blobs. Blobs that are part of no pending stream only cost the first UPDATE, which
+// only looks at pending streams
+func (s *SQL) progressStreams(hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, 0, len(hashes)+1)
+	args = append(args, time.Now())
+	for _, h := range hashes {
+		args = append(args, h)
+	}
+	pending := pendingStreamsWith("b.hash IN (" + qt.Qs(len(hashes)) + ")")
+
+	progressed, err := s.execAffected("UPDATE stream SET last_progress_at = ? WHERE "+pending, args...)
+	if err != nil || progressed == 0 {
+		return err
+	}
+	_, err = s.execAffected("UPDATE stream SET is_pending = 0 WHERE "+pending+" AND "+streamComplete, args[1:]...)
+	return err
+}
+
+// progressStream bumps last_progress_at of a pending stream, and commits it if all of its content blobs are stored
+func (s *SQL) progressStream(streamID int64) error {
+	_, err := s.execAffected("UPDATE stream SET last_progress_at = ? WHERE id = ? AND is_pending = 1", time.Now(), streamID)
+	if err != nil {
+		return err
+	}
+	_, err = s.execAffected("UPDATE stream SET is_pending = 0 WHERE id = ? AND is_pending = 1 AND "+streamComplete, streamID)
+	return err
+}
+
+// AbortPendingStreams deletes the streams that are still missing some of their blobs and had none of them stored
+// since olderThan, and returns the hashes of their sd blobs. The blobs themselves are left alone, so that the caller can delete
+// them from the blob store. Content blobs that are not part of any other stream are then picked up by OrphanedBlobs.
+func (s *SQL) AbortPendingStreams(olderThan time.Time) ([]string, error) {
+	if s.conn == nil {
+		return nil, errors.Err("not connected")
+	}
+
+	query := `
+		SELECT s.id, b.hash FROM stream s
+		INNER JOIN blob_ b ON b.id = s.sd_blob_id
+		WHERE s.is_pending = 1 AND s.last_progress_at < ?`
+	s.logQuery(query, olderThan)
+
+	rows, err := s.conn.Query(query, olderThan)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer closeRows(rows)
+
+	type pending struct {
+		id     int64
+		sdHash string
+	}
+	var streams []pending
+	for rows.Next() {
+		var p pending
+		err := rows.Scan(&p.id, &p.sdHash)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		streams = append(streams, p)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	var sdHashes []string
+	for _, p := range streams {
+		var deleted bool
+		err := withTx(s.conn, func(tx *sql.Tx) error {
+			var err error
+			// is_pending is checked again in case the stream was committed in the meantime
+			deleted, _, err = s.deleteStreamTx(tx, p.id, true)
+			return err
+		})
+		if err != nil {
+			return sdHashes, err
+		}
+		if deleted {
+			sdHashes = append(sdHashes, p.sdHash)
+		}
+	}
+	return sdHashes, nil
+}
+
+// OrphanedBlobs returns up to limit blobs that are neither the sd blob nor a content blob of any stream and were added
+// before olderThan, in hash order starting after the given hash. Pass an empty string to start from the beginning.
+// Blobs that were in the db before created_at was added have a NULL created_at and are never returned, since their
+// age is unknown
+func (s *SQL) OrphanedBlobs(olderThan time.Time, after string, limit int) ([]string, error) {
+	if s.conn == nil {
+		return nil, errors.Err("not connected")
+	}
+
+	query := `
+		SELECT b.hash FROM blob_ b
+		LEFT JOIN stream_blob sb ON sb.blob_id = b.id
+		LEFT JOIN stream s ON s.sd_blob_id = b.id
+		WHERE sb.blob_id IS NULL AND s.id IS NULL AND b.created_at IS NOT NULL AND b.created_at < ? AND b.hash > ?`
+	if s.SoftDelete {
+		// soft-deleted blobs stay in the table, don't return them again
+		query += " AND b.is_stored = 1"
+	}
+	query += " ORDER BY b.hash LIMIT ?"
+	args := []interface{}{olderThan, after, limit}
+
+	s.logQuery(query, args...)
+
+	rows, err := s.conn.Query(query, args...)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer closeRows(rows)
+
+	hashes := make([]string, 0, limit)
+	var hash string
+	for rows.Next() {
+		err := rows.Scan(&hash)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, errors.Err(rows.Err())
 }
 
 // GetHashRange gets the smallest and biggest hashes in the db
@@ -601,13 +1029,34 @@ func (s *SQL) GetHashRange() (string, string, error) {
 
 	query := "SELECT MIN(hash), MAX(hash) from blob_"
 
-	s.logQuery(query)
-
-	err := s.conn.QueryRow(query).Scan(&min, &max)
+	err := s.readQueryRow(query, nil, &min, &max)
 	return min, max, err
 }
 
-// GetStoredHashesInRange gets stored blobs with hashes in a given range, and sends the hashes into a channel
+// CountStoredHashesInRange counts the stored blobs with hashes in a given range
+func (s *SQL) CountStoredHashesInRange(start, end bits.Bitmap) (int, error) {
+	if s.conn == nil {
+		return 0, errors.Err("not connected")
+	}
+
+	query := "SELECT count(id) FROM blob_ WHERE hash >= ? AND hash <= ? AND is_stored = 1"
+	args := []interface{}{start.Hex(), end.Hex()}
+
+	var count int
+	err := s.readQueryRow(query, args, &count)
+	return count, errors.Err(err)
+}
+
+const (
+	// storedHashesPageSize is how many hashes GetStoredHashesInRange reads with each query
+	storedHashesPageSize = 1000
+	// storedHashesPagePause is how long GetStoredHashesInRange waits between pages, so a large range doesn't load the db
+	storedHashesPagePause = 50 * time.Millisecond
+)
+
+// GetStoredHashesInRange gets stored blobs with hashes in a given range, and sends the hashes into a channel. The
+// hashes are read a page at a time, and each page's query is done before its hashes are sent, so a slow reader
+// doesn't keep a query open on the db
 func (s *SQL) GetStoredHashesInRange(ctx context.Context, start, end bits.Bitmap) (ch chan bits.Bitmap, ech chan error) {
 	ch = make(chan bits.Bitmap)
 	ech = make(chan error)
@@ -622,43 +1071,62 @@ func (s *SQL) GetStoredHashesInRange(ctx context.Context, start, end bits.Bitmap
 			return
 		}
 
-		query := "SELECT hash FROM blob_ WHERE hash >= ? AND hash <= ? AND is_stored = 1"
-		args := []interface{}{start.Hex(), end.Hex()}
-
-		s.logQuery(query, args...)
-
-		rows, err := s.conn.Query(query, args...)
-		defer closeRows(rows)
-		if err != nil {
-			ech <- err
-			return
-		}
-
-		var hash string
-	ScanLoop:
-		for rows.Next() {
-			err := rows.Scan(&hash)
+		after := ""
+		for {
+			hashes, err := s.StoredHashesInRange(start, end, after, storedHashesPageSize)
 			if err != nil {
 				ech <- err
 				return
 			}
+			for _, hash := range hashes {
+				select {
+				case <-ctx.Done():
+					return
+				case ch <- bits.FromHexP(hash):
+				}
+			}
+			if len(hashes) < storedHashesPageSize {
+				return
+			}
+			after = hashes[len(hashes)-1]
 			select {
 			case <-ctx.Done():
-				break ScanLoop
-			case ch <- bits.FromHexP(hash):
+				return
+			case <-time.After(storedHashesPagePause):
 			}
 		}
-
-		err = rows.Err()
-		if err != nil {
-			ech <- err
-			return
-		}
 	}()
 
 	return
 }
 
+// StoredHashesInRange returns up to limit stored blobs with hashes in a given range, in hash order starting after the
+// given hash. Pass an empty string to start from the beginning of the range
+func (s *SQL) StoredHashesInRange(start, end bits.Bitmap, after string, limit int) ([]string, error) {
+	if s.conn == nil {
+		return nil, errors.Err("not connected")
+	}
+
+	query := "SELECT b.hash FROM blob_ b WHERE b.hash >= ? AND b.hash > ? AND b.hash <= ? AND b.is_stored = 1 AND " +
+		notPendingSdBlob + " ORDER BY b.hash LIMIT ?"
+	rows, _, err := s.readQuery(query, start.Hex(), after, end.Hex(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+
+	hashes := make([]string, 0, limit)
+	var hash string
+	for rows.Next() {
+		err := rows.Scan(&hash)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, errors.Err(rows.Err())
+}
+
 // txFunc is a function that can be wrapped in a transaction
 type txFunc func(tx *sql.Tx) error
 
@@ -727,6 +1195,17 @@ Retry:
 	return lastID, errors.Err(err)
 }
 
+// execAffected runs a query like exec, and returns the number of rows it changed
+func (s *SQL) execAffected(query string, args ...interface{}) (int64, error) {
+	s.logQuery(query, args...)
+	result, err := s.conn.Exec(query, args...)
+	if err != nil {
+		return 0, errors.Err(err)
+	}
+	affected, err := result.RowsAffected()
+	return affected, errors.Err(err)
+}
+
 func isLockTimeoutError(err error) bool {
 	e, ok := err.(*mysql.MySQLError)
 	return ok && e != nil && e.Number == 1205
@@ -734,48 +1213,11 @@ func isLockTimeoutError(err error) bool {
 
 /*  SQL schema
 
+the schema is created and updated by the migrations in the migrations dir. run `prism migrate up` to apply them.
+
 in prod, set tx_isolation to READ-COMMITTED to improve db performance
 make sure you use latin1 or utf8 charset, NOT utf8mb4. that's a waste of space.
 
 todo: could add UNIQUE KEY (stream_hash, num) to stream_blob ...
 
-CREATE TABLE blob_ (
-  id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT UNIQUE,
-  hash char(96) NOT NULL,
-  is_stored TINYINT(1) NOT NULL DEFAULT 0,
-  length bigint(20) unsigned DEFAULT NULL,
-  last_accessed_at TIMESTAMP NULL DEFAULT NULL,
-  PRIMARY KEY (id),
-  UNIQUE KEY blob_hash_idx (hash),
-  KEY `blob_last_accessed_idx` (`last_accessed_at`),
-  KEY `is_stored_idx` (`is_stored`)
-);
-
-CREATE TABLE stream (
-  id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT UNIQUE,
-  hash char(96) NOT NULL,
-  sd_blob_id BIGINT UNSIGNED NOT NULL,
-  last_accessed_at TIMESTAMP NULL DEFAULT NULL,
-  PRIMARY KEY (id),
-  UNIQUE KEY stream_hash_idx (hash),
-  KEY stream_sd_blob_id_idx (sd_blob_id),
-  KEY last_accessed_at_idx (last_accessed_at),
-  FOREIGN KEY (sd_blob_id) REFERENCES blob_ (id) ON DELETE RESTRICT ON UPDATE CASCADE
-);
-
-CREATE TABLE stream_blob (
-  stream_id BIGINT UNSIGNED NOT NULL,
-  blob_id BIGINT UNSIGNED NOT NULL,
-  num int NOT NULL,
-  PRIMARY KEY (stream_id, blob_id),
-  KEY stream_blob_blob_id_idx (blob_id),
-  FOREIGN KEY (stream_id) REFERENCES stream (id) ON DELETE CASCADE ON UPDATE CASCADE,
-  FOREIGN KEY (blob_id) REFERENCES blob_ (id) ON DELETE CASCADE ON UPDATE CASCADE
-);
-
-CREATE TABLE blocked (
-  hash char(96) NOT NULL,
-  PRIMARY KEY (hash)
-);
-
 */
@@ -0,0 +1,308 @@
+package db
+
+import (
+	"database/sql"
+	"embed"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Migrations live in migrations/<dialect>/ as NNNN_name.up.sql and NNNN_name.down.sql. Both dialects use the same
+// version numbers. The current version is kept in the schema_migrations table, along with a dirty flag that is set
+// while a migration runs. If a migration fails halfway, the db stays dirty until someone fixes it by hand and calls
+// ForceSchemaVersion.
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// ErrSchemaOutdated is returned by CheckSchema when there are migrations that have not been applied yet
+var ErrSchemaOutdated = errors.Base("db schema is outdated, run `prism migrate up`")
+
+// ErrSchemaDirty is returned when a previous migration failed halfway
+var ErrSchemaDirty = errors.Base("db schema is dirty, a migration failed. fix it by hand and use `prism migrate force`")
+
+// ErrDropAll is returned by MigrateDown when it would roll back the first migration, which drops the blob tables,
+// without being asked to
+var ErrDropAll = errors.Base("rolling back the first migration drops the blob, stream and stream_blob tables")
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+func (s *SQL) migrations() ([]migration, error) {
+	dir := "migrations/mysql"
+	if s.dialect == dialectSQLite {
+		dir = "migrations/sqlite"
+	}
+	files, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, f := range files {
+		name := f.Name()
+		parts := strings.SplitN(strings.TrimSuffix(name, ".sql"), "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, errors.Err("invalid migration file name %s", name)
+		}
+		content, err := migrationFiles.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version}
+			byVersion[version] = m
+		}
+		switch {
+		case strings.HasSuffix(parts[1], ".up"):
+			m.name = strings.TrimSuffix(parts[1], ".up")
+			m.up = string(content)
+		case strings.HasSuffix(parts[1], ".down"):
+			m.down = string(content)
+		default:
+			return nil, errors.Err("migration file %s is neither up nor down", name)
+		}
+	}
+
+	list := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].version < list[j].version })
+	return list, nil
+}
+
+// LatestSchemaVersion returns the version that the db will be at once all migrations are applied
+func (s *SQL) LatestSchemaVersion() (int, error) {
+	list, err := s.migrations()
+	if err != nil || len(list) == 0 {
+		return 0, err
+	}
+	return list[len(list)-1].version, nil
+}
+
+// SchemaVersion returns the version of the last migration applied to the db, and whether it failed halfway.
+// A db that has never been migrated is at version 0. It doesn't change the db.
+func (s *SQL) SchemaVersion() (int, bool, error) {
+	if s.conn == nil {
+		return 0, false, errors.Err("not connected")
+	}
+	exists, err := s.schemaTableExists()
+	if err != nil || !exists {
+		return 0, false, err
+	}
+
+	var version int
+	var dirty bool
+	err = s.conn.QueryRow("SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return version, dirty, errors.Err(err)
+}
+
+// schemaTableExists returns whether the schema_migrations table was created
+func (s *SQL) schemaTableExists() (bool, error) {
+	query := "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = 'schema_migrations'"
+	if s.dialect == dialectSQLite {
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'"
+	}
+	var n int
+	err := s.conn.QueryRow(query).Scan(&n)
+	return n > 0, errors.Err(err)
+}
+
+// createSchemaTable creates the schema_migrations table if it doesn't exist yet
+func (s *SQL) createSchemaTable() error {
+	_, err := s.conn.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL PRIMARY KEY, dirty TINYINT(1) NOT NULL)")
+	return errors.Err(err)
+}
+
+// CheckSchema returns an error if the db is missing migrations or a migration failed. A db with a newer schema than
+// this binary knows about is only logged, since migrations are supposed to be backwards compatible.
+func (s *SQL) CheckSchema() error {
+	version, dirty, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return errors.Err(ErrSchemaDirty)
+	}
+	latest, err := s.LatestSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version < latest {
+		return errors.Prefix("version "+strconv.Itoa(version)+" < "+strconv.Itoa(latest), ErrSchemaOutdated)
+	}
+	if version > latest {
+		log.Warnf("db schema version %d is newer than the latest one this binary knows (%d)", version, latest)
+	}
+	return nil
+}
+
+// MigrateUp applies up to steps migrations that have not been applied yet, or all of them if steps is 0.
+// It returns the number of migrations applied.
+func (s *SQL) MigrateUp(steps int) (int, error) {
+	if s.conn == nil {
+		return 0, errors.Err("not connected")
+	}
+	err := s.createSchemaTable()
+	if err != nil {
+		return 0, err
+	}
+	version, dirty, err := s.SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	if dirty {
+		return 0, errors.Err(ErrSchemaDirty)
+	}
+	list, err := s.migrations()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, m := range list {
+		if m.version <= version {
+			continue
+		}
+		if steps > 0 && applied == steps {
+			break
+		}
+		log.Infof("applying migration %04d_%s", m.version, m.name)
+		err = s.runMigration(m.up, m.version)
+		if err != nil {
+			return applied, errors.Prefix("migration "+strconv.Itoa(m.version), err)
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// MigrateDown rolls back the last steps migrations, at least one. Rolling back the first migration drops the tables
+// that track the blobs, so it's refused with ErrDropAll unless dropAll is set.
+// It returns the number of migrations rolled back.
+func (s *SQL) MigrateDown(steps int, dropAll bool) (int, error) {
+	if steps < 1 {
+		return 0, errors.Err("at least one migration must be rolled back")
+	}
+	version, dirty, err := s.SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	if dirty {
+		return 0, errors.Err(ErrSchemaDirty)
+	}
+	list, err := s.migrations()
+	if err != nil {
+		return 0, err
+	}
+
+	var applied []int // indexes of the applied migrations, the last one first
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].version <= version {
+			applied = append(applied, i)
+		}
+	}
+	if len(applied) > steps {
+		applied = applied[:steps]
+	}
+	if len(applied) > 0 && applied[len(applied)-1] == 0 && !dropAll {
+		return 0, errors.Err(ErrDropAll)
+	}
+
+	rolledBack := 0
+	for _, i := range applied {
+		m := list[i]
+		previous := 0
+		if i > 0 {
+			previous = list[i-1].version
+		}
+		log.Infof("rolling back migration %04d_%s", m.version, m.name)
+		err = s.runMigration(m.down, previous)
+		if err != nil {
+			return rolledBack, errors.Prefix("migration "+strconv.Itoa(m.version), err)
+		}
+		rolledBack++
+	}
+	return rolledBack, nil
+}
+
+// ForceSchemaVersion sets the schema version without running any migrations and clears the dirty flag. Use it after
+// fixing a failed migration by hand, or to mark a db whose tables were created by hand as up to date.
+func (s *SQL) ForceSchemaVersion(version int) error {
+	if s.conn == nil {
+		return errors.Err("not connected")
+	}
+	err := s.createSchemaTable()
+	if err != nil {
+		return err
+	}
+	return s.setSchemaVersion(version, false)
+}
+
+// runMigration runs the statements of one migration and records the new version. MySQL can't roll back schema
+// changes, so the version is marked dirty while the statements run. If one of them fails the db stays dirty.
+func (s *SQL) runMigration(script string, newVersion int) error {
+	err := s.setSchemaVersion(newVersion, true)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range splitStatements(script) {
+		s.logQuery(stmt)
+		_, err = s.conn.Exec(stmt)
+		if err != nil {
+			return errors.Err(err)
+		}
+	}
+	return s.setSchemaVersion(newVersion, false)
+}
+
+func (s *SQL) setSchemaVersion(version int, dirty bool) error {
+	return withTx(s.conn, func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM schema_migrations")
+		if err != nil {
+			return errors.Err(err)
+		}
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, dirty) VALUES (?, ?)", version, dirty)
+		return errors.Err(err)
+	})
+}
+
+// splitStatements splits a migration into single statements, dropping comments. Statements end with a semicolon at
+// the end of a line.
+func splitStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(current.String()), ";"))
+			current.Reset()
+		}
+	}
+	if strings.TrimSpace(current.String()) != "" {
+		statements = append(statements, strings.TrimSpace(current.String()))
+	}
+	return statements
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+func TestMigrate_DownAndUp(t *testing.T) {
+	s := testSQLite(t)
+
+	// versions can skip numbers, so count the migrations instead of going by the latest version
+	list, err := s.migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := len(list)
+	if err := s.CheckSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.MigrateDown(0, true); err == nil {
+		t.Error("expected rolling back 0 migrations to fail")
+	}
+	if count > 1 {
+		rolledBack, err := s.MigrateDown(count-1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rolledBack != count-1 {
+			t.Errorf("expected %d migrations to be rolled back, got %d", count-1, rolledBack)
+		}
+	}
+	_, err = s.MigrateDown(count, false)
+	if !errors.Is(err, ErrDropAll) {
+		t.Errorf("expected rolling back the first migration to need dropAll, got %v", err)
+	}
+	if version, _, _ := s.SchemaVersion(); version != 1 {
+		t.Errorf("expected nothing to be rolled back without dropAll, got version %d", version)
+	}
+
+	rolledBack, err := s.MigrateDown(count, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rolledBack != 1 {
+		t.Errorf("expected 1 migration to be rolled back, got %d", rolledBack)
+	}
+	version, dirty, err := s.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 || dirty {
+		t.Errorf("expected clean version 0, got %d (dirty: %t)", version, dirty)
+	}
+
+	applied, err := s.MigrateUp(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != 1 {
+		t.Errorf("expected 1 migration to be applied, got %d", applied)
+	}
+	if err := s.CheckSchema(); err == nil && count > 1 {
+		t.Error("expected the schema to be outdated")
+	}
+
+	_, err = s.MigrateUp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckSchema(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrate_SchemaVersionReadOnly(t *testing.T) {
+	skipWithoutSQLite(t)
+	// a db that was never migrated
+	s := &SQL{SkipSchemaCheck: true}
+	err := s.Connect(SQLitePrefix + filepath.Join(t.TempDir(), "reflector.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, dirty, err := s.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 || dirty {
+		t.Errorf("expected clean version 0, got %d (dirty: %t)", version, dirty)
+	}
+	exists, err := s.schemaTableExists()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("expected reading the schema version not to create the table")
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- a comment
+CREATE TABLE a (
+  id INT
+);
+
+ALTER TABLE a ADD COLUMN b INT;
+`
+	expected := []string{"CREATE TABLE a (\n  id INT\n)", "ALTER TABLE a ADD COLUMN b INT"}
+	if got := splitStatements(script); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
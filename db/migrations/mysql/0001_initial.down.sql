@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS blocked;
+DROP TABLE IF EXISTS stream_blob;
+DROP TABLE IF EXISTS stream;
+DROP TABLE IF EXISTS blob_;
@@ -0,0 +1,3 @@
+ALTER TABLE blob_
+  DROP KEY blob_created_at_idx,
+  DROP COLUMN created_at;
@@ -0,0 +1,6 @@
+-- blobs that were added before this migration keep a NULL created_at, since their age is unknown. gc skips them
+ALTER TABLE blob_
+  ADD COLUMN created_at TIMESTAMP NULL DEFAULT NULL,
+  ADD KEY blob_created_at_idx (created_at);
+ALTER TABLE blob_
+  MODIFY created_at TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP;
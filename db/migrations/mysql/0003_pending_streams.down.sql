@@ -0,0 +1,4 @@
+ALTER TABLE stream
+  DROP KEY stream_pending_idx,
+  DROP COLUMN last_progress_at,
+  DROP COLUMN is_pending;
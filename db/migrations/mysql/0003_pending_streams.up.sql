@@ -0,0 +1,4 @@
+ALTER TABLE stream
+  ADD COLUMN is_pending TINYINT(1) NOT NULL DEFAULT 0 AFTER sd_blob_id,
+  ADD COLUMN last_progress_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  ADD KEY stream_pending_idx (is_pending, last_progress_at);
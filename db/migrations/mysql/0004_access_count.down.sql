@@ -0,0 +1,6 @@
+ALTER TABLE blob_
+  DROP KEY blob_access_count_idx,
+  DROP COLUMN access_count;
+ALTER TABLE stream
+  DROP KEY stream_access_count_idx,
+  DROP COLUMN access_count;
@@ -0,0 +1,6 @@
+ALTER TABLE blob_
+  ADD COLUMN access_count BIGINT UNSIGNED NOT NULL DEFAULT 0 AFTER last_accessed_at,
+  ADD KEY blob_access_count_idx (access_count);
+ALTER TABLE stream
+  ADD COLUMN access_count BIGINT UNSIGNED NOT NULL DEFAULT 0 AFTER last_accessed_at,
+  ADD KEY stream_access_count_idx (access_count);
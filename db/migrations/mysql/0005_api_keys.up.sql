@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS api_key (
+  id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+  name VARCHAR(255) NOT NULL,
+  key_hash CHAR(64) NOT NULL,
+  daily_quota BIGINT UNSIGNED NOT NULL DEFAULT 0,
+  max_rate BIGINT UNSIGNED NOT NULL DEFAULT 0,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  revoked_at TIMESTAMP NULL DEFAULT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY api_key_hash_idx (key_hash)
+);
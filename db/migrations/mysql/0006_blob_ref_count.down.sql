@@ -0,0 +1,2 @@
+ALTER TABLE blob_
+  DROP COLUMN ref_count;
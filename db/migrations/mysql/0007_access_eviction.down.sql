@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS access_decay;
+ALTER TABLE blob_
+  ADD KEY blob_access_count_idx (access_count),
+  DROP KEY blob_eviction_idx;
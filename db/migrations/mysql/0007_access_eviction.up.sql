@@ -0,0 +1,11 @@
+-- EvictionCandidates orders the stored blobs by access_count, then last_accessed_at. The index starts with
+-- access_count, so it replaces the one on access_count alone from 0004
+ALTER TABLE blob_
+  ADD KEY blob_eviction_idx (access_count, last_accessed_at),
+  DROP KEY blob_access_count_idx;
+-- access counts are halved once a day by whichever process sharing the db gets to it first. the one row holds when
+CREATE TABLE IF NOT EXISTS access_decay (
+  id INT UNSIGNED NOT NULL,
+  decayed_at TIMESTAMP NOT NULL,
+  PRIMARY KEY (id)
+);
@@ -0,0 +1,8 @@
+-- what was uploaded with each api key per UTC day, added up over all the reflectors sharing the db
+CREATE TABLE IF NOT EXISTS api_key_usage (
+  api_key_id BIGINT UNSIGNED NOT NULL,
+  day DATE NOT NULL,
+  bytes BIGINT UNSIGNED NOT NULL DEFAULT 0,
+  blobs BIGINT UNSIGNED NOT NULL DEFAULT 0,
+  PRIMARY KEY (api_key_id, day)
+);
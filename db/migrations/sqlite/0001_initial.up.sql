@@ -0,0 +1,36 @@
+-- sqlite support was added after 0002 and 0003, so the initial schema already includes them
+CREATE TABLE IF NOT EXISTS blob_ (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  hash CHAR(96) NOT NULL UNIQUE,
+  is_stored TINYINT(1) NOT NULL DEFAULT 0,
+  length BIGINT DEFAULT NULL,
+  last_accessed_at TIMESTAMP NULL DEFAULT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS blob_last_accessed_idx ON blob_ (last_accessed_at);
+CREATE INDEX IF NOT EXISTS blob_created_at_idx ON blob_ (created_at);
+CREATE INDEX IF NOT EXISTS is_stored_idx ON blob_ (is_stored);
+
+CREATE TABLE IF NOT EXISTS stream (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  hash CHAR(96) NOT NULL UNIQUE,
+  sd_blob_id BIGINT NOT NULL REFERENCES blob_ (id) ON DELETE RESTRICT ON UPDATE CASCADE,
+  is_pending TINYINT(1) NOT NULL DEFAULT 0,
+  last_accessed_at TIMESTAMP NULL DEFAULT NULL,
+  last_progress_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS stream_sd_blob_id_idx ON stream (sd_blob_id);
+CREATE INDEX IF NOT EXISTS last_accessed_at_idx ON stream (last_accessed_at);
+CREATE INDEX IF NOT EXISTS stream_pending_idx ON stream (is_pending, last_progress_at);
+
+CREATE TABLE IF NOT EXISTS stream_blob (
+  stream_id BIGINT NOT NULL REFERENCES stream (id) ON DELETE CASCADE ON UPDATE CASCADE,
+  blob_id BIGINT NOT NULL REFERENCES blob_ (id) ON DELETE CASCADE ON UPDATE CASCADE,
+  num INT NOT NULL,
+  PRIMARY KEY (stream_id, blob_id)
+);
+CREATE INDEX IF NOT EXISTS stream_blob_blob_id_idx ON stream_blob (blob_id);
+
+CREATE TABLE IF NOT EXISTS blocked (
+  hash CHAR(96) NOT NULL PRIMARY KEY
+);
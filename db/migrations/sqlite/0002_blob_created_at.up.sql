@@ -0,0 +1 @@
+-- nothing to do, this is part of 0001_initial for sqlite
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS stream_access_count_idx;
+ALTER TABLE stream DROP COLUMN access_count;
+DROP INDEX IF EXISTS blob_access_count_idx;
+ALTER TABLE blob_ DROP COLUMN access_count;
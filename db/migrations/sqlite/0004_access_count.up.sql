@@ -0,0 +1,4 @@
+ALTER TABLE blob_ ADD COLUMN access_count BIGINT NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS blob_access_count_idx ON blob_ (access_count);
+ALTER TABLE stream ADD COLUMN access_count BIGINT NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS stream_access_count_idx ON stream (access_count);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS api_key (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR(255) NOT NULL,
+  key_hash CHAR(64) NOT NULL UNIQUE,
+  daily_quota BIGINT NOT NULL DEFAULT 0,
+  max_rate BIGINT NOT NULL DEFAULT 0,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  revoked_at TIMESTAMP NULL DEFAULT NULL
+);
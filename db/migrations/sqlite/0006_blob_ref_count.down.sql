@@ -0,0 +1 @@
+ALTER TABLE blob_ DROP COLUMN ref_count;
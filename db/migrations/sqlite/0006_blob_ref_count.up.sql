@@ -0,0 +1,3 @@
+-- ref_count is how many streams have the blob as a content blob. existing blobs start at 0, run `prism refcounts` to
+-- count them. deletes check the streams too, so they are safe until then
+ALTER TABLE blob_ ADD COLUMN ref_count INT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS access_decay;
+CREATE INDEX IF NOT EXISTS blob_access_count_idx ON blob_ (access_count);
+DROP INDEX IF EXISTS blob_eviction_idx;
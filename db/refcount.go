@@ -0,0 +1,233 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	qt "github.com/lbryio/lbry.go/v2/extras/query"
+)
+
+// ErrStreamNotFound is returned when deleting a stream the db doesn't have
+var ErrStreamNotFound = errors.Base("stream not found")
+
+// The ref_count of a blob is how many streams have it as a content blob. It goes up when a stream is added and down
+// when one is deleted, so a blob that several streams share is only deleted with the last of them. The counts are
+// kept in the same transactions as the streams, but uploads of the same stream at once can count a blob twice, which
+// only keeps it around. RepairRefCounts sets them right
+
+// linkedBlobs returns which of the blobs are content blobs of the stream already
+func (s *SQL) linkedBlobs(tx *sql.Tx, streamID int64, blobIDs []interface{}) (map[int64]bool, error) {
+	args := append([]interface{}{streamID}, blobIDs...)
+	query := "SELECT blob_id FROM stream_blob WHERE stream_id = ? AND blob_id IN (" + qt.Qs(len(blobIDs)) + ")"
+	s.logQuery(query, args...)
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer closeRows(rows)
+
+	linked := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		linked[id] = true
+	}
+	return linked, errors.Err(rows.Err())
+}
+
+// addRefs counts one more stream for each of the blobs
+func (s *SQL) addRefs(tx *sql.Tx, blobIDs []interface{}) error {
+	return s.updateRefs(tx, "UPDATE blob_ SET ref_count = ref_count + 1 WHERE id IN (%s)", blobIDs)
+}
+
+// releaseRefs counts one less stream for each of the blobs. Counts that are already 0 stay there
+func (s *SQL) releaseRefs(tx *sql.Tx, blobIDs []interface{}) error {
+	return s.updateRefs(tx, "UPDATE blob_ SET ref_count = ref_count - 1 WHERE ref_count > 0 AND id IN (%s)", blobIDs)
+}
+
+func (s *SQL) updateRefs(tx *sql.Tx, query string, blobIDs []interface{}) error {
+	for i := 0; i < len(blobIDs); i += addBlobsBatchSize {
+		j := i + addBlobsBatchSize
+		if j > len(blobIDs) {
+			j = len(blobIDs)
+		}
+		batch := blobIDs[i:j]
+		q := strings.Replace(query, "%s", qt.Qs(len(batch)), 1)
+		s.logQuery(q, batch...)
+		_, err := tx.Exec(q, batch...)
+		if err != nil {
+			return errors.Err(err)
+		}
+	}
+	return nil
+}
+
+// deleteStreamTx deletes a stream and releases its content blobs, whose ids it returns. Nothing is deleted if the
+// stream is gone already, or if onlyPending is set and the stream was committed
+func (s *SQL) deleteStreamTx(tx *sql.Tx, streamID int64, onlyPending bool) (bool, []interface{}, error) {
+	query := "SELECT blob_id FROM stream_blob WHERE stream_id = ?"
+	s.logQuery(query, streamID)
+	rows, err := tx.Query(query, streamID)
+	if err != nil {
+		return false, nil, errors.Err(err)
+	}
+	var blobIDs []interface{}
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			closeRows(rows)
+			return false, nil, errors.Err(err)
+		}
+		blobIDs = append(blobIDs, id)
+	}
+	closeRows(rows)
+	if err := rows.Err(); err != nil {
+		return false, nil, errors.Err(err)
+	}
+
+	query = "DELETE FROM stream WHERE id = ?"
+	if onlyPending {
+		query += " AND is_pending = 1"
+	}
+	s.logQuery(query, streamID)
+	res, err := tx.Exec(query, streamID)
+	if err != nil {
+		return false, nil, errors.Err(err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return false, nil, errors.Err(err)
+	}
+	// the stream may have been deleted since its blobs were read, and they're released only once
+	if deleted == 0 {
+		return false, nil, nil
+	}
+	return true, blobIDs, s.releaseRefs(tx, blobIDs)
+}
+
+// DeleteStream deletes the stream of an sd blob from the db, and returns the blobs no stream needs anymore: the sd blob,
+// and the content blobs that no other stream has. The blobs themselves are left in the db, so the caller can delete
+// them from the blob store with DeleteIfUnreferenced
+func (s *SQL) DeleteStream(sdHash string) ([]string, error) {
+	if s.conn == nil {
+		return nil, errors.Err("not connected")
+	}
+
+	var unreferenced []string
+	err := withTx(s.conn, func(tx *sql.Tx) error {
+		var streamID int64
+		query := "SELECT s.id FROM stream s INNER JOIN blob_ b ON b.id = s.sd_blob_id WHERE b.hash = ?"
+		s.logQuery(query, sdHash)
+		err := tx.QueryRow(query, sdHash).Scan(&streamID)
+		if err == sql.ErrNoRows {
+			return errors.Prefix(sdHash, ErrStreamNotFound)
+		} else if err != nil {
+			return errors.Err(err)
+		}
+
+		deleted, blobIDs, err := s.deleteStreamTx(tx, streamID, false)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return errors.Prefix(sdHash, ErrStreamNotFound)
+		}
+		unreferenced = append(unreferenced, sdHash)
+
+		for i := 0; i < len(blobIDs); i += addBlobsBatchSize {
+			j := i + addBlobsBatchSize
+			if j > len(blobIDs) {
+				j = len(blobIDs)
+			}
+			batch := blobIDs[i:j]
+			query := "SELECT hash FROM blob_ WHERE ref_count = 0 AND id IN (" + qt.Qs(len(batch)) + ")"
+			s.logQuery(query, batch...)
+			rows, err := tx.Query(query, batch...)
+			if err != nil {
+				return errors.Err(err)
+			}
+			for rows.Next() {
+				var hash string
+				err := rows.Scan(&hash)
+				if err != nil {
+					closeRows(rows)
+					return errors.Err(err)
+				}
+				unreferenced = append(unreferenced, hash)
+			}
+			closeRows(rows)
+			if err := rows.Err(); err != nil {
+				return errors.Err(err)
+			}
+		}
+		return nil
+	})
+	return unreferenced, err
+}
+
+// DeleteIfUnreferenced deletes (or soft-deletes) a blob from the db, unless a stream has it. That's checked against
+// the streams too, in case its ref count is off. It returns whether the blob was deleted
+func (s *SQL) DeleteIfUnreferenced(hash string) (bool, error) {
+	if s.conn == nil {
+		return false, errors.Err("not connected")
+	}
+
+	query := "DELETE FROM blob_"
+	if s.SoftDelete {
+		query = "UPDATE blob_ SET is_stored = 0"
+	}
+	query += ` WHERE hash = ? AND ref_count = 0
+		AND NOT EXISTS (SELECT 1 FROM stream_blob sb WHERE sb.blob_id = blob_.id)
+		AND NOT EXISTS (SELECT 1 FROM stream s WHERE s.sd_blob_id = blob_.id)`
+	s.logQuery(query, hash)
+
+	res, err := s.conn.Exec(query, hash)
+	if err != nil {
+		return false, errors.Err(err)
+	}
+	deleted, err := res.RowsAffected()
+	return deleted > 0, errors.Err(err)
+}
+
+// MaxBlobID returns the highest blob id, to go through the blobs in ranges of ids
+func (s *SQL) MaxBlobID() (int64, error) {
+	if s.conn == nil {
+		return 0, errors.Err("not connected")
+	}
+	var id sql.NullInt64
+	err := s.conn.QueryRow("SELECT MAX(id) FROM blob_").Scan(&id)
+	return id.Int64, errors.Err(err)
+}
+
+// RepairRefCounts recounts the streams of the blobs with ids after fromID up to toID, and fixes the counts that are
+// off. It returns how many were off. With dryRun, they're only counted
+func (s *SQL) RepairRefCounts(fromID, toID int64, dryRun bool) (int64, error) {
+	if s.conn == nil {
+		return 0, errors.Err("not connected")
+	}
+
+	count := "(SELECT COUNT(*) FROM stream_blob sb WHERE sb.blob_id = blob_.id)"
+	where := " WHERE id > ? AND id <= ? AND ref_count <> " + count
+	if dryRun {
+		var off int64
+		query := "SELECT COUNT(*) FROM blob_" + where
+		s.logQuery(query, fromID, toID)
+		err := s.conn.QueryRow(query, fromID, toID).Scan(&off)
+		return off, errors.Err(err)
+	}
+
+	query := "UPDATE blob_ SET ref_count = " + count + where
+	s.logQuery(query, fromID, toID)
+	res, err := s.conn.Exec(query, fromID, toID)
+	if err != nil {
+		return 0, errors.Err(err)
+	}
+	fixed, err := res.RowsAffected()
+	return fixed, errors.Err(err)
+}
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
+)
+
+// Read replicas take the load of the has-blob checks off the primary. A replica is skipped for a while after a query
+// on it fails, and, if ReplicaMaxLag is set, while it is too far behind the primary. When no replica can be used the
+// query goes to the primary.
+//
+// Replicas may be a little behind, so a blob that a replica doesn't have is looked up again on the primary. Queries
+// whose answer must be current, like the missing blobs of a stream that is being uploaded, always go to the primary.
+
+const (
+	// how long a replica is skipped after a query on it fails
+	replicaRetryInterval = 30 * time.Second
+	// how often the replication lag is checked
+	replicaLagCheckInterval = 10 * time.Second
+)
+
+type replica struct {
+	conn *sql.DB
+	name string // the dsn without the password, for logging
+	// queryLag is how the lag is checked. It's r.lag, or a fake in tests
+	queryLag func() (time.Duration, error)
+
+	mu        sync.Mutex
+	downUntil time.Time
+
+	// the result of the last lag check. The check is a query, so it runs without the lock, one at a time
+	lagCheckedAt atomic.Int64 // unix nanoseconds
+	lagOK        atomic.Bool
+	checkingLag  atomic.Bool
+}
+
+func (s *SQL) connectReplicas() error {
+	if len(s.ReadDSNs) == 0 {
+		return nil
+	}
+	if s.dialect == dialectSQLite {
+		return errors.Err("read replicas are not supported with sqlite")
+	}
+
+	for _, dsn := range s.ReadDSNs {
+		conn, err := sql.Open("mysql", dsn+"?parseTime=1&collation=utf8mb4_unicode_ci&interpolateParams=1")
+		if err != nil {
+			return errors.Err(err)
+		}
+		conn.SetMaxIdleConns(12)
+
+		r := &replica{conn: conn, name: redactDSN(dsn)}
+		r.queryLag = r.lag
+		// a replica that is down at startup shouldn't keep the primary from being used
+		err = conn.Ping()
+		if err != nil {
+			log.Warnf("db replica %s is not reachable: %s", r.name, err.Error())
+			r.downUntil = time.Now().Add(replicaRetryInterval)
+		}
+		s.replicas = append(s.replicas, r)
+	}
+	return nil
+}
+
+// readReplica returns the next replica that can take reads, or nil if there is none
+func (s *SQL) readReplica() *replica {
+	for i := 0; i < len(s.replicas); i++ {
+		r := s.replicas[int(s.nextReplica.Inc())%len(s.replicas)]
+		if r.usable(s.ReplicaMaxLag) {
+			return r
+		}
+	}
+	return nil
+}
+
+// readQuery runs a read-only query on a replica if possible, and on the primary otherwise. It returns whether the
+// rows came from a replica.
+func (s *SQL) readQuery(query string, args ...interface{}) (*sql.Rows, bool, error) {
+	s.logQuery(query, args...)
+	if r := s.readReplica(); r != nil {
+		rows, err := r.conn.Query(query, args...)
+		if err == nil {
+			return rows, true, nil
+		}
+		log.Warnf("query on db replica %s failed, using the primary: %s", r.name, err.Error())
+		r.markDown()
+	}
+
+	rows, err := s.conn.Query(query, args...)
+	return rows, false, errors.Err(err)
+}
+
+// readQueryRow is like readQuery for queries that return a single row, and scans the row into dest
+func (s *SQL) readQueryRow(query string, args []interface{}, dest ...interface{}) error {
+	s.logQuery(query, args...)
+	if r := s.readReplica(); r != nil {
+		err := r.conn.QueryRow(query, args...).Scan(dest...)
+		if err == nil || err == sql.ErrNoRows {
+			return err
+		}
+		log.Warnf("query on db replica %s failed, using the primary: %s", r.name, err.Error())
+		r.markDown()
+	}
+	return s.conn.QueryRow(query, args...).Scan(dest...)
+}
+
+func (r *replica) markDown() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.downUntil = time.Now().Add(replicaRetryInterval)
+}
+
+// usable returns whether the replica can take reads. If the lag is due to be checked, the first caller checks it while
+// the others go by the last check
+func (r *replica) usable(maxLag time.Duration) bool {
+	r.mu.Lock()
+	down := time.Now().Before(r.downUntil)
+	r.mu.Unlock()
+	if down {
+		return false
+	}
+	if maxLag <= 0 {
+		return true
+	}
+
+	if time.Since(time.Unix(0, r.lagCheckedAt.Load())) >= replicaLagCheckInterval && r.checkingLag.CAS(false, true) {
+		r.checkLag(maxLag)
+		r.lagCheckedAt.Store(time.Now().UnixNano())
+		r.checkingLag.Store(false)
+	}
+	return r.lagOK.Load()
+}
+
+func (r *replica) checkLag(maxLag time.Duration) {
+	lag, err := r.queryLag()
+	if err != nil {
+		log.Warnf("checking the lag of db replica %s failed: %s", r.name, err.Error())
+		r.lagOK.Store(false)
+		return
+	}
+	r.lagOK.Store(lag <= maxLag)
+	if lag > maxLag {
+		log.Warnf("db replica %s is %s behind the primary, not using it", r.name, lag.String())
+	}
+}
+
+// lag returns how far the replica is behind its primary. The db user needs the REPLICATION CLIENT privilege.
+func (r *replica) lag() (time.Duration, error) {
+	rows, err := r.conn.Query("SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, errors.Err(err)
+	}
+	defer closeRows(rows)
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, errors.Err(err)
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, errors.Err(err)
+		}
+		return 0, errors.Err("not a replica")
+	}
+
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	err = rows.Scan(dest...)
+	if err != nil {
+		return 0, errors.Err(err)
+	}
+
+	for i, c := range columns {
+		if c != "Seconds_Behind_Master" {
+			continue
+		}
+		if !values[i].Valid {
+			// NULL means replication is not running
+			return 0, errors.Err("replication is stopped")
+		}
+		seconds, err := time.ParseDuration(values[i].String + "s")
+		return seconds, errors.Err(err)
+	}
+	return 0, errors.Err("no Seconds_Behind_Master in slave status")
+}
+
+// redactDSN removes the password from a mysql dsn
+func redactDSN(dsn string) string {
+	at := strings.LastIndex(dsn, "@")
+	colon := strings.Index(dsn, ":")
+	if at < 0 || colon < 0 || colon > at {
+		return dsn
+	}
+	return dsn[:colon] + ":***" + dsn[at:]
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+func TestRedactDSN(t *testing.T) {
+	tests := map[string]string{
+		"reflector:secret@tcp(localhost:3306)/reflector": "reflector:***@tcp(localhost:3306)/reflector",
+		"reflector:p@ss@tcp(localhost:3306)/reflector":   "reflector:***@tcp(localhost:3306)/reflector",
+		"reflector@tcp(localhost:3306)/reflector":        "reflector@tcp(localhost:3306)/reflector",
+		"tcp(localhost:3306)/reflector":                  "tcp(localhost:3306)/reflector",
+	}
+	for dsn, expected := range tests {
+		if got := redactDSN(dsn); got != expected {
+			t.Errorf("redactDSN(%q) = %q, expected %q", dsn, got, expected)
+		}
+	}
+}
+
+func TestReadQuery_NoReplicas(t *testing.T) {
+	s := testSQLite(t)
+	err := s.AddBlob(testHash("a"), 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, fromReplica, err := s.readQuery("SELECT hash FROM blob_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeRows(rows)
+	if fromReplica {
+		t.Error("expected the primary to be used when there are no replicas")
+	}
+	if !rows.Next() {
+		t.Error("expected a row")
+	}
+}
+
+func TestReplica_UsableChecksLagOnce(t *testing.T) {
+	var checks atomic.Int32
+	release := make(chan struct{})
+	r := &replica{name: "replica"}
+	r.queryLag = func() (time.Duration, error) {
+		checks.Inc()
+		<-release
+		return time.Second, nil
+	}
+
+	// the lag check waits for release, so the first call is still checking while the others run
+	checked := make(chan bool)
+	go func() { checked <- r.usable(5 * time.Second) }()
+	for checks.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		if r.usable(5 * time.Second) {
+			t.Error("expected the replica not to be used before its lag was checked")
+		}
+	}
+	r.markDown() // doesn't wait for the check either
+	close(release)
+	if !<-checked {
+		t.Error("expected the replica to be usable once its lag was checked")
+	}
+	if checks.Load() != 1 {
+		t.Errorf("expected the lag to be checked once, got %d", checks.Load())
+	}
+
+	// the result is reused until the next check is due
+	r.downUntil = time.Time{}
+	if !r.usable(5*time.Second) || checks.Load() != 1 {
+		t.Errorf("expected the last lag check to be reused, got %d checks", checks.Load())
+	}
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	_ "github.com/mattn/go-sqlite3" // blank import for db driver ensures its imported even if its not used
+)
+
+// SQLitePrefix marks a dsn as the path of an SQLite database file instead of a MySQL connection string, e.g.
+// sqlite:///var/lib/reflector/reflector.db
+const SQLitePrefix = "sqlite://"
+
+type dialect int
+
+const (
+	dialectMySQL dialect = iota
+	dialectSQLite
+)
+
+func (s *SQL) connectSQLite(path string) error {
+	if !SQLiteSupported {
+		return errors.Err("this binary was built without cgo, which sqlite needs. Use mysql, or build with CGO_ENABLED=1 (make build-sqlite)")
+	}
+	var err error
+	s.dialect = dialectSQLite
+	// foreign keys are off by default in sqlite, and the stream_blob cascades depend on them. sqlite allows one writer
+	// at a time, so writers wait for each other instead of failing right away. WAL lets reads go on during writes
+	s.conn, err = sql.Open("sqlite3", "file:"+path+"?_fk=1&_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	if s.SkipSchemaCheck {
+		return nil
+	}
+	// single-node setups shouldn't need a separate step to create the schema
+	_, err = s.MigrateUp(0)
+	return err
+}
+
+// insertIgnore starts an INSERT that silently skips rows that would violate a unique key
+func (s *SQL) insertIgnore() string {
+	if s.dialect == dialectSQLite {
+		return "INSERT OR IGNORE"
+	}
+	return "INSERT IGNORE"
+}
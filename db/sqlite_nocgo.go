@@ -0,0 +1,8 @@
+//go:build !cgo
+// +build !cgo
+
+package db
+
+// SQLiteSupported is whether the sqlite driver works in this binary. go-sqlite3 is a cgo package, and only a stub
+// without cgo
+const SQLiteSupported = false
@@ -0,0 +1,477 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+func skipWithoutSQLite(t *testing.T) {
+	if !SQLiteSupported {
+		t.Skip("sqlite needs cgo")
+	}
+}
+
+func testSQLite(t *testing.T) *SQL {
+	skipWithoutSQLite(t)
+	s := &SQL{}
+	err := s.Connect(SQLitePrefix + filepath.Join(t.TempDir(), "reflector.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testHash(c string) string { return strings.Repeat(c, 96) }
+
+func TestSQLite_StreamLifecycle(t *testing.T) {
+	s := testSQLite(t)
+
+	var sd SdBlob
+	err := json.Unmarshal([]byte(`{"stream_hash":"`+testHash("f")+`","blobs":[`+
+		`{"blob_num":0,"length":100,"blob_hash":"`+testHash("1")+`","iv":"00"},`+
+		`{"blob_num":1,"length":100,"blob_hash":"`+testHash("2")+`","iv":"00"},`+
+		`{"blob_num":2,"length":0,"iv":"00"}]}`), &sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.AddSDBlob(testHash("a"), 500, sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err := s.MissingBlobsForKnownStream(testHash("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 2 {
+		t.Fatalf("expected 2 missing blobs, got %d", len(missing))
+	}
+
+	// the stream is pending, so its sd blob isn't served yet
+	sdStored, err := s.HasBlob(testHash("a"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sdStored {
+		t.Error("expected the sd blob of a pending stream not to be reported")
+	}
+
+	// storing one of its blobs is progress, so an upload that was resumed isn't abandoned
+	_, err = s.conn.Exec("UPDATE stream SET last_progress_at = ?", time.Now().Add(-2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AddBlob(testHash("1"), 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aborted, err := s.AbortPendingStreams(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aborted) != 0 {
+		t.Errorf("expected a stream that is making progress not to be aborted, got %v", aborted)
+	}
+
+	err = s.AddBlob(testHash("2"), 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	has, err := s.HasBlobs([]string{testHash("a"), testHash("1"), testHash("2"), testHash("3")}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has[testHash("a")] || !has[testHash("1")] || !has[testHash("2")] || has[testHash("3")] {
+		t.Errorf("unexpected HasBlobs result: %v", has)
+	}
+
+	// the stream got all its blobs, so it is not pending anymore
+	aborted, err = s.AbortPendingStreams(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aborted) != 0 {
+		t.Errorf("expected no aborted streams, got %v", aborted)
+	}
+}
+
+func TestSQLite_OrphanedBlobs(t *testing.T) {
+	s := testSQLite(t)
+
+	err := s.AddBlob(testHash("b"), 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orphans, err := s.OrphanedBlobs(time.Now().Add(-time.Hour), "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("blob is within the grace period, got %v", orphans)
+	}
+
+	orphans, err = s.OrphanedBlobs(time.Now().Add(time.Hour), "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0] != testHash("b") {
+		t.Errorf("expected the blob to be orphaned, got %v", orphans)
+	}
+
+	err = s.Delete(testHash("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := s.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected 0 blobs, got %d", count)
+	}
+}
+
+func TestSQLite_AddBlobs(t *testing.T) {
+	skipWithoutSQLite(t)
+	s := &SQL{TrackAccess: TrackAccessBlobs}
+	err := s.Connect(SQLitePrefix + filepath.Join(t.TempDir(), "reflector.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sd SdBlob
+	err = json.Unmarshal([]byte(`{"stream_hash":"`+testHash("f")+`","blobs":[`+
+		`{"blob_num":0,"length":100,"blob_hash":"`+testHash("1")+`","iv":"00"},`+
+		`{"blob_num":1,"length":100,"blob_hash":"`+testHash("2")+`","iv":"00"},`+
+		`{"blob_num":2,"length":0,"iv":"00"}]}`), &sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AddSDBlob(testHash("a"), 500, sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := make([]BlobInfo, 0, 2*addBlobsBatchSize+1)
+	blobs = append(blobs, BlobInfo{Hash: testHash("1"), Length: 100, IsStored: true}, BlobInfo{Hash: testHash("2"), Length: 100, IsStored: true})
+	for i := len(blobs); i < cap(blobs); i++ {
+		blobs = append(blobs, BlobInfo{Hash: fmt.Sprintf("%096x", i), Length: 100, IsStored: true})
+	}
+	err = s.AddBlobs(blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := s.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(blobs)+1 {
+		t.Errorf("expected %d blobs, got %d", len(blobs)+1, count)
+	}
+
+	// the batch stored the last missing blobs of the stream
+	aborted, err := s.AbortPendingStreams(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aborted) != 0 {
+		t.Errorf("expected no aborted streams, got %v", aborted)
+	}
+
+	err = s.AddBlobs([]BlobInfo{{Hash: testHash("c")}})
+	if err == nil {
+		t.Error("expected an error for a blob without a length")
+	}
+}
+
+func TestSQLite_AccessCounts(t *testing.T) {
+	skipWithoutSQLite(t)
+	s := &SQL{TrackAccess: TrackAccessBlobs, AccessFlushInterval: time.Hour}
+	err := s.Connect(SQLitePrefix + filepath.Join(t.TempDir(), "reflector.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []string{"1", "2", "3"} {
+		err = s.AddBlob(testHash(c), 100, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		_, err = s.HasBlob(testHash("2"), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = s.HasBlobs([]string{testHash("1"), testHash("4")}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Shutdown() // writes the pending accesses
+
+	stats, err := s.MostAccessed(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0].Hash != testHash("2") || stats[0].Count != 4 || stats[1].Hash != testHash("1") || stats[1].Count != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	candidates, err := s.EvictionCandidates(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 || candidates[0] != testHash("3") {
+		t.Errorf("expected the blob that was never requested to be evicted first, got %v", candidates)
+	}
+	s.EvictionGracePeriod = time.Hour
+	candidates, err = s.EvictionCandidates(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 || candidates[0] != testHash("1") {
+		t.Errorf("expected the new blob that was never requested to be kept, got %v", candidates)
+	}
+
+	err = s.DecayAccessCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = s.MostAccessed(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].Count != 2 {
+		t.Errorf("expected the count to be halved to 2, got %d", stats[0].Count)
+	}
+
+	// the first check starts the clock, and the counts are halved once per interval
+	for i, due := range []bool{false, false} {
+		decayed, err := s.decayAccessCountsIfDue(time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decayed != due {
+			t.Errorf("check %d: expected decayed to be %t", i, due)
+		}
+	}
+	_, err = s.conn.Exec("UPDATE access_decay SET decayed_at = ?", time.Now().UTC().Add(-2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, due := range []bool{true, false} {
+		decayed, err := s.decayAccessCountsIfDue(time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decayed != due {
+			t.Errorf("check %d after an hour: expected decayed to be %t", i, due)
+		}
+	}
+	stats, err = s.MostAccessed(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].Count != 1 {
+		t.Errorf("expected the count to be halved once more to 1, got %d", stats[0].Count)
+	}
+}
+
+func TestSQLite_AccessTimes(t *testing.T) {
+	skipWithoutSQLite(t)
+	s := &SQL{TrackAccess: TrackAccessBlobs}
+	err := s.Connect(SQLitePrefix + filepath.Join(t.TempDir(), "reflector.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{"1", "2"} {
+		err = s.AddBlob(testHash(c), 100, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each blob gets the time it was last accessed, not the time of the latest access of any blob
+	earlier := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	later := earlier.Add(time.Hour)
+	err = s.addAccesses(map[string]pendingAccess{
+		testHash("1"): {count: 1, at: earlier},
+		testHash("2"): {count: 1, at: later},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for c, want := range map[string]time.Time{"1": earlier, "2": later} {
+		var at time.Time
+		err = s.conn.QueryRow("SELECT last_accessed_at FROM blob_ WHERE hash = ?", testHash(c)).Scan(&at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !at.Equal(want) {
+			t.Errorf("expected blob %s to be last accessed at %s, got %s", c, want, at)
+		}
+	}
+}
+
+func testSdBlob(t *testing.T, streamHash string, blobHashes ...string) SdBlob {
+	var sd SdBlob
+	err := json.Unmarshal([]byte(`{"stream_hash":"`+streamHash+`","blobs":[`+
+		`{"blob_num":0,"length":100,"blob_hash":"`+blobHashes[0]+`","iv":"00"},`+
+		`{"blob_num":1,"length":100,"blob_hash":"`+blobHashes[1]+`","iv":"00"},`+
+		`{"blob_num":2,"length":0,"iv":"00"}]}`), &sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sd
+}
+
+func refCount(t *testing.T, s *SQL, hash string) int {
+	var count int
+	err := s.conn.QueryRow("SELECT ref_count FROM blob_ WHERE hash = ?", hash).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestSQLite_RefCounts(t *testing.T) {
+	s := testSQLite(t)
+
+	// two streams share blob 2
+	for _, sd := range []struct {
+		hash  string
+		blobs SdBlob
+	}{
+		{testHash("a"), testSdBlob(t, testHash("e"), testHash("1"), testHash("2"))},
+		{testHash("b"), testSdBlob(t, testHash("f"), testHash("2"), testHash("3"))},
+		{testHash("b"), testSdBlob(t, testHash("f"), testHash("2"), testHash("3"))}, // uploaded again
+	} {
+		err := s.AddSDBlob(sd.hash, 500, sd.blobs)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for c, expected := range map[string]int{"1": 1, "2": 2, "3": 1, "a": 0} {
+		if count := refCount(t, s, testHash(c)); count != expected {
+			t.Errorf("expected blob %s to be in %d streams, got %d", c, expected, count)
+		}
+	}
+
+	unreferenced, err := s.DeleteStream(testHash("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(unreferenced)
+	if !reflect.DeepEqual(unreferenced, []string{testHash("1"), testHash("a")}) {
+		t.Errorf("expected the sd blob and the blob only stream a has to be unreferenced, got %v", unreferenced)
+	}
+	if count := refCount(t, s, testHash("2")); count != 1 {
+		t.Errorf("expected the shared blob to be in 1 stream, got %d", count)
+	}
+	_, err = s.DeleteStream(testHash("a"))
+	if !errors.Is(err, ErrStreamNotFound) {
+		t.Errorf("expected the stream to be gone, got %v", err)
+	}
+
+	for c, expected := range map[string]bool{"1": true, "2": false, "b": false} {
+		deleted, err := s.DeleteIfUnreferenced(testHash(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != expected {
+			t.Errorf("expected blob %s to be deleted: %t, got %t", c, expected, deleted)
+		}
+	}
+
+	// a count that's off is fixed, and a stream that's deleted with its sd blob releases its blobs
+	_, err = s.conn.Exec("UPDATE blob_ SET ref_count = 0 WHERE hash = ?", testHash("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxID, err := s.MaxBlobID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	off, err := s.RepairRefCounts(0, maxID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off != 1 || refCount(t, s, testHash("3")) != 0 {
+		t.Errorf("expected a dry run to find 1 count that's off, got %d", off)
+	}
+	off, err = s.RepairRefCounts(0, maxID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off != 1 || refCount(t, s, testHash("3")) != 1 {
+		t.Errorf("expected 1 count to be fixed, got %d", off)
+	}
+
+	err = s.Delete(testHash("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{"2", "3"} {
+		if count := refCount(t, s, testHash(c)); count != 0 {
+			t.Errorf("expected blob %s to be in no stream, got %d", c, count)
+		}
+	}
+}
+
+func TestSQLite_StoredHashesInRange(t *testing.T) {
+	s := testSQLite(t)
+
+	for _, c := range []string{"1", "3", "5", "7", "9"} {
+		err := s.AddBlob(testHash(c), 100, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.AddBlob(testHash("4"), 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start, end := bits.FromHexP(testHash("2")), bits.FromHexP(testHash("8"))
+	page, err := s.StoredHashesInRange(start, end, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0] != testHash("3") || page[1] != testHash("5") {
+		t.Errorf("expected the first page to be 3 and 5, got %v", page)
+	}
+	page, err = s.StoredHashesInRange(start, end, page[len(page)-1], 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0] != testHash("7") {
+		t.Errorf("expected the second page to be 7, got %v", page)
+	}
+
+	ch, ech := s.GetStoredHashesInRange(context.Background(), start, end)
+	var got []string
+	for h := range ch {
+		got = append(got, h.Hex())
+	}
+	if err := <-ech; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Errorf("expected 3 stored hashes in the range, got %v", got)
+	}
+}
@@ -0,0 +1,190 @@
+// Package events publishes what happens to blobs and streams to an event bus, NATS or Kafka, so analytics and cache
+// coherency consumers across a fleet can follow along. Events are queued and published in the background in batches,
+// and dropped if the bus can't keep up, so the bus being slow or down never holds up serving blobs.
+package events
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Type is what happened
+type Type string
+
+const (
+	// BlobStored is published when a blob is uploaded and stored
+	BlobStored Type = "blob.stored"
+	// BlobDeleted is published when a blob is deleted from the store
+	BlobDeleted Type = "blob.deleted"
+	// StreamIngested is published when all the blobs of a stream are stored. Hash is the sd hash
+	StreamIngested Type = "stream.ingested"
+	// BlocklistHit is published when an upload of a blocked blob is turned away
+	BlocklistHit Type = "blocklist.hit"
+)
+
+// Valid returns whether t is one of the event types
+func (t Type) Valid() bool {
+	return t == BlobStored || t == BlobDeleted || t == StreamIngested || t == BlocklistHit
+}
+
+// Event is something that happened to a blob or a stream
+type Event struct {
+	ID   string    `json:"id"`
+	Type Type      `json:"type"`
+	Hash string    `json:"hash"`
+	Host string    `json:"host"`
+	Time time.Time `json:"time"`
+}
+
+// New returns an event of type t about the blob with the given hash, that happened now on this host
+func New(t Type, hash string) Event {
+	return Event{ID: shared.NewRequestID(), Type: t, Hash: hash, Host: shared.HostName(), Time: time.Now().UTC()}
+}
+
+// Publisher sends events to a bus
+type Publisher interface {
+	// Publish sends the events, in order
+	Publish(events []Event) error
+	Close() error
+}
+
+// Open returns the publisher for a bus url:
+//
+//	nats://[USER:PASS@]HOST:PORT[?subject=PREFIX]  publishes each event to PREFIX.TYPE (reflector.blob.stored by default)
+//	kafka+http://HOST:PORT?topic=TOPIC             publishes to the topic through a Kafka REST proxy, keyed by hash
+//	kafka+https://HOST:PORT?topic=TOPIC            the same over https
+func Open(busURL string) (Publisher, error) {
+	u, err := url.Parse(busURL)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	switch u.Scheme {
+	case "nats":
+		subject := u.Query().Get("subject")
+		if subject == "" {
+			subject = DefaultSubject
+		}
+		var user, pass string
+		if u.User != nil {
+			user = u.User.Username()
+			pass, _ = u.User.Password()
+		}
+		return NewNATS(u.Host, subject, user, pass), nil
+	case "kafka+http", "kafka+https":
+		topic := u.Query().Get("topic")
+		if topic == "" {
+			return nil, errors.Err("kafka event bus needs a topic, like kafka+http://HOST:8082?topic=TOPIC")
+		}
+		proxy := strings.TrimPrefix(u.Scheme, "kafka+") + "://" + u.Host + u.Path
+		return NewKafkaREST(proxy, topic), nil
+	}
+	return nil, errors.Err("unknown event bus '%s', it should start with nats:// or kafka+http://", u.Scheme)
+}
+
+const (
+	queueSize    = 10000
+	maxBatchSize = 100
+)
+
+// Bus queues events and publishes them in the background
+type Bus struct {
+	// Types are the types of events that are published. All of them are if it's empty
+	Types []Type
+
+	publisher Publisher
+	queue     chan Event
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+// NewBus returns a bus that publishes with p
+func NewBus(p Publisher) *Bus {
+	return &Bus{
+		publisher: p,
+		queue:     make(chan Event, queueSize),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start starts publishing events
+func (b *Bus) Start() {
+	go func() {
+		defer close(b.done)
+		for e := range b.queue {
+			batch := []Event{e}
+		fill:
+			for len(batch) < maxBatchSize {
+				select {
+				case e, ok := <-b.queue:
+					if !ok {
+						break fill
+					}
+					batch = append(batch, e)
+				default:
+					break fill
+				}
+			}
+			err := b.publisher.Publish(batch)
+			if err != nil {
+				log.Errorf("event bus: dropping %d events: %s", len(batch), err.Error())
+			}
+		}
+	}()
+}
+
+// Shutdown publishes the events that are queued and closes the publisher. Events sent after it are dropped
+func (b *Bus) Shutdown() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	close(b.queue)
+	b.mu.Unlock()
+	<-b.done
+	err := b.publisher.Close()
+	if err != nil {
+		log.Errorf("event bus: %s", err.Error())
+	}
+}
+
+// Send queues an event of type t about the blob with the given hash
+func (b *Bus) Send(t Type, hash string) {
+	if !b.wants(t) {
+		return
+	}
+	e := New(t, hash)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	select {
+	case b.queue <- e:
+	default:
+		log.Errorf("event bus queue is full, dropping %s event for %s", t, hash)
+	}
+}
+
+func (b *Bus) wants(t Type) bool {
+	if len(b.Types) == 0 {
+		return true
+	}
+	for _, w := range b.Types {
+		if w == t {
+			return true
+		}
+	}
+	return false
+}
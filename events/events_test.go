@@ -0,0 +1,159 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNATS is enough of a nats server to accept a publisher and record what it publishes
+type fakeNATS struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	connects []string
+	subjects []string
+	payloads []string
+	got      chan struct{}
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeNATS{l: l, got: make(chan struct{}, 100)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+	return f
+}
+
+func (f *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	_, _ = conn.Write([]byte(`INFO {"server_id":"fake","max_payload":1048576}` + "\r\n"))
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "CONNECT "):
+			f.mu.Lock()
+			f.connects = append(f.connects, strings.TrimPrefix(line, "CONNECT "))
+			f.mu.Unlock()
+		case line == "PING":
+			_, _ = conn.Write([]byte("PONG\r\n"))
+		case strings.HasPrefix(line, "PUB "):
+			parts := strings.Fields(line)
+			size, _ := strconv.Atoi(parts[2])
+			payload := make([]byte, size+2) // with the \r\n after it
+			_, err = io.ReadFull(r, payload)
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.subjects = append(f.subjects, parts[1])
+			f.payloads = append(f.payloads, string(payload[:size]))
+			f.mu.Unlock()
+			f.got <- struct{}{}
+		}
+	}
+}
+
+func TestNATS_Publish(t *testing.T) {
+	f := newFakeNATS(t)
+	p, err := Open("nats://user:secret@" + f.l.Addr().String() + "?subject=fleet")
+	require.NoError(t, err)
+
+	bus := NewBus(p)
+	bus.Types = []Type{BlobStored, BlobDeleted}
+	bus.Start()
+	bus.Send(BlobStored, "aa")
+	bus.Send(StreamIngested, "bb") // not one of the types
+	bus.Send(BlobDeleted, "cc")
+	bus.Shutdown()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-f.got:
+		case <-time.After(5 * time.Second):
+			t.Fatal("events were not published")
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	require.Len(t, f.connects, 1)
+	assert.Contains(t, f.connects[0], `"user":"user"`)
+	assert.Contains(t, f.connects[0], `"pass":"secret"`)
+	assert.Equal(t, []string{"fleet.blob.stored", "fleet.blob.deleted"}, f.subjects)
+
+	var e Event
+	require.NoError(t, json.Unmarshal([]byte(f.payloads[1]), &e))
+	assert.Equal(t, BlobDeleted, e.Type)
+	assert.Equal(t, "cc", e.Hash)
+	assert.NotEmpty(t, e.ID)
+}
+
+func TestKafkaREST_Publish(t *testing.T) {
+	var mu sync.Mutex
+	var path, contentType string
+	var got kafkaRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path = r.URL.Path
+		contentType = r.Header.Get("Content-Type")
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		_, _ = w.Write([]byte(`{"offsets":[{"partition":0,"offset":1}]}`))
+	}))
+	defer srv.Close()
+
+	p, err := Open("kafka+" + srv.URL + "?topic=blobs")
+	require.NoError(t, err)
+	require.NoError(t, p.Publish([]Event{New(BlobStored, "aa")}))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "/topics/blobs", path)
+	assert.Equal(t, "application/vnd.kafka.json.v2+json", contentType)
+	require.Len(t, got.Records, 1)
+	assert.Equal(t, "aa", got.Records[0].Key)
+	assert.Equal(t, BlobStored, got.Records[0].Value.Type)
+}
+
+func TestKafkaREST_PublishFailed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"offsets":[{"error_code":50002,"error":"not leader"}]}`))
+	}))
+	defer srv.Close()
+
+	p := NewKafkaREST(srv.URL, "blobs")
+	assert.Error(t, p.Publish([]Event{New(BlobStored, "aa")}))
+}
+
+func TestOpen_Unknown(t *testing.T) {
+	_, err := Open("amqp://localhost")
+	assert.Error(t, err)
+	_, err = Open("kafka+http://localhost:8082")
+	assert.Error(t, err)
+}
@@ -0,0 +1,99 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// kafkaTimeout is how long a request to the REST proxy may take
+const kafkaTimeout = 10 * time.Second
+
+// KafkaREST publishes events to a Kafka topic through a Kafka REST proxy (v2 api), keyed by the hash so the events of
+// a blob stay in order within a partition
+type KafkaREST struct {
+	url    string
+	client *http.Client
+}
+
+// NewKafkaREST returns a publisher to the topic, through the REST proxy at proxyURL
+func NewKafkaREST(proxyURL, topic string) *KafkaREST {
+	return &KafkaREST{
+		url:    strings.TrimSuffix(proxyURL, "/") + "/topics/" + url.PathEscape(topic),
+		client: &http.Client{Timeout: kafkaTimeout},
+	}
+}
+
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value Event  `json:"value"`
+}
+
+type kafkaRequest struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaResponse struct {
+	Offsets []struct {
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+// Publish publishes the events in a single request
+func (k *KafkaREST) Publish(events []Event) error {
+	r := kafkaRequest{Records: make([]kafkaRecord, len(events))}
+	for i, e := range events {
+		r.Records[i] = kafkaRecord{Key: e.Hash, Value: e}
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return errors.Err(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, k.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Err(err)
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	res, err := k.client.Do(req)
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return errors.Err("kafka rest proxy answered with status %d: %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	// the proxy answers 200 even if some records were not written
+	var kr kafkaResponse
+	err = json.NewDecoder(res.Body).Decode(&kr)
+	if err != nil {
+		return errors.Err(err)
+	}
+	failed := 0
+	var last string
+	for _, o := range kr.Offsets {
+		if o.ErrorCode != nil || o.Error != "" {
+			failed++
+			last = o.Error
+		}
+	}
+	if failed > 0 {
+		return errors.Err("kafka rest proxy failed to write %d of %d events: %s", failed, len(events), last)
+	}
+	return nil
+}
+
+// Close does nothing, there's no connection to close
+func (k *KafkaREST) Close() error {
+	return nil
+}
@@ -0,0 +1,199 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultSubject is the subject prefix of the events published to NATS, unless another one is set
+const DefaultSubject = "reflector"
+
+// natsTimeout is how long connecting to the NATS server and each write may take
+const natsTimeout = 5 * time.Second
+
+// NATS publishes events to a NATS server, each to the subject PREFIX.TYPE. It speaks the text protocol of core NATS
+// itself, which is all that publishing needs. Core NATS doesn't acknowledge messages, so events published while the
+// connection is breaking may be lost
+type NATS struct {
+	addr    string
+	subject string
+	user    string
+	pass    string
+
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+// NewNATS returns a publisher to the NATS server at addr. user and pass are only sent if user is set
+func NewNATS(addr, subject, user, pass string) *NATS {
+	return &NATS{addr: addr, subject: subject, user: user, pass: pass}
+}
+
+// natsInfo is the part of the server's INFO message that matters to a publisher
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	Lang     string `json:"lang"`
+	Version  string `json:"version"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+}
+
+// connect opens the connection and checks that the server accepted it. It must be called with the lock held
+func (n *NATS) connect() error {
+	conn, err := net.DialTimeout("tcp", n.addr, natsTimeout)
+	if err != nil {
+		return errors.Err(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(natsTimeout))
+	r := bufio.NewReader(conn)
+	fail := func(err error) error {
+		_ = conn.Close()
+		return err
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return fail(errors.Err(err))
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fail(errors.Err("nats server sent %q instead of INFO", strings.TrimSpace(line)))
+	}
+	var info natsInfo
+	err = json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+	if err != nil {
+		return fail(errors.Err(err))
+	}
+	if info.TLSRequired {
+		return fail(errors.Err("nats server requires tls, which is not supported"))
+	}
+
+	connect, err := json.Marshal(natsConnect{Name: "reflector", Lang: "go", Version: "1", User: n.user, Pass: n.pass})
+	if err != nil {
+		return fail(errors.Err(err))
+	}
+	// the PONG to this PING says that the server took the CONNECT
+	_, err = conn.Write([]byte("CONNECT " + string(connect) + "\r\nPING\r\n"))
+	if err != nil {
+		return fail(errors.Err(err))
+	}
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return fail(errors.Err(err))
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			return fail(errors.Err("nats server: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))))
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	n.conn = conn
+	n.w = bufio.NewWriter(conn)
+	go n.read(conn, r)
+	return nil
+}
+
+// read answers the server's PINGs, which it sends to check that the client is alive, until the connection closes
+func (n *NATS) read(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			n.mu.Lock()
+			if n.conn == conn {
+				n.drop()
+			}
+			n.mu.Unlock()
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			n.mu.Lock()
+			if n.conn == conn {
+				_, _ = n.w.WriteString("PONG\r\n")
+				_ = n.w.Flush()
+			}
+			n.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Errorf("nats server: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// drop closes the connection, so the next publish opens a new one. It must be called with the lock held
+func (n *NATS) drop() {
+	if n.conn != nil {
+		_ = n.conn.Close()
+	}
+	n.conn = nil
+	n.w = nil
+}
+
+// Publish publishes the events. If the connection broke, it's opened again once
+func (n *NATS) Publish(events []Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	err := n.publish(events)
+	if err != nil && n.conn != nil {
+		n.drop()
+		err = n.publish(events)
+	}
+	if err != nil {
+		n.drop()
+	}
+	return err
+}
+
+// publish must be called with the lock held
+func (n *NATS) publish(events []Event) error {
+	if n.conn == nil {
+		err := n.connect()
+		if err != nil {
+			return err
+		}
+	}
+	_ = n.conn.SetWriteDeadline(time.Now().Add(natsTimeout))
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return errors.Err(err)
+		}
+		_, err = n.w.WriteString("PUB " + n.subject + "." + string(e.Type) + " " + strconv.Itoa(len(data)) + "\r\n")
+		if err != nil {
+			return errors.Err(err)
+		}
+		_, err = n.w.Write(append(data, '\r', '\n'))
+		if err != nil {
+			return errors.Err(err)
+		}
+	}
+	return errors.Err(n.w.Flush())
+}
+
+// Close closes the connection
+func (n *NATS) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.drop()
+	return nil
+}
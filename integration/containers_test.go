@@ -0,0 +1,141 @@
+// +build integration
+
+package integration
+
+import (
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/db"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// container is a docker container started for a test, and removed when the test ends
+type container struct {
+	id string
+}
+
+// startContainer runs the image with the env and args, publishing port on a random port of localhost. The test is
+// skipped if docker is not available
+func startContainer(t *testing.T, image string, port int, env map[string]string, args ...string) (*container, string) {
+	t.Helper()
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is needed for the integration tests")
+	}
+	if err := exec.Command("docker", "info").Run(); err != nil {
+		t.Skip("docker is not running: " + err.Error())
+	}
+
+	run := []string{"run", "-d", "--rm", "-p", "127.0.0.1::" + strconv.Itoa(port)}
+	for k, v := range env {
+		run = append(run, "-e", k+"="+v)
+	}
+	run = append(run, image)
+	run = append(run, args...)
+	out, err := exec.Command("docker", run...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("starting %s: %s: %s", image, err, out)
+	}
+	c := &container{id: strings.TrimSpace(string(out))}
+	t.Cleanup(func() {
+		_ = exec.Command("docker", "rm", "-f", c.id).Run()
+	})
+
+	out, err = exec.Command("docker", "port", c.id, strconv.Itoa(port)+"/tcp").Output()
+	if err != nil {
+		t.Fatalf("getting the port of %s: %s", image, err)
+	}
+	// there's a line for each address the port is published on
+	addr := strings.TrimSpace(strings.Split(string(out), "\n")[0])
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		t.Fatalf("unexpected port of %s: %s", image, addr)
+	}
+	return c, addr
+}
+
+// logs returns the output of the container, for failures
+func (c *container) logs() string {
+	out, _ := exec.Command("docker", "logs", "--tail", "50", c.id).CombinedOutput()
+	return string(out)
+}
+
+// waitFor calls f until it succeeds, and fails the test with the logs of c, if it's set, if f doesn't succeed within
+// timeout
+func waitFor(t *testing.T, what string, timeout time.Duration, c *container, f func() error) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := f()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			if c != nil {
+				t.Log(c.logs())
+			}
+			t.Fatalf("%s: %s", what, err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+const (
+	mysqlUser     = "reflector"
+	mysqlPassword = "reflector"
+	mysqlDatabase = "reflector"
+)
+
+// startMySQL starts mysql and returns a connection to its migrated reflector database
+func startMySQL(t *testing.T) *db.SQL {
+	c, addr := startContainer(t, "mysql:8.0", 3306, map[string]string{
+		"MYSQL_RANDOM_ROOT_PASSWORD": "yes",
+		"MYSQL_DATABASE":             mysqlDatabase,
+		"MYSQL_USER":                 mysqlUser,
+		"MYSQL_PASSWORD":             mysqlPassword,
+	})
+	dsn := mysqlUser + ":" + mysqlPassword + "@tcp(" + addr + ")/" + mysqlDatabase
+
+	sqlDB := &db.SQL{SkipSchemaCheck: true, TrackAccess: db.TrackAccessBlobs}
+	// mysql restarts once after initializing the database, so it takes a while to answer for good
+	waitFor(t, "connecting to mysql", 2*time.Minute, c, func() error {
+		return sqlDB.Connect(dsn)
+	})
+	_, err := sqlDB.MigrateUp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sqlDB
+}
+
+const (
+	minioUser     = "reflector"
+	minioPassword = "reflector-secret"
+	minioBucket   = "blobs"
+	minioRegion   = "us-east-1"
+)
+
+// startMinIO starts minio with an empty bucket and returns a store of the bucket
+func startMinIO(t *testing.T) *store.S3Store {
+	c, addr := startContainer(t, "minio/minio", 9000, map[string]string{
+		"MINIO_ROOT_USER":     minioUser,
+		"MINIO_ROOT_PASSWORD": minioPassword,
+	}, "server", "/data")
+
+	opts := store.S3Opts{Endpoint: "http://" + addr, Region: minioRegion, PathStyle: true}
+	client, err := store.NewS3Client(minioUser, minioPassword, minioRegion, minioBucket, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "creating the minio bucket", time.Minute, c, func() error {
+		_, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(minioBucket)})
+		return err
+	})
+	return store.NewS3StoreWithOpts(minioUser, minioPassword, minioRegion, minioBucket, opts)
+}
@@ -0,0 +1,6 @@
+// Package integration tests a whole prism node end to end: MySQL and MinIO run in docker containers, blobs are
+// uploaded to the reflector server and downloaded over the tcp, http3 and http protocols, and the db and dht are
+// checked. The tests need docker and only run with the integration build tag:
+//
+//	go test -tags integration -v ./integration
+package integration
@@ -0,0 +1,200 @@
+// +build integration
+
+package integration
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/prism"
+	"github.com/lbryio/reflector.go/reflector"
+	"github.com/lbryio/reflector.go/server/http"
+	"github.com/lbryio/reflector.go/server/http3"
+	"github.com/lbryio/reflector.go/server/peer"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/phayes/freeport"
+)
+
+// node is a prism node with all of its servers, on free ports of localhost
+type node struct {
+	reflectorAddr, peerAddr, http3Addr, httpAddr string
+	peerPort                                     int
+}
+
+func startNode(t *testing.T, blobs store.BlobStore, conf *prism.Config) *node {
+	ports := make([]int, 6)
+	for i := range ports {
+		var err error
+		ports[i], err = freeport.GetFreePort()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := &node{
+		reflectorAddr: "127.0.0.1:" + strconv.Itoa(ports[0]),
+		peerAddr:      "127.0.0.1:" + strconv.Itoa(ports[1]),
+		http3Addr:     "127.0.0.1:" + strconv.Itoa(ports[2]),
+		httpAddr:      "127.0.0.1:" + strconv.Itoa(ports[3]),
+		peerPort:      ports[1],
+	}
+	conf.ReflectorPort = ports[0]
+	conf.PeerPort = ports[1]
+	conf.DhtAddress = "127.0.0.1:" + strconv.Itoa(ports[4])
+	conf.ClusterPort = ports[5]
+	conf.Blobs = blobs
+
+	p := prism.New(conf)
+	err := p.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Shutdown)
+
+	http3Server := http3.NewServer(blobs, 10)
+	err = http3Server.Start(n.http3Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(http3Server.Shutdown)
+
+	httpServer := http.NewServer(blobs, 10)
+	err = httpServer.Start(n.httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(httpServer.Shutdown)
+	return n
+}
+
+// upload sends the stream to the reflector server, sd blob first like the lbry app does
+func upload(t *testing.T, addr string, s stream.Stream) {
+	c := reflector.Client{}
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i, b := range s {
+		if i == 0 {
+			err = c.SendSDBlob(b)
+		} else {
+			err = c.SendBlob(b)
+		}
+		if err != nil {
+			t.Fatalf("sending blob %d: %s", i, err)
+		}
+	}
+}
+
+// testingBootstrapAddr is where dht.TestingCreateNetwork starts its bootstrap node
+const testingBootstrapAddr = "127.0.0.1:21000"
+
+func TestEndToEnd(t *testing.T) {
+	sqlDB := startMySQL(t)
+	blobs := store.NewDBBackedStore(startMinIO(t), sqlDB, false)
+
+	// a small dht for the node to announce its blobs to
+	bootstrap, dhts := dht.TestingCreateNetwork(t, 3, true, false)
+	defer func() {
+		for _, d := range dhts {
+			d.Shutdown()
+		}
+		bootstrap.Shutdown()
+	}()
+
+	conf := prism.DefaultConf()
+	conf.DB = sqlDB
+	conf.DhtSeedNodes = []string{testingBootstrapAddr}
+	maxRange := bits.MaxRange()
+	conf.HashRange = &maxRange
+	conf.AnnounceRate = 100
+	n := startNode(t, blobs, conf)
+
+	data := make([]byte, 5*stream.MaxBlobSize/2)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := stream.New(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdHash := s[0].HashHex()
+	upload(t, n.reflectorAddr, s)
+
+	t.Run("db", func(t *testing.T) {
+		for i, b := range s {
+			has, err := sqlDB.HasBlob(b.HashHex(), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !has {
+				t.Errorf("blob %d is not in the db", i)
+			}
+		}
+		missing, err := sqlDB.MissingBlobsForKnownStream(sdHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(missing) > 0 {
+			t.Errorf("the db says the stream is missing %d blobs", len(missing))
+		}
+	})
+
+	downloaders := map[string]store.BlobStore{
+		"tcp":   peer.NewStore(peer.StoreOpts{Address: n.peerAddr, Timeout: 30 * time.Second}),
+		"http3": http3.NewStore(http3.StoreOpts{Address: n.http3Addr, Timeout: 30 * time.Second}),
+		"http":  store.NewHttpStore(n.httpAddr),
+	}
+	for protocol, downloader := range downloaders {
+		downloader := downloader
+		t.Run(protocol, func(t *testing.T) {
+			defer downloader.Shutdown()
+			downloaded := make(stream.Stream, len(s))
+			for i, b := range s {
+				blob, _, err := downloader.Get(b.HashHex())
+				if err != nil {
+					t.Fatalf("getting blob %d: %s", i, err)
+				}
+				downloaded[i] = blob
+			}
+			decoded, err := downloaded.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Error("the downloaded stream is not what was uploaded")
+			}
+
+			_, _, err = downloader.Get(stream.Blob("not uploaded").HashHex())
+			if !errors.Is(err, store.ErrBlobNotFound) {
+				t.Errorf("expected a missing blob to be not found, got %v", err)
+			}
+		})
+	}
+
+	t.Run("dht", func(t *testing.T) {
+		hash := bits.FromHexP(sdHash)
+		waitFor(t, "finding the node in the dht", time.Minute, nil, func() error {
+			contacts, err := dhts[0].Get(hash)
+			if err != nil {
+				return err
+			}
+			for _, c := range contacts {
+				if c.PeerPort == n.peerPort {
+					return nil
+				}
+			}
+			return errors.Err("the node did not announce the sd blob, peers: %v", contacts)
+		})
+	})
+}
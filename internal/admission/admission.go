@@ -0,0 +1,168 @@
+// Package admission bounds how many requests a server handles at once, and turns requests away when it's overloaded
+// instead of letting them pile up. Once requests wait in the queue for longer than a target, new ones are shed right
+// away and clients are told to retry later, so the latency of the requests that are handled stays bounded.
+package admission
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	"go.uber.org/atomic"
+)
+
+// ErrOverloaded is returned when a request is shed. The client should retry later
+var ErrOverloaded = errors.Base("server is overloaded, retry later")
+
+// reasons for shedding requests, used in metrics
+const (
+	reasonFull     = "queue_full"
+	reasonLatency  = "queue_latency"
+	reasonExpired  = "expired"
+	reasonCanceled = "canceled"
+	reasonStopped  = "stopped"
+	reasonRefused  = "refused"
+)
+
+// Opts configures a queue
+type Opts struct {
+	// Workers is how many requests are handled at once
+	Workers int
+	// MaxQueued is how many requests can wait for a worker. More are shed right away
+	MaxQueued int
+	// Target is how long requests may wait for a worker. If recent requests waited longer, new ones are shed right
+	// away, and requests that waited longer by the time a worker gets to them are shed too. 0 means no target
+	Target time.Duration
+	// Admit, if set, is asked before each request is queued. Requests are shed while it returns false, like when the
+	// memory budget is used up
+	Admit func() bool
+}
+
+type job struct {
+	ctx      context.Context
+	fn       func()
+	enqueued time.Time
+	done     chan error
+}
+
+// Queue hands requests to a fixed number of workers
+type Queue struct {
+	name string
+	opts Opts
+	grp  *stop.Group
+	jobs chan *job
+
+	mu     sync.RWMutex
+	closed bool
+
+	// how long the last request a worker picked up had waited
+	lastWait atomic.Duration
+}
+
+// New creates a queue. name labels its metrics
+func New(name string, opts Opts) *Queue {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.MaxQueued < 1 {
+		opts.MaxQueued = 1
+	}
+	return &Queue{
+		name: name,
+		opts: opts,
+		grp:  stop.New(),
+		jobs: make(chan *job, opts.MaxQueued),
+	}
+}
+
+// Start starts the workers
+func (q *Queue) Start() {
+	for i := 0; i < q.opts.Workers; i++ {
+		q.grp.Add(1)
+		metrics.RoutinesQueue.WithLabelValues(q.name, "admission-worker").Inc()
+		go func() {
+			defer metrics.RoutinesQueue.WithLabelValues(q.name, "admission-worker").Dec()
+			defer q.grp.Done()
+			for {
+				select {
+				case <-q.grp.Ch():
+					return
+				case j := <-q.jobs:
+					q.run(j)
+				}
+			}
+		}()
+	}
+}
+
+// Shutdown stops the workers. Requests that are still queued are shed
+func (q *Queue) Shutdown() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.grp.StopAndWait()
+
+	for {
+		select {
+		case j := <-q.jobs:
+			metrics.AdmissionQueued.WithLabelValues(q.name).Dec()
+			q.shed(j, reasonStopped)
+		default:
+			return
+		}
+	}
+}
+
+// Do runs fn on a worker and waits for it to finish. It returns ErrOverloaded without running fn if the request was
+// shed. fn is not run if ctx is done by the time a worker gets to it.
+func (q *Queue) Do(ctx context.Context, fn func()) error {
+	j := &job{ctx: ctx, fn: fn, enqueued: time.Now(), done: make(chan error, 1)}
+
+	q.mu.RLock()
+	switch {
+	case q.closed:
+		q.shed(j, reasonStopped)
+	case q.opts.Admit != nil && !q.opts.Admit():
+		q.shed(j, reasonRefused)
+	case q.opts.Target > 0 && len(q.jobs) > 0 && q.lastWait.Load() > q.opts.Target:
+		q.shed(j, reasonLatency)
+	default:
+		select {
+		case q.jobs <- j:
+			metrics.AdmissionQueued.WithLabelValues(q.name).Inc()
+		default:
+			q.shed(j, reasonFull)
+		}
+	}
+	q.mu.RUnlock()
+
+	return <-j.done
+}
+
+func (q *Queue) run(j *job) {
+	metrics.AdmissionQueued.WithLabelValues(q.name).Dec()
+	wait := time.Since(j.enqueued)
+	q.lastWait.Store(wait)
+	metrics.AdmissionWaitSeconds.WithLabelValues(q.name).Observe(wait.Seconds())
+
+	if j.ctx.Err() != nil {
+		q.shed(j, reasonCanceled)
+		return
+	}
+	if q.opts.Target > 0 && wait > q.opts.Target {
+		q.shed(j, reasonExpired)
+		return
+	}
+	j.fn()
+	j.done <- nil
+}
+
+func (q *Queue) shed(j *job, reason string) {
+	metrics.AdmissionShedCount.WithLabelValues(q.name, reason).Inc()
+	j.done <- errors.Prefix(reason, ErrOverloaded)
+}
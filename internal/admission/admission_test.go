@@ -0,0 +1,107 @@
+package admission
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+func TestQueue_Full(t *testing.T) {
+	q := New("test", Opts{Workers: 1, MaxQueued: 1})
+	q.Start()
+	defer q.Shutdown()
+
+	block := make(chan struct{})
+	started := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = q.Do(context.Background(), func() { close(started); <-block })
+	}()
+	<-started
+	go func() {
+		defer wg.Done()
+		if err := q.Do(context.Background(), func() {}); err != nil {
+			t.Errorf("expected the queued request to run, got %v", err)
+		}
+	}()
+	for len(q.jobs) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the worker is busy and the queue is full
+	if err := q.Do(context.Background(), func() { t.Error("should not run") }); !errors.Is(err, ErrOverloaded) {
+		t.Errorf("expected the request to be shed, got %v", err)
+	}
+	close(block)
+	wg.Wait()
+}
+
+func TestQueue_Target(t *testing.T) {
+	q := New("test", Opts{Workers: 1, MaxQueued: 10, Target: 20 * time.Millisecond})
+	q.Start()
+	defer q.Shutdown()
+
+	var wg sync.WaitGroup
+	results := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- q.Do(context.Background(), func() { time.Sleep(50 * time.Millisecond) })
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	shed := 0
+	for err := range results {
+		if errors.Is(err, ErrOverloaded) {
+			shed++
+		} else if err != nil {
+			t.Error(err)
+		}
+	}
+	// the first request runs right away, the others wait longer than the target
+	if shed != 2 {
+		t.Errorf("expected 2 requests to be shed, got %d", shed)
+	}
+
+	// once the queue is empty, requests go through again
+	if err := q.Do(context.Background(), func() {}); err != nil {
+		t.Errorf("expected the request to run, got %v", err)
+	}
+}
+
+func TestQueue_Canceled(t *testing.T) {
+	q := New("test", Opts{Workers: 1, MaxQueued: 10})
+	q.Start()
+	defer q.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := q.Do(ctx, func() { t.Error("should not run") }); !errors.Is(err, ErrOverloaded) {
+		t.Errorf("expected a canceled request to be dropped, got %v", err)
+	}
+}
+
+func TestQueue_Admit(t *testing.T) {
+	admit := false
+	q := New("test", Opts{Workers: 1, MaxQueued: 10, Admit: func() bool { return admit }})
+	q.Start()
+	defer q.Shutdown()
+
+	if err := q.Do(context.Background(), func() { t.Error("should not run") }); !errors.Is(err, ErrOverloaded) {
+		t.Errorf("expected the request to be shed, got %v", err)
+	}
+
+	admit = true
+	ran := false
+	if err := q.Do(context.Background(), func() { ran = true }); err != nil || !ran {
+		t.Errorf("expected the request to run, got %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+// Package bitmap has the operations on dht ids and hashes that bits.Bitmap lacks: a comparison that takes as long
+// wherever the bitmaps differ, random bitmaps within a range from crypto/rand, a walk over the bits that doesn't go
+// through strings, and the arithmetic, range and distance helpers that k-buckets and lookups need. bits.Add and
+// bits.Sub panic when they overflow, and the others go through big.Int or allocate, which these don't. bits.Bitmap is
+// defined in lbry.go, so these are functions instead of methods.
+package bitmap
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"math/big"
+
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Equal returns whether a and b are the same. Unlike a.Equals(b), it takes as long wherever they differ
+func Equal(a, b bits.Bitmap) bool {
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// RandInRange returns a bitmap within r, drawn uniformly from crypto/rand. bits.RandInRangeP can return bitmaps
+// outside of the range
+func RandInRange(r bits.Range) (bits.Bitmap, error) {
+	start, end := r.Start.Big(), r.End.Big()
+	if start.Cmp(end) > 0 {
+		return bits.Bitmap{}, errors.Err("empty range")
+	}
+	size := new(big.Int).Sub(end, start)
+	size.Add(size, big.NewInt(1))
+	n, err := rand.Int(rand.Reader, size)
+	if err != nil {
+		return bits.Bitmap{}, errors.Err(err)
+	}
+	return bits.FromBigP(n.Add(n, start)), nil
+}
+
+// Bits calls f with each bit of b, from the most significant one, until f returns false. i is the position of the
+// bit, as in b.Get(i)
+func Bits(b bits.Bitmap, f func(i int, set bool) bool) {
+	for i, byt := range b {
+		for j := 0; j < 8; j++ {
+			if !f(i*8+j, byt&(0x80>>uint(j)) != 0) {
+				return
+			}
+		}
+	}
+}
+
+// Add returns a+b, and whether it overflowed. The sum wraps around if it did
+func Add(a, b bits.Bitmap) (bits.Bitmap, bool) {
+	var sum bits.Bitmap
+	carry := 0
+	for i := bits.NumBytes - 1; i >= 0; i-- {
+		n := int(a[i]) + int(b[i]) + carry
+		sum[i] = byte(n)
+		carry = n >> 8
+	}
+	return sum, carry != 0
+}
+
+// Sub returns a-b, and whether it underflowed. The difference wraps around if it did
+func Sub(a, b bits.Bitmap) (bits.Bitmap, bool) {
+	var diff bits.Bitmap
+	borrow := 0
+	for i := bits.NumBytes - 1; i >= 0; i-- {
+		n := int(a[i]) - int(b[i]) - borrow
+		borrow = 0
+		if n < 0 {
+			n += 256
+			borrow = 1
+		}
+		diff[i] = byte(n)
+	}
+	return diff, borrow != 0
+}
+
+// RangeContains returns whether every bitmap of inner is in outer
+func RangeContains(outer, inner bits.Range) bool {
+	return outer.Start.Cmp(inner.Start) <= 0 && inner.End.Cmp(outer.End) <= 0
+}
+
+// Split halves r, the way a k-bucket is split. The lower half gets the middle if r has an odd number of bitmaps. It
+// returns false if r holds a single bitmap, or none
+func Split(r bits.Range) (lower, upper bits.Range, ok bool) {
+	size, under := Sub(r.End, r.Start)
+	if under || size == (bits.Bitmap{}) {
+		return lower, upper, false
+	}
+	// start + size/2 can't overflow, it's at most end
+	var half bits.Bitmap
+	carry := byte(0)
+	for i := range size {
+		half[i] = size[i]>>1 | carry
+		carry = size[i] << 7
+	}
+	mid, _ := Add(r.Start, half)
+	next, _ := Add(mid, one)
+	return bits.Range{Start: r.Start, End: mid}, bits.Range{Start: next, End: r.End}, true
+}
+
+var one = func() bits.Bitmap {
+	var b bits.Bitmap
+	b[bits.NumBytes-1] = 1
+	return b
+}()
+
+// DistanceCmp compares the xor distances of a and b to target. It returns -1 if a is closer, 1 if b is, and 0 if they
+// are the same bitmap
+func DistanceCmp(target, a, b bits.Bitmap) int {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			if da < db {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,132 @@
+package bitmap
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEqual(t *testing.T) {
+	a := bits.Rand()
+	b := a
+	assert.True(t, Equal(a, b))
+	b[bits.NumBytes-1] ^= 1
+	assert.False(t, Equal(a, b))
+	assert.False(t, Equal(a, bits.Bitmap{}))
+}
+
+func TestRandInRange(t *testing.T) {
+	r := bits.Range{Start: bits.FromShortHexP("a3"), End: bits.FromShortHexP("a3ff")}
+	for i := 0; i < 100; i++ {
+		b, err := RandInRange(r)
+		require.NoError(t, err)
+		assert.True(t, r.Contains(b), b.Hex())
+	}
+
+	one := bits.Rand()
+	b, err := RandInRange(bits.Range{Start: one, End: one})
+	require.NoError(t, err)
+	assert.Equal(t, one, b)
+
+	_, err = RandInRange(bits.Range{Start: bits.FromShortHexP("02"), End: bits.FromShortHexP("01")})
+	assert.Error(t, err)
+}
+
+func TestBits(t *testing.T) {
+	b := bits.Rand()
+	n := 0
+	Bits(b, func(i int, set bool) bool {
+		assert.Equal(t, b.Get(i), set, "bit %d", i)
+		n++
+		return true
+	})
+	assert.Equal(t, bits.NumBits, n)
+
+	n = 0
+	Bits(b, func(int, bool) bool {
+		n++
+		return n < 3
+	})
+	assert.Equal(t, 3, n)
+}
+
+func TestAddSub(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		a, b := bits.Rand(), bits.Rand()
+		sum, over := Add(a, b)
+		expected := new(big.Int).Add(a.Big(), b.Big())
+		assert.Equal(t, expected.Cmp(bits.MaxP().Big()) > 0, over)
+		if !over {
+			assert.Equal(t, a.Add(b), sum)
+		}
+		back, under := Sub(sum, b)
+		assert.Equal(t, a, back)
+		assert.Equal(t, over, under, "subtracting undoes the wrap around")
+	}
+
+	_, over := Add(bits.MaxP(), one)
+	assert.True(t, over)
+	zero, under := Sub(bits.Bitmap{}, one)
+	assert.True(t, under)
+	assert.Equal(t, bits.MaxP(), zero)
+}
+
+func TestRangeContains(t *testing.T) {
+	outer := bits.Range{Start: bits.FromShortHexP("10"), End: bits.FromShortHexP("20")}
+	assert.True(t, RangeContains(outer, outer))
+	assert.True(t, RangeContains(outer, bits.Range{Start: bits.FromShortHexP("11"), End: bits.FromShortHexP("1f")}))
+	assert.False(t, RangeContains(outer, bits.Range{Start: bits.FromShortHexP("0f"), End: bits.FromShortHexP("1f")}))
+	assert.False(t, RangeContains(outer, bits.Range{Start: bits.FromShortHexP("11"), End: bits.FromShortHexP("21")}))
+}
+
+func TestSplit(t *testing.T) {
+	lower, upper, ok := Split(bits.MaxRange())
+	require.True(t, ok)
+	assert.Equal(t, bits.Bitmap{}, lower.Start)
+	assert.Equal(t, bits.MaxP().Set(0, false), lower.End)
+	assert.Equal(t, bits.Bitmap{}.Set(0, true), upper.Start)
+	assert.Equal(t, bits.MaxP(), upper.End)
+
+	// the halves of any range cover it without overlapping
+	for i := 0; i < 100; i++ {
+		r := bits.Range{Start: bits.Rand(), End: bits.Rand()}
+		if r.Start.Cmp(r.End) > 0 {
+			r.Start, r.End = r.End, r.Start
+		}
+		lower, upper, ok := Split(r)
+		require.True(t, ok)
+		assert.Equal(t, r.Start, lower.Start)
+		assert.Equal(t, r.End, upper.End)
+		next, _ := Add(lower.End, one)
+		assert.Equal(t, next, upper.Start)
+		assert.True(t, RangeContains(r, lower) && RangeContains(r, upper))
+	}
+
+	b := bits.Rand()
+	_, _, ok = Split(bits.Range{Start: b, End: b})
+	assert.False(t, ok)
+	next, _ := Add(b, one)
+	lower, upper, ok = Split(bits.Range{Start: b, End: next})
+	require.True(t, ok)
+	assert.Equal(t, bits.Range{Start: b, End: b}, lower)
+	assert.Equal(t, bits.Range{Start: next, End: next}, upper)
+}
+
+func TestDistanceCmp(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		target, a, b := bits.Rand(), bits.Rand(), bits.Rand()
+		expected := 1
+		if target.Closer(a, b) {
+			expected = -1
+		}
+		assert.Equal(t, expected, DistanceCmp(target, a, b))
+		assert.Equal(t, -expected, DistanceCmp(target, b, a))
+		assert.Equal(t, 0, DistanceCmp(target, a, a))
+	}
+	target := bits.Rand()
+	assert.Equal(t, -1, DistanceCmp(target, target, bits.Rand()))
+}
@@ -0,0 +1,111 @@
+// Package bloom implements a Bloom filter, a compact set that can answer "definitely not in the set" or "probably
+// in the set". Cluster members and reflector clients use it to tell each other which blobs they have without
+// sending every hash.
+package bloom
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// ErrInvalidFilter is returned when unmarshalling data that is not a filter
+var ErrInvalidFilter = errors.Base("invalid bloom filter")
+
+const maxHashes = 32
+
+// Filter is a Bloom filter. It is not safe for concurrent use
+type Filter struct {
+	bits   []uint64
+	m      uint64 // number of bits
+	k      uint64 // number of hash functions
+	length int
+}
+
+// New returns a filter sized for n keys with the given false positive rate
+func New(n int, falsePositiveRate float64) *Filter {
+	if n < 1 {
+		n = 1
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	if k > maxHashes {
+		k = maxHashes
+	}
+	m = (m + 63) / 64 * 64
+	return &Filter{bits: make([]uint64, m/64), m: m, k: k}
+}
+
+// Add adds a key to the filter
+func (f *Filter) Add(key string) {
+	h1, h2 := hashes(key)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.length++
+}
+
+// Test returns false if the key is definitely not in the filter, and true if it probably is
+func (f *Filter) Test(key string) bool {
+	h1, h2 := hashes(key)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Len returns the number of keys added to the filter. Filters that were unmarshalled report the number of keys that
+// were added before marshalling
+func (f *Filter) Len() int {
+	return f.length
+}
+
+// MarshalBinary encodes the filter as k, the number of keys, and the bits
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 16+8*len(f.bits))
+	binary.BigEndian.PutUint64(data[0:8], f.k)
+	binary.BigEndian.PutUint64(data[8:16], uint64(f.length))
+	for i, word := range f.bits {
+		binary.BigEndian.PutUint64(data[16+8*i:], word)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes a filter encoded by MarshalBinary
+func (f *Filter) UnmarshalBinary(data []byte) error {
+	if len(data) < 24 || (len(data)-16)%8 != 0 {
+		return errors.Err(ErrInvalidFilter)
+	}
+	k := binary.BigEndian.Uint64(data[0:8])
+	if k < 1 || k > maxHashes {
+		return errors.Err(ErrInvalidFilter)
+	}
+	f.k = k
+	f.length = int(binary.BigEndian.Uint64(data[8:16]))
+	f.bits = make([]uint64, (len(data)-16)/8)
+	for i := range f.bits {
+		f.bits[i] = binary.BigEndian.Uint64(data[16+8*i:])
+	}
+	f.m = uint64(len(f.bits)) * 64
+	return nil
+}
+
+// hashes derives the two hashes that the k bit positions are computed from
+func hashes(key string) (uint64, uint64) {
+	sum := sha256.Sum256([]byte(key))
+	h1 := binary.BigEndian.Uint64(sum[0:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16]) | 1 // odd, so the positions don't repeat
+	return h1, h2
+}
@@ -0,0 +1,52 @@
+package bloom
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	f := New(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		f.Add("in" + strconv.Itoa(i))
+	}
+	for i := 0; i < 10000; i++ {
+		if !f.Test("in" + strconv.Itoa(i)) {
+			t.Fatalf("key %d was added but is not in the filter", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.Test("out" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 200 {
+		t.Errorf("expected about 1%% false positives, got %d of 10000", falsePositives)
+	}
+}
+
+func TestFilter_Marshal(t *testing.T) {
+	f := New(100, 0.01)
+	f.Add("a")
+	f.Add("b")
+
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g Filter
+	err = g.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.Test("a") || !g.Test("b") || g.Len() != 2 {
+		t.Error("unmarshalled filter is missing keys")
+	}
+
+	err = g.UnmarshalBinary(data[:10])
+	if err == nil {
+		t.Error("expected an error for truncated data")
+	}
+}
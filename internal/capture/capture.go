@@ -0,0 +1,204 @@
+// Package capture records the blob requests a reflector serves, so they can be replayed against a test node to
+// benchmark changes on real traffic. Captures are anonymized: a request only keeps the blob hash, the time, the size
+// and the class of the client, never its address
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/internal/geo"
+	"github.com/lbryio/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// queueSize is how many requests can wait to be written. More are dropped, so the capture never slows down the
+	// requests
+	queueSize = 10000
+	// flushInterval is how often the captured requests are flushed to the file
+	flushInterval = 5 * time.Second
+)
+
+// Request is a captured blob request. Captures are files of one json Request per line
+type Request struct {
+	// Time is when the request was served, in milliseconds since the epoch
+	Time  int64  `json:"t"`
+	Hash  string `json:"hash"`
+	Size  int    `json:"size"`
+	Class string `json:"class"`
+}
+
+// Recorder writes the requests served to a capture file
+type Recorder struct {
+	// GeoIP, if set, adds the country of the client to its class
+	GeoIP *geo.Database
+
+	f     *os.File
+	queue chan Request
+	grp   *stop.Group
+}
+
+// Open returns a recorder that appends to the capture file at path
+func Open(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	return &Recorder{f: f, queue: make(chan Request, queueSize), grp: stop.New()}, nil
+}
+
+// Start writes the requests in the background
+func (r *Recorder) Start() {
+	r.grp.Add(1)
+	go func() {
+		defer r.grp.Done()
+		r.write()
+	}()
+}
+
+// Shutdown writes the requests that are waiting and closes the file
+func (r *Recorder) Shutdown() {
+	r.grp.StopAndWait()
+	err := r.f.Close()
+	if err != nil {
+		log.Errorf("closing request capture: %s", err)
+	}
+}
+
+// Record adds a blob of size bytes served to the client at remoteAddr over protocol. It never blocks
+func (r *Recorder) Record(protocol, remoteAddr, hash string, size int) {
+	req := Request{
+		Time:  time.Now().UnixNano() / int64(time.Millisecond),
+		Hash:  hash,
+		Size:  size,
+		Class: r.class(protocol, auth.Request{RemoteAddr: remoteAddr}.IP()),
+	}
+	select {
+	case r.queue <- req:
+	default:
+		metrics.CaptureDroppedCount.Inc()
+	}
+}
+
+// class is the protocol, and where the client is: private for clients on private networks like cluster members, or
+// its country if there's a GeoIP database
+func (r *Recorder) class(protocol string, ip net.IP) string {
+	switch {
+	case ip != nil && (ip.IsLoopback() || isPrivate(ip)):
+		return protocol + "/private"
+	case r.GeoIP != nil:
+		country := r.GeoIP.Country(ip)
+		if country == "" {
+			country = "unknown"
+		}
+		return protocol + "/" + country
+	default:
+		return protocol
+	}
+}
+
+// privateNets are the private ipv4 networks of RFC 1918 and the unique local ipv6 addresses of RFC 4193
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func isPrivate(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Recorder) write() {
+	w := bufio.NewWriter(r.f)
+	enc := json.NewEncoder(w)
+	flush := func() {
+		err := w.Flush()
+		if err != nil {
+			log.Errorf("writing request capture: %s", err)
+		}
+	}
+	defer flush()
+	encode := func(req Request) {
+		err := enc.Encode(req)
+		if err != nil {
+			log.Errorf("writing request capture: %s", err)
+			return
+		}
+		metrics.CaptureRequestCount.Inc()
+	}
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.grp.Ch():
+			for {
+				select {
+				case req := <-r.queue:
+					encode(req)
+				default:
+					return
+				}
+			}
+		case <-ticker.C:
+			flush()
+		case req := <-r.queue:
+			encode(req)
+		}
+	}
+}
+
+// Reader reads the requests of a capture in order
+type Reader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+// NewReader returns a reader of the capture in r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{s: bufio.NewScanner(r)}
+}
+
+// Next returns the next request, or io.EOF at the end of the capture
+func (r *Reader) Next() (Request, error) {
+	for r.s.Scan() {
+		r.line++
+		if len(r.s.Bytes()) == 0 {
+			continue
+		}
+		var req Request
+		err := json.Unmarshal(r.s.Bytes(), &req)
+		if err != nil {
+			return req, errors.Err("line %d of the capture: %s", r.line, err)
+		}
+		if req.Hash == "" {
+			return req, errors.Err("line %d of the capture has no hash", r.line)
+		}
+		return req, nil
+	}
+	if err := r.s.Err(); err != nil {
+		return Request{}, errors.Err(err)
+	}
+	return Request{}, io.EOF
+}
@@ -0,0 +1,68 @@
+package capture
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	r, err := Open(path)
+	require.NoError(t, err)
+	r.Start()
+	r.Record("http", "203.0.113.7:4444", "aa", 100)
+	r.Record("peer", "10.1.2.3:5555", "bb", 200)
+	r.Shutdown()
+
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "203.0.113.7", "client addresses are not captured")
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	reader := NewReader(f)
+	req, err := reader.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "aa", req.Hash)
+	assert.Equal(t, 100, req.Size)
+	assert.Equal(t, "http", req.Class)
+	assert.NotZero(t, req.Time)
+	req, err = reader.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "peer/private", req.Class)
+	_, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReader_Errors(t *testing.T) {
+	reader := NewReader(strings.NewReader("{\"t\":1,\"hash\":\"aa\"}\n\nnot json\n"))
+	_, err := reader.Next()
+	require.NoError(t, err)
+	_, err = reader.Next()
+	assert.Contains(t, err.Error(), "line 3")
+
+	_, err = NewReader(strings.NewReader(`{"t":1}`)).Next()
+	assert.Error(t, err)
+}
+
+func TestIsPrivate(t *testing.T) {
+	for ip, private := range map[string]bool{
+		"10.1.2.3":        true,
+		"172.20.0.1":      true,
+		"172.32.0.1":      false,
+		"192.168.1.1":     true,
+		"fd00::1":         true,
+		"8.8.8.8":         false,
+		"2001:4860::8888": false,
+	} {
+		assert.Equal(t, private, isPrivate(net.ParseIP(ip)), ip)
+	}
+}
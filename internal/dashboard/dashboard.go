@@ -0,0 +1,282 @@
+package dashboard
+
+import (
+	_ "embed" // for the page
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lbryio/reflector.go/cluster"
+	"github.com/lbryio/reflector.go/meta"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Path is where the dashboard is served. The page polls Path + "stats" for the numbers, with the query of the page, so
+// a ?token= it was opened with is sent along
+const Path = "/dashboard/"
+
+// how many of the latest errors are shown
+const recentErrors = 50
+
+//go:embed index.html
+var page []byte
+
+// Dashboard is a small status page for operators. It shows what the prometheus metrics of this process say, along
+// with the cluster members, the dht state and the latest errors that were logged.
+type Dashboard struct {
+	// Cluster, if set, shows the cluster members
+	Cluster *cluster.Cluster
+
+	started   time.Time
+	dht       *dht.DHT
+	dhtJoined int32
+	errors    *errorLog
+}
+
+// New returns a dashboard. It starts collecting logged errors right away
+func New() *Dashboard {
+	d := &Dashboard{
+		started: time.Now(),
+		errors:  &errorLog{},
+	}
+	log.AddHook(d.errors)
+	return d
+}
+
+// WatchDHT shows the state of a dht node
+func (d *Dashboard) WatchDHT(node *dht.DHT) {
+	d.dht = node
+	go func() {
+		node.WaitUntilJoined()
+		atomic.StoreInt32(&d.dhtJoined, 1)
+	}()
+}
+
+// ServeHTTP serves the page and the stats it shows
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case Path:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(page)
+	case Path + "stats":
+		stats, err := d.Stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(stats)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Stats is a snapshot of the state of the process. Counters are totals since the start, the page turns them into
+// rates by comparing snapshots
+type Stats struct {
+	Version       string        `json:"version"`
+	UptimeSeconds int64         `json:"uptime_seconds"`
+	Downloads     float64       `json:"downloads"`
+	Uploads       float64       `json:"uploads"`
+	BytesOut      float64       `json:"bytes_out"`
+	BytesIn       float64       `json:"bytes_in"`
+	Errors        float64       `json:"errors"`
+	Caches        []CacheStats  `json:"caches"`
+	Stores        []StoreStats  `json:"stores"`
+	DHT           *DHTStats     `json:"dht,omitempty"`
+	Cluster       *ClusterStats `json:"cluster,omitempty"`
+	RecentErrors  []LoggedError `json:"recent_errors"`
+}
+
+// CacheStats counts the hits and misses of a cache
+type CacheStats struct {
+	Cache     string  `json:"cache"`
+	Component string  `json:"component"`
+	Hits      float64 `json:"hits"`
+	Misses    float64 `json:"misses"`
+}
+
+// StoreStats is how long gets from a cache or its origin take
+type StoreStats struct {
+	Store     string  `json:"store"`
+	Component string  `json:"component"`
+	Source    string  `json:"source"`
+	Requests  uint64  `json:"requests"`
+	AvgMillis float64 `json:"avg_ms"`
+}
+
+// DHTStats is the state of the dht node
+type DHTStats struct {
+	ID     string `json:"id"`
+	Joined bool   `json:"joined"`
+}
+
+// ClusterStats lists the cluster members that serve blobs
+type ClusterStats struct {
+	Name    string         `json:"name"`
+	Members []cluster.Node `json:"members"`
+}
+
+// Stats reads the current state
+func (d *Dashboard) Stats() (*Stats, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	metrics := make(map[string]*dto.MetricFamily, len(families))
+	for _, f := range families {
+		metrics[f.GetName()] = f
+	}
+
+	s := &Stats{
+		Version:       meta.VersionString(),
+		UptimeSeconds: int64(time.Since(d.started).Seconds()),
+		Downloads:     sum(metrics, "reflector_blob_download_total"),
+		Uploads:       sum(metrics, "reflector_blob_upload_total"),
+		BytesOut:      sum(metrics, "reflector_tcp_out_bytes", "reflector_udp_out_bytes", "reflector_http_out_bytes"),
+		BytesIn:       sum(metrics, "reflector_reflector_in_bytes", "reflector_s3_in_bytes"),
+		Errors:        sum(metrics, "reflector_error_total"),
+		Caches:        cacheStats(metrics),
+		Stores:        storeStats(metrics),
+		RecentErrors:  d.errors.list(),
+	}
+	if d.dht != nil {
+		s.DHT = &DHTStats{ID: d.dht.ID().Hex(), Joined: atomic.LoadInt32(&d.dhtJoined) == 1}
+	}
+	if d.Cluster != nil {
+		members := d.Cluster.Ring().Nodes()
+		sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+		s.Cluster = &ClusterStats{Name: d.Cluster.Name(), Members: members}
+	}
+	return s, nil
+}
+
+// sum adds up the values of all the counters and gauges with these names
+func sum(metrics map[string]*dto.MetricFamily, names ...string) float64 {
+	total := 0.0
+	for _, name := range names {
+		f, ok := metrics[name]
+		if !ok {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			total += m.GetCounter().GetValue() + m.GetGauge().GetValue()
+		}
+	}
+	return total
+}
+
+func labels(m *dto.Metric) map[string]string {
+	l := make(map[string]string, len(m.GetLabel()))
+	for _, p := range m.GetLabel() {
+		l[p.GetName()] = p.GetValue()
+	}
+	return l
+}
+
+func cacheStats(metrics map[string]*dto.MetricFamily) []CacheStats {
+	byCache := make(map[[2]string]*CacheStats)
+	get := func(m *dto.Metric) *CacheStats {
+		l := labels(m)
+		key := [2]string{l["cache_type"], l["component"]}
+		if byCache[key] == nil {
+			byCache[key] = &CacheStats{Cache: key[0], Component: key[1]}
+		}
+		return byCache[key]
+	}
+	if f, ok := metrics["reflector_cache_hit_total"]; ok {
+		for _, m := range f.GetMetric() {
+			get(m).Hits += m.GetCounter().GetValue()
+		}
+	}
+	if f, ok := metrics["reflector_cache_miss_total"]; ok {
+		for _, m := range f.GetMetric() {
+			get(m).Misses += m.GetCounter().GetValue()
+		}
+	}
+
+	caches := make([]CacheStats, 0, len(byCache))
+	for _, c := range byCache {
+		caches = append(caches, *c)
+	}
+	sort.Slice(caches, func(i, j int) bool {
+		if caches[i].Component != caches[j].Component {
+			return caches[i].Component < caches[j].Component
+		}
+		return caches[i].Cache < caches[j].Cache
+	})
+	return caches
+}
+
+func storeStats(metrics map[string]*dto.MetricFamily) []StoreStats {
+	f, ok := metrics["reflector_cache_retrieval_seconds"]
+	if !ok {
+		return nil
+	}
+	stores := make([]StoreStats, 0, len(f.GetMetric()))
+	for _, m := range f.GetMetric() {
+		l := labels(m)
+		h := m.GetHistogram()
+		s := StoreStats{Store: l["cache_type"], Component: l["component"], Source: l["source"], Requests: h.GetSampleCount()}
+		if s.Requests > 0 {
+			s.AvgMillis = h.GetSampleSum() / float64(s.Requests) * 1000
+		}
+		stores = append(stores, s)
+	}
+	sort.Slice(stores, func(i, j int) bool {
+		if stores[i].Component != stores[j].Component {
+			return stores[i].Component < stores[j].Component
+		}
+		return stores[i].Store < stores[j].Store
+	})
+	return stores
+}
+
+// LoggedError is an error that was logged
+type LoggedError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// errorLog is a logrus hook that keeps the latest errors
+type errorLog struct {
+	mu     sync.Mutex
+	errors []LoggedError
+	next   int
+}
+
+func (e *errorLog) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+}
+
+func (e *errorLog) Fire(entry *log.Entry) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	logged := LoggedError{Time: entry.Time, Message: entry.Message}
+	if len(e.errors) < recentErrors {
+		e.errors = append(e.errors, logged)
+		return nil
+	}
+	e.errors[e.next] = logged
+	e.next = (e.next + 1) % recentErrors
+	return nil
+}
+
+// list returns the errors, newest first
+func (e *errorLog) list() []LoggedError {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	list := make([]LoggedError, 0, len(e.errors))
+	for i := len(e.errors) - 1; i >= 0; i-- {
+		list = append(list, e.errors[(e.next+i)%len(e.errors)])
+	}
+	return list
+}
@@ -0,0 +1,51 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestErrorLog_KeepsNewest(t *testing.T) {
+	e := &errorLog{}
+	for i := 0; i < recentErrors+10; i++ {
+		_ = e.Fire(&log.Entry{Message: fmt.Sprintf("error %d", i)})
+	}
+
+	list := e.list()
+	if len(list) != recentErrors {
+		t.Fatalf("expected %d errors, got %d", recentErrors, len(list))
+	}
+	if list[0].Message != fmt.Sprintf("error %d", recentErrors+9) {
+		t.Errorf("expected the newest error first, got %s", list[0].Message)
+	}
+	if list[len(list)-1].Message != "error 10" {
+		t.Errorf("expected the oldest kept error last, got %s", list[len(list)-1].Message)
+	}
+}
+
+func TestDashboard_Stats(t *testing.T) {
+	d := New()
+	log.Error("something broke")
+
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, httptest.NewRequest("GET", Path+"stats", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var stats Stats
+	err := json.NewDecoder(w.Body).Decode(&stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.RecentErrors) != 1 || stats.RecentErrors[0].Message != "something broke" {
+		t.Errorf("expected the logged error in the stats, got %v", stats.RecentErrors)
+	}
+	if stats.Cluster != nil || stats.DHT != nil {
+		t.Error("expected no cluster or dht stats")
+	}
+}
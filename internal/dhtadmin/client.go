@@ -0,0 +1,79 @@
+package dhtadmin
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Client makes json-rpc calls to the rpc server of a dht node. The methods and their params are those of the dht
+// library, like rpc.Ping with a dht.RpcPingArgs
+type Client struct {
+	// Timeout is how long the node gets to answer. Iterative lookups take a few seconds
+	Timeout time.Duration
+
+	rpcURL string
+}
+
+// NewClient returns a client for the dht node whose rpc server listens on rpcAddr, like 127.0.0.1:5678
+func NewClient(rpcAddr string) *Client {
+	return &Client{
+		Timeout: 30 * time.Second,
+		rpcURL:  "http://" + rpcAddr + "/",
+	}
+}
+
+type rpcRequest struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	ID     int           `json:"id"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  interface{}     `json:"error"`
+}
+
+// Call makes a json-rpc call to the node and returns the result
+func (c *Client) Call(method string, params interface{}) ([]byte, error) {
+	body, err := json.Marshal(rpcRequest{Method: method, Params: []interface{}{params}, ID: 1})
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	client := &http.Client{Timeout: c.Timeout}
+	res, err := client.Post(c.rpcURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Prefix("dht rpc", err)
+	}
+	defer res.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(res.Body, 10<<20))
+	if err != nil {
+		return nil, errors.Prefix("dht rpc", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Err("dht rpc: status %d: %s", res.StatusCode, strings.TrimSpace(string(raw)))
+	}
+	var resp rpcResponse
+	err = json.Unmarshal(raw, &resp)
+	if err != nil {
+		return nil, errors.Prefix("dht rpc", err)
+	}
+	if resp.Error != nil {
+		return nil, errors.Err("dht rpc: %v", resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// CallInto makes a json-rpc call to the node and decodes the result into result
+func (c *Client) CallInto(method string, params, result interface{}) error {
+	raw, err := c.Call(method, params)
+	if err != nil {
+		return err
+	}
+	return errors.Err(json.Unmarshal(raw, result))
+}
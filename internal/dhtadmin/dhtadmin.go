@@ -0,0 +1,130 @@
+// Package dhtadmin serves the debugging operations of a dht node over http, so connectivity problems can be looked into
+// with curl instead of a custom Go program: ping a node, ask one node for the nodes or peers closest to a hash, look a
+// hash up through the whole dht, and dump the routing table.
+//
+// The dht node answers these on its json-rpc port, which anyone who can reach it may use. The handler passes requests
+// on to that port after checking a bearer token, so the rpc port can stay firewalled and only the admin endpoints are
+// exposed. Client makes the same calls from Go, for tools like the dht shell.
+package dhtadmin
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lbryio/reflector.go/auth"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Path is where the handler is served. The operations are below it
+const Path = "/dht/"
+
+// Mux is what the admin handlers are added to, like the metrics server
+type Mux interface {
+	Handle(path string, handler http.Handler)
+}
+
+// Handler serves the dht operations to clients that send the token as a bearer token. The server it's on must give
+// responses as long to write as the Timeout of the client, since lookups take that long
+//
+//	curl -H 'Authorization: Bearer TOKEN' 'localhost:2112/dht/ping?addr=lbrynet1.lbry.com:4444'
+//
+// The operations, all GET:
+//
+//	/dht/ping?addr=HOST:PORT                              ping a node
+//	/dht/find_node?key=HASH&node_id=ID&ip=IP&port=PORT    ask one node for the nodes closest to key
+//	/dht/find_value?key=HASH&node_id=ID&ip=IP&port=PORT   ask one node for the peers of key, or the closest nodes
+//	/dht/iterative_find_value?key=HASH                    look up the peers of key through the dht
+//	/dht/routing_table                                    dump the routing table
+type Handler struct {
+	*Client
+
+	token string
+}
+
+// New returns a handler for the dht node whose rpc server listens on rpcAddr, like 127.0.0.1:5678. Requests must carry
+// token
+func New(rpcAddr, token string) *Handler {
+	return &Handler{
+		Client: NewClient(rpcAddr),
+		token:  token,
+	}
+}
+
+// Register adds the handler to mux
+func (h *Handler) Register(mux Mux) {
+	mux.Handle(Path, h)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !auth.HasToken(r, h.token) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	var method string
+	var params interface{}
+	switch strings.TrimPrefix(r.URL.Path, Path) {
+	case "ping":
+		if q.Get("addr") == "" {
+			http.Error(w, "addr is required", http.StatusBadRequest)
+			return
+		}
+		method, params = "rpc.Ping", map[string]string{"Address": q.Get("addr")}
+	case "find_node", "find_value":
+		args, err := findArgs(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		method, params = "rpc.FindNode", args
+		if strings.HasSuffix(r.URL.Path, "find_value") {
+			method = "rpc.FindValue"
+		}
+	case "iterative_find_value":
+		if q.Get("key") == "" {
+			http.Error(w, "key is required", http.StatusBadRequest)
+			return
+		}
+		method, params = "rpc.IterativeFindValue", map[string]string{"Key": q.Get("key")}
+	case "routing_table":
+		method, params = "rpc.GetRoutingTable", struct{}{}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	result, err := h.Call(method, params)
+	if err != nil {
+		log.Debugf("dht admin: %s: %s", method, err.Error())
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(result)
+}
+
+// findArgs are the arguments of find_node and find_value: the hash, and the node that is asked
+func findArgs(q url.Values) (map[string]interface{}, error) {
+	for _, k := range []string{"key", "node_id", "ip", "port"} {
+		if q.Get(k) == "" {
+			return nil, errors.Err("%s is required", k)
+		}
+	}
+	port, err := strconv.Atoi(q.Get("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, errors.Err("port must be a port number")
+	}
+	return map[string]interface{}{"Key": q.Get("key"), "NodeID": q.Get("node_id"), "IP": q.Get("ip"), "Port": port}, nil
+}
@@ -0,0 +1,69 @@
+package dhtadmin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRPC answers json-rpc calls like the dht node, with the method and params it was called with
+func fakeRPC(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rpcRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if req.Method == "rpc.Ping" {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"result": nil, "error": "timeout", "id": req.ID})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"result": req, "error": nil, "id": req.ID})
+	}))
+}
+
+func get(h http.Handler, target, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestHandler(t *testing.T) {
+	rpc := fakeRPC(t)
+	defer rpc.Close()
+	h := New(strings.TrimPrefix(rpc.URL, "http://"), "secret")
+
+	assert.Equal(t, http.StatusUnauthorized, get(h, "/dht/routing_table", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, get(h, "/dht/routing_table", "wrong").Code)
+
+	w := get(h, "/dht/find_value?key=aa&node_id=bb&ip=1.2.3.4&port=4444", "secret")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var req rpcRequest
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &req))
+	assert.Equal(t, "rpc.FindValue", req.Method)
+	assert.Equal(t, map[string]interface{}{"Key": "aa", "NodeID": "bb", "IP": "1.2.3.4", "Port": float64(4444)}, req.Params[0])
+
+	w = get(h, "/dht/routing_table", "secret")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &req))
+	assert.Equal(t, "rpc.GetRoutingTable", req.Method)
+
+	// errors of the node are passed on
+	w = get(h, "/dht/ping?addr=1.2.3.4:4444", "secret")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), "timeout")
+
+	assert.Equal(t, http.StatusBadRequest, get(h, "/dht/find_node?key=aa", "secret").Code)
+	assert.Equal(t, http.StatusNotFound, get(h, "/dht/store", "secret").Code)
+}
+
+func TestHandler_NoToken(t *testing.T) {
+	h := New("127.0.0.1:1", "")
+	assert.Equal(t, http.StatusUnauthorized, get(h, "/dht/routing_table", "").Code)
+}
@@ -0,0 +1,204 @@
+// Package dhtguard drops the udp packets a dht node shouldn't handle before the node reads them: packets from ips that
+// send more than their share, packets that aren't dht messages, and everything from ips that were banned for doing
+// either. A node answers every request it handles, to the address the request claims to come from, so limiting the
+// packets of each ip also limits how much traffic the node can be made to send to a spoofed address.
+//
+// The dht package reads packets from any connection that has the methods of a udp connection, so Conn wraps the
+// connection of a node that is started with dht.NewNode and Node.Connect. dht.DHT opens its connection itself, so
+// nodes started with it can't be guarded.
+package dhtguard
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+
+	"github.com/lyoshenka/bencode"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRate is how many packets per second an ip may send, unless Rate is changed. A node that looks up a hash
+	// sends a few packets to each node it asks
+	DefaultRate = 20
+	// DefaultBurst is how many packets an ip may send at once, unless Burst is changed
+	DefaultBurst = 100
+	// DefaultMaxMalformed is how many packets that aren't dht messages an ip may send, unless MaxMalformed is changed
+	DefaultMaxMalformed = 10
+	// DefaultBanTime is how long an ip is banned, unless BanTime is changed
+	DefaultBanTime = 10 * time.Minute
+
+	// forgetAfter is how long an ip is remembered after its last packet, once it's not banned
+	forgetAfter = time.Minute
+	// sweepInterval is how often the ips that can be forgotten are
+	sweepInterval = time.Minute
+)
+
+// Reasons a packet is dropped, in the metrics
+const (
+	reasonBanned      = "banned"
+	reasonRateLimited = "rate_limited"
+	reasonMalformed   = "malformed"
+)
+
+// Conn drops the packets of ips that go over the limits, and bans them for a while
+type Conn struct {
+	dht.UDPConn
+
+	// Rate is how many packets per second an ip may send on average, and Burst how many at once. An ip that sends
+	// more is banned
+	Rate  float64
+	Burst int
+	// MaxMalformed is how many packets that aren't dht messages an ip may send before it's banned. They're dropped
+	// either way
+	MaxMalformed int
+	// BanTime is how long an ip that went over a limit is banned
+	BanTime time.Duration
+	// WellFormed returns whether a packet is a dht message the node can decode. It's the check for the messages of the
+	// dht package if nil
+	WellFormed func(packet []byte) bool
+
+	mu        sync.Mutex
+	ips       map[string]*source
+	lastSweep time.Time
+	// now is time.Now. It's a field so tests can move time
+	now func() time.Time
+}
+
+// source is what's known about the packets of an ip
+type source struct {
+	tokens      float64
+	last        time.Time
+	malformed   int
+	bannedUntil time.Time
+}
+
+// New wraps conn, with the default limits
+func New(conn dht.UDPConn) *Conn {
+	return &Conn{
+		UDPConn:      conn,
+		Rate:         DefaultRate,
+		Burst:        DefaultBurst,
+		MaxMalformed: DefaultMaxMalformed,
+		BanTime:      DefaultBanTime,
+		ips:          make(map[string]*source),
+		now:          time.Now,
+	}
+}
+
+// ReadFromUDP returns the next packet that's within the limits
+func (c *Conn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		n, addr, err := c.UDPConn.ReadFromUDP(b)
+		if err != nil || addr == nil {
+			return n, addr, err
+		}
+		reason := c.check(addr.IP, b[:n])
+		if reason == "" {
+			return n, addr, nil
+		}
+		metrics.DHTDroppedPacketCount.WithLabelValues(reason).Inc()
+	}
+}
+
+// Banned returns whether ip is banned
+func (c *Conn) Banned(ip net.IP) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.ips[ip.String()]
+	return ok && c.now().Before(s.bannedUntil)
+}
+
+// check returns why the packet from ip is dropped, or "" if it isn't
+func (c *Conn) check(ip net.IP, packet []byte) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.sweep(now)
+
+	key := ip.String()
+	s, ok := c.ips[key]
+	if !ok {
+		s = &source{tokens: float64(c.Burst), last: now}
+		c.ips[key] = s
+	}
+	if now.Before(s.bannedUntil) {
+		return reasonBanned
+	}
+
+	s.tokens += now.Sub(s.last).Seconds() * c.Rate
+	if s.tokens > float64(c.Burst) {
+		s.tokens = float64(c.Burst)
+	}
+	s.last = now
+	if s.tokens < 1 {
+		c.ban(key, s, now, "it went over the packet rate")
+		return reasonRateLimited
+	}
+	s.tokens--
+
+	isWellFormed := c.WellFormed
+	if isWellFormed == nil {
+		isWellFormed = wellFormed
+	}
+	if !isWellFormed(packet) {
+		s.malformed++
+		if s.malformed > c.MaxMalformed {
+			c.ban(key, s, now, "it sent malformed packets")
+		}
+		return reasonMalformed
+	}
+	return ""
+}
+
+// ban bans the ip of s from now on. The lock must be held
+func (c *Conn) ban(ip string, s *source, now time.Time, why string) {
+	log.Warnf("dht: banning %s for %s, %s", ip, c.BanTime, why)
+	s.bannedUntil = now.Add(c.BanTime)
+	s.malformed = 0
+	metrics.DHTBanCount.Inc()
+}
+
+// sweep forgets the ips that haven't sent anything for a while, and the bans that are over. The lock must be held
+func (c *Conn) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < sweepInterval {
+		return
+	}
+	c.lastSweep = now
+	for ip, s := range c.ips {
+		if now.Before(s.bannedUntil) || now.Sub(s.last) < forgetAfter {
+			continue
+		}
+		delete(c.ips, ip)
+	}
+}
+
+// wellFormed returns whether packet is a dht message the dht package can decode. It reads the message type from the
+// start of the packet without checking its length, and crashes on errors without arguments
+func wellFormed(packet []byte) (ok bool) {
+	if len(packet) < 6 || !(bytes.HasPrefix(packet, []byte("d1:0i")) || bytes.HasPrefix(packet, []byte("di0ei"))) {
+		return false
+	}
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	var err error
+	switch packet[5] {
+	case '0':
+		err = bencode.DecodeBytes(packet, &dht.Request{})
+	case '1':
+		err = bencode.DecodeBytes(packet, &dht.Response{})
+	case '2':
+		err = bencode.DecodeBytes(packet, &dht.Error{})
+	default:
+		return false
+	}
+	return err == nil
+}
@@ -0,0 +1,105 @@
+package dhtguard
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConn returns the packets it's given, then fails reads
+type fakeConn struct {
+	dht.UDPConn
+	packets []fakePacket
+}
+
+type fakePacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+func (f *fakeConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	if len(f.packets) == 0 {
+		return 0, nil, net.ErrClosed
+	}
+	p := f.packets[0]
+	f.packets = f.packets[1:]
+	return copy(b, p.data), p.from, nil
+}
+
+func ping(t *testing.T) []byte {
+	p, err := dht.Request{Method: "ping"}.MarshalBencode()
+	require.NoError(t, err)
+	return p
+}
+
+// read returns how many of the packets sent from addr get through c
+func read(c *Conn, f *fakeConn, addr *net.UDPAddr, packet []byte, n int) int {
+	for i := 0; i < n; i++ {
+		f.packets = append(f.packets, fakePacket{data: packet, from: addr})
+	}
+	got := 0
+	buf := make([]byte, 2048)
+	for {
+		_, from, err := c.ReadFromUDP(buf)
+		if err != nil {
+			return got
+		}
+		if from.IP.Equal(addr.IP) {
+			got++
+		}
+	}
+}
+
+func TestConn_Rate(t *testing.T) {
+	f := &fakeConn{}
+	c := New(f)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4444}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 4444}
+
+	assert.Equal(t, DefaultBurst, read(c, f, a, ping(t), DefaultBurst))
+	assert.False(t, c.Banned(a.IP))
+
+	// the packets of a second go over the rate, and the ip is banned
+	now = now.Add(time.Second)
+	assert.Equal(t, DefaultRate, read(c, f, a, ping(t), DefaultRate+1))
+	assert.True(t, c.Banned(a.IP))
+	now = now.Add(time.Minute)
+	assert.Zero(t, read(c, f, a, ping(t), 1))
+	// other ips aren't
+	assert.Equal(t, 1, read(c, f, b, ping(t), 1))
+
+	now = now.Add(DefaultBanTime)
+	assert.False(t, c.Banned(a.IP))
+	assert.Equal(t, 1, read(c, f, a, ping(t), 1))
+}
+
+func TestConn_Malformed(t *testing.T) {
+	f := &fakeConn{}
+	c := New(f)
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4444}
+
+	for _, packet := range []string{"", "d1:0i", "d1:0i0e", "d1:0i3e1:1i0ee", "d1:0i2ee", "hello world"} {
+		assert.Zero(t, read(c, f, a, []byte(packet), 1), "%q", packet)
+	}
+	assert.False(t, c.Banned(a.IP))
+	assert.Zero(t, read(c, f, a, []byte("junk"), DefaultMaxMalformed))
+	assert.True(t, c.Banned(a.IP))
+	assert.Zero(t, read(c, f, a, ping(t), 1))
+}
+
+func TestConn_WellFormed(t *testing.T) {
+	f := &fakeConn{}
+	c := New(f)
+	c.WellFormed = func(packet []byte) bool { return string(packet) == "hello" }
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4444}
+
+	assert.Equal(t, 1, read(c, f, a, []byte("hello"), 1))
+	assert.Zero(t, read(c, f, a, ping(t), 1), "expected the check of the node to replace the default one")
+}
@@ -0,0 +1,271 @@
+// Package dhtlookup runs the iterative lookups of kademlia: it asks the nodes closest to a target for the nodes they
+// know closer to it, until the closest nodes it heard of have all answered or failed. FindContacts of the dht package
+// always asks 3 nodes at once, and waits as long for each of them as its transport does. Here both are config, and
+// the requests can go out in rounds (strict) or one as soon as another is done (loose), so lookups can be tuned for
+// links with high latency or loss.
+package dhtlookup
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/bitmap"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+const (
+	// DefaultAlpha is how many nodes a lookup asks at once, like the dht package does
+	DefaultAlpha = 3
+	// DefaultTimeout is how long a lookup waits for a node to answer, like the transport of the dht package does
+	DefaultTimeout = 5 * time.Second
+	// K is how many of the closest nodes a lookup finds, the bucket size of the dht
+	K = 8
+
+	findNodeMethod  = "findNode"
+	findValueMethod = "findValue"
+)
+
+// ErrStopped is returned by lookups that were stopped before they were done
+var ErrStopped = errors.Base("lookup stopped")
+
+// Mode is how the requests of a lookup are spread out
+type Mode string
+
+const (
+	// Loose keeps Alpha requests going: as soon as one node answers or times out, the next one is asked. Lookups
+	// converge faster, and a slow node holds up nothing but its own request
+	Loose Mode = "loose"
+	// Strict asks Alpha nodes at a time, and only asks the next ones once all of them answered or timed out. It sends
+	// the fewest requests, and is what the kademlia paper describes
+	Strict Mode = "strict"
+)
+
+// ParseMode returns the mode with the name. Empty is Loose
+func ParseMode(s string) (Mode, error) {
+	switch Mode(strings.ToLower(s)) {
+	case "", Loose:
+		return Loose, nil
+	case Strict:
+		return Strict, nil
+	}
+	return "", errors.Err("unknown dht lookup mode %q, it's %s or %s", s, Loose, Strict)
+}
+
+// Config configures lookups. The zero value is the defaults
+type Config struct {
+	// Alpha is how many nodes are asked at once. DefaultAlpha if 0
+	Alpha int
+	// Timeout is how long a node gets to answer. DefaultTimeout if 0
+	Timeout time.Duration
+	// Mode is how requests are spread out. Loose if empty
+	Mode Mode
+}
+
+// SendFunc sends a request to a node and returns a channel that gets the response, or is closed without one if there
+// was none. Node.SendAsync of the dht package is one
+type SendFunc func(c dht.Contact, req dht.Request) <-chan *dht.Response
+
+// Finder runs lookups through a node
+type Finder struct {
+	Config
+	// Send sends the requests of the lookups
+	Send SendFunc
+	// Self is the id of the node that sends them. It is never asked
+	Self bits.Bitmap
+}
+
+// Result is what a lookup found
+type Result struct {
+	// Contacts are the K nodes closest to the target that answered, closest first
+	Contacts []dht.Contact
+	// Failed are the nodes that were asked and didn't answer in time
+	Failed []dht.Contact
+	// Peers are the peers that announced the target, from the nodes that had any. Only value lookups find them
+	Peers []dht.Contact
+	// Tokens are the tokens that nodes sent with their answer to a value lookup, by node id. A node only takes a store
+	// with the token it gave the node that stores
+	Tokens map[bits.Bitmap]string
+}
+
+// entry is a node a lookup heard of
+type entry struct {
+	contact dht.Contact
+	state   state
+}
+
+type state int
+
+const (
+	unasked state = iota
+	asked
+	answered
+	failed
+)
+
+// answer is the response of a node, nil if it had none in time
+type answer struct {
+	e   *entry
+	res *dht.Response
+}
+
+// lookup is the state of one lookup
+type lookup struct {
+	target    bits.Bitmap
+	findValue bool
+	self      bits.Bitmap
+	// entries are the nodes heard of, closest to the target first
+	entries []*entry
+	known   map[bits.Bitmap]bool
+	result  Result
+	peers   map[string]bool
+}
+
+// Find looks up the nodes closest to target, starting from the nodes in start. A value lookup also collects the peers
+// that announced target and the tokens to store it with. It doesn't stop at the first node that has peers, so the
+// tokens of all of the closest nodes are there. It returns ErrStopped if stopCh is closed first
+func (f *Finder) Find(target bits.Bitmap, start []dht.Contact, findValue bool, stopCh stop.Chan) (*Result, error) {
+	alpha, timeout, mode := f.Alpha, f.Timeout, f.Mode
+	if alpha <= 0 {
+		alpha = DefaultAlpha
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	if mode == "" {
+		mode = Loose
+	}
+	method := findNodeMethod
+	if findValue {
+		method = findValueMethod
+	}
+
+	l := &lookup{
+		target:    target,
+		findValue: findValue,
+		self:      f.Self,
+		known:     make(map[bits.Bitmap]bool),
+		result:    Result{Tokens: make(map[bits.Bitmap]string)},
+		peers:     make(map[string]bool),
+	}
+	l.add(start)
+	if len(l.entries) == 0 {
+		return nil, errors.Err("no nodes to start the lookup from")
+	}
+
+	// done ends the requests that are still going when the lookup returns
+	done := make(chan struct{})
+	defer close(done)
+	answers := make(chan answer)
+	inFlight := 0
+	for {
+		if mode == Loose || inFlight == 0 {
+			for inFlight < alpha {
+				e := l.next()
+				if e == nil {
+					break
+				}
+				e.state = asked
+				inFlight++
+				go f.ask(e, dht.Request{Method: method, Arg: &target}, timeout, answers, done)
+			}
+		}
+		if inFlight == 0 {
+			break
+		}
+		select {
+		case a := <-answers:
+			inFlight--
+			l.handle(a)
+		case <-stopCh:
+			return nil, errors.Err(ErrStopped)
+		}
+	}
+
+	for _, e := range l.entries {
+		if e.state == answered && len(l.result.Contacts) < K {
+			l.result.Contacts = append(l.result.Contacts, e.contact)
+		}
+	}
+	return &l.result, nil
+}
+
+// ask sends the request to the node of e, and passes on its response, or nil if it didn't answer within timeout
+func (f *Finder) ask(e *entry, req dht.Request, timeout time.Duration, answers chan<- answer, done <-chan struct{}) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var res *dht.Response
+	select {
+	case res = <-f.Send(e.contact, req):
+	case <-timer.C:
+	case <-done:
+		return
+	}
+	select {
+	case answers <- answer{e: e, res: res}:
+	case <-done:
+	}
+}
+
+// add adds the nodes the lookup didn't know yet, in the order of their distance to the target
+func (l *lookup) add(contacts []dht.Contact) {
+	for _, c := range contacts {
+		if c.ID == l.self || l.known[c.ID] {
+			continue
+		}
+		l.known[c.ID] = true
+		i := sort.Search(len(l.entries), func(i int) bool {
+			return bitmap.DistanceCmp(l.target, c.ID, l.entries[i].contact.ID) < 0
+		})
+		l.entries = append(l.entries, nil)
+		copy(l.entries[i+1:], l.entries[i:])
+		l.entries[i] = &entry{contact: c}
+	}
+}
+
+// next returns the closest node that wasn't asked yet, if it's among the K closest nodes that didn't fail. It returns
+// nil once those were all asked, which is when the lookup is done
+func (l *lookup) next() *entry {
+	n := 0
+	for _, e := range l.entries {
+		if e.state == failed {
+			continue
+		}
+		if e.state == unasked {
+			return e
+		}
+		n++
+		if n == K {
+			return nil
+		}
+	}
+	return nil
+}
+
+// handle takes in the answer of a node
+func (l *lookup) handle(a answer) {
+	if a.res == nil {
+		a.e.state = failed
+		l.result.Failed = append(l.result.Failed, a.e.contact)
+		return
+	}
+	a.e.state = answered
+	if a.res.Token != "" {
+		l.result.Tokens[a.e.contact.ID] = a.res.Token
+	}
+	if l.findValue && a.res.FindValueKey != "" {
+		for _, p := range a.res.Contacts {
+			key := p.ID.Hex() + p.Addr().String()
+			if !l.peers[key] {
+				l.peers[key] = true
+				l.result.Peers = append(l.result.Peers, p)
+			}
+		}
+		return
+	}
+	l.add(a.res.Contacts)
+}
@@ -0,0 +1,245 @@
+package dhtlookup
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/bitmap"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+// network is a dht whose nodes know all of the others, and answer a lookup with the K closest to its target
+type network struct {
+	contacts []dht.Contact
+	// answer is how many contacts the nodes answer with
+	answer int
+	// dead nodes never answer
+	dead map[bits.Bitmap]bool
+	// slow nodes answer once slowCh is closed
+	slow     map[bits.Bitmap]bool
+	slowCh   chan struct{}
+	peers    map[bits.Bitmap][]dht.Contact
+	mu       sync.Mutex
+	inFlight int
+	// maxInFlight is the most requests that were ever waiting for an answer at once
+	maxInFlight int
+	asked       map[bits.Bitmap]int
+}
+
+func newNetwork(n int) *network {
+	net := &network{
+		answer: K,
+		dead:   make(map[bits.Bitmap]bool),
+		slow:   make(map[bits.Bitmap]bool),
+		slowCh: make(chan struct{}),
+		peers:  make(map[bits.Bitmap][]dht.Contact),
+		asked:  make(map[bits.Bitmap]int),
+	}
+	for i := 0; i < n; i++ {
+		net.contacts = append(net.contacts, contact(bits.Rand(), i))
+	}
+	return net
+}
+
+func contact(id bits.Bitmap, i int) dht.Contact {
+	return dht.Contact{ID: id, IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 4444}
+}
+
+// closest returns the n contacts closest to target, closest first
+func (n *network) closest(target bits.Bitmap, k int) []dht.Contact {
+	sorted := append([]dht.Contact{}, n.contacts...)
+	sort.Slice(sorted, func(i, j int) bool { return bitmap.DistanceCmp(target, sorted[i].ID, sorted[j].ID) < 0 })
+	if len(sorted) > k {
+		sorted = sorted[:k]
+	}
+	return sorted
+}
+
+func (n *network) send(c dht.Contact, req dht.Request) <-chan *dht.Response {
+	ch := make(chan *dht.Response, 1)
+	n.mu.Lock()
+	n.asked[c.ID]++
+	n.inFlight++
+	if n.inFlight > n.maxInFlight {
+		n.maxInFlight = n.inFlight
+	}
+	dead, slow := n.dead[c.ID], n.slow[c.ID]
+	n.mu.Unlock()
+	if dead {
+		return ch
+	}
+	go func() {
+		if slow {
+			<-n.slowCh
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+		res := &dht.Response{NodeID: c.ID, Token: "token" + c.ID.HexShort()}
+		if peers, ok := n.peers[c.ID]; ok && req.Method == findValueMethod {
+			res.FindValueKey = req.Arg.RawString()
+			res.Contacts = peers
+		} else {
+			res.Contacts = n.closest(*req.Arg, n.answer)
+		}
+		n.mu.Lock()
+		n.inFlight--
+		n.mu.Unlock()
+		ch <- res
+	}()
+	return ch
+}
+
+func TestFinder_Converges(t *testing.T) {
+	for _, mode := range []Mode{Loose, Strict} {
+		n := newNetwork(200)
+		target := bits.Rand()
+		f := &Finder{Config: Config{Alpha: 3, Mode: mode}, Send: n.send, Self: bits.Rand()}
+		res, err := f.Find(target, n.contacts[:1], false, stop.New().Ch())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := n.closest(target, K)
+		if len(res.Contacts) != K {
+			t.Fatalf("%s: expected %d contacts, got %d", mode, K, len(res.Contacts))
+		}
+		for i := range want {
+			if res.Contacts[i].ID != want[i].ID {
+				t.Errorf("%s: contact %d is %s, expected %s", mode, i, res.Contacts[i].ID.HexShort(), want[i].ID.HexShort())
+			}
+		}
+		if n.maxInFlight > 3 {
+			t.Errorf("%s: expected at most 3 requests at once, got %d", mode, n.maxInFlight)
+		}
+		for id, times := range n.asked {
+			if times > 1 {
+				t.Errorf("%s: %s was asked %d times", mode, id.HexShort(), times)
+			}
+		}
+	}
+}
+
+func TestFinder_Timeout(t *testing.T) {
+	n := newNetwork(100)
+	target := bits.Rand()
+	// the closest nodes are dead, so the lookup has to time out on them and settle for the next ones. The nodes still
+	// know them, and enough others to fill their place
+	n.answer = 2 * K
+	for _, c := range n.closest(target, 3) {
+		n.dead[c.ID] = true
+	}
+	f := &Finder{Config: Config{Alpha: 3, Timeout: 50 * time.Millisecond}, Send: n.send, Self: bits.Rand()}
+	start := time.Now()
+	res, err := f.Find(target, n.closest(target, len(n.contacts))[len(n.contacts)-1:], false, stop.New().Ch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("lookup took %s, the timeout was not applied", time.Since(start))
+	}
+	if len(res.Failed) != 3 {
+		t.Errorf("expected the 3 dead nodes to fail, got %d", len(res.Failed))
+	}
+	want := n.closest(target, K+3)[3:]
+	if len(res.Contacts) != K {
+		t.Fatalf("expected %d contacts, got %d", K, len(res.Contacts))
+	}
+	for i := range want {
+		if res.Contacts[i].ID != want[i].ID {
+			t.Errorf("contact %d is %s, expected %s", i, res.Contacts[i].ID.HexShort(), want[i].ID.HexShort())
+		}
+	}
+}
+
+func TestFinder_Modes(t *testing.T) {
+	for _, mode := range []Mode{Loose, Strict} {
+		n := newNetwork(100)
+		target := bits.Rand()
+		start := n.contacts[:3]
+		// one of the nodes the lookup starts from takes long to answer
+		n.slow[start[0].ID] = true
+		f := &Finder{Config: Config{Alpha: 3, Timeout: time.Minute, Mode: mode}, Send: n.send, Self: bits.Rand()}
+
+		done := make(chan *Result)
+		go func() {
+			res, err := f.Find(target, start, false, stop.New().Ch())
+			if err != nil {
+				t.Error(err)
+			}
+			done <- res
+		}()
+		time.Sleep(100 * time.Millisecond)
+		n.mu.Lock()
+		sent := len(n.asked) - len(start)
+		n.mu.Unlock()
+		close(n.slowCh)
+		<-done
+
+		// strict waits for all requests of the first round, loose goes on with the nodes the other two sent
+		if mode == Strict && sent != 0 {
+			t.Errorf("strict: expected no requests past the first round while the slow node waited, got %d", sent)
+		}
+		if mode == Loose && sent == 0 {
+			t.Error("loose: expected requests past the first round while the slow node waited")
+		}
+	}
+}
+
+func TestFinder_FindValue(t *testing.T) {
+	n := newNetwork(100)
+	target := bits.Rand()
+	closest := n.closest(target, K)
+	peer := dht.Contact{ID: target, IP: net.IPv4(1, 2, 3, 4), Port: 3333}
+	n.peers[closest[0].ID] = []dht.Contact{peer}
+	n.peers[closest[1].ID] = []dht.Contact{peer}
+
+	// start from the farthest node, which doesn't have the peer
+	farthest := n.closest(target, len(n.contacts))[len(n.contacts)-1]
+	f := &Finder{Send: n.send, Self: bits.Rand()}
+	res, err := f.Find(target, []dht.Contact{farthest}, true, stop.New().Ch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Peers) != 1 || res.Peers[0].Port != 3333 {
+		t.Errorf("expected the peer once, got %v", res.Peers)
+	}
+	for _, c := range closest {
+		if res.Tokens[c.ID] == "" {
+			t.Errorf("expected a token from %s", c.ID.HexShort())
+		}
+	}
+}
+
+func TestFinder_Stop(t *testing.T) {
+	n := newNetwork(10)
+	for _, c := range n.contacts {
+		n.dead[c.ID] = true
+	}
+	f := &Finder{Config: Config{Timeout: time.Minute}, Send: n.send, Self: bits.Rand()}
+	s := stop.New()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Stop()
+	}()
+	_, err := f.Find(bits.Rand(), n.contacts, false, s.Ch())
+	if err == nil || err.Error() != ErrStopped.Error() {
+		t.Errorf("expected the lookup to stop, got %v", err)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for s, want := range map[string]Mode{"": Loose, "loose": Loose, "Strict": Strict} {
+		m, err := ParseMode(s)
+		if err != nil || m != want {
+			t.Errorf("ParseMode(%q) = %q, %v", s, m, err)
+		}
+	}
+	if _, err := ParseMode("eager"); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
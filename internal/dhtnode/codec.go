@@ -0,0 +1,262 @@
+package dhtnode
+
+import (
+	"net"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/lyoshenka/bencode"
+)
+
+const (
+	typeField      = "0"
+	messageIDField = "1"
+	nodeIDField    = "2"
+	payloadField   = "3"
+
+	contactsField        = "contacts"
+	tokenField           = "token"
+	protocolVersionField = "protocolVersion"
+
+	// compactIPv4Length and compactIPv6Length are the lengths of the compact info of a peer: its ip, its peer port and
+	// its id. The dht package only knows the ipv4 one
+	compactIPv4Length = net.IPv4len + 2 + bits.NumBytes
+	compactIPv6Length = net.IPv6len + 2 + bits.NumBytes
+)
+
+// response is a dht.Response that is encoded and decoded with ipv6 contacts and peers too. Its encoding is the one of
+// the dht package as long as all of them are ipv4, which is the only kind the nodes of the dht package can decode
+type response dht.Response
+
+// MarshalBencode encodes the response like the dht package does, with the compact info of ipv6 peers 16 bytes of ip
+// long
+func (r response) MarshalBencode() ([]byte, error) {
+	data := map[string]interface{}{
+		typeField:      responseType,
+		messageIDField: r.ID,
+		nodeIDField:    r.NodeID,
+	}
+	if r.Data != "" {
+		// ping or store
+		data[payloadField] = r.Data
+	} else if r.FindValueKey != "" {
+		// value lookup that found peers
+		if r.Token == "" {
+			return nil, errors.Err("response to findValue must have a token")
+		}
+		var peers [][]byte
+		for _, c := range r.Contacts {
+			compact, err := marshalCompact(c)
+			if err != nil {
+				return nil, err
+			}
+			peers = append(peers, compact)
+		}
+		data[payloadField] = map[string]interface{}{
+			r.FindValueKey: peers,
+			tokenField:     r.Token,
+		}
+	} else if r.Token != "" {
+		// value lookup that found nodes
+		data[payloadField] = map[string]interface{}{
+			contactsField: r.Contacts,
+			tokenField:    r.Token,
+		}
+	} else {
+		// node lookup
+		data[payloadField] = r.Contacts
+	}
+	return bencode.EncodeBytes(data)
+}
+
+// UnmarshalBencode decodes a response of a node of the dht package or of this package
+func (r *response) UnmarshalBencode(b []byte) error {
+	var raw struct {
+		ID     string             `bencode:"1"`
+		NodeID bits.Bitmap        `bencode:"2"`
+		Data   bencode.RawMessage `bencode:"3"`
+	}
+	err := bencode.DecodeBytes(b, &raw)
+	if err != nil {
+		return err
+	}
+	copy(r.ID[:], raw.ID)
+	r.NodeID = raw.NodeID
+
+	// a ping or store
+	err = bencode.DecodeBytes(raw.Data, &r.Data)
+	if err == nil {
+		return nil
+	}
+
+	// a node lookup
+	r.Contacts, err = decodeContacts(raw.Data)
+	if err == nil {
+		return nil
+	}
+
+	// a value lookup
+	var payload map[string]bencode.RawMessage
+	err = bencode.DecodeBytes(raw.Data, &payload)
+	if err != nil {
+		return err
+	}
+	if token, ok := payload[tokenField]; ok {
+		err = bencode.DecodeBytes(token, &r.Token)
+		if err != nil {
+			return err
+		}
+		delete(payload, tokenField)
+	}
+	if version, ok := payload[protocolVersionField]; ok {
+		err = bencode.DecodeBytes(version, &r.ProtocolVersion)
+		if err != nil {
+			return err
+		}
+		delete(payload, protocolVersionField)
+	}
+	if contacts, ok := payload[contactsField]; ok {
+		r.Contacts, err = decodeContacts(contacts)
+		return err
+	}
+	for key, value := range payload {
+		r.FindValueKey = key
+		var peers [][]byte
+		err = bencode.DecodeBytes(value, &peers)
+		if err != nil {
+			return err
+		}
+		for _, compact := range peers {
+			c, err := unmarshalCompact(compact)
+			if err != nil {
+				return err
+			}
+			r.Contacts = append(r.Contacts, c)
+		}
+		break
+	}
+	return nil
+}
+
+// decodeContacts decodes a list of contacts, ipv4 or ipv6
+func decodeContacts(b []byte) ([]dht.Contact, error) {
+	var raw []bencode.RawMessage
+	err := bencode.DecodeBytes(b, &raw)
+	if err != nil {
+		return nil, err
+	}
+	contacts := make([]dht.Contact, 0, len(raw))
+	for _, r := range raw {
+		c, err := decodeContact(r)
+		if err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, nil
+}
+
+// decodeContact decodes a contact like dht.Contact.UnmarshalBencode does, but takes ipv6 addresses too
+func decodeContact(b []byte) (dht.Contact, error) {
+	var c dht.Contact
+	var raw []bencode.RawMessage
+	err := bencode.DecodeBytes(b, &raw)
+	if err != nil {
+		return c, err
+	}
+	if len(raw) != 3 {
+		return c, errors.Err("contact must have 3 elements; got %d", len(raw))
+	}
+	err = bencode.DecodeBytes(raw[0], &c.ID)
+	if err != nil {
+		return c, err
+	}
+	var ip string
+	err = bencode.DecodeBytes(raw[1], &ip)
+	if err != nil {
+		return c, err
+	}
+	c.IP = normalizeIP(net.ParseIP(ip))
+	if c.IP == nil {
+		return c, errors.Err("invalid IP")
+	}
+	return c, bencode.DecodeBytes(raw[2], &c.Port)
+}
+
+// marshalCompact returns the compact info of a peer: its ip, its peer port and its id. Like in the dht package, it's
+// the tcp port of the peer and not its udp port
+func marshalCompact(c dht.Contact) ([]byte, error) {
+	ip := normalizeIP(c.IP)
+	if ip == nil {
+		return nil, errors.Err("ip not set")
+	}
+	if c.PeerPort < 0 || c.PeerPort > 65535 {
+		return nil, errors.Err("invalid port")
+	}
+	b := make([]byte, 0, len(ip)+2+bits.NumBytes)
+	b = append(b, ip...)
+	b = append(b, byte(c.PeerPort>>8), byte(c.PeerPort))
+	return append(b, c.ID[:]...), nil
+}
+
+// unmarshalCompact decodes the compact info of an ipv4 or ipv6 peer, which are told apart by their length
+func unmarshalCompact(b []byte) (dht.Contact, error) {
+	var ipLen int
+	switch len(b) {
+	case compactIPv4Length:
+		ipLen = net.IPv4len
+	case compactIPv6Length:
+		ipLen = net.IPv6len
+	default:
+		return dht.Contact{}, errors.Err("invalid compact length")
+	}
+	return dht.Contact{
+		IP:       net.IP(append([]byte(nil), b[:ipLen]...)),
+		PeerPort: int(b[ipLen])<<8 | int(b[ipLen+1]),
+		ID:       bits.FromBytesP(b[ipLen+2:]),
+	}, nil
+}
+
+// normalizeIP returns the 4 byte form of an ipv4 address, and the 16 byte form of an ipv6 one
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+// isIPv4 returns whether ip is an ipv4 address, or an ipv6 address mapped from one
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+// WellFormed returns whether packet is a message the node can decode. It's the check for dhtguard.Conn.WellFormed
+// when the guard is in front of a node of this package, since the dht package can't decode ipv6 contacts. Like the
+// default check, it doesn't crash on errors the dht package crashes on
+func WellFormed(packet []byte) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	var header struct {
+		Type int `bencode:"0"`
+	}
+	if bencode.DecodeBytes(packet, &header) != nil {
+		return false
+	}
+	var err error
+	switch header.Type {
+	case requestType:
+		err = bencode.DecodeBytes(packet, &dht.Request{})
+	case responseType:
+		err = bencode.DecodeBytes(packet, &response{})
+	case errorType:
+		err = bencode.DecodeBytes(packet, &dht.Error{})
+	default:
+		return false
+	}
+	return err == nil
+}
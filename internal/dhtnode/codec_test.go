@@ -0,0 +1,104 @@
+package dhtnode
+
+import (
+	"net"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+
+	"github.com/lyoshenka/bencode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponse(t *testing.T) {
+	v4 := dht.Contact{ID: bits.Rand(), IP: net.IPv4(10, 0, 0, 1), Port: 4444, PeerPort: 3333}
+	v6 := dht.Contact{ID: bits.Rand(), IP: net.ParseIP("2001:db8::1"), Port: 4445, PeerPort: 3334}
+	hash := bits.Rand()
+	tests := []struct {
+		name string
+		res  dht.Response
+	}{
+		{"ping", dht.Response{Data: pingResponse}},
+		{"findNode", dht.Response{Contacts: []dht.Contact{v6, v4}}},
+		{"findValue nodes", dht.Response{Contacts: []dht.Contact{v6, v4}, Token: "token"}},
+		{"findValue peers", dht.Response{Contacts: []dht.Contact{v6, v4}, Token: "token", FindValueKey: hash.RawString()}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.res.NodeID = bits.Rand()
+			copy(test.res.ID[:], "01234567890123456789")
+			encoded, err := bencode.EncodeBytes(response(test.res))
+			require.NoError(t, err)
+			var decoded response
+			require.NoError(t, bencode.DecodeBytes(encoded, &decoded))
+			assert.True(t, WellFormed(encoded))
+
+			assert.Equal(t, test.res.ID, decoded.ID)
+			assert.Equal(t, test.res.NodeID, decoded.NodeID)
+			assert.Equal(t, test.res.Data, decoded.Data)
+			assert.Equal(t, test.res.Token, decoded.Token)
+			assert.Equal(t, test.res.FindValueKey, decoded.FindValueKey)
+			require.Len(t, decoded.Contacts, len(test.res.Contacts))
+			for i, c := range test.res.Contacts {
+				assert.Equal(t, c.ID, decoded.Contacts[i].ID)
+				assert.True(t, c.IP.Equal(decoded.Contacts[i].IP))
+				if test.res.FindValueKey != "" {
+					assert.Equal(t, c.PeerPort, decoded.Contacts[i].PeerPort)
+				} else {
+					assert.Equal(t, c.Port, decoded.Contacts[i].Port)
+				}
+			}
+		})
+	}
+}
+
+func TestResponse_IPv4(t *testing.T) {
+	// a response with only ipv4 peers is the one of the dht package, both ways
+	res := dht.Response{
+		NodeID:       bits.Rand(),
+		Contacts:     []dht.Contact{{ID: bits.Rand(), IP: net.IPv4(10, 0, 0, 1).To4(), PeerPort: 3333}},
+		Token:        "token",
+		FindValueKey: bits.Rand().RawString(),
+	}
+	ours, err := bencode.EncodeBytes(response(res))
+	require.NoError(t, err)
+	theirs, err := bencode.EncodeBytes(res)
+	require.NoError(t, err)
+	assert.Equal(t, theirs, ours)
+
+	var decoded dht.Response
+	require.NoError(t, bencode.DecodeBytes(ours, &decoded))
+	require.Len(t, decoded.Contacts, 1)
+	assert.Equal(t, 3333, decoded.Contacts[0].PeerPort)
+}
+
+func TestCompact(t *testing.T) {
+	for _, ip := range []net.IP{net.IPv4(10, 0, 0, 1), net.ParseIP("2001:db8::1")} {
+		c := dht.Contact{ID: bits.Rand(), IP: ip, PeerPort: 3333}
+		compact, err := marshalCompact(c)
+		require.NoError(t, err)
+		if isIPv4(ip) {
+			assert.Len(t, compact, compactIPv4Length)
+		} else {
+			assert.Len(t, compact, compactIPv6Length)
+		}
+		decoded, err := unmarshalCompact(compact)
+		require.NoError(t, err)
+		assert.Equal(t, c.ID, decoded.ID)
+		assert.True(t, c.IP.Equal(decoded.IP))
+		assert.Equal(t, c.PeerPort, decoded.PeerPort)
+	}
+	_, err := unmarshalCompact(make([]byte, compactIPv4Length+1))
+	assert.Error(t, err)
+}
+
+func TestWellFormed(t *testing.T) {
+	for _, packet := range []string{"", "d1:0i", "d1:0i0e", "d1:0i3e1:1i0ee", "d1:0i2ee", "hello world"} {
+		assert.False(t, WellFormed([]byte(packet)), "%q", packet)
+	}
+	ping, err := dht.Request{Method: pingMethod}.MarshalBencode()
+	require.NoError(t, err)
+	assert.True(t, WellFormed(ping))
+}
@@ -0,0 +1,536 @@
+// Package dhtnode is a dht node that takes announces, and speaks the protocol of the nodes of the dht package. Those
+// rotate the secret of their write tokens every 5 minutes, which can't be configured, and make their tokens from the
+// ip and port the way Go prints them, so the same address can get two tokens. The node here rotates its tokens on the
+// interval it's configured with, binds them to the node id, ip and port the lookup came from, and only takes a store
+// from there. A node can't store announces for an address it doesn't get packets on, and has to come back for a token
+// every rotation, which makes flooding the node with announces and spoofing them costly. Its routing table is a
+// routingtable.Table, and its lookups are dhtlookup lookups.
+//
+// Nodes of this package also answer a request of their own, which tells the node that sends it which address it's seen
+// at, like STUN does, so a node behind a NAT can learn its external ip. See DetectExternalIP.
+//
+// The node is dual-stack: it takes a connection for each of ipv4 and ipv6, and encodes and decodes ipv6 contacts and
+// peers, which the dht package can't. Nodes of the dht package only speak ipv4, so a node that asks over ipv4 only gets
+// ipv4 nodes and peers back, and one that asks over ipv6 gets the ipv6 ones first.
+package dhtnode
+
+import (
+	"crypto/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/dhtlookup"
+	"github.com/lbryio/reflector.go/internal/routingtable"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	"github.com/lyoshenka/bencode"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pingMethod      = "ping"
+	storeMethod     = "store"
+	findNodeMethod  = "findNode"
+	findValueMethod = "findValue"
+	// addressMethod is an extension of the protocol that nodes of this package answer with the address the request
+	// came from. See DetectExternalIP
+	addressMethod = "address"
+
+	pingResponse  = "pong"
+	storeResponse = "OK"
+
+	requestType  = 0
+	responseType = 1
+	errorType    = 2
+
+	// invalidToken is the error a node sends for a store with a token it didn't give to the node that stores
+	invalidToken = "invalid-token"
+
+	// maxPacketSize is the biggest packet the node reads, like in the dht package
+	maxPacketSize = 4096
+	// messageIDSize is the size of the ids that tell the requests of a node apart
+	messageIDSize = 20
+	writeTimeout  = 5 * time.Second
+	// expireInterval is how often the announces that expired are removed from the store
+	expireInterval = time.Minute
+)
+
+// Config configures a node. The zero value is the defaults
+type Config struct {
+	// TokenRotation is how often the secret of the write tokens is rotated. A token is good for one to two rotations.
+	// DefaultTokenRotation if 0
+	TokenRotation time.Duration
+	// Lookup configures the lookups of the node. Its timeout is also how long the node waits for an answer to any
+	// request
+	Lookup dhtlookup.Config
+	// RoutingTable configures the routing table of the node
+	RoutingTable routingtable.TableConfig
+	// Store keeps the announces. They're kept in memory for DefaultPeerTTL if it's nil
+	Store Store
+	// PeerLimits caps how many peers the announces of a hash can add to the store
+	PeerLimits PeerLimits
+}
+
+// Node is a dht node
+type Node struct {
+	id bits.Bitmap
+	// conn4 and conn6 are the ipv4 and ipv6 connections. Either can be nil
+	conn4   dht.UDPConn
+	conn6   dht.UDPConn
+	tokens  *tokens
+	table   *routingtable.Table
+	store   Store
+	limits  PeerLimits
+	finder  *dhtlookup.Finder
+	timeout time.Duration
+
+	txMu sync.Mutex
+	txs  map[[messageIDSize]byte]*transaction
+
+	grp *stop.Group
+}
+
+// transaction is a request that waits for its answer
+type transaction struct {
+	addr string
+	res  chan *dht.Response
+}
+
+// New returns a node with the id
+func New(id bits.Bitmap, conf Config) *Node {
+	store := conf.Store
+	if store == nil {
+		store = NewMemStore(0)
+	}
+	timeout := conf.Lookup.Timeout
+	if timeout <= 0 {
+		timeout = dhtlookup.DefaultTimeout
+	}
+	n := &Node{
+		id:      id,
+		tokens:  newTokens(conf.TokenRotation),
+		table:   routingtable.NewTable(id, conf.RoutingTable),
+		store:   store,
+		limits:  conf.PeerLimits.withDefaults(),
+		timeout: timeout,
+		txs:     make(map[[messageIDSize]byte]*transaction),
+		grp:     stop.New(),
+	}
+	n.finder = &dhtlookup.Finder{Config: conf.Lookup, Send: n.SendAsync, Self: id}
+	return n
+}
+
+// ID returns the id of the node
+func (n *Node) ID() bits.Bitmap {
+	return n.id
+}
+
+// Connect starts answering the requests that come in on the ipv4 and ipv6 connections, keeping the routing table
+// healthy, and removing the announces that expired. Either connection can be nil, but not both. Packets to a node are
+// sent on the connection of its family
+func (n *Node) Connect(conn4, conn6 dht.UDPConn) {
+	n.conn4, n.conn6 = conn4, conn6
+	for _, conn := range []dht.UDPConn{conn4, conn6} {
+		if conn == nil {
+			continue
+		}
+		n.grp.Add(1)
+		go func(conn dht.UDPConn) {
+			defer n.grp.Done()
+			n.read(conn)
+		}(conn)
+	}
+	n.grp.Add(2)
+	go func() {
+		defer n.grp.Done()
+		n.expire()
+	}()
+	go func() {
+		defer n.grp.Done()
+		n.table.Run(func(c dht.Contact) bool {
+			return n.Send(c, dht.Request{Method: pingMethod}) != nil
+		}, func(target bits.Bitmap) {
+			_, err := n.Lookup(target, false)
+			if err != nil && !errors.Is(err, dhtlookup.ErrStopped) {
+				log.Debugf("refreshing the routing table: %s", err.Error())
+			}
+		}, n.grp.Ch())
+	}()
+}
+
+// Join pings the seed nodes, and looks up the id of the node through the ones that answered, so the node and the
+// nodes closest to it get to know each other. Each family is looked up through the seeds of that family, since nodes
+// that are asked over ipv4 only answer with ipv4 nodes. It returns an error if none of the seeds answered
+func (n *Node) Join(seeds []*net.UDPAddr) error {
+	var wg sync.WaitGroup
+	for _, addr := range seeds {
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			c := dht.Contact{IP: addr.IP, Port: addr.Port}
+			res := n.Send(c, dht.Request{Method: pingMethod})
+			if res != nil {
+				c.ID = res.NodeID
+				n.table.Update(c)
+			}
+		}(addr)
+	}
+	wg.Wait()
+	if n.table.Len() == 0 {
+		if len(seeds) > 0 {
+			return errors.Err("none of the %d seed nodes answered", len(seeds))
+		}
+		return nil
+	}
+	var lookupErr error
+	for _, ipv6 := range []bool{false, true} {
+		var start []dht.Contact
+		for _, c := range n.table.Closest(n.id, n.table.Len()) {
+			if isIPv4(c.IP) != ipv6 {
+				start = append(start, c)
+			}
+		}
+		if len(start) == 0 {
+			continue
+		}
+		if len(start) > dhtlookup.K {
+			start = start[:dhtlookup.K]
+		}
+		_, err := n.lookup(n.id, start, false)
+		if errors.Is(err, dhtlookup.ErrStopped) {
+			return nil
+		}
+		if err != nil {
+			lookupErr = err
+		}
+	}
+	return lookupErr
+}
+
+// Shutdown stops the node and closes its connections
+func (n *Node) Shutdown() {
+	n.grp.Stop()
+	for _, conn := range []dht.UDPConn{n.conn4, n.conn6} {
+		if conn == nil {
+			continue
+		}
+		err := conn.Close()
+		if err != nil {
+			log.Errorf("closing the dht node connection: %s", err.Error())
+		}
+	}
+	n.grp.Wait()
+}
+
+// Lookup looks up the nodes closest to target through the routing table, and updates it with the nodes that answered
+// or failed. A value lookup also finds the peers that announced target, and the tokens to announce it with
+func (n *Node) Lookup(target bits.Bitmap, findValue bool) (*dhtlookup.Result, error) {
+	return n.lookup(target, n.table.Closest(target, dhtlookup.K), findValue)
+}
+
+// lookup looks up target starting from the nodes of start, and updates the routing table like Lookup
+func (n *Node) lookup(target bits.Bitmap, start []dht.Contact, findValue bool) (*dhtlookup.Result, error) {
+	res, err := n.finder.Find(target, start, findValue, n.grp.Ch())
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range res.Contacts {
+		n.table.Update(c)
+	}
+	for _, c := range res.Failed {
+		n.table.Fail(c)
+	}
+	return res, nil
+}
+
+// SendAsync sends req to c, and returns a channel that gets the answer, or is closed without one if c sent an error or
+// didn't answer in time. It sets the message id and node id of req
+func (n *Node) SendAsync(c dht.Contact, req dht.Request) <-chan *dht.Response {
+	ch := make(chan *dht.Response, 1)
+	if c.ID == n.id {
+		close(ch)
+		return ch
+	}
+	var id [messageIDSize]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		panic(err)
+	}
+	copy(req.ID[:], id[:])
+	req.NodeID = n.id
+	tx := &transaction{addr: c.Addr().String(), res: make(chan *dht.Response, 1)}
+	n.txMu.Lock()
+	n.txs[id] = tx
+	n.txMu.Unlock()
+
+	go func() {
+		defer close(ch)
+		defer func() {
+			n.txMu.Lock()
+			delete(n.txs, id)
+			n.txMu.Unlock()
+		}()
+		err := n.send(c.Addr(), req)
+		if err != nil {
+			log.Debugf("sending %s to %s: %s", req.Method, c.String(), err.Error())
+			return
+		}
+		timer := time.NewTimer(n.timeout)
+		defer timer.Stop()
+		select {
+		case res := <-tx.res:
+			if res != nil {
+				ch <- res
+			}
+		case <-timer.C:
+		case <-n.grp.Ch():
+		}
+	}()
+	return ch
+}
+
+// Send sends req to c and returns the answer, or nil if c sent an error or didn't answer in time
+func (n *Node) Send(c dht.Contact, req dht.Request) *dht.Response {
+	return <-n.SendAsync(c, req)
+}
+
+// expire removes the announces that expired from the store every expireInterval, until the node shuts down
+func (n *Node) expire() {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.grp.Ch():
+			return
+		case <-ticker.C:
+		}
+		expired, err := n.store.Expire()
+		if err != nil {
+			log.Errorf("removing expired announces: %s", errors.FullTrace(err))
+		} else if expired > 0 {
+			log.Debugf("removed %d expired announces", expired)
+		}
+	}
+}
+
+// read handles the packets that come in on conn until the node shuts down
+func (n *Node) read(conn dht.UDPConn) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		size, addr, err := conn.ReadFromUDP(buf)
+		select {
+		case <-n.grp.Ch():
+			return
+		default:
+		}
+		if err != nil {
+			log.Errorf("dht node read: %s", err.Error())
+			continue
+		}
+		n.handlePacket(append([]byte(nil), buf[:size]...), addr)
+	}
+}
+
+// handlePacket handles a request, response or error
+func (n *Node) handlePacket(data []byte, addr *net.UDPAddr) {
+	// the dht package crashes on some malformed errors
+	defer func() {
+		if r := recover(); r != nil {
+			log.Debugf("malformed dht message from %s: %v", addr, r)
+		}
+	}()
+	var header struct {
+		Type int `bencode:"0"`
+	}
+	err := bencode.DecodeBytes(data, &header)
+	if err != nil {
+		log.Debugf("malformed dht packet from %s: %s", addr, err.Error())
+		return
+	}
+	switch header.Type {
+	case requestType:
+		var req dht.Request
+		err = bencode.DecodeBytes(data, &req)
+		if err == nil && req.NodeID != n.id {
+			n.handleRequest(addr, req)
+		}
+	case responseType:
+		var decoded response
+		err = bencode.DecodeBytes(data, &decoded)
+		if err == nil {
+			res := dht.Response(decoded)
+			n.answer(addr, res.ID, &res)
+		}
+	case errorType:
+		var e dht.Error
+		err = bencode.DecodeBytes(data, &e)
+		if err == nil {
+			log.Debugf("dht error from %s: %s", addr, e.ExceptionType)
+			n.answer(addr, e.ID, nil)
+		}
+	}
+	if err != nil {
+		log.Debugf("malformed dht message from %s: %s", addr, err.Error())
+	}
+}
+
+// answer passes res on to the request with the id, if it was sent to addr. res is nil for an error
+func (n *Node) answer(addr *net.UDPAddr, id [messageIDSize]byte, res *dht.Response) {
+	n.txMu.Lock()
+	defer n.txMu.Unlock()
+	tx, ok := n.txs[id]
+	if !ok || tx.addr != addr.String() {
+		return
+	}
+	select {
+	case tx.res <- res:
+	default:
+	}
+}
+
+// handleRequest answers a request
+func (n *Node) handleRequest(addr *net.UDPAddr, req dht.Request) {
+	res := dht.Response{ID: req.ID, NodeID: n.id}
+	switch req.Method {
+	case pingMethod:
+		res.Data = pingResponse
+	case storeMethod:
+		if req.StoreArgs == nil {
+			return
+		}
+		args := req.StoreArgs
+		// the token is bound to the address the value lookup came from, so a store from another address fails here
+		if !n.tokens.Verify(args.Value.Token, req.NodeID, addr) {
+			log.Debugf("store of %s from %s with an invalid token", args.BlobHash.HexShort(), addr)
+			n.reply(addr, dht.Error{ID: req.ID, NodeID: n.id, ExceptionType: invalidToken})
+			return
+		}
+		if args.Value.Port <= 0 || args.Value.Port > 65535 {
+			return
+		}
+		// the token is for the node that asked for it, so it can't store peers with other ids
+		if args.NodeID != req.NodeID {
+			log.Debugf("store of %s from %s for another node id", args.BlobHash.HexShort(), addr)
+			return
+		}
+		// the peer is at the ip the store came from, whatever it claims
+		err := n.store.Add(args.BlobHash, dht.Contact{ID: args.NodeID, IP: addr.IP, Port: addr.Port, PeerPort: args.Value.Port}, n.limits)
+		if errors.Is(err, ErrTooManyPeers) {
+			log.Debugf("store of %s from %s: %s", args.BlobHash.HexShort(), addr, err.Error())
+			return
+		}
+		if err != nil {
+			log.Errorf("storing an announce of %s: %s", args.BlobHash.HexShort(), errors.FullTrace(err))
+			return
+		}
+		res.Data = storeResponse
+	case findNodeMethod:
+		if req.Arg == nil {
+			return
+		}
+		res.Contacts = n.closest(*req.Arg, req.NodeID, addr.IP)
+	case findValueMethod:
+		if req.Arg == nil {
+			return
+		}
+		res.Token = n.tokens.Get(req.NodeID, addr)
+		peers, err := n.store.Get(*req.Arg)
+		if err != nil {
+			log.Errorf("reading the announces of %s: %s", req.Arg.HexShort(), errors.FullTrace(err))
+		}
+		peers = sameFamilyFirst(peers, addr.IP)
+		if len(peers) > 0 {
+			res.FindValueKey = req.Arg.RawString()
+			res.Contacts = peers
+		} else {
+			res.Contacts = n.closest(*req.Arg, req.NodeID, addr.IP)
+		}
+	case addressMethod:
+		res.Data = addr.String()
+	default:
+		log.Debugf("unknown dht method %q from %s", req.Method, addr)
+		return
+	}
+	n.reply(addr, response(res))
+	n.table.Touch(dht.Contact{ID: req.NodeID, IP: addr.IP, Port: addr.Port})
+}
+
+// DetectExternalIP asks the nodes of this package in the routing table which ip requests of the node come from. It asks
+// over ipv6 if ipv6 is true, and over ipv4 otherwise
+func (n *Node) DetectExternalIP(ipv6 bool) (net.IP, error) {
+	var nodes []dht.Contact
+	for _, c := range n.table.Closest(bits.Rand(), n.table.Len()) {
+		if isIPv4(c.IP) != ipv6 {
+			nodes = append(nodes, c)
+		}
+	}
+	return DetectExternalIP(n.SendAsync, nodes)
+}
+
+// closest returns the nodes of the routing table closest to target for the node that asked from ip, without that node.
+// The ones of the family of ip come first
+func (n *Node) closest(target, asker bits.Bitmap, ip net.IP) []dht.Contact {
+	contacts := n.table.Closest(target, n.table.Len())
+	for i, c := range contacts {
+		if c.ID == asker {
+			contacts = append(contacts[:i], contacts[i+1:]...)
+			break
+		}
+	}
+	contacts = sameFamilyFirst(contacts, ip)
+	if len(contacts) > dhtlookup.K {
+		contacts = contacts[:dhtlookup.K]
+	}
+	return contacts
+}
+
+// sameFamilyFirst returns the contacts of the family of ip, in order, followed by the others if ip is ipv6. A node
+// that asks over ipv4 may be a node of the dht package, which can't decode a response with ipv6 contacts in it
+func sameFamilyFirst(contacts []dht.Contact, ip net.IP) []dht.Contact {
+	var same, other []dht.Contact
+	for _, c := range contacts {
+		if isIPv4(c.IP) == isIPv4(ip) {
+			same = append(same, c)
+		} else {
+			other = append(other, c)
+		}
+	}
+	if isIPv4(ip) {
+		return same
+	}
+	return append(same, other...)
+}
+
+// reply sends a response or error, and logs if that fails
+func (n *Node) reply(addr *net.UDPAddr, msg interface{}) {
+	err := n.send(addr, msg)
+	if err != nil {
+		log.Debugf("answering %s: %s", addr, err.Error())
+	}
+}
+
+// send encodes msg and sends it to addr, on the connection of its family
+func (n *Node) send(addr *net.UDPAddr, msg interface{}) error {
+	conn, family := n.conn6, "ipv6"
+	if isIPv4(addr.IP) {
+		conn, family = n.conn4, "ipv4"
+	}
+	if conn == nil {
+		return errors.Err("no %s connection", family)
+	}
+	encoded, err := bencode.EncodeBytes(msg)
+	if err != nil {
+		return errors.Err(err)
+	}
+	err = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err != nil {
+		return errors.Err(err)
+	}
+	_, err = conn.WriteToUDP(encoded, addr)
+	return errors.Err(err)
+}
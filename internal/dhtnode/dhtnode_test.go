@@ -0,0 +1,267 @@
+package dhtnode
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/dhtlookup"
+	"github.com/lbryio/reflector.go/internal/dhtsim"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+
+	"github.com/lyoshenka/bencode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPort = 4444
+
+// startNode starts a node at ip on the network, with a connection of the family of ip only
+func startNode(t *testing.T, network *dhtsim.Network, id bits.Bitmap, ip net.IP, port int) (*Node, dht.Contact) {
+	c := dht.Contact{ID: id, IP: ip, Port: port}
+	conn, err := network.Listen(c.Addr())
+	require.NoError(t, err)
+	n := New(id, Config{})
+	if isIPv4(ip) {
+		n.Connect(conn, nil)
+	} else {
+		n.Connect(nil, conn)
+	}
+	t.Cleanup(n.Shutdown)
+	return n, c
+}
+
+// startDualStackNode starts a node at ip4 and ip6 on the network
+func startDualStackNode(t *testing.T, network *dhtsim.Network, id bits.Bitmap, ip4, ip6 net.IP,
+	port int) (*Node, dht.Contact, dht.Contact) {
+	c4, c6 := dht.Contact{ID: id, IP: ip4, Port: port}, dht.Contact{ID: id, IP: ip6, Port: port}
+	conn4, err := network.Listen(c4.Addr())
+	require.NoError(t, err)
+	conn6, err := network.Listen(c6.Addr())
+	require.NoError(t, err)
+	n := New(id, Config{})
+	n.Connect(conn4, conn6)
+	t.Cleanup(n.Shutdown)
+	return n, c4, c6
+}
+
+// storeRequest returns a request that stores hash for the peer with the id on port, decoded from its encoding like
+// the announcer of the prism does
+func storeRequest(t *testing.T, hash, id bits.Bitmap, token string, port int) dht.Request {
+	encoded, err := bencode.EncodeBytes(map[string]interface{}{
+		"3": storeMethod,
+		"4": []interface{}{hash, map[string]interface{}{"token": token, "lbryid": id, "port": port}, id, 0},
+	})
+	require.NoError(t, err)
+	var req dht.Request
+	require.NoError(t, req.UnmarshalBencode(encoded))
+	return req
+}
+
+// announce asks c for a token from n and stores hash with it
+func announce(t *testing.T, n *Node, c dht.Contact, hash bits.Bitmap, peerPort int) *dht.Response {
+	res := n.Send(c, dht.Request{Method: findValueMethod, Arg: &hash})
+	require.NotNil(t, res)
+	require.NotEmpty(t, res.Token)
+	return n.Send(c, storeRequest(t, hash, n.ID(), res.Token, peerPort))
+}
+
+func TestNode_Store(t *testing.T) {
+	network := dhtsim.NewNetwork(1)
+	_, storerContact := startNode(t, network, bits.Rand(), net.IPv4(10, 0, 0, 1), testPort)
+	announcer, _ := startNode(t, network, bits.Rand(), net.IPv4(10, 0, 0, 2), testPort)
+	asker, _ := startNode(t, network, bits.Rand(), net.IPv4(10, 0, 0, 3), testPort)
+	require.NoError(t, announcer.Join([]*net.UDPAddr{storerContact.Addr()}))
+
+	hash := bits.Rand()
+	res := announce(t, announcer, storerContact, hash, 3333)
+	require.NotNil(t, res)
+	assert.Equal(t, storeResponse, res.Data)
+
+	res = asker.Send(storerContact, dht.Request{Method: findValueMethod, Arg: &hash})
+	require.NotNil(t, res)
+	assert.Equal(t, hash.RawString(), res.FindValueKey)
+	require.Len(t, res.Contacts, 1)
+	assert.Equal(t, announcer.ID(), res.Contacts[0].ID)
+	assert.True(t, res.Contacts[0].IP.Equal(net.IPv4(10, 0, 0, 2)))
+	assert.Equal(t, 3333, res.Contacts[0].PeerPort)
+}
+
+func TestNode_StoreFromAnotherAddress(t *testing.T) {
+	network := dhtsim.NewNetwork(1)
+	storer, storerContact := startNode(t, network, bits.Rand(), net.IPv4(10, 0, 0, 1), testPort)
+	id := bits.Rand()
+	announcer, _ := startNode(t, network, id, net.IPv4(10, 0, 0, 2), testPort)
+	// the same node id on another port of the same ip, and on another ip
+	otherPort, _ := startNode(t, network, id, net.IPv4(10, 0, 0, 2), testPort+1)
+	otherIP, _ := startNode(t, network, id, net.IPv4(10, 0, 0, 3), testPort)
+
+	hash := bits.Rand()
+	res := announcer.Send(storerContact, dht.Request{Method: findValueMethod, Arg: &hash})
+	require.NotNil(t, res)
+	for _, spoofer := range []*Node{otherPort, otherIP} {
+		assert.Nil(t, spoofer.Send(storerContact, storeRequest(t, hash, id, res.Token, 3333)),
+			"expected a store with a token of another address to fail")
+	}
+	peers, err := storer.store.Get(hash)
+	require.NoError(t, err)
+	assert.Empty(t, peers)
+
+	// the node the token was given to can store with it
+	res = announcer.Send(storerContact, storeRequest(t, hash, id, res.Token, 3333))
+	require.NotNil(t, res)
+	assert.Equal(t, storeResponse, res.Data)
+}
+
+func TestNode_StoreForAnotherNodeID(t *testing.T) {
+	network := dhtsim.NewNetwork(1)
+	storer, storerContact := startNode(t, network, bits.Rand(), net.IPv4(10, 0, 0, 1), testPort)
+	announcer, _ := startNode(t, network, bits.Rand(), net.IPv4(10, 0, 0, 2), testPort)
+
+	hash := bits.Rand()
+	res := announcer.Send(storerContact, dht.Request{Method: findValueMethod, Arg: &hash})
+	require.NotNil(t, res)
+	var stores []<-chan *dht.Response
+	for i := 0; i < 3; i++ {
+		stores = append(stores, announcer.SendAsync(storerContact, storeRequest(t, hash, bits.Rand(), res.Token, 3333)))
+	}
+	for _, ch := range stores {
+		assert.Nil(t, <-ch, "expected a store of a peer with another id than the node's to fail")
+	}
+	peers, err := storer.store.Get(hash)
+	require.NoError(t, err)
+	assert.Empty(t, peers)
+}
+
+func TestNode_TokenRotation(t *testing.T) {
+	network := dhtsim.NewNetwork(1)
+	storer, storerContact := startNode(t, network, bits.Rand(), net.IPv4(10, 0, 0, 1), testPort)
+	announcer, _ := startNode(t, network, bits.Rand(), net.IPv4(10, 0, 0, 2), testPort)
+	now := time.Now()
+	storer.tokens.now = func() time.Time { return now }
+
+	hash := bits.Rand()
+	res := announcer.Send(storerContact, dht.Request{Method: findValueMethod, Arg: &hash})
+	require.NotNil(t, res)
+	token := res.Token
+
+	// the token is good for the rotation it was made in and the next one
+	now = now.Add(DefaultTokenRotation + time.Second)
+	res = announcer.Send(storerContact, storeRequest(t, hash, announcer.ID(), token, 3333))
+	require.NotNil(t, res, "expected the token of the rotation before to be good")
+
+	now = now.Add(DefaultTokenRotation)
+	assert.Nil(t, announcer.Send(storerContact, storeRequest(t, hash, announcer.ID(), token, 3333)),
+		"expected the token to be stale after two rotations")
+}
+
+func TestNode_Interop(t *testing.T) {
+	network := dhtsim.NewNetwork(1)
+	sim, err := dhtsim.New(network, 30)
+	require.NoError(t, err)
+	defer sim.Shutdown()
+
+	node, contact := startNode(t, network, bits.Rand(), net.IPv4(10, 1, 0, 1), testPort)
+	require.NoError(t, node.Join([]*net.UDPAddr{sim.Contacts[0].Addr()}))
+	network.Settle(10 * time.Millisecond)
+
+	target := bits.Rand()
+	res, err := node.Lookup(target, false)
+	require.NoError(t, err)
+	network.Settle(10 * time.Millisecond)
+	require.Len(t, res.Contacts, dhtlookup.K)
+	var found, want []string
+	for _, c := range res.Contacts {
+		found = append(found, c.ID.HexShort())
+	}
+	for _, c := range sim.Closest(target, len(res.Contacts)) {
+		want = append(want, c.ID.HexShort())
+	}
+	assert.Equal(t, want, found, "expected the lookup through the nodes of the dht package to find the closest ones")
+
+	// a node of the dht package gets a token, stores an announce, and finds it
+	hash := bits.Rand()
+	lbry := sim.Nodes[3]
+	res2 := lbry.Send(contact, dht.Request{Method: findValueMethod, Arg: &hash})
+	require.NotNil(t, res2)
+	res2 = lbry.Send(contact, storeRequest(t, hash, sim.Contacts[3].ID, res2.Token, 3333))
+	require.NotNil(t, res2)
+	assert.Equal(t, storeResponse, res2.Data)
+	res2 = lbry.Send(contact, dht.Request{Method: findValueMethod, Arg: &hash})
+	require.NotNil(t, res2)
+	require.Len(t, res2.Contacts, 1)
+	assert.Equal(t, 3333, res2.Contacts[0].PeerPort)
+	network.Settle(10 * time.Millisecond)
+}
+
+func TestNode_DualStack(t *testing.T) {
+	network := dhtsim.NewNetwork(1)
+	sim, err := dhtsim.New(network, 1)
+	require.NoError(t, err)
+	defer sim.Shutdown()
+
+	storer, storer4, storer6 := startDualStackNode(t, network, bits.Rand(), net.IPv4(10, 2, 0, 1),
+		net.ParseIP("2001:db8::1"), testPort)
+	announcer6, contact6 := startNode(t, network, bits.Rand(), net.ParseIP("2001:db8::2"), testPort)
+	announcer4, contact4 := startNode(t, network, bits.Rand(), net.IPv4(10, 2, 0, 2), testPort)
+	asker6, _ := startNode(t, network, bits.Rand(), net.ParseIP("2001:db8::3"), testPort)
+	require.NoError(t, storer.Join([]*net.UDPAddr{contact6.Addr(), contact4.Addr()}))
+
+	// an ipv6-only node joins through the ipv6 address of the storer, and announces to it
+	require.NoError(t, announcer6.Join([]*net.UDPAddr{storer6.Addr()}))
+	hash := bits.Rand()
+	res := announce(t, announcer6, storer6, hash, 3333)
+	require.NotNil(t, res)
+	assert.Equal(t, storeResponse, res.Data)
+	res = announce(t, announcer4, storer4, hash, 4444)
+	require.NotNil(t, res)
+	assert.Equal(t, storeResponse, res.Data)
+
+	// a node that asks over ipv6 gets the ipv6 peer first, and the ipv4 one after it
+	res = asker6.Send(storer6, dht.Request{Method: findValueMethod, Arg: &hash})
+	require.NotNil(t, res)
+	require.Len(t, res.Contacts, 2)
+	assert.True(t, res.Contacts[0].IP.Equal(contact6.IP))
+	assert.Equal(t, 3333, res.Contacts[0].PeerPort)
+	assert.True(t, res.Contacts[1].IP.Equal(contact4.IP))
+	res = asker6.Send(storer6, dht.Request{Method: findNodeMethod, Arg: &hash})
+	require.NotNil(t, res)
+	require.Len(t, res.Contacts, 2)
+	assert.True(t, res.Contacts[0].IP.Equal(contact6.IP))
+
+	// a node of the dht package, which only decodes ipv4, only gets the ipv4 peer and nodes
+	lbry := sim.Nodes[0]
+	res = lbry.Send(storer4, dht.Request{Method: findValueMethod, Arg: &hash})
+	require.NotNil(t, res)
+	require.Len(t, res.Contacts, 1)
+	assert.True(t, res.Contacts[0].IP.Equal(contact4.IP))
+	assert.Equal(t, 4444, res.Contacts[0].PeerPort)
+	res = lbry.Send(storer4, dht.Request{Method: findNodeMethod, Arg: &hash})
+	require.NotNil(t, res)
+	for _, c := range res.Contacts {
+		assert.True(t, isIPv4(c.IP), "expected only ipv4 nodes, got %s", c.String())
+	}
+	network.Settle(10 * time.Millisecond)
+}
+
+func TestNode_JoinEachFamily(t *testing.T) {
+	network := dhtsim.NewNetwork(1)
+	seed4, seed4Contact := startNode(t, network, bits.Rand(), net.IPv4(10, 3, 0, 1), testPort)
+	seed6, seed6Contact := startNode(t, network, bits.Rand(), net.ParseIP("2001:db8:3::1"), testPort)
+	_, other4 := startNode(t, network, bits.Rand(), net.IPv4(10, 3, 0, 2), testPort)
+	_, other6 := startNode(t, network, bits.Rand(), net.ParseIP("2001:db8:3::2"), testPort)
+	require.NoError(t, seed4.Join([]*net.UDPAddr{other4.Addr()}))
+	require.NoError(t, seed6.Join([]*net.UDPAddr{other6.Addr()}))
+
+	n, _, _ := startDualStackNode(t, network, bits.Rand(), net.IPv4(10, 3, 0, 3), net.ParseIP("2001:db8:3::3"), testPort)
+	require.NoError(t, n.Join([]*net.UDPAddr{seed4Contact.Addr(), seed6Contact.Addr()}))
+
+	known := make(map[bits.Bitmap]bool)
+	for _, c := range n.table.Closest(n.ID(), n.table.Len()) {
+		known[c.ID] = true
+	}
+	assert.True(t, known[other4.ID], "expected the node to find the ipv4 node through the ipv4 seed")
+	assert.True(t, known[other6.ID], "expected the node to find the ipv6 node through the ipv6 seed")
+}
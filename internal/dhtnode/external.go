@@ -0,0 +1,60 @@
+package dhtnode
+
+import (
+	"net"
+	"sync"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// maxAddressQueries is how many nodes DetectExternalIP asks at most
+const maxAddressQueries = 8
+
+// DetectExternalIP asks the nodes which address the requests sent with send come from, and returns the ip most of the
+// ones that answered saw. Only nodes of this package answer, nodes of the dht package ignore the request. It returns an
+// error if none of them answered, or if as many saw another ip, since a single node could lie about it
+func DetectExternalIP(send func(dht.Contact, dht.Request) <-chan *dht.Response, nodes []dht.Contact) (net.IP, error) {
+	if len(nodes) > maxAddressQueries {
+		nodes = nodes[:maxAddressQueries]
+	}
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	var wg sync.WaitGroup
+	for _, c := range nodes {
+		wg.Add(1)
+		go func(c dht.Contact) {
+			defer wg.Done()
+			res := <-send(c, dht.Request{Method: addressMethod})
+			if res == nil {
+				return
+			}
+			addr, err := net.ResolveUDPAddr("udp", res.Data)
+			if err != nil || addr.IP == nil {
+				return
+			}
+			mu.Lock()
+			seen[addr.IP.String()]++
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	var best string
+	most, tied := 0, false
+	for ip, n := range seen {
+		switch {
+		case n > most:
+			best, most, tied = ip, n, false
+		case n == most:
+			tied = true
+		}
+	}
+	if most == 0 {
+		return nil, errors.Err("none of the %d nodes told the address they see", len(nodes))
+	}
+	if tied {
+		return nil, errors.Err("the nodes disagree on the address they see")
+	}
+	return net.ParseIP(best), nil
+}
@@ -0,0 +1,57 @@
+package dhtnode
+
+import (
+	"net"
+	"testing"
+
+	"github.com/lbryio/reflector.go/internal/dhtsim"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode_DetectExternalIP(t *testing.T) {
+	network := dhtsim.NewNetwork(1)
+	_, seed4 := startNode(t, network, bits.Rand(), net.IPv4(10, 0, 0, 1), testPort)
+	_, seed6 := startNode(t, network, bits.Rand(), net.ParseIP("2001:db8::1"), testPort)
+	n, _, _ := startDualStackNode(t, network, bits.Rand(), net.IPv4(10, 0, 0, 2), net.ParseIP("2001:db8::2"), testPort)
+	require.NoError(t, n.Join([]*net.UDPAddr{seed4.Addr(), seed6.Addr()}))
+
+	ip, err := n.DetectExternalIP(false)
+	require.NoError(t, err)
+	assert.True(t, ip.Equal(net.IPv4(10, 0, 0, 2)), "got %s", ip)
+	ip, err = n.DetectExternalIP(true)
+	require.NoError(t, err)
+	assert.True(t, ip.Equal(net.ParseIP("2001:db8::2")), "got %s", ip)
+}
+
+func TestDetectExternalIP(t *testing.T) {
+	// answers maps the port of a node to the address it says it sees, or to "" if it doesn't answer
+	detect := func(answers map[int]string) (net.IP, error) {
+		var nodes []dht.Contact
+		for port := range answers {
+			nodes = append(nodes, dht.Contact{ID: bits.Rand(), IP: net.IPv4(10, 0, 0, 1), Port: port})
+		}
+		return DetectExternalIP(func(c dht.Contact, req dht.Request) <-chan *dht.Response {
+			assert.Equal(t, addressMethod, req.Method)
+			ch := make(chan *dht.Response, 1)
+			if a := answers[c.Port]; a != "" {
+				ch <- &dht.Response{Data: a}
+			}
+			close(ch)
+			return ch
+		}, nodes)
+	}
+
+	ip, err := detect(map[int]string{1: "203.0.113.1:4444", 2: "203.0.113.1:5555", 3: "198.51.100.1:4444", 4: ""})
+	require.NoError(t, err)
+	assert.True(t, ip.Equal(net.IPv4(203, 0, 113, 1)), "expected the ip most nodes saw, got %s", ip)
+
+	_, err = detect(map[int]string{1: "203.0.113.1:4444", 2: "198.51.100.1:4444"})
+	assert.Error(t, err, "expected an error when the nodes disagree")
+	_, err = detect(map[int]string{1: "", 2: "not an address"})
+	assert.Error(t, err, "expected an error when no node answers")
+}
@@ -0,0 +1,329 @@
+package dhtnode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultPeerTTL is how long an announce is kept if it's not announced again. Announcers of the dht package announce
+// every 50 minutes
+const DefaultPeerTTL = time.Hour
+
+// expireBatch is how many announces Expire removes in one transaction of a bolt store
+const expireBatch = 10000
+
+const (
+	// DefaultMaxPeersPerHash is how many peers a hash can have. A findValue answer only holds about 70 of them anyway
+	DefaultMaxPeersPerHash = 256
+	// DefaultMaxPeersPerIP is how many of the peers of a hash can be at the same ip, for the nodes behind one NAT
+	DefaultMaxPeersPerIP = 8
+)
+
+// ErrTooManyPeers is returned by Add when a new peer would go over the PeerLimits
+var ErrTooManyPeers = errors.Base("too many peers")
+
+// PeerLimits caps the peers of a hash, so a node that gets tokens for many node ids can't flood a hash with peers.
+// A peer that's already stored can always announce again. The zero value is the defaults
+type PeerLimits struct {
+	// PerHash is how many peers a hash can have. DefaultMaxPeersPerHash if 0
+	PerHash int
+	// PerIP is how many peers of a hash can be at the same ip. DefaultMaxPeersPerIP if 0
+	PerIP int
+}
+
+// withDefaults returns the limits with the defaults for the ones that are 0
+func (l PeerLimits) withDefaults() PeerLimits {
+	if l.PerHash <= 0 {
+		l.PerHash = DefaultMaxPeersPerHash
+	}
+	if l.PerIP <= 0 {
+		l.PerIP = DefaultMaxPeersPerIP
+	}
+	return l
+}
+
+// peerCounter counts the peers of a hash other than the one being added, to check a new one against the limits
+type peerCounter struct {
+	limits PeerLimits
+	ip     net.IP
+	total  int
+	sameIP int
+}
+
+func newPeerCounter(limits PeerLimits, peer dht.Contact) *peerCounter {
+	return &peerCounter{limits: limits.withDefaults(), ip: peer.IP}
+}
+
+func (c *peerCounter) count(p dht.Contact) {
+	c.total++
+	if p.IP.Equal(c.ip) {
+		c.sameIP++
+	}
+}
+
+// check returns ErrTooManyPeers if a new peer doesn't fit
+func (c *peerCounter) check() error {
+	if c.total >= c.limits.PerHash {
+		return errors.Prefix("hash", ErrTooManyPeers)
+	}
+	if c.sameIP >= c.limits.PerIP {
+		return errors.Prefix("ip", ErrTooManyPeers)
+	}
+	return nil
+}
+
+// Store keeps the peers that announced hashes to a node, until they weren't announced again for the ttl of the store
+type Store interface {
+	// Add adds peer to the peers of hash, or replaces the peer with the same id. It returns ErrTooManyPeers if a new
+	// peer goes over the limits
+	Add(hash bits.Bitmap, peer dht.Contact, limits PeerLimits) error
+	// Get returns the peers of hash that didn't expire
+	Get(hash bits.Bitmap) ([]dht.Contact, error)
+	// Expire removes the peers that expired, and returns how many there were
+	Expire() (int, error)
+}
+
+// storedPeer is a peer and when it expires
+type storedPeer struct {
+	dht.Contact
+	expires time.Time
+}
+
+// memStore keeps the peers in memory, like the nodes of the dht package do
+type memStore struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu    sync.RWMutex
+	peers map[bits.Bitmap][]storedPeer
+}
+
+// NewMemStore returns a store that keeps the peers in memory for ttl, or DefaultPeerTTL if it's 0
+func NewMemStore(ttl time.Duration) Store {
+	if ttl <= 0 {
+		ttl = DefaultPeerTTL
+	}
+	return &memStore{ttl: ttl, now: time.Now, peers: make(map[bits.Bitmap][]storedPeer)}
+}
+
+func (m *memStore) Add(hash bits.Bitmap, peer dht.Contact, limits PeerLimits) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	stored := storedPeer{Contact: peer, expires: now.Add(m.ttl)}
+	peers := m.peers[hash]
+	counter := newPeerCounter(limits, peer)
+	for i, p := range peers {
+		if p.ID == peer.ID {
+			peers[i] = stored
+			return nil
+		}
+		if now.Before(p.expires) {
+			counter.count(p.Contact)
+		}
+	}
+	if err := counter.check(); err != nil {
+		return err
+	}
+	m.peers[hash] = append(peers, stored)
+	return nil
+}
+
+func (m *memStore) Get(hash bits.Bitmap) ([]dht.Contact, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := m.now()
+	var peers []dht.Contact
+	for _, p := range m.peers[hash] {
+		if now.Before(p.expires) {
+			peers = append(peers, p.Contact)
+		}
+	}
+	return peers, nil
+}
+
+func (m *memStore) Expire() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	expired := 0
+	for hash, peers := range m.peers {
+		kept := peers[:0]
+		for _, p := range peers {
+			if now.Before(p.expires) {
+				kept = append(kept, p)
+			}
+		}
+		expired += len(peers) - len(kept)
+		if len(kept) == 0 {
+			delete(m.peers, hash)
+		} else {
+			m.peers[hash] = kept
+		}
+	}
+	return expired, nil
+}
+
+var (
+	// peersBucket holds the peers by hash and peer id, with when they expire
+	peersBucket = []byte("peers")
+	// expiryBucket holds the keys of peersBucket by when they expire, so the expired ones are found without a scan
+	expiryBucket = []byte("expiry")
+)
+
+// BoltStore keeps the peers in a bolt db on disk, so a node that restarts still has the announces it got before
+type BoltStore struct {
+	db  *bolt.DB
+	ttl time.Duration
+	now func() time.Time
+}
+
+// OpenBoltStore opens the store in the file at path, creating it if it doesn't exist. Peers are kept for ttl, or
+// DefaultPeerTTL if it's 0
+func OpenBoltStore(path string, ttl time.Duration) (*BoltStore, error) {
+	if ttl <= 0 {
+		ttl = DefaultPeerTTL
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Prefix("opening peer store "+path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{peersBucket, expiryBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Err(err)
+	}
+	return &BoltStore{db: db, ttl: ttl, now: time.Now}, nil
+}
+
+// Close closes the store file
+func (s *BoltStore) Close() error {
+	return errors.Err(s.db.Close())
+}
+
+// Add adds peer to the peers of hash, or replaces the peer with the same id. Calls from several goroutines are written
+// together
+func (s *BoltStore) Add(hash bits.Bitmap, peer dht.Contact, limits PeerLimits) error {
+	key := append(append([]byte(nil), hash[:]...), peer.ID[:]...)
+	now := s.now()
+	value := encodePeer(peer, now.Add(s.ttl))
+	return errors.Err(s.db.Batch(func(tx *bolt.Tx) error {
+		peers, expiry := tx.Bucket(peersBucket), tx.Bucket(expiryBucket)
+		if old := peers.Get(key); len(old) >= 8 {
+			if err := expiry.Delete(append(append([]byte(nil), old[:8]...), key...)); err != nil {
+				return err
+			}
+		} else {
+			counter := newPeerCounter(limits, peer)
+			c := peers.Cursor()
+			for k, v := c.Seek(hash[:]); k != nil && bytes.HasPrefix(k, hash[:]); k, v = c.Next() {
+				p, expires, err := decodePeer(k[len(hash):], v)
+				if err != nil {
+					return err
+				}
+				if now.Before(expires) {
+					counter.count(p)
+				}
+			}
+			if err := counter.check(); err != nil {
+				return err
+			}
+		}
+		if err := peers.Put(key, value); err != nil {
+			return err
+		}
+		return expiry.Put(append(append([]byte(nil), value[:8]...), key...), nil)
+	}))
+}
+
+// Get returns the peers of hash that didn't expire
+func (s *BoltStore) Get(hash bits.Bitmap) ([]dht.Contact, error) {
+	now := s.now()
+	var peers []dht.Contact
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(peersBucket).Cursor()
+		for k, v := c.Seek(hash[:]); k != nil && bytes.HasPrefix(k, hash[:]); k, v = c.Next() {
+			peer, expires, err := decodePeer(k[len(hash):], v)
+			if err != nil {
+				return err
+			}
+			if now.Before(expires) {
+				peers = append(peers, peer)
+			}
+		}
+		return nil
+	})
+	return peers, errors.Err(err)
+}
+
+// Expire removes the peers that expired, a batch at a time so a lot of them don't hold up the announces that come in
+func (s *BoltStore) Expire() (int, error) {
+	var now [8]byte
+	binary.BigEndian.PutUint64(now[:], uint64(s.now().UnixNano()))
+	expired := 0
+	for {
+		var n int
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			peers, expiry := tx.Bucket(peersBucket), tx.Bucket(expiryBucket)
+			var keys [][]byte
+			c := expiry.Cursor()
+			for k, _ := c.First(); k != nil && len(keys) < expireBatch && bytes.Compare(k[:8], now[:]) <= 0; k, _ = c.Next() {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			for _, k := range keys {
+				if err := peers.Delete(k[8:]); err != nil {
+					return err
+				}
+				if err := expiry.Delete(k); err != nil {
+					return err
+				}
+			}
+			n = len(keys)
+			return nil
+		})
+		expired += n
+		if err != nil || n < expireBatch {
+			return expired, errors.Err(err)
+		}
+	}
+}
+
+// encodePeer encodes when the peer expires, its ports and its ip. Its id is in the key
+func encodePeer(peer dht.Contact, expires time.Time) []byte {
+	ip := normalizeIP(peer.IP)
+	b := make([]byte, 12, 12+len(ip))
+	binary.BigEndian.PutUint64(b, uint64(expires.UnixNano()))
+	binary.BigEndian.PutUint16(b[8:], uint16(peer.Port))
+	binary.BigEndian.PutUint16(b[10:], uint16(peer.PeerPort))
+	return append(b, ip...)
+}
+
+// decodePeer decodes a peer with the id
+func decodePeer(id, b []byte) (dht.Contact, time.Time, error) {
+	if len(id) != bits.NumBytes || (len(b) != 12+net.IPv4len && len(b) != 12+net.IPv6len) {
+		return dht.Contact{}, time.Time{}, errors.Err("malformed peer in the peer store")
+	}
+	peer := dht.Contact{
+		ID:       bits.FromBytesP(id),
+		Port:     int(binary.BigEndian.Uint16(b[8:])),
+		PeerPort: int(binary.BigEndian.Uint16(b[10:])),
+		IP:       net.IP(append([]byte(nil), b[12:]...)),
+	}
+	return peer, time.Unix(0, int64(binary.BigEndian.Uint64(b))), nil
+}
@@ -0,0 +1,160 @@
+package dhtnode
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testStores returns a memory and a bolt store that keep peers for a minute, and a func that moves their clock
+func testStores(t *testing.T) (map[string]Store, func(time.Duration)) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	mem := NewMemStore(time.Minute).(*memStore)
+	mem.now = clock
+	bolt, err := OpenBoltStore(filepath.Join(t.TempDir(), "peers.db"), time.Minute)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = bolt.Close() })
+	bolt.now = clock
+	return map[string]Store{"mem": mem, "bolt": bolt}, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestStore(t *testing.T) {
+	stores, _ := testStores(t)
+	hash := bits.Rand()
+	v4 := dht.Contact{ID: bits.Rand(), IP: net.IPv4(10, 0, 0, 1), Port: 4444, PeerPort: 3333}
+	v6 := dht.Contact{ID: bits.Rand(), IP: net.ParseIP("2001:db8::1"), Port: 4445, PeerPort: 3334}
+	for name, s := range stores {
+		require.NoError(t, s.Add(hash, v4, PeerLimits{}), name)
+		require.NoError(t, s.Add(hash, v6, PeerLimits{}), name)
+		// announcing again replaces the peer
+		v4.PeerPort = 5555
+		require.NoError(t, s.Add(hash, v4, PeerLimits{}), name)
+		v4.PeerPort = 3333
+
+		peers, err := s.Get(hash)
+		require.NoError(t, err, name)
+		require.Len(t, peers, 2, name)
+		for _, p := range peers {
+			switch p.ID {
+			case v4.ID:
+				assert.True(t, p.IP.Equal(v4.IP), name)
+				assert.Equal(t, 4444, p.Port, name)
+				assert.Equal(t, 5555, p.PeerPort, name)
+			case v6.ID:
+				assert.True(t, p.IP.Equal(v6.IP), name)
+				assert.Equal(t, 4445, p.Port, name)
+				assert.Equal(t, 3334, p.PeerPort, name)
+			default:
+				t.Errorf("%s: unexpected peer %s", name, p.ID.HexShort())
+			}
+		}
+		peers, err = s.Get(bits.Rand())
+		require.NoError(t, err, name)
+		assert.Empty(t, peers, name)
+	}
+}
+
+func TestStore_Expire(t *testing.T) {
+	stores, advance := testStores(t)
+	hash := bits.Rand()
+	first := dht.Contact{ID: bits.Rand(), IP: net.IPv4(10, 0, 0, 1), Port: 4444, PeerPort: 3333}
+	second := dht.Contact{ID: bits.Rand(), IP: net.IPv4(10, 0, 0, 2), Port: 4444, PeerPort: 3333}
+	for _, s := range stores {
+		require.NoError(t, s.Add(hash, first, PeerLimits{}))
+		require.NoError(t, s.Add(hash, second, PeerLimits{}))
+	}
+	advance(30 * time.Second)
+	for _, s := range stores {
+		// announcing again pushes back the expiry
+		require.NoError(t, s.Add(hash, second, PeerLimits{}))
+	}
+	advance(30 * time.Second)
+
+	for name, s := range stores {
+		peers, err := s.Get(hash)
+		require.NoError(t, err, name)
+		require.Len(t, peers, 1, "%s: expected an expired peer to be left out before it's removed", name)
+		assert.Equal(t, second.ID, peers[0].ID, name)
+
+		expired, err := s.Expire()
+		require.NoError(t, err, name)
+		assert.Equal(t, 1, expired, name)
+		expired, err = s.Expire()
+		require.NoError(t, err, name)
+		assert.Equal(t, 0, expired, name)
+	}
+
+	advance(30 * time.Second)
+	for name, s := range stores {
+		expired, err := s.Expire()
+		require.NoError(t, err, name)
+		assert.Equal(t, 1, expired, name)
+		peers, err := s.Get(hash)
+		require.NoError(t, err, name)
+		assert.Empty(t, peers, name)
+	}
+}
+
+func TestStore_Limits(t *testing.T) {
+	stores, advance := testStores(t)
+	limits := PeerLimits{PerHash: 3, PerIP: 2}
+	hash := bits.Rand()
+	peer := func(ip net.IP) dht.Contact {
+		return dht.Contact{ID: bits.Rand(), IP: ip, Port: 4444, PeerPort: 3333}
+	}
+	ip1, ip2, ip3 := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)
+	for name, s := range stores {
+		first := peer(ip1)
+		require.NoError(t, s.Add(hash, first, limits), name)
+		require.NoError(t, s.Add(hash, peer(ip1), limits), name)
+		err := s.Add(hash, peer(ip1), limits)
+		assert.True(t, errors.Is(err, ErrTooManyPeers), "%s: expected a third peer at one ip to be refused, got %v", name, err)
+
+		require.NoError(t, s.Add(hash, peer(ip2), limits), name)
+		err = s.Add(hash, peer(ip3), limits)
+		assert.True(t, errors.Is(err, ErrTooManyPeers), "%s: expected a fourth peer of the hash to be refused, got %v", name, err)
+
+		// a stored peer can still announce again, and other hashes have their own limits
+		require.NoError(t, s.Add(hash, first, limits), name)
+		require.NoError(t, s.Add(bits.Rand(), peer(ip1), limits), name)
+
+		peers, err := s.Get(hash)
+		require.NoError(t, err, name)
+		assert.Len(t, peers, 3, name)
+	}
+
+	// expired peers don't count
+	advance(2 * time.Minute)
+	for name, s := range stores {
+		require.NoError(t, s.Add(hash, peer(ip1), limits), name)
+	}
+}
+
+func TestBoltStore_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.db")
+	s, err := OpenBoltStore(path, 0)
+	require.NoError(t, err)
+	hash := bits.Rand()
+	peer := dht.Contact{ID: bits.Rand(), IP: net.IPv4(10, 0, 0, 1), Port: 4444, PeerPort: 3333}
+	require.NoError(t, s.Add(hash, peer, PeerLimits{}))
+	require.NoError(t, s.Close())
+
+	s, err = OpenBoltStore(path, 0)
+	require.NoError(t, err)
+	defer s.Close()
+	peers, err := s.Get(hash)
+	require.NoError(t, err)
+	require.Len(t, peers, 1, "expected the announces to be kept across a restart")
+	assert.Equal(t, peer.ID, peers[0].ID)
+	assert.True(t, peers[0].IP.Equal(peer.IP))
+	assert.Equal(t, peer.PeerPort, peers[0].PeerPort)
+}
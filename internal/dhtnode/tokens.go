@@ -0,0 +1,94 @@
+package dhtnode
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+)
+
+// DefaultTokenRotation is how often the secret of the write tokens is rotated, like in the dht package
+const DefaultTokenRotation = 5 * time.Minute
+
+const secretSize = 32
+
+// tokens makes and checks the write tokens that a node sends with its answer to a value lookup. A store only goes
+// through with a token the node gave to the same node id, ip and port the store comes from, so a node can't store
+// announces for an address it can't get packets on, and has to ask for a new token every rotation. The secret the
+// tokens are made from is rotated every interval, and the tokens of the secret before are still good, so a token is
+// good for one to two intervals
+type tokens struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	secret  []byte
+	prev    []byte
+	rotated time.Time
+	now     func() time.Time
+}
+
+func newTokens(interval time.Duration) *tokens {
+	if interval <= 0 {
+		interval = DefaultTokenRotation
+	}
+	return &tokens{interval: interval, now: time.Now}
+}
+
+// Get returns the token of the node with the id at addr
+func (t *tokens) Get(nodeID bits.Bitmap, addr *net.UDPAddr) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate()
+	return token(t.secret, nodeID, addr)
+}
+
+// Verify returns whether token is the token of the node with the id at addr, of this secret or the one before
+func (t *tokens) Verify(tok string, nodeID bits.Bitmap, addr *net.UDPAddr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate()
+	return hmac.Equal([]byte(tok), []byte(token(t.secret, nodeID, addr))) ||
+		hmac.Equal([]byte(tok), []byte(token(t.prev, nodeID, addr)))
+}
+
+// rotate rotates the secret if it's due. Both secrets are new if the secret is two intervals old, so tokens never
+// outlive two intervals. The lock must be held
+func (t *tokens) rotate() {
+	now := t.now()
+	age := now.Sub(t.rotated)
+	if t.secret != nil && age < t.interval {
+		return
+	}
+	if t.secret == nil || age >= 2*t.interval {
+		t.prev = newSecret()
+	} else {
+		t.prev = t.secret
+	}
+	t.secret = newSecret()
+	t.rotated = now
+}
+
+func newSecret() []byte {
+	secret := make([]byte, secretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// token returns the hmac of the node id, ip and port with the secret
+func token(secret []byte, nodeID bits.Bitmap, addr *net.UDPAddr) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nodeID[:])
+	mac.Write(normalizeIP(addr.IP))
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], uint16(addr.Port))
+	mac.Write(port[:])
+	return string(mac.Sum(nil))
+}
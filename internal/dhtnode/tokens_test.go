@@ -0,0 +1,39 @@
+package dhtnode
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokens(t *testing.T) {
+	tk := newTokens(time.Minute)
+	now := time.Now()
+	tk.now = func() time.Time { return now }
+	id := bits.Rand()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4444}
+
+	token := tk.Get(id, addr)
+	assert.True(t, tk.Verify(token, id, addr))
+	assert.True(t, tk.Verify(token, id, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 4444}),
+		"expected the 4 and 16 byte forms of an ipv4 address to get the same token")
+	assert.False(t, tk.Verify(token, bits.Rand(), addr), "another node id")
+	assert.False(t, tk.Verify(token, id, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 4444}), "another ip")
+	assert.False(t, tk.Verify(token, id, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4445}), "another port")
+	assert.False(t, tk.Verify("", id, addr))
+
+	now = now.Add(time.Minute)
+	assert.True(t, tk.Verify(token, id, addr), "expected the token of the secret before to be good")
+	assert.NotEqual(t, token, tk.Get(id, addr), "expected a new token after a rotation")
+	now = now.Add(time.Minute)
+	assert.False(t, tk.Verify(token, id, addr), "expected the token to be stale after two rotations")
+
+	// a token of a node that went quiet for two rotations is stale even though the secret wasn't rotated in between
+	token = tk.Get(id, addr)
+	now = now.Add(2 * time.Minute)
+	assert.False(t, tk.Verify(token, id, addr))
+}
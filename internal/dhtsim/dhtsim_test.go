@@ -0,0 +1,147 @@
+package dhtsim
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomHash(rnd *rand.Rand) bits.Bitmap {
+	b := make([]byte, bits.NumBytes)
+	_, _ = rnd.Read(b)
+	return bits.FromBytesP(b)
+}
+
+func ids(contacts []dht.Contact) []string {
+	var s []string
+	for _, c := range contacts {
+		s = append(s, c.ID.HexShort())
+	}
+	return s
+}
+
+func TestNetworkIsDeterministic(t *testing.T) {
+	fates := func() []bool {
+		n := NewNetwork(42)
+		n.Loss = 0.5
+		// packets are delivered while they're sent, so a slow read doesn't look like a loss
+		n.Latency = 0
+		a, err := n.Listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1})
+		require.NoError(t, err)
+		b, err := n.Listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1})
+		require.NoError(t, err)
+		defer a.Close()
+		defer b.Close()
+
+		var got []bool
+		buf := make([]byte, 10)
+		for i := 0; i < 100; i++ {
+			_, err = a.WriteToUDP([]byte("ping"), b.addr)
+			require.NoError(t, err)
+			require.NoError(t, b.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+			_, _, err = b.ReadFromUDP(buf)
+			got = append(got, err == nil)
+		}
+		sent, dropped := n.Stats()
+		assert.EqualValues(t, 100, sent)
+		assert.InDelta(t, 50, dropped, 15)
+		return got
+	}
+	assert.Equal(t, fates(), fates())
+}
+
+func TestLookup(t *testing.T) {
+	s, err := New(NewNetwork(1), 50)
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		target := randomHash(rnd)
+		contacts, err := s.Lookup(i, target)
+		require.NoError(t, err)
+		// a node doesn't find itself
+		var closest []dht.Contact
+		for _, c := range s.Closest(target, k+1) {
+			if c.ID != s.Contacts[i].ID {
+				closest = append(closest, c)
+			}
+		}
+		assert.Equal(t, ids(closest[:k]), ids(contacts), "lookup %d", i)
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	s, err := New(NewNetwork(2), 30)
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	hash := randomHash(rand.New(rand.NewSource(2)))
+	_, err = s.Announce(3, hash, 5567)
+	require.NoError(t, err)
+
+	peers, err := s.FindPeers(20, hash)
+	require.NoError(t, err)
+	require.Len(t, peers, 1)
+	assert.Equal(t, s.Contacts[3].ID, peers[0].ID)
+	assert.Equal(t, 5567, peers[0].PeerPort)
+
+	peers, err = s.FindPeers(20, randomHash(rand.New(rand.NewSource(3))))
+	require.NoError(t, err)
+	assert.Empty(t, peers)
+}
+
+func TestAnnounceWithChurn(t *testing.T) {
+	s, err := New(NewNetwork(3), 30)
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	hash := randomHash(rand.New(rand.NewSource(3)))
+	stored, err := s.Announce(0, hash, 5567)
+	require.NoError(t, err)
+	// all but one of the nodes that have the announce leave
+	for _, c := range stored[1:] {
+		if i := s.index(c); i != 0 {
+			s.Stop(i)
+		}
+	}
+
+	from := 1
+	for s.stopped[from] {
+		from++
+	}
+	peers, err := s.FindPeers(from, hash)
+	require.NoError(t, err)
+	require.Len(t, peers, 1)
+	assert.Equal(t, s.Contacts[0].ID, peers[0].ID)
+}
+
+func TestLossyNetwork(t *testing.T) {
+	if testing.Short() {
+		t.Skip("lost packets are retried after the udp timeout of the dht")
+	}
+	n := NewNetwork(4)
+	n.Latency = 5 * time.Millisecond
+	n.Jitter = 20 * time.Millisecond
+	s, err := New(n, 20)
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	n.Loss = 0.1
+	target := randomHash(rand.New(rand.NewSource(4)))
+	contacts, err := s.Lookup(5, target)
+	require.NoError(t, err)
+	require.NotEmpty(t, contacts)
+	// lost packets can hide a node from the lookup, but never make it return a far node as the closest
+	assert.Equal(t, s.Closest(target, 1)[0].ID, contacts[0].ID)
+	sent, dropped := n.Stats()
+	assert.NotZero(t, dropped)
+	assert.Less(t, dropped, sent)
+}
@@ -0,0 +1,120 @@
+//go:build go1.18
+// +build go1.18
+
+package dhtsim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/fuzzing"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+)
+
+// knownCrash returns true for the packets the dht package is known to crash on. They can only be fixed upstream, so
+// the fuzzer skips them to look for other problems
+func knownCrash(packet []byte) (crashes bool) {
+	// the message type is read from the sixth byte without checking the length first
+	if len(packet) < 6 {
+		return true
+	}
+	// error messages without args make decoding them dereference a nil type
+	if packet[5] == '2' {
+		defer func() {
+			if recover() != nil {
+				crashes = true
+			}
+		}()
+		var e dht.Error
+		_ = e.UnmarshalBencode(packet)
+	}
+	return false
+}
+
+// pingMessageID returns the bytes of a ping with the message id n, and the message id as it's encoded in the pong
+func pingMessageID(ping []byte, n uint64) ([]byte, []byte) {
+	id := make([]byte, 20)
+	copy(id, "fuzzping")
+	binary.BigEndian.PutUint64(id[12:], n)
+	encoded := append([]byte("1:120:"), id...)
+	return bytes.Replace(ping, append([]byte("1:120:"), make([]byte, 20)...), encoded, 1), encoded
+}
+
+// FuzzNodePacket sends a udp packet to a dht node, and then pings it to make sure it handled the packet
+func FuzzNodePacket(f *testing.F) {
+	f.Cleanup(fuzzing.QuietLogs())
+
+	// the packets are delivered while they're sent, so the node gets the fuzz packet and the ping in order
+	network := NewNetwork(1)
+	s, err := New(network, 2)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(s.Shutdown)
+	from, err := network.Listen(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: dhtPort})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(func() { _ = from.Close() })
+
+	id := bits.FromShortHexP("f")
+	target := s.Contacts[1].ID
+	for _, m := range []dht.Message{
+		dht.Request{NodeID: id, Method: pingMethod},
+		dht.Request{NodeID: id, Method: "findNode", Arg: &target},
+		dht.Request{NodeID: id, Method: "findValue", Arg: &target},
+		dht.Response{NodeID: id, Data: "pong"},
+		dht.Response{NodeID: id, Contacts: []dht.Contact{s.Contacts[1]}},
+		dht.Error{NodeID: id, ExceptionType: "invalid-token"},
+	} {
+		packet, err := m.MarshalBencode()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(packet)
+	}
+	f.Add([]byte("d1:0i0e1:1"))
+
+	ping, err := dht.Request{NodeID: id, Method: pingMethod}.MarshalBencode()
+	if err != nil {
+		f.Fatal(err)
+	}
+	pings := uint64(0)
+	buf := make([]byte, 4096)
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		if knownCrash(packet) {
+			return
+		}
+		_, err := from.WriteToUDP(packet, s.Contacts[0].Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the node handles packets in order, so it's done with the fuzz packet once it answers the ping
+		pings++
+		ping, pong := pingMessageID(ping, pings)
+		_, err = from.WriteToUDP(ping, s.Contacts[0].Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = from.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			n, _, err := from.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatal("the node stopped answering pings")
+			}
+			if bytes.Contains(buf[:n], pong) {
+				return
+			}
+		}
+	})
+}
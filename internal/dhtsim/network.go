@@ -0,0 +1,272 @@
+package dhtsim
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"go.uber.org/atomic"
+)
+
+// inboxSize is how many packets can wait to be read by a node. More are dropped, like a full socket buffer would
+const inboxSize = 1024
+
+// ErrClosed is returned by reads and writes on a closed connection, and by writes to an address nothing listens on. The
+// dht package doesn't log write errors with this text, which only come from connections on the same host
+var ErrClosed = errors.Base("use of closed network connection")
+
+// Network is a virtual udp network. Packets between its connections are lost and delayed the way it's configured. The
+// fate of a packet only depends on the seed, the two addresses, and how many packets went between them before, so a
+// test sees the same losses and delays in each run
+type Network struct {
+	// Loss is the share of packets that are lost, from 0 to 1
+	Loss float64
+	// Latency is how long packets take to arrive, a millisecond by default. The dht package drops responses that come
+	// back before it's done sending the request, so without latency a request times out once in a while
+	Latency time.Duration
+	// Jitter is a random extra delay for each packet, up to this
+	Jitter time.Duration
+
+	seed    int64
+	mu      sync.Mutex
+	conns   map[string]*Conn
+	links   map[[2]string]uint64
+	sent    *atomic.Int64
+	dropped *atomic.Int64
+	// unread is how many packets are on their way or waiting to be read, and lastMoved is when a packet was last sent
+	// or read, in unix nanoseconds
+	unread    *atomic.Int64
+	lastMoved *atomic.Int64
+}
+
+// NewNetwork returns an empty network
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		Latency:   time.Millisecond,
+		seed:      seed,
+		conns:     make(map[string]*Conn),
+		links:     make(map[[2]string]uint64),
+		sent:      atomic.NewInt64(0),
+		dropped:   atomic.NewInt64(0),
+		unread:    atomic.NewInt64(0),
+		lastMoved: atomic.NewInt64(0),
+	}
+}
+
+// Listen returns a connection that gets the packets sent to addr
+func (n *Network) Listen(addr *net.UDPAddr) (*Conn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.conns[addr.String()]; ok {
+		return nil, errors.Err("%s is already in use", addr)
+	}
+	c := &Conn{net: n, addr: addr, inbox: make(chan packet, inboxSize), closed: make(chan struct{})}
+	n.conns[addr.String()] = c
+	return c, nil
+}
+
+// Stats returns how many packets were sent over the network, and how many of them were lost
+func (n *Network) Stats() (sent, dropped int64) {
+	return n.sent.Load(), n.dropped.Load()
+}
+
+// Settle waits until every packet was read and no packet was sent or read for quiet, which is time enough for the
+// nodes to handle the last packets they read. A node that handles a request while it's used for a lookup is a data
+// race in the dht package, and changes its routing table while the lookup reads it
+func (n *Network) Settle(quiet time.Duration) {
+	for {
+		idle := time.Duration(time.Now().UnixNano() - n.lastMoved.Load())
+		if n.unread.Load() == 0 && idle >= quiet {
+			return
+		}
+		if idle < quiet {
+			time.Sleep(quiet - idle)
+		} else {
+			time.Sleep(quiet / 10)
+		}
+	}
+}
+
+// traffic returns how many packets were sent between addresses other than except
+func (n *Network) traffic(except string) uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var sum uint64
+	for link, count := range n.links {
+		if link[0] != except && link[1] != except {
+			sum += count
+		}
+	}
+	return sum
+}
+
+func (n *Network) moved() {
+	n.lastMoved.Store(time.Now().UnixNano())
+}
+
+// roll returns two numbers from 0 to 1 for the next packet from one address to another
+func (n *Network) roll(from, to string) (float64, float64) {
+	n.mu.Lock()
+	link := [2]string{from, to}
+	seq := n.links[link]
+	n.links[link]++
+	n.mu.Unlock()
+
+	h := fnv.New64a()
+	_ = binary.Write(h, binary.BigEndian, n.seed)
+	_, _ = h.Write([]byte(from + ">" + to))
+	_ = binary.Write(h, binary.BigEndian, seq)
+	// fnv barely changes when only the last bytes do, so the bits are mixed like splitmix64 does
+	sum := h.Sum64()
+	sum = (sum ^ (sum >> 30)) * 0xbf58476d1ce4e5b9
+	sum = (sum ^ (sum >> 27)) * 0x94d049bb133111eb
+	sum ^= sum >> 31
+	return float64(sum>>32) / (1 << 32), float64(sum&0xffffffff) / (1 << 32)
+}
+
+func (n *Network) send(from *net.UDPAddr, to *net.UDPAddr, data []byte) error {
+	n.sent.Inc()
+	n.moved()
+	loss, jitter := n.roll(from.String(), to.String())
+	if loss < n.Loss {
+		n.dropped.Inc()
+		return nil
+	}
+	n.mu.Lock()
+	dst, ok := n.conns[to.String()]
+	n.mu.Unlock()
+	if !ok {
+		// like a port that's closed on the same host, so a request to a stopped node fails now instead of after the
+		// udp timeout of the dht
+		n.dropped.Inc()
+		return errors.Err(ErrClosed)
+	}
+
+	p := packet{data: data, from: from}
+	n.unread.Inc()
+	delay := n.Latency + time.Duration(jitter*float64(n.Jitter))
+	if delay <= 0 {
+		dst.deliver(p)
+		return nil
+	}
+	time.AfterFunc(delay, func() { dst.deliver(p) })
+	return nil
+}
+
+func (n *Network) remove(c *Conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conns[c.addr.String()] == c {
+		delete(n.conns, c.addr.String())
+	}
+}
+
+type packet struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// Conn is a connection to a Network. It's a dht.UDPConn
+type Conn struct {
+	net    *Network
+	addr   *net.UDPAddr
+	inbox  chan packet
+	closed chan struct{}
+	once   sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *Conn) deliver(p packet) {
+	// the lock keeps packets out of the inbox once Close emptied it
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		c.net.dropped.Inc()
+		c.net.unread.Dec()
+	case c.inbox <- p:
+	default:
+		c.net.dropped.Inc()
+		c.net.unread.Dec()
+	}
+}
+
+// ReadFromUDP waits for a packet
+func (c *Conn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-c.closed:
+		return 0, nil, errors.Err(ErrClosed)
+	case <-timeout:
+		return 0, nil, errors.Err("read timeout")
+	case p := <-c.inbox:
+		c.net.unread.Dec()
+		c.net.moved()
+		// the dht package drops a response that's handled before the request that it answers waits for it. Yielding
+		// here gives the request a chance to get there when the cpu is busy
+		runtime.Gosched()
+		return copy(b, p.data), p.from, nil
+	}
+}
+
+// WriteToUDP sends a packet to addr
+func (c *Conn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errors.Err(ErrClosed)
+	default:
+	}
+	data := make([]byte, len(b))
+	copy(data, b)
+	err := c.net.send(c.addr, addr, data)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// SetReadDeadline makes reads fail after t. The zero time means no deadline
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes never block
+func (c *Conn) SetWriteDeadline(time.Time) error { return nil }
+
+// Close takes the connection off the network. Packets sent to it fail with ErrClosed
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		c.mu.Lock()
+		close(c.closed)
+		c.mu.Unlock()
+		c.net.remove(c)
+		for {
+			select {
+			case <-c.inbox:
+				c.net.unread.Dec()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,318 @@
+// Package dhtsim runs many dht nodes in one process over a virtual udp network, so lookups and announces can be tested
+// without real sockets, and with the same packet losses and delays in each run. The routing table of the dht package
+// refreshes contacts without a write lock, so the simulation waits for the nodes to handle every packet after a lookup,
+// before another one reads the routing tables
+package dhtsim
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+// dhtPort is the port of every node. The nodes are told apart by their ips
+const dhtPort = 4444
+
+// k is how many nodes are closest to a hash, and get its announces
+const k = 8
+
+// settleTime is how long the network has to be quiet before it's settled, which is time enough for the nodes to handle
+// the packets they read
+const settleTime = 5 * time.Millisecond
+
+// maxSettle is how long the nodes get to answer the pings of the probe. Nodes that are stopped aren't pinged, so only a
+// network that loses nearly every packet takes that long
+const maxSettle = 30 * time.Second
+
+// probeAddr is where the simulation pings the nodes from, to know they handled the packets before the ping
+var probeAddr = &net.UDPAddr{IP: net.IPv4(172, 16, 0, 1), Port: dhtPort}
+
+// Sim is a dht of nodes on a virtual network
+type Sim struct {
+	Net   *Network
+	Nodes []*dht.Node
+	// Contacts are the contacts of the nodes, in the same order
+	Contacts []dht.Contact
+
+	stopped []bool
+	probe   *Conn
+	// answers are the addresses of the packets the probe read
+	answers chan string
+	grp     *stop.Group
+}
+
+// New starts a simulation of n nodes on network. The first k+1 nodes know each other, and the others join one by one by
+// looking themselves up through the first node, like real nodes do through a bootstrap node. Node ids are picked from
+// the seed of the network
+func New(network *Network, n int) (*Sim, error) {
+	if n < 1 {
+		return nil, errors.Err("a simulation needs at least one node")
+	}
+	probe, err := network.Listen(probeAddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Sim{Net: network, probe: probe, answers: make(chan string, 1024), grp: stop.New()}
+	go s.listen()
+	rnd := rand.New(rand.NewSource(network.seed))
+	for i := 0; i < n; i++ {
+		id := make([]byte, bits.NumBytes)
+		_, _ = rnd.Read(id)
+		err := s.join(bits.FromBytesP(id), i)
+		if err != nil {
+			s.Shutdown()
+			return nil, err
+		}
+	}
+	// the nodes that joined early only know the nodes that joined after them if they were found by them, so every node
+	// looks itself up again once all of them joined, like nodes refresh their routing tables
+	for i := k + 1; i < n; i++ {
+		err := s.refresh(i)
+		if err != nil {
+			s.Shutdown()
+			return nil, err
+		}
+	}
+	s.settle()
+	return s, nil
+}
+
+// nodeIP returns the ip of the ith node
+func nodeIP(i int) net.IP {
+	return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).To4()
+}
+
+func (s *Sim) join(id bits.Bitmap, i int) error {
+	c := dht.Contact{ID: id, IP: nodeIP(i), Port: dhtPort}
+	conn, err := s.Net.Listen(c.Addr())
+	if err != nil {
+		return err
+	}
+	node := dht.NewNode(id)
+	err = node.Connect(conn)
+	if err != nil {
+		return errors.Err(err)
+	}
+	s.Nodes = append(s.Nodes, node)
+	s.Contacts = append(s.Contacts, c)
+	s.stopped = append(s.stopped, false)
+	if i <= k {
+		// lookups wait for k nodes to answer, or time out, so the first nodes just get to know each other
+		for j := 0; j < i; j++ {
+			s.ping(i, s.Contacts[j])
+			s.ping(j, c)
+		}
+		s.Net.Settle(settleTime)
+		return nil
+	}
+
+	node.AddKnownNode(s.Contacts[0])
+	// nodes only go in routing tables once they answer a request. The bootstrap node pings new nodes
+	s.ping(0, c)
+	return s.refresh(i)
+}
+
+// refresh has the ith node look itself up, and the nodes it found ping it like the rest of the network does when it
+// gets a request from a node it doesn't know, so the node and the nodes closest to it know each other
+func (s *Sim) refresh(i int) error {
+	c := s.Contacts[i]
+	s.settle()
+	found, _, err := dht.FindContacts(s.Nodes[i], c.ID, false, s.grp)
+	s.Net.Settle(settleTime)
+	if err != nil {
+		return errors.Prefix("looking up node "+c.ID.HexShort(), err)
+	}
+	for _, f := range found {
+		if j := s.index(f); j >= 0 && j != i && !s.stopped[j] {
+			s.ping(j, c)
+		}
+	}
+	s.Net.Settle(settleTime)
+	return nil
+}
+
+// pingMethod is the dht method of pings, which the dht package doesn't export
+const pingMethod = "ping"
+
+// ping sends a ping from the ith node to c, over the network
+func (s *Sim) ping(from int, c dht.Contact) {
+	s.Nodes[from].Send(c, dht.Request{Method: pingMethod})
+}
+
+// settle waits until the nodes handled every packet. It waits for the network to settle, and pings the running nodes
+// until they all answered: a node answers the ping after it handled the packets it read before, so their changes to its
+// routing table happen before the next lookup, as far as the race detector is concerned. Nodes refresh unknown contacts
+// without changing their routing table, so handling the ping itself changes nothing. Handling a packet can make a node
+// send another one, so this goes on until no node sent a packet to another one while they were pinged
+func (s *Sim) settle() {
+	for {
+		s.Net.Settle(settleTime)
+		before := s.Net.traffic(probeAddr.String())
+		s.pingAll()
+		s.Net.Settle(settleTime)
+		if s.Net.traffic(probeAddr.String()) == before {
+			return
+		}
+	}
+}
+
+// pingAll pings the running nodes from the probe until they all answered, or until maxSettle went by
+func (s *Sim) pingAll() {
+	ping, err := dht.Request{Method: pingMethod}.MarshalBencode()
+	if err != nil {
+		panic(err)
+	}
+	waiting := make(map[string]*net.UDPAddr)
+	for i, c := range s.Contacts {
+		if !s.stopped[i] {
+			waiting[c.Addr().String()] = c.Addr()
+		}
+	}
+	// answers to earlier pings don't count
+	for len(s.answers) > 0 {
+		<-s.answers
+	}
+	// pings and answers can be lost, and a busy node takes a while to answer, so the pings are sent again to the nodes
+	// that didn't answer, waiting twice as long each time
+	wait := 2*(s.Net.Latency+s.Net.Jitter) + settleTime
+	for deadline := time.Now().Add(maxSettle); len(waiting) > 0 && time.Now().Before(deadline); wait *= 2 {
+		for _, addr := range waiting {
+			_, _ = s.probe.WriteToUDP(ping, addr)
+		}
+		timeout := time.After(wait)
+	answers:
+		for len(waiting) > 0 {
+			select {
+			case addr := <-s.answers:
+				delete(waiting, addr)
+			case <-timeout:
+				break answers
+			}
+		}
+	}
+}
+
+// listen reads the packets sent to the probe until it's closed. Answers can come after pingAll stopped waiting for
+// them, and a packet left unread would keep the network from settling
+func (s *Sim) listen() {
+	buf := make([]byte, 1024)
+	for {
+		_, from, err := s.probe.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case s.answers <- from.String():
+		default:
+		}
+	}
+}
+
+// Lookup looks up the nodes closest to target, starting from the ith node. It returns once the network is idle, with
+// the requests the lookup didn't wait for answered and handled
+func (s *Sim) Lookup(from int, target bits.Bitmap) ([]dht.Contact, error) {
+	contacts, _, err := dht.FindContacts(s.Nodes[from], target, false, s.grp)
+	s.settle()
+	return contacts, err
+}
+
+// Closest returns the n running nodes that are closest to target, worked out from all of them instead of by a lookup
+func (s *Sim) Closest(target bits.Bitmap, n int) []dht.Contact {
+	var contacts []dht.Contact
+	for i, c := range s.Contacts {
+		if !s.stopped[i] {
+			contacts = append(contacts, c)
+		}
+	}
+	sort.Slice(contacts, func(i, j int) bool { return target.Closer(contacts[i].ID, contacts[j].ID) })
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+// Announce announces that the ith node has the blob with hash on peerPort. It looks up the nodes closest to the hash
+// over the network and stores the announce in them. The store itself doesn't go over the network, since the dht package
+// doesn't export the arguments of store requests
+func (s *Sim) Announce(from int, hash bits.Bitmap, peerPort int) ([]dht.Contact, error) {
+	contacts, err := s.Lookup(from, hash)
+	if err != nil {
+		return nil, err
+	}
+	self := s.Contacts[from]
+	self.PeerPort = peerPort
+	// like a real announce, the node keeps the announce too if it's as close as the nodes that got it
+	if len(contacts) < k || hash.Closer(self.ID, contacts[len(contacts)-1].ID) {
+		s.Nodes[from].Store(hash, self)
+	}
+	for _, c := range contacts {
+		i := s.index(c)
+		if i >= 0 && !s.stopped[i] {
+			s.Nodes[i].Store(hash, self)
+		}
+	}
+	return contacts, nil
+}
+
+// findValueMethod is the dht method that asks a node for the peers of a hash, which the dht package doesn't export
+const findValueMethod = "findValue"
+
+// FindPeers looks up the peers that announced hash, starting from the ith node. It looks up the nodes closest to the
+// hash, and asks each of them for the peers over the network. A value lookup of the dht package would stop at the first
+// node that has peers, but it reads the peers it found without a lock
+func (s *Sim) FindPeers(from int, hash bits.Bitmap) ([]dht.Contact, error) {
+	contacts, err := s.Lookup(from, hash)
+	if err != nil {
+		return nil, err
+	}
+	var peers []dht.Contact
+	seen := make(map[bits.Bitmap]bool)
+	for _, c := range contacts {
+		res := s.Nodes[from].Send(c, dht.Request{Method: findValueMethod, Arg: &hash})
+		if res == nil || res.FindValueKey == "" {
+			continue
+		}
+		for _, p := range res.Contacts {
+			if !seen[p.ID] {
+				seen[p.ID] = true
+				peers = append(peers, p)
+			}
+		}
+	}
+	s.settle()
+	return peers, nil
+}
+
+// Stop shuts down the ith node, like it left the network. Packets sent to it fail like they would to a closed port
+func (s *Sim) Stop(i int) {
+	if s.stopped[i] {
+		return
+	}
+	s.stopped[i] = true
+	s.Nodes[i].Shutdown()
+}
+
+// Shutdown stops the lookups in progress and all the nodes
+func (s *Sim) Shutdown() {
+	s.grp.StopAndWait()
+	for i := range s.Nodes {
+		s.Stop(i)
+	}
+	s.probe.Close()
+}
+
+// index returns the index of the node of c, or -1 if it's not in the simulation
+func (s *Sim) index(c dht.Contact) int {
+	for i, sc := range s.Contacts {
+		if sc.ID == c.ID {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,101 @@
+// Package fuzzing has the harness the fuzz targets share to feed untrusted input into the servers. Targets run with
+// go test's -fuzz flag, like "go test -run XXX -fuzz FuzzReflectorConn ./reflector". Inputs that fail are saved in the
+// package's testdata/fuzz dir, and are checked by every go test run from then on
+package fuzzing
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrClosed is returned by reads and writes on a closed Conn
+var ErrClosed = errors.Base("use of closed network connection")
+
+// Conn is a net.Conn that reads the fuzz input and keeps what's written to it. The input is read one message at a
+// time, like from a client that waits for the answer to each message before sending the next. That matters to servers
+// that decode each message with a fresh decoder, which would read ahead into the next messages otherwise. Deadlines are
+// ignored, since reads never block
+type Conn struct {
+	mu       sync.Mutex
+	messages [][]byte
+	written  bytes.Buffer
+	closed   bool
+}
+
+// NewConn returns a connection that reads the messages, and then io.EOF
+func NewConn(messages ...[]byte) *Conn {
+	return &Conn{messages: messages}
+}
+
+// Read reads from the current message
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, errors.Err(ErrClosed)
+	}
+	for len(c.messages) > 0 && len(c.messages[0]) == 0 {
+		c.messages = c.messages[1:]
+	}
+	if len(c.messages) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.messages[0])
+	c.messages[0] = c.messages[0][n:]
+	return n, nil
+}
+
+// Write keeps b, for the target to check
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, errors.Err(ErrClosed)
+	}
+	return c.written.Write(b)
+}
+
+// Written returns everything written to the connection
+func (c *Conn) Written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.written.Bytes()...)
+}
+
+// Close closes the connection. It's safe to call more than once
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// LocalAddr is where the server listens
+func (c *Conn) LocalAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5567} }
+
+// RemoteAddr is where the fuzz input comes from
+func (c *Conn) RemoteAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000} }
+
+// SetDeadline does nothing
+func (c *Conn) SetDeadline(time.Time) error { return nil }
+
+// SetReadDeadline does nothing
+func (c *Conn) SetReadDeadline(time.Time) error { return nil }
+
+// SetWriteDeadline does nothing
+func (c *Conn) SetWriteDeadline(time.Time) error { return nil }
+
+// QuietLogs turns off logging below fatal until the returned function is called. Servers log every bad message, which
+// slows fuzzing down and buries its output
+func QuietLogs() func() {
+	level := log.GetLevel()
+	log.SetLevel(log.FatalLevel)
+	return func() { log.SetLevel(level) }
+}
@@ -0,0 +1,73 @@
+package geo
+
+import (
+	"strings"
+
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// unknownCountry is the country label of clients that are not in the database, like private networks
+const unknownCountry = "unknown"
+
+// Count adds a blob request served to the client at remoteAddr, and the bytes sent for it, to the metrics of the
+// client's country
+func (d *Database) Count(protocol, remoteAddr string, bytes int) {
+	country := d.Country(auth.Request{RemoteAddr: remoteAddr}.IP())
+	if country == "" {
+		country = unknownCountry
+	}
+	metrics.CountryRequestCount.WithLabelValues(protocol, country).Inc()
+	metrics.CountryOutBytes.WithLabelValues(protocol, country).Add(float64(bytes))
+}
+
+// CountryRules is an authorizer that serves blobs only to clients in the allowed countries, or to clients outside the
+// blocked countries, for content that may only be served in some places
+type CountryRules struct {
+	// BlockUnknown blocks clients whose country is not known. They are allowed by default, so cluster members and
+	// clients on private networks are not locked out
+	BlockUnknown bool
+
+	db    *Database
+	allow map[string]bool
+	block map[string]bool
+}
+
+// NewCountryRules returns rules for the lists of two letter country codes. If allow is not empty, only its countries
+// are served
+func NewCountryRules(db *Database, allow, block []string) *CountryRules {
+	set := func(countries []string) map[string]bool {
+		m := make(map[string]bool, len(countries))
+		for _, c := range countries {
+			if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+				m[c] = true
+			}
+		}
+		return m
+	}
+	return &CountryRules{db: db, allow: set(allow), block: set(block)}
+}
+
+func (c *CountryRules) Authorize(r auth.Request) error {
+	country := c.db.Country(r.IP())
+	var blocked bool
+	switch {
+	case country == "":
+		blocked = c.BlockUnknown
+	case len(c.allow) > 0:
+		blocked = !c.allow[country]
+	default:
+		blocked = c.block[country]
+	}
+	if !blocked {
+		return nil
+	}
+	if country == "" {
+		metrics.CountryBlockedCount.WithLabelValues(r.Protocol, unknownCountry).Inc()
+		return errors.Prefix("the country of "+r.RemoteAddr+" is not known", auth.ErrForbidden)
+	}
+	metrics.CountryBlockedCount.WithLabelValues(r.Protocol, country).Inc()
+	return errors.Prefix(r.RemoteAddr+" is in "+country+", where blobs are not served", auth.ErrForbidden)
+}
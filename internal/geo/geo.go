@@ -0,0 +1,149 @@
+// Package geo finds where clients are. A Locator finds the region a client is in, so its requests can be sent to the
+// nearest cluster members. There are two sources, tried in order: a header with the client's country, which CDNs and
+// load balancers add (like CloudFront-Viewer-Country or CF-IPCountry), mapped to regions, and a list of networks and
+// their regions, which can be made from the csv files of a GeoIP database. A Database finds the country of a client in
+// a MaxMind database, to count traffic by country and to serve blobs only in some countries.
+package geo
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Locator finds the region of clients
+type Locator struct {
+	// CountryHeader is the request header with the client's two letter country code
+	CountryHeader string
+	// Countries maps country codes, in upper case, to regions
+	Countries map[string]string
+
+	networks []network
+}
+
+type network struct {
+	first, last net.IP // 16 bytes each
+	region      string
+	// parent is the index of the smallest network that contains this one, or -1
+	parent int
+}
+
+// ParseCountries parses a comma separated list of COUNTRY=REGION, like "US=us,CA=us,DE=eu"
+func ParseCountries(spec string) (map[string]string, error) {
+	countries := make(map[string]string)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, errors.Err("country regions look like COUNTRY=REGION, not '%s'", part)
+		}
+		countries[strings.ToUpper(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	}
+	return countries, nil
+}
+
+// LoadNetworks reads the networks of the regions from a file with a NETWORK,REGION line for each network, like
+// "203.0.113.0/24,ap". Lines that start with # are skipped
+func (l *Locator) LoadNetworks(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer f.Close()
+	return l.ReadNetworks(f)
+}
+
+// ReadNetworks reads networks like LoadNetworks, from r
+func (l *Locator) ReadNetworks(r io.Reader) error {
+	var networks []network
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, ",", 2)
+		if len(fields) != 2 {
+			return errors.Err("line %d: expected NETWORK,REGION", line)
+		}
+		cidr, region := fields[0], fields[1]
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return errors.Err("line %d: %s", line, err.Error())
+		}
+		first := ipnet.IP.To16()
+		last := make(net.IP, len(first))
+		mask := ipnet.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range first {
+			last[i] = first[i] | ^mask[i]
+		}
+		networks = append(networks, network{first: first, last: last, region: strings.TrimSpace(region)})
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Err(err)
+	}
+	// the most specific network wins where they overlap, so it sorts after the networks it is in
+	sort.SliceStable(networks, func(i, j int) bool {
+		if c := bytes.Compare(networks[i].first, networks[j].first); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(networks[i].last, networks[j].last) > 0
+	})
+	// networks either contain one another or don't overlap, so the ones containing a network are on a stack
+	var stack []int
+	for i := range networks {
+		for len(stack) > 0 && bytes.Compare(networks[i].first, networks[stack[len(stack)-1]].last) > 0 {
+			stack = stack[:len(stack)-1]
+		}
+		networks[i].parent = -1
+		if len(stack) > 0 {
+			networks[i].parent = stack[len(stack)-1]
+		}
+		stack = append(stack, i)
+	}
+	l.networks = networks
+	return nil
+}
+
+// Locate returns the region of the client that made the request, or "" if it's not known
+func (l *Locator) Locate(r *http.Request) string {
+	if l.CountryHeader != "" {
+		if region, ok := l.Countries[strings.ToUpper(r.Header.Get(l.CountryHeader))]; ok {
+			return region
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return l.lookup(net.ParseIP(host))
+}
+
+func (l *Locator) lookup(ip net.IP) string {
+	ip = ip.To16()
+	if ip == nil {
+		return ""
+	}
+	// the last network that starts at or before ip. if it doesn't contain ip, one of the networks containing it may
+	i := sort.Search(len(l.networks), func(i int) bool { return bytes.Compare(l.networks[i].first, ip) > 0 }) - 1
+	for i >= 0 && bytes.Compare(ip, l.networks[i].last) > 0 {
+		i = l.networks[i].parent
+	}
+	if i < 0 {
+		return ""
+	}
+	return l.networks[i].region
+}
@@ -0,0 +1,54 @@
+package geo
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocator_Locate(t *testing.T) {
+	l := &Locator{CountryHeader: "CF-IPCountry"}
+	err := l.ReadNetworks(strings.NewReader(`
+# network,region
+10.0.0.0/8,us
+10.1.0.0/16,eu
+10.1.2.0/24,ap
+2001:db8::/32,eu
+`))
+	require.NoError(t, err)
+	l.Countries, err = ParseCountries("us=us, DE=eu")
+	require.NoError(t, err)
+
+	for addr, region := range map[string]string{
+		"10.0.0.1:1234":     "us",
+		"10.1.0.1:1234":     "eu",
+		"10.1.2.3:1234":     "ap",
+		"10.1.3.3:1234":     "eu",
+		"10.2.0.1:1234":     "us",
+		"11.0.0.1:1234":     "",
+		"9.255.255.255:1":   "",
+		"[2001:db8::1]:443": "eu",
+		"[2001:db9::1]:443": "",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		assert.Equal(t, region, l.Locate(r), addr)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("CF-IPCountry", "de")
+	assert.Equal(t, "eu", l.Locate(r))
+	r.Header.Set("CF-IPCountry", "FR")
+	assert.Equal(t, "us", l.Locate(r), "countries without a region fall back to the networks")
+}
+
+func TestParseCountries(t *testing.T) {
+	_, err := ParseCountries("US")
+	assert.Error(t, err)
+	_, err = ParseCountries("US=")
+	assert.Error(t, err)
+}
@@ -0,0 +1,350 @@
+package geo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Database looks up the country of ips in a MaxMind database, like GeoLite2-Country.mmdb or GeoIP2-City.mmdb. Only
+// what's needed to find the country is read, so no MaxMind library is needed.
+// See https://maxmind.github.io/MaxMind-DB/ for the format
+type Database struct {
+	tree       []byte
+	data       decoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// the node ipv4 addresses start at in an ipv6 tree
+	ipv4Start uint
+}
+
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// dataSeparator is the size of the zeros between the search tree and the data
+const dataSeparator = 16
+
+// OpenDatabase reads a MaxMind database into memory
+func OpenDatabase(path string) (*Database, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	d, err := NewDatabase(raw)
+	if err != nil {
+		return nil, errors.Prefix("geoip database "+path, err)
+	}
+	return d, nil
+}
+
+// NewDatabase parses a MaxMind database
+func NewDatabase(raw []byte) (*Database, error) {
+	at := bytes.LastIndex(raw, metadataMarker)
+	if at < 0 {
+		return nil, errors.Err("not a MaxMind database: no metadata")
+	}
+	meta, _, err := decoder{buf: raw[at+len(metadataMarker):]}.decode(0)
+	if err != nil {
+		return nil, errors.Prefix("metadata", err)
+	}
+	fields, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errors.Err("metadata is not a map")
+	}
+	number := func(key string) uint {
+		n, _ := fields[key].(uint64)
+		return uint(n)
+	}
+
+	d := &Database{nodeCount: number("node_count"), recordSize: number("record_size"), ipVersion: number("ip_version")}
+	if d.recordSize != 24 && d.recordSize != 28 && d.recordSize != 32 {
+		return nil, errors.Err("unsupported record size %d", d.recordSize)
+	}
+	if d.ipVersion != 4 && d.ipVersion != 6 {
+		return nil, errors.Err("unsupported ip version %d", d.ipVersion)
+	}
+	treeSize := int(d.nodeCount * d.recordSize / 4)
+	if treeSize+dataSeparator > at {
+		return nil, errors.Err("search tree is bigger than the file")
+	}
+	d.tree = raw[:treeSize]
+	d.data = decoder{buf: raw[treeSize+dataSeparator : at]}
+
+	if d.ipVersion == 6 {
+		for i := 0; i < 96 && d.ipv4Start < d.nodeCount; i++ {
+			d.ipv4Start = d.record(d.ipv4Start, 0)
+		}
+	}
+	return d, nil
+}
+
+// Country returns the upper case iso code of the country of ip, or "" if it's not in the database. The country of the
+// network's registration is used when the database doesn't know where the ip is
+func (d *Database) Country(ip net.IP) string {
+	offset, ok := d.lookup(ip)
+	if !ok {
+		return ""
+	}
+	for _, field := range []string{"country", "registered_country"} {
+		code, err := d.data.find(offset, field, "iso_code")
+		if err == nil {
+			if s, ok := code.(string); ok && s != "" {
+				return strings.ToUpper(s)
+			}
+		}
+	}
+	return ""
+}
+
+// lookup walks the search tree to the data of ip
+func (d *Database) lookup(ip net.IP) (int, bool) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = d.ipv4Start
+	} else if ip = ip.To16(); ip == nil || d.ipVersion == 4 {
+		return 0, false
+	}
+	for i := 0; i < len(ip)*8 && node < d.nodeCount; i++ {
+		node = d.record(node, uint(ip[i/8]>>(7-i%8))&1)
+	}
+	if node <= d.nodeCount {
+		// nodeCount means the ip is not in the database, and a smaller record means the ip was too short
+		return 0, false
+	}
+	return int(node - d.nodeCount - dataSeparator), true
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node
+func (d *Database) record(node, bit uint) uint {
+	switch d.recordSize {
+	case 24:
+		b := d.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := d.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(d.tree[node*8+bit*4:]))
+	}
+}
+
+// types of the values in the data section
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+var errCorrupt = errors.Base("corrupt MaxMind database")
+
+// decoder reads values from the data or metadata section. Offsets are from the start of the section
+type decoder struct {
+	buf []byte
+}
+
+// header reads the control byte of the value at offset. For pointers, size is where they point
+func (d decoder) header(offset int) (typ, size, next int, err error) {
+	if offset >= len(d.buf) {
+		return 0, 0, 0, errCorrupt
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typ = int(ctrl >> 5)
+
+	if typ == typePointer {
+		n := int(ctrl>>3&3) + 1
+		if offset+n > len(d.buf) {
+			return 0, 0, 0, errCorrupt
+		}
+		p := 0
+		if n < 4 {
+			p = int(ctrl & 7)
+		}
+		for _, b := range d.buf[offset : offset+n] {
+			p = p<<8 | int(b)
+		}
+		p += [...]int{0, 2048, 526336, 0}[n-1]
+		return typ, p, offset + n, nil
+	}
+
+	if typ == typeExtended {
+		if offset >= len(d.buf) {
+			return 0, 0, 0, errCorrupt
+		}
+		typ = 7 + int(d.buf[offset])
+		offset++
+	}
+	size = int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(d.buf) {
+			return 0, 0, 0, errCorrupt
+		}
+		extra := 0
+		for _, b := range d.buf[offset : offset+n] {
+			extra = extra<<8 | int(b)
+		}
+		size = [...]int{29, 285, 65821}[n-1] + extra
+		offset += n
+	}
+	return typ, size, offset, nil
+}
+
+// decode returns the value at offset and the offset after it. Maps are map[string]interface{}, arrays
+// []interface{}, and unsigned ints uint64, except for uint128s, which are left as bytes
+func (d decoder) decode(offset int) (interface{}, int, error) {
+	typ, size, next, err := d.header(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch typ {
+	case typePointer:
+		v, _, err := d.decode(size)
+		return v, next, err
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			var key, value interface{}
+			key, next, err = d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err = d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errCorrupt
+			}
+			m[k] = value
+		}
+		return m, next, nil
+	case typeArray:
+		a := make([]interface{}, size)
+		for i := range a {
+			a[i], next, err = d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, next, nil
+	case typeBool:
+		return size != 0, next, nil
+	}
+
+	if next+size > len(d.buf) {
+		return nil, 0, errCorrupt
+	}
+	b := d.buf[next : next+size]
+	next += size
+	switch typ {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes, typeUint128:
+		return b, next, nil
+	case typeUint16, typeUint32, typeUint64:
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, next, nil
+	case typeInt32:
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int32(n), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), next, nil
+	}
+	return nil, 0, errCorrupt
+}
+
+// skip returns the offset after the value at offset, without decoding it
+func (d decoder) skip(offset int) (int, error) {
+	typ, size, next, err := d.header(offset)
+	if err != nil {
+		return 0, err
+	}
+	switch typ {
+	case typePointer, typeBool:
+		return next, nil
+	case typeMap, typeArray:
+		n := size
+		if typ == typeMap {
+			n *= 2
+		}
+		for i := 0; i < n; i++ {
+			next, err = d.skip(next)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return next, nil
+	}
+	return next + size, nil
+}
+
+// find returns the value at a path of map keys under the map at offset, decoding only what's on the way
+func (d decoder) find(offset int, path ...string) (interface{}, error) {
+	typ, size, next, err := d.header(offset)
+	if err != nil {
+		return nil, err
+	}
+	if typ == typePointer {
+		return d.find(size, path...)
+	}
+	if len(path) == 0 {
+		v, _, err := d.decode(offset)
+		return v, err
+	}
+	if typ != typeMap {
+		return nil, errors.Err("not a map")
+	}
+	for i := 0; i < size; i++ {
+		var key interface{}
+		key, next, err = d.decode(next)
+		if err != nil {
+			return nil, err
+		}
+		if key == path[0] {
+			return d.find(next, path[1:]...)
+		}
+		next, err = d.skip(next)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, errors.Err("%s not found", path[0])
+}
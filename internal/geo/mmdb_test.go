@@ -0,0 +1,152 @@
+package geo
+
+import (
+	"net"
+	"testing"
+
+	"github.com/lbryio/reflector.go/auth"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDatabase builds an ipv6 MaxMind database with 24 bit records, with a record for each network
+func testDatabase(t *testing.T, networks map[string]map[string]interface{}) []byte {
+	const (
+		empty = -1
+		// records >= dataRecord point to data, at record-dataRecord in the data section
+		dataRecord = 1 << 22
+	)
+	nodes := [][2]int{{empty, empty}}
+	var data []byte
+	for cidr, record := range networks {
+		_, n, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		// ipv4 networks are under ::/96
+		ip := n.IP.To16()
+		ones, _ := n.Mask.Size()
+		if ip4 := n.IP.To4(); ip4 != nil {
+			ip = append(make(net.IP, 12), ip4...)
+			ones += 96
+		}
+
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[node][bit] = dataRecord + len(data)
+				break
+			}
+			if nodes[node][bit] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+		data = append(data, encodeValue(record)...)
+	}
+
+	var raw []byte
+	for _, n := range nodes {
+		for _, r := range n {
+			switch {
+			case r == empty:
+				r = len(nodes)
+			case r >= dataRecord:
+				r = r - dataRecord + len(nodes) + dataSeparator
+			}
+			raw = append(raw, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	raw = append(raw, make([]byte, dataSeparator)...)
+	raw = append(raw, data...)
+	raw = append(raw, metadataMarker...)
+	return append(raw, encodeValue(map[string]interface{}{
+		"node_count":  uint32(len(nodes)),
+		"record_size": uint16(24),
+		"ip_version":  uint16(6),
+	})...)
+}
+
+// encodeValue encodes maps, strings and unsigned ints. Sizes must be under 29
+func encodeValue(v interface{}) []byte {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := []byte{typeMap<<5 | byte(len(v))}
+		for k, value := range v {
+			out = append(out, encodeValue(k)...)
+			out = append(out, encodeValue(value)...)
+		}
+		return out
+	case string:
+		return append([]byte{typeString<<5 | byte(len(v))}, v...)
+	case uint16:
+		return []byte{typeUint16<<5 | 2, byte(v >> 8), byte(v)}
+	case uint32:
+		return []byte{typeUint32<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+	panic("can't encode this")
+}
+
+func country(code string) map[string]interface{} {
+	return map[string]interface{}{"iso_code": code, "names": map[string]interface{}{"en": "somewhere"}}
+}
+
+func TestDatabase_Country(t *testing.T) {
+	raw := testDatabase(t, map[string]map[string]interface{}{
+		"203.0.113.0/24":  {"continent": map[string]interface{}{"code": "OC"}, "country": country("AU")},
+		"198.51.100.0/25": {"registered_country": country("de")},
+		"2001:db8::/32":   {"country": country("NL"), "registered_country": country("DE")},
+	})
+	db, err := NewDatabase(raw)
+	require.NoError(t, err)
+
+	for ip, code := range map[string]string{
+		"203.0.113.7":    "AU",
+		"198.51.100.1":   "DE",
+		"198.51.100.200": "",
+		"192.0.2.1":      "",
+		"2001:db8::1":    "NL",
+		"2001:db9::1":    "",
+	} {
+		assert.Equal(t, code, db.Country(net.ParseIP(ip)), ip)
+	}
+
+	_, err = NewDatabase([]byte("not a database"))
+	assert.Error(t, err)
+}
+
+func TestDecoder_Pointer(t *testing.T) {
+	// a map whose value is a pointer back to the string at offset 0
+	buf := append(encodeValue("AU"), typeMap<<5|1)
+	buf = append(buf, encodeValue("iso_code")...)
+	buf = append(buf, typePointer<<5, 0)
+	v, err := decoder{buf: buf}.find(3, "iso_code")
+	require.NoError(t, err)
+	assert.Equal(t, "AU", v)
+}
+
+func TestCountryRules(t *testing.T) {
+	db, err := NewDatabase(testDatabase(t, map[string]map[string]interface{}{
+		"203.0.113.0/24":  {"country": country("AU")},
+		"198.51.100.0/24": {"country": country("DE")},
+	}))
+	require.NoError(t, err)
+
+	request := func(ip string) auth.Request {
+		return auth.Request{RemoteAddr: ip + ":1234", Protocol: auth.ProtocolHTTP}
+	}
+
+	allow := NewCountryRules(db, []string{"au"}, nil)
+	assert.NoError(t, allow.Authorize(request("203.0.113.1")))
+	assert.True(t, errors.Is(allow.Authorize(request("198.51.100.1")), auth.ErrForbidden))
+	assert.NoError(t, allow.Authorize(request("10.0.0.1")))
+	allow.BlockUnknown = true
+	assert.True(t, errors.Is(allow.Authorize(request("10.0.0.1")), auth.ErrForbidden))
+
+	block := NewCountryRules(db, nil, []string{"DE"})
+	assert.NoError(t, block.Authorize(request("203.0.113.1")))
+	assert.True(t, errors.Is(block.Authorize(request("198.51.100.1")), auth.ErrForbidden))
+}
@@ -0,0 +1,138 @@
+// Package membudget sizes the parts of the reflector that hold blobs in memory from a single max memory figure, so a
+// reflector on a small VM stays inside its memory instead of being OOM killed. Half of the budget goes to the
+// in-memory blob cache and a quarter to blob transfers, each of which holds a blob and the pooled buffer it's read
+// into. The rest is left to the runtime, the db, the dht and everything else.
+//
+// With go 1.19 or newer the budget is also the Go memory limit, so the GC works harder as memory gets close to it. If
+// memory goes over the budget anyway, Admit turns new requests away until it's back under, so clients retry later
+// instead of the process being killed.
+package membudget
+
+import (
+	"runtime/metrics"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/c2h5oh/datasize"
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
+)
+
+const (
+	// TransferSize is how much memory a blob transfer takes, a blob and the buffer it's read into
+	TransferSize = 2 * stream.MaxBlobSize
+	// MinTransfers is how many transfers are allowed at once however small the budget is
+	MinTransfers = 4
+	// DefaultInterval is how often memory is checked against the budget, unless Interval is changed
+	DefaultInterval = time.Second
+
+	memCacheShare = 0.5
+	transferShare = 0.25
+
+	// requests are turned away once memory is above highWater of the budget, and let in again once it's below lowWater
+	highWater = 0.95
+	lowWater  = 0.85
+)
+
+// the memory the runtime got from the os, minus what it gave back
+var memorySamples = []metrics.Sample{
+	{Name: "/memory/classes/total:bytes"},
+	{Name: "/memory/classes/heap/released:bytes"},
+}
+
+// Budget splits a max memory figure between the in-memory cache and transfers, and holds back requests when memory
+// goes over it
+type Budget struct {
+	// Interval is how often memory is checked against the budget
+	Interval time.Duration
+
+	total int64
+	over  *atomic.Bool
+	grp   *stop.Group
+	// inUse is how much memory is used. It's a field so tests can fake it
+	inUse func() int64
+}
+
+// New returns a budget of total bytes
+func New(total int64) *Budget {
+	return &Budget{
+		Interval: DefaultInterval,
+		total:    total,
+		over:     atomic.NewBool(false),
+		grp:      stop.New(),
+		inUse:    inUse,
+	}
+}
+
+// Total is the size of the budget
+func (b *Budget) Total() int64 {
+	return b.total
+}
+
+// MemCacheBytes is how large the in-memory blob cache may be
+func (b *Budget) MemCacheBytes() int64 {
+	return int64(float64(b.total) * memCacheShare)
+}
+
+// Transfers is how many blob transfers may run at once, over all the servers
+func (b *Budget) Transfers() int {
+	n := int(float64(b.total) * transferShare / TransferSize)
+	if n < MinTransfers {
+		return MinTransfers
+	}
+	return n
+}
+
+// Start sets the Go memory limit to the budget and starts checking memory against it
+func (b *Budget) Start() {
+	setMemoryLimit(b.total)
+	log.Infof("memory budget is %s: %s of in-memory cache and %d transfers at once", datasize.ByteSize(b.total).HR(),
+		datasize.ByteSize(b.MemCacheBytes()).HR(), b.Transfers())
+
+	b.grp.Add(1)
+	go func() {
+		defer b.grp.Done()
+		t := time.NewTicker(b.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-b.grp.Ch():
+				return
+			case <-t.C:
+				b.check()
+			}
+		}
+	}()
+}
+
+// Shutdown stops checking memory
+func (b *Budget) Shutdown() {
+	b.grp.StopAndWait()
+}
+
+// Admit returns whether there's memory for new requests. It's meant for the servers' Admit
+func (b *Budget) Admit() bool {
+	return !b.over.Load()
+}
+
+func (b *Budget) check() {
+	used := b.inUse()
+	switch {
+	case !b.over.Load() && float64(used) > highWater*float64(b.total):
+		b.over.Store(true)
+		log.Warnf("memory use of %s is over the budget of %s, turning new requests away",
+			datasize.ByteSize(used).HR(), datasize.ByteSize(b.total).HR())
+	case b.over.Load() && float64(used) < lowWater*float64(b.total):
+		b.over.Store(false)
+		log.Infof("memory use of %s is back under the budget, letting requests in again", datasize.ByteSize(used).HR())
+	}
+}
+
+func inUse() int64 {
+	samples := make([]metrics.Sample, len(memorySamples))
+	copy(samples, memorySamples)
+	metrics.Read(samples)
+	return int64(samples[0].Value.Uint64() - samples[1].Value.Uint64())
+}
@@ -0,0 +1,43 @@
+package membudget
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBudget_Sizes(t *testing.T) {
+	b := New(4 << 30)
+	assert.Equal(t, int64(2<<30), b.MemCacheBytes())
+	assert.Equal(t, int((1<<30)/TransferSize), b.Transfers())
+
+	// a tiny budget still lets a few transfers through
+	assert.Equal(t, MinTransfers, New(1<<20).Transfers())
+}
+
+func TestBudget_Admit(t *testing.T) {
+	b := New(1000)
+	var used int64
+	b.inUse = func() int64 { return used }
+
+	used = 900
+	b.check()
+	assert.True(t, b.Admit())
+
+	used = 960
+	b.check()
+	assert.False(t, b.Admit())
+
+	// requests stay out until memory is well under the budget
+	used = 900
+	b.check()
+	assert.False(t, b.Admit())
+
+	used = 800
+	b.check()
+	assert.True(t, b.Admit())
+}
+
+func TestInUse(t *testing.T) {
+	assert.Greater(t, inUse(), int64(0))
+}
@@ -0,0 +1,11 @@
+//go:build go1.19
+// +build go1.19
+
+package membudget
+
+import "runtime/debug"
+
+// setMemoryLimit makes total the Go memory limit
+func setMemoryLimit(total int64) {
+	debug.SetMemoryLimit(total)
+}
@@ -0,0 +1,15 @@
+//go:build !go1.19
+// +build !go1.19
+
+package membudget
+
+import (
+	"github.com/c2h5oh/datasize"
+	log "github.com/sirupsen/logrus"
+)
+
+// setMemoryLimit only logs the budget, the Go memory limit came with go 1.19. Admit still holds requests back
+func setMemoryLimit(total int64) {
+	log.Infof("go memory limit not set to the budget of %s, it needs a reflector built with go 1.19 or newer",
+		datasize.ByteSize(total).HR())
+}
@@ -21,6 +21,7 @@ import (
 
 type Server struct {
 	srv  *http.Server
+	mux  *http.ServeMux
 	stop *stop.Stopper
 }
 
@@ -28,6 +29,7 @@ func NewServer(address string, path string) *Server {
 	h := http.NewServeMux()
 	h.Handle(path, promhttp.Handler())
 	return &Server{
+		mux: h,
 		srv: &http.Server{
 			Addr:    address,
 			Handler: h,
@@ -41,6 +43,19 @@ func NewServer(address string, path string) *Server {
 	}
 }
 
+// Handle adds an operator endpoint next to the metrics
+func (s *Server) Handle(path string, handler http.Handler) {
+	s.mux.Handle(path, handler)
+}
+
+// ExtendWriteTimeout gives responses at least d to be written, for operator endpoints that wait on slow work like dht
+// lookups. It must be called before Start
+func (s *Server) ExtendWriteTimeout(d time.Duration) {
+	if d > s.srv.WriteTimeout {
+		s.srv.WriteTimeout = d
+	}
+}
+
 func (s *Server) Start() {
 	s.stop.Add(1)
 	go func() {
@@ -58,9 +73,17 @@ func (s *Server) Shutdown() {
 }
 
 const (
-	ns             = "reflector"
-	subsystemCache = "cache"
-	subsystemITTT  = "ittt"
+	ns                 = "reflector"
+	subsystemCache     = "cache"
+	subsystemITTT      = "ittt"
+	subsystemBreaker   = "circuit_breaker"
+	subsystemCluster   = "cluster"
+	subsystemAdmission = "admission"
+	subsystemS3        = "s3"
+	subsystemStore     = "store"
+	subsystemShadow    = "shadow"
+	subsystemCapture   = "capture"
+	subsystemDHT       = "dht"
 
 	labelDirection = "direction"
 	labelErrorType = "error_type"
@@ -71,6 +94,13 @@ const (
 	LabelCacheType = "cache_type"
 	LabelComponent = "component"
 	LabelSource    = "source"
+	LabelServer    = "server"
+	LabelReason    = "reason"
+	LabelOperation = "operation"
+	LabelResult    = "result"
+	LabelClass     = "error_class"
+	LabelAction    = "action"
+	LabelAPIKey    = "api_key"
 
 	errConnReset         = "conn_reset"
 	errReadConnReset     = "read_conn_reset"
@@ -167,11 +197,156 @@ var (
 		Name:      "evict_total",
 		Help:      "Count of blobs evicted from cache",
 	}, []string{LabelCacheType, LabelComponent})
+	CacheAdmissionRejectedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "admission_rejected_total",
+		Help:      "Total number of blobs fetched from the origin that the admission filter kept out of the cache",
+	}, []string{LabelCacheType, LabelComponent})
+	CacheAdmissionRegretCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "admission_regret_total",
+		Help:      "Total number of misses for blobs that the admission filter kept out of the cache recently",
+	}, []string{LabelCacheType, LabelComponent})
+	CacheAdmissionHitRateGain = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "admission_hit_rate_gain",
+		Help:      "Estimated change in the hit rate from the admission filter over its last window",
+	}, []string{LabelCacheType, LabelComponent})
+	ShadowRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemShadow,
+		Name:      "requests_total",
+		Help:      "Total number of requests simulated on each shadow cache",
+	}, []string{"cache"})
+	ShadowHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemShadow,
+		Name:      "hits_total",
+		Help:      "Total number of requests each shadow cache would have served",
+	}, []string{"cache"})
+	ShadowHitBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemShadow,
+		Name:      "hit_bytes",
+		Help:      "Total number of bytes each shadow cache would have served",
+	}, []string{"cache"})
+	ShadowDroppedCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemShadow,
+		Name:      "dropped_total",
+		Help:      "Total number of requests left out of the shadow caches because the simulation fell behind",
+	})
+	CaptureRequestCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCapture,
+		Name:      "requests_total",
+		Help:      "Total number of requests written to the request capture",
+	})
+	CaptureDroppedCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCapture,
+		Name:      "dropped_total",
+		Help:      "Total number of requests left out of the request capture because writing it fell behind",
+	})
+	DHTDroppedPacketCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemDHT,
+		Name:      "dropped_packets_total",
+		Help:      "Total number of udp packets dropped before the dht node read them, by reason",
+	}, []string{LabelReason})
+	DHTBanCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemDHT,
+		Name:      "bans_total",
+		Help:      "Total number of times an ip was banned from the dht node for going over the packet limits",
+	})
+	MemStoreHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "mem_hit_total",
+		Help:      "Total number of blobs found in the in-memory store",
+	}, []string{LabelComponent})
+	MemStoreMissCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "mem_miss_total",
+		Help:      "Total number of blobs not found in the in-memory store",
+	}, []string{LabelComponent})
+	MemStoreBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "mem_bytes",
+		Help:      "Size of the blobs held by the in-memory store",
+	}, []string{LabelComponent})
+	CircuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: subsystemBreaker,
+		Name:      "state",
+		Help:      "State of the circuit breaker in front of an origin (0 closed, 1 half-open, 2 open)",
+	}, []string{LabelComponent})
+	CircuitBreakerRejectedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemBreaker,
+		Name:      "rejected_total",
+		Help:      "Total number of requests failed by an open circuit breaker without reaching the origin",
+	}, []string{LabelComponent})
+	ReadAheadCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "read_ahead_total",
+		Help:      "Total number of blobs prefetched because an earlier blob of their stream was requested",
+	})
+	ClusterReplicationPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: subsystemCluster,
+		Name:      "replication_pending",
+		Help:      "How many blobs still have to be handed to new replicas after the cluster membership changed",
+	})
+	ClusterReplicatedCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCluster,
+		Name:      "replicated_total",
+		Help:      "Total number of blobs handed to new replicas",
+	})
+	ClusterReplicationErrorCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCluster,
+		Name:      "replication_error_total",
+		Help:      "Total number of failed requests asking a member to replicate blobs",
+	})
+	ClusterRegionRoutedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCluster,
+		Name:      "region_routed_total",
+		Help:      "Total number of blob requests sent to a member in the client's region, by redirect or proxy",
+	}, []string{"region", "how"})
+	ClusterSiblingHitCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCluster,
+		Name:      "sibling_hit_total",
+		Help:      "Total number of cache misses served by another member's cache",
+	})
+	ClusterSiblingMissCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCluster,
+		Name:      "sibling_miss_total",
+		Help:      "Total number of requests to members whose cache summary had a blob they could not serve",
+	})
 	CacheRetrievalSpeed = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: ns,
 		Name:      "speed_mbps",
 		Help:      "Speed of blob retrieval from cache or from origin",
 	}, []string{LabelCacheType, LabelComponent, LabelSource})
+	CacheRetrievalSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "retrieval_seconds",
+		Help:      "How long it takes to get a blob from the cache or from the origin",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{LabelCacheType, LabelComponent, LabelSource})
 
 	BlobUploadCount = promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: ns,
@@ -183,6 +358,41 @@ var (
 		Name:      "sdblob_upload_total",
 		Help:      "Total number of SD blobs (and therefore streams) uploaded to reflector",
 	})
+	ReflectorClientFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "reflector_client_failure_total",
+		Help:      "Total number of corrupt blobs and protocol errors from reflector clients, by reason",
+	}, []string{LabelReason})
+	ReflectorBanCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "reflector_ban_total",
+		Help:      "Total number of times a reflector client was banned for repeated failures",
+	})
+	ReflectorRejectedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "reflector_rejected_total",
+		Help:      "Total number of uploads rejected for being over a limit, by reason",
+	}, []string{LabelReason})
+	ReflectorBannedConnCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "reflector_banned_conn_total",
+		Help:      "Total number of connections from banned reflector clients that were closed",
+	})
+	APIKeyUploadCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "api_key_upload_total",
+		Help:      "Total number of blobs uploaded to reflector, by the name of the api key they were uploaded with",
+	}, []string{LabelAPIKey})
+	APIKeyUploadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "api_key_upload_bytes_total",
+		Help:      "Total number of bytes uploaded to reflector, by the name of the api key they were uploaded with",
+	}, []string{LabelAPIKey})
+	APIKeyRejectedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "api_key_rejected_total",
+		Help:      "Total number of uploads rejected because of their api key, by the name of the key and reason",
+	}, []string{LabelAPIKey, LabelReason})
 
 	MtrInBytesTcp = promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: ns,
@@ -214,6 +424,36 @@ var (
 		Name:      "http_out_bytes",
 		Help:      "Total number of bytes streamed out through UDP",
 	})
+	MtrInBytesS3Gateway = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "s3_gateway_in_bytes",
+		Help:      "Total number of bytes uploaded through the s3 gateway",
+	})
+	MtrOutBytesS3Gateway = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "s3_gateway_out_bytes",
+		Help:      "Total number of bytes downloaded through the s3 gateway",
+	})
+	CountryRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "country_requests_total",
+		Help:      "Total number of blobs served, by protocol and country of the client",
+	}, []string{"protocol", "country"})
+	CountryOutBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "country_out_bytes",
+		Help:      "Total number of bytes of blobs served, by protocol and country of the client",
+	}, []string{"protocol", "country"})
+	CountryBlockedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "country_blocked_total",
+		Help:      "Total number of requests denied because of the country of the client",
+	}, []string{"protocol", "country"})
+	S3GatewayRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "s3_gateway_requests_total",
+		Help:      "Total number of requests to the s3 gateway, by method and result (ok or the s3 error code)",
+	}, []string{LabelOperation, LabelResult})
 	MtrInBytesReflector = promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: ns,
 		Name:      "reflector_in_bytes",
@@ -239,6 +479,92 @@ var (
 		Name:      "http_blob_request_queue_size",
 		Help:      "Blob requests queue size of the HTTP protocol",
 	})
+	AdmissionQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: subsystemAdmission,
+		Name:      "queued",
+		Help:      "Requests waiting to be handled, by server",
+	}, []string{LabelServer})
+	AdmissionWaitSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: subsystemAdmission,
+		Name:      "wait_seconds",
+		Help:      "How long requests waited in the queue before being handled, by server",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{LabelServer})
+	AdmissionShedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemAdmission,
+		Name:      "shed_total",
+		Help:      "Total number of requests turned away because the server was overloaded, by server and reason",
+	}, []string{LabelServer, LabelReason})
+	S3AttemptCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemS3,
+		Name:      "attempts_total",
+		Help:      "Total number of s3 request attempts, by operation and result (ok, the reason it's retried, or error)",
+	}, []string{LabelOperation, LabelResult})
+	S3AttemptDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: subsystemS3,
+		Name:      "attempt_duration_seconds",
+		Help:      "How long s3 request attempts took, by operation",
+		Buckets:   []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{LabelOperation})
+	S3RetryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemS3,
+		Name:      "retries_total",
+		Help:      "Total number of s3 requests that were retried, by operation and reason",
+	}, []string{LabelOperation, LabelReason})
+	S3ErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemS3,
+		Name:      "errors_total",
+		Help:      "Total number of s3 requests that failed after all their attempts, by operation",
+	}, []string{LabelOperation})
+	StoreOperationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: subsystemStore,
+		Name:      "operation_seconds",
+		Help:      "How long operations on a store with the metrics middleware took, by operation and result",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{LabelComponent, LabelOperation, LabelResult})
+	StoreRetryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemStore,
+		Name:      "retry_total",
+		Help:      "Total number of store operations retried by the retry middleware",
+	}, []string{LabelComponent, LabelOperation})
+	StoreTimeoutCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemStore,
+		Name:      "timeout_total",
+		Help:      "Total number of store operations given up on by the timeout middleware",
+	}, []string{LabelComponent, LabelOperation})
+	StoreInjectedFaultCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemStore,
+		Name:      "injected_fault_total",
+		Help:      "Total number of faults injected into store operations by the faults middleware",
+	}, []string{LabelComponent, LabelOperation, "fault"})
+	StorePolicyDecisionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemStore,
+		Name:      "policy_decision_total",
+		Help:      "Total number of failed store reads that a tier policy retried, passed to the next tier or failed, by error class",
+	}, []string{LabelComponent, LabelClass, LabelAction})
+	VerifyCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemStore,
+		Name:      "verify_total",
+		Help:      "Total number of blobs checked against their hash after they were served, by result",
+	}, []string{LabelResult})
+	MirrorDriftCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "mirror_drift_total",
+		Help:      "Total number of blobs found missing from one side of a mirrored store, by reason",
+	}, []string{LabelReason})
 	RoutinesQueue = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: ns,
 		Name:      "routines",
@@ -0,0 +1,102 @@
+// Package nodeid keeps the id of a dht node across restarts. A node that comes back with a new id is a stranger to
+// the nodes that had it in their routing tables: they keep the old id until it fails enough pings, and the new one has
+// to be learned again. With a saved id, a restarted node takes its old place in the dht.
+//
+// An id can also be generated within a range of the id space, so the nodes of a deployment that splits the hashes
+// between them sit close to the hashes they announce.
+package nodeid
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lbryio/reflector.go/internal/bitmap"
+
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Load returns the node id saved in path. If there's no file, or the saved id isn't within r, a new id is generated
+// within r and saved. A nil r is the whole id space
+func Load(path string, r *bits.Range) (bits.Bitmap, error) {
+	within := bits.MaxRange()
+	if r != nil {
+		within = *r
+	}
+
+	raw, err := os.ReadFile(path)
+	if err == nil {
+		id, err := bits.FromHex(strings.TrimSpace(string(raw)))
+		if err != nil {
+			return bits.Bitmap{}, errors.Prefix("node id in "+path, err)
+		}
+		if within.Contains(id) {
+			return id, nil
+		}
+		log.Warnf("node id %s in %s is outside of the node id range, generating a new one", id.HexShort(), path)
+	} else if !os.IsNotExist(err) {
+		return bits.Bitmap{}, errors.Err(err)
+	}
+
+	id, err := Generate(within)
+	if err != nil {
+		return bits.Bitmap{}, err
+	}
+	err = save(path, id)
+	if err != nil {
+		return bits.Bitmap{}, err
+	}
+	log.Infof("saved new node id %s to %s", id.HexShort(), path)
+	return id, nil
+}
+
+// save writes the id to a temporary file first, so a crash can't leave half an id behind
+func save(path string, id bits.Bitmap) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errors.Err(err)
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, []byte(id.Hex()+"\n"), 0644)
+	if err != nil {
+		return errors.Err(err)
+	}
+	return errors.Err(os.Rename(tmp, path))
+}
+
+// Generate returns a random id within r, drawn uniformly from crypto/rand
+func Generate(r bits.Range) (bits.Bitmap, error) {
+	id, err := bitmap.RandInRange(r)
+	if err != nil {
+		return bits.Bitmap{}, errors.Prefix("node id range", err)
+	}
+	return id, nil
+}
+
+// ParseRange parses a range of node ids. It's either a hex prefix like "a3", for the ids that start with it, or N/M
+// like "2/4", for the 2nd of 4 equal parts of the id space
+func ParseRange(spec string) (bits.Range, error) {
+	if i := strings.Index(spec, "/"); i >= 0 {
+		part, err1 := strconv.Atoi(spec[:i])
+		parts, err2 := strconv.Atoi(spec[i+1:])
+		if err1 != nil || err2 != nil || parts < 1 || part < 1 || part > parts {
+			return bits.Range{}, errors.Err("node id range '%s' is not N/M with 1 <= N <= M", spec)
+		}
+		return bits.MaxRange().IntervalP(part, parts), nil
+	}
+
+	if spec == "" || len(spec) > bits.NumBytes*2 {
+		return bits.Range{}, errors.Err("node id prefix must be 1 to %d hex digits", bits.NumBytes*2)
+	}
+	pad := bits.NumBytes*2 - len(spec)
+	start, err := bits.FromHex(spec + strings.Repeat("0", pad))
+	if err != nil {
+		return bits.Range{}, errors.Err("node id prefix '%s' is not hex", spec)
+	}
+	end := bits.FromHexP(spec + strings.Repeat("f", pad))
+	return bits.Range{Start: start, End: end}, nil
+}
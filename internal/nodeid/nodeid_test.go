@@ -0,0 +1,60 @@
+package nodeid
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dht", "node_id")
+
+	id, err := Load(path, nil)
+	require.NoError(t, err)
+	again, err := Load(path, nil)
+	require.NoError(t, err)
+	assert.Equal(t, id, again)
+
+	// a saved id outside of the range is replaced
+	r, err := ParseRange("1/16")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte(strings.Repeat("f", bits.NumBytes*2)), 0644))
+	id, err = Load(path, &r)
+	require.NoError(t, err)
+	assert.True(t, r.Contains(id))
+	again, err = Load(path, &r)
+	require.NoError(t, err)
+	assert.Equal(t, id, again)
+
+	require.NoError(t, os.WriteFile(path, []byte("not hex"), 0644))
+	_, err = Load(path, nil)
+	assert.Error(t, err)
+}
+
+func TestParseRange(t *testing.T) {
+	r, err := ParseRange("a3")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(r.Start.Hex(), "a300"))
+	assert.True(t, strings.HasPrefix(r.End.Hex(), "a3ff"))
+	for i := 0; i < 20; i++ {
+		id, err := Generate(r)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(id.Hex(), "a3"), id.Hex())
+	}
+
+	r, err = ParseRange("4/4")
+	require.NoError(t, err)
+	assert.Equal(t, bits.MaxRange().IntervalP(4, 4), r)
+	assert.Equal(t, bits.MaxP(), r.End)
+
+	for _, spec := range []string{"", "xy", "0/4", "5/4", "a/b", strings.Repeat("a", bits.NumBytes*2+1)} {
+		_, err = ParseRange(spec)
+		assert.Error(t, err, spec)
+	}
+}
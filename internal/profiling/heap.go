@@ -0,0 +1,144 @@
+package profiling
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultInterval is how often the heap is looked at, unless Interval is changed
+	DefaultInterval = 10 * time.Second
+	// DefaultCooldown is the least time between two profiles, unless Cooldown is changed
+	DefaultCooldown = 10 * time.Minute
+	// DefaultKeep is how many profiles are kept, unless Keep is changed
+	DefaultKeep = 10
+
+	heapProfilePrefix = "heap-"
+	heapProfileSuffix = ".pb.gz"
+)
+
+// HeapWatcher writes a heap profile to a dir whenever the heap in use grows past a watermark. The profiles are named
+// heap-TIME.pb.gz and can be read with go tool pprof
+type HeapWatcher struct {
+	// Interval is how often the heap is looked at
+	Interval time.Duration
+	// Cooldown is the least time between two profiles, so a heap that stays above the watermark doesn't fill the dir
+	Cooldown time.Duration
+	// Keep is how many profiles are kept. The oldest ones are deleted
+	Keep int
+
+	dir       string
+	watermark uint64
+	last      time.Time
+	grp       *stop.Group
+}
+
+// NewHeapWatcher returns a watcher that writes profiles to dir once the heap in use is larger than watermark bytes
+func NewHeapWatcher(dir string, watermark uint64) *HeapWatcher {
+	return &HeapWatcher{
+		Interval:  DefaultInterval,
+		Cooldown:  DefaultCooldown,
+		Keep:      DefaultKeep,
+		dir:       dir,
+		watermark: watermark,
+		grp:       stop.New(),
+	}
+}
+
+// Start starts watching the heap
+func (h *HeapWatcher) Start() error {
+	err := os.MkdirAll(h.dir, 0755)
+	if err != nil {
+		return errors.Err(err)
+	}
+	h.grp.Add(1)
+	go func() {
+		defer h.grp.Done()
+		t := time.NewTicker(h.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-h.grp.Ch():
+				return
+			case <-t.C:
+				h.check()
+			}
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops watching the heap
+func (h *HeapWatcher) Shutdown() {
+	h.grp.StopAndWait()
+}
+
+func (h *HeapWatcher) check() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.HeapInuse < h.watermark || time.Since(h.last) < h.Cooldown {
+		return
+	}
+	h.last = time.Now()
+	path, err := h.WriteProfile()
+	if err != nil {
+		log.Errorf("writing heap profile: %s", errors.FullTrace(err))
+		return
+	}
+	log.Warnf("heap in use is %d bytes, over the watermark of %d. wrote a heap profile to %s", m.HeapInuse, h.watermark,
+		path)
+}
+
+// WriteProfile writes a heap profile right away and deletes the oldest ones beyond Keep. It returns the path of the
+// profile
+func (h *HeapWatcher) WriteProfile() (string, error) {
+	path := filepath.Join(h.dir, heapProfilePrefix+time.Now().UTC().Format("20060102T150405.000000000")+heapProfileSuffix)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", errors.Err(err)
+	}
+	err = pprof.Lookup("heap").WriteTo(f, 0)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return "", errors.Err(err)
+	}
+	err = f.Close()
+	if err != nil {
+		return "", errors.Err(err)
+	}
+	return path, h.prune()
+}
+
+// prune deletes the oldest profiles beyond Keep. The names sort by time
+func (h *HeapWatcher) prune() error {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return errors.Err(err)
+	}
+	var profiles []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), heapProfilePrefix) && strings.HasSuffix(e.Name(), heapProfileSuffix) {
+			profiles = append(profiles, e.Name())
+		}
+	}
+	sort.Strings(profiles)
+	for len(profiles) > h.Keep && h.Keep > 0 {
+		err = os.Remove(filepath.Join(h.dir, profiles[0]))
+		if err != nil {
+			return errors.Err(err)
+		}
+		profiles = profiles[1:]
+	}
+	return nil
+}
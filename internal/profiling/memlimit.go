@@ -0,0 +1,18 @@
+//go:build go1.19
+// +build go1.19
+
+package profiling
+
+import "runtime/debug"
+
+// memoryLimitSupported is whether the runtime has a soft memory limit, which came with go 1.19
+const memoryLimitSupported = true
+
+// memoryLimit returns the soft memory limit of the runtime, in bytes
+func memoryLimit() int64 {
+	return debug.SetMemoryLimit(-1)
+}
+
+func setMemoryLimit(limit int64) {
+	debug.SetMemoryLimit(limit)
+}
@@ -0,0 +1,16 @@
+//go:build !go1.19
+// +build !go1.19
+
+package profiling
+
+import "math"
+
+// memoryLimitSupported is whether the runtime has a soft memory limit, which came with go 1.19
+const memoryLimitSupported = false
+
+// memoryLimit returns what go 1.19 reports when there is no limit
+func memoryLimit() int64 {
+	return math.MaxInt64
+}
+
+func setMemoryLimit(int64) {}
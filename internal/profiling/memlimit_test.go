@@ -0,0 +1,24 @@
+//go:build go1.19
+// +build go1.19
+
+package profiling
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuntimeHandler_MemoryLimit(t *testing.T) {
+	limit := debug.SetMemoryLimit(-1)
+	defer debug.SetMemoryLimit(limit)
+
+	w := httptest.NewRecorder()
+	RuntimeHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, RuntimePath+"?memory_limit=4000000000", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(4000000000), debug.SetMemoryLimit(-1))
+}
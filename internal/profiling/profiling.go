@@ -0,0 +1,160 @@
+// Package profiling helps with debugging a reflector in production. It serves the pprof profiles and lets operators
+// change the GC percent, the memory limit and GOMAXPROCS while the process runs, and a HeapWatcher writes heap profiles
+// by itself when the heap grows past a watermark, so the profile of a memory spike is there even if nobody was looking.
+package profiling
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/internal/dhtadmin"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Paths where the handlers are served
+const (
+	PprofPath   = "/debug/pprof/"
+	RuntimePath = "/debug/runtime"
+)
+
+// WriteTimeout is how long the server the handlers are on must give responses to be written. pprof refuses to take a
+// cpu profile or a trace that lasts longer than the write timeout of the server, and the default is 30 seconds
+const WriteTimeout = 45 * time.Second
+
+// Register adds the pprof handlers and the runtime handler to mux, for clients that send token as a bearer token.
+// Changing the runtime settings can take the process down, so nothing is served without a token
+func Register(mux dhtadmin.Mux, token string) {
+	if token == "" {
+		return
+	}
+	mux.Handle(PprofPath, auth.RequireToken(token, http.HandlerFunc(pprof.Index)))
+	mux.Handle(PprofPath+"cmdline", auth.RequireToken(token, http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle(PprofPath+"profile", auth.RequireToken(token, http.HandlerFunc(pprof.Profile)))
+	mux.Handle(PprofPath+"symbol", auth.RequireToken(token, http.HandlerFunc(pprof.Symbol)))
+	mux.Handle(PprofPath+"trace", auth.RequireToken(token, http.HandlerFunc(pprof.Trace)))
+	mux.Handle(RuntimePath, auth.RequireToken(token, RuntimeHandler()))
+}
+
+// Runtime is what the runtime handler shows
+type Runtime struct {
+	GOMAXPROCS  int    `json:"gomaxprocs"`
+	NumCPU      int    `json:"num_cpu"`
+	GCPercent   int    `json:"gc_percent"`
+	MemoryLimit int64  `json:"memory_limit"`
+	Goroutines  int    `json:"goroutines"`
+	HeapAlloc   uint64 `json:"heap_alloc"`
+	HeapInuse   uint64 `json:"heap_inuse"`
+	HeapSys     uint64 `json:"heap_sys"`
+	Sys         uint64 `json:"sys"`
+	NumGC       uint32 `json:"num_gc"`
+}
+
+// the runtime has no getter for the gc percent, it's read by setting it and putting it back. The lock keeps two
+// requests from doing that at once
+var gcPercentMu sync.Mutex
+
+func gcPercent() int {
+	gcPercentMu.Lock()
+	defer gcPercentMu.Unlock()
+	p := debug.SetGCPercent(100)
+	debug.SetGCPercent(p)
+	return p
+}
+
+func setGCPercent(p int) {
+	gcPercentMu.Lock()
+	defer gcPercentMu.Unlock()
+	debug.SetGCPercent(p)
+}
+
+// ReadRuntime returns the current runtime settings and memory stats
+func ReadRuntime() Runtime {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return Runtime{
+		GOMAXPROCS:  runtime.GOMAXPROCS(0),
+		NumCPU:      runtime.NumCPU(),
+		GCPercent:   gcPercent(),
+		MemoryLimit: memoryLimit(),
+		Goroutines:  runtime.NumGoroutine(),
+		HeapAlloc:   m.HeapAlloc,
+		HeapInuse:   m.HeapInuse,
+		HeapSys:     m.HeapSys,
+		Sys:         m.Sys,
+		NumGC:       m.NumGC,
+	}
+}
+
+// RuntimeHandler shows the runtime settings and memory stats as json on GET. POST changes the settings given in the
+// query, any of gc_percent (negative turns the GC off), memory_limit (bytes) and gomaxprocs, and shows the result.
+// Nothing is changed if any of them is invalid
+//
+//	curl -X POST 'localhost:2112/debug/runtime?gc_percent=50&gomaxprocs=8'
+func RuntimeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			q := r.URL.Query()
+			var gcp, procs int
+			var limit int64
+			var err error
+			if v := q.Get("gc_percent"); v != "" {
+				gcp, err = strconv.Atoi(v)
+				if err != nil {
+					http.Error(w, "gc_percent must be a number", http.StatusBadRequest)
+					return
+				}
+			}
+			if v := q.Get("memory_limit"); v != "" {
+				if !memoryLimitSupported {
+					http.Error(w, "memory_limit needs a reflector built with go 1.19 or newer", http.StatusBadRequest)
+					return
+				}
+				limit, err = strconv.ParseInt(v, 10, 64)
+				if err != nil || limit <= 0 {
+					http.Error(w, "memory_limit must be a positive number of bytes", http.StatusBadRequest)
+					return
+				}
+			}
+			if v := q.Get("gomaxprocs"); v != "" {
+				procs, err = strconv.Atoi(v)
+				if err != nil || procs <= 0 {
+					http.Error(w, "gomaxprocs must be a positive number", http.StatusBadRequest)
+					return
+				}
+			}
+
+			if q.Get("gc_percent") != "" {
+				setGCPercent(gcp)
+				log.Infof("profiling: gc percent set to %d", gcp)
+			}
+			if limit > 0 {
+				setMemoryLimit(limit)
+				log.Infof("profiling: memory limit set to %d bytes", limit)
+			}
+			if procs > 0 {
+				runtime.GOMAXPROCS(procs)
+				log.Infof("profiling: gomaxprocs set to %d", procs)
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(ReadRuntime())
+		if err != nil {
+			log.Errorf("profiling: writing runtime: %s", err.Error())
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package profiling
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuntimeHandler(t *testing.T) {
+	procs := runtime.GOMAXPROCS(0)
+	gcp := gcPercent()
+	defer runtime.GOMAXPROCS(procs)
+	defer setGCPercent(gcp)
+
+	h := RuntimeHandler()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, RuntimePath+"?gc_percent=42&gomaxprocs=1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var rt Runtime
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rt))
+	assert.Equal(t, 42, rt.GCPercent)
+	assert.Equal(t, 1, rt.GOMAXPROCS)
+	assert.Equal(t, 42, gcPercent())
+
+	// nothing changes if any setting is invalid
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, RuntimePath+"?gc_percent=50&gomaxprocs=0", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 42, gcPercent())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, RuntimePath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestHeapWatcher(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHeapWatcher(dir, 1) // any heap is over the watermark
+	h.Keep = 2
+
+	h.check()
+	h.check() // within the cooldown, no profile
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	for i := 0; i < 3; i++ {
+		_, err = h.WriteProfile()
+		require.NoError(t, err)
+	}
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	Register(mux, "secret")
+
+	for _, token := range []string{"", "wrong"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, RuntimePath+"?gomaxprocs=1", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		mux.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, RuntimePath, nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// nothing is served without a token
+	empty := http.NewServeMux()
+	Register(empty, "")
+	w = httptest.NewRecorder()
+	empty.ServeHTTP(w, httptest.NewRequest(http.MethodGet, RuntimePath, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
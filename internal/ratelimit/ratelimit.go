@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+// ErrStopped is returned by Wait when the stop channel closes
+var ErrStopped = errors.Base("stopped")
+
+// Limiter sleeps as needed to keep the average rate since it was created under a limit. It is safe to use from
+// several goroutines.
+type Limiter struct {
+	stopCh stop.Chan
+
+	mu          sync.Mutex
+	bytesPerSec int64
+	burstBytes  int64 // 0 keeps the average since the limiter was created or its rate was set
+	burst       time.Duration
+	next        time.Time // when the bytes counted so far fit in the limit
+}
+
+// New returns a limiter for bytesPerSec. 0 means no limit. Waits end early when stopCh closes
+func New(bytesPerSec int64, stopCh stop.Chan) *Limiter {
+	return &Limiter{bytesPerSec: bytesPerSec, next: time.Now(), stopCh: stopCh}
+}
+
+// NewBurst returns a limiter that only keeps the rate over the recent past instead of since it was created, so a
+// long idle period doesn't allow more than burst bytes to go through at full speed afterwards
+func NewBurst(bytesPerSec, burst int64, stopCh stop.Chan) *Limiter {
+	l := New(bytesPerSec, stopCh)
+	l.burstBytes = burst
+	l.setBurst()
+	return l
+}
+
+// SetRate changes the limit to bytesPerSec, 0 meaning no limit, and the burst like NewBurst. A burst of 0 keeps the
+// average since the change. Bytes counted before are forgotten
+func (l *Limiter) SetRate(bytesPerSec, burst int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bytesPerSec = bytesPerSec
+	l.burstBytes = burst
+	l.next = time.Now()
+	l.setBurst()
+}
+
+func (l *Limiter) setBurst() {
+	l.burst = 0
+	if l.bytesPerSec > 0 && l.burstBytes > 0 {
+		l.burst = l.duration(l.burstBytes)
+		if l.burst <= 0 {
+			l.burst = time.Nanosecond
+		}
+	}
+}
+
+func (l *Limiter) duration(n int64) time.Duration {
+	return time.Duration(float64(n) / float64(l.bytesPerSec) * float64(time.Second))
+}
+
+// Wait counts n more bytes and sleeps until they fit in the limit
+func (l *Limiter) Wait(n int) error {
+	if l == nil {
+		return nil
+	}
+	var delay time.Duration
+	l.mu.Lock()
+	if l.bytesPerSec > 0 {
+		now := time.Now()
+		if l.burst > 0 && l.next.Before(now.Add(-l.burst)) {
+			l.next = now.Add(-l.burst)
+		}
+		l.next = l.next.Add(l.duration(int64(n)))
+		delay = l.next.Sub(now)
+	}
+	l.mu.Unlock()
+	if delay <= 0 {
+		select {
+		case <-l.stopCh:
+			return errors.Err(ErrStopped)
+		default:
+			return nil
+		}
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-l.stopCh:
+		return errors.Err(ErrStopped)
+	case <-t.C:
+		return nil
+	}
+}
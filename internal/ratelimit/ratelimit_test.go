@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Burst(t *testing.T) {
+	const rate = 10 * 1024 * 1024
+
+	unlimited := New(rate, nil)
+	burst := NewBurst(rate, rate/10, nil)
+	time.Sleep(300 * time.Millisecond)
+
+	// after being idle, the plain limiter lets 3MB through at once, the burst one only 1MB
+	start := time.Now()
+	if err := unlimited.Wait(2 * 1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected no wait, waited %s", elapsed)
+	}
+
+	start = time.Now()
+	if err := burst.Wait(2 * 1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected to wait about 100ms, waited %s", elapsed)
+	}
+}
+
+func TestLimiter_SetRate(t *testing.T) {
+	l := New(0, nil)
+	start := time.Now()
+	if err := l.Wait(10 * 1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	l.SetRate(10*1024*1024, 0)
+	if err := l.Wait(1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("expected to wait about 100ms for the new rate only, waited %s", elapsed)
+	}
+
+	l.SetRate(0, 0)
+	start = time.Now()
+	if err := l.Wait(100 * 1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected no wait without a limit, waited %s", elapsed)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	data := bytes.Repeat([]byte("x"), 3*writerChunkSize+10)
+
+	start := time.Now()
+	n, err := NewWriter(&buf, nil, NewBurst(int64(len(data))*5, 1, nil)).Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) || !bytes.Equal(buf.Bytes(), data) {
+		t.Error("written data does not match")
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected the write to take about 200ms, took %s", elapsed)
+	}
+}
@@ -0,0 +1,42 @@
+package ratelimit
+
+import (
+	"io"
+)
+
+// writerChunkSize is how much is written at once, so that large writes are spread out instead of waiting once and
+// then sending everything in a burst
+const writerChunkSize = 32 * 1024
+
+// Writer writes in chunks, waiting for each chunk to fit in the limits of all its limiters
+type Writer struct {
+	w        io.Writer
+	limiters []*Limiter
+}
+
+// NewWriter returns a writer that shapes writes to w. nil limiters are skipped
+func NewWriter(w io.Writer, limiters ...*Limiter) *Writer {
+	return &Writer{w: w, limiters: limiters}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > writerChunkSize {
+			chunk = chunk[:writerChunkSize]
+		}
+		for _, l := range w.limiters {
+			err := l.Wait(len(chunk))
+			if err != nil {
+				return written, err
+			}
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,183 @@
+// Package routingtable saves the routing table of a dht node to a file, so a restarted node rejoins the dht through
+// the nodes it knew before instead of bootstrapping from the seed nodes alone. The dht library doesn't export the
+// routing table, so it's read and refilled through the rpc server of the node. Table is a routing table for the dht
+// nodes of this repo, which keeps itself healthy under churn.
+package routingtable
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/dhtadmin"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultInterval is how often the routing table is saved
+	DefaultInterval = 5 * time.Minute
+	// JoinSeeds is how many of the saved nodes are pinged as seed nodes when the node starts. The seeds are pinged one
+	// at a time, so a lot of saved nodes that went away would hold up the start. The others are added to the routing
+	// table once the node runs
+	JoinSeeds = 8
+
+	rpcStartTimeout = 5 * time.Second
+)
+
+// savedContact is a contact in the file
+type savedContact struct {
+	ID   string `json:"id"`
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+}
+
+// Load returns the contacts saved in path. There are none if the file doesn't exist
+func Load(path string) ([]dht.Contact, error) {
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Err(err)
+	}
+	var saved []savedContact
+	err = json.Unmarshal(raw, &saved)
+	if err != nil {
+		return nil, errors.Prefix("routing table in "+path, err)
+	}
+	contacts := make([]dht.Contact, 0, len(saved))
+	for _, s := range saved {
+		id, err := bits.FromHex(s.ID)
+		ip := net.ParseIP(s.IP)
+		if err != nil || ip == nil || s.Port <= 0 {
+			log.Warnf("skipping bad contact %s@%s:%d in %s", s.ID, s.IP, s.Port, path)
+			continue
+		}
+		contacts = append(contacts, dht.Contact{ID: id, IP: ip, Port: s.Port})
+	}
+	return contacts, nil
+}
+
+// Seeds splits the contacts into the addresses of the first JoinSeeds of them, to add to the seed nodes of the dht
+// config, and the rest, to Restore once the node runs
+func Seeds(contacts []dht.Contact) ([]string, []dht.Contact) {
+	n := JoinSeeds
+	if n > len(contacts) {
+		n = len(contacts)
+	}
+	seeds := make([]string, 0, n)
+	for _, c := range contacts[:n] {
+		seeds = append(seeds, c.Addr().String())
+	}
+	return seeds, contacts[n:]
+}
+
+// Restore adds the contacts to the routing table of the node whose rpc server listens on rpcAddr. The node starts its
+// rpc server after it joined the dht, so Restore waits up to rpcStartTimeout for it
+func Restore(rpcAddr string, contacts []dht.Contact) error {
+	client := dhtadmin.NewClient(rpcAddr)
+	for i, c := range contacts {
+		var result string
+		err := client.CallInto("rpc.AddKnownNode", c, &result)
+		for start := time.Now(); err != nil && i == 0 && time.Since(start) < rpcStartTimeout; {
+			time.Sleep(rpcStartTimeout / 20)
+			err = client.CallInto("rpc.AddKnownNode", c, &result)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Saver saves the routing table of a dht node to a file while the node runs
+type Saver struct {
+	// Interval is how often the routing table is saved
+	Interval time.Duration
+
+	path string
+	rpc  *dhtadmin.Client
+	grp  *stop.Group
+}
+
+// NewSaver returns a saver for the node whose rpc server listens on rpcAddr, like 127.0.0.1:5678
+func NewSaver(rpcAddr, path string) *Saver {
+	return &Saver{
+		Interval: DefaultInterval,
+		path:     path,
+		rpc:      dhtadmin.NewClient(rpcAddr),
+		grp:      stop.New(),
+	}
+}
+
+// Start saves the routing table every Interval
+func (s *Saver) Start() {
+	s.grp.Add(1)
+	go func() {
+		defer s.grp.Done()
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.grp.Ch():
+				return
+			case <-ticker.C:
+				err := s.Save()
+				if err != nil {
+					log.Errorf("saving the routing table: %s", errors.FullTrace(err))
+				}
+			}
+		}
+	}()
+}
+
+// Shutdown stops saving and saves the routing table one last time. Call it before the node shuts down
+func (s *Saver) Shutdown() {
+	s.grp.StopAndWait()
+	err := s.Save()
+	if err != nil {
+		log.Errorf("saving the routing table: %s", errors.FullTrace(err))
+	}
+}
+
+// Save writes the contacts in the routing table to the file. An empty routing table is not saved, so a node that lost
+// its network doesn't forget the nodes it knew
+func (s *Saver) Save() error {
+	var rt dht.RpcRoutingTableResponse
+	err := s.rpc.CallInto("rpc.GetRoutingTable", struct{}{}, &rt)
+	if err != nil {
+		return err
+	}
+	var saved []savedContact
+	for _, b := range rt.Buckets {
+		for _, c := range b.Contacts {
+			saved = append(saved, savedContact{ID: c.ID.Hex(), IP: c.IP.String(), Port: c.Port})
+		}
+	}
+	if len(saved) == 0 {
+		return nil
+	}
+	raw, err := json.Marshal(saved)
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	// write to a temporary file first, so a crash can't leave half a routing table behind
+	err = os.MkdirAll(filepath.Dir(s.path), 0755)
+	if err != nil {
+		return errors.Err(err)
+	}
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, raw, 0644)
+	if err != nil {
+		return errors.Err(err)
+	}
+	return errors.Err(os.Rename(tmp, s.path))
+}
@@ -0,0 +1,81 @@
+package routingtable
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+
+	"github.com/phayes/freeport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// node is a dht node on localhost, with the address of its rpc server
+type node struct {
+	*dht.DHT
+	addr    string
+	rpcAddr string
+}
+
+// startNode starts a dht node that joins through the seeds
+func startNode(t *testing.T, seeds ...string) node {
+	port, err := freeport.GetFreePort()
+	require.NoError(t, err)
+	rpcPort, err := freeport.GetFreePort()
+	require.NoError(t, err)
+	conf := dht.NewStandardConfig()
+	conf.Address = "127.0.0.1:" + strconv.Itoa(port)
+	conf.RPCPort = rpcPort
+	conf.SeedNodes = seeds
+	d := dht.New(conf)
+	require.NoError(t, d.Start())
+	t.Cleanup(d.Shutdown)
+	return node{DHT: d, addr: conf.Address, rpcAddr: "127.0.0.1:" + strconv.Itoa(rpcPort)}
+}
+
+// saved saves the routing table of n and returns the ids of the saved nodes
+func saved(t *testing.T, n node, path string) []bits.Bitmap {
+	// the rpc server starts after the node joined
+	s := NewSaver(n.rpcAddr, path)
+	require.Eventually(t, func() bool { return s.Save() == nil }, 5*time.Second, 50*time.Millisecond)
+	contacts, err := Load(path)
+	require.NoError(t, err)
+	var ids []bits.Bitmap
+	for _, c := range contacts {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+func TestSaver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rt.json")
+	seed := startNode(t)
+	other := startNode(t)
+	extra := startNode(t)
+	n := startNode(t, seed.addr, other.addr)
+
+	extraAddr, err := net.ResolveUDPAddr("udp", extra.addr)
+	require.NoError(t, err)
+	require.NoError(t, Restore(n.rpcAddr, []dht.Contact{{ID: extra.ID(), IP: extraAddr.IP, Port: extraAddr.Port}}))
+	assert.ElementsMatch(t, []bits.Bitmap{seed.ID(), other.ID(), extra.ID()}, saved(t, n, path))
+
+	// a restarted node joins through the saved nodes
+	contacts, err := Load(path)
+	require.NoError(t, err)
+	seeds, rest := Seeds(contacts)
+	assert.Len(t, seeds, 3)
+	assert.Empty(t, rest)
+	restarted := startNode(t, seeds...)
+	assert.ElementsMatch(t, []bits.Bitmap{seed.ID(), other.ID(), extra.ID()}, saved(t, restarted, path))
+}
+
+func TestLoad_NoFile(t *testing.T) {
+	contacts, err := Load(filepath.Join(t.TempDir(), "rt.json"))
+	require.NoError(t, err)
+	assert.Empty(t, contacts)
+}
@@ -0,0 +1,356 @@
+package routingtable
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/bitmap"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// BucketSize is how many nodes a bucket holds, like in the dht package
+	BucketSize = 8
+	// DefaultRefreshInterval is how long a bucket can go without news of its nodes before it's refreshed, like in the
+	// dht package
+	DefaultRefreshInterval = time.Hour
+	// DefaultPingInterval is how long a node can go unheard before it's questionable and pinged
+	DefaultPingInterval = 15 * time.Minute
+	// DefaultPingBackoff is how long a node that didn't answer a ping has until the next one. It doubles with each ping
+	// the node misses
+	DefaultPingBackoff = 30 * time.Second
+	// DefaultMaxFailures is how many requests in a row a node can miss before it's dropped, like in the dht package
+	DefaultMaxFailures = 3
+
+	// tick is how often Run looks for nodes to ping and buckets to refresh
+	tick = 5 * time.Second
+)
+
+// TableConfig configures a Table. The zero value is the defaults
+type TableConfig struct {
+	// RefreshInterval is how long a bucket can go without news of its nodes before Run looks up a random id in it.
+	// DefaultRefreshInterval if 0
+	RefreshInterval time.Duration
+	// PingInterval is how long a node can go unheard before Run pings it. DefaultPingInterval if 0
+	PingInterval time.Duration
+	// PingBackoff is how long a node that missed a request has until it's pinged again, doubled for each request it
+	// missed since it was last heard from. DefaultPingBackoff if 0
+	PingBackoff time.Duration
+	// MaxFailures is how many requests in a row a node can miss before it's replaced by a node of the replacement
+	// cache of its bucket. DefaultMaxFailures if 0
+	MaxFailures int
+}
+
+// Table is a kademlia routing table. The nodes that answer a request are added to the bucket of their id. A full
+// bucket is split if it holds the id of the table, and otherwise keeps the node in its replacement cache, so there's a
+// node to take the place of one that stops answering. Nodes that go unheard are pinged, less and less often as they
+// miss pings, and dropped once they missed MaxFailures in a row. Buckets that go without news are refreshed with a
+// lookup in their range, so the table keeps track of the whole dht and not just of the nodes it asks all the time
+type Table struct {
+	conf TableConfig
+	self bits.Bitmap
+
+	mu sync.Mutex
+	// buckets cover the whole id space, lowest range first
+	buckets []*bucket
+	now     func() time.Time
+}
+
+// bucket holds the nodes in a range of ids
+type bucket struct {
+	r bits.Range
+	// contacts are the nodes of the bucket, the one heard from longest ago first
+	contacts []*contact
+	// replacements are nodes that were heard from while the bucket was full, the one heard from last at the end
+	replacements []dht.Contact
+	// updated is when the bucket last had news of one of its nodes, or was refreshed
+	updated time.Time
+}
+
+// contact is a node of a bucket
+type contact struct {
+	dht.Contact
+	// failures is how many requests in a row the node missed
+	failures int
+	// next is when the node is pinged next, if it's not heard from before
+	next time.Time
+}
+
+// NewTable returns an empty routing table of the node with the id
+func NewTable(self bits.Bitmap, conf TableConfig) *Table {
+	if conf.RefreshInterval <= 0 {
+		conf.RefreshInterval = DefaultRefreshInterval
+	}
+	if conf.PingInterval <= 0 {
+		conf.PingInterval = DefaultPingInterval
+	}
+	if conf.PingBackoff <= 0 {
+		conf.PingBackoff = DefaultPingBackoff
+	}
+	if conf.MaxFailures <= 0 {
+		conf.MaxFailures = DefaultMaxFailures
+	}
+	t := &Table{conf: conf, self: self, now: time.Now}
+	t.buckets = []*bucket{{r: bits.MaxRange(), updated: t.now()}}
+	return t
+}
+
+// Update records that c answered a request. It's added to the table if there's room for it
+func (t *Table) Update(c dht.Contact) {
+	if c.ID == t.self {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	for {
+		b := t.bucket(c.ID)
+		if i := b.index(c.ID); i >= 0 {
+			t.seen(b, i, c)
+			return
+		}
+		if len(b.contacts) < BucketSize {
+			b.contacts = append(b.contacts, &contact{Contact: c, next: now.Add(t.conf.PingInterval)})
+			b.removeReplacement(c.ID)
+			b.updated = now
+			return
+		}
+		if !b.r.Contains(t.self) || !t.split(b) {
+			b.addReplacement(c)
+			return
+		}
+	}
+}
+
+// Touch records that c sent a request. Only nodes that answer requests go into the table, so c is only marked as heard
+// from if it's in the table already, at the same address
+func (t *Table) Touch(c dht.Contact) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucket(c.ID)
+	i := b.index(c.ID)
+	if i < 0 || !b.contacts[i].IP.Equal(c.IP) || b.contacts[i].Port != c.Port {
+		return
+	}
+	t.seen(b, i, c)
+}
+
+// seen marks the ith node of b as heard from at c, and moves it to the end of the bucket. The lock must be held
+func (t *Table) seen(b *bucket, i int, c dht.Contact) {
+	now := t.now()
+	existing := b.contacts[i]
+	existing.Contact, existing.failures = c, 0
+	existing.next = now.Add(t.conf.PingInterval)
+	b.contacts = append(append(b.contacts[:i], b.contacts[i+1:]...), existing)
+	b.updated = now
+}
+
+// Fail records that c missed a request. It's pinged again after a backoff, and replaced once it missed MaxFailures
+// requests in a row
+func (t *Table) Fail(c dht.Contact) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucket(c.ID)
+	i := b.index(c.ID)
+	if i < 0 {
+		b.removeReplacement(c.ID)
+		return
+	}
+	existing := b.contacts[i]
+	existing.failures++
+	if existing.failures < t.conf.MaxFailures {
+		existing.next = t.now().Add(t.conf.PingBackoff << uint(existing.failures-1))
+		return
+	}
+	b.contacts = append(b.contacts[:i], b.contacts[i+1:]...)
+	if n := len(b.replacements); n > 0 {
+		// the replacement heard from last is the most likely to still be there
+		r := b.replacements[n-1]
+		b.replacements = b.replacements[:n-1]
+		// it wasn't heard from since it went into the cache, so it's pinged right away
+		b.contacts = append([]*contact{{Contact: r, next: t.now()}}, b.contacts...)
+	}
+}
+
+// Closest returns up to n nodes of the table closest to target, closest first. Nodes that missed a request are left
+// out if there are enough others
+func (t *Table) Closest(target bits.Bitmap, n int) []dht.Contact {
+	t.mu.Lock()
+	var good, failing []dht.Contact
+	for _, b := range t.buckets {
+		for _, c := range b.contacts {
+			if c.failures == 0 {
+				good = append(good, c.Contact)
+			} else {
+				failing = append(failing, c.Contact)
+			}
+		}
+	}
+	t.mu.Unlock()
+	for _, l := range [][]dht.Contact{good, failing} {
+		sort.Slice(l, func(i, j int) bool { return bitmap.DistanceCmp(target, l[i].ID, l[j].ID) < 0 })
+	}
+	closest := append(good, failing...)
+	if len(closest) > n {
+		closest = closest[:n]
+	}
+	return closest
+}
+
+// Len returns how many nodes are in the table, not counting the replacement caches
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, b := range t.buckets {
+		n += len(b.contacts)
+	}
+	return n
+}
+
+// Due returns the nodes that are due for a ping, and a random id in each bucket that is due for a refresh. The buckets
+// due for a refresh count as refreshed
+func (t *Table) Due() ([]dht.Contact, []bits.Bitmap) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	var ping []dht.Contact
+	var refresh []bits.Bitmap
+	for _, b := range t.buckets {
+		for _, c := range b.contacts {
+			if !now.Before(c.next) {
+				ping = append(ping, c.Contact)
+				// a ping that gets lost without a call to Update or Fail doesn't leave the node due on every tick
+				c.next = now.Add(t.conf.PingBackoff << uint(c.failures))
+			}
+		}
+		if now.Sub(b.updated) >= t.conf.RefreshInterval {
+			id, err := bitmap.RandInRange(b.r)
+			if err == nil {
+				refresh = append(refresh, id)
+			}
+			b.updated = now
+		}
+	}
+	return ping, refresh
+}
+
+// Run pings the nodes and refreshes the buckets that are due, until stopCh is closed. ping returns whether the node
+// answered. refresh looks up target, and is expected to Update the table with the nodes that answer
+func (t *Table) Run(ping func(c dht.Contact) bool, refresh func(target bits.Bitmap), stopCh stop.Chan) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		t.Maintain(ping, refresh)
+	}
+}
+
+// Maintain pings the nodes and refreshes the buckets that are due once, and waits for them
+func (t *Table) Maintain(ping func(c dht.Contact) bool, refresh func(target bits.Bitmap)) {
+	due, targets := t.Due()
+	var wg sync.WaitGroup
+	for _, c := range due {
+		wg.Add(1)
+		go func(c dht.Contact) {
+			defer wg.Done()
+			if ping(c) {
+				t.Update(c)
+			} else {
+				t.Fail(c)
+			}
+		}(c)
+	}
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target bits.Bitmap) {
+			defer wg.Done()
+			refresh(target)
+		}(target)
+	}
+	wg.Wait()
+	if len(due) > 0 || len(targets) > 0 {
+		log.Debugf("routing table: pinged %d nodes and refreshed %d buckets, %d nodes left", len(due), len(targets), t.Len())
+	}
+}
+
+// bucket returns the bucket of id. The lock must be held
+func (t *Table) bucket(id bits.Bitmap) *bucket {
+	for _, b := range t.buckets {
+		if b.r.Contains(id) {
+			return b
+		}
+	}
+	// the buckets cover the whole id space
+	panic("no bucket for " + id.Hex())
+}
+
+// split splits b in two, and returns false if its range is a single id. The lock must be held
+func (t *Table) split(b *bucket) bool {
+	lower, upper, ok := bitmap.Split(b.r)
+	if !ok {
+		return false
+	}
+	lo, hi := &bucket{r: lower, updated: b.updated}, &bucket{r: upper, updated: b.updated}
+	for _, c := range b.contacts {
+		if lower.Contains(c.ID) {
+			lo.contacts = append(lo.contacts, c)
+		} else {
+			hi.contacts = append(hi.contacts, c)
+		}
+	}
+	for _, r := range b.replacements {
+		if lower.Contains(r.ID) {
+			lo.replacements = append(lo.replacements, r)
+		} else {
+			hi.replacements = append(hi.replacements, r)
+		}
+	}
+	for i := range t.buckets {
+		if t.buckets[i] == b {
+			t.buckets = append(t.buckets[:i], append([]*bucket{lo, hi}, t.buckets[i+1:]...)...)
+			break
+		}
+	}
+	return true
+}
+
+// index returns the index of the node with the id in the bucket, or -1
+func (b *bucket) index(id bits.Bitmap) int {
+	for i, c := range b.contacts {
+		if c.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// addReplacement puts c at the end of the replacement cache, dropping the replacement heard from longest ago if the
+// cache is full
+func (b *bucket) addReplacement(c dht.Contact) {
+	b.removeReplacement(c.ID)
+	b.replacements = append(b.replacements, c)
+	if len(b.replacements) > BucketSize {
+		b.replacements = b.replacements[1:]
+	}
+}
+
+// removeReplacement removes the node with the id from the replacement cache
+func (b *bucket) removeReplacement(id bits.Bitmap) {
+	for i, r := range b.replacements {
+		if r.ID == id {
+			b.replacements = append(b.replacements[:i], b.replacements[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package routingtable
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clock is a time that tests move forward
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestTable(conf TableConfig) (*Table, *clock) {
+	c := &clock{t: time.Unix(1600000000, 0)}
+	t := NewTable(bits.Bitmap{}, conf)
+	t.now = c.now
+	t.buckets[0].updated = c.now()
+	return t, c
+}
+
+// far returns a contact in the half of the id space away from the zero id of the test tables
+func far(i int) dht.Contact {
+	id := bits.Rand()
+	id[0] |= 0x80
+	return dht.Contact{ID: id, IP: net.IPv4(10, 0, 0, byte(i)), Port: 4444}
+}
+
+func ids(contacts []dht.Contact) map[bits.Bitmap]bool {
+	m := make(map[bits.Bitmap]bool)
+	for _, c := range contacts {
+		m[c.ID] = true
+	}
+	return m
+}
+
+func TestTable_ReplacementCache(t *testing.T) {
+	table, _ := newTestTable(TableConfig{})
+	var contacts []dht.Contact
+	for i := 0; i < 3*BucketSize; i++ {
+		contacts = append(contacts, far(i))
+		table.Update(contacts[i])
+	}
+	// the far half is a single bucket without the id of the table, so it doesn't split
+	assert.Equal(t, BucketSize, table.Len())
+	all := ids(table.Closest(bits.Bitmap{}, 100))
+	for _, c := range contacts[:BucketSize] {
+		assert.True(t, all[c.ID], "expected the first nodes to stay in the bucket")
+	}
+
+	// the node that keeps missing requests is replaced by the replacement heard from last
+	dead := contacts[0]
+	for i := 0; i < DefaultMaxFailures; i++ {
+		table.Fail(dead)
+	}
+	assert.Equal(t, BucketSize, table.Len())
+	all = ids(table.Closest(bits.Bitmap{}, 100))
+	assert.False(t, all[dead.ID])
+	assert.True(t, all[contacts[len(contacts)-1].ID])
+
+	b := table.bucket(dead.ID)
+	assert.Len(t, b.replacements, BucketSize-1, "the cache holds the last BucketSize nodes, minus the one that moved up")
+}
+
+func TestTable_Split(t *testing.T) {
+	table, _ := newTestTable(TableConfig{})
+	for i := 0; i < 100; i++ {
+		c := dht.Contact{ID: bits.Rand(), IP: net.IPv4(10, 0, 0, byte(i)), Port: 4444}
+		table.Update(c)
+	}
+	require.Greater(t, len(table.buckets), 1)
+	// only the buckets with the id of the table split, so there's one bucket per prefix length
+	for i, b := range table.buckets {
+		assert.LessOrEqual(t, len(b.contacts), BucketSize)
+		for _, c := range b.contacts {
+			assert.True(t, b.r.Contains(c.ID))
+		}
+		if i > 0 {
+			next := table.buckets[i-1].r.End.Add(bits.FromShortHexP("1"))
+			assert.Equal(t, next, b.r.Start, "buckets must not overlap or leave gaps")
+		}
+	}
+	assert.Greater(t, table.Len(), BucketSize)
+}
+
+func TestTable_PingBackoff(t *testing.T) {
+	conf := TableConfig{PingInterval: time.Minute, PingBackoff: 10 * time.Second, MaxFailures: 4}
+	table, clk := newTestTable(conf)
+	c := far(1)
+	table.Update(c)
+
+	pinged := 0
+	answer := false
+	ping := func(dht.Contact) bool {
+		pinged++
+		return answer
+	}
+	noRefresh := func(bits.Bitmap) {}
+
+	table.Maintain(ping, noRefresh)
+	assert.Equal(t, 0, pinged, "a node that was just heard from isn't pinged")
+
+	clk.advance(time.Minute)
+	table.Maintain(ping, noRefresh)
+	assert.Equal(t, 1, pinged, "a node that went unheard for the ping interval is pinged")
+
+	// each missed ping doubles the wait for the next one
+	for i, wait := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second} {
+		clk.advance(wait - time.Second)
+		table.Maintain(ping, noRefresh)
+		assert.Equal(t, i+1, pinged, "pinged before the backoff was over")
+		clk.advance(time.Second)
+		table.Maintain(ping, noRefresh)
+		assert.Equal(t, i+2, pinged, "not pinged after a backoff of %s", wait)
+	}
+	assert.Equal(t, 0, table.Len(), "expected the node to be dropped after 4 missed pings")
+
+	// a node that answers goes back to the ping interval
+	table.Update(c)
+	clk.advance(time.Minute)
+	table.Fail(c)
+	clk.advance(10 * time.Second)
+	answer = true
+	table.Maintain(ping, noRefresh)
+	assert.Equal(t, 5, pinged)
+	clk.advance(time.Minute - time.Second)
+	table.Maintain(ping, noRefresh)
+	assert.Equal(t, 5, pinged)
+	assert.Equal(t, 1, table.Len())
+}
+
+func TestTable_Refresh(t *testing.T) {
+	table, clk := newTestTable(TableConfig{RefreshInterval: time.Hour, PingInterval: 24 * time.Hour})
+	for i := 0; i < 50; i++ {
+		table.Update(dht.Contact{ID: bits.Rand(), IP: net.IPv4(10, 0, 0, byte(i)), Port: 4444})
+	}
+	var mu sync.Mutex
+	var refreshed []bits.Bitmap
+	refresh := func(target bits.Bitmap) {
+		mu.Lock()
+		defer mu.Unlock()
+		refreshed = append(refreshed, target)
+	}
+	ping := func(dht.Contact) bool { return true }
+
+	table.Maintain(ping, refresh)
+	assert.Empty(t, refreshed)
+
+	clk.advance(time.Hour)
+	// news of a node keeps its bucket from being refreshed
+	fresh := table.Closest(bits.Bitmap{}, 1)[0]
+	table.Update(fresh)
+	table.Maintain(ping, refresh)
+	assert.Len(t, refreshed, len(table.buckets)-1)
+	for _, target := range refreshed {
+		assert.False(t, table.bucket(target) == table.bucket(fresh.ID), "refreshed the bucket that had news")
+	}
+
+	refreshed = nil
+	table.Maintain(ping, refresh)
+	assert.Empty(t, refreshed, "a bucket is refreshed once per interval")
+}
+
+func TestTable_Closest(t *testing.T) {
+	table, _ := newTestTable(TableConfig{})
+	near := dht.Contact{ID: bits.FromShortHexP("100"), IP: net.IPv4(10, 0, 0, 1), Port: 4444}
+	nearer := dht.Contact{ID: bits.FromShortHexP("1"), IP: net.IPv4(10, 0, 0, 2), Port: 4444}
+	table.Update(far(3))
+	table.Update(near)
+	table.Update(nearer)
+	table.Update(dht.Contact{ID: bits.Bitmap{}, IP: net.IPv4(10, 0, 0, 4), Port: 4444})
+
+	closest := table.Closest(bits.Bitmap{}, 2)
+	require.Len(t, closest, 2, "the table never holds its own id")
+	assert.Equal(t, nearer.ID, closest[0].ID)
+	assert.Equal(t, near.ID, closest[1].ID)
+
+	// nodes that missed a request come after the others
+	table.Fail(nearer)
+	closest = table.Closest(bits.Bitmap{}, 3)
+	assert.Equal(t, nearer.ID, closest[2].ID)
+}
@@ -0,0 +1,242 @@
+// Package schedule changes how hard a reflector works with the time of day, so it can go easy on the network and disks
+// at peak hours and catch up at night. Each window of the day overrides some of the settings, and the default
+// settings apply outside of them.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	"github.com/c2h5oh/datasize"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkInterval is how often the scheduler checks whether another window started
+const checkInterval = time.Minute
+
+// Settings are what a window changes
+type Settings struct {
+	// MaxRate is how many bytes per second are sent to all clients together. 0 means no limit
+	MaxRate int64
+	// PrefetchStreams is how many popular streams a prefetch pass fetches. 0 pauses prefetching
+	PrefetchStreams int
+	// PrefetchMaxRate is how many bytes per second prefetching downloads. 0 means no limit
+	PrefetchMaxRate int64
+	// EvictPercent is how much of the disk cache is evicted at once when it's full, from 1 to 100
+	EvictPercent int
+}
+
+// Window is a time of day with its own settings. Settings that are nil keep their default
+type Window struct {
+	// Start and End are minutes since midnight, local time. The window may wrap around midnight
+	Start, End int
+
+	MaxRate         *int64
+	PrefetchStreams *int
+	PrefetchMaxRate *int64
+	EvictPercent    *int
+}
+
+// Name is the hours of the window, like 18:00-23:00
+func (w Window) Name() string {
+	return fmt.Sprintf("%d:%02d-%d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+// contains returns whether the minute of the day is in the window
+func (w Window) contains(minute int) bool {
+	if w.Start == w.End {
+		return true
+	}
+	if w.Start < w.End {
+		return minute >= w.Start && minute < w.End
+	}
+	return minute >= w.Start || minute < w.End
+}
+
+// apply returns the settings with the window's overrides
+func (w Window) apply(s Settings) Settings {
+	if w.MaxRate != nil {
+		s.MaxRate = *w.MaxRate
+	}
+	if w.PrefetchStreams != nil {
+		s.PrefetchStreams = *w.PrefetchStreams
+	}
+	if w.PrefetchMaxRate != nil {
+		s.PrefetchMaxRate = *w.PrefetchMaxRate
+	}
+	if w.EvictPercent != nil {
+		s.EvictPercent = *w.EvictPercent
+	}
+	return s
+}
+
+// Parse parses windows from a semicolon separated list of HOURS SETTINGS, like
+// "18-23 max_rate=50MB,prefetch_streams=0,evict_percent=2; 1:30-6 max_rate=0,evict_percent=20". Hours are H or H:MM,
+// local time. The settings are max_rate, prefetch_streams, prefetch_max_rate and evict_percent. The first window that
+// contains a time is used
+func Parse(spec string) ([]Window, error) {
+	var windows []Window
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.SplitN(part, " ", 2)
+		hours := strings.SplitN(fields[0], "-", 2)
+		if len(hours) != 2 {
+			return nil, errors.Err("schedule windows look like START-END SETTINGS, not '%s'", part)
+		}
+		settings := ""
+		if len(fields) == 2 {
+			settings = fields[1]
+		}
+		var w Window
+		var err error
+		if w.Start, err = parseTime(hours[0]); err != nil {
+			return nil, err
+		}
+		if w.End, err = parseTime(hours[1]); err != nil {
+			return nil, err
+		}
+		for _, setting := range strings.Split(settings, ",") {
+			setting = strings.TrimSpace(setting)
+			if setting == "" {
+				continue
+			}
+			if err := w.set(setting); err != nil {
+				return nil, err
+			}
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func (w *Window) set(setting string) error {
+	kv := strings.SplitN(setting, "=", 2)
+	if len(kv) != 2 {
+		return errors.Err("schedule settings look like NAME=VALUE, not '%s'", setting)
+	}
+	key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+	switch key {
+	case "max_rate", "prefetch_max_rate":
+		var rate datasize.ByteSize
+		if err := rate.UnmarshalText([]byte(value)); err != nil {
+			return errors.Err("schedule %s must be a size like 50MB, not '%s'", key, value)
+		}
+		r := int64(rate)
+		if key == "max_rate" {
+			w.MaxRate = &r
+		} else {
+			w.PrefetchMaxRate = &r
+		}
+	case "prefetch_streams", "evict_percent":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return errors.Err("schedule %s must be a number, not '%s'", key, value)
+		}
+		if key == "evict_percent" && (n < 1 || n > 100) {
+			return errors.Err("schedule evict_percent must be from 1 to 100, not '%s'", value)
+		}
+		if key == "prefetch_streams" {
+			w.PrefetchStreams = &n
+		} else {
+			w.EvictPercent = &n
+		}
+	default:
+		return errors.Err("unknown schedule setting '%s'", key)
+	}
+	return nil
+}
+
+// parseTime parses H or H:MM into minutes since midnight
+func parseTime(s string) (int, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, errors.Err("schedule hours must look like 18 or 18:30, not '%s'", s)
+	}
+	m := 0
+	if len(parts) == 2 {
+		m, err = strconv.Atoi(parts[1])
+		if err != nil || m < 0 || m > 59 || h == 24 {
+			return 0, errors.Err("schedule hours must look like 18 or 18:30, not '%s'", s)
+		}
+	}
+	return (h*60 + m) % (24 * 60), nil
+}
+
+// Scheduler applies the settings of the window the time of day is in
+type Scheduler struct {
+	// Default are the settings outside of the windows
+	Default Settings
+	// OnChange is called with the new settings when a window starts or ends, and once when the scheduler starts.
+	// window is the name of the window, or "" for the default settings
+	OnChange func(window string, s Settings)
+
+	windows []Window
+	current int
+	grp     *stop.Group
+}
+
+// New returns a scheduler for the windows
+func New(windows []Window) *Scheduler {
+	return &Scheduler{windows: windows, current: -2, grp: stop.New()}
+}
+
+// At returns the settings at time t, and the index of the window t is in, or -1
+func (s *Scheduler) At(t time.Time) (Settings, int) {
+	minute := t.Hour()*60 + t.Minute()
+	for i, w := range s.windows {
+		if w.contains(minute) {
+			return w.apply(s.Default), i
+		}
+	}
+	return s.Default, -1
+}
+
+// Start applies the current settings, and then checks for the next window in the background
+func (s *Scheduler) Start() {
+	s.check(time.Now())
+	s.grp.Add(1)
+	go func() {
+		defer s.grp.Done()
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.grp.Ch():
+				return
+			case now := <-ticker.C:
+				s.check(now)
+			}
+		}
+	}()
+}
+
+// Shutdown stops the scheduler. The last settings stay applied
+func (s *Scheduler) Shutdown() {
+	s.grp.StopAndWait()
+}
+
+func (s *Scheduler) check(now time.Time) {
+	settings, i := s.At(now)
+	if i == s.current {
+		return
+	}
+	s.current = i
+	name, logged := "", "default"
+	if i >= 0 {
+		name = s.windows[i].Name()
+		logged = name
+	}
+	log.Infof("schedule: %s settings apply: %+v", logged, settings)
+	if s.OnChange != nil {
+		s.OnChange(name, settings)
+	}
+}
@@ -0,0 +1,54 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduler_At(t *testing.T) {
+	windows, err := Parse("18-23 max_rate=50MB,prefetch_streams=0,evict_percent=2; 22:30-6 max_rate=0,prefetch_streams=500,evict_percent=20")
+	require.NoError(t, err)
+	require.Len(t, windows, 2)
+	assert.Equal(t, "22:30-6:00", windows[1].Name())
+
+	s := New(windows)
+	s.Default = Settings{MaxRate: 100, PrefetchStreams: 10, PrefetchMaxRate: 5, EvictPercent: 10}
+	at := func(hour, minute int) time.Time { return time.Date(2021, 4, 1, hour, minute, 0, 0, time.Local) }
+
+	settings, i := s.At(at(12, 0))
+	assert.Equal(t, -1, i)
+	assert.Equal(t, s.Default, settings)
+
+	settings, i = s.At(at(22, 45))
+	assert.Equal(t, 0, i, "the first window wins where they overlap")
+	assert.Equal(t, Settings{MaxRate: 50 * 1024 * 1024, PrefetchStreams: 0, PrefetchMaxRate: 5, EvictPercent: 2}, settings)
+
+	settings, i = s.At(at(3, 0))
+	assert.Equal(t, 1, i)
+	assert.Equal(t, Settings{MaxRate: 0, PrefetchStreams: 500, PrefetchMaxRate: 5, EvictPercent: 20}, settings)
+
+	var changes []string
+	s.OnChange = func(window string, _ Settings) { changes = append(changes, window) }
+	for _, t := range []time.Time{at(12, 0), at(13, 0), at(18, 0), at(23, 0), at(6, 0)} {
+		s.check(t)
+	}
+	assert.Equal(t, []string{"", "18:00-23:00", "22:30-6:00", ""}, changes)
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, spec := range []string{
+		"18 max_rate=1MB",
+		"18-25 max_rate=1MB",
+		"18:60-20 max_rate=1MB",
+		"18-20 max_rate=fast",
+		"18-20 evict_percent=0",
+		"18-20 speed=1",
+		"18-20 max_rate",
+	} {
+		_, err := Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,143 @@
+package shadow
+
+import (
+	"container/heap"
+	"container/list"
+	"strconv"
+
+	"github.com/lbryio/reflector.go/internal/tinylfu"
+
+	"github.com/lbryio/lbry.go/v2/stream"
+)
+
+type entry struct {
+	key  uint64
+	size int64
+}
+
+// lru evicts the blob that was used the longest time ago. Without moveOnHit, it's fifo and evicts the oldest blob
+type lru struct {
+	maxBytes, bytes int64
+	moveOnHit       bool
+	order           *list.List // front is the most recent
+	entries         map[uint64]*list.Element
+}
+
+func newLRU(maxBytes int64, moveOnHit bool) *lru {
+	return &lru{maxBytes: maxBytes, moveOnHit: moveOnHit, order: list.New(), entries: make(map[uint64]*list.Element)}
+}
+
+func (l *lru) access(key uint64, size int64) bool {
+	if e, ok := l.entries[key]; ok {
+		if l.moveOnHit {
+			l.order.MoveToFront(e)
+		}
+		return true
+	}
+	l.add(key, size)
+	return false
+}
+
+func (l *lru) add(key uint64, size int64) {
+	if size > l.maxBytes {
+		return
+	}
+	for l.bytes+size > l.maxBytes {
+		oldest := l.order.Back()
+		e := l.order.Remove(oldest).(entry)
+		delete(l.entries, e.key)
+		l.bytes -= e.size
+	}
+	l.entries[key] = l.order.PushFront(entry{key: key, size: size})
+	l.bytes += size
+}
+
+// lfu evicts the blob that was used the fewest times, and the one used the longest time ago of those
+type lfu struct {
+	maxBytes, bytes int64
+	clock           int64
+	heap            lfuHeap
+	entries         map[uint64]*lfuEntry
+}
+
+type lfuEntry struct {
+	entry
+	uses, lastUse int64
+	index         int
+}
+
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].uses != h[j].uses {
+		return h[i].uses < h[j].uses
+	}
+	return h[i].lastUse < h[j].lastUse
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+func newLFU(maxBytes int64) *lfu {
+	return &lfu{maxBytes: maxBytes, entries: make(map[uint64]*lfuEntry)}
+}
+
+func (l *lfu) access(key uint64, size int64) bool {
+	l.clock++
+	if e, ok := l.entries[key]; ok {
+		e.uses++
+		e.lastUse = l.clock
+		heap.Fix(&l.heap, e.index)
+		return true
+	}
+	if size > l.maxBytes {
+		return false
+	}
+	for l.bytes+size > l.maxBytes {
+		e := heap.Pop(&l.heap).(*lfuEntry)
+		delete(l.entries, e.key)
+		l.bytes -= e.size
+	}
+	e := &lfuEntry{entry: entry{key: key, size: size}, uses: 1, lastUse: l.clock}
+	heap.Push(&l.heap, e)
+	l.entries[key] = e
+	l.bytes += size
+	return false
+}
+
+// tinyLFU is an lru that only takes the blobs its admission filter lets in
+type tinyLFU struct {
+	*lru
+	filter *tinylfu.Filter
+}
+
+func newTinyLFU(maxBytes int64) *tinyLFU {
+	return &tinyLFU{lru: newLRU(maxBytes, true), filter: tinylfu.New(int(maxBytes / stream.MaxBlobSize))}
+}
+
+func (t *tinyLFU) access(key uint64, size int64) bool {
+	hash := strconv.FormatUint(key, 16)
+	if e, ok := t.entries[key]; ok {
+		t.filter.Record(hash, true)
+		t.order.MoveToFront(e)
+		return true
+	}
+	t.filter.Record(hash, false)
+	if t.filter.Admit(hash) {
+		t.add(key, size)
+	}
+	return false
+}
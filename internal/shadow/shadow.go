@@ -0,0 +1,185 @@
+// Package shadow simulates caches of other sizes and policies next to the real one. The simulated caches only keep
+// the hashes and sizes of the blobs they would hold, so many of them can run on production traffic, and report the
+// hit rate each one would have. Operators can then size disks and pick policies with data instead of guesses.
+package shadow
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/lbryio/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	"github.com/c2h5oh/datasize"
+	log "github.com/sirupsen/logrus"
+)
+
+// queueSize is how many requests can wait to be simulated. More are dropped, so the simulation never slows down the
+// requests
+const queueSize = 10000
+
+// Policies the caches can be simulated with
+const (
+	PolicyLRU  = "lru"
+	PolicyFIFO = "fifo"
+	PolicyLFU  = "lfu"
+	// PolicyTinyLFU is lru with the TinyLFU admission filter of --cache-admission
+	PolicyTinyLFU = "tinylfu"
+)
+
+// policy is a simulated cache
+type policy interface {
+	// access requests a blob, and returns whether the cache had it. Misses are added to the cache
+	access(key uint64, size int64) bool
+}
+
+// Stats are what a simulated cache would have served
+type Stats struct {
+	Name        string  `json:"name"`
+	Requests    int64   `json:"requests"`
+	Hits        int64   `json:"hits"`
+	Bytes       int64   `json:"bytes"`
+	HitBytes    int64   `json:"hit_bytes"`
+	HitRate     float64 `json:"hit_rate"`
+	ByteHitRate float64 `json:"byte_hit_rate"`
+}
+
+type cache struct {
+	policy
+	stats Stats
+}
+
+type request struct {
+	hash string
+	size int64
+}
+
+// Simulator feeds the requests of the real cache to the simulated ones
+type Simulator struct {
+	caches  []*cache
+	queue   chan request
+	grp     *stop.Group
+	statsMu sync.Mutex
+}
+
+// Parse parses a comma separated list of POLICY:SIZE, like "lru:500GB,lru:1TB,tinylfu:1TB". The policies are lru,
+// fifo, lfu and tinylfu
+func Parse(spec string) (*Simulator, error) {
+	s := &Simulator{queue: make(chan request, queueSize), grp: stop.New()}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.SplitN(part, ":", 2)
+		if len(fields) != 2 {
+			return nil, errors.Err("shadow caches look like POLICY:SIZE, not '%s'", part)
+		}
+		name, sizeSpec := fields[0], fields[1]
+		var size datasize.ByteSize
+		err := size.UnmarshalText([]byte(sizeSpec))
+		if err != nil || size == 0 {
+			return nil, errors.Err("shadow cache size must be like 500GB, not '%s'", sizeSpec)
+		}
+		var p policy
+		switch name {
+		case PolicyLRU:
+			p = newLRU(int64(size), true)
+		case PolicyFIFO:
+			p = newLRU(int64(size), false)
+		case PolicyLFU:
+			p = newLFU(int64(size))
+		case PolicyTinyLFU:
+			p = newTinyLFU(int64(size))
+		default:
+			return nil, errors.Err("unknown shadow cache policy '%s'", name)
+		}
+		s.caches = append(s.caches, &cache{policy: p, stats: Stats{Name: name + ":" + sizeSpec}})
+	}
+	if len(s.caches) == 0 {
+		return nil, errors.Err("no shadow caches")
+	}
+	return s, nil
+}
+
+// Start simulates the requests in the background
+func (s *Simulator) Start() {
+	s.grp.Add(1)
+	go func() {
+		defer s.grp.Done()
+		for {
+			select {
+			case <-s.grp.Ch():
+				return
+			case r := <-s.queue:
+				s.simulate(r)
+			}
+		}
+	}()
+}
+
+// Shutdown stops the simulation
+func (s *Simulator) Shutdown() {
+	s.grp.StopAndWait()
+}
+
+// Record adds a request for a blob of size bytes to the simulation. It never blocks
+func (s *Simulator) Record(hash string, size int) {
+	select {
+	case s.queue <- request{hash: hash, size: int64(size)}:
+	default:
+		metrics.ShadowDroppedCount.Inc()
+	}
+}
+
+func (s *Simulator) simulate(r request) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(r.hash))
+	key := h.Sum64()
+
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	for _, c := range s.caches {
+		hit := c.access(key, r.size)
+		c.stats.Requests++
+		c.stats.Bytes += r.size
+		metrics.ShadowRequestCount.WithLabelValues(c.stats.Name).Inc()
+		if hit {
+			c.stats.Hits++
+			c.stats.HitBytes += r.size
+			metrics.ShadowHitCount.WithLabelValues(c.stats.Name).Inc()
+			metrics.ShadowHitBytes.WithLabelValues(c.stats.Name).Add(float64(r.size))
+		}
+	}
+}
+
+// Stats returns what each simulated cache served since the start
+func (s *Simulator) Stats() []Stats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	stats := make([]Stats, len(s.caches))
+	for i, c := range s.caches {
+		stats[i] = c.stats
+		if c.stats.Requests > 0 {
+			stats[i].HitRate = float64(c.stats.Hits) / float64(c.stats.Requests)
+		}
+		if c.stats.Bytes > 0 {
+			stats[i].ByteHitRate = float64(c.stats.HitBytes) / float64(c.stats.Bytes)
+		}
+	}
+	return stats
+}
+
+// ServeHTTP shows the stats of the simulated caches as json
+func (s *Simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(s.Stats())
+	if err != nil {
+		log.Error(err)
+	}
+}
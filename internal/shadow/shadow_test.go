@@ -0,0 +1,72 @@
+package shadow
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	s, err := Parse("lru:2KB, fifo:1MB,lfu:1GB,tinylfu:1TB")
+	require.NoError(t, err)
+	stats := s.Stats()
+	require.Len(t, stats, 4)
+	assert.Equal(t, "lru:2KB", stats[0].Name)
+	assert.Equal(t, "tinylfu:1TB", stats[3].Name)
+
+	for _, spec := range []string{"", "lru", "lru:lots", "lru:0", "arc:1GB"} {
+		_, err := Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestLRU(t *testing.T) {
+	l := newLRU(3, true)
+	assert.False(t, l.access(1, 1))
+	assert.False(t, l.access(2, 1))
+	assert.False(t, l.access(3, 1))
+	assert.True(t, l.access(1, 1))
+	assert.False(t, l.access(4, 1), "2 is evicted, it was used the longest time ago")
+	assert.True(t, l.access(1, 1))
+	assert.False(t, l.access(2, 1))
+	assert.False(t, l.access(5, 10), "blobs bigger than the cache are never cached")
+	assert.False(t, l.access(5, 10))
+}
+
+func TestFIFO(t *testing.T) {
+	l := newLRU(3, false)
+	l.access(1, 1)
+	l.access(2, 1)
+	l.access(3, 1)
+	assert.True(t, l.access(1, 1))
+	assert.False(t, l.access(4, 1), "1 is evicted, it's the oldest")
+	assert.False(t, l.access(1, 1))
+	assert.True(t, l.access(3, 1))
+}
+
+func TestLFU(t *testing.T) {
+	l := newLFU(2)
+	l.access(1, 1)
+	l.access(1, 1)
+	l.access(2, 1)
+	assert.False(t, l.access(3, 1), "2 is evicted, it was used fewer times")
+	assert.True(t, l.access(1, 1))
+	assert.False(t, l.access(2, 1), "3 is evicted, it was used the longest time ago of the blobs used once")
+	assert.True(t, l.access(1, 1))
+	assert.False(t, l.access(3, 1))
+}
+
+func TestSimulator(t *testing.T) {
+	s, err := Parse("lru:2B,lru:3B")
+	require.NoError(t, err)
+	for _, hash := range []string{"a", "b", "c", "a", "b", "c"} {
+		s.simulate(request{hash: hash, size: 1})
+	}
+	stats := s.Stats()
+	assert.Equal(t, int64(6), stats[0].Requests)
+	assert.Equal(t, int64(0), stats[0].Hits, "a cycle longer than the cache never hits")
+	assert.Equal(t, int64(3), stats[1].Hits)
+	assert.Equal(t, 0.5, stats[1].HitRate)
+	assert.Equal(t, 0.5, stats[1].ByteHitRate)
+}
@@ -0,0 +1,184 @@
+// Package tinylfu decides which blobs are worth caching. It estimates how often each blob was requested recently with
+// a count-min sketch, and only admits blobs that were requested more than once, so a stream of blobs that are
+// watched once doesn't push the popular blobs out of the cache. See https://arxiv.org/abs/1512.00727
+package tinylfu
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/lbryio/reflector.go/internal/bloom"
+)
+
+const (
+	// sketchRows is how many counters each blob has in the sketch. Its estimate is the smallest of them
+	sketchRows = 4
+	// maxCount is where counters stop, like the 4 bit counters of the paper
+	maxCount = 15
+	// windowPerBlob is how many requests the window has for each blob the cache holds
+	windowPerBlob = 10
+	// defaultMinFrequency admits blobs on their second request in the window
+	defaultMinFrequency = 2
+)
+
+// Stats are the requests and admissions of a window
+type Stats struct {
+	Requests int
+	Hits     int
+	// Rejected is how many blobs were not admitted
+	Rejected int
+	// Regretted is how many of the rejected blobs were requested again in the window after, and missed
+	Regretted int
+}
+
+// HitRateGain estimates how much admission changed the hit rate. Each rejected blob that was not requested again kept
+// a cached blob from being evicted, which is assumed to be hit as often as the cache is. Each rejected blob that was
+// requested again cost a hit
+func (s Stats) HitRateGain() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	hitRate := float64(s.Hits) / float64(s.Requests)
+	kept := s.Rejected - s.Regretted
+	if kept < 0 {
+		kept = 0
+	}
+	return (float64(kept)*hitRate - float64(s.Regretted)) / float64(s.Requests)
+}
+
+// Filter is a TinyLFU admission filter. It is safe to use from several goroutines
+type Filter struct {
+	// MinFrequency is how many times a blob must have been requested recently to be admitted. 2 if 0
+	MinFrequency int
+	// OnWindow is called with the stats of each window when it ends. The window is windowPerBlob requests for each
+	// blob the cache holds, after which all the counts are halved, so old popularity fades
+	OnWindow func(Stats)
+
+	mu      sync.Mutex
+	window  int
+	samples int
+	counts  [sketchRows][]uint8
+	mask    uint64
+	// doorkeeper holds the blobs requested once in the window, so they don't take counters in the sketch
+	doorkeeper *bloom.Filter
+	// rejected holds the blobs rejected in this and the last window, to tell when a rejection was a mistake
+	rejected, lastRejected *bloom.Filter
+	stats                  Stats
+}
+
+// New returns a filter for a cache of size blobs
+func New(size int) *Filter {
+	if size < 1 {
+		size = 1
+	}
+	width := 1
+	for width < size {
+		width <<= 1
+	}
+	f := &Filter{window: size * windowPerBlob, mask: uint64(width - 1)}
+	for i := range f.counts {
+		f.counts[i] = make([]uint8, width)
+	}
+	f.doorkeeper = bloom.New(f.window, 0.01)
+	f.rejected = bloom.New(f.window, 0.01)
+	f.lastRejected = bloom.New(f.window, 0.01)
+	return f
+}
+
+// Record counts a request for a blob, and whether the cache had it. It returns true if the blob was rejected
+// recently and missed because of it
+func (f *Filter) Record(hash string, hit bool) bool {
+	f.mu.Lock()
+
+	if f.doorkeeper.Test(hash) {
+		h1, h2 := hashes(hash)
+		for i := range f.counts {
+			c := &f.counts[i][(h1+uint64(i)*h2)&f.mask]
+			if *c < maxCount {
+				*c++
+			}
+		}
+	} else {
+		f.doorkeeper.Add(hash)
+	}
+
+	f.stats.Requests++
+	regretted := false
+	if hit {
+		f.stats.Hits++
+	} else if f.rejected.Test(hash) || f.lastRejected.Test(hash) {
+		f.stats.Regretted++
+		regretted = true
+	}
+
+	f.samples++
+	if f.samples < f.window {
+		f.mu.Unlock()
+		return regretted
+	}
+	stats := f.reset()
+	f.mu.Unlock()
+	if f.OnWindow != nil {
+		f.OnWindow(stats)
+	}
+	return regretted
+}
+
+// Admit returns whether a blob that missed should be cached
+func (f *Filter) Admit(hash string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	min := f.MinFrequency
+	if min <= 0 {
+		min = defaultMinFrequency
+	}
+	if f.estimate(hash) >= min {
+		return true
+	}
+	f.stats.Rejected++
+	f.rejected.Add(hash)
+	return false
+}
+
+// Estimate returns about how many times the blob was requested recently
+func (f *Filter) Estimate(hash string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.estimate(hash)
+}
+
+func (f *Filter) estimate(hash string) int {
+	if !f.doorkeeper.Test(hash) {
+		return 0
+	}
+	h1, h2 := hashes(hash)
+	min := uint8(maxCount)
+	for i := range f.counts {
+		if c := f.counts[i][(h1+uint64(i)*h2)&f.mask]; c < min {
+			min = c
+		}
+	}
+	return int(min) + 1
+}
+
+// reset halves the counts and starts a new window. It returns the stats of the window that ended
+func (f *Filter) reset() Stats {
+	for i := range f.counts {
+		for j := range f.counts[i] {
+			f.counts[i][j] >>= 1
+		}
+	}
+	f.doorkeeper = bloom.New(f.window, 0.01)
+	f.lastRejected, f.rejected = f.rejected, bloom.New(f.window, 0.01)
+	f.samples = 0
+	stats := f.stats
+	f.stats = Stats{}
+	return stats
+}
+
+func hashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	return sum, sum>>32 | 1
+}
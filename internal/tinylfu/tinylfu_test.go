@@ -0,0 +1,57 @@
+package tinylfu
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter_Admit(t *testing.T) {
+	f := New(100)
+
+	f.Record("a", false)
+	assert.False(t, f.Admit("a"), "blobs are not admitted on their first request")
+	assert.True(t, f.Record("a", false), "a miss of a rejected blob is a regret")
+	assert.True(t, f.Admit("a"))
+	assert.Equal(t, 2, f.Estimate("a"))
+	assert.Equal(t, 0, f.Estimate("b"))
+
+	f.MinFrequency = 3
+	f.Record("c", false)
+	f.Record("c", false)
+	assert.False(t, f.Admit("c"))
+	f.Record("c", false)
+	assert.True(t, f.Admit("c"))
+}
+
+func TestFilter_Window(t *testing.T) {
+	f := New(10)
+	var windows []Stats
+	f.OnWindow = func(s Stats) { windows = append(windows, s) }
+
+	for i := 0; i < 8; i++ {
+		f.Record("popular", false)
+	}
+	// one hit wonders fill the rest of the window
+	for i := 0; i < 10*windowPerBlob-8; i++ {
+		hash := strconv.Itoa(i)
+		f.Record(hash, i%2 == 0)
+		f.Admit(hash)
+	}
+	assert.Len(t, windows, 1)
+	assert.Equal(t, 10*windowPerBlob, windows[0].Requests)
+	assert.Equal(t, 46, windows[0].Hits)
+	assert.Greater(t, windows[0].HitRateGain(), 0.0)
+
+	// the counts are halved, but popular blobs stay popular
+	assert.Equal(t, 0, f.Estimate("popular"))
+	f.Record("popular", false)
+	assert.Equal(t, 4, f.Estimate("popular"))
+}
+
+func TestStats_HitRateGain(t *testing.T) {
+	assert.Zero(t, Stats{}.HitRateGain())
+	assert.InDelta(t, 0.05, Stats{Requests: 100, Hits: 50, Rejected: 10}.HitRateGain(), 0.0001)
+	assert.InDelta(t, -0.1, Stats{Requests: 100, Hits: 50, Rejected: 10, Regretted: 10}.HitRateGain(), 0.0001)
+}
@@ -0,0 +1,344 @@
+package migrator
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/ratelimit"
+	"github.com/lbryio/reflector.go/shared"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how often progress is logged
+const progressInterval = 10 * time.Second
+
+// Opts configures a Migrator
+type Opts struct {
+	// How many blobs are copied at once
+	Workers int
+	// Max bytes per second to copy. 0 means no limit
+	MaxBytesPerSec int64
+	// Read every blob back from the destination after writing it and check its hash
+	Verify bool
+	// Copy blobs the destination already has
+	Overwrite bool
+	// File to save progress to. A migration with the same file continues where the last one stopped. Blobs that
+	// failed are listed in the same file with a .failed suffix, so they can be retried. Empty disables resuming
+	Checkpoint string
+	// How often the checkpoint is saved. Defaults to 10 seconds
+	CheckpointInterval time.Duration
+}
+
+// Result counts what a migration did
+type Result struct {
+	Copied  int
+	Skipped int // already in the destination, or done by an earlier run
+	Failed  int
+	Bytes   int64
+}
+
+// Migrator copies blobs from one store to another
+type Migrator struct {
+	src, dst store.BlobStore
+	opts     Opts
+	grp      *stop.Group
+
+	mu     sync.Mutex
+	result Result
+}
+
+// New returns a migrator that copies from src to dst
+func New(src, dst store.BlobStore, opts Opts) *Migrator {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.CheckpointInterval <= 0 {
+		opts.CheckpointInterval = 10 * time.Second
+	}
+	return &Migrator{src: src, dst: dst, opts: opts, grp: stop.New()}
+}
+
+// Shutdown stops a running migration. The checkpoint is saved before Run returns
+func (m *Migrator) Shutdown() {
+	m.grp.Stop()
+}
+
+// Run copies the blobs. The hashes are copied in sorted order, so the checkpoint only has to remember the last hash
+// before which everything is done.
+func (m *Migrator) Run(hashes []string) (Result, error) {
+	hashes = append([]string(nil), hashes...)
+	sort.Strings(hashes)
+
+	done, err := m.loadCheckpoint()
+	if err != nil {
+		return m.result, err
+	}
+	start := sort.SearchStrings(hashes, done)
+	if start < len(hashes) && hashes[start] == done {
+		start++
+	}
+	m.result.Skipped = start
+	if start > 0 {
+		log.Infof("resuming after %s, %d of %d blobs were done before", done, start, len(hashes))
+	}
+	hashes = hashes[start:]
+
+	failedFile, err := m.openFailedFile()
+	if err != nil {
+		return m.result, err
+	}
+	if failedFile != nil {
+		defer failedFile.Close()
+	}
+
+	limiter := ratelimit.New(m.opts.MaxBytesPerSec, m.grp.Ch())
+	w := newWatermark(hashes)
+
+	tasks := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < m.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range tasks {
+				err := m.copy(hashes[i], limiter)
+				if errors.Is(err, ratelimit.ErrStopped) {
+					continue // not done, the next run copies it
+				}
+				if err != nil {
+					log.Errorf("copying %s: %s", hashes[i], err.Error())
+					m.fail(failedFile, hashes[i])
+				}
+				w.done(i)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	checkpoint := time.NewTicker(m.opts.CheckpointInterval)
+	defer checkpoint.Stop()
+	began := time.Now()
+
+queue:
+	for i := 0; i < len(hashes); {
+		select {
+		case tasks <- i:
+			i++
+		case <-m.grp.Ch():
+			break queue
+		case <-ticker.C:
+			m.logProgress(began, w.count(), len(hashes))
+		case <-checkpoint.C:
+			m.saveCheckpoint(w.last())
+		}
+	}
+	close(tasks)
+	wg.Wait()
+
+	m.saveCheckpoint(w.last())
+	m.logProgress(began, w.count(), len(hashes))
+	return m.result, nil
+}
+
+func (m *Migrator) copy(hash string, limiter *ratelimit.Limiter) error {
+	if !m.opts.Overwrite {
+		has, err := m.dst.Has(hash)
+		if err != nil {
+			return err
+		}
+		if has {
+			m.count(func(r *Result) { r.Skipped++ })
+			return nil
+		}
+	}
+
+	blob, _, err := m.src.Get(hash)
+	if err != nil {
+		return err
+	}
+	err = limiter.Wait(len(blob))
+	if err != nil {
+		return err
+	}
+	if blob.HashHex() != hash {
+		return errors.Err("source has a corrupt blob")
+	}
+
+	if _, sdErr := shared.ParseSDBlob(blob); sdErr == nil {
+		err = m.dst.PutSD(hash, blob)
+	} else {
+		err = m.dst.Put(hash, blob)
+	}
+	if err != nil {
+		return err
+	}
+
+	if m.opts.Verify {
+		written, _, err := m.dst.Get(hash)
+		if err != nil {
+			return errors.Prefix("verifying", err)
+		}
+		if written.HashHex() != hash {
+			return errors.Err("verifying: destination has a different blob")
+		}
+	}
+
+	m.count(func(r *Result) {
+		r.Copied++
+		r.Bytes += int64(len(blob))
+	})
+	return nil
+}
+
+func (m *Migrator) count(f func(r *Result)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f(&m.result)
+}
+
+func (m *Migrator) fail(failedFile *os.File, hash string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.result.Failed++
+	if failedFile != nil {
+		_, err := failedFile.WriteString(hash + "\n")
+		if err != nil {
+			log.Errorf("recording failed blob %s: %s", hash, err.Error())
+		}
+	}
+}
+
+func (m *Migrator) logProgress(began time.Time, done, total int) {
+	m.mu.Lock()
+	r := m.result
+	m.mu.Unlock()
+
+	elapsed := time.Since(began)
+	eta := "unknown"
+	if done > 0 {
+		eta = (time.Duration(float64(elapsed) / float64(done) * float64(total-done))).Round(time.Second).String()
+	}
+	log.Infof("%d/%d blobs done (%d copied, %d skipped, %d failed), %.1f MB/s, ETA %s", done, total, r.Copied,
+		r.Skipped, r.Failed, float64(r.Bytes)/1024/1024/elapsed.Seconds(), eta)
+}
+
+func (m *Migrator) loadCheckpoint() (string, error) {
+	if m.opts.Checkpoint == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(m.opts.Checkpoint)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Err(err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (m *Migrator) saveCheckpoint(last string) {
+	if m.opts.Checkpoint == "" || last == "" {
+		return
+	}
+	tmp := m.opts.Checkpoint + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(last+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(tmp, m.opts.Checkpoint)
+	}
+	if err != nil {
+		log.Errorf("saving checkpoint: %s", err.Error())
+	}
+}
+
+func (m *Migrator) openFailedFile() (*os.File, error) {
+	if m.opts.Checkpoint == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(m.opts.Checkpoint+".failed", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	return f, errors.Err(err)
+}
+
+// ReadHashes reads a file with one hash per line, like the .failed file of a checkpoint
+func ReadHashes(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer f.Close()
+
+	var hashes []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if h := strings.TrimSpace(scanner.Text()); h != "" {
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes, errors.Err(scanner.Err())
+}
+
+// Missing returns the hashes in want that are not in have, sorted
+func Missing(have, want []string) []string {
+	haveSet := make(map[string]struct{}, len(have))
+	for _, h := range have {
+		haveSet[h] = struct{}{}
+	}
+	var missing []string
+	for _, h := range want {
+		if _, ok := haveSet[h]; !ok {
+			missing = append(missing, h)
+			haveSet[h] = struct{}{} // list each hash once
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// watermark tracks which hashes are done, and the last hash before which all of them are
+type watermark struct {
+	mu      sync.Mutex
+	hashes  []string
+	next    int // everything before this is done
+	pending map[int]bool
+	total   int
+}
+
+func newWatermark(hashes []string) *watermark {
+	return &watermark{hashes: hashes, pending: make(map[int]bool)}
+}
+
+func (w *watermark) done(i int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.total++
+	w.pending[i] = true
+	for w.pending[w.next] {
+		delete(w.pending, w.next)
+		w.next++
+	}
+}
+
+func (w *watermark) last() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.next == 0 {
+		return ""
+	}
+	return w.hashes[w.next-1]
+}
+
+func (w *watermark) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.total
+}
@@ -0,0 +1,75 @@
+package migrator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testBlobs(t *testing.T, n int) (*store.MemStore, []string) {
+	src := store.NewMemStore()
+	var hashes []string
+	for i := 0; i < n; i++ {
+		b := stream.Blob(fmt.Sprintf("blob %d", i))
+		require.NoError(t, src.Put(b.HashHex(), b))
+		hashes = append(hashes, b.HashHex())
+	}
+	sort.Strings(hashes)
+	return src, hashes
+}
+
+func TestMigrator_Run(t *testing.T) {
+	src, hashes := testBlobs(t, 5)
+	dst := store.NewMemStore()
+	blob, _, err := src.Get(hashes[0])
+	require.NoError(t, err)
+	require.NoError(t, dst.Put(hashes[0], blob))
+
+	result, err := New(src, dst, Opts{Workers: 3, Verify: true}).Run(append(hashes, "missing"))
+	require.NoError(t, err)
+	assert.Equal(t, 4, result.Copied)
+	assert.Equal(t, 1, result.Skipped)
+	assert.Equal(t, 1, result.Failed)
+	for _, h := range hashes {
+		has, err := dst.Has(h)
+		require.NoError(t, err)
+		assert.True(t, has)
+	}
+}
+
+func TestMigrator_Resume(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	checkpoint := path.Join(tmpDir, "checkpoint")
+
+	src, hashes := testBlobs(t, 5)
+	require.NoError(t, ioutil.WriteFile(checkpoint, []byte(hashes[2]+"\n"), 0644))
+
+	dst := store.NewMemStore()
+	result, err := New(src, dst, Opts{Workers: 2, Checkpoint: checkpoint}).Run(hashes)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Copied)
+	assert.Equal(t, 3, result.Skipped)
+	assert.Len(t, dst.Debug(), 2)
+
+	saved, err := ioutil.ReadFile(checkpoint)
+	require.NoError(t, err)
+	assert.Equal(t, hashes[4]+"\n", string(saved))
+}
+
+func TestMissing(t *testing.T) {
+	assert.Equal(t, []string{"a", "d"}, Missing([]string{"b", "c", "e"}, []string{"d", "c", "a", "b", "d"}))
+	assert.Empty(t, Missing([]string{"a"}, []string{"a"}))
+	assert.Equal(t, []string{"a"}, Missing(nil, []string{"a"}))
+}
@@ -0,0 +1,14 @@
+// +build !linux
+
+package nat
+
+import (
+	"net"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// defaultGateway is only implemented on linux. Elsewhere NAT-PMP is skipped and UPnP discovery is used instead.
+func defaultGateway() (net.IP, error) {
+	return nil, errors.Err("finding the default gateway is not supported on this platform")
+}
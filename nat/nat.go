@@ -0,0 +1,189 @@
+package nat
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultLifetime is how long port mappings are requested for. They are renewed at half that interval.
+	DefaultLifetime = 1 * time.Hour
+
+	ProtocolTCP = "TCP"
+	ProtocolUDP = "UDP"
+
+	description = "reflector.go"
+)
+
+// ErrNoGateway is returned when no NAT-PMP or UPnP gateway could be found on the local network
+var ErrNoGateway = errors.Base("no NAT-PMP or UPnP gateway found")
+
+// Mapper is a gateway that can forward external ports to this host.
+type Mapper interface {
+	// Name of the mapping method (useful for logging)
+	Name() string
+	// ExternalIP returns the external (internet-facing) address of the gateway
+	ExternalIP() (net.IP, error)
+	// AddPortMapping maps externalPort on the gateway to internalPort on this host and returns the external port
+	// that was actually mapped, which may differ from the one requested
+	AddPortMapping(protocol string, internalPort, externalPort int, lifetime time.Duration) (int, error)
+	// DeletePortMapping removes a mapping created by AddPortMapping
+	DeletePortMapping(protocol string, internalPort, externalPort int) error
+}
+
+// Mapping is a port that should be reachable from outside the local network
+type Mapping struct {
+	Protocol     string
+	InternalPort int
+	ExternalPort int
+}
+
+// Discover finds a gateway on the local network, trying NAT-PMP first and falling back to UPnP.
+func Discover() (Mapper, error) {
+	pmp, err := discoverNATPMP()
+	if err == nil {
+		return pmp, nil
+	}
+	log.Debugf("nat-pmp discovery failed: %s", err.Error())
+
+	igd, err := discoverUPnP()
+	if err == nil {
+		return igd, nil
+	}
+	log.Debugf("upnp discovery failed: %s", err.Error())
+
+	return nil, errors.Err(ErrNoGateway)
+}
+
+// Service maps a set of ports on the gateway and keeps renewing the mappings until it is shut down.
+type Service struct {
+	Lifetime time.Duration
+	// FindGateway finds the gateway to map the ports on when the service is started. Defaults to Discover
+	FindGateway func() (Mapper, error)
+	// OnChange is called when a renewal gets another external port for a mapping than it had. It's not called for
+	// the first mappings, which Mappings returns once the service is started
+	OnChange func(m Mapping)
+
+	// mu guards the external ports of the mappings, which the renewals update
+	mu         sync.Mutex
+	mappings   []Mapping
+	mapper     Mapper
+	externalIP net.IP
+
+	grp *stop.Group
+}
+
+// New returns a Service that will map the given ports once started.
+func New(mappings ...Mapping) *Service {
+	return &Service{
+		Lifetime:    DefaultLifetime,
+		FindGateway: Discover,
+		mappings:    mappings,
+		grp:         stop.New(),
+	}
+}
+
+// Start discovers the gateway, maps all ports and starts renewing the mappings in the background.
+func (s *Service) Start() error {
+	var err error
+	s.mapper, err = s.FindGateway()
+	if err != nil {
+		return err
+	}
+
+	s.externalIP, err = s.mapper.ExternalIP()
+	if err != nil {
+		return errors.Prefix("getting external ip", err)
+	}
+	log.Infof("nat: found %s gateway, external ip is %s", s.mapper.Name(), s.externalIP)
+
+	err = s.mapAll(false)
+	if err != nil {
+		return err
+	}
+
+	s.grp.Add(1)
+	go func() {
+		defer s.grp.Done()
+		s.renew()
+	}()
+
+	return nil
+}
+
+// ExternalIP returns the external address discovered when the service was started
+func (s *Service) ExternalIP() net.IP {
+	return s.externalIP
+}
+
+// Mappings returns the ports as they are mapped on the gateway
+func (s *Service) Mappings() []Mapping {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Mapping(nil), s.mappings...)
+}
+
+// Shutdown stops renewing the mappings and removes them from the gateway.
+func (s *Service) Shutdown() {
+	log.Debug("shutting down nat service")
+	s.grp.StopAndWait()
+	if s.mapper == nil {
+		return
+	}
+	for _, m := range s.Mappings() {
+		err := s.mapper.DeletePortMapping(m.Protocol, m.InternalPort, m.ExternalPort)
+		if err != nil {
+			log.Error(errors.Prefix("nat: removing mapping", err))
+		}
+	}
+	log.Debug("nat service stopped")
+}
+
+// mapAll maps all the ports, and calls OnChange for the ones that got another external port if notify is set
+func (s *Service) mapAll(notify bool) error {
+	for i, m := range s.Mappings() {
+		external := m.ExternalPort
+		if external == 0 {
+			external = m.InternalPort
+		}
+		mapped, err := s.mapper.AddPortMapping(m.Protocol, m.InternalPort, external, s.Lifetime)
+		if err != nil {
+			return errors.Prefix("nat: mapping "+m.Protocol+" port", err)
+		}
+		if mapped != external {
+			log.Warnf("nat: requested external %s port %d but gateway mapped %d", m.Protocol, external, mapped)
+		}
+		s.mu.Lock()
+		s.mappings[i].ExternalPort = mapped
+		s.mu.Unlock()
+		log.Infof("nat: mapped %s %s:%d to local port %d", m.Protocol, s.externalIP, mapped, m.InternalPort)
+
+		if notify && mapped != m.ExternalPort && s.OnChange != nil {
+			m.ExternalPort = mapped
+			s.OnChange(m)
+		}
+	}
+	return nil
+}
+
+func (s *Service) renew() {
+	t := time.NewTicker(s.Lifetime / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.grp.Ch():
+			return
+		case <-t.C:
+			err := s.mapAll(true)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package nat
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMapper maps every port to the one in next, or to the requested port if next is 0
+type fakeMapper struct {
+	mu      sync.Mutex
+	next    int
+	renewed int
+	deleted []int
+}
+
+func (f *fakeMapper) Name() string                { return "fake" }
+func (f *fakeMapper) ExternalIP() (net.IP, error) { return net.IPv4(203, 0, 113, 1), nil }
+
+func (f *fakeMapper) AddPortMapping(protocol string, internalPort, externalPort int, lifetime time.Duration) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.renewed++
+	if f.next != 0 {
+		return f.next, nil
+	}
+	return externalPort, nil
+}
+
+func (f *fakeMapper) DeletePortMapping(protocol string, internalPort, externalPort int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, externalPort)
+	return nil
+}
+
+func (f *fakeMapper) setNext(port int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.next = port
+}
+
+func (f *fakeMapper) renewals() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.renewed
+}
+
+func testService(mapper Mapper, mappings ...Mapping) *Service {
+	s := New(mappings...)
+	s.Lifetime = 10 * time.Millisecond
+	s.FindGateway = func() (Mapper, error) { return mapper, nil }
+	return s
+}
+
+func TestService_Mappings(t *testing.T) {
+	mapper := &fakeMapper{}
+	s := testService(mapper,
+		Mapping{Protocol: ProtocolUDP, InternalPort: 4444},
+		Mapping{Protocol: ProtocolTCP, InternalPort: 5567, ExternalPort: 6000},
+	)
+	changes := make(chan Mapping, 100)
+	s.OnChange = func(m Mapping) { changes <- m }
+	require.NoError(t, s.Start())
+	assert.Len(t, changes, 0)
+
+	assert.Equal(t, []Mapping{
+		{Protocol: ProtocolUDP, InternalPort: 4444, ExternalPort: 4444},
+		{Protocol: ProtocolTCP, InternalPort: 5567, ExternalPort: 6000},
+	}, s.Mappings())
+
+	// the mappings are read while the renewals update them. run with -race
+	mapper.setNext(7000)
+	deadline := time.Now().Add(time.Second)
+	for mapper.renewals() < 6 && time.Now().Before(deadline) {
+		for _, m := range s.Mappings() {
+			_ = m.ExternalPort
+		}
+	}
+	s.Shutdown()
+
+	for _, m := range s.Mappings() {
+		assert.Equal(t, 7000, m.ExternalPort)
+	}
+	assert.Equal(t, []int{7000, 7000}, mapper.deleted)
+
+	// each port changed once, on the first renewal after the gateway started mapping another port
+	require.Len(t, changes, 2)
+	assert.Equal(t, Mapping{Protocol: ProtocolUDP, InternalPort: 4444, ExternalPort: 7000}, <-changes)
+	assert.Equal(t, Mapping{Protocol: ProtocolTCP, InternalPort: 5567, ExternalPort: 7000}, <-changes)
+}
+
+func TestService_NoGateway(t *testing.T) {
+	s := New(Mapping{Protocol: ProtocolTCP, InternalPort: 5567})
+	s.FindGateway = func() (Mapper, error) { return nil, ErrNoGateway }
+	assert.Error(t, s.Start())
+	s.Shutdown()
+}
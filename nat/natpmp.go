@@ -0,0 +1,129 @@
+package nat
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// NAT-PMP as described in RFC 6886
+
+const (
+	natpmpPort    = 5351
+	natpmpVersion = 0
+	natpmpTries   = 4
+	natpmpTimeout = 250 * time.Millisecond
+
+	natpmpOpExternalAddress = 0
+	natpmpOpMapUDP          = 1
+	natpmpOpMapTCP          = 2
+)
+
+type natpmp struct {
+	// addr is the host:port of the gateway's NAT-PMP server
+	addr string
+}
+
+func discoverNATPMP() (*natpmp, error) {
+	gw, err := defaultGateway()
+	if err != nil {
+		return nil, err
+	}
+	n := &natpmp{addr: net.JoinHostPort(gw.String(), strconv.Itoa(natpmpPort))}
+	// a gateway that answers the external address request speaks NAT-PMP
+	_, err = n.ExternalIP()
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *natpmp) Name() string { return "NAT-PMP" }
+
+func (n *natpmp) ExternalIP() (net.IP, error) {
+	res, err := n.call([]byte{natpmpVersion, natpmpOpExternalAddress}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(res[8], res[9], res[10], res[11]), nil
+}
+
+func (n *natpmp) AddPortMapping(protocol string, internalPort, externalPort int, lifetime time.Duration) (int, error) {
+	res, err := n.mapPort(protocol, internalPort, externalPort, uint32(lifetime/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(res[10:12])), nil
+}
+
+func (n *natpmp) DeletePortMapping(protocol string, internalPort, _ int) error {
+	// a mapping is deleted by requesting it with a lifetime and external port of 0
+	_, err := n.mapPort(protocol, internalPort, 0, 0)
+	return err
+}
+
+func (n *natpmp) mapPort(protocol string, internalPort, externalPort int, lifetime uint32) ([]byte, error) {
+	op := byte(natpmpOpMapTCP)
+	if protocol == ProtocolUDP {
+		op = natpmpOpMapUDP
+	}
+	req := make([]byte, 12)
+	req[0] = natpmpVersion
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], lifetime)
+	return n.call(req, 16)
+}
+
+// call sends the request to the gateway and waits for the response, doubling the timeout after every try
+func (n *natpmp) call(req []byte, resLen int) ([]byte, error) {
+	conn, err := net.Dial("udp4", n.addr)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer conn.Close()
+
+	res := make([]byte, 16)
+	timeout := natpmpTimeout
+	for i := 0; i < natpmpTries; i++ {
+		_, err = conn.Write(req)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		err = conn.SetReadDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		var read int
+		read, err = conn.Read(res)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				timeout *= 2
+				continue
+			}
+			return nil, errors.Err(err)
+		}
+		parsed, err := parseNATPMPResponse(req[1], res[:read], resLen)
+		if err != nil {
+			return nil, errors.Prefix(n.addr, err)
+		}
+		return parsed, nil
+	}
+	return nil, errors.Err("nat-pmp: no response from %s", n.addr)
+}
+
+// parseNATPMPResponse checks that res is a successful response to a request with the given opcode, and returns its
+// first resLen bytes
+func parseNATPMPResponse(op byte, res []byte, resLen int) ([]byte, error) {
+	if len(res) < resLen || res[0] != natpmpVersion || res[1] != op|0x80 {
+		return nil, errors.Err("nat-pmp: unexpected response")
+	}
+	if code := binary.BigEndian.Uint16(res[2:4]); code != 0 {
+		return nil, errors.Err("nat-pmp: gateway returned result code %d", code)
+	}
+	return res[:resLen], nil
+}
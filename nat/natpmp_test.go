@@ -0,0 +1,79 @@
+package nat
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func packet(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+func TestParseNATPMPResponse(t *testing.T) {
+	// external address response: version 0, op 128, result 0, epoch 86400, ip 203.0.113.7
+	res, err := parseNATPMPResponse(natpmpOpExternalAddress, packet(t, "0080000000015180cb007107"), 12)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{203, 0, 113, 7}, res[8:12])
+
+	// tcp mapping response: internal port 5567, mapped external port 6001, lifetime 3600
+	_, err = parseNATPMPResponse(natpmpOpMapTCP, packet(t, "008200000001518015bf177100000e10"), 16)
+	require.NoError(t, err)
+
+	for name, p := range map[string]string{
+		"result code 3, network failure": "008000030001518000000000",
+		"response to another request":    "008100000001518000000000",
+		"too short":                      "00800000000151",
+		"unsupported version":            "018000000001518000000000",
+	} {
+		_, err := parseNATPMPResponse(natpmpOpExternalAddress, packet(t, p), 12)
+		assert.Error(t, err, name)
+	}
+}
+
+// fakeNATPMPGateway answers every request with the packet that answer returns for it
+func fakeNATPMPGateway(t *testing.T, answer func(req []byte) []byte) *natpmp {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(answer(buf[:n]), addr)
+		}
+	}()
+	return &natpmp{addr: conn.LocalAddr().String()}
+}
+
+func TestNATPMP(t *testing.T) {
+	reqs := make(chan []byte, 10)
+	gw := fakeNATPMPGateway(t, func(req []byte) []byte {
+		reqs <- append([]byte(nil), req...)
+		if req[1] == natpmpOpExternalAddress {
+			return packet(t, "0080000000015180cb007107")
+		}
+		// the gateway maps another port than the one requested
+		return packet(t, "0082000000015180"+hex.EncodeToString(req[4:6])+"177100000e10")
+	})
+
+	ip, err := gw.ExternalIP()
+	require.NoError(t, err)
+	assert.Equal(t, "203.0.113.7", ip.String())
+
+	port, err := gw.AddPortMapping(ProtocolTCP, 5567, 5567, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 6001, port)
+	<-reqs
+	assert.Equal(t, packet(t, "0002000015bf15bf00000e10"), <-reqs)
+}
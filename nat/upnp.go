@@ -0,0 +1,281 @@
+package nat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// UPnP Internet Gateway Device protocol (port mapping only)
+
+const (
+	ssdpAddr    = "239.255.255.250:1900"
+	ssdpTarget  = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	ssdpTimeout = 3 * time.Second
+
+	upnpTimeout = 5 * time.Second
+)
+
+var upnpServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+type upnp struct {
+	controlURL  string
+	serviceType string
+	localIP     net.IP
+	client      *http.Client
+}
+
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+	Services   []upnpService `xml:"serviceList>service"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+func (d upnpDevice) findService(types []string) *upnpService {
+	for _, s := range d.Services {
+		for _, t := range types {
+			if s.ServiceType == t {
+				return &s
+			}
+		}
+	}
+	for _, child := range d.Devices {
+		if s := child.findService(types); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+func discoverUPnP() (*upnp, error) {
+	location, err := ssdpSearch()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: upnpTimeout}
+	res, err := client.Get(location)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer res.Body.Close()
+
+	u, err := parseDeviceDescription(res.Body, location)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	u.localIP, err = localAddrTo(base.Host)
+	if err != nil {
+		return nil, err
+	}
+	u.client = client
+	return u, nil
+}
+
+// parseDeviceDescription finds the WAN connection service in the description of the gateway at location
+func parseDeviceDescription(r io.Reader, location string) (*upnp, error) {
+	var root struct {
+		Device upnpDevice `xml:"device"`
+	}
+	err := xml.NewDecoder(r).Decode(&root)
+	if err != nil {
+		return nil, errors.Prefix("upnp: parsing device description", err)
+	}
+
+	service := root.Device.findService(upnpServiceTypes)
+	if service == nil {
+		return nil, errors.Err("upnp: gateway at %s has no WAN connection service", location)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	control, err := base.Parse(service.ControlURL)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	return &upnp{controlURL: control.String(), serviceType: service.ServiceType}, nil
+}
+
+// ssdpSearch multicasts an M-SEARCH for an internet gateway and returns the location of its description
+func ssdpSearch() (string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", errors.Err(err)
+	}
+	defer conn.Close()
+
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", errors.Err(err)
+	}
+
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: " + ssdpTarget + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	_, err = conn.WriteTo([]byte(req), addr)
+	if err != nil {
+		return "", errors.Err(err)
+	}
+
+	err = conn.SetReadDeadline(time.Now().Add(ssdpTimeout))
+	if err != nil {
+		return "", errors.Err(err)
+	}
+
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", errors.Prefix("upnp: no gateway answered", err)
+		}
+		if location := parseSSDPResponse(buf[:n]); location != "" {
+			return location, nil
+		}
+	}
+}
+
+// parseSSDPResponse returns the location of the description of an internet gateway that answered the M-SEARCH, or
+// an empty string if the packet is not such an answer
+func parseSSDPResponse(packet []byte) string {
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(packet)), nil)
+	if err != nil {
+		return ""
+	}
+	res.Body.Close()
+	if !strings.Contains(res.Header.Get("St"), "InternetGatewayDevice") {
+		return ""
+	}
+	return res.Header.Get("Location")
+}
+
+// localAddrTo returns the local address used to reach host
+func localAddrTo(host string) (net.IP, error) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+	conn, err := net.Dial("udp4", host)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func (u *upnp) Name() string { return "UPnP" }
+
+func (u *upnp) ExternalIP() (net.IP, error) {
+	var res struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	err := u.soap("GetExternalIPAddress", "", &res)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(res.IP))
+	if ip == nil {
+		return nil, errors.Err("upnp: gateway returned invalid external ip %q", res.IP)
+	}
+	return ip, nil
+}
+
+func (u *upnp) AddPortMapping(protocol string, internalPort, externalPort int, lifetime time.Duration) (int, error) {
+	args := fmt.Sprintf(
+		"<NewRemoteHost></NewRemoteHost>"+
+			"<NewExternalPort>%d</NewExternalPort>"+
+			"<NewProtocol>%s</NewProtocol>"+
+			"<NewInternalPort>%d</NewInternalPort>"+
+			"<NewInternalClient>%s</NewInternalClient>"+
+			"<NewEnabled>1</NewEnabled>"+
+			"<NewPortMappingDescription>%s</NewPortMappingDescription>"+
+			"<NewLeaseDuration>%d</NewLeaseDuration>",
+		externalPort, protocol, internalPort, u.localIP, description, int(lifetime/time.Second),
+	)
+	err := u.soap("AddPortMapping", args, nil)
+	if err != nil {
+		return 0, err
+	}
+	return externalPort, nil
+}
+
+func (u *upnp) DeletePortMapping(protocol string, _, externalPort int) error {
+	args := fmt.Sprintf(
+		"<NewRemoteHost></NewRemoteHost>"+
+			"<NewExternalPort>%d</NewExternalPort>"+
+			"<NewProtocol>%s</NewProtocol>",
+		externalPort, protocol,
+	)
+	return u.soap("DeletePortMapping", args, nil)
+}
+
+func (u *upnp) soap(action, args string, out interface{}) error {
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + u.serviceType + `">` + args + `</u:` + action + `></s:Body>` +
+		`</s:Envelope>`
+
+	req, err := http.NewRequest(http.MethodPost, u.controlURL, strings.NewReader(body))
+	if err != nil {
+		return errors.Err(err)
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+u.serviceType+"#"+action+`"`)
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return errors.Err(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		var fault struct {
+			Code        string `xml:"Body>Fault>detail>UPnPError>errorCode"`
+			Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+		}
+		if xml.Unmarshal(data, &fault) == nil && fault.Code != "" {
+			return errors.Err("upnp: %s failed with error %s %s", action, fault.Code, fault.Description)
+		}
+		return errors.Err("upnp: %s failed with status %d", action, res.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	err = xml.Unmarshal(data, out)
+	if err != nil {
+		return errors.Prefix("upnp: parsing "+action+" response", err)
+	}
+	return nil
+}
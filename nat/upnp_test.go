@@ -0,0 +1,122 @@
+package nat
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const ssdpResponse = "HTTP/1.1 200 OK\r\n" +
+	"CACHE-CONTROL: max-age=120\r\n" +
+	"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+	"USN: uuid:6a8f2b1e-0000-0000-0000-001122334455::urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+	"EXT:\r\n" +
+	"SERVER: Linux/4.4 UPnP/1.0 MiniUPnPd/2.1\r\n" +
+	"LOCATION: http://192.168.1.1:5000/rootDesc.xml\r\n" +
+	"\r\n"
+
+const deviceDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<friendlyName>router</friendlyName>
+<serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType>
+<controlURL>/ctl/L3F</controlURL>
+</service></serviceList>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+<controlURL>/ctl/IPConn</controlURL>
+<eventSubURL>/evt/IPConn</eventSubURL>
+<SCPDURL>/WANIPCn.xml</SCPDURL>
+</service></serviceList>
+</device></deviceList>
+</device></deviceList>
+</device>
+</root>`
+
+const externalIPResponse = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+<NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>
+</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`
+
+const conflictFault = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">
+<errorCode>718</errorCode><errorDescription>ConflictInMappingEntry</errorDescription>
+</UPnPError></detail></s:Fault></s:Body></s:Envelope>`
+
+func TestParseSSDPResponse(t *testing.T) {
+	assert.Equal(t, "http://192.168.1.1:5000/rootDesc.xml", parseSSDPResponse([]byte(ssdpResponse)))
+
+	// other devices answer the multicast too
+	printer := strings.Replace(ssdpResponse, "device:InternetGatewayDevice:1\r\n", "device:Printer:1\r\n", 1)
+	assert.Equal(t, "", parseSSDPResponse([]byte(printer)))
+	assert.Equal(t, "", parseSSDPResponse([]byte("NOTIFY * HTTP/1.1\r\n")))
+}
+
+func TestParseDeviceDescription(t *testing.T) {
+	u, err := parseDeviceDescription(strings.NewReader(deviceDescription), "http://192.168.1.1:5000/rootDesc.xml")
+	require.NoError(t, err)
+	assert.Equal(t, "http://192.168.1.1:5000/ctl/IPConn", u.controlURL)
+	assert.Equal(t, "urn:schemas-upnp-org:service:WANIPConnection:1", u.serviceType)
+
+	noWAN := strings.Replace(deviceDescription, "WANIPConnection", "WANCommonInterfaceConfig", 1)
+	_, err = parseDeviceDescription(strings.NewReader(noWAN), "http://192.168.1.1:5000/rootDesc.xml")
+	assert.Error(t, err)
+}
+
+func TestUPnP(t *testing.T) {
+	actions := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		action := r.Header.Get("SOAPAction")
+		actions <- action
+		switch {
+		case strings.HasSuffix(action, `#GetExternalIPAddress"`):
+			_, _ = w.Write([]byte(externalIPResponse))
+		case strings.Contains(string(body), "<NewExternalPort>5567</NewExternalPort>"):
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(conflictFault))
+		default:
+			_, _ = w.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body/></s:Envelope>`))
+		}
+	}))
+	defer srv.Close()
+
+	u := &upnp{
+		controlURL:  srv.URL + "/ctl/IPConn",
+		serviceType: "urn:schemas-upnp-org:service:WANIPConnection:1",
+		localIP:     net.IPv4(192, 168, 1, 10),
+		client:      srv.Client(),
+	}
+
+	ip, err := u.ExternalIP()
+	require.NoError(t, err)
+	assert.Equal(t, "203.0.113.7", ip.String())
+	assert.Equal(t, `"urn:schemas-upnp-org:service:WANIPConnection:1#GetExternalIPAddress"`, <-actions)
+
+	port, err := u.AddPortMapping(ProtocolTCP, 5567, 6001, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 6001, port)
+	<-actions
+
+	_, err = u.AddPortMapping(ProtocolTCP, 5567, 5567, time.Hour)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "718 ConflictInMappingEntry")
+}
@@ -0,0 +1,276 @@
+package prefetch
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/db"
+	"github.com/lbryio/reflector.go/internal/ratelimit"
+	"github.com/lbryio/reflector.go/shared"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how often the warmer checks whether it's time for a pass
+const checkInterval = 10 * time.Minute
+
+// Source lists the hashes of the most popular streams or blobs, most popular first
+type Source interface {
+	Popular(limit int) ([]string, error)
+}
+
+type dbSource struct {
+	sql *db.SQL
+}
+
+// DBSource returns the most accessed streams (or blobs, if the db tracks blob accesses) from the db
+func DBSource(sql *db.SQL) Source {
+	return &dbSource{sql: sql}
+}
+
+func (d *dbSource) Popular(limit int) ([]string, error) {
+	stats, err := d.sql.MostAccessed(limit)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(stats))
+	for i, s := range stats {
+		hashes[i] = s.Hash
+	}
+	return hashes, nil
+}
+
+type manifestSource struct {
+	location string
+	client   *http.Client
+}
+
+// URLSource downloads the list of hashes from a url. See ManifestSource for the format
+func URLSource(url string) Source {
+	return ManifestSource(url)
+}
+
+// ManifestSource reads the list of hashes from a url or a file. The list must be a json array of hashes, or of
+// objects with a hash field like the /stats/popular endpoint of another reflector returns
+func ManifestSource(location string) Source {
+	return &manifestSource{location: location, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (m *manifestSource) Popular(limit int) ([]string, error) {
+	var body io.ReadCloser
+	if strings.HasPrefix(m.location, "http://") || strings.HasPrefix(m.location, "https://") {
+		res, err := m.client.Get(m.location)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, errors.Err("popular list request failed with status %d", res.StatusCode)
+		}
+		body = res.Body
+	} else {
+		f, err := os.Open(m.location)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		body = f
+	}
+	defer body.Close()
+
+	var entries []json.RawMessage
+	err := json.NewDecoder(body).Decode(&entries)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	hashes := make([]string, 0, len(entries))
+	for _, e := range entries {
+		var hash string
+		if json.Unmarshal(e, &hash) != nil {
+			var stat struct {
+				Hash string `json:"hash"`
+			}
+			err = json.Unmarshal(e, &stat)
+			if err != nil {
+				return nil, errors.Err(err)
+			}
+			hash = stat.Hash
+		}
+		if hash != "" {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes, nil
+}
+
+// WarmerOpts configures a Warmer
+type WarmerOpts struct {
+	// How many popular streams to prefetch in a pass
+	Limit int
+	// Passes only run between these hours of the day (0-23, local time). The window may wrap around midnight. If
+	// both are the same, passes run at any time
+	StartHour, EndHour int
+	// Minimum time between the start of two passes
+	Interval time.Duration
+	// Max bytes per second to download. 0 means no limit
+	MaxBytesPerSec int64
+}
+
+// Warmer fills a cache with popular streams ahead of time, so the first viewers don't have to wait for the origin.
+// Blobs are fetched through the caching store, which keeps them.
+type Warmer struct {
+	store  store.BlobStore
+	source Source
+	grp    *stop.Group
+
+	mu   sync.Mutex
+	opts WarmerOpts
+
+	lastPass time.Time
+}
+
+// NewWarmer returns a warmer that fetches blobs through the store
+func NewWarmer(store store.BlobStore, source Source, opts WarmerOpts) *Warmer {
+	return &Warmer{
+		store:  store,
+		source: source,
+		opts:   opts,
+		grp:    stop.New(),
+	}
+}
+
+// Start runs passes in the background
+func (w *Warmer) Start() {
+	w.grp.Add(1)
+	go func() {
+		defer w.grp.Done()
+		w.run()
+	}()
+}
+
+// Shutdown stops the current pass and waits for it to end
+func (w *Warmer) Shutdown() {
+	w.grp.StopAndWait()
+}
+
+// SetLimits changes how many streams the next passes fetch, 0 pausing them, and how fast they download
+func (w *Warmer) SetLimits(limit int, maxBytesPerSec int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.opts.Limit = limit
+	w.opts.MaxBytesPerSec = maxBytesPerSec
+}
+
+func (w *Warmer) options() WarmerOpts {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.opts
+}
+
+func (w *Warmer) run() {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		opts := w.options()
+		if opts.Limit > 0 && w.inWindow(time.Now()) && time.Since(w.lastPass) >= opts.Interval {
+			w.lastPass = time.Now()
+			fetched, err := w.Pass()
+			if err != nil {
+				log.Errorf("prefetch pass failed: %s", errors.FullTrace(err))
+			} else {
+				log.Infof("prefetch pass fetched %d blobs", fetched)
+			}
+		}
+
+		select {
+		case <-w.grp.Ch():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Warmer) inWindow(t time.Time) bool {
+	opts := w.options()
+	start, end, hour := opts.StartHour, opts.EndHour, t.Hour()
+	if start == end {
+		return true
+	}
+	if start < end {
+		return hour >= start && hour < end
+	}
+	return hour >= start || hour < end
+}
+
+// Pass fetches the popular streams once. It stops early when the time window ends. It returns how many blobs were
+// fetched.
+func (w *Warmer) Pass() (int, error) {
+	opts := w.options()
+	hashes, err := w.source.Popular(opts.Limit)
+	if err != nil {
+		return 0, err
+	}
+
+	limiter := ratelimit.New(opts.MaxBytesPerSec, w.grp.Ch())
+	fetched := 0
+	for _, hash := range hashes {
+		if !w.inWindow(time.Now()) {
+			log.Infof("prefetch window ended, stopping the pass")
+			break
+		}
+
+		blobs, err := w.fetch(hash, limiter)
+		fetched += blobs
+		if errors.Is(err, ratelimit.ErrStopped) {
+			break
+		}
+		if err != nil {
+			log.Warnf("could not prefetch %s: %s", hash, err.Error())
+		}
+	}
+	return fetched, nil
+}
+
+// fetch gets a blob and, if it is an sd blob, the blobs of its stream
+func (w *Warmer) fetch(hash string, limiter *ratelimit.Limiter) (int, error) {
+	blob, _, err := w.store.Get(hash)
+	if err != nil {
+		return 0, err
+	}
+	err = limiter.Wait(len(blob))
+	if err != nil {
+		return 1, err
+	}
+
+	sd, err := shared.ParseSDBlob(blob)
+	if err != nil {
+		return 1, nil // just a popular blob
+	}
+
+	fetched := 1
+	for _, b := range sd.ContentBlobs() {
+		blob, _, err := w.store.Get(hex.EncodeToString(b.BlobHash))
+		if err != nil {
+			return fetched, err
+		}
+		fetched++
+		err = limiter.Wait(len(blob))
+		if err != nil {
+			return fetched, err
+		}
+	}
+	return fetched, nil
+}
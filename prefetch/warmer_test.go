@@ -0,0 +1,86 @@
+package prefetch
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type listSource []string
+
+func (l listSource) Popular(limit int) ([]string, error) { return l, nil }
+
+func TestWarmer_Pass(t *testing.T) {
+	data := make([]byte, stream.MaxBlobSize+100)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	s, err := stream.New(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	origin := store.NewMemStore()
+	for _, b := range s {
+		require.NoError(t, origin.Put(b.HashHex(), b))
+	}
+	require.NoError(t, origin.Put("notansdblob", []byte("blob")))
+	cache := store.NewMemStore()
+
+	w := NewWarmer(store.NewCachingStore("test", origin, cache), listSource{s[0].HashHex(), "notansdblob"}, WarmerOpts{Limit: 10})
+	fetched, err := w.Pass()
+	require.NoError(t, err)
+	assert.Equal(t, len(s)+1, fetched)
+
+	for _, b := range s {
+		has, err := cache.Has(b.HashHex())
+		require.NoError(t, err)
+		assert.True(t, has)
+	}
+}
+
+func TestWarmer_InWindow(t *testing.T) {
+	at := func(hour int) time.Time { return time.Date(2021, 1, 1, hour, 30, 0, 0, time.Local) }
+
+	w := &Warmer{opts: WarmerOpts{StartHour: 2, EndHour: 6}}
+	assert.False(t, w.inWindow(at(1)))
+	assert.True(t, w.inWindow(at(2)))
+	assert.True(t, w.inWindow(at(5)))
+	assert.False(t, w.inWindow(at(6)))
+
+	w.opts = WarmerOpts{StartHour: 22, EndHour: 4}
+	assert.True(t, w.inWindow(at(23)))
+	assert.True(t, w.inWindow(at(0)))
+	assert.False(t, w.inWindow(at(4)))
+	assert.False(t, w.inWindow(at(12)))
+
+	w.opts = WarmerOpts{}
+	assert.True(t, w.inWindow(at(12)))
+}
+
+func TestManifestSource(t *testing.T) {
+	f, err := ioutil.TempFile("", "manifest_*.json")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// the format of /stats/popular
+	_, err = f.WriteString(`[{"hash":"aa","count":10},{"hash":"bb","count":5},{"hash":"cc","count":1}]`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	hashes, err := ManifestSource(f.Name()).Popular(2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aa", "bb"}, hashes)
+
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte(`["aa","bb"]`), 0644))
+	hashes, err = ManifestSource(f.Name()).Popular(10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aa", "bb"}, hashes)
+}
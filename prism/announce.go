@@ -0,0 +1,75 @@
+package prism
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+// announceJitter is how far (as a fraction of the interval) the wait between two hashes may deviate from the interval
+const announceJitter = 0.2
+
+// announceScheduler hands hashes to the announcer of the prism at a steady pace instead of all at once.
+//
+// The announcer announces a new hash through its own dht node as soon as its announce rate allows, and then again
+// ReannounceTime after each announce, in the order the hashes were last announced in. Adding hundreds of thousands of
+// hashes in one loop therefore produces a burst that repeats every reannounce window. Spreading the adds over
+// ReannounceTime (with some jitter so that several nodes don't line up) keeps every later reannounce spread out as well.
+type announceScheduler struct {
+	add     func(bits.Bitmap)
+	window  time.Duration
+	maxRate int // hashes per second, 0 means unlimited
+}
+
+// interval returns the time to wait between two hashes so that total hashes fit into the window, without
+// exceeding maxRate
+func (a *announceScheduler) interval(total int) time.Duration {
+	var interval time.Duration
+	if total > 0 {
+		interval = a.window / time.Duration(total)
+	}
+	if a.maxRate > 0 {
+		if minInterval := time.Second / time.Duration(a.maxRate); interval < minInterval {
+			interval = minInterval
+		}
+	}
+	return interval
+}
+
+// run hands hashes from hashCh to the announcer until hashCh is closed or stopCh is closed. total is the expected
+// number of hashes and is used to compute the pace.
+func (a *announceScheduler) run(total int, hashCh <-chan bits.Bitmap, stopCh stop.Chan) {
+	interval := a.interval(total)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-timer.C:
+		}
+
+		select {
+		case <-stopCh:
+			return
+		case hash, more := <-hashCh:
+			if !more {
+				return
+			}
+			a.add(hash)
+		}
+
+		timer.Reset(jitter(interval))
+	}
+}
+
+// jitter returns d randomly shifted by up to announceJitter*d in either direction
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d + time.Duration((rand.Float64()*2-1)*announceJitter*float64(d))
+}
@@ -0,0 +1,444 @@
+package prism
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/dhtguard"
+	"github.com/lbryio/reflector.go/internal/dhtlookup"
+	"github.com/lbryio/reflector.go/internal/dhtnode"
+	"github.com/lbryio/reflector.go/internal/routingtable"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	"github.com/lyoshenka/bencode"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pingMethod      = "ping"
+	findValueMethod = "findValue"
+	storeMethod     = "store"
+
+	// detectDelay is how long after it starts the announcer first checks its external ip, so its lookups had time to
+	// fill the routing table
+	detectDelay = time.Minute
+	// detectInterval is how often the announcer checks its external ip after that
+	detectInterval = 30 * time.Minute
+)
+
+// announcer announces hashes in the dht, and announces each of them again once every window, like the announcer of the
+// dht package does. That one adds to the stop group of the dht for every hash it puts off and never takes it back, so a
+// dht that announced anything can't be shut down. The announcer uses a dht node of its own on a connection it closes
+// instead, and finds the nodes closest to a hash through the dht node of the prism, which only answers other nodes,
+// and the nodes in a routing table of its own. The nodes that answer its lookups go into the routing table, which
+// pings the ones it didn't hear from in a while and refreshes the buckets it had no news of.
+type announcer struct {
+	window   time.Duration
+	interval time.Duration // time between two announces, from the announce rate
+
+	mu sync.Mutex
+	// queue holds the hashes in the order they're announced in, so the ones announced longest ago are in front
+	queue  *list.List
+	hashes map[bits.Bitmap]*list.Element
+	port   int
+	wake   chan struct{}
+
+	// externalIP is the ip peers should download from, or nil. The announcer sends from it if it's an ip of this host
+	externalIP net.IP
+	// detect is whether the announcer asks the dht nodes of this repo which ip its announces come from
+	detect   bool
+	detected net.IP // guarded by mu
+
+	id     bits.Bitmap
+	node   *dht.Node
+	via    dht.Contact
+	lookup dhtlookup.Config
+	finder *dhtlookup.Finder
+	table  *routingtable.Table
+	grp    *stop.Group
+}
+
+// queued is a hash in the queue and when it was last announced
+type queued struct {
+	hash bits.Bitmap
+	last time.Time
+}
+
+// newAnnouncer returns an announcer that announces at most rate hashes per second, each of them once every window, with
+// peerPort as the port to download them from. lookup configures the lookups for the nodes to store the hashes on, and
+// table the routing table the lookups start from
+func newAnnouncer(rate int, window time.Duration, peerPort int, lookup dhtlookup.Config, table routingtable.TableConfig) *announcer {
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Second / time.Duration(rate)
+	}
+	id := bits.Rand()
+	return &announcer{
+		window:   window,
+		interval: interval,
+		queue:    list.New(),
+		hashes:   make(map[bits.Bitmap]*list.Element),
+		port:     peerPort,
+		wake:     make(chan struct{}, 1),
+		id:       id,
+		lookup:   lookup,
+		table:    routingtable.NewTable(id, table),
+		grp:      stop.New(),
+	}
+}
+
+// Start listens on the ip of addr, or on the external ip if it's an ip of this host, and starts announcing the hashes.
+// Packets of ips that go over the limits of dhtguard are dropped. Lookups start from via, the dht node of the prism.
+// The announcer doesn't store hashes on via, which would see the announcer's local address as the address of the peer
+func (a *announcer) Start(addr string, via dht.Contact) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Err(err)
+	}
+	if a.externalIP != nil && isLocalIP(a.externalIP) {
+		host = a.externalIP.String()
+	}
+	listener, err := net.ListenPacket(dht.Network, net.JoinHostPort(host, "0"))
+	if err != nil {
+		return errors.Err(err)
+	}
+	a.node = dht.NewNode(a.id)
+	err = a.node.Connect(dhtguard.New(listener.(*net.UDPConn)))
+	if err != nil {
+		return err
+	}
+	a.via = via
+	a.node.AddKnownNode(via)
+	a.finder = &dhtlookup.Finder{
+		Config: a.lookup,
+		Send: func(c dht.Contact, req dht.Request) <-chan *dht.Response {
+			return a.node.SendAsync(c, req)
+		},
+		Self: a.id,
+	}
+
+	a.grp.Add(2)
+	go func() {
+		defer a.grp.Done()
+		a.run()
+	}()
+	go func() {
+		defer a.grp.Done()
+		a.table.Run(a.ping, func(target bits.Bitmap) {
+			_, err := a.find(target, false)
+			if err != nil && !errors.Is(err, dhtlookup.ErrStopped) {
+				log.Debugf("refreshing the routing table: %s", err.Error())
+			}
+		}, a.grp.Ch())
+	}()
+	if a.detect {
+		a.grp.Add(1)
+		go func() {
+			defer a.grp.Done()
+			a.watchExternalIP()
+		}()
+	}
+	return nil
+}
+
+// Shutdown stops announcing and closes the connection of the announcer. The node is shut down first, which ends the
+// requests that are waiting for an answer
+func (a *announcer) Shutdown() {
+	a.grp.Stop()
+	if a.node != nil {
+		a.node.Shutdown()
+	}
+	a.grp.Wait()
+}
+
+// Add announces hash, and then again once every window until it's removed
+func (a *announcer) Add(hash bits.Bitmap) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.hashes[hash]; ok {
+		return
+	}
+	// new hashes are announced before the ones that are due again, like the dht package does
+	a.hashes[hash] = a.queue.PushFront(&queued{hash: hash})
+	a.signal()
+}
+
+// Remove stops announcing hash
+func (a *announcer) Remove(hash bits.Bitmap) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if e, ok := a.hashes[hash]; ok {
+		a.queue.Remove(e)
+		delete(a.hashes, hash)
+	}
+}
+
+// RemoveIf stops announcing the hashes remove returns true for, and returns how many there were
+func (a *announcer) RemoveIf(remove func(hash bits.Bitmap) bool) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	removed := 0
+	for hash, e := range a.hashes {
+		if remove(hash) {
+			a.queue.Remove(e)
+			delete(a.hashes, hash)
+			removed++
+		}
+	}
+	return removed
+}
+
+// SetPort changes the port that is announced, and announces the hashes again with it
+func (a *announcer) SetPort(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if port == a.port {
+		return
+	}
+	a.port = port
+	for e := a.queue.Front(); e != nil; e = e.Next() {
+		e.Value.(*queued).last = time.Time{}
+	}
+	a.signal()
+}
+
+// DetectedIP returns the ip the dht nodes of this repo last saw the announces come from, or nil if it's not known
+func (a *announcer) DetectedIP() net.IP {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.detected
+}
+
+// watchExternalIP checks the external ip every detectInterval until the announcer is shut down
+func (a *announcer) watchExternalIP() {
+	timer := time.NewTimer(detectDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-a.grp.Ch():
+			return
+		case <-timer.C:
+		}
+		_, err := a.detectExternalIP()
+		if err != nil {
+			log.Debugf("dht: detecting the external ip: %s", err.Error())
+		}
+		timer.Reset(detectInterval)
+	}
+}
+
+// detectExternalIP asks the nodes of the routing table which ip the announces come from. The dht nodes store that ip
+// as the address of the peer, so it logs an error if it's not the external ip
+func (a *announcer) detectExternalIP() (net.IP, error) {
+	ip, err := dhtnode.DetectExternalIP(func(c dht.Contact, req dht.Request) <-chan *dht.Response {
+		return a.node.SendAsync(c, req)
+	}, a.table.Closest(bits.Rand(), a.table.Len()))
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	changed := !ip.Equal(a.detected)
+	a.detected = ip
+	a.mu.Unlock()
+	if a.externalIP != nil && !ip.Equal(a.externalIP) {
+		log.Errorf("dht: announces come from %s, not the external ip %s, so peers are told to download from %s", ip,
+			a.externalIP, ip)
+	} else if changed {
+		log.Infof("dht: announces come from %s", ip)
+	}
+	return ip, nil
+}
+
+// Len returns how many hashes are announced
+func (a *announcer) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.hashes)
+}
+
+// signal wakes up run. The lock must be held
+func (a *announcer) signal() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run announces the hash in front of the queue when it's due, and moves it to the back
+func (a *announcer) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		a.mu.Lock()
+		var wait time.Duration
+		front := a.queue.Front()
+		if front != nil {
+			wait = time.Until(front.Value.(*queued).last.Add(a.window))
+		}
+		a.mu.Unlock()
+
+		if front == nil || wait > 0 {
+			var due <-chan time.Time
+			if front != nil {
+				resetTimer(timer, wait)
+				due = timer.C
+			}
+			select {
+			case <-a.grp.Ch():
+				return
+			case <-a.wake:
+			case <-due:
+			}
+			continue
+		}
+
+		a.mu.Lock()
+		// the front may have been removed while the lock wasn't held
+		front = a.queue.Front()
+		if front == nil || time.Until(front.Value.(*queued).last.Add(a.window)) > 0 {
+			a.mu.Unlock()
+			continue
+		}
+		q := front.Value.(*queued)
+		q.last = time.Now()
+		a.queue.MoveToBack(front)
+		port := a.port
+		a.mu.Unlock()
+
+		a.grp.Add(1)
+		go func(hash bits.Bitmap) {
+			defer a.grp.Done()
+			err := a.announce(hash, port)
+			if err != nil {
+				log.Error(errors.Prefix("announce "+hash.HexShort(), err))
+			}
+		}(q.hash)
+
+		resetTimer(timer, a.interval)
+		select {
+		case <-a.grp.Ch():
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// isLocalIP returns whether ip is an address of an interface of this host
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resetTimer stops t, drains it if it fired, and resets it to d
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// announce stores hash with port on the nodes closest to it. The lookup for them is a value lookup, so the nodes send
+// the tokens to store with along with their answer
+func (a *announcer) announce(hash bits.Bitmap, port int) error {
+	res, err := a.find(hash, true)
+	if errors.Is(err, dhtlookup.ErrStopped) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for _, c := range res.Contacts {
+		if c.ID == a.via.ID {
+			continue
+		}
+		wg.Add(1)
+		go func(c dht.Contact, token string) {
+			defer wg.Done()
+			a.store(c, hash, token, port)
+		}(c, res.Tokens[c.ID])
+	}
+	wg.Wait()
+	return nil
+}
+
+// find looks up target, starting from via and the nodes of the routing table closest to target. The routing table is
+// updated with the nodes that answered or failed
+func (a *announcer) find(target bits.Bitmap, findValue bool) (*dhtlookup.Result, error) {
+	start := append(a.table.Closest(target, dhtlookup.K), a.via)
+	res, err := a.finder.Find(target, start, findValue, a.grp.Ch())
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range res.Contacts {
+		a.table.Update(c)
+	}
+	for _, c := range res.Failed {
+		a.table.Fail(c)
+	}
+	return res, nil
+}
+
+// ping returns whether c answers a ping
+func (a *announcer) ping(c dht.Contact) bool {
+	return a.node.Send(c, dht.Request{Method: pingMethod}) != nil
+}
+
+// store stores hash on c with token, or with a token it asks c for if token is empty. Nodes only take stores with a
+// token they gave to the same node id and address
+func (a *announcer) store(c dht.Contact, hash bits.Bitmap, token string, port int) {
+	if token == "" {
+		res := a.node.Send(c, dht.Request{Method: findValueMethod, Arg: &hash})
+		if res == nil || res.Token == "" {
+			return
+		}
+		token = res.Token
+	}
+	req, err := storeRequest(hash, a.id, token, port)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	a.node.Send(c, req)
+}
+
+// storeValue is the value of a store request
+type storeValue struct {
+	Token  string      `bencode:"token"`
+	LbryID bits.Bitmap `bencode:"lbryid"`
+	Port   int         `bencode:"port"`
+}
+
+// storeRequest returns a request that stores hash for the peer with the id, on port. The dht package doesn't export the
+// arguments of store requests, so the request is decoded from its encoding. The node that sends it sets its message id
+// and node id
+func storeRequest(hash, id bits.Bitmap, token string, port int) (dht.Request, error) {
+	var req dht.Request
+	encoded, err := bencode.EncodeBytes(map[string]interface{}{
+		"3": storeMethod,
+		// the last argument is whether the peer stores the hash on itself, which the receiving node ignores
+		"4": []interface{}{hash, storeValue{Token: token, LbryID: id, Port: port}, id, 0},
+	})
+	if err != nil {
+		return req, errors.Err(err)
+	}
+	err = req.UnmarshalBencode(encoded)
+	return req, err
+}
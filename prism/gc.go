@@ -0,0 +1,155 @@
+package prism
+
+import (
+	"time"
+
+	"github.com/lbryio/reflector.go/db"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultGCGracePeriod is how old a blob that's not part of any stream must be before it's garbage collected. Blobs
+// of a stream can arrive before the sd blob that lists them, so this has to be longer than any upload could take.
+const DefaultGCGracePeriod = 7 * 24 * time.Hour
+
+// GCOpts configures a garbage collection run
+type GCOpts struct {
+	// only delete blobs that were added at least this long ago
+	GracePeriod time.Duration
+	// how many blobs to fetch from the db at a time
+	BatchSize int
+	// log the blobs that would be deleted without deleting them
+	DryRun bool
+}
+
+// CollectGarbage deletes blobs that belong to no stream and are older than the grace period. These are left behind
+// by uploads that were aborted before the sd blob was sent. Blobs that were in the db before it tracked when blobs
+// were added are never collected. Each blob is removed from the db first, unless a stream took it since it was listed,
+// and then from blobStore. It returns the number of blobs deleted (or that would be deleted, on a dry run).
+func CollectGarbage(sql *db.SQL, blobStore store.BlobStore, opts GCOpts, stopCh stop.Chan) (int, error) {
+	if opts.GracePeriod <= 0 {
+		opts.GracePeriod = DefaultGCGracePeriod
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+
+	olderThan := time.Now().Add(-opts.GracePeriod)
+	deleted := 0
+	after := ""
+	for {
+		hashes, err := sql.OrphanedBlobs(olderThan, after, opts.BatchSize)
+		if err != nil {
+			return deleted, err
+		}
+		if len(hashes) == 0 {
+			return deleted, nil
+		}
+		after = hashes[len(hashes)-1]
+
+		for _, hash := range hashes {
+			select {
+			case <-stopCh:
+				return deleted, nil
+			default:
+			}
+
+			if opts.DryRun {
+				log.Infof("gc: would delete %s", hash)
+				deleted++
+				continue
+			}
+			// a stream may have taken the blob since it was listed
+			ok, err := deleteIfUnreferenced(sql, blobStore, hash)
+			if err != nil {
+				log.Errorf("gc: error deleting %s: %s", hash, errors.FullTrace(err))
+				continue
+			}
+			if !ok {
+				log.Debugf("gc: keeping %s, a stream has it now", hash)
+				continue
+			}
+			deleted++
+		}
+		log.Infof("gc: %d orphaned blobs so far", deleted)
+	}
+}
+
+// unreferencedDeleter is a store that checks that no stream has a blob before deleting it, like the db-backed store
+type unreferencedDeleter interface {
+	DeleteIfUnreferenced(hash string) (bool, error)
+}
+
+// deleteIfUnreferenced deletes the blob from the db and then from blobStore, unless a stream has it. It returns
+// whether the blob was deleted
+func deleteIfUnreferenced(sql *db.SQL, blobStore store.BlobStore, hash string) (bool, error) {
+	if d, ok := blobStore.(unreferencedDeleter); ok {
+		return d.DeleteIfUnreferenced(hash)
+	}
+	// the blob leaves the db first, so it's never in the db without being in the store
+	ok, err := sql.DeleteIfUnreferenced(hash)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, blobStore.Delete(hash)
+}
+
+// ExpirePendingStreams aborts the uploads of streams that are missing blobs and got none of them for longer than ttl.
+// Their sd blobs are deleted from blobStore, and their content blobs are left for CollectGarbage. It returns the
+// number of streams that were aborted.
+func ExpirePendingStreams(sql *db.SQL, blobStore store.BlobStore, ttl time.Duration) (int, error) {
+	sdHashes, err := sql.AbortPendingStreams(time.Now().Add(-ttl))
+	for _, hash := range sdHashes {
+		log.Debugf("gc: aborting stream %s", hash)
+		e := blobStore.Delete(hash)
+		if e != nil {
+			log.Errorf("gc: error deleting sd blob %s: %s", hash, errors.FullTrace(e))
+		}
+	}
+	return len(sdHashes), err
+}
+
+// expirePendingStreams aborts abandoned uploads every hour until prism is shut down
+func (p *Prism) expirePendingStreams(ttl time.Duration) {
+	defer p.grp.Done()
+	RunPendingStreamExpiry(p.conf.DB, p.conf.Blobs, ttl, p.grp.Ch())
+}
+
+// RunPendingStreamExpiry aborts abandoned uploads with ExpirePendingStreams every hour until stopCh is closed
+func RunPendingStreamExpiry(sql *db.SQL, blobStore store.BlobStore, ttl time.Duration, stopCh stop.Chan) {
+	for {
+		aborted, err := ExpirePendingStreams(sql, blobStore, ttl)
+		if err != nil {
+			log.Errorf("gc: %s", errors.FullTrace(err))
+		}
+		if aborted > 0 {
+			log.Infof("gc: aborted %d abandoned stream uploads", aborted)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
+
+// runGC collects garbage every interval until prism is shut down
+func (p *Prism) runGC(interval time.Duration) {
+	defer p.grp.Done()
+	for {
+		select {
+		case <-p.grp.Ch():
+			return
+		case <-time.After(interval):
+		}
+		deleted, err := CollectGarbage(p.conf.DB, p.conf.Blobs, GCOpts{GracePeriod: p.conf.GCGracePeriod}, p.grp.Ch())
+		if err != nil {
+			log.Errorf("gc: %s", errors.FullTrace(err))
+		}
+		log.Infof("gc: deleted %d orphaned blobs", deleted)
+	}
+}
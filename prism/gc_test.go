@@ -0,0 +1,83 @@
+package prism
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/db"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+// deleteHookStore calls onDelete before each blob is deleted
+type deleteHookStore struct {
+	store.BlobStore
+	onDelete func(hash string)
+}
+
+func (s *deleteHookStore) Delete(hash string) error {
+	s.onDelete(hash)
+	return s.BlobStore.Delete(hash)
+}
+
+func TestCollectGarbage_BlobTakenByStream(t *testing.T) {
+	if !db.SQLiteSupported {
+		t.Skip("sqlite needs cgo")
+	}
+	sqlDB := &db.SQL{}
+	err := sqlDB.Connect(db.SQLitePrefix + filepath.Join(t.TempDir(), "reflector.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orphan := strings.Repeat("a", 96)
+	taken := strings.Repeat("b", 96) // an orphan when the gc lists it, but in a stream by the time it's deleted
+	mem := store.NewMemStore()
+	for _, hash := range []string{orphan, taken} {
+		err = mem.Put(hash, []byte(hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sqlDB.AddBlob(hash, len(hash), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hooked := &deleteHookStore{BlobStore: mem, onDelete: func(hash string) {
+		if hash != orphan {
+			return
+		}
+		var sd db.SdBlob
+		err := json.Unmarshal([]byte(`{"stream_hash":"`+strings.Repeat("d", 96)+`","blobs":[`+
+			`{"blob_num":0,"length":96,"blob_hash":"`+taken+`","iv":"00"},{"blob_num":1,"length":0,"iv":"00"}]}`), &sd)
+		if err == nil {
+			err = sqlDB.AddSDBlob(strings.Repeat("c", 96), 200, sd)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	}}
+
+	deleted, err := CollectGarbage(sqlDB, store.NewDBBackedStore(hooked, sqlDB, false),
+		GCOpts{GracePeriod: time.Nanosecond}, stop.New().Ch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("expected only the orphan to be deleted, got %d", deleted)
+	}
+	if has, _ := mem.Has(orphan); has {
+		t.Error("expected the orphan to be deleted")
+	}
+	if has, _ := mem.Has(taken); !has {
+		t.Error("expected the blob a stream took to be kept")
+	}
+	if has, _ := sqlDB.HasBlob(taken, false); !has {
+		t.Error("expected the blob a stream took to stay in the db")
+	}
+}
@@ -2,11 +2,16 @@ package prism
 
 import (
 	"context"
+	"net"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/lbryio/reflector.go/cluster"
 	"github.com/lbryio/reflector.go/db"
+	"github.com/lbryio/reflector.go/internal/dhtlookup"
+	"github.com/lbryio/reflector.go/internal/routingtable"
+	"github.com/lbryio/reflector.go/nat"
 	"github.com/lbryio/reflector.go/reflector"
 	"github.com/lbryio/reflector.go/server/peer"
 	"github.com/lbryio/reflector.go/store"
@@ -22,16 +27,63 @@ import (
 type Config struct {
 	PeerPort      int
 	ReflectorPort int
+	// ExternalPeerPort is the peer port that is announced in the dht, for nodes behind a NAT that forwards another
+	// port to PeerPort. PeerPort is announced if it's 0
+	ExternalPeerPort int
+	// ExternalIP is the ipv4 address peers download from, for nodes behind a static NAT or with several addresses. Dht
+	// nodes store the address that announces come from and can't be told another one, so the announces are sent from
+	// ExternalIP if it's an address of this host. Otherwise the NAT has to send them from it, which DetectExternalIP
+	// checks
+	ExternalIP string
+	// DetectExternalIP has the announcer ask the dht nodes of this repo which ip its announces come from every half
+	// hour, and log an error if it's not ExternalIP. With NAT, the external ip of the gateway is checked too
+	DetectExternalIP bool
 
 	DhtAddress   string
 	DhtSeedNodes []string
+	// DhtNodeID is the id of the dht node in hex. A random id is used if it's empty
+	DhtNodeID string
+	// DhtRPCPort is the port of the json-rpc server of the dht node, which answers anyone who can reach it. It's off
+	// if 0
+	DhtRPCPort int
+	// DhtRoutingTableFile keeps the routing table of the dht node, so a restarted node rejoins the dht through the
+	// nodes it knew before. The routing table is read and refilled through the rpc server, so it needs DhtRPCPort
+	DhtRoutingTableFile string
+
+	// send at most this many announces per second
+	AnnounceRate int
+	// announces are spread over this window, which is also how often the announcer announces each hash again
+	ReannounceTime time.Duration
+	// DhtLookup configures the lookups of the announcer for the nodes to store hashes on: how many nodes it asks at
+	// once, how long it waits for each, and whether it asks them in rounds. The defaults are those of the dht package
+	DhtLookup dhtlookup.Config
+	// DhtRoutingTable configures the routing table the lookups of the announcer start from: how often its buckets are
+	// refreshed, and how its nodes are pinged and dropped
+	DhtRoutingTable routingtable.TableConfig
+
+	// map the dht and peer ports on the local gateway using NAT-PMP or UPnP
+	NAT bool
 
 	ClusterPort     int
 	ClusterSeedAddr string
+	// roles of this node in the cluster, all of them if empty. only announcers split the hashes to announce
+	ClusterRoles []string
+	// how big this node's share of the hashes to announce is compared to the other announcers. 1 if 0
+	ClusterCapacity int
+	// json list of base64 keys to encrypt the cluster gossip with. not encrypted if empty
+	ClusterKeyringFile string
 
 	// limit the range of hashes to announce. useful for testing
 	HashRange *bits.Range
 
+	// delete blobs that belong to no stream this often. 0 disables it. only one node of a cluster needs to do this
+	GCInterval time.Duration
+	// only delete blobs that were added at least this long ago
+	GCGracePeriod time.Duration
+	// abort uploads of streams that are missing blobs and got none of them for this long, which deletes their sd blobs
+	// from Blobs. 0 disables it
+	PendingStreamTTL time.Duration
+
 	DB    *db.SQL
 	Blobs store.BlobStore
 }
@@ -39,7 +91,9 @@ type Config struct {
 // DefaultConf returns a default config
 func DefaultConf() *Config {
 	return &Config{
-		ClusterPort: cluster.DefaultPort,
+		ClusterPort:    cluster.DefaultPort,
+		AnnounceRate:   dht.DefaultAnnounceRate,
+		ReannounceTime: dht.DefaultReannounceTime,
 	}
 }
 
@@ -48,10 +102,22 @@ type Prism struct {
 	conf *Config
 
 	db        *db.SQL
-	dht       *dht.DHT
 	peer      *peer.Server
 	reflector *reflector.Server
 	cluster   *cluster.Cluster
+	nat       *nat.Service
+
+	dht        *dht.DHT
+	dhtConf    *dht.Config
+	dhtRunning bool
+	announcer  *announcer
+	// savedContacts are the saved nodes of the routing table that aren't seed nodes, added once the dht runs
+	savedContacts []dht.Contact
+	rtSaver       *routingtable.Saver
+
+	announceMu    sync.Mutex
+	announceGrp   *stop.Group
+	announceRange *bits.Range
 
 	grp *stop.Group
 }
@@ -64,30 +130,71 @@ func New(conf *Config) *Prism {
 
 	dhtConf := dht.NewStandardConfig()
 	dhtConf.Address = conf.DhtAddress
+	dhtConf.NodeID = conf.DhtNodeID
 	dhtConf.PeerProtocolPort = conf.PeerPort
+	if conf.ExternalPeerPort > 0 {
+		dhtConf.PeerProtocolPort = conf.ExternalPeerPort
+	}
+	dhtConf.RPCPort = conf.DhtRPCPort
 	if len(conf.DhtSeedNodes) > 0 {
 		dhtConf.SeedNodes = conf.DhtSeedNodes
 	}
+	var saved []dht.Contact
+	if conf.DhtRoutingTableFile != "" {
+		contacts, err := routingtable.Load(conf.DhtRoutingTableFile)
+		if err != nil {
+			log.Errorf("loading the routing table: %s", err.Error())
+		}
+		var seeds []string
+		seeds, saved = routingtable.Seeds(contacts)
+		dhtConf.SeedNodes = append(seeds, dhtConf.SeedNodes...)
+		log.Infof("rejoining the dht through %d saved nodes", len(contacts))
+	}
+	if conf.AnnounceRate > 0 {
+		dhtConf.AnnounceRate = conf.AnnounceRate
+	}
+	if conf.ReannounceTime > 0 {
+		dhtConf.ReannounceTime = conf.ReannounceTime
+	}
 	d := dht.New(dhtConf)
 
 	c := cluster.New(conf.ClusterPort, conf.ClusterSeedAddr)
+	c.Roles = conf.ClusterRoles
+	c.Capacity = conf.ClusterCapacity
+	c.KeyringFile = conf.ClusterKeyringFile
+
+	a := newAnnouncer(dhtConf.AnnounceRate, dhtConf.ReannounceTime, dhtConf.PeerProtocolPort, conf.DhtLookup,
+		conf.DhtRoutingTable)
+	a.externalIP = net.ParseIP(conf.ExternalIP).To4()
+	a.detect = conf.DetectExternalIP
 
 	p := &Prism{
 		conf: conf,
 
-		db:        conf.DB,
-		dht:       d,
-		cluster:   c,
-		peer:      peer.NewServer(conf.Blobs),
-		reflector: reflector.NewServer(conf.Blobs, conf.Blobs),
+		db:            conf.DB,
+		dht:           d,
+		dhtConf:       dhtConf,
+		savedContacts: saved,
+		announcer:     a,
+		cluster:       c,
+		peer:          peer.NewServer(conf.Blobs),
+		reflector:     reflector.NewServer(conf.Blobs, conf.Blobs),
 
 		grp: stop.New(),
 	}
 
-	c.OnMembershipChange = func(n, total int) {
+	c.OnAnnounceShareChange = func(share cluster.Share) {
+		p.grp.Add(1)
+		go func() {
+			p.AnnounceShare(share)
+			p.grp.Done()
+		}()
+	}
+
+	p.reflector.OnBlobReceived = func(hash string, _ bool) {
 		p.grp.Add(1)
 		go func() {
-			p.AnnounceRange(n, total)
+			p.announceNew(hash)
 			p.grp.Done()
 		}()
 	}
@@ -107,6 +214,14 @@ func (p *Prism) Start() error {
 		return errors.Err("blobs required in conf")
 	}
 
+	if p.conf.DhtRoutingTableFile != "" && p.conf.DhtRPCPort == 0 {
+		return errors.Err("the dht routing table file needs the dht rpc port")
+	}
+
+	if p.conf.ExternalIP != "" && p.announcer.externalIP == nil {
+		return errors.Err("external ip %q is not an ipv4 address", p.conf.ExternalIP)
+	}
+
 	err = p.peer.Start(":" + strconv.Itoa(p.conf.PeerPort))
 	if err != nil {
 		return err
@@ -117,19 +232,156 @@ func (p *Prism) Start() error {
 		return err
 	}
 
-	err = p.dht.Start()
+	// the announcer takes the peer port the gateway mapped, so the ports are mapped before it starts
+	if p.conf.NAT {
+		p.startNAT()
+	}
+
+	err = p.startDHT()
 	if err != nil {
 		return err
 	}
 
+	if p.conf.PendingStreamTTL > 0 {
+		p.grp.Add(1)
+		go p.expirePendingStreams(p.conf.PendingStreamTTL)
+	}
+
+	if p.conf.GCInterval > 0 {
+		p.grp.Add(1)
+		go p.runGC(p.conf.GCInterval)
+	}
+
 	return p.cluster.Connect()
 }
 
+// startNAT maps the dht and peer ports on the gateway, and sets the peer port the announcer announces to the one the
+// gateway mapped, now and whenever a renewal changes it. It must run before the dht is started. Not being able to map
+// the ports is not fatal, since the node may not be behind a NAT at all.
+func (p *Prism) startNAT() {
+	_, dhtPort, err := net.SplitHostPort(p.conf.DhtAddress)
+	if err != nil {
+		log.Errorf("nat: cannot parse dht address: %s", err.Error())
+		return
+	}
+	dhtPortNum, err := strconv.Atoi(dhtPort)
+	if err != nil {
+		log.Errorf("nat: cannot parse dht port: %s", err.Error())
+		return
+	}
+
+	p.nat = nat.New(
+		nat.Mapping{Protocol: nat.ProtocolUDP, InternalPort: dhtPortNum},
+		nat.Mapping{Protocol: nat.ProtocolTCP, InternalPort: p.conf.PeerPort, ExternalPort: p.conf.ExternalPeerPort},
+	)
+	p.nat.OnChange = func(m nat.Mapping) {
+		if m.Protocol == nat.ProtocolTCP {
+			p.setPeerPort(m.ExternalPort)
+		}
+	}
+	err = p.nat.Start()
+	if err != nil {
+		log.Warnf("nat: port mapping failed, the node may not be reachable from outside: %s", err.Error())
+		p.nat.Shutdown()
+		p.nat = nil
+		return
+	}
+	for _, m := range p.nat.Mappings() {
+		p.nat.OnChange(m)
+	}
+	if gateway := p.nat.ExternalIP(); p.conf.DetectExternalIP && p.announcer.externalIP != nil && gateway != nil &&
+		!gateway.Equal(p.announcer.externalIP) {
+		log.Errorf("nat: the gateway's external ip is %s, not the external ip %s", gateway, p.announcer.externalIP)
+	}
+}
+
+// ExternalIP returns the ip peers are told to download from as far as it's known: the one the dht nodes of this repo
+// saw the announces come from, the external ip of the config, or the external ip of the NAT gateway. It's nil if none
+// of them is known
+func (p *Prism) ExternalIP() net.IP {
+	if ip := p.announcer.DetectedIP(); ip != nil {
+		return ip
+	}
+	if p.announcer.externalIP != nil {
+		return p.announcer.externalIP
+	}
+	if p.nat != nil {
+		return p.nat.ExternalIP()
+	}
+	return nil
+}
+
+// setPeerPort changes the peer port that is announced in the dht. The hashes that were announced already are
+// announced again with the new port
+func (p *Prism) setPeerPort(port int) {
+	log.Infof("nat: announcing peer port %d", port)
+	p.announcer.SetPort(port)
+}
+
+// startDHT starts the dht node, and the announcer that finds the nodes to announce to through it. With a routing table
+// file, the saved nodes go in the routing table and it's saved while the node runs
+func (p *Prism) startDHT() error {
+	err := p.dht.Start()
+	if err != nil {
+		return err
+	}
+	p.dhtRunning = true
+	if p.conf.DhtRoutingTableFile != "" {
+		rpcAddr := "127.0.0.1:" + strconv.Itoa(p.conf.DhtRPCPort)
+		err = routingtable.Restore(rpcAddr, p.savedContacts)
+		if err != nil {
+			log.Errorf("restoring the routing table: %s", err.Error())
+		}
+		p.rtSaver = routingtable.NewSaver(rpcAddr, p.conf.DhtRoutingTableFile)
+		p.rtSaver.Start()
+	}
+	via := dht.Contact{ID: p.dht.ID(), IP: net.IPv4(127, 0, 0, 1)}
+	host, port, err := net.SplitHostPort(p.dhtConf.Address)
+	if err != nil {
+		return errors.Err(err)
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		via.IP = ip
+	}
+	via.Port, err = strconv.Atoi(port)
+	if err != nil {
+		return errors.Err(err)
+	}
+	return p.announcer.Start(p.dhtConf.Address, via)
+}
+
+// stopDHT stops the announcer and the dht node. The routing table is read through the rpc server, so it's saved before
+// the node shuts down
+func (p *Prism) stopDHT() {
+	p.announcer.Shutdown()
+	if p.rtSaver != nil {
+		p.rtSaver.Shutdown()
+		p.rtSaver = nil
+	}
+	if p.dhtRunning {
+		p.dht.Shutdown()
+		p.dhtRunning = false
+	}
+}
+
+// announce adds a hash to the ones that are announced
+func (p *Prism) announce(hash bits.Bitmap) {
+	p.announcer.Add(hash)
+}
+
+// nodeID returns the short id of the dht node, for logging
+func (p *Prism) nodeID() string {
+	return p.dht.ID().HexShort()
+}
+
 // Shutdown gracefully shuts down the different prism components before exiting.
 func (p *Prism) Shutdown() {
 	p.grp.StopAndWait()
+	if p.nat != nil {
+		p.nat.Shutdown()
+	}
 	p.cluster.Shutdown()
-	p.dht.Shutdown()
+	p.stopDHT()
 	p.reflector.Shutdown()
 	p.peer.Shutdown()
 }
@@ -138,7 +390,19 @@ func (p *Prism) Shutdown() {
 func (p *Prism) AnnounceRange(n, total int) {
 	// num and total are 1-indexed
 	if n < 1 {
-		log.Errorf("%s: n must be >= 1", p.dht.ID().HexShort())
+		log.Errorf("%s: n must be >= 1", p.nodeID())
+		return
+	}
+	p.AnnounceShare(cluster.Share{Offset: n - 1, Size: 1, Total: total})
+}
+
+// AnnounceShare announces this node's share of the hashes, and stops announcing the hashes outside of it. The hashes
+// of the share are handed to the announcer in the background, spread over the reannounce window. An empty share stops
+// announcing
+func (p *Prism) AnnounceShare(share cluster.Share) {
+	if share.None() {
+		log.Infof("%s: not an announcer, not announcing any hashes", p.nodeID())
+		p.setAnnounceRange(nil, nil)
 		return
 	}
 
@@ -146,28 +410,79 @@ func (p *Prism) AnnounceRange(n, total int) {
 	if p.conf.HashRange != nil {
 		r = *p.conf.HashRange
 	} else {
-		//r := bits.MaxRange().IntervalP(n, total)
+		//r := share.Of(bits.MaxRange())
 		// TODO: this is temporary. it lets me test with a small number of hashes. use the full range in production
 		min, max, err := p.db.GetHashRange()
 		if err != nil {
-			log.Errorf("%s: error getting hash range: %s", p.dht.ID().HexShort(), err.Error())
+			log.Errorf("%s: error getting hash range: %s", p.nodeID(), err.Error())
 			return
 		}
-		r = (bits.Range{Start: bits.FromHexP(min), End: bits.FromHexP(max)}).IntervalP(n, total)
+		r = share.Of(bits.Range{Start: bits.FromHexP(min), End: bits.FromHexP(max)})
+	}
+
+	log.Infof("%s: hash range is now %s to %s", p.nodeID(), r.Start, r.End)
+
+	count, err := p.db.CountStoredHashesInRange(r.Start, r.End)
+	if err != nil {
+		log.Errorf("%s: error counting hashes in range: %s", p.nodeID(), err.Error())
+		return
 	}
 
-	log.Infof("%s: hash range is now %s to %s", p.dht.ID().HexShort(), r.Start, r.End)
+	// a membership change makes the previous range obsolete, so stop feeding it to the dht
+	grp := stop.New(p.grp)
+	p.setAnnounceRange(&r, grp)
+
+	p.grp.Add(1)
+	go func() {
+		defer p.grp.Done()
+		p.announceRangeHashes(r, count, grp)
+	}()
+}
+
+// setAnnounceRange stops the sweep of the previous range, and removes the hashes outside of r from the announcer. grp
+// is the stop group of the sweep of r. Nothing is announced if r is nil
+func (p *Prism) setAnnounceRange(r *bits.Range, grp *stop.Group) {
+	p.announceMu.Lock()
+	defer p.announceMu.Unlock()
+	if p.announceGrp != nil {
+		p.announceGrp.Stop()
+	}
+	p.announceGrp = grp
+	p.announceRange = r
+
+	removed := p.announcer.RemoveIf(func(hash bits.Bitmap) bool { return r == nil || !r.Contains(hash) })
+	if removed > 0 {
+		log.Infof("%s: stopped announcing %d hashes outside of the hash range", p.nodeID(), removed)
+	}
+}
 
+// announceRangeHashes hands the count stored hashes of r to the announcer, spread over the reannounce window, until
+// grp is stopped
+func (p *Prism) announceRangeHashes(r bits.Range, count int, grp *stop.Group) {
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	hashCh, errCh := p.db.GetStoredHashesInRange(ctx, r.Start, r.End)
 
+	scheduler := &announceScheduler{
+		add: func(hash bits.Bitmap) {
+			// the range may have changed since the hash was read, and its hashes removed
+			p.announceMu.Lock()
+			defer p.announceMu.Unlock()
+			if p.announceGrp == grp {
+				p.announce(hash)
+			}
+		},
+		window:  p.dhtConf.ReannounceTime,
+		maxRate: p.dhtConf.AnnounceRate,
+	}
+
 	var wg sync.WaitGroup
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		select {
-		case <-p.grp.Ch():
+		case <-grp.Ch():
 			return
 		case err, more := <-errCh:
 			if more && err != nil {
@@ -179,20 +494,26 @@ func (p *Prism) AnnounceRange(n, total int) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		for {
-			select {
-			case <-p.grp.Ch():
-				cancel()
-				return
-			case hash, more := <-hashCh:
-				if !more {
-					return
-				}
-				//log.Infof("%s: announcing %s", p.dht.ID().HexShort(), hash.Hex())
-				p.dht.Add(hash)
-			}
-		}
+		scheduler.run(count, hashCh, grp.Ch())
+		cancel()
 	}()
 
 	wg.Wait()
 }
+
+// announceNew announces a newly received blob right away if it falls into this node's hash range, instead of
+// waiting for the next full sweep of the range
+func (p *Prism) announceNew(hash string) {
+	h, err := bits.FromHex(hash)
+	if err != nil {
+		log.Errorf("%s: not announcing invalid hash %s: %s", p.nodeID(), hash, err.Error())
+		return
+	}
+
+	p.announceMu.Lock()
+	defer p.announceMu.Unlock()
+	if p.announceRange == nil || !p.announceRange.Contains(h) {
+		return
+	}
+	p.announce(h)
+}
@@ -2,11 +2,22 @@ package prism
 
 import (
 	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/lbryio/reflector.go/cluster"
+	"github.com/lbryio/reflector.go/db"
+	"github.com/lbryio/reflector.go/internal/dhtnode"
+	"github.com/lbryio/reflector.go/internal/routingtable"
+
+	"github.com/lbryio/lbry.go/v2/dht"
 	"github.com/lbryio/lbry.go/v2/dht/bits"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/phayes/freeport"
 )
 
 func TestAnnounceRange(t *testing.T) {
@@ -39,3 +50,311 @@ func TestAnnounceRange(t *testing.T) {
 	//t.Logf("%s to %s\n", startB.Hex(), endB.Hex())
 
 }
+
+func TestAnnounceScheduler_Interval(t *testing.T) {
+	a := &announceScheduler{window: 50 * time.Minute, maxRate: 10}
+
+	if i := a.interval(3000); i != 1*time.Second {
+		t.Errorf("expected 1s interval for 3000 hashes in 50m, got %s", i)
+	}
+	if i := a.interval(1000000); i != 100*time.Millisecond {
+		t.Errorf("expected interval to be capped by max rate, got %s", i)
+	}
+
+	a.maxRate = 0
+	if i := a.interval(0); i != 0 {
+		t.Errorf("expected no interval without hashes or rate limit, got %s", i)
+	}
+}
+
+func TestPrism_SetPeerPort(t *testing.T) {
+	if testing.Short() {
+		t.Skip("dht joins and lookups take a few seconds each")
+	}
+	seed := startDHT(t)
+	finder := startDHT(t, seed.addr)
+	p := New(&Config{DhtAddress: "127.0.0.1:" + strconv.Itoa(freePort(t)), DhtSeedNodes: []string{seed.addr}, PeerPort: 5567})
+	p.setPeerPort(6000)
+	err := p.startDHT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.stopDHT()
+
+	hash := bits.Rand()
+	p.announce(hash)
+	waitForPeerPort(t, finder, hash, 6000)
+
+	// the port changes while the dht announces, and the hash is announced again with the new one
+	p.setPeerPort(6001)
+	waitForPeerPort(t, finder, hash, 6001)
+
+	// the dht shuts down after it announced
+	done := make(chan struct{})
+	go func() {
+		p.stopDHT()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the dht did not shut down")
+	}
+}
+
+func TestAnnouncer_DetectExternalIP(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := dhtnode.New(bits.Rand(), dhtnode.Config{})
+	node.Connect(conn, nil)
+	defer node.Shutdown()
+	c := dht.Contact{ID: node.ID(), IP: net.IPv4(127, 0, 0, 1), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+
+	p := New(&Config{ExternalIP: "203.0.113.1"})
+	err = p.announcer.Start("127.0.0.1:0", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.announcer.Shutdown()
+	if ip := p.ExternalIP(); !ip.Equal(net.IPv4(203, 0, 113, 1)) {
+		t.Errorf("expected the external ip of the config before it's detected, got %s", ip)
+	}
+
+	// the announces come from localhost, not from the external ip, which isn't an ip of this host
+	p.announcer.table.Update(c)
+	ip, err := p.announcer.detectExternalIP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("expected the node to see the announcer at 127.0.0.1, got %s", ip)
+	}
+	if ip := p.ExternalIP(); !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("expected the detected ip, got %s", ip)
+	}
+}
+
+func TestIsLocalIP(t *testing.T) {
+	if !isLocalIP(net.IPv4(127, 0, 0, 1)) {
+		t.Error("expected 127.0.0.1 to be local")
+	}
+	if isLocalIP(net.IPv4(203, 0, 113, 1)) {
+		t.Error("expected 203.0.113.1 not to be local")
+	}
+}
+
+func TestPrism_RoutingTableFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("dht joins take a few seconds each")
+	}
+	seed := startDHT(t)
+	path := filepath.Join(t.TempDir(), "routing_table.json")
+	newPrism := func(seeds ...string) *Prism {
+		return New(&Config{
+			DhtAddress:          "127.0.0.1:" + strconv.Itoa(freePort(t)),
+			DhtSeedNodes:        seeds,
+			DhtRPCPort:          freePort(t),
+			DhtRoutingTableFile: path,
+		})
+	}
+
+	// the first node joins through the seed, and saves it when it stops
+	p := newPrism(seed.addr)
+	err := p.startDHT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.stopDHT()
+	saved, err := routingtable.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].ID != seed.ID() {
+		t.Fatalf("expected the seed in the routing table, got %v", saved)
+	}
+
+	// after a restart, the saved node is the first seed node
+	p = newPrism()
+	if p.dhtConf.SeedNodes[0] != seed.addr {
+		t.Fatalf("expected the saved node as a seed, got %v", p.dhtConf.SeedNodes)
+	}
+}
+
+func TestPrism_AnnounceShare(t *testing.T) {
+	low, high := hashWithPrefix(0x10), hashWithPrefix(0xf0)
+	// with two hashes in an hour, the second one is handed to the announcer half an hour after the first
+	p := announcingPrism(t, time.Hour, low, high)
+	share := cluster.Share{Offset: 0, Size: 1, Total: 1}
+
+	all := bits.MaxRange()
+	p.conf.HashRange = &all
+	returned := make(chan struct{})
+	go func() {
+		p.AnnounceShare(share)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("AnnounceShare waited for the hashes to be announced")
+	}
+	waitForAnnounced(t, p, low)
+
+	// the hashes that leave the range aren't announced anymore
+	upper := bits.Range{Start: hashWithPrefix(0x80), End: bits.MaxP()}
+	p.conf.HashRange = &upper
+	p.AnnounceShare(share)
+	if announced(p, low) {
+		t.Error("expected the hash that left the range not to be announced")
+	}
+	waitForAnnounced(t, p, high)
+
+	p.AnnounceShare(cluster.Share{})
+	if n := p.announcer.Len(); n != 0 {
+		t.Errorf("expected no hashes to be announced without a share, got %d", n)
+	}
+}
+
+func TestPrism_AnnounceNew(t *testing.T) {
+	stored, last := hashWithPrefix(0x10), hashWithPrefix(0x30)
+	p := announcingPrism(t, 100*time.Millisecond, stored, last)
+	lower := bits.Range{Start: bits.Bitmap{}, End: hashWithPrefix(0x80)}
+	p.conf.HashRange = &lower
+
+	// nothing is announced before there's a range
+	received := hashWithPrefix(0x20)
+	p.announceNew(received.Hex())
+	if announced(p, received) {
+		t.Fatal("expected nothing to be announced without a range")
+	}
+
+	p.AnnounceShare(cluster.Share{Offset: 0, Size: 1, Total: 1})
+	waitForAnnounced(t, p, last)
+
+	// a blob received in the range is announced right away, once
+	p.announceNew(received.Hex())
+	if !announced(p, received) {
+		t.Fatal("expected the new blob to be announced")
+	}
+	p.announcer.mu.Lock()
+	queued := p.announcer.hashes[received]
+	p.announcer.mu.Unlock()
+	p.announceNew(received.Hex())
+	p.announceNew(hashWithPrefix(0xf0).Hex())
+	p.announceNew("not a hash")
+	if n := p.announcer.Len(); n != 3 {
+		t.Errorf("expected 3 hashes to be announced, got %d", n)
+	}
+
+	// the next cycle finds the blob in the db, and keeps it where it is in the queue instead of announcing it again
+	err := p.db.AddBlob(received.Hex(), 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.announcer.Remove(last)
+	p.AnnounceShare(cluster.Share{Offset: 0, Size: 1, Total: 1})
+	waitForAnnounced(t, p, last)
+	p.announcer.mu.Lock()
+	requeued := p.announcer.hashes[received] != queued
+	p.announcer.mu.Unlock()
+	if requeued {
+		t.Error("expected the new blob not to be queued again")
+	}
+	if n := p.announcer.Len(); n != 3 {
+		t.Errorf("expected 3 hashes to be announced, got %d", n)
+	}
+}
+
+// announcingPrism returns a prism that is not started, with a db that stores the hashes. Its announcer queues the
+// hashes without announcing them
+func announcingPrism(t *testing.T, window time.Duration, hashes ...bits.Bitmap) *Prism {
+	if !db.SQLiteSupported {
+		t.Skip("sqlite needs cgo")
+	}
+	sqlDB := &db.SQL{}
+	err := sqlDB.Connect(db.SQLitePrefix + filepath.Join(t.TempDir(), "reflector.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range hashes {
+		err = sqlDB.AddBlob(h.Hex(), 100, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := New(&Config{DB: sqlDB, AnnounceRate: 1000, ReannounceTime: window})
+	t.Cleanup(p.grp.StopAndWait)
+	return p
+}
+
+// hashWithPrefix returns the hash that starts with the byte, followed by zeroes
+func hashWithPrefix(b byte) bits.Bitmap {
+	var h bits.Bitmap
+	h[0] = b
+	return h
+}
+
+// announced returns whether the announcer of p announces hash
+func announced(p *Prism, hash bits.Bitmap) bool {
+	p.announcer.mu.Lock()
+	defer p.announcer.mu.Unlock()
+	_, ok := p.announcer.hashes[hash]
+	return ok
+}
+
+// waitForAnnounced waits until the announcer of p announces hash
+func waitForAnnounced(t *testing.T, p *Prism, hash bits.Bitmap) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if announced(p, hash) {
+			return
+		}
+	}
+	t.Fatalf("expected %s to be announced", hash.HexShort())
+}
+
+// testDHT is a dht node on localhost
+type testDHT struct {
+	*dht.DHT
+	addr string
+}
+
+func startDHT(t *testing.T, seeds ...string) testDHT {
+	conf := dht.NewStandardConfig()
+	conf.Address = "127.0.0.1:" + strconv.Itoa(freePort(t))
+	conf.SeedNodes = seeds
+	d := dht.New(conf)
+	err := d.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Shutdown)
+	return testDHT{DHT: d, addr: conf.Address}
+}
+
+func freePort(t *testing.T) int {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+// waitForPeerPort waits until d finds a peer for the hash on the port
+func waitForPeerPort(t *testing.T, d testDHT, hash bits.Bitmap, port int) {
+	var peers []dht.Contact
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(100 * time.Millisecond) {
+		var err error
+		peers, err = d.Get(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range peers {
+			if c.PeerPort == port {
+				return
+			}
+		}
+	}
+	t.Fatalf("expected a peer on port %d, got %v", port, peers)
+}
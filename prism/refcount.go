@@ -0,0 +1,49 @@
+package prism
+
+import (
+	"github.com/lbryio/reflector.go/db"
+
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RefCountOpts configures a ref count repair
+type RefCountOpts struct {
+	// how many blob ids to recount at a time
+	BatchSize int
+	// only count the blobs whose ref count is off
+	DryRun bool
+}
+
+// RepairRefCounts recounts the streams each blob is part of, and fixes the ref counts that are off, a range of blob ids
+// at a time. Counts only go wrong when the same stream is uploaded several times at once, or when the db is changed by
+// hand. It returns how many counts were off
+func RepairRefCounts(sql *db.SQL, opts RefCountOpts, stopCh stop.Chan) (int64, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 10000
+	}
+
+	maxID, err := sql.MaxBlobID()
+	if err != nil {
+		return 0, err
+	}
+	var off int64
+	for from := int64(0); from < maxID; from += int64(opts.BatchSize) {
+		select {
+		case <-stopCh:
+			return off, nil
+		default:
+		}
+
+		n, err := sql.RepairRefCounts(from, from+int64(opts.BatchSize), opts.DryRun)
+		if err != nil {
+			return off, err
+		}
+		off += n
+		if n > 0 {
+			log.Infof("refcounts: %d counts were off up to blob %d", n, from+int64(opts.BatchSize))
+		}
+	}
+	return off, nil
+}
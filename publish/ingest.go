@@ -0,0 +1,89 @@
+package publish
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+	pb "github.com/lbryio/types/v2/go"
+)
+
+// Ingested is a stream that was made from a file and stored
+type Ingested struct {
+	SDHash string `json:"sd_hash"`
+	// Blobs are the hashes of the content blobs, in order
+	Blobs []string `json:"blobs"`
+	// Size is the size of the file
+	Size int `json:"size"`
+	// Claim is the stream metadata to publish the stream with
+	Claim *pb.Stream `json:"claim"`
+}
+
+// Ingest chunks and encrypts the data read from r into a stream, and stores the blobs in dst as they're made, so the
+// file is never all in memory. The content blobs are stored first and the sd blob last, so a store that has the sd blob
+// has the whole stream. Stores that record blobs in the db, like a DBBackedStore, record the stream too. name is the
+// file name in the sd blob and the claim
+func Ingest(r io.Reader, name string, dst store.BlobStore) (*Ingested, error) {
+	enc := stream.NewEncoder(fullReader{r})
+	sd := enc.SDBlob()
+	sd.StreamName = filepath.Base(name)
+	sd.SuggestedFileName = filepath.Base(name)
+
+	result := &Ingested{}
+	for {
+		blob, err := enc.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Err(err)
+		}
+		hash := blob.HashHex()
+		err = dst.Put(hash, blob)
+		if err != nil {
+			return nil, errors.Prefix("storing blob "+hash, err)
+		}
+		result.Blobs = append(result.Blobs, hash)
+	}
+	if len(result.Blobs) == 0 {
+		return nil, errors.Err("%s is empty", name)
+	}
+
+	sdBlob := enc.SDBlob().ToBlob()
+	result.SDHash = sdBlob.HashHex()
+	err := dst.PutSD(result.SDHash, sdBlob)
+	if err != nil {
+		return nil, errors.Prefix("storing sd blob "+result.SDHash, err)
+	}
+	result.Size = enc.SourceLen()
+	result.Claim = streamClaim(enc, name)
+	return result, nil
+}
+
+// IngestFile ingests the file at path into dst
+func IngestFile(path string, dst store.BlobStore) (*Ingested, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer file.Close()
+	return Ingest(file, path, dst)
+}
+
+// fullReader fills the whole buffer on each read unless the data runs out, so every blob but the last one is full no
+// matter how the data arrives. The encoder makes a blob from each read, and drops the data of a read that also
+// returns io.EOF
+type fullReader struct {
+	r io.Reader
+}
+
+func (f fullReader) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(f.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
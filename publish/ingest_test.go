@@ -0,0 +1,63 @@
+package publish
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIngest(t *testing.T) {
+	data := make([]byte, 2*stream.MaxBlobSize+1000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	st := store.NewMemStore()
+	// a reader that returns little at a time still makes full blobs
+	result, err := Ingest(&slowReader{data: data}, "/videos/cat.mp4", st)
+	require.NoError(t, err)
+	assert.Len(t, result.Blobs, 3)
+	assert.Equal(t, len(data), result.Size)
+	assert.Equal(t, "cat.mp4", result.Claim.GetSource().GetName())
+	assert.Equal(t, "video/mp4", result.Claim.GetSource().GetMediaType())
+
+	sdBlob, _, err := st.Get(result.SDHash)
+	require.NoError(t, err)
+	s := stream.Stream{sdBlob}
+	for _, hash := range result.Blobs {
+		blob, _, err := st.Get(hash)
+		require.NoError(t, err)
+		s = append(s, blob)
+	}
+	decoded, err := s.Decode()
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, decoded))
+}
+
+func TestIngest_Empty(t *testing.T) {
+	_, err := Ingest(bytes.NewReader(nil), "empty", store.NewMemStore())
+	assert.Error(t, err)
+}
+
+type slowReader struct {
+	data []byte
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > 1000 {
+		p = p[:1000]
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
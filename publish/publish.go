@@ -231,16 +231,21 @@ func makeStream(path string) (stream.Stream, *pb.Stream, error) {
 		return nil, nil, errors.Err(err)
 	}
 
+	return s, streamClaim(enc, file.Name()), nil
+}
+
+// streamClaim returns the claim metadata of a stream that enc finished encoding from the file at path
+func streamClaim(enc *stream.Encoder, path string) *pb.Stream {
 	streamProto := &pb.Stream{
 		Source: &pb.Source{
 			SdHash: enc.SDBlob().Hash(),
-			Name:   filepath.Base(file.Name()),
+			Name:   filepath.Base(path),
 			Size:   uint64(enc.SourceLen()),
 			Hash:   enc.SourceHash(),
 		},
 	}
 
-	mimeType, category := guessMimeType(filepath.Ext(file.Name()))
+	mimeType, category := guessMimeType(filepath.Ext(path))
 	streamProto.Source.MediaType = mimeType
 
 	switch category {
@@ -256,7 +261,7 @@ func makeStream(path string) (stream.Stream, *pb.Stream, error) {
 		streamProto.Type = &pb.Stream_Image{}
 	}
 
-	return s, streamProto, nil
+	return streamProto
 }
 
 func getClaimPayoutScript(name string, value []byte, address btcutil.Address) ([]byte, error) {
@@ -1,6 +1,7 @@
 package reflector
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"net/http"
@@ -140,7 +141,7 @@ OutpointLoop:
 			continue
 		}
 
-		claim, err := node.GetClaimInTx(parts[0], nout)
+		claim, err := node.GetClaimInTx(context.Background(), parts[0], nout)
 		if err != nil {
 			values[outpoint] = valOrErr{Err: err}
 			continue
@@ -14,8 +14,15 @@ var ErrBlobExists = errors.Base("blob exists on server")
 
 // Client is an instance of a client connected to a server.
 type Client struct {
-	conn      net.Conn
-	connected bool
+	// AuthToken is sent to servers that authorize uploads
+	AuthToken string
+	// Events is told about each blob as it's sent, if set
+	Events Events
+
+	conn       net.Conn
+	connected  bool
+	address    string
+	haveFilter bool // the server answers have filters
 }
 
 // Connect connects to a specific clients and errors if it cannot be contacted.
@@ -26,6 +33,7 @@ func (c *Client) Connect(address string) error {
 		return err
 	}
 	c.connected = true
+	c.address = address
 	return c.doHandshake(protocolVersion1)
 }
 
@@ -45,17 +53,31 @@ func (c *Client) SendSDBlob(blob stream.Blob) error {
 	return c.sendBlob(blob, true)
 }
 
-// sendBlob does the actual blob sending
+// progressChunk is how many bytes of a blob are written between progress events
+const progressChunk = 64 * 1024
+
+// sendBlob sends the blob and tells c.Events about it
 func (c *Client) sendBlob(blob stream.Blob, isSDBlob bool) error {
+	event := Event{Hash: blob.HashHex(), SD: isSDBlob, Size: len(blob), Attempt: 1, Server: c.address}
+	event.Type = EventStart
+	c.Events.emit(event)
+	sent, err := c.doSendBlob(blob, isSDBlob, event)
+	event.Type, event.Sent, event.Err = EventFinish, sent, err
+	c.Events.emit(event)
+	return err
+}
+
+// doSendBlob does the actual blob sending. It returns how many bytes of the blob were sent
+func (c *Client) doSendBlob(blob stream.Blob, isSDBlob bool, event Event) (int, error) {
 	if !c.connected {
-		return errors.Err("not connected")
+		return 0, errors.Err("not connected")
 	}
 
 	if err := blob.ValidForSend(); err != nil {
-		return errors.Err(err)
+		return 0, errors.Err(err)
 	}
 
-	blobHash := blob.HashHex()
+	blobHash := event.Hash
 	var req sendBlobRequest
 	if isSDBlob {
 		req.SdBlobSize = blob.Size()
@@ -66,12 +88,12 @@ func (c *Client) sendBlob(blob stream.Blob, isSDBlob bool) error {
 	}
 	sendRequest, err := json.Marshal(req)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	_, err = c.conn.Write(sendRequest)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	dec := json.NewDecoder(c.conn)
@@ -80,50 +102,72 @@ func (c *Client) sendBlob(blob stream.Blob, isSDBlob bool) error {
 		var sendResp sendSdBlobResponse
 		err = dec.Decode(&sendResp)
 		if err != nil {
-			return err
+			return 0, err
+		}
+		if sendResp.Code != "" {
+			return 0, sendResp.rejected(blobHash)
 		}
 		if !sendResp.SendSdBlob {
-			return errors.Prefix(blobHash[:8], ErrBlobExists)
+			return 0, errors.Prefix(blobHash[:8], ErrBlobExists)
 		}
 		log.Println("Sending SD blob " + blobHash[:8])
 	} else {
 		var sendResp sendBlobResponse
 		err = dec.Decode(&sendResp)
 		if err != nil {
-			return err
+			return 0, err
+		}
+		if sendResp.Code != "" {
+			return 0, sendResp.rejected(blobHash)
 		}
 		if !sendResp.SendBlob {
-			return errors.Prefix(blobHash[:8], ErrBlobExists)
+			return 0, errors.Prefix(blobHash[:8], ErrBlobExists)
 		}
 		log.Println("Sending blob " + blobHash[:8])
 	}
 
-	_, err = c.conn.Write(blob)
-	if err != nil {
-		return err
+	sent := 0
+	for sent < len(blob) {
+		end := sent + progressChunk
+		if end > len(blob) {
+			end = len(blob)
+		}
+		n, err := c.conn.Write(blob[sent:end])
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+		event.Type, event.Sent = EventProgress, sent
+		c.Events.emit(event)
 	}
 
 	if isSDBlob {
 		var transferResp sdBlobTransferResponse
 		err = dec.Decode(&transferResp)
 		if err != nil {
-			return err
+			return sent, err
+		}
+		if transferResp.Code != "" {
+			return sent, transferResp.rejected(blobHash)
 		}
 		if !transferResp.ReceivedSdBlob {
-			return errors.Err("server did not received SD blob")
+			return sent, errors.Err("server did not received SD blob")
 		}
 	} else {
 		var transferResp blobTransferResponse
 		err = dec.Decode(&transferResp)
 		if err != nil {
-			return err
+			return sent, err
+		}
+		if transferResp.Code != "" {
+			return sent, transferResp.rejected(blobHash)
 		}
 		if !transferResp.ReceivedBlob {
-			return errors.Err("server did not received blob")
+			return sent, errors.Err("server did not received blob")
 		}
 	}
 
-	return nil
+	return sent, nil
 }
 
 func (c *Client) doHandshake(version int) error {
@@ -131,7 +175,7 @@ func (c *Client) doHandshake(version int) error {
 		return errors.Err("not connected")
 	}
 
-	handshake, err := json.Marshal(handshakeRequestResponse{Version: &version})
+	handshake, err := json.Marshal(handshakeRequestResponse{Version: &version, AuthToken: c.AuthToken})
 	if err != nil {
 		return err
 	}
@@ -150,6 +194,11 @@ func (c *Client) doHandshake(version int) error {
 	} else if *resp.Version != version {
 		return errors.Err("handshake version mismatch")
 	}
+	for _, f := range resp.Features {
+		if f == featureHaveFilter {
+			c.haveFilter = true
+		}
+	}
 
 	return nil
 }
@@ -0,0 +1,79 @@
+package reflector
+
+import "github.com/lbryio/lbry.go/v2/extras/errors"
+
+// EventType is what happened to a blob during an upload
+type EventType int
+
+const (
+	// EventStart is sent before a blob is sent or stored
+	EventStart EventType = iota + 1
+	// EventProgress is sent as the bytes of a blob are sent. Only the client sends it, the uploader stores each blob
+	// in one go
+	EventProgress
+	// EventRetry is sent when storing a blob failed and it will be tried again
+	EventRetry
+	// EventFinish is sent when a blob is done, whether it was sent, skipped because the server has it, or failed
+	EventFinish
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventStart:
+		return "start"
+	case EventProgress:
+		return "progress"
+	case EventRetry:
+		return "retry"
+	case EventFinish:
+		return "finish"
+	}
+	return "unknown"
+}
+
+// Event tells what's happening to a blob that's being uploaded
+type Event struct {
+	Type EventType
+	Hash string
+	SD   bool
+	// Server is the address of the reflector the client sends the blob to. It's empty for the uploader
+	Server string
+	// Size is the size of the blob, and Sent how many of its bytes were sent so far
+	Size int
+	Sent int
+	// Attempt counts the tries, starting at 1
+	Attempt int
+	// Err is why a retry was needed or why the blob failed. It's ErrBlobExists when the server already has the blob,
+	// which is not a failure
+	Err error
+}
+
+// Failed says whether the blob failed to upload. The blob counts as uploaded if the server already had it
+func (e Event) Failed() bool {
+	return e.Err != nil && !errors.Is(e.Err, ErrBlobExists)
+}
+
+// Events is called with the events of an upload, on the goroutine doing the upload, so it should return quickly. It
+// may be called from several goroutines at once by the uploader
+type Events func(Event)
+
+// ChanEvents returns Events that sends the events to ch. Progress events are dropped when ch is full, so a slow reader
+// only holds the upload up for the events that matter
+func ChanEvents(ch chan<- Event) Events {
+	return func(e Event) {
+		if e.Type != EventProgress {
+			ch <- e
+			return
+		}
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (f Events) emit(e Event) {
+	if f != nil {
+		f(e)
+	}
+}
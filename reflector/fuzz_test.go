@@ -0,0 +1,52 @@
+//go:build go1.18
+// +build go1.18
+
+package reflector
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/lbryio/reflector.go/internal/fuzzing"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/stream"
+)
+
+// FuzzReflectorConn sends a handshake, a blob request and the blob to the server, the way an uploader would
+func FuzzReflectorConn(f *testing.F) {
+	f.Cleanup(fuzzing.QuietLogs())
+
+	s, err := stream.New(bytes.NewReader([]byte("fuzz")))
+	if err != nil {
+		f.Fatal(err)
+	}
+	sdBlob, blob := s[0], s[1]
+	request := func(key, hash string, size int) []byte {
+		return []byte(`{"` + key + `_hash":"` + hash + `","` + key + `_size":` + strconv.Itoa(size) + `}`)
+	}
+	v1, v2 := []byte(`{"version":0}`), []byte(`{"version":1,"auth_token":"token"}`)
+	f.Add(v1, request("blob", blob.HashHex(), len(blob)), []byte(blob))
+	f.Add(v2, request("sd_blob", sdBlob.HashHex(), len(sdBlob)), []byte(sdBlob))
+	f.Add(v1, request("blob", blob.HashHex(), len(blob)), []byte(sdBlob)[:len(blob)])
+	f.Add(v1, request("blob", blob.HashHex(), -1), []byte(blob))
+	f.Add(v1, request("blob", blob.HashHex(), maxBlobSize+1), []byte(blob))
+	f.Add(v2, []byte(`{"have_filter":"AAAA"}`), []byte(nil))
+	f.Add([]byte(`{"version":7}`), []byte(nil), []byte(nil))
+	f.Add([]byte(`{"version":`), []byte(`0}`), []byte(nil))
+
+	f.Fuzz(func(t *testing.T, handshake, request, blob []byte) {
+		blobs := store.NewMemStore()
+		srv := NewServer(blobs, blobs)
+		srv.EnableHaveFilter = true
+		srv.handleConn(fuzzing.NewConn(handshake, request, blob))
+		srv.Shutdown()
+
+		for hash, b := range blobs.Debug() {
+			if BlobHash(b) != hash {
+				t.Errorf("stored blob %s has hash %s", hash, BlobHash(b))
+			}
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package reflector
+
+import (
+	"encoding/json"
+	"net"
+
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/internal/bloom"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// featureHaveFilter is the handshake feature of servers that answer have filters
+const featureHaveFilter = "have_filter"
+
+const (
+	// queryFalsePositiveRate is the rate of the filter a client sends. A false positive costs the server a few bytes in
+	// its answer
+	queryFalsePositiveRate = 0.01
+	// answerFalsePositiveRate is the rate of the filter the server answers with. A false positive is a blob the client
+	// doesn't upload because it thinks the server has it, so it's kept very low
+	answerFalsePositiveRate = 1e-9
+)
+
+// haveFilterResponse answers a have filter with a filter of the blobs the server has among them
+type haveFilterResponse struct {
+	errorResponse
+	HaveFilter []byte `json:"have_filter,omitempty"`
+}
+
+// answerHaveFilter tells the client which of the blobs in its filter the server has. The server can't get the hashes
+// back out of the filter, so it walks its own blobs and answers with a filter of the ones that are in the client's
+func (s *Server) answerHaveFilter(conn net.Conn, client auth.Request, data []byte) error {
+	if !s.EnableHaveFilter {
+		return errors.Prefix("have filters are not enabled", ErrProtocol)
+	}
+	client.Action = auth.ActionList
+	err := auth.Check(s.Authorizer, client)
+	if err != nil {
+		return errors.Prefix("have filter", err)
+	}
+	if s.APIKeys != nil {
+		// walking the store is too much work to do for anyone
+		_, err = s.APIKeys.Check(client.Token, 0)
+		if err != nil {
+			return errors.Prefix("have filter", err)
+		}
+	}
+	filter := &bloom.Filter{}
+	err = filter.UnmarshalBinary(data)
+	if err != nil {
+		return errors.Prefix(err.Error(), ErrProtocol)
+	}
+
+	select {
+	case s.filterSlot <- struct{}{}:
+	case <-s.grp.Ch():
+		return errors.Err("server is shutting down")
+	}
+	answer, err := s.haveInFilter(filter)
+	<-s.filterSlot
+
+	var resp haveFilterResponse
+	if err != nil {
+		log.Errorf("answering have filter from %s: %s", conn.RemoteAddr(), err.Error())
+		resp.Error = err.Error()
+	} else {
+		resp.HaveFilter, err = answer.MarshalBinary()
+		if err != nil {
+			return errors.Err(err)
+		}
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return errors.Err(err)
+	}
+	return s.write(conn, b)
+}
+
+// haveInFilter returns a filter of the blobs in the store that are in filter
+func (s *Server) haveInFilter(filter *bloom.Filter) (*bloom.Filter, error) {
+	var have []string
+	err := store.Walk(s.underlyingStore, func(hash string) error {
+		if s.quitting() {
+			return errors.Err("server is shutting down")
+		}
+		if filter.Test(hash) {
+			have = append(have, hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	answer := bloom.New(len(have), answerFalsePositiveRate)
+	for _, h := range have {
+		answer.Add(h)
+	}
+	return answer, nil
+}
+
+// MissingBlobs returns the hashes the server doesn't have. It asks about all of them at once by sending a Bloom filter
+// of them, instead of asking about each blob as it's sent. About one in a billion blobs the server doesn't have is
+// taken for one it has. Servers that don't answer filters are taken to have none of the blobs
+func (c *Client) MissingBlobs(hashes []string) ([]string, error) {
+	if !c.connected {
+		return nil, errors.Err("not connected")
+	}
+	if !c.haveFilter || len(hashes) == 0 {
+		return append([]string(nil), hashes...), nil
+	}
+
+	filter := bloom.New(len(hashes), queryFalsePositiveRate)
+	for _, h := range hashes {
+		filter.Add(h)
+	}
+	data, err := filter.MarshalBinary()
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	req, err := json.Marshal(sendBlobRequest{HaveFilter: data})
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	_, err = c.conn.Write(req)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	var resp haveFilterResponse
+	err = json.NewDecoder(c.conn).Decode(&resp)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	if resp.Error != "" {
+		return nil, errors.Err("server could not answer the have filter: %s", resp.Error)
+	}
+	have := &bloom.Filter{}
+	err = have.UnmarshalBinary(resp.HaveFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, h := range hashes {
+		if !have.Test(h) {
+			missing = append(missing, h)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,153 @@
+package reflector
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/apikey"
+	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// ErrRejected is returned by the client when the server refuses an upload because it is over one of the server's
+// limits
+var ErrRejected = errors.Base("upload rejected")
+
+// Codes the server sends when it rejects an upload
+const (
+	RejectBlobTooBig    = "blob_too_big"
+	RejectTooManyBlobs  = "too_many_blobs"
+	RejectQuotaExceeded = "quota_exceeded"
+	RejectInvalidKey    = "invalid_api_key"
+)
+
+// rejection is an upload the server refused. It is sent to the client as an errorResponse
+type rejection struct {
+	code  string
+	msg   string
+	limit int64
+}
+
+func (r *rejection) Error() string { return r.msg }
+
+func (r *rejection) response() errorResponse {
+	return errorResponse{Error: r.msg, Code: r.code, Limit: r.limit}
+}
+
+// rejected returns the error for a rejected upload of the blob
+func (e errorResponse) rejected(blobHash string) error {
+	return errors.Prefix(fmt.Sprintf("%s: %s (%s)", blobHash[:8], e.Error, e.Code), ErrRejected)
+}
+
+// checkLimits returns a rejection if a blob of this size may not be uploaded by the client. Otherwise the size is held
+// against the client's daily limit, so uploads that go on at the same time can't get past it together
+func (s *Server) checkLimits(ip string, blobSize int) error {
+	if s.MaxBlobSize > 0 && blobSize > s.MaxBlobSize {
+		return &rejection{
+			code:  RejectBlobTooBig,
+			msg:   fmt.Sprintf("blob is %d bytes, the limit is %d", blobSize, s.MaxBlobSize),
+			limit: int64(s.MaxBlobSize),
+		}
+	}
+	if !s.quota.reserve(ip, blobSize, s.MaxDailyUpload) {
+		return &rejection{
+			code:  RejectQuotaExceeded,
+			msg:   fmt.Sprintf("daily upload limit of %d bytes reached", s.MaxDailyUpload),
+			limit: s.MaxDailyUpload,
+		}
+	}
+	return nil
+}
+
+// checkKey returns the api key the client uploads with, or a rejection if a blob of this size may not be uploaded with
+// it. The key is nil if keys are not needed
+func (s *Server) checkKey(token string, blobSize int) (*apikey.Key, error) {
+	if s.APIKeys == nil {
+		return nil, nil
+	}
+	key, err := s.APIKeys.Check(token, blobSize)
+	if errors.Is(err, apikey.ErrQuotaExceeded) {
+		return nil, &rejection{code: RejectQuotaExceeded, msg: err.Error()}
+	} else if err != nil {
+		return nil, &rejection{code: RejectInvalidKey, msg: err.Error()}
+	}
+	return key, nil
+}
+
+// checkStreamLimits returns a rejection if the stream an sd blob describes has too many blobs. Sd blobs that can't be
+// parsed are left to the store to deal with
+func (s *Server) checkStreamLimits(sdBlob []byte) error {
+	if s.MaxStreamBlobs <= 0 {
+		return nil
+	}
+	sd, err := shared.ParseSDBlob(sdBlob)
+	if err != nil {
+		return nil
+	}
+	if n := len(sd.ContentBlobs()); n > s.MaxStreamBlobs {
+		return &rejection{
+			code:  RejectTooManyBlobs,
+			msg:   fmt.Sprintf("stream has %d blobs, the limit is %d", n, s.MaxStreamBlobs),
+			limit: int64(s.MaxStreamBlobs),
+		}
+	}
+	return nil
+}
+
+func trackRejection(r *rejection) {
+	metrics.ReflectorRejectedCount.WithLabelValues(r.code).Inc()
+}
+
+// uploadQuota counts the bytes each client uploaded today (UTC), and the bytes of the uploads it has going on
+type uploadQuota struct {
+	mu       sync.Mutex
+	day      string
+	bytes    map[string]int64
+	reserved map[string]int64 // not reset when the day changes, the uploads aren't done
+}
+
+// reserve holds n bytes for an upload of the client, unless that would take it over limit. There is no limit if it's 0
+func (q *uploadQuota) reserve(ip string, n int, limit int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	if limit > 0 && q.bytes[ip]+q.reserved[ip]+int64(n) > limit {
+		return false
+	}
+	if q.reserved == nil {
+		q.reserved = make(map[string]int64)
+	}
+	q.reserved[ip] += int64(n)
+	return true
+}
+
+// release gives back the bytes reserve held for an upload that didn't happen
+func (q *uploadQuota) release(ip string, reserved int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reserved[ip] -= int64(reserved)
+	if q.reserved[ip] <= 0 {
+		delete(q.reserved, ip)
+	}
+}
+
+// uploaded counts an upload of n bytes in place of the bytes reserve held for it
+func (q *uploadQuota) uploaded(ip string, reserved, n int) {
+	q.release(ip, reserved)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	q.bytes[ip] += int64(n)
+}
+
+// rollover starts counting from 0 when the day changes
+func (q *uploadQuota) rollover() {
+	day := time.Now().UTC().Format("2006-01-02")
+	if day != q.day || q.bytes == nil {
+		q.day = day
+		q.bytes = make(map[string]int64)
+	}
+}
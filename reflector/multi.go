@@ -0,0 +1,185 @@
+package reflector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/cluster"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultServerCooldown is how long the MultiUploader skips a server that failed, unless Cooldown is changed
+const DefaultServerCooldown = time.Minute
+
+// MultiUploader sends streams to several reflector servers. All the blobs of a stream go to the same server, picked by
+// the stream's sd hash on a hash ring of the servers, so streams are spread over the servers and a stream that's sent
+// again goes where its blobs already are. When a server fails partway through a stream, the whole stream is sent to the
+// next server on the ring, and the server that failed is skipped for a while.
+type MultiUploader struct {
+	// AuthToken is sent to servers that authorize uploads
+	AuthToken string
+	// Events is told about each blob as it's sent, if set. Attempt counts the servers the stream was tried on
+	Events Events
+	// Cooldown is how long a server that failed is skipped. Servers are still tried when all of them failed recently
+	Cooldown time.Duration
+
+	ring    *cluster.Ring
+	servers map[string]*uploadServer
+}
+
+type uploadServer struct {
+	addr  string
+	slots chan struct{} // one for each stream that may be sent at once
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+// StreamResult is how the upload of a stream went
+type StreamResult struct {
+	SDHash string
+	// Server is where the stream was sent, or the last server it was tried on if it failed
+	Server string
+	Err    error
+}
+
+// NewMultiUploader returns an uploader that sends streams to the servers at the addresses, sending up to perServer
+// streams to each server at once
+func NewMultiUploader(addresses []string, perServer int) *MultiUploader {
+	if perServer < 1 {
+		perServer = 1
+	}
+	m := &MultiUploader{
+		Cooldown: DefaultServerCooldown,
+		ring:     cluster.NewRing(0),
+		servers:  make(map[string]*uploadServer, len(addresses)),
+	}
+	nodes := make([]cluster.Node, 0, len(addresses))
+	for _, addr := range addresses {
+		if _, ok := m.servers[addr]; ok {
+			continue
+		}
+		m.servers[addr] = &uploadServer{addr: addr, slots: make(chan struct{}, perServer)}
+		nodes = append(nodes, cluster.Node{Name: addr, Addr: addr})
+	}
+	m.ring.Set(nodes)
+	return m
+}
+
+// UploadStreams sends the streams, as many at once as the servers take, and returns how each one went in the same order
+func (m *MultiUploader) UploadStreams(streams []stream.Stream) []StreamResult {
+	results := make([]StreamResult, len(streams))
+	workers := 0
+	for _, s := range m.servers {
+		workers += cap(s.slots)
+	}
+
+	tasks := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range tasks {
+				results[i] = m.UploadStream(streams[i])
+			}
+		}()
+	}
+	for i := range streams {
+		tasks <- i
+	}
+	close(tasks)
+	wg.Wait()
+	return results
+}
+
+// UploadStream sends all the blobs of a stream, sd blob first, to one server. It waits if that server already has as
+// many streams in flight as it may
+func (m *MultiUploader) UploadStream(s stream.Stream) StreamResult {
+	if len(s) == 0 {
+		return StreamResult{Err: errors.Err("empty stream")}
+	}
+	result := StreamResult{SDHash: s[0].HashHex()}
+	servers := m.order(result.SDHash)
+	if len(servers) == 0 {
+		result.Err = errors.Err("no servers to upload to")
+		return result
+	}
+
+	for attempt, srv := range servers {
+		if attempt > 0 {
+			log.Debugf("sending stream %s to %s instead: %s", result.SDHash[:8], srv.addr, result.Err.Error())
+			m.Events.emit(Event{Type: EventRetry, Hash: result.SDHash, SD: true, Size: len(s[0]), Attempt: attempt,
+				Server: result.Server, Err: result.Err})
+		}
+		result.Server = srv.addr
+		srv.slots <- struct{}{}
+		result.Err = m.send(srv.addr, s, attempt+1)
+		<-srv.slots
+		if result.Err == nil {
+			return result
+		}
+		if !errors.Is(result.Err, ErrRejected) {
+			// a server that rejects blobs is working, its limits just don't allow them
+			srv.mu.Lock()
+			srv.downUntil = time.Now().Add(m.Cooldown)
+			srv.mu.Unlock()
+		}
+	}
+	return result
+}
+
+// order returns the servers to try for a stream, starting with the one it belongs to. Servers that failed recently
+// go last
+func (m *MultiUploader) order(sdHash string) []*uploadServer {
+	nodes := m.ring.Owners(sdHash, len(m.servers))
+	up := make([]*uploadServer, 0, len(nodes))
+	var down []*uploadServer
+	now := time.Now()
+	for _, n := range nodes {
+		srv := m.servers[n.Addr]
+		srv.mu.Lock()
+		isDown := now.Before(srv.downUntil)
+		srv.mu.Unlock()
+		if isDown {
+			down = append(down, srv)
+		} else {
+			up = append(up, srv)
+		}
+	}
+	return append(up, down...)
+}
+
+// send sends the stream to one server over a new connection
+func (m *MultiUploader) send(addr string, s stream.Stream, attempt int) error {
+	c := Client{AuthToken: m.AuthToken}
+	if m.Events != nil {
+		c.Events = func(e Event) {
+			e.Attempt = attempt
+			m.Events(e)
+		}
+	}
+	err := c.Connect(addr)
+	if c.connected {
+		defer c.Close()
+	}
+	if err != nil {
+		return errors.Prefix(addr, err)
+	}
+
+	for i, b := range s {
+		if i == 0 {
+			err = c.SendSDBlob(b)
+		} else {
+			err = c.SendBlob(b)
+		}
+		if err != nil && !errors.Is(err, ErrBlobExists) {
+			return errors.Prefix(addr, err)
+		}
+	}
+	return nil
+}
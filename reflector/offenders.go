@@ -0,0 +1,213 @@
+package reflector
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/internal/metrics"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of client failures
+const (
+	FailureHashMismatch = "hash_mismatch"
+	FailureProtocol     = "protocol"
+)
+
+// Offenders tracks clients that send corrupt blobs or break the protocol, and bans the ones that keep doing it for a
+// while. Clients are identified by ip. It is safe to use from several goroutines.
+type Offenders struct {
+	// AdminToken is the bearer token that ServeHTTP needs. The offenders can't be listed or unbanned over http if
+	// it's empty
+	AdminToken string
+
+	maxFailures int
+	window      time.Duration
+	banDuration time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	clients map[string]*offender
+	checks  int
+}
+
+type offender struct {
+	hashMismatches int
+	protocolErrors int
+	bans           int
+	recent         []time.Time // failures within the window
+	lastFailure    time.Time
+	bannedUntil    time.Time
+}
+
+// Offender is what the admin view shows about a client
+type Offender struct {
+	IP             string     `json:"ip"`
+	HashMismatches int        `json:"hash_mismatches"`
+	ProtocolErrors int        `json:"protocol_errors"`
+	RecentFailures int        `json:"recent_failures"`
+	Bans           int        `json:"bans"`
+	LastFailure    time.Time  `json:"last_failure"`
+	BannedUntil    *time.Time `json:"banned_until,omitempty"`
+}
+
+// NewOffenders returns a tracker that bans a client for banDuration once it fails maxFailures times within window
+func NewOffenders(maxFailures int, window, banDuration time.Duration) *Offenders {
+	return &Offenders{
+		maxFailures: maxFailures,
+		window:      window,
+		banDuration: banDuration,
+		now:         time.Now,
+		clients:     make(map[string]*offender),
+	}
+}
+
+// clientIP returns the ip part of a remote address
+func clientIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Banned returns whether the client is banned right now
+func (o *Offenders) Banned(ip string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	c, ok := o.clients[ip]
+	return ok && o.now().Before(c.bannedUntil)
+}
+
+// Failure records a failure of the given kind, and returns whether the client got banned for it
+func (o *Offenders) Failure(ip, kind string) bool {
+	metrics.ReflectorClientFailureCount.WithLabelValues(kind).Inc()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := o.now()
+	o.prune(now)
+
+	c, ok := o.clients[ip]
+	if !ok {
+		c = &offender{}
+		o.clients[ip] = c
+	}
+	switch kind {
+	case FailureHashMismatch:
+		c.hashMismatches++
+	default:
+		c.protocolErrors++
+	}
+	c.lastFailure = now
+	c.recent = append(recentSince(c.recent, now.Add(-o.window)), now)
+
+	if o.maxFailures <= 0 || len(c.recent) < o.maxFailures || now.Before(c.bannedUntil) {
+		return false
+	}
+	c.bannedUntil = now.Add(o.banDuration)
+	c.bans++
+	c.recent = nil
+	metrics.ReflectorBanCount.Inc()
+	log.Warnf("banning reflector client %s for %s after %d hash mismatches and %d protocol errors", ip,
+		o.banDuration, c.hashMismatches, c.protocolErrors)
+	return true
+}
+
+// Unban lifts the ban of a client, and returns whether it was banned
+func (o *Offenders) Unban(ip string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	c, ok := o.clients[ip]
+	if !ok || !o.now().Before(c.bannedUntil) {
+		return false
+	}
+	c.bannedUntil = time.Time{}
+	return true
+}
+
+// List returns the clients that failed recently or are banned, the worst ones first
+func (o *Offenders) List() []Offender {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := o.now()
+	list := make([]Offender, 0, len(o.clients))
+	for ip, c := range o.clients {
+		entry := Offender{
+			IP:             ip,
+			HashMismatches: c.hashMismatches,
+			ProtocolErrors: c.protocolErrors,
+			RecentFailures: len(recentSince(c.recent, now.Add(-o.window))),
+			Bans:           c.bans,
+			LastFailure:    c.lastFailure,
+		}
+		if now.Before(c.bannedUntil) {
+			bannedUntil := c.bannedUntil
+			entry.BannedUntil = &bannedUntil
+		}
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if (list[i].BannedUntil != nil) != (list[j].BannedUntil != nil) {
+			return list[i].BannedUntil != nil
+		}
+		return list[i].HashMismatches+list[i].ProtocolErrors > list[j].HashMismatches+list[j].ProtocolErrors
+	})
+	return list
+}
+
+// ServeHTTP is the admin view, for clients with the AdminToken. GET lists the offending clients as json, DELETE ?ip=
+// lifts a ban
+func (o *Offenders) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !auth.HasToken(r, o.AdminToken) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(o.List())
+		if err != nil {
+			log.Error(err)
+		}
+	case http.MethodDelete:
+		ip := r.URL.Query().Get("ip")
+		if !o.Unban(ip) {
+			http.Error(w, ip+" is not banned", http.StatusNotFound)
+			return
+		}
+		log.Infof("reflector client %s was unbanned", ip)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// prune forgets clients that are not banned and haven't failed within the window, every so often
+func (o *Offenders) prune(now time.Time) {
+	o.checks++
+	if o.checks%1000 != 0 {
+		return
+	}
+	for ip, c := range o.clients {
+		if !now.Before(c.bannedUntil) && now.Sub(c.lastFailure) > o.window {
+			delete(o.clients, ip)
+		}
+	}
+}
+
+// recentSince drops the times before since
+func recentSince(times []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(since) {
+		i++
+	}
+	return times[i:]
+}
@@ -0,0 +1,89 @@
+package reflector
+
+import (
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	queueMetaBucket    = []byte("meta")
+	queuePendingBucket = []byte("pending")
+	queueSourceKey     = []byte("source")
+)
+
+// UploadQueue keeps the blob files an upload has left to do in a bolt db on disk. An upload that was interrupted by a
+// crash or reboot picks up the files that were left from the queue, instead of listing the source dir and checking
+// every blob against the db again.
+type UploadQueue struct {
+	db *bolt.DB
+}
+
+// OpenUploadQueue opens the queue in the file at path, creating it if it doesn't exist
+func OpenUploadQueue(path string) (*UploadQueue, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Prefix("opening upload queue "+path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{queueMetaBucket, queuePendingBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Err(err)
+	}
+	return &UploadQueue{db: db}, nil
+}
+
+// Close closes the queue file
+func (q *UploadQueue) Close() error {
+	return errors.Err(q.db.Close())
+}
+
+// Reset replaces what's in the queue with the files of an upload from source
+func (q *UploadQueue) Reset(source string, paths []string) error {
+	return errors.Err(q.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(queuePendingBucket); err != nil {
+			return err
+		}
+		pending, err := tx.CreateBucket(queuePendingBucket)
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			if err := pending.Put([]byte(p), nil); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(queueMetaBucket).Put(queueSourceKey, []byte(source))
+	}))
+}
+
+// Pending returns the source of the upload in the queue and the files it has left, in order
+func (q *UploadQueue) Pending() (string, []string, error) {
+	var source string
+	var paths []string
+	err := q.db.View(func(tx *bolt.Tx) error {
+		source = string(tx.Bucket(queueMetaBucket).Get(queueSourceKey))
+		return tx.Bucket(queuePendingBucket).ForEach(func(k, _ []byte) error {
+			paths = append(paths, string(k))
+			return nil
+		})
+	})
+	return source, paths, errors.Err(err)
+}
+
+// Done takes a file off the queue. Calls from several goroutines are written together, so it's cheap to call for
+// every file
+func (q *UploadQueue) Done(path string) error {
+	return errors.Err(q.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(queuePendingBucket).Delete([]byte(path))
+	}))
+}
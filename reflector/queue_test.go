@@ -0,0 +1,53 @@
+package reflector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.db")
+
+	q, err := OpenUploadQueue(path)
+	require.NoError(t, err)
+	source, pending, err := q.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, source)
+	assert.Empty(t, pending)
+
+	require.NoError(t, q.Reset("/blobs", []string{"/blobs/c", "/blobs/a", "/blobs/b", "/blobs/d"}))
+	wg := sync.WaitGroup{}
+	for _, p := range []string{"/blobs/a", "/blobs/d"} {
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
+			assert.NoError(t, q.Done(p))
+		}(p)
+	}
+	wg.Wait()
+	require.NoError(t, q.Close())
+
+	// what's left is still there after reopening
+	q, err = OpenUploadQueue(path)
+	require.NoError(t, err)
+	defer q.Close()
+	source, pending, err = q.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, "/blobs", source)
+	assert.Equal(t, []string{"/blobs/b", "/blobs/c"}, pending)
+
+	require.NoError(t, q.Reset("/other", []string{"/other/x"}))
+	source, pending, err = q.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, "/other", source)
+	assert.Equal(t, []string{"/other/x"}, pending)
+}
@@ -5,12 +5,17 @@ import (
 	"crypto/sha512"
 	"encoding/hex"
 	"encoding/json"
+	ee "errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"time"
 
+	"github.com/lbryio/reflector.go/apikey"
+	"github.com/lbryio/reflector.go/auth"
 	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/shared"
 	"github.com/lbryio/reflector.go/store"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
@@ -32,7 +37,11 @@ const (
 	maxBlobSize      = stream.MaxBlobSize
 )
 
-var ErrBlobTooBig = errors.Base("blob must be at most %d bytes", maxBlobSize)
+var (
+	ErrBlobTooBig   = errors.Base("blob must be at most %d bytes", maxBlobSize)
+	ErrHashMismatch = errors.Base("hash of received blob data does not match hash from send request")
+	ErrProtocol     = errors.Base("protocol violation")
+)
 
 // Server is and instance of the reflector server. It houses the blob store and listener.
 type Server struct {
@@ -40,9 +49,36 @@ type Server struct {
 
 	EnableBlocklist bool // if true, blocklist checking and blob deletion will be enabled
 
+	// OnBlobReceived is called after a blob has been received and stored
+	OnBlobReceived func(hash string, isSdBlob bool)
+
+	// Authorizer decides whether each blob may be uploaded. Everything is accepted if it's nil
+	Authorizer auth.Authorizer
+
+	// APIKeys only lets clients upload with a valid api key as their auth token, and holds each key to its daily quota
+	// and rate. Keys are not needed if it's nil
+	APIKeys *apikey.Keys
+
+	// MaxBlobSize is the largest blob that is accepted. 0 means the protocol's limit
+	MaxBlobSize int
+	// MaxStreamBlobs is how many content blobs a stream may have. 0 means no limit
+	MaxStreamBlobs int
+	// MaxDailyUpload is how many bytes each client ip may upload per day (UTC). 0 means no limit
+	MaxDailyUpload int64
+
+	// EnableHaveFilter lets clients send a Bloom filter of their blobs and get back which of them the server has, so
+	// they don't ask about each blob before uploading it. Answering walks every blob in the store, so it's off by default
+	EnableHaveFilter bool
+
+	// Offenders tracks clients that send corrupt blobs or break the protocol, and turns away the ones it banned.
+	// Nobody is tracked if it's nil
+	Offenders *Offenders
+
 	underlyingStore store.BlobStore
 	outerStore      store.BlobStore
 	grp             *stop.Group
+	quota           uploadQuota
+	filterSlot      chan struct{} // held while a have filter is answered, so only one store walk runs at a time
 }
 
 // NewServer returns an initialized reflector server pointer.
@@ -52,6 +88,7 @@ func NewServer(underlying store.BlobStore, outer store.BlobStore) *Server {
 		underlyingStore: underlying,
 		outerStore:      outer,
 		grp:             stop.New(),
+		filterSlot:      make(chan struct{}, 1),
 	}
 }
 
@@ -128,6 +165,15 @@ func (s *Server) listenAndServe(listener net.Listener) {
 }
 
 func (s *Server) handleConn(conn net.Conn) {
+	if s.Offenders != nil && s.Offenders.Banned(clientIP(conn.RemoteAddr().String())) {
+		metrics.ReflectorBannedConnCount.Inc()
+		log.Debugf("closing connection from banned client %s", conn.RemoteAddr())
+		if err := conn.Close(); err != nil {
+			log.Error(errors.Prefix("closing banned conn", err))
+		}
+		return
+	}
+
 	// all this stuff is to close the connections correctly when we're shutting down the server
 	connNeedsClosing := make(chan struct{})
 	defer func() {
@@ -148,11 +194,12 @@ func (s *Server) handleConn(conn net.Conn) {
 		}
 	}()
 
-	err := s.doHandshake(conn)
+	client, err := s.doHandshake(conn)
 	if err != nil {
 		if errors.Is(err, io.EOF) || s.quitting() {
 			return
 		}
+		s.trackFailure(clientIP(conn.RemoteAddr().String()), err)
 		err := s.doError(conn, err)
 		if err != nil {
 			log.Error(errors.Prefix("sending handshake error", err))
@@ -161,24 +208,51 @@ func (s *Server) handleConn(conn net.Conn) {
 	}
 
 	for {
-		err = s.receiveBlob(conn)
+		err = s.receiveBlob(conn, client)
 		if err != nil {
 			if errors.Is(err, io.EOF) || s.quitting() {
 				return
 			}
+			s.trackFailure(clientIP(conn.RemoteAddr().String()), err)
+			_, rejected := err.(*rejection)
 			err := s.doError(conn, err)
 			if err != nil {
 				log.Error(errors.Prefix("sending blob receive error", err))
+				return
+			}
+			// a rejection is answered where the client expects a response, so the client can go on with other blobs
+			if !rejected {
+				return
 			}
-			return
 		}
 	}
 }
 
+// trackFailure counts corrupt blobs and protocol errors against the client. Network errors are not the client's fault
+func (s *Server) trackFailure(ip string, err error) {
+	if s.Offenders == nil || err == nil {
+		return
+	}
+	if errors.Is(err, ErrHashMismatch) {
+		s.Offenders.Failure(ip, FailureHashMismatch)
+	} else if errors.Is(err, ErrProtocol) || errors.Is(err, ErrBlobTooBig) {
+		s.Offenders.Failure(ip, FailureProtocol)
+	}
+}
+
 func (s *Server) doError(conn net.Conn, err error) error {
 	if err == nil {
 		return nil
 	}
+	if r, ok := err.(*rejection); ok {
+		trackRejection(r)
+		log.Infof("rejected upload from %s: %s", conn.RemoteAddr(), r.msg)
+		resp, err := json.Marshal(r.response())
+		if err != nil {
+			return errors.Err(err)
+		}
+		return s.write(conn, resp)
+	}
 	shouldLog := metrics.TrackError(metrics.DirectionUpload, err)
 	if shouldLog {
 		log.Errorln(errors.FullTrace(err))
@@ -194,24 +268,37 @@ func (s *Server) doError(conn net.Conn, err error) error {
 	return nil
 }
 
-func (s *Server) receiveBlob(conn net.Conn) error {
-	blobSize, blobHash, isSdBlob, err := s.readBlobRequest(conn)
+func (s *Server) receiveBlob(conn net.Conn, client auth.Request) error {
+	var sendRequest sendBlobRequest
+	err := s.read(conn, &sendRequest)
 	if err != nil {
 		return err
 	}
+	if sendRequest.HaveFilter != nil {
+		return s.answerHaveFilter(conn, client, sendRequest.HaveFilter)
+	}
 
-	var wantsBlob bool
-	if bl, ok := s.underlyingStore.(store.Blocklister); ok {
-		wantsBlob, err = bl.Wants(blobHash)
-		if err != nil {
-			return err
-		}
-	} else {
-		blobExists, err := s.underlyingStore.Has(blobHash)
-		if err != nil {
-			return err
+	blobSize, blobHash, isSdBlob, err := parseBlobRequest(sendRequest)
+	if err != nil {
+		return err
+	}
+
+	client.Hash = blobHash
+	ip := clientIP(client.RemoteAddr)
+	key, err := s.admit(client, ip, blobSize)
+	if err != nil {
+		return err
+	}
+	counted := false
+	defer func() {
+		if !counted {
+			s.release(ip, key, blobSize)
 		}
-		wantsBlob = !blobExists
+	}()
+
+	wantsBlob, err := s.wants(blobHash)
+	if err != nil {
+		return err
 	}
 
 	var neededBlobs []string
@@ -229,6 +316,14 @@ func (s *Server) receiveBlob(conn net.Conn) error {
 		}
 	}
 
+	if wantsBlob && key != nil {
+		// the client waits for the answer before sending the blob, which keeps it to the key's rate
+		err = key.Wait(blobSize)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = s.sendBlobResponse(conn, wantsBlob, isSdBlob, neededBlobs)
 	if err != nil {
 		return err
@@ -253,54 +348,182 @@ func (s *Server) receiveBlob(conn net.Conn) error {
 		if sendErr != nil {
 			return sendErr
 		}
-		return errors.Err("hash of received blob data does not match hash from send request")
+		return errors.Err(ErrHashMismatch)
 		// this can also happen if the blob size is wrong, because the server will read the wrong number of bytes from the stream
 	}
 
 	log.Debugln("Got blob " + blobHash[:8])
 
 	if isSdBlob {
-		err = s.outerStore.PutSD(blobHash, blob)
-	} else {
-		err = s.outerStore.Put(blobHash, blob)
+		err = s.checkStreamLimits(blob)
+		if err != nil {
+			return err
+		}
 	}
+	counted = true
+	err = s.put(ip, key, blobSize, blobHash, blob, isSdBlob)
 	if err != nil {
 		return err
 	}
 	metrics.MtrInBytesReflector.Add(float64(len(blob)))
+	return s.sendTransferResponse(conn, true, isSdBlob)
+}
+
+// admit returns the api key a client uploads a blob of this size with, or why it may not upload it. The size is held
+// against the client's daily limit and the key's quota, and must be given back with release or counted by put
+func (s *Server) admit(client auth.Request, ip string, blobSize int) (*apikey.Key, error) {
+	err := auth.Check(s.Authorizer, client)
+	if err != nil {
+		return nil, errors.Prefix("upload of "+client.Hash, err)
+	}
+	key, err := s.checkKey(client.Token, blobSize)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkLimits(ip, blobSize)
+	if err != nil {
+		if key != nil {
+			s.APIKeys.Release(key, blobSize)
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+// release gives back the size admit held against the client and the key for an upload that didn't happen
+func (s *Server) release(ip string, key *apikey.Key, reserved int) {
+	s.quota.release(ip, reserved)
+	if key != nil {
+		s.APIKeys.Release(key, reserved)
+	}
+}
+
+// wants returns whether the store should take a blob: it doesn't have it, and it isn't blocked
+func (s *Server) wants(hash string) (bool, error) {
+	if bl, ok := s.underlyingStore.(store.Blocklister); ok {
+		return bl.Wants(hash)
+	}
+	has, err := s.underlyingStore.Has(hash)
+	return !has, err
+}
+
+// put stores a blob a client uploaded, and counts it against the client's limits in place of the size admit held
+func (s *Server) put(ip string, key *apikey.Key, reserved int, hash string, blob []byte, isSdBlob bool) error {
+	var err error
+	if isSdBlob {
+		err = s.outerStore.PutSD(hash, blob)
+	} else {
+		err = s.outerStore.Put(hash, blob)
+	}
+	if err != nil {
+		s.release(ip, key, reserved)
+		return err
+	}
+	s.quota.uploaded(ip, reserved, len(blob))
+	if key != nil {
+		s.APIKeys.Uploaded(key, reserved, len(blob))
+	}
 	metrics.BlobUploadCount.Inc()
 	if isSdBlob {
 		metrics.SDBlobUploadCount.Inc()
 	}
-	return s.sendTransferResponse(conn, true, isSdBlob)
+	if s.OnBlobReceived != nil {
+		s.OnBlobReceived(hash, isSdBlob)
+	}
+	return nil
+}
+
+// Accept takes a blob that a client uploaded some other way than the reflector protocol, like the s3 gateway, with the
+// same checks and limits as uploads over the protocol. client.Hash is the hash the client says the blob has. Blobs the
+// store has already are not stored again. Uploads from banned clients or over a limit return errors that wrap
+// ErrRejected
+func (s *Server) Accept(client auth.Request, blob []byte) error {
+	ip := clientIP(client.RemoteAddr)
+	if s.Offenders != nil && s.Offenders.Banned(ip) {
+		metrics.ReflectorBannedConnCount.Inc()
+		return errors.Prefix("client is banned", ErrRejected)
+	}
+	err := s.accept(client, ip, blob)
+	if r, ok := err.(*rejection); ok {
+		trackRejection(r)
+		log.Infof("rejected upload from %s: %s", client.RemoteAddr, r.msg)
+		return errors.Prefix(r.msg, ErrRejected)
+	}
+	s.trackFailure(ip, err)
+	return err
+}
+
+func (s *Server) accept(client auth.Request, ip string, blob []byte) error {
+	if len(blob) > maxBlobSize {
+		return errors.Err(ErrBlobTooBig)
+	}
+	if BlobHash(blob) != client.Hash {
+		return errors.Err(ErrHashMismatch)
+	}
+	key, err := s.admit(client, ip, len(blob))
+	if err != nil {
+		return err
+	}
+	counted := false
+	defer func() {
+		if !counted {
+			s.release(ip, key, len(blob))
+		}
+	}()
+	wants, err := s.wants(client.Hash)
+	if err != nil || !wants {
+		return err
+	}
+	_, sdErr := shared.ParseSDBlob(blob)
+	isSdBlob := sdErr == nil
+	if isSdBlob {
+		err = s.checkStreamLimits(blob)
+		if err != nil {
+			return err
+		}
+	}
+	if key != nil {
+		err = key.Wait(len(blob))
+		if err != nil {
+			return err
+		}
+	}
+	counted = true
+	return s.put(ip, key, len(blob), client.Hash, blob, isSdBlob)
 }
 
-func (s *Server) doHandshake(conn net.Conn) error {
+// doHandshake agrees on the protocol version, and returns who the client is for authorizing its uploads
+func (s *Server) doHandshake(conn net.Conn) (auth.Request, error) {
+	client := auth.Request{
+		Action:     auth.ActionUpload,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Protocol:   auth.ProtocolReflector,
+	}
+
 	var handshake handshakeRequestResponse
 	err := s.read(conn, &handshake)
 	if err != nil {
-		return err
+		return client, err
 	} else if handshake.Version == nil {
-		return errors.Err("handshake is missing protocol version")
+		return client, errors.Prefix("handshake is missing protocol version", ErrProtocol)
 	} else if *handshake.Version != protocolVersion1 && *handshake.Version != protocolVersion2 {
-		return errors.Err("protocol version not supported")
+		return client, errors.Prefix("protocol version not supported", ErrProtocol)
 	}
+	client.Token = handshake.AuthToken
 
-	resp, err := json.Marshal(handshakeRequestResponse{Version: handshake.Version})
+	var features []string
+	if s.EnableHaveFilter {
+		features = append(features, featureHaveFilter)
+	}
+	resp, err := json.Marshal(handshakeRequestResponse{Version: handshake.Version, Features: features})
 	if err != nil {
-		return err
+		return client, err
 	}
 
-	return s.write(conn, resp)
+	return client, s.write(conn, resp)
 }
 
-func (s *Server) readBlobRequest(conn net.Conn) (int, string, bool, error) {
-	var sendRequest sendBlobRequest
-	err := s.read(conn, &sendRequest)
-	if err != nil {
-		return 0, "", false, err
-	}
-
+func parseBlobRequest(sendRequest sendBlobRequest) (int, string, bool, error) {
 	var blobHash string
 	var blobSize int
 	isSdBlob := sendRequest.SdBlobHash != ""
@@ -314,13 +537,16 @@ func (s *Server) readBlobRequest(conn net.Conn) (int, string, bool, error) {
 	}
 
 	if blobHash == "" {
-		return blobSize, blobHash, isSdBlob, errors.Err("blob hash is empty")
+		return blobSize, blobHash, isSdBlob, errors.Prefix("blob hash is empty", ErrProtocol)
 	}
 	if blobSize > maxBlobSize {
 		return blobSize, blobHash, isSdBlob, errors.Err(ErrBlobTooBig)
 	}
 	if blobSize == 0 {
-		return blobSize, blobHash, isSdBlob, errors.Err("0-byte blob received")
+		return blobSize, blobHash, isSdBlob, errors.Prefix("0-byte blob received", ErrProtocol)
+	}
+	if blobSize < 0 {
+		return blobSize, blobHash, isSdBlob, errors.Prefix("negative blob size", ErrProtocol)
 	}
 
 	return blobSize, blobHash, isSdBlob, nil
@@ -367,9 +593,15 @@ func (s *Server) read(conn net.Conn, v interface{}) error {
 	dec := json.NewDecoder(conn)
 	err = dec.Decode(v)
 	if err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		invalid := ee.As(err, &syntaxErr) || ee.As(err, &typeErr)
 		data, _ := ioutil.ReadAll(dec.Buffered())
 		if len(data) > 0 {
-			return errors.Err("%s. Data: %s", err.Error(), hex.EncodeToString(data))
+			err = fmt.Errorf("%s. Data: %s", err.Error(), hex.EncodeToString(data))
+		}
+		if invalid {
+			return errors.Prefix(err.Error(), ErrProtocol)
 		}
 		return errors.Err(err)
 	}
@@ -420,12 +652,18 @@ func IsValidJSON(b []byte) bool {
 	return json.Unmarshal(b, &r) == nil
 }
 
-//type errorResponse struct {
-//	Error string `json:"error"`
-//}
+// errorResponse is sent instead of the usual response when the server rejects an upload
+type errorResponse struct {
+	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"`
+	Limit int64  `json:"limit,omitempty"`
+}
 
 type handshakeRequestResponse struct {
-	Version *int `json:"version"`
+	Version   *int   `json:"version"`
+	AuthToken string `json:"auth_token,omitempty"`
+	// Features are the optional parts of the protocol the server supports. Clients don't send them
+	Features []string `json:"features,omitempty"`
 }
 
 type sendBlobRequest struct {
@@ -433,22 +671,28 @@ type sendBlobRequest struct {
 	BlobSize   int    `json:"blob_size,omitempty"`
 	SdBlobHash string `json:"sd_blob_hash,omitempty"`
 	SdBlobSize int    `json:"sd_blob_size,omitempty"`
+	// HaveFilter is sent instead of a blob, to ask which of the blobs in the filter the server has
+	HaveFilter []byte `json:"have_filter,omitempty"`
 }
 
 type sendBlobResponse struct {
+	errorResponse
 	SendBlob bool `json:"send_blob"`
 }
 
 type sendSdBlobResponse struct {
+	errorResponse
 	SendSdBlob  bool     `json:"send_sd_blob"`
 	NeededBlobs []string `json:"needed_blobs,omitempty"`
 }
 
 type blobTransferResponse struct {
+	errorResponse
 	ReceivedBlob bool `json:"received_blob"`
 }
 
 type sdBlobTransferResponse struct {
+	errorResponse
 	ReceivedSdBlob bool `json:"received_sd_blob"`
 }
 
@@ -1,17 +1,26 @@
 package reflector
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/json"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/lbryio/reflector.go/apikey"
+	"github.com/lbryio/reflector.go/db"
 	"github.com/lbryio/reflector.go/store"
 
 	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/phayes/freeport"
@@ -241,6 +250,285 @@ func TestServer_PartialUpload(t *testing.T) {
 	}
 }
 
+func TestServer_BansCorruptUploads(t *testing.T) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(store.NewMemStore(), store.NewMemStore())
+	srv.Offenders = NewOffenders(2, time.Minute, time.Minute)
+	err = srv.Start("127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown()
+
+	sendCorrupt := func() error {
+		c := Client{}
+		err := c.Connect(":" + strconv.Itoa(port))
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		blob := randBlob(100)
+		sendRequest, err := json.Marshal(sendBlobRequest{BlobHash: BlobHash(randBlob(100)), BlobSize: len(blob)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.conn.Write(sendRequest)
+		if err != nil {
+			return err
+		}
+		var sendResp sendBlobResponse
+		err = json.NewDecoder(c.conn).Decode(&sendResp)
+		if err != nil {
+			return err
+		}
+		_, err = c.conn.Write(blob)
+		if err != nil {
+			return err
+		}
+		var transferResp blobTransferResponse
+		err = json.NewDecoder(c.conn).Decode(&transferResp)
+		if err != nil {
+			return err
+		}
+		if transferResp.ReceivedBlob {
+			t.Error("the server should not accept a blob that doesn't match its hash")
+		}
+		return nil
+	}
+
+	for i := 0; i < 2; i++ {
+		err := sendCorrupt()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the failure is counted after the server answers, so give it a moment
+	var list []Offender
+	for i := 0; i < 100; i++ {
+		list = srv.Offenders.List()
+		if len(list) == 1 && list[0].BannedUntil != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(list) != 1 || list[0].HashMismatches != 2 || list[0].BannedUntil == nil {
+		t.Fatalf("expected the client to be banned after 2 hash mismatches, got %+v", list)
+	}
+
+	// the server hangs up on banned clients right away
+	if err := sendCorrupt(); err == nil {
+		t.Error("expected the banned client to be turned away")
+	}
+
+	// only the admin can list the offenders and lift the ban
+	srv.Offenders.AdminToken = "secret"
+	unban := func(token string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodDelete, "/stats/offenders?ip="+list[0].IP, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		srv.Offenders.ServeHTTP(w, r)
+		return w.Code
+	}
+	for token, expected := range map[string]int{"wrong": http.StatusUnauthorized, "secret": http.StatusOK} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/stats/offenders", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		srv.Offenders.ServeHTTP(w, r)
+		if w.Code != expected {
+			t.Errorf("expected listing the offenders with token %q to give %d, got %d", token, expected, w.Code)
+		}
+	}
+	if code := unban("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("expected unbanning without the admin token to be refused, got %d", code)
+	}
+	if code := unban("secret"); code != http.StatusNoContent {
+		t.Errorf("expected the client to be unbanned, got %d", code)
+	}
+	if err := sendCorrupt(); err != nil {
+		t.Errorf("expected the unbanned client to be able to upload again, got %v", err)
+	}
+}
+
+func TestServer_UploadLimits(t *testing.T) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(store.NewMemStore(), store.NewMemStore())
+	srv.MaxBlobSize = 1000
+	srv.MaxDailyUpload = 1500
+	err = srv.Start("127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown()
+
+	c := Client{}
+	err = c.Connect(":" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.SendBlob(randBlob(1001))
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("expected a blob over the size limit to be rejected, got %v", err)
+	}
+	err = c.SendBlob(randBlob(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SendBlob(randBlob(600))
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("expected a blob over the daily limit to be rejected, got %v", err)
+	}
+	err = c.SendBlob(randBlob(500))
+	if err != nil {
+		t.Errorf("expected a blob within the daily limit to be accepted, got %v", err)
+	}
+}
+
+func TestUploadQuota_Reserve(t *testing.T) {
+	var q uploadQuota
+	if !q.reserve("1.2.3.4", 600, 1000) {
+		t.Fatal("expected the first upload to fit")
+	}
+	// the upload that is going on holds its size, so a second one at the same time can't get past the limit
+	if q.reserve("1.2.3.4", 600, 1000) {
+		t.Error("expected a second upload over the limit to be refused while the first one is going on")
+	}
+	if !q.reserve("5.6.7.8", 600, 1000) {
+		t.Error("expected another client's upload to fit")
+	}
+
+	q.release("1.2.3.4", 600)
+	if !q.reserve("1.2.3.4", 600, 1000) {
+		t.Fatal("expected an upload to fit once the first one was given back")
+	}
+	q.uploaded("1.2.3.4", 600, 600)
+	if q.reserve("1.2.3.4", 600, 1000) {
+		t.Error("expected an upload over the limit to be refused after the first one was counted")
+	}
+	if !q.reserve("1.2.3.4", 400, 1000) {
+		t.Error("expected an upload within the limit to fit")
+	}
+}
+
+func TestServer_StreamLimit(t *testing.T) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(store.NewMemStore(), store.NewMemStore())
+	srv.MaxStreamBlobs = 2
+	err = srv.Start("127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown()
+
+	c := Client{}
+	err = c.Connect(":" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	small, err := stream.New(bytes.NewReader(randBlob(100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SendSDBlob(small[0])
+	if err != nil {
+		t.Errorf("expected a stream with 1 blob to be accepted, got %v", err)
+	}
+
+	big, err := stream.New(bytes.NewReader(randBlob(2*stream.MaxBlobSize + 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SendSDBlob(big[0])
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("expected a stream with 3 blobs to be rejected, got %v", err)
+	}
+}
+
+func TestServer_APIKeys(t *testing.T) {
+	if !db.SQLiteSupported {
+		t.Skip("sqlite needs cgo")
+	}
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB := &db.SQL{}
+	err = sqlDB.Connect(db.SQLitePrefix + filepath.Join(t.TempDir(), "reflector.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := apikey.New(sqlDB)
+	err = keys.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Shutdown()
+	token, key, err := keys.Create("publisher", 1500, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer(store.NewMemStore(), store.NewMemStore())
+	srv.APIKeys = keys
+	err = srv.Start("127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown()
+
+	anonymous := Client{}
+	err = anonymous.Connect(":" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anonymous.Close()
+	err = anonymous.SendBlob(randBlob(100))
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("expected an upload without a key to be rejected, got %v", err)
+	}
+
+	c := Client{AuthToken: token}
+	err = c.Connect(":" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.SendBlob(randBlob(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SendBlob(randBlob(600))
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("expected a blob over the key's quota to be rejected, got %v", err)
+	}
+	if used := keys.List()[0].BytesToday; used != 1000 {
+		t.Errorf("expected 1000 bytes to be counted against the key, got %d", used)
+	}
+
+	err = keys.Revoke(key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SendBlob(randBlob(100))
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("expected an upload with a revoked key to be rejected, got %v", err)
+	}
+}
+
 func randBlob(size int) []byte {
 	//if size > maxBlobSize {
 	//	panic("blob size too big")
@@ -252,3 +540,209 @@ func randBlob(size int) []byte {
 	}
 	return blob
 }
+
+func TestClient_Events(t *testing.T) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one store, so the server knows about the blob after it's uploaded
+	st := store.NewMemStore()
+	srv := NewServer(st, st)
+	err = srv.Start("127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown()
+
+	var events []Event
+	c := Client{Events: func(e Event) { events = append(events, e) }}
+	err = c.Connect(":" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal("error connecting client to server", err)
+	}
+
+	blob := randBlob(3*progressChunk + 10)
+	err = c.SendBlob(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SendBlob(blob)
+	if !errors.Is(err, ErrBlobExists) {
+		t.Fatalf("expected ErrBlobExists, got %v", err)
+	}
+
+	var types []EventType
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	expected := []EventType{EventStart, EventProgress, EventProgress, EventProgress, EventProgress, EventFinish, EventStart, EventFinish}
+	if len(types) != len(expected) {
+		t.Fatalf("expected events %v, got %v", expected, types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Fatalf("expected events %v, got %v", expected, types)
+		}
+	}
+
+	if events[4].Sent != len(blob) || events[5].Sent != len(blob) || events[5].Failed() {
+		t.Errorf("the blob should be fully sent: %+v", events[5])
+	}
+	if events[7].Sent != 0 || events[7].Failed() || !errors.Is(events[7].Err, ErrBlobExists) {
+		t.Errorf("the second send should be skipped, not failed: %+v", events[7])
+	}
+}
+
+func TestMultiUploader(t *testing.T) {
+	var stores []*store.MemStore
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		port, err := freeport.GetFreePort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := store.NewMemStore()
+		srv := NewServer(st, st)
+		err = srv.Start("127.0.0.1:" + strconv.Itoa(port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Shutdown()
+		stores = append(stores, st)
+		addrs = append(addrs, "127.0.0.1:"+strconv.Itoa(port))
+	}
+	deadPort, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs = append(addrs, "127.0.0.1:"+strconv.Itoa(deadPort))
+
+	// enough streams that some belong to each server
+	var streams []stream.Stream
+	for i := 0; i < 30; i++ {
+		s, err := stream.New(bytes.NewReader(randBlob(1000 + i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, s)
+	}
+
+	var mu sync.Mutex
+	retries := 0
+	m := NewMultiUploader(addrs, 2)
+	m.Events = func(e Event) {
+		if e.Type == EventRetry {
+			mu.Lock()
+			retries++
+			mu.Unlock()
+		}
+	}
+	results := m.UploadStreams(streams)
+
+	used := make(map[string]bool)
+	for i, r := range results {
+		if r.Err != nil {
+			t.Fatalf("stream %d failed: %v", i, r.Err)
+		}
+		if r.Server == addrs[2] {
+			t.Errorf("stream %d was uploaded to the dead server", i)
+		}
+		used[r.Server] = true
+		// all the blobs of a stream are on the server it was uploaded to, and none on the other
+		for _, b := range streams[i] {
+			for j, st := range stores {
+				has, _ := st.Has(b.HashHex())
+				if has != (addrs[j] == r.Server) {
+					t.Errorf("stream %d went to %s, but %s has its blob %s: %t", i, r.Server, addrs[j], b.HashHex()[:8], has)
+				}
+			}
+		}
+	}
+	if len(used) != 2 {
+		t.Errorf("streams should be spread over both servers, got %v", used)
+	}
+	if retries == 0 {
+		t.Error("streams of the dead server should have been retried on another one")
+	}
+}
+
+func TestClient_MissingBlobs(t *testing.T) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := store.NewMemStore()
+	var have, missing []string
+	for i := 0; i < 500; i++ {
+		blob := randBlob(100)
+		hash := BlobHash(blob)
+		if i%2 == 0 {
+			have = append(have, hash)
+			_ = st.Put(hash, blob)
+		} else {
+			missing = append(missing, hash)
+		}
+	}
+	// blobs the client doesn't have don't matter
+	for i := 0; i < 500; i++ {
+		blob := randBlob(100)
+		_ = st.Put(BlobHash(blob), blob)
+	}
+
+	srv := NewServer(st, st)
+	srv.EnableHaveFilter = true
+	err = srv.Start("127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown()
+
+	c := Client{}
+	err = c.Connect(":" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal("error connecting client to server", err)
+	}
+	defer c.Close()
+
+	got, err := c.MissingBlobs(append(append([]string{}, have...), missing...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(missing) {
+		t.Fatalf("expected %d missing blobs, got %d", len(missing), len(got))
+	}
+	for i := range missing {
+		if got[i] != missing[i] {
+			t.Fatalf("expected %s to be missing, got %s", missing[i], got[i])
+		}
+	}
+
+	// the connection is still good for uploads
+	blob := randBlob(100)
+	err = c.SendBlob(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient_MissingBlobsUnsupported(t *testing.T) {
+	srv, port := startServerOnRandomPort(t)
+	defer srv.Shutdown()
+
+	c := Client{}
+	err := c.Connect(":" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal("error connecting client to server", err)
+	}
+	defer c.Close()
+
+	hashes := []string{BlobHash(randBlob(10)), BlobHash(randBlob(10))}
+	got, err := c.MissingBlobs(hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(hashes) {
+		t.Fatalf("expected all %d blobs to be missing, got %d", len(hashes), len(got))
+	}
+}
@@ -23,6 +23,7 @@ const (
 	sdInc increment = iota + 1
 	blobInc
 	errInc
+	totalInc // a blob to upload was found after the upload started
 )
 
 type Summary struct {
@@ -30,6 +31,16 @@ type Summary struct {
 }
 
 type Uploader struct {
+	// Events is told about each blob as it's uploaded, if set. It's called from all the workers
+	Events Events
+	// Retries is how many times a blob that failed to store is tried again
+	Retries int
+	// Queue keeps track of the files that are left, so an interrupted upload of the same path continues where it
+	// stopped, if set
+	Queue *UploadQueue
+	// WatchSettle is how long Watch waits for a new file to stop changing before uploading it
+	WatchSettle time.Duration
+
 	db                     *db.SQL
 	store                  *store.DBBackedStore // could just be store.BlobStore interface
 	workers                int
@@ -59,31 +70,40 @@ func (u *Uploader) Stop() {
 }
 
 func (u *Uploader) Upload(dirOrFilePath string) error {
-	paths, err := getPaths(dirOrFilePath)
+	paths, exists, err := u.pathsToUpload(dirOrFilePath)
 	if err != nil {
 		return err
 	}
 
-	u.count.Total = len(paths)
+	log.Debugf("%d new blobs to upload", u.count.Total-u.count.AlreadyStored)
 
-	hashes := make([]string, len(paths))
-	for i, p := range paths {
-		hashes[i] = path.Base(p)
-	}
+	pathChan, wait := u.start()
 
-	log.Debug("checking for existing blobs")
+Upload:
+	for _, f := range paths {
+		if exists != nil && exists[path.Base(f)] {
+			continue
+		}
 
-	var exists map[string]bool
-	if !u.skipExistsCheck {
-		exists, err = u.db.HasBlobs(hashes, false)
-		if err != nil {
-			return err
+		select {
+		case pathChan <- f:
+		case <-u.stopper.Ch():
+			break Upload
 		}
-		u.count.AlreadyStored = len(exists)
 	}
 
-	log.Debugf("%d new blobs to upload", u.count.Total-u.count.AlreadyStored)
+	wait()
+
+	log.Debugf(
+		"upload stats: %d blobs total, %d already stored, %d SD blobs uploaded, %d content blobs uploaded, %d errors",
+		u.count.Total, u.count.AlreadyStored, u.count.Sd, u.count.Blob, u.count.Err,
+	)
+	return nil
+}
 
+// start starts the workers and the counter. The returned func stops them after the paths sent so far are uploaded, and
+// stops the uploader
+func (u *Uploader) start() (chan<- string, func()) {
 	workerWG := sync.WaitGroup{}
 	pathChan := make(chan string)
 
@@ -107,30 +127,76 @@ func (u *Uploader) Upload(dirOrFilePath string) error {
 		u.counter()
 	}()
 
-Upload:
-	for _, f := range paths {
-		if exists != nil && exists[path.Base(f)] {
-			continue
+	return pathChan, func() {
+		close(pathChan)
+		workerWG.Wait()
+		close(u.countChan)
+		countWG.Wait()
+		u.stopper.Stop()
+	}
+}
+
+// pathsToUpload returns the files to upload and which of them are already stored. With a queue, an interrupted upload
+// of the same path is picked up from the queue. Otherwise the files are listed and checked against the db, and put
+// in the queue
+func (u *Uploader) pathsToUpload(dirOrFilePath string) ([]string, map[string]bool, error) {
+	if u.Queue != nil {
+		source, pending, err := u.Queue.Pending()
+		if err != nil {
+			return nil, nil, err
+		}
+		if source == dirOrFilePath && len(pending) > 0 {
+			log.Infof("resuming the upload of %s, %d blobs are left", dirOrFilePath, len(pending))
+			u.count.Total = len(pending)
+			return pending, nil, nil
 		}
+	}
 
-		select {
-		case pathChan <- f:
-		case <-u.stopper.Ch():
-			break Upload
+	paths, exists, err := u.listNew(dirOrFilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if u.Queue != nil {
+		todo := make([]string, 0, len(paths)-len(exists))
+		for _, p := range paths {
+			if !exists[path.Base(p)] {
+				todo = append(todo, p)
+			}
+		}
+		err = u.Queue.Reset(dirOrFilePath, todo)
+		if err != nil {
+			return nil, nil, err
 		}
 	}
+	return paths, exists, nil
+}
 
-	close(pathChan)
-	workerWG.Wait()
-	close(u.countChan)
-	countWG.Wait()
-	u.stopper.Stop()
+// listNew lists the files to upload and checks which of them are already stored, unless the check is skipped
+func (u *Uploader) listNew(dirOrFilePath string) ([]string, map[string]bool, error) {
+	paths, err := getPaths(dirOrFilePath)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	log.Debugf(
-		"upload stats: %d blobs total, %d already stored, %d SD blobs uploaded, %d content blobs uploaded, %d errors",
-		u.count.Total, u.count.AlreadyStored, u.count.Sd, u.count.Blob, u.count.Err,
-	)
-	return nil
+	u.count.Total = len(paths)
+
+	hashes := make([]string, len(paths))
+	for i, p := range paths {
+		hashes[i] = path.Base(p)
+	}
+
+	log.Debug("checking for existing blobs")
+
+	var exists map[string]bool
+	if !u.skipExistsCheck {
+		exists, err = u.db.HasBlobs(hashes, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		u.count.AlreadyStored = len(exists)
+	}
+	return paths, exists, nil
 }
 
 // worker reads paths from a channel,  uploads them, and optionally deletes them
@@ -144,15 +210,29 @@ func (u *Uploader) worker(pathChan chan string) {
 				return
 			}
 
+			if _, err := os.Stat(filepath); os.IsNotExist(err) && u.Queue != nil {
+				// uploaded and deleted by an upload that stopped before it could update the queue
+				_ = u.Queue.Done(filepath)
+				continue
+			}
 			err := u.uploadBlob(filepath)
 			if err != nil {
+				// the blob stays in the queue, so it's tried again by the next upload
 				log.Errorln(err)
-			} else if u.deleteBlobsAfterUpload {
+				continue
+			}
+			if u.deleteBlobsAfterUpload {
 				err = os.Remove(filepath)
 				if err != nil {
 					log.Errorln(errors.Prefix("deleting blob", err))
 				}
 			}
+			if u.Queue != nil {
+				err = u.Queue.Done(filepath)
+				if err != nil {
+					log.Errorln(errors.Prefix("updating the upload queue", err))
+				}
+			}
 		}
 	}
 }
@@ -175,25 +255,52 @@ func (u *Uploader) uploadBlob(filepath string) (err error) {
 		return errors.Err("file name does not match hash (%s != %s), skipping", filepath, hash)
 	}
 
-	if IsValidJSON(blob) {
-		log.Debugf("uploading SD blob %s", hash)
-		err := u.store.PutSD(hash, blob)
-		if err != nil {
-			return errors.Prefix("uploading SD blob "+hash, err)
+	isSD := IsValidJSON(blob)
+	event := Event{Type: EventStart, Hash: hash, SD: isSD, Size: len(blob), Attempt: 1}
+	u.Events.emit(event)
+	for {
+		err = u.putBlob(hash, blob, isSD)
+		if err == nil || event.Attempt > u.Retries {
+			break
+		}
+		log.Debugf("retrying %s: %s", hash, err.Error())
+		event.Type, event.Err = EventRetry, err
+		u.Events.emit(event)
+		event.Attempt++
+		select {
+		case <-u.stopper.Ch():
+			return err
+		case <-time.After(time.Duration(event.Attempt) * time.Second):
 		}
+	}
+	event.Type, event.Err = EventFinish, err
+	if err == nil {
+		event.Sent = len(blob)
+	}
+	u.Events.emit(event)
+	if err != nil {
+		return err
+	}
+
+	if isSD {
 		u.inc(sdInc)
 	} else {
-		log.Debugf("uploading blob %s", hash)
-		err = u.store.Put(hash, blob)
-		if err != nil {
-			return errors.Prefix("uploading blob "+hash, err)
-		}
 		u.inc(blobInc)
 	}
-
 	return nil
 }
 
+func (u *Uploader) putBlob(hash string, blob []byte, isSD bool) error {
+	if isSD {
+		log.Debugf("uploading SD blob %s", hash)
+		err := u.store.PutSD(hash, blob)
+		return errors.Prefix("uploading SD blob "+hash, err)
+	}
+	log.Debugf("uploading blob %s", hash)
+	err := u.store.Put(hash, blob)
+	return errors.Prefix("uploading blob "+hash, err)
+}
+
 // counter updates the counts of how many sd blobs and content blobs were uploaded, and how many
 // errors were encountered. It occasionally prints the upload progress to debug.
 func (u *Uploader) counter() {
@@ -214,6 +321,9 @@ func (u *Uploader) counter() {
 				u.count.Blob++
 			case errInc:
 				u.count.Err++
+			case totalInc:
+				u.count.Total++
+				continue
 			}
 		}
 		if (u.count.Sd+u.count.Blob)%50 == 0 {
@@ -0,0 +1,109 @@
+package reflector
+
+import (
+	"encoding/hex"
+	"path"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultWatchSettle is how long a new blob file must go unchanged before it's uploaded, unless WatchSettle is changed
+const DefaultWatchSettle = 2 * time.Second
+
+// Watch uploads the blobs in dir, then keeps watching dir and uploads new blob files as they appear, until the
+// uploader is stopped. A file is uploaded once it hasn't changed for WatchSettle, so files that are still being
+// written are left alone. Files that aren't named like blobs are ignored. The Queue is not used: on start, the whole
+// dir is checked against the db
+func (u *Uploader) Watch(dir string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer watcher.Close()
+	// watch before listing, so files that appear meanwhile are not missed
+	err = watcher.Add(dir)
+	if err != nil {
+		return errors.Prefix("watching "+dir, err)
+	}
+
+	paths, exists, err := u.listNew(dir)
+	if err != nil {
+		return err
+	}
+	log.Infof("watching %s, %d blobs to upload first", dir, len(paths)-len(exists))
+	pathChan, wait := u.start()
+	defer wait()
+
+	settle := u.WatchSettle
+	if settle <= 0 {
+		settle = DefaultWatchSettle
+	}
+	// files waiting to settle, with the time they last changed
+	changed := make(map[string]time.Time)
+	ticker := time.NewTicker(settle / 2)
+	defer ticker.Stop()
+
+	send := func(p string) bool {
+		select {
+		case pathChan <- p:
+			return true
+		case <-u.stopper.Ch():
+			return false
+		}
+	}
+	for _, p := range paths {
+		if exists[path.Base(p)] {
+			continue
+		}
+		if !send(p) {
+			return nil
+		}
+	}
+
+	for {
+		select {
+		case <-u.stopper.Ch():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write) == 0 || !isBlobFileName(path.Base(event.Name)) {
+				continue
+			}
+			if _, waiting := changed[event.Name]; !waiting {
+				u.inc(totalInc)
+			}
+			changed[event.Name] = time.Now()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			// the watcher keeps going after errors, like when events were dropped because too many came at once
+			log.Errorf("watching %s: %s", dir, err.Error())
+		case <-ticker.C:
+			for p, at := range changed {
+				if time.Since(at) < settle {
+					continue
+				}
+				delete(changed, p)
+				if !send(p) {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func isBlobFileName(name string) bool {
+	if len(name) != stream.BlobHashHexLength {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
@@ -0,0 +1,91 @@
+package http
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// rawWriterKey is where the http.ResponseWriter under gin's is kept in the request context
+type rawWriterKey struct{}
+
+// keepRawWriter puts the http.ResponseWriter in the request context. Its ReadFrom sends files with sendfile, and gin's
+// response writer doesn't have one
+func keepRawWriter(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rawWriterKey{}, w)))
+	})
+}
+
+// fileWriter is gin's response writer with the ReadFrom of the writer under it
+type fileWriter struct {
+	gin.ResponseWriter
+	raw http.ResponseWriter
+}
+
+// ReadFrom has gin write the headers, so it knows the status, and then sends the body straight to the connection
+func (w fileWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.ResponseWriter.WriteHeaderNow()
+	return io.Copy(w.raw, r)
+}
+
+// serveFile sends the blob from its file if the store has it in one, so the kernel copies it to the socket without
+// the whole blob being read into memory first. Range requests are supported. It returns false if the blob is not in a
+// file and should be sent from Get instead
+func (s *Server) serveFile(c *gin.Context, st store.BlobStore, hash, reqID string, start time.Time) bool {
+	f, trace, err := store.OpenFile(st, hash)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFile) {
+			log.Warnf("request %s: opening the file of %s: %s", reqID, hash, err.Error())
+		}
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		log.Warnf("request %s: opening the file of %s: %s", reqID, hash, err.Error())
+		return false
+	}
+
+	trace = trace.Stack(time.Since(start), "file")
+	trace.Served(reqID)
+	log.Debugf("request %s: %s", reqID, trace.String())
+	serialized, err := trace.Serialize()
+	if err != nil {
+		_ = c.Error(err)
+		c.String(http.StatusInternalServerError, err.Error())
+		return true
+	}
+	metrics.MtrOutBytesHttp.Add(float64(info.Size()))
+	metrics.BlobDownloadCount.Inc()
+	metrics.HttpDownloadCount.Inc()
+	if s.GeoIP != nil {
+		s.GeoIP.Count(auth.ProtocolHTTP, c.Request.RemoteAddr, int(info.Size()))
+	}
+	if s.Capture != nil {
+		s.Capture.Record(auth.ProtocolHTTP, c.Request.RemoteAddr, hash, int(info.Size()))
+	}
+	c.Header("Via", serialized)
+	c.Header("Content-Disposition", "filename="+hash)
+	c.Header("Content-Type", "application/octet-stream")
+
+	var w http.ResponseWriter = c.Writer
+	// shaped responses have to go through the rate limits
+	if _, shaped := c.Writer.(*shapedWriter); !shaped {
+		if raw, ok := c.Request.Context().Value(rawWriterKey{}).(http.ResponseWriter); ok {
+			w = fileWriter{ResponseWriter: c.Writer, raw: raw}
+		}
+	}
+	http.ServeContent(w, c.Request, "", info.ModTime(), f)
+	return true
+}
@@ -0,0 +1,54 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/lbryio/reflector.go/reflector"
+	"github.com/lbryio/reflector.go/shared"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_BlobFromFile(t *testing.T) {
+	st := store.NewDiskStore(t.TempDir(), 2)
+	blob := randBytes(t, 1000)
+	hash := reflector.BlobHash(blob)
+	require.NoError(t, st.Put(hash, blob))
+	ts := newTestServer(t, NewServer(st, 4))
+	url := ts.URL + "/blob?hash=" + hash
+
+	res, body := get(t, http.MethodGet, url, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, blob, body)
+	assert.Equal(t, "application/octet-stream", res.Header.Get("Content-Type"))
+	trace, err := shared.Deserialize(res.Header.Get("Via"))
+	require.NoError(t, err)
+	require.NotEmpty(t, trace.Stacks)
+	assert.Equal(t, "file", trace.Stacks[len(trace.Stacks)-1].OriginName, "the blob wasn't sent from its file")
+
+	res, body = get(t, http.MethodGet, url, map[string]string{"Range": "bytes=10-19"})
+	require.Equal(t, http.StatusPartialContent, res.StatusCode)
+	assert.Equal(t, blob[10:20], body)
+
+	res, _ = get(t, http.MethodGet, ts.URL+"/blob?hash="+reflector.BlobHash([]byte("missing")), nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestServer_BlobFromMemory(t *testing.T) {
+	st := store.NewMemStore()
+	blob := randBytes(t, 1000)
+	hash := reflector.BlobHash(blob)
+	require.NoError(t, st.Put(hash, blob))
+	ts := newTestServer(t, NewServer(st, 4))
+
+	// blobs that aren't in a file are sent whole
+	res, body := get(t, http.MethodGet, ts.URL+"/blob?hash="+hash, map[string]string{"Range": "bytes=10-19"})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, blob, body)
+
+	res, _ = get(t, http.MethodHead, ts.URL+"/blob?hash="+hash, nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+}
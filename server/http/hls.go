@@ -0,0 +1,106 @@
+package http
+
+import (
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// every blob of a stream becomes one HLS segment. media players need a duration for each segment but the blobs don't
+// say anything about the media inside them, so the durations are spread over the segments by size. the total is
+// taken from the duration query parameter if the caller knows it (the claim metadata has it), otherwise we assume
+// each full blob holds defaultSegmentDuration seconds.
+const defaultSegmentDuration = 10.0
+
+// getHLSPlaylist generates a VOD media playlist for the stream, with one segment per blob.
+// Players only get useful segments if the stream is in a format that can be split at arbitrary byte offsets, such as
+// MPEG-TS.
+func (s *Server) getHLSPlaylist(c *gin.Context) {
+	sdHash := c.Param("sdhash")
+	sd, err := s.getSDBlob(sdHash)
+	if err != nil {
+		s.streamError(c, err)
+		return
+	}
+	f, err := newStreamFile(s.store, sd, sd.Key)
+	if err != nil {
+		s.streamError(c, err)
+		return
+	}
+	if f.size == 0 {
+		c.String(http.StatusBadRequest, "stream is empty")
+		return
+	}
+
+	total := defaultSegmentDuration * float64(f.size) / fullBlobDataSize
+	if d := c.Query("duration"); d != "" {
+		total, err = strconv.ParseFloat(d, 64)
+		if err != nil || total <= 0 {
+			c.String(http.StatusBadRequest, "invalid duration")
+			return
+		}
+	}
+
+	durations := make([]float64, len(f.offsets))
+	target := 0.0
+	for i := range f.offsets {
+		durations[i] = total * float64(f.segmentSize(i)) / float64(f.size)
+		target = math.Max(target, durations[i])
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	for i, d := range durations {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", d)
+		fmt.Fprintf(&b, "segment/%d%s\n", i, filepath.Ext(sd.SuggestedFileName))
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(b.String()))
+}
+
+// getHLSSegment serves the decrypted contents of one blob of the stream
+func (s *Server) getHLSSegment(c *gin.Context) {
+	sdHash := c.Param("sdhash")
+	segment := c.Param("segment")
+	n, err := strconv.Atoi(strings.TrimSuffix(segment, filepath.Ext(segment)))
+	if err != nil || n < 0 {
+		c.String(http.StatusBadRequest, "invalid segment")
+		return
+	}
+
+	sd, err := s.getSDBlob(sdHash)
+	if err != nil {
+		s.streamError(c, err)
+		return
+	}
+	infos := sd.ContentBlobs()
+	if n >= len(infos) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	data, err := fetchBlobData(s.store, infos[n], sd.Key)
+	if err != nil {
+		s.streamError(c, err)
+		return
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(sd.SuggestedFileName))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	// segments never change, they are addressed by the hash of the stream
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Data(http.StatusOK, contentType, data)
+}
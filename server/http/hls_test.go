@@ -0,0 +1,61 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_HLS(t *testing.T) {
+	st := store.NewMemStore()
+	data := randBytes(t, 2*fullBlobDataSize+100)
+	s := putStream(t, st, "video.png", data)
+	ts := newTestServer(t, NewServer(st, 4))
+	url := ts.URL + "/stream/" + s[0].HashHex()
+
+	res, body := get(t, http.MethodGet, url+"/hls.m3u8?duration=30", nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/vnd.apple.mpegurl", res.Header.Get("Content-Type"))
+	playlist := string(body)
+	assert.True(t, strings.HasPrefix(playlist, "#EXTM3U\n"))
+	assert.True(t, strings.HasSuffix(playlist, "#EXT-X-ENDLIST\n"))
+	// the 30 seconds are spread over the blobs by size, so the full ones get almost 15 each
+	assert.Contains(t, playlist, "#EXT-X-TARGETDURATION:15\n")
+	assert.Equal(t, 3, strings.Count(playlist, "#EXTINF:"))
+	for _, segment := range []string{"segment/0.png", "segment/1.png", "segment/2.png"} {
+		assert.Contains(t, playlist, "\n"+segment+"\n")
+	}
+
+	res, _ = get(t, http.MethodGet, url+"/hls.m3u8?duration=-1", nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, body = get(t, http.MethodGet, url+"/segment/1.png", nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, data[fullBlobDataSize:2*fullBlobDataSize], body)
+	assert.Equal(t, "image/png", res.Header.Get("Content-Type"))
+	assert.Contains(t, res.Header.Get("Cache-Control"), "immutable")
+
+	res, body = get(t, http.MethodGet, url+"/segment/2.png", nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, data[2*fullBlobDataSize:], body)
+
+	res, _ = get(t, http.MethodGet, url+"/segment/3.png", nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, _ = get(t, http.MethodGet, url+"/segment/first.png", nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestServer_HLSEmptyStream(t *testing.T) {
+	st := store.NewMemStore()
+	s := putStream(t, st, "", nil)
+	require.Len(t, s, 1)
+	ts := newTestServer(t, NewServer(st, 4))
+
+	res, _ := get(t, http.MethodGet, ts.URL+"/stream/"+s[0].HashHex()+"/hls.m3u8", nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
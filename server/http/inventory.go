@@ -0,0 +1,102 @@
+package http
+
+import (
+	"bufio"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBlobsPageSize = 1000
+	maxBlobsPageSize     = 10000
+)
+
+// authorizeList lets a request through if the authorizer allows listing the server's blobs
+func (s *Server) authorizeList(c *gin.Context) {
+	err := auth.Check(s.Authorizer, auth.FromHTTP(c.Request, auth.ActionList, "", auth.ProtocolHTTP))
+	if errors.Is(err, auth.ErrForbidden) {
+		log.Debugf("blob listing request denied: %s", err.Error())
+		c.AbortWithStatus(http.StatusForbidden)
+	} else if err != nil {
+		_ = c.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
+}
+
+// getBlobs lists the hashes of the blobs this server has a page at a time, in order. ?after= is the last hash of the
+// previous page, and ?limit= how many hashes to list (1000 by default, at most 10000)
+func (s *Server) getBlobs(c *gin.Context) {
+	limit := defaultBlobsPageSize
+	if l := c.Query("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			c.String(http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		if limit > maxBlobsPageSize {
+			limit = maxBlobsPageSize
+		}
+	}
+
+	// one more than the limit is fetched to know whether there's a next page
+	hashes, err := store.ListPage(s.local, strings.ToLower(c.Query("after")), limit+1)
+	if err != nil {
+		_ = c.Error(err)
+		c.String(http.StatusNotImplemented, err.Error())
+		return
+	}
+	page := store.BlobsPage{Blobs: hashes}
+	if len(hashes) > limit {
+		page.Blobs = hashes[:limit]
+		page.Next = page.Blobs[limit-1]
+	}
+	if page.Blobs == nil {
+		page.Blobs = []string{}
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// getInventory lists the hashes of the blobs this server has, sorted and one per line, so another node can work out
+// which blobs it's missing. With ?prefix=, only the hashes that start with it are listed, so a big inventory can be
+// fetched in parts. In a cluster, only this member's own blobs are listed.
+func (s *Server) getInventory(c *gin.Context) {
+	hashes, err := store.List(s.local)
+	if err != nil {
+		_ = c.Error(err)
+		c.String(http.StatusNotImplemented, err.Error())
+		return
+	}
+	if prefix := strings.ToLower(c.Query("prefix")); prefix != "" {
+		filtered := hashes[:0]
+		for _, h := range hashes {
+			if strings.HasPrefix(h, prefix) {
+				filtered = append(filtered, h)
+			}
+		}
+		hashes = filtered
+	}
+	sort.Strings(hashes)
+
+	c.Header(store.InventoryCountHeader, strconv.Itoa(len(hashes)))
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Status(http.StatusOK)
+	w := bufio.NewWriter(c.Writer)
+	for _, h := range hashes {
+		_, err = w.WriteString(h + "\n")
+		if err != nil {
+			return
+		}
+	}
+	_ = w.Flush()
+}
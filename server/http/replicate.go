@@ -0,0 +1,68 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how many blobs can wait to be replicated. hashes beyond that are dropped, and will be fetched when requested
+	replicateQueueSize = 100000
+	replicateWorkers   = 4
+)
+
+// replicate takes a list of blobs that this member became an owner of, and fetches them in the background. Only other
+// members may ask for it. Their signature covers the body, so a signed request can't be sent again with other hashes
+func (s *Server) replicate(c *gin.Context) {
+	if !s.fromMember(c) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	var hashes []string
+	err := c.BindJSON(&hashes)
+	if err != nil {
+		_ = c.Error(errors.Err(err))
+		return
+	}
+
+	queued := 0
+	for _, hash := range hashes {
+		if _, local := s.Router.BlobOwners(hash); !local {
+			continue
+		}
+		select {
+		case s.replicateCh <- hash:
+			queued++
+		default:
+		}
+	}
+	c.JSON(http.StatusAccepted, gin.H{"queued": queued})
+}
+
+func (s *Server) startReplicationWorkers() {
+	for i := 0; i < replicateWorkers; i++ {
+		s.grp.Add(1)
+		go func() {
+			defer s.grp.Done()
+			for {
+				select {
+				case <-s.grp.Ch():
+					return
+				case hash := <-s.replicateCh:
+					// getting the blob through the caching store keeps it in the cache
+					_, _, err := s.local.Get(hash)
+					if err != nil && !errors.Is(err, store.ErrBlobNotFound) {
+						log.Warnf("replicating %s failed: %s", hash, err.Error())
+					}
+				}
+			}
+		}()
+	}
+}
@@ -1,10 +1,13 @@
 package http
 
 import (
+	"math"
 	"net/http"
-	"sync"
+	"strconv"
 	"time"
 
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/internal/admission"
 	"github.com/lbryio/reflector.go/internal/metrics"
 	"github.com/lbryio/reflector.go/shared"
 	"github.com/lbryio/reflector.go/store"
@@ -16,10 +19,31 @@ import (
 )
 
 func (s *Server) getBlob(c *gin.Context) {
-	waiter := &sync.WaitGroup{}
-	waiter.Add(1)
-	enqueue(&blobRequest{c: c, finished: waiter})
-	waiter.Wait()
+	metrics.HttpBlobReqQueue.Inc()
+	defer metrics.HttpBlobReqQueue.Dec()
+	err := s.queue.Do(c.Request.Context(), func() { s.HandleGetBlob(c) })
+	if errors.Is(err, admission.ErrOverloaded) {
+		c.Header("Retry-After", "1")
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+	}
+}
+
+// retryLater answers with a 503 and a Retry-After header if err says the blob is temporarily unavailable
+func retryLater(c *gin.Context, err error) bool {
+	retryAfter, ok := store.RetryAfter(err)
+	if !ok {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	c.String(http.StatusServiceUnavailable, err.Error())
+	return true
+}
+
+// requestID returns the id of the request, which the client may have sent, and sends it back in the response
+func requestID(c *gin.Context) string {
+	id := shared.RequestIDOrNew(c.GetHeader(shared.RequestIDHeader))
+	c.Header(shared.RequestIDHeader, id)
+	return id
 }
 
 func (s *Server) HandleGetBlob(c *gin.Context) {
@@ -30,9 +54,11 @@ func (s *Server) HandleGetBlob(c *gin.Context) {
 	}()
 	start := time.Now()
 	hash := c.Query("hash")
+	reqID := requestID(c)
 
 	if s.missesCache.Has(hash) {
-		serialized, err := shared.NewBlobTrace(time.Since(start), "http").Serialize()
+		trace := shared.NewBlobTrace(time.Since(start), "http")
+		serialized, err := trace.Served(reqID).Serialize()
 		c.Header("Via", serialized)
 		if err != nil {
 			_ = c.Error(errors.Err(err))
@@ -42,7 +68,16 @@ func (s *Server) HandleGetBlob(c *gin.Context) {
 		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
-	blob, trace, err := s.store.Get(hash)
+	st := s.route(c, hash)
+	if st == nil {
+		return
+	}
+	if s.serveFile(c, st, hash, reqID, start) {
+		return
+	}
+	blob, trace, err := st.Get(hash)
+	trace.Served(reqID)
+	log.Debugf("request %s: %s", reqID, trace.String())
 	if err != nil {
 		serialized, serializeErr := trace.Serialize()
 		if serializeErr != nil {
@@ -57,6 +92,9 @@ func (s *Server) HandleGetBlob(c *gin.Context) {
 			c.AbortWithStatus(http.StatusNotFound)
 			return
 		}
+		if retryLater(c, err) {
+			return
+		}
 		_ = c.Error(err)
 		c.String(http.StatusInternalServerError, err.Error())
 		return
@@ -70,6 +108,12 @@ func (s *Server) HandleGetBlob(c *gin.Context) {
 	metrics.MtrOutBytesHttp.Add(float64(len(blob)))
 	metrics.BlobDownloadCount.Inc()
 	metrics.HttpDownloadCount.Inc()
+	if s.GeoIP != nil {
+		s.GeoIP.Count(auth.ProtocolHTTP, c.Request.RemoteAddr, len(blob))
+	}
+	if s.Capture != nil {
+		s.Capture.Record(auth.ProtocolHTTP, c.Request.RemoteAddr, hash, len(blob))
+	}
 	c.Header("Via", serialized)
 	c.Header("Content-Disposition", "filename="+hash)
 	c.Data(http.StatusOK, "application/octet-stream", blob)
@@ -77,7 +121,11 @@ func (s *Server) HandleGetBlob(c *gin.Context) {
 
 func (s *Server) hasBlob(c *gin.Context) {
 	hash := c.Query("hash")
-	has, err := s.store.Has(hash)
+	st := s.route(c, hash)
+	if st == nil {
+		return
+	}
+	has, err := st.Has(hash)
 	if err != nil {
 		_ = c.Error(err)
 		c.String(http.StatusInternalServerError, err.Error())
@@ -90,6 +138,76 @@ func (s *Server) hasBlob(c *gin.Context) {
 	c.Status(http.StatusNotFound)
 }
 
+// fromMember returns true if another cluster member signed the request
+func (s *Server) fromMember(c *gin.Context) bool {
+	return s.Router != nil && c.GetHeader(store.RoutedHeader) != "" && s.MemberAuth.VerifyRequest(c.Request)
+}
+
+// route returns the store to serve a blob request from, or nil if the client was redirected to the cluster member
+// that owns the blob. Requests that another member routed here are always served locally
+func (s *Server) route(c *gin.Context, hash string) store.BlobStore {
+	if s.Router == nil || s.fromMember(c) {
+		return s.local
+	}
+	if st, routed := s.routeToRegion(c, hash); routed {
+		return st
+	}
+	if !s.RedirectToOwner {
+		return s.store
+	}
+	addrs, local := s.Router.BlobOwners(hash)
+	if local || len(addrs) == 0 {
+		return s.local
+	}
+	c.Redirect(http.StatusTemporaryRedirect, "http://"+addrs[0]+c.Request.URL.RequestURI())
+	return nil
+}
+
+// routeToRegion sends requests from clients in another region to the member of that region that holds the blob, so
+// they are served, and cached, near the client. It returns false if the request is not for another region
+func (s *Server) routeToRegion(c *gin.Context, hash string) (store.BlobStore, bool) {
+	if s.Regions == nil || s.Locate == nil {
+		return nil, false
+	}
+	region := s.Locate(c.Request)
+	if region == "" || region == s.Region {
+		return nil, false
+	}
+	addr, ok := s.Regions.RegionOwner(region, hash)
+	if !ok {
+		return nil, false
+	}
+	if s.RedirectToRegion {
+		metrics.ClusterRegionRoutedCount.WithLabelValues(region, "redirect").Inc()
+		c.Redirect(http.StatusFound, "http://"+addr+c.Request.URL.RequestURI())
+		return nil, true
+	}
+	metrics.ClusterRegionRoutedCount.WithLabelValues(region, "proxy").Inc()
+	return s.routed.Remote(addr), true
+}
+
+// authorize returns a middleware that checks the request with the Authorizer. The hash is taken from the query or
+// path param with the given name. Requests that another cluster member routed here were authorized by that member
+func (s *Server) authorize(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.Authorizer == nil || s.fromMember(c) {
+			return
+		}
+		hash := c.Param(param)
+		if hash == "" {
+			hash = c.Query(param)
+		}
+		err := s.Authorizer.Authorize(auth.FromHTTP(c.Request, auth.ActionDownload, hash, auth.ProtocolHTTP))
+		if errors.Is(err, auth.ErrForbidden) {
+			log.Debugf("http request for %s denied: %s", hash, err.Error())
+			c.AbortWithStatus(http.StatusForbidden)
+		} else if err != nil {
+			_ = c.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+}
+
 func (s *Server) recoveryHandler(c *gin.Context, err interface{}) {
 	c.JSON(500, gin.H{
 		"title": "Error",
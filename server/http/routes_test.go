@@ -0,0 +1,89 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lbryio/reflector.go/reflector"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// localRouter keeps every blob on this member
+type localRouter struct{}
+
+func (localRouter) BlobOwners(string) ([]string, bool) { return nil, true }
+
+// trustAll signs nothing and takes every request as coming from a member
+type trustAll struct{}
+
+func (trustAll) SignRequest(*http.Request)        {}
+func (trustAll) VerifyRequest(*http.Request) bool { return true }
+
+// regions maps each region to the address of the member that holds every blob there
+type regions map[string]string
+
+func (r regions) RegionOwner(region, _ string) (string, bool) {
+	addr, ok := r[region]
+	return addr, ok
+}
+
+// regionServer returns a server in region us that sends the clients of region eu to the member at eu. The region of a
+// client is in its X-Region header
+func regionServer(st store.BlobStore, eu string, redirect bool) *Server {
+	s := NewServer(st, 4)
+	s.Router = localRouter{}
+	s.MemberAuth = trustAll{}
+	s.Regions = regions{"eu": eu}
+	s.Region = "us"
+	s.Locate = func(r *http.Request) string { return r.Header.Get("X-Region") }
+	s.RedirectToRegion = redirect
+	return s
+}
+
+func TestServer_RegionRedirect(t *testing.T) {
+	blob := randBytes(t, 1000)
+	hash := reflector.BlobHash(blob)
+	st := store.NewMemStore()
+	require.NoError(t, st.Put(hash, blob))
+	ts := newTestServer(t, regionServer(st, "eu.example.com:5569", true))
+	url := ts.URL + "/blob?hash=" + hash
+
+	res, _ := get(t, http.MethodGet, url, map[string]string{"X-Region": "eu"})
+	require.Equal(t, http.StatusFound, res.StatusCode)
+	assert.Equal(t, "http://eu.example.com:5569/blob?hash="+hash, res.Header.Get("Location"))
+
+	// clients of this region, and of regions without members, are served here
+	for _, region := range []string{"us", "ap", ""} {
+		res, body := get(t, http.MethodGet, url, map[string]string{"X-Region": region})
+		require.Equal(t, http.StatusOK, res.StatusCode, region)
+		assert.Equal(t, blob, body, region)
+	}
+
+	// requests routed here by another member aren't sent on
+	res, body := get(t, http.MethodGet, url, map[string]string{"X-Region": "eu", store.RoutedHeader: "1"})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, blob, body)
+}
+
+func TestServer_RegionProxy(t *testing.T) {
+	blob := randBytes(t, 1000)
+	hash := reflector.BlobHash(blob)
+	euStore := store.NewMemStore()
+	require.NoError(t, euStore.Put(hash, blob))
+	eu := newTestServer(t, NewServer(euStore, 4))
+
+	ts := newTestServer(t, regionServer(store.NewMemStore(), strings.TrimPrefix(eu.URL, "http://"), false))
+	url := ts.URL + "/blob?hash=" + hash
+
+	res, body := get(t, http.MethodGet, url, map[string]string{"X-Region": "eu"})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, blob, body)
+
+	// the member of region us doesn't have the blob
+	res, _ = get(t, http.MethodGet, url, map[string]string{"X-Region": "us"})
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
@@ -5,6 +5,12 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/cluster"
+	"github.com/lbryio/reflector.go/internal/admission"
+	"github.com/lbryio/reflector.go/internal/capture"
+	"github.com/lbryio/reflector.go/internal/geo"
+	"github.com/lbryio/reflector.go/internal/ratelimit"
 	"github.com/lbryio/reflector.go/store"
 
 	"github.com/lbryio/lbry.go/v2/extras/stop"
@@ -15,20 +21,67 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// defaultMaxQueued is how many blob requests can wait to be handled, unless MaxQueued is changed
+const defaultMaxQueued = 20000
+
 // Server is an instance of a peer server that houses the listener and store.
 type Server struct {
+	// Router partitions blobs between cluster members. If set, requests for blobs of other members are proxied to
+	// them, or redirected if RedirectToOwner is set
+	Router          store.BlobRouter
+	RedirectToOwner bool
+	// MemberAuth checks that requests marked with store.RoutedHeader come from other members, and signs the requests
+	// sent to them. It must be set with Router
+	MemberAuth store.MemberAuth
+	// Regions finds the members of other regions that hold a blob. If it and Locate are set, requests from clients in
+	// another region than Region are proxied to the member of their region that holds the blob, or redirected if
+	// RedirectToRegion is set. Router must be set too
+	Regions          store.RegionRouter
+	Region           string
+	Locate           func(r *http.Request) string
+	RedirectToRegion bool
+	// ClusterHandler serves the endpoints cluster members use to share their caches, if set
+	ClusterHandler http.Handler
+	// Authorizer decides whether each blob and stream may be served. Everything is served if it's nil
+	Authorizer auth.Authorizer
+	// ConnBytesPerSec limits how fast each response is sent. 0 means no limit
+	ConnBytesPerSec int64
+	// Limiter limits how fast responses are sent over all connections together, if set. It can be shared with
+	// other servers
+	Limiter *ratelimit.Limiter
+	// MaxQueued is how many blob requests can wait to be handled. More are turned away with a 503
+	MaxQueued int
+	// QueueTarget is how long blob requests may wait to be handled before the server sheds load. 0 means no limit
+	QueueTarget time.Duration
+	// Admit, if set, is asked before each blob request is queued. Requests are turned away with a 503 while it returns
+	// false
+	Admit func() bool
+	// Inventory serves the list of blobs the server has, whole and a page at a time. Sync uses it to fetch only the
+	// blobs it's missing
+	Inventory bool
+	// GeoIP, if set, counts the blobs served and the bytes sent by country of the client
+	GeoIP *geo.Database
+	// Capture, if set, records the blobs served so they can be replayed
+	Capture *capture.Recorder
+
 	store              store.BlobStore
+	routed             *store.RoutedStore
+	local              store.BlobStore
 	grp                *stop.Group
 	concurrentRequests int
+	queue              *admission.Queue
 	missesCache        gcache.Cache
+	replicateCh        chan string
 }
 
 // NewServer returns an initialized Server pointer.
 func NewServer(store store.BlobStore, requestQueueSize int) *Server {
 	return &Server{
 		store:              store,
+		local:              store,
 		grp:                stop.New(),
 		concurrentRequests: requestQueueSize,
+		MaxQueued:          defaultMaxQueued,
 		missesCache:        gcache.New(2000).Expiration(5 * time.Minute).ARC().Build(),
 	}
 }
@@ -37,27 +90,19 @@ func NewServer(store store.BlobStore, requestQueueSize int) *Server {
 func (s *Server) Shutdown() {
 	log.Debug("shutting down HTTP server")
 	s.grp.StopAndWait()
+	if s.queue != nil {
+		s.queue.Shutdown()
+	}
 	log.Debug("HTTP server stopped")
 }
 
 // Start starts the server listener to handle connections.
 func (s *Server) Start(address string) error {
-	gin.SetMode(gin.ReleaseMode)
-	router := gin.New()
-	router.Use(gin.Logger())
-	// Install nice.Recovery, passing the handler to call after recovery
-	router.Use(nice.Recovery(s.recoveryHandler))
-	router.GET("/blob", s.getBlob)
-	router.GET("/", func(c *gin.Context) {
-		panic("woops")
-	})
-	router.HEAD("/blob", s.hasBlob)
 	srv := &http.Server{
 		Addr:    address,
-		Handler: router,
+		Handler: s.handler(),
 	}
 	go s.listenForShutdown(srv)
-	go InitWorkers(s, s.concurrentRequests)
 	// Initializing the server in a goroutine so that
 	// it won't block the graceful shutdown handling below
 	s.grp.Add(1)
@@ -71,6 +116,52 @@ func (s *Server) Start(address string) error {
 	return nil
 }
 
+// handler starts the routing to other cluster members and the request queue, and returns the handler of the server's
+// endpoints. Shutdown stops them
+func (s *Server) handler() http.Handler {
+	if s.Router != nil {
+		s.routed = store.NewRoutedStore(s.local, s.Router, s.MemberAuth)
+		s.store = s.routed
+		s.replicateCh = make(chan string, replicateQueueSize)
+		s.startReplicationWorkers()
+	}
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(gin.Logger())
+	// Install nice.Recovery, passing the handler to call after recovery
+	router.Use(nice.Recovery(s.recoveryHandler))
+	if s.ConnBytesPerSec > 0 || s.Limiter != nil {
+		router.Use(s.shape)
+	}
+	router.GET("/blob", s.authorize("hash"), s.getBlob)
+	router.GET("/", func(c *gin.Context) {
+		panic("woops")
+	})
+	router.HEAD("/blob", s.authorize("hash"), s.hasBlob)
+	router.POST(cluster.ReplicatePath, s.replicate)
+	if s.Inventory {
+		router.GET(store.InventoryPath, s.authorizeList, s.getInventory)
+		router.GET(store.BlobsPath, s.authorizeList, s.getBlobs)
+	}
+	if s.ClusterHandler != nil {
+		router.GET(cluster.SiblingsPath+"*any", gin.WrapH(s.ClusterHandler))
+	}
+	authorizeStream := s.authorize("sdhash")
+	router.GET("/stream/:sdhash", authorizeStream, s.getStream)
+	router.HEAD("/stream/:sdhash", authorizeStream, s.getStream)
+	router.GET("/stream/:sdhash/info", authorizeStream, s.getStreamInfo)
+	router.GET("/stream/:sdhash/hls.m3u8", authorizeStream, s.getHLSPlaylist)
+	router.GET("/stream/:sdhash/segment/:segment", authorizeStream, s.getHLSSegment)
+	s.queue = admission.New("http", admission.Opts{
+		Workers:   s.concurrentRequests,
+		MaxQueued: s.MaxQueued,
+		Target:    s.QueueTarget,
+		Admit:     s.Admit,
+	})
+	s.queue.Start()
+	return keepRawWriter(router)
+}
+
 func (s *Server) listenForShutdown(listener *http.Server) {
 	<-s.grp.Ch()
 	// The context is used to inform the server it has 5 seconds to finish
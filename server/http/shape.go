@@ -0,0 +1,35 @@
+package http
+
+import (
+	"github.com/lbryio/reflector.go/internal/ratelimit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// shapedWriter sends the response body through the rate limits
+type shapedWriter struct {
+	gin.ResponseWriter
+	out *ratelimit.Writer
+}
+
+func (w *shapedWriter) Write(p []byte) (int, error) {
+	return w.out.Write(p)
+}
+
+func (w *shapedWriter) WriteString(s string) (int, error) {
+	return w.out.Write([]byte(s))
+}
+
+// shape is a middleware that limits how fast the response is sent, to ConnBytesPerSec for the request and to the
+// shared Limiter over all requests
+func (s *Server) shape(c *gin.Context) {
+	var reqLimiter *ratelimit.Limiter
+	if s.ConnBytesPerSec > 0 {
+		reqLimiter = ratelimit.NewBurst(s.ConnBytesPerSec, s.ConnBytesPerSec, s.grp.Ch())
+	}
+	c.Writer = &shapedWriter{
+		ResponseWriter: c.Writer,
+		out:            ratelimit.NewWriter(c.Writer, s.Limiter, reqLimiter),
+	}
+	c.Next()
+}
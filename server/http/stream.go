@@ -0,0 +1,254 @@
+package http
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/shared"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/gin-gonic/gin"
+)
+
+// the lbry encoder fills every blob except the last with MaxBlobSize-1 bytes of data, which pads to exactly
+// MaxBlobSize. for any other blob we need to decrypt it to know how much data it holds.
+const fullBlobDataSize = stream.MaxBlobSize - 1
+
+// getStream reassembles the stream described by the sd blob and serves the original file. Range requests are
+// supported, and only the blobs that overlap the requested range are fetched.
+// The key in the sd blob is used to decrypt the stream, unless a hex key is passed in the key query parameter.
+func (s *Server) getStream(c *gin.Context) {
+	sdHash := c.Param("sdhash")
+
+	sd, err := s.getSDBlob(sdHash)
+	if err != nil {
+		s.streamError(c, err)
+		return
+	}
+
+	key := sd.Key
+	if k := c.Query("key"); k != "" {
+		key, err = hex.DecodeString(k)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid key")
+			return
+		}
+	}
+
+	f, err := newStreamFile(s.store, sd, key)
+	if err != nil {
+		s.streamError(c, err)
+		return
+	}
+
+	name := sd.SuggestedFileName
+	if name == "" {
+		name = sdHash
+	}
+	contentType, disposition := streamHeaders(name)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", disposition)
+	c.Header("X-Content-Type-Options", "nosniff")
+	// ServeContent takes care of Content-Length and ranges
+	http.ServeContent(c.Writer, c.Request, name, time.Time{}, f)
+}
+
+// streamHeaders returns the Content-Type and Content-Disposition of a stream with this file name. The uploader picks
+// the name, so only video, audio and images other than svg, which can't run scripts, are shown in the browser. The
+// rest, like html, is served as an opaque download
+func streamHeaders(name string) (string, string) {
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	disposition := "attachment"
+	if strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/") ||
+		(strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml") {
+		disposition = "inline"
+	} else {
+		contentType = "application/octet-stream"
+	}
+	header := mime.FormatMediaType(disposition, map[string]string{"filename": name})
+	if header == "" {
+		// the name can't be encoded
+		header = disposition
+	}
+	return contentType, header
+}
+
+// getStreamInfo returns the list of blobs in the stream, with their sizes and the total length
+func (s *Server) getStreamInfo(c *gin.Context) {
+	sd, err := s.getSDBlob(c.Param("sdhash"))
+	if err != nil {
+		s.streamError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, sd.Info())
+}
+
+func (s *Server) getSDBlob(sdHash string) (*shared.SDBlob, error) {
+	if len(sdHash) != stream.BlobHashHexLength {
+		return nil, errors.Err(errInvalidHash)
+	}
+	blob, _, err := s.store.Get(sdHash)
+	if err != nil {
+		return nil, err
+	}
+	return shared.ParseSDBlob(blob)
+}
+
+var errInvalidHash = errors.Base("invalid sd hash")
+
+func (s *Server) streamError(c *gin.Context, err error) {
+	if retryLater(c, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, store.ErrBlobNotFound):
+		c.AbortWithStatus(http.StatusNotFound)
+	case errors.Is(err, errInvalidHash), errors.Is(err, shared.ErrInvalidSDBlob):
+		c.String(http.StatusBadRequest, err.Error())
+	default:
+		_ = c.Error(err)
+		c.String(http.StatusInternalServerError, err.Error())
+	}
+}
+
+// streamFile is an io.ReadSeeker over the decrypted contents of a stream. Blobs are fetched from the store as they
+// are read, and the current one is kept around so sequential reads don't fetch it again.
+type streamFile struct {
+	store store.BlobStore
+	key   []byte
+	infos []stream.BlobInfo
+
+	offsets []int64 // offset of the first byte of each blob in the file
+	size    int64
+	pos     int64
+
+	current     int
+	currentData []byte
+}
+
+func newStreamFile(blobStore store.BlobStore, sd *shared.SDBlob, key []byte) (*streamFile, error) {
+	f := &streamFile{store: blobStore, key: key, infos: sd.ContentBlobs(), current: -1}
+
+	f.offsets = make([]int64, len(f.infos))
+	for i, info := range f.infos {
+		f.offsets[i] = f.size
+		if info.Length == stream.MaxBlobSize {
+			f.size += fullBlobDataSize
+			continue
+		}
+		data, err := f.blobData(i)
+		if err != nil {
+			return nil, err
+		}
+		f.size += int64(len(data))
+	}
+
+	return f, nil
+}
+
+// Read reads decrypted stream data
+func (f *streamFile) Read(p []byte) (int, error) {
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+
+	i := f.blobAt(f.pos)
+	data, err := f.blobData(i)
+	if err != nil {
+		return 0, err
+	}
+
+	n := copy(p, data[f.pos-f.offsets[i]:])
+	f.pos += int64(n)
+	metrics.MtrOutBytesHttp.Add(float64(n))
+	return n, nil
+}
+
+// Seek sets the offset for the next Read
+func (f *streamFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.Err("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.Err("negative position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// blobAt returns the index of the blob that holds the byte at pos
+func (f *streamFile) blobAt(pos int64) int {
+	i := len(f.offsets) - 1
+	for i > 0 && f.offsets[i] > pos {
+		i--
+	}
+	return i
+}
+
+// blobData fetches and decrypts the i-th blob of the stream
+func (f *streamFile) blobData(i int) ([]byte, error) {
+	if i == f.current {
+		return f.currentData, nil
+	}
+	data, err := fetchBlobData(f.store, f.infos[i], f.key)
+	if err != nil {
+		return nil, err
+	}
+	f.current = i
+	f.currentData = data
+	return data, nil
+}
+
+// segmentSize returns how many bytes of the file are in the i-th blob
+func (f *streamFile) segmentSize(i int) int64 {
+	if i == len(f.offsets)-1 {
+		return f.size - f.offsets[i]
+	}
+	return f.offsets[i+1] - f.offsets[i]
+}
+
+// fetchBlobData gets a blob of a stream from the store and decrypts it
+func fetchBlobData(blobStore store.BlobStore, info stream.BlobInfo, key []byte) ([]byte, error) {
+	hash := hex.EncodeToString(info.BlobHash)
+	short := shortHash(hash)
+	blob, _, err := blobStore.Get(hash)
+	if err != nil {
+		return nil, errors.Prefix(short, err)
+	}
+	if !bytes.Equal(blob.Hash(), info.BlobHash) {
+		return nil, errors.Err("blob %s does not match its hash", short)
+	}
+	data, err := shared.DecryptBlob(blob, key, info.IV)
+	if err != nil {
+		return nil, errors.Prefix(short, err)
+	}
+	if info.Length == stream.MaxBlobSize && len(data) != fullBlobDataSize {
+		return nil, errors.Err("blob %s holds %d bytes instead of %d", short, len(data), fullBlobDataSize)
+	}
+	return data, nil
+}
+
+// shortHash returns the first 8 characters of a hash for errors and logs, or all of it if it's shorter
+func shortHash(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
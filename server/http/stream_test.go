@@ -0,0 +1,126 @@
+package http
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/lbryio/reflector.go/reflector"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer serves the endpoints of s over httptest, and shuts both down when the test ends
+func newTestServer(t *testing.T, s *Server) *httptest.Server {
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(func() {
+		ts.Close()
+		s.Shutdown()
+	})
+	return ts
+}
+
+// randBytes returns n random bytes
+func randBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	return b
+}
+
+// putStream puts the blobs of a stream of data with the file name in st, and returns the stream
+func putStream(t *testing.T, st store.BlobStore, name string, data []byte) stream.Stream {
+	sd := &stream.SDBlob{Key: randBytes(t, 16), SuggestedFileName: name}
+	s, err := stream.NewEncoderFromSD(bytes.NewReader(data), sd).Stream()
+	require.NoError(t, err)
+	for _, b := range s {
+		require.NoError(t, st.Put(b.HashHex(), b))
+	}
+	return s
+}
+
+// get requests url with the headers, and returns the response with its body read
+func get(t *testing.T, method, url string, header map[string]string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, nil)
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, body
+}
+
+func TestServer_Stream(t *testing.T) {
+	st := store.NewMemStore()
+	data := randBytes(t, 2*stream.MaxBlobSize+100)
+	s := putStream(t, st, "picture.png", data)
+	ts := newTestServer(t, NewServer(st, 4))
+	url := ts.URL + "/stream/" + s[0].HashHex()
+
+	res, body := get(t, http.MethodGet, url, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.True(t, bytes.Equal(data, body), "the stream doesn't match its data")
+	assert.Equal(t, "image/png", res.Header.Get("Content-Type"))
+	assert.Equal(t, `inline; filename=picture.png`, res.Header.Get("Content-Disposition"))
+
+	res, body = get(t, http.MethodHead, url, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, strconv.Itoa(len(data)), res.Header.Get("Content-Length"))
+	assert.Empty(t, body)
+
+	// a range over the end of the first blob and the start of the second
+	from, to := fullBlobDataSize-10, fullBlobDataSize+9
+	res, body = get(t, http.MethodGet, url, map[string]string{"Range": "bytes=" + strconv.Itoa(from) + "-" + strconv.Itoa(to)})
+	require.Equal(t, http.StatusPartialContent, res.StatusCode)
+	assert.Equal(t, data[from:to+1], body)
+	assert.Equal(t, "bytes "+strconv.Itoa(from)+"-"+strconv.Itoa(to)+"/"+strconv.Itoa(len(data)), res.Header.Get("Content-Range"))
+
+	res, _ = get(t, http.MethodGet, url, map[string]string{"Range": "bytes=" + strconv.Itoa(len(data)) + "-"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, res.StatusCode)
+
+	res, _ = get(t, http.MethodGet, ts.URL+"/stream/"+reflector.BlobHash([]byte("missing")), nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, _ = get(t, http.MethodGet, ts.URL+"/stream/abc", nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestStreamHeaders(t *testing.T) {
+	for name, want := range map[string][2]string{
+		"picture.png": {"image/png", "inline; filename=picture.png"},
+		"page.html":   {"application/octet-stream", "attachment; filename=page.html"},
+		"image.svg":   {"application/octet-stream", "attachment; filename=image.svg"},
+		"my file.png": {"image/png", `inline; filename="my file.png"`},
+	} {
+		contentType, disposition := streamHeaders(name)
+		assert.Equal(t, want[0], contentType, name)
+		assert.Equal(t, want[1], disposition, name)
+	}
+}
+
+func TestFetchBlobData_Invalid(t *testing.T) {
+	st := store.NewMemStore()
+	key, iv := randBytes(t, 16), randBytes(t, 16)
+	misaligned := stream.Blob(randBytes(t, 17))
+	require.NoError(t, st.Put(misaligned.HashHex(), misaligned))
+
+	// none of these may panic
+	_, err := fetchBlobData(st, stream.BlobInfo{BlobHash: misaligned.Hash(), IV: iv, Length: 17}, key)
+	assert.Error(t, err)
+	_, err = fetchBlobData(st, stream.BlobInfo{BlobHash: misaligned.Hash(), IV: iv[:4], Length: 17}, key)
+	assert.Error(t, err)
+	_, err = fetchBlobData(st, stream.BlobInfo{BlobHash: []byte{1, 2}, IV: iv, Length: 17}, key)
+	assert.Error(t, err)
+}
@@ -14,7 +14,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/internal/capture"
 	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/shared"
 	"github.com/lbryio/reflector.go/store"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
@@ -28,6 +31,11 @@ import (
 
 // Server is an instance of a peer server that houses the listener and store.
 type Server struct {
+	// Authorizer decides whether each blob may be served. Everything is served if it's nil
+	Authorizer auth.Authorizer
+	// Capture, if set, records the blobs served so they can be replayed
+	Capture *capture.Recorder
+
 	store              store.BlobStore
 	grp                *stop.Group
 	concurrentRequests int
@@ -78,12 +86,18 @@ func (s *Server) Start(address string) error {
 	}
 	r := mux.NewRouter()
 	r.HandleFunc("/get/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(w, r) {
+			return
+		}
 		waiter := &sync.WaitGroup{}
 		waiter.Add(1)
 		enqueue(&blobRequest{request: r, reply: w, finished: waiter})
 		waiter.Wait()
 	})
 	r.HandleFunc("/has/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(w, r) {
+			return
+		}
 		vars := mux.Vars(r)
 		requestedBlob := vars["hash"]
 		blobExists, err := s.store.Has(requestedBlob)
@@ -130,6 +144,22 @@ func (s *Server) Start(address string) error {
 	return nil
 }
 
+// authorized checks the request with the Authorizer, and writes the error response if it's denied
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	hash := mux.Vars(r)["hash"]
+	err := auth.Check(s.Authorizer, auth.FromHTTP(r, auth.ActionDownload, hash, auth.ProtocolHTTP3))
+	if errors.Is(err, auth.ErrForbidden) {
+		log.Debugf("http3 request for %s denied: %s", hash, err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	} else if err != nil {
+		s.logError(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
 // Setup a bare-bones TLS config for the server
 func generateTLSConfig() *tls.Config {
 	key, err := rsa.GenerateKey(rand.Reader, 1024)
@@ -182,7 +212,11 @@ func (s *Server) HandleGetBlob(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	reqID := shared.RequestIDOrNew(r.Header.Get(shared.RequestIDHeader))
+	w.Header().Set(shared.RequestIDHeader, reqID)
+
 	blob, trace, err := s.store.Get(requestedBlob)
+	trace.Served(reqID)
 
 	if wantsTrace {
 		serialized, err := trace.Serialize()
@@ -191,7 +225,7 @@ func (s *Server) HandleGetBlob(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		w.Header().Add("Via", serialized)
-		log.Debug(trace.String())
+		log.Debugf("request %s: %s", reqID, trace.String())
 	}
 	if err != nil {
 		if errors.Is(err, store.ErrBlobNotFound) {
@@ -211,4 +245,7 @@ func (s *Server) HandleGetBlob(w http.ResponseWriter, r *http.Request) {
 	metrics.MtrOutBytesUdp.Add(float64(len(blob)))
 	metrics.BlobDownloadCount.Inc()
 	metrics.Http3DownloadCount.Inc()
+	if s.Capture != nil {
+		s.Capture.Record(auth.ProtocolHTTP3, r.RemoteAddr, requestedBlob, len(blob))
+	}
 }
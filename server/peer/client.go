@@ -2,10 +2,14 @@ package peer
 
 import (
 	"bufio"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"io"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lbryio/reflector.go/internal/metrics"
@@ -20,10 +24,31 @@ import (
 
 // Client is an instance of a client connected to a server.
 type Client struct {
-	Timeout   time.Duration
+	Timeout time.Duration
+	// UseV2 makes Connect negotiate peer protocol v2. If the server only speaks v1, the client falls back to v1.
+	// A client connected with v2 can be used from several goroutines at once and pipelines their requests.
+	UseV2 bool
+	// AuthToken is sent to servers that authorize downloads
+	AuthToken string
+
 	conn      net.Conn
 	buf       *bufio.Reader
 	connected bool
+	version   int
+	v2        *v2Conn
+}
+
+// v2Conn tracks the requests waiting for a response on a v2 connection
+type v2Conn struct {
+	compression string
+	nextID      uint32
+	writeMu     sync.Mutex
+	// maxAvailabilityHashes is how many hashes the server takes per availability request
+	maxAvailabilityHashes int
+
+	mu      sync.Mutex
+	pending map[uint32]chan v2Response
+	err     error
 }
 
 // Connect connects to a specific clients and errors if it cannot be contacted.
@@ -38,6 +63,14 @@ func (c *Client) Connect(address string) error {
 	}
 	c.connected = true
 	c.buf = bufio.NewReader(c.conn)
+	c.version = ProtocolV1
+	if c.UseV2 {
+		err = c.handshake()
+		if err != nil {
+			_ = c.Close()
+			return err
+		}
+	}
 	return nil
 }
 
@@ -47,6 +80,127 @@ func (c *Client) Close() error {
 	return c.conn.Close()
 }
 
+// ProtocolVersion returns the protocol version negotiated with the server
+func (c *Client) ProtocolVersion() int {
+	return c.version
+}
+
+func (c *Client) handshake() error {
+	req, err := json.Marshal(handshakeRequest{ProtocolVersion: ProtocolV2, Compression: supportedCompression, AuthToken: c.AuthToken})
+	if err != nil {
+		return errors.Err(err)
+	}
+	err = c.write(req)
+	if err != nil {
+		return err
+	}
+
+	// a v1 server responds to the handshake like to any other request, so protocol_version will be missing
+	var resp handshakeResponse
+	err = c.read(&resp)
+	if err != nil {
+		return err
+	}
+	if resp.ProtocolVersion < ProtocolV2 {
+		log.Debugf("%s only speaks peer protocol v1", c.conn.RemoteAddr())
+		return nil
+	}
+
+	// responses are read in the background from now on, and each request has its own timeout
+	err = c.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	c.version = ProtocolV2
+	c.v2 = &v2Conn{
+		compression:           resp.Compression,
+		maxAvailabilityHashes: maxAvailabilityHashes,
+		pending:               make(map[uint32]chan v2Response),
+	}
+	if resp.MaxAvailabilityHashes > 0 && resp.MaxAvailabilityHashes < maxAvailabilityHashes {
+		c.v2.maxAvailabilityHashes = resp.MaxAvailabilityHashes
+	}
+	go c.readV2Responses()
+	return nil
+}
+
+// readV2Responses hands every response to the request that is waiting for it, until the connection is closed
+func (c *Client) readV2Responses() {
+	for {
+		frame, err := readFrame(c.buf, maxV2ResponseSize)
+		if err == nil && len(frame) < responseHeaderLength {
+			err = errors.Err("v2 response frame too short")
+		}
+		if err != nil {
+			c.v2.mu.Lock()
+			c.v2.err = errors.Prefix("connection closed", err)
+			for id, ch := range c.v2.pending {
+				close(ch)
+				delete(c.v2.pending, id)
+			}
+			c.v2.mu.Unlock()
+			return
+		}
+
+		id := binary.BigEndian.Uint32(frame[0:4])
+		res := v2Response{
+			status:  Status(frame[4]),
+			flags:   frame[5],
+			payload: frame[responseHeaderLength:],
+		}
+
+		c.v2.mu.Lock()
+		ch, ok := c.v2.pending[id]
+		delete(c.v2.pending, id)
+		c.v2.mu.Unlock()
+		if ok {
+			ch <- res
+		}
+	}
+}
+
+// roundTrip sends a v2 request and waits for its response
+func (c *Client) roundTrip(reqType uint8, payload []byte) (*v2Response, error) {
+	id := atomic.AddUint32(&c.v2.nextID, 1)
+	ch := make(chan v2Response, 1)
+
+	c.v2.mu.Lock()
+	if c.v2.err != nil {
+		c.v2.mu.Unlock()
+		return nil, c.v2.err
+	}
+	c.v2.pending[id] = ch
+	c.v2.mu.Unlock()
+
+	defer func() {
+		c.v2.mu.Lock()
+		delete(c.v2.pending, id)
+		c.v2.mu.Unlock()
+	}()
+
+	c.v2.writeMu.Lock()
+	err := c.write(requestFrame(id, reqType, payload))
+	c.v2.writeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	t := time.NewTimer(c.Timeout)
+	defer t.Stop()
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			c.v2.mu.Lock()
+			defer c.v2.mu.Unlock()
+			return nil, c.v2.err
+		}
+		return &res, nil
+	case <-t.C:
+		return nil, errors.Err("timed out waiting for response")
+	}
+}
+
 // GetStream gets a stream
 func (c *Client) GetStream(sdHash string, blobCache store.BlobStore) (stream.Stream, error) {
 	if !c.connected {
@@ -86,6 +240,17 @@ func (c *Client) HasBlob(hash string) (bool, error) {
 		return false, errors.Err("not connected")
 	}
 
+	if c.version == ProtocolV2 {
+		res, err := c.roundTrip(requestTypeHas, []byte(hash))
+		if err != nil {
+			return false, err
+		}
+		if res.status != StatusOK {
+			return false, errors.Err("%s: %s", res.status, string(res.payload))
+		}
+		return len(res.payload) == 1 && res.payload[0] == 1, nil
+	}
+
 	sendRequest, err := json.Marshal(availabilityRequest{
 		RequestedBlobs: []string{hash},
 	})
@@ -113,6 +278,79 @@ func (c *Client) HasBlob(hash string) (bool, error) {
 	return false, nil
 }
 
+// HasBlobs checks which of the blobs are available. The result has one entry per hash, in the same order.
+// With protocol v2 this is a single request no matter how many hashes there are.
+func (c *Client) HasBlobs(hashes []string) ([]bool, error) {
+	if !c.connected {
+		return nil, errors.Err("not connected")
+	}
+
+	available := make([]bool, len(hashes))
+
+	if c.version == ProtocolV2 {
+		// stay under the server's limit of hashes per request
+		batchSize := c.v2.maxAvailabilityHashes
+		for start := 0; start < len(hashes); start += batchSize {
+			end := start + batchSize
+			if end > len(hashes) {
+				end = len(hashes)
+			}
+
+			payload := make([]byte, 0, (end-start)*stream.BlobHashSize)
+			for _, h := range hashes[start:end] {
+				raw, err := hex.DecodeString(h)
+				if err != nil || len(raw) != stream.BlobHashSize {
+					return nil, errors.Err("invalid blob hash %s", h)
+				}
+				payload = append(payload, raw...)
+			}
+
+			res, err := c.roundTrip(requestTypeAvailability, payload)
+			if err != nil {
+				return nil, err
+			}
+			if res.status != StatusOK {
+				return nil, errors.Err("%s: %s", res.status, string(res.payload))
+			}
+			if len(res.payload) != (end-start+7)/8 {
+				return nil, errors.Err("availability bitmap has the wrong length")
+			}
+			for i := start; i < end; i++ {
+				j := i - start
+				available[i] = res.payload[j/8]&(0x80>>uint(j%8)) != 0
+			}
+		}
+		return available, nil
+	}
+
+	sendRequest, err := json.Marshal(availabilityRequest{
+		RequestedBlobs: hashes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.write(sendRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp availabilityResponse
+	err = c.read(&resp)
+	if err != nil {
+		return nil, err
+	}
+
+	has := make(map[string]bool, len(resp.AvailableBlobs))
+	for _, h := range resp.AvailableBlobs {
+		has[h] = true
+	}
+	for i, h := range hashes {
+		available[i] = has[h]
+	}
+	return available, nil
+}
+
 // GetBlob gets a blob
 func (c *Client) GetBlob(hash string) (stream.Blob, shared.BlobTrace, error) {
 	start := time.Now()
@@ -120,8 +358,13 @@ func (c *Client) GetBlob(hash string) (stream.Blob, shared.BlobTrace, error) {
 		return nil, shared.NewBlobTrace(time.Since(start), "tcp"), errors.Err("not connected")
 	}
 
+	if c.version == ProtocolV2 {
+		return c.getBlobV2(hash, start)
+	}
+
 	sendRequest, err := json.Marshal(blobRequest{
 		RequestedBlob: hash,
+		AuthToken:     c.AuthToken,
 	})
 	if err != nil {
 		return nil, shared.NewBlobTrace(time.Since(start), "tcp"), err
@@ -143,6 +386,10 @@ func (c *Client) GetBlob(hash string) (stream.Blob, shared.BlobTrace, error) {
 		trace = *resp.RequestTrace
 	}
 	if resp.IncomingBlob.Error != "" {
+		// v1 only sends the text of the error, so a missing blob is recognized by it
+		if strings.Contains(resp.IncomingBlob.Error, store.ErrBlobNotFound.Error()) {
+			return nil, trace, errors.Prefix(hash[:8], store.ErrBlobNotFound)
+		}
 		return nil, trace, errors.Prefix(hash[:8], resp.IncomingBlob.Error)
 	}
 	if resp.IncomingBlob.BlobHash != hash {
@@ -162,6 +409,20 @@ func (c *Client) GetBlob(hash string) (stream.Blob, shared.BlobTrace, error) {
 	return blob, trace.Stack(time.Since(start), "tcp"), nil
 }
 
+func (c *Client) getBlobV2(hash string, start time.Time) (stream.Blob, shared.BlobTrace, error) {
+	res, err := c.roundTrip(requestTypeBlob, []byte(hash))
+	if err != nil {
+		return nil, shared.NewBlobTrace(time.Since(start), "tcp"), err
+	}
+	blob, err := blobFromResponse(hash, res)
+	if err != nil {
+		return nil, shared.NewBlobTrace(time.Since(start), "tcp"), err
+	}
+	log.Debugf("received blob %s from %s", hash[:8], c.conn.RemoteAddr())
+	metrics.MtrInBytesTcp.Add(float64(len(res.payload)))
+	return blob, shared.NewBlobTrace(time.Since(start), "tcp"), nil
+}
+
 func (c *Client) read(v interface{}) error {
 	err := c.conn.SetReadDeadline(time.Now().Add(c.Timeout))
 	if err != nil {
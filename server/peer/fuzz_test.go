@@ -0,0 +1,60 @@
+//go:build go1.18
+// +build go1.18
+
+package peer
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/lbryio/reflector.go/internal/fuzzing"
+	"github.com/lbryio/reflector.go/reflector"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/stream"
+)
+
+// FuzzPeerConn sends three messages to the server, which can be v1 json requests, or a v2 handshake and frames
+func FuzzPeerConn(f *testing.F) {
+	f.Cleanup(fuzzing.QuietLogs())
+
+	blob := stream.Blob("fuzz")
+	hash := blob.HashHex()
+	rawHash, _ := hex.DecodeString(hash)
+	f.Add([]byte(`{"lbrycrd_address":true,"requested_blobs":["`+hash+`"]}`),
+		[]byte(`{"requested_blob":"`+hash+`","blob_data_payment_rate":0.0}`), []byte(`{"requested_blob":"`))
+	f.Add([]byte(`{"protocol_version":2,"compression":["zstd"]}`), requestFrame(1, requestTypeBlob, []byte(hash)),
+		requestFrame(2, requestTypeAvailability, rawHash))
+	f.Add([]byte(`{"protocol_version":2}`), requestFrame(1, requestTypeHas, []byte(hash)),
+		[]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte(`{"protocol_version":2}`), requestFrame(1, 9, nil), []byte{0, 0, 0, 1, 0})
+
+	f.Fuzz(func(t *testing.T, first, second, third []byte) {
+		blobs := store.NewMemStore()
+		err := blobs.Put(hash, blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewServer(blobs)
+		s.handleConnection(fuzzing.NewConn(first, second, third))
+		s.Shutdown()
+	})
+}
+
+// FuzzBlobFromResponse checks that a v2 client never takes a blob from a response unless it's the one it asked for,
+// however the response is compressed
+func FuzzBlobFromResponse(f *testing.F) {
+	blob := stream.Blob("fuzz")
+	hash := blob.HashHex()
+	f.Add(uint8(StatusOK), uint8(0), []byte(blob))
+	f.Add(uint8(StatusOK), uint8(flagCompressed), zstdEncoder.EncodeAll(blob, nil))
+	f.Add(uint8(StatusUnavailable), uint8(0), []byte("30"))
+	f.Add(uint8(StatusNotFound), uint8(0), []byte(nil))
+
+	f.Fuzz(func(t *testing.T, status, flags uint8, payload []byte) {
+		got, err := blobFromResponse(hash, &v2Response{status: Status(status), flags: flags, payload: payload})
+		if err == nil && reflector.BlobHash(got) != hash {
+			t.Errorf("got a blob with hash %s instead of %s", reflector.BlobHash(got), hash)
+		}
+	})
+}
@@ -0,0 +1,224 @@
+package peer
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+const (
+	// DefaultMaxConnsPerHost is how many connections a pool opens to each host, unless MaxConnsPerHost is set
+	DefaultMaxConnsPerHost = 8
+	// DefaultIdleTimeout is how long a pool keeps an unused connection open, unless IdleTimeout is set. It's below the
+	// minute after which the server hangs up on idle clients
+	DefaultIdleTimeout = 30 * time.Second
+
+	// healthCheckWait is how long a health check waits to see whether the server hung up an idle connection
+	healthCheckWait = time.Millisecond
+)
+
+// Pool keeps connections to peers open after they're used, so fetching many blobs from the same peer doesn't pay for a
+// tcp connection and a handshake each time. Connections are checked before they're handed out again, and the ones
+// that were idle for too long are closed.
+type Pool struct {
+	// MaxConnsPerHost is how many connections to a host can be in use at once. Get waits for one to be released when
+	// they're all in use
+	MaxConnsPerHost int
+	// IdleTimeout is how long an unused connection is kept open
+	IdleTimeout time.Duration
+	// Timeout, UseV2 and AuthToken are set on the clients of new connections
+	Timeout   time.Duration
+	UseV2     bool
+	AuthToken string
+
+	mu     sync.Mutex
+	hosts  map[string]*hostConns
+	closed bool
+	grp    *stop.Group
+}
+
+// hostConns are the connections to one host
+type hostConns struct {
+	// slots has a token for each connection in use, so there are never more than MaxConnsPerHost. Connections are
+	// only opened when there's no idle one, so that limits the idle ones too
+	slots chan struct{}
+	// idle connections, the most recently used last
+	idle []idleConn
+}
+
+type idleConn struct {
+	c     *Client
+	since time.Time
+}
+
+// NewPool returns a pool with the default limits. Start it to have idle connections closed
+func NewPool() *Pool {
+	return &Pool{
+		MaxConnsPerHost: DefaultMaxConnsPerHost,
+		IdleTimeout:     DefaultIdleTimeout,
+		hosts:           make(map[string]*hostConns),
+		grp:             stop.New(),
+	}
+}
+
+// Start starts closing the connections that are idle for longer than IdleTimeout
+func (p *Pool) Start() {
+	if p.IdleTimeout <= 0 {
+		p.IdleTimeout = DefaultIdleTimeout
+	}
+	p.grp.Add(1)
+	go func() {
+		defer p.grp.Done()
+		t := time.NewTicker(p.IdleTimeout / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-p.grp.Ch():
+				return
+			case <-t.C:
+				p.closeIdle(time.Now().Add(-p.IdleTimeout))
+			}
+		}
+	}()
+}
+
+// Shutdown closes the idle connections. Connections that are in use are closed when they're released
+func (p *Pool) Shutdown() {
+	p.grp.StopAndWait()
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.closeIdle(time.Now())
+}
+
+// Get returns a connection to addr, an idle one if there's a healthy one and a new one otherwise. It waits for a
+// connection to be released if MaxConnsPerHost are in use. It must be given back with Put
+func (p *Pool) Get(addr string) (*Client, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errors.Err("connection pool is shut down")
+	}
+	h, ok := p.hosts[addr]
+	if !ok {
+		max := p.MaxConnsPerHost
+		if max < 1 {
+			max = DefaultMaxConnsPerHost
+		}
+		h = &hostConns{slots: make(chan struct{}, max)}
+		p.hosts[addr] = h
+	}
+	p.mu.Unlock()
+
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case h.slots <- struct{}{}:
+	case <-t.C:
+		return nil, errors.Err("timed out waiting for a connection to %s", addr)
+	}
+
+	for {
+		c := p.popIdle(h)
+		if c == nil {
+			break
+		}
+		if c.healthy() {
+			return c, nil
+		}
+		_ = c.Close()
+	}
+
+	c := &Client{Timeout: p.Timeout, UseV2: p.UseV2, AuthToken: p.AuthToken}
+	err := c.Connect(addr)
+	if err != nil {
+		<-h.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+// Put gives a connection back to the pool. reuse says whether it can be used again, which it can't after most errors
+// because a response may have been left half read
+func (p *Pool) Put(addr string, c *Client, reuse bool) {
+	p.mu.Lock()
+	h := p.hosts[addr]
+	if reuse && !p.closed && h != nil {
+		h.idle = append(h.idle, idleConn{c: c, since: time.Now()})
+		c = nil
+	}
+	p.mu.Unlock()
+	if c != nil {
+		_ = c.Close()
+	}
+	if h != nil {
+		<-h.slots
+	}
+}
+
+// popIdle takes the most recently used idle connection to the host
+func (p *Pool) popIdle(h *hostConns) *Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(h.idle) == 0 {
+		return nil
+	}
+	c := h.idle[len(h.idle)-1].c
+	h.idle = h.idle[:len(h.idle)-1]
+	return c
+}
+
+// closeIdle closes the idle connections that were last used before the cutoff
+func (p *Pool) closeIdle(cutoff time.Time) {
+	var expired []*Client
+	p.mu.Lock()
+	for _, h := range p.hosts {
+		n := 0
+		for _, ic := range h.idle {
+			if ic.since.Before(cutoff) {
+				expired = append(expired, ic.c)
+			} else {
+				h.idle[n] = ic
+				n++
+			}
+		}
+		h.idle = h.idle[:n]
+	}
+	p.mu.Unlock()
+	for _, c := range expired {
+		_ = c.Close()
+	}
+}
+
+// healthy returns whether an idle connection can still be used. A v2 connection reads in the background and knows when
+// the server hung up. A v1 connection is checked by reading from it for a moment: an idle server sends nothing, so
+// anything but a timeout means the connection is closed or out of step
+func (c *Client) healthy() bool {
+	if !c.connected {
+		return false
+	}
+	if c.version == ProtocolV2 {
+		c.v2.mu.Lock()
+		defer c.v2.mu.Unlock()
+		return c.v2.err == nil
+	}
+	if c.buf.Buffered() > 0 {
+		return false
+	}
+	err := c.conn.SetReadDeadline(time.Now().Add(healthCheckWait))
+	if err != nil {
+		return false
+	}
+	_, err = c.buf.Peek(1)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package peer
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/reflector"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/phayes/freeport"
+)
+
+func TestStore_ReusesConnections(t *testing.T) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+
+	st := store.NewMemStore()
+	blob := []byte("pooled blob")
+	hash := reflector.BlobHash(blob)
+	err = st.Put(hash, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(st)
+	err = s.Start(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	for _, useV2 := range []bool{false, true} {
+		p := NewStore(StoreOpts{Address: addr, Timeout: time.Second, UseV2: useV2})
+
+		var first *Client
+		for i := 0; i < 3; i++ {
+			got, _, err := p.Get(hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, blob) {
+				t.Error("received blob does not match")
+			}
+			idle := p.pool.hosts[addr].idle
+			if len(idle) != 1 {
+				t.Fatalf("v2=%t: expected 1 idle connection, got %d", useV2, len(idle))
+			}
+			if first == nil {
+				first = idle[0].c
+			} else if idle[0].c != first {
+				t.Errorf("v2=%t: expected the connection to be reused", useV2)
+			}
+		}
+
+		// a connection the server hung up on is replaced
+		_ = first.conn.Close()
+		if useV2 {
+			time.Sleep(50 * time.Millisecond) // for the reader to notice
+		}
+		_, _, err = p.Get(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.pool.hosts[addr].idle[0].c == first {
+			t.Errorf("v2=%t: expected a new connection", useV2)
+		}
+
+		// a missing blob doesn't cost the connection
+		_, _, err = p.Get(reflector.BlobHash([]byte("missing")))
+		if err != store.ErrBlobNotFound {
+			t.Errorf("v2=%t: expected blob not found, got %v", useV2, err)
+		}
+		if len(p.pool.hosts[addr].idle) != 1 {
+			t.Errorf("v2=%t: expected the connection to be kept", useV2)
+		}
+
+		p.Shutdown()
+		if len(p.pool.hosts[addr].idle) != 0 {
+			t.Errorf("v2=%t: expected idle connections to be closed on shutdown", useV2)
+		}
+	}
+}
+
+func TestPool_MaxConnsPerHost(t *testing.T) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+
+	s := NewServer(store.NewMemStore())
+	err = s.Start(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	p := NewPool()
+	p.MaxConnsPerHost = 1
+	p.Timeout = 100 * time.Millisecond
+	defer p.Shutdown()
+
+	c, err := p.Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Get(addr)
+	if err == nil {
+		t.Fatal("expected to time out waiting for a connection")
+	}
+
+	p.Put(addr, c, true)
+	c2, err := p.Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2 != c {
+		t.Error("expected the released connection")
+	}
+	p.Put(addr, c2, true)
+}
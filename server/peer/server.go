@@ -2,6 +2,7 @@ package peer
 
 import (
 	"bufio"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	ee "errors"
@@ -10,7 +11,12 @@ import (
 	"strings"
 	"time"
 
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/internal/admission"
+	"github.com/lbryio/reflector.go/internal/capture"
+	"github.com/lbryio/reflector.go/internal/geo"
 	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/internal/ratelimit"
 	"github.com/lbryio/reflector.go/reflector"
 	"github.com/lbryio/reflector.go/shared"
 	"github.com/lbryio/reflector.go/store"
@@ -31,7 +37,31 @@ const (
 
 // Server is an instance of a peer server that houses the listener and store.
 type Server struct {
+	// Authorizer decides whether each blob may be served. Everything is served if it's nil
+	Authorizer auth.Authorizer
+	// ConnBytesPerSec limits how fast responses are sent on each connection. 0 means no limit
+	ConnBytesPerSec int64
+	// Limiter limits how fast responses are sent over all connections together, if set. It can be shared with
+	// other servers
+	Limiter *ratelimit.Limiter
+	// Workers is how many blobs are fetched from the store at once. Blob requests go straight to the store if it's 0
+	Workers int
+	// MaxQueued is how many blob requests can wait for a worker. More are turned away with a retry later error
+	MaxQueued int
+	// QueueTarget is how long blob requests may wait for a worker before the server sheds load. 0 means no limit
+	QueueTarget time.Duration
+	// Admit, if set, is asked before each blob request is queued. Requests are turned away while it returns false
+	Admit func() bool
+	// GeoIP, if set, counts the blobs served and the bytes sent by country of the client
+	GeoIP *geo.Database
+	// Capture, if set, records the blobs served so they can be replayed
+	Capture *capture.Recorder
+	// MaxAvailabilityHashes is how many hashes a v2 availability request may ask about, up to 256. Each one is
+	// authorized, so it should be lower if the Authorizer is slow. 256 if it's 0
+	MaxAvailabilityHashes int
+
 	store  store.BlobStore
+	queue  *admission.Queue
 	closed bool
 
 	grp *stop.Group
@@ -49,6 +79,9 @@ func NewServer(store store.BlobStore) *Server {
 func (s *Server) Shutdown() {
 	log.Debug("shutting down peer server")
 	s.grp.StopAndWait()
+	if s.queue != nil {
+		s.queue.Shutdown()
+	}
 	log.Debug("peer server stopped")
 }
 
@@ -60,6 +93,16 @@ func (s *Server) Start(address string) error {
 		return err
 	}
 
+	if s.Workers > 0 {
+		s.queue = admission.New("peer", admission.Opts{
+			Workers:   s.Workers,
+			MaxQueued: s.MaxQueued,
+			Target:    s.QueueTarget,
+			Admit:     s.Admit,
+		})
+		s.queue.Start()
+	}
+
 	go s.listenForShutdown(l)
 	s.grp.Add(1)
 	go func() {
@@ -106,8 +149,10 @@ func (s *Server) handleConnection(conn net.Conn) {
 		}
 	}()
 
-	timeoutDuration := 1 * time.Minute
 	buf := bufio.NewReader(conn)
+	first := true
+	client := auth.Request{RemoteAddr: conn.RemoteAddr().String(), Protocol: auth.ProtocolPeer}
+	out := s.responseWriter(conn)
 
 	for {
 		var request []byte
@@ -131,7 +176,21 @@ func (s *Server) handleConnection(conn net.Conn) {
 			log.Error(errors.FullTrace(err))
 		}
 
-		response, err = s.handleCompositeRequest(request)
+		if first {
+			first = false
+			if h := parseHandshake(request); h != nil {
+				compression, err := s.handleHandshake(conn, h)
+				if err != nil {
+					s.logError(err)
+					return
+				}
+				client.Token = h.AuthToken
+				s.serveV2(conn, out, buf, compression, client)
+				return
+			}
+		}
+
+		response, err = s.handleCompositeRequest(client, request)
 		if err != nil {
 			log.Error(errors.FullTrace(err))
 			return
@@ -142,7 +201,7 @@ func (s *Server) handleConnection(conn net.Conn) {
 			log.Error(errors.FullTrace(err))
 		}
 
-		n, err := conn.Write(response)
+		n, err := out.Write(response)
 		if err != nil {
 			if !strings.Contains(err.Error(), "connection reset by peer") { // means the other side closed the connection using TCP reset
 				s.logError(err)
@@ -221,7 +280,7 @@ func (s *Server) handleAvailabilityRequest(data []byte) ([]byte, error) {
 //	return append(response, blob...), nil
 //}
 
-func (s *Server) handleCompositeRequest(data []byte) ([]byte, error) {
+func (s *Server) handleCompositeRequest(client auth.Request, data []byte) ([]byte, error) {
 	var request compositeRequest
 	err := json.Unmarshal(data, &request)
 	if err != nil {
@@ -262,11 +321,15 @@ func (s *Server) handleCompositeRequest(data []byte) ([]byte, error) {
 			return nil, errors.Err("Invalid blob hash length")
 		}
 
-		log.Debugln("Sending blob " + request.RequestedBlob[:8])
-
-		blob, trace, err = s.store.Get(request.RequestedBlob)
-		log.Debug(trace.String())
-		if errors.Is(err, store.ErrBlobNotFound) {
+		client.Token = request.AuthToken
+		err = s.authorize(s.Authorizer, client, request.RequestedBlob)
+		if err == nil {
+			log.Debugln("Sending blob " + request.RequestedBlob[:8])
+			blob, trace, err = s.getBlob(request.RequestedBlob)
+			log.Debug(trace.String())
+		}
+		if errors.Is(err, store.ErrBlobNotFound) || errors.Is(err, auth.ErrForbidden) ||
+			errors.Is(err, admission.ErrOverloaded) || errors.Is(err, store.ErrBlobUnavailable) {
 			response.IncomingBlob = incomingBlob{
 				Error: err.Error(),
 			}
@@ -280,6 +343,12 @@ func (s *Server) handleCompositeRequest(data []byte) ([]byte, error) {
 			metrics.MtrOutBytesTcp.Add(float64(len(blob)))
 			metrics.BlobDownloadCount.Inc()
 			metrics.PeerDownloadCount.Inc()
+			if s.GeoIP != nil {
+				s.GeoIP.Count(auth.ProtocolPeer, client.RemoteAddr, len(blob))
+			}
+			if s.Capture != nil {
+				s.Capture.Record(auth.ProtocolPeer, client.RemoteAddr, request.RequestedBlob, len(blob))
+			}
 		}
 	}
 
@@ -291,6 +360,64 @@ func (s *Server) handleCompositeRequest(data []byte) ([]byte, error) {
 	return append(respData, blob...), nil
 }
 
+// getBlob gets the blob from the store, waiting for a worker if there is a queue
+func (s *Server) getBlob(hash string) (stream.Blob, shared.BlobTrace, error) {
+	var blob stream.Blob
+	var trace shared.BlobTrace
+	var err error
+	if s.queue == nil {
+		blob, trace, err = s.store.Get(hash)
+	} else {
+		queueErr := s.queue.Do(context.Background(), func() {
+			blob, trace, err = s.store.Get(hash)
+		})
+		if queueErr != nil {
+			return nil, trace, queueErr
+		}
+	}
+	// the peer protocol has no way to pass a request id, so every request gets a new one
+	trace.Served(shared.NewRequestID())
+	return blob, trace, err
+}
+
+// responseWriter returns the writer that responses on conn are sent through, shaped to the rate limits if there are
+// any
+func (s *Server) responseWriter(conn net.Conn) io.Writer {
+	if s.ConnBytesPerSec <= 0 && s.Limiter == nil {
+		return conn
+	}
+	var connLimiter *ratelimit.Limiter
+	if s.ConnBytesPerSec > 0 {
+		connLimiter = ratelimit.NewBurst(s.ConnBytesPerSec, s.ConnBytesPerSec, s.grp.Ch())
+	}
+	return ratelimit.NewWriter(deadlineWriter{conn}, s.Limiter, connLimiter)
+}
+
+// deadlineWriter extends the write deadline before each write, so a response that is slowed down by the rate limits
+// doesn't time out as long as it keeps moving
+type deadlineWriter struct {
+	conn net.Conn
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	err := w.conn.SetWriteDeadline(time.Now().Add(timeoutDuration))
+	if err != nil {
+		return 0, errors.Err(err)
+	}
+	return w.conn.Write(p)
+}
+
+// authorize asks a whether the client may download the blob
+func (s *Server) authorize(a auth.Authorizer, client auth.Request, hash string) error {
+	client.Action = auth.ActionDownload
+	client.Hash = hash
+	err := auth.Check(a, client)
+	if errors.Is(err, auth.ErrForbidden) {
+		log.Debugf("peer request for %s from %s denied: %s", hash, client.RemoteAddr, err.Error())
+	}
+	return err
+}
+
 func (s *Server) logError(e error) {
 	if e == nil {
 		return
@@ -349,6 +476,7 @@ func readNextMessage(buf *bufio.Reader) ([]byte, error) {
 }
 
 const (
+	timeoutDuration     = 1 * time.Minute
 	maxRequestSize      = 64 * (2 ^ 10) // 64kb
 	paymentRateAccepted = "RATE_ACCEPTED"
 	paymentRateTooLow   = "RATE_TOO_LOW"
@@ -378,6 +506,7 @@ type paymentRateResponse struct {
 
 type blobRequest struct {
 	RequestedBlob string `json:"requested_blob"`
+	AuthToken     string `json:"auth_token,omitempty"`
 }
 
 type incomingBlob struct {
@@ -395,6 +524,7 @@ type compositeRequest struct {
 	RequestedBlobs      []string `json:"requested_blobs"`
 	BlobDataPaymentRate float64  `json:"blob_data_payment_rate"`
 	RequestedBlob       string   `json:"requested_blob"`
+	AuthToken           string   `json:"auth_token,omitempty"`
 }
 
 type compositeResponse struct {
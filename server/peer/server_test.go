@@ -2,9 +2,19 @@ package peer
 
 import (
 	"bytes"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
 	"testing"
 
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/reflector"
 	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/phayes/freeport"
 )
 
 var blobs = map[string][]byte{
@@ -75,3 +85,233 @@ func TestAvailabilityRequest_WithBlobs(t *testing.T) {
 		}
 	}
 }
+
+func TestServer_AvailabilityBitmap(t *testing.T) {
+	st := store.NewMemStore()
+	blob := []byte("available")
+	hash := reflector.BlobHash(blob)
+	err := st.Put(hash, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(st)
+
+	raw, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := make([]byte, stream.BlobHashSize)
+	res := s.handleAvailabilityBitmap(s.Authorizer, auth.Request{}, append(append([]byte{}, missing...), raw...))
+	if res.status != StatusOK || !bytes.Equal(res.payload, []byte{0x40}) {
+		t.Errorf("expected %s [0x40], got %s %x", StatusOK, res.status, res.payload)
+	}
+
+	res = s.handleAvailabilityBitmap(s.Authorizer, auth.Request{}, bytes.Repeat(raw, maxAvailabilityHashes+1))
+	if res.status != StatusBadRequest {
+		t.Errorf("expected %s for too many hashes, got %s", StatusBadRequest, res.status)
+	}
+}
+
+func TestServer_AuthorizerHas(t *testing.T) {
+	st := store.NewMemStore()
+	var raw []byte
+	var hashes []string
+	for _, b := range []string{"allowed", "denied"} {
+		hash := reflector.BlobHash([]byte(b))
+		err := st.Put(hash, []byte(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+		h, _ := hex.DecodeString(hash)
+		raw = append(raw, h...)
+	}
+	s := NewServer(st)
+	s.Authorizer = auth.Func(func(r auth.Request) error {
+		if r.Hash == hashes[1] {
+			return errors.Err(auth.ErrForbidden)
+		}
+		return nil
+	})
+
+	res := s.handleV2Request(s.Authorizer, auth.Request{}, requestTypeHas, []byte(hashes[0]), "")
+	if res.status != StatusOK || !bytes.Equal(res.payload, []byte{1}) {
+		t.Errorf("expected the allowed blob to be there, got %s %x", res.status, res.payload)
+	}
+	res = s.handleV2Request(s.Authorizer, auth.Request{}, requestTypeHas, []byte(hashes[1]), "")
+	if res.status != StatusForbidden {
+		t.Errorf("expected %s for the denied blob, got %s", StatusForbidden, res.status)
+	}
+	res = s.handleV2Request(s.Authorizer, auth.Request{}, requestTypeAvailability, raw, "")
+	if res.status != StatusOK || !bytes.Equal(res.payload, []byte{0x80}) {
+		t.Errorf("expected only the allowed blob to be available, got %s %x", res.status, res.payload)
+	}
+}
+
+func TestServer_MaxAvailabilityHashes(t *testing.T) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := store.NewMemStore()
+	var hashes []string
+	for i := 0; i < 10; i++ {
+		blob := []byte("blob " + strconv.Itoa(i))
+		hash := reflector.BlobHash(blob)
+		err = st.Put(hash, blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	var calls int32
+	s := NewServer(st)
+	s.MaxAvailabilityHashes = 4
+	s.Authorizer = auth.Func(func(r auth.Request) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	err = s.Start("127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	raw, _ := hex.DecodeString(hashes[0])
+	res := s.handleAvailabilityBitmap(s.Authorizer, auth.Request{}, bytes.Repeat(raw, 5))
+	if res.status != StatusBadRequest {
+		t.Errorf("expected %s for too many hashes, got %s", StatusBadRequest, res.status)
+	}
+
+	c := &Client{UseV2: true}
+	err = c.Connect("127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the client splits the hashes into requests the server takes, and each hash is only authorized once
+	for i := 0; i < 2; i++ {
+		available, err := c.HasBlobs(hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, a := range available {
+			if !a {
+				t.Errorf("expected blob %d to be available", j)
+			}
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != int32(len(hashes)) {
+		t.Errorf("expected %d authorizations, got %d", len(hashes), n)
+	}
+}
+
+func TestServer_V2GetBlob(t *testing.T) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := store.NewMemStore()
+	blob := make([]byte, 1000) // zeroes compress well, so this also goes through zstd
+	hash := reflector.BlobHash(blob)
+	err = st.Put(hash, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(st)
+	err = s.Start("127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	c := &Client{UseV2: true}
+	err = c.Connect("127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.ProtocolVersion() != ProtocolV2 {
+		t.Fatalf("expected protocol v2, got v%d", c.ProtocolVersion())
+	}
+
+	has, err := c.HasBlob(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has {
+		t.Error("expected server to have the blob")
+	}
+
+	got, _, err := c.GetBlob(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, blob) {
+		t.Error("received blob does not match")
+	}
+
+	available, err := c.HasBlobs([]string{reflector.BlobHash([]byte("missing")), hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(available) != 2 || available[0] || !available[1] {
+		t.Errorf("expected [false true], got %v", available)
+	}
+
+	_, _, err = c.GetBlob(reflector.BlobHash([]byte("missing")))
+	if !errors.Is(err, store.ErrBlobNotFound) {
+		t.Errorf("expected blob not found, got %v", err)
+	}
+}
+
+func TestServer_Authorizer(t *testing.T) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := store.NewMemStore()
+	blob := []byte("authorized blob")
+	hash := reflector.BlobHash(blob)
+	err = st.Put(hash, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(st)
+	s.Authorizer = auth.Func(func(r auth.Request) error {
+		if r.Token != "letmein" {
+			return errors.Err(auth.ErrForbidden)
+		}
+		return nil
+	})
+	err = s.Start("127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	for _, useV2 := range []bool{false, true} {
+		for token, allowed := range map[string]bool{"letmein": true, "wrong": false} {
+			c := &Client{UseV2: useV2, AuthToken: token}
+			err = c.Connect("127.0.0.1:" + strconv.Itoa(port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = c.GetBlob(hash)
+			_ = c.Close()
+			if allowed && err != nil {
+				t.Errorf("v2=%t: expected the download to be allowed, got %v", useV2, err)
+			} else if !allowed && err == nil {
+				t.Errorf("v2=%t: expected the download to be denied", useV2)
+			}
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package peer
 
 import (
-	"strings"
 	"time"
 
 	"github.com/lbryio/reflector.go/shared"
@@ -11,29 +10,54 @@ import (
 	"github.com/lbryio/lbry.go/v2/stream"
 )
 
-// Store is a blob store that gets blobs from a peer.
+// Store is a blob store that gets blobs from a peer. Connections to the peer are kept open between requests.
 // It satisfies the store.BlobStore interface but cannot put or delete blobs.
 type Store struct {
 	opts StoreOpts
+	pool *Pool
 }
 
 // StoreOpts allows to set options for a new Store.
 type StoreOpts struct {
 	Address string
 	Timeout time.Duration
+	// UseV2 negotiates peer protocol v2 with the peer, falling back to v1 if the peer doesn't support it
+	UseV2 bool
+	// AuthToken is sent to peers that authorize downloads
+	AuthToken string
+	// MaxConns is how many connections to the peer can be in use at once. DefaultMaxConnsPerHost if 0
+	MaxConns int
+	// IdleTimeout is how long an unused connection to the peer is kept open. DefaultIdleTimeout if 0
+	IdleTimeout time.Duration
 }
 
 // NewStore makes a new peer store.
 func NewStore(opts StoreOpts) *Store {
-	return &Store{opts: opts}
+	pool := NewPool()
+	pool.Timeout = opts.Timeout
+	pool.UseV2 = opts.UseV2
+	pool.AuthToken = opts.AuthToken
+	if opts.MaxConns > 0 {
+		pool.MaxConnsPerHost = opts.MaxConns
+	}
+	if opts.IdleTimeout > 0 {
+		pool.IdleTimeout = opts.IdleTimeout
+	}
+	pool.Start()
+	return &Store{opts: opts, pool: pool}
 }
 
 func (p *Store) getClient() (*Client, error) {
-	c := &Client{Timeout: p.opts.Timeout}
-	err := c.Connect(p.opts.Address)
+	c, err := p.pool.Get(p.opts.Address)
 	return c, errors.Prefix("connection error", err)
 }
 
+// putClient gives the connection back to the pool. It's reused unless the request failed in a way that could leave
+// part of the response unread
+func (p *Store) putClient(c *Client, err error) {
+	p.pool.Put(p.opts.Address, c, err == nil || errors.Is(err, store.ErrBlobNotFound))
+}
+
 func (p *Store) Name() string { return "peer" }
 
 // Has asks the peer if they have a hash
@@ -42,8 +66,9 @@ func (p *Store) Has(hash string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	defer c.Close()
-	return c.HasBlob(hash)
+	has, err := c.HasBlob(hash)
+	p.putClient(c, err)
+	return has, err
 }
 
 // Get downloads the blob from the peer
@@ -53,10 +78,13 @@ func (p *Store) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
 	if err != nil {
 		return nil, shared.NewBlobTrace(time.Since(start), p.Name()), err
 	}
-	defer c.Close()
 	blob, trace, err := c.GetBlob(hash)
-	if err != nil && strings.Contains(err.Error(), "blob not found") {
-		return nil, trace, store.ErrBlobNotFound
+	if errors.Is(err, store.ErrBlobNotFound) {
+		err = store.ErrBlobNotFound
+	}
+	p.putClient(c, err)
+	if err != nil {
+		return nil, trace, err
 	}
 
 	return blob, trace, err
@@ -77,6 +105,7 @@ func (p *Store) Delete(hash string) error {
 	return errors.Err(shared.ErrNotImplemented)
 }
 
-// Shutdown is not supported
+// Shutdown closes the connections to the peer
 func (p *Store) Shutdown() {
+	p.pool.Shutdown()
 }
@@ -0,0 +1,298 @@
+package peer
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/shared"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PeerFinder finds the peers that announced a blob. *dht.DHT satisfies it.
+type PeerFinder interface {
+	Get(hash bits.Bitmap) ([]dht.Contact, error)
+}
+
+// PeerSwarmStore is a blob store that looks up which peers have a blob in the dht and downloads it from several of
+// them at once, keeping the first copy that arrives. Peers are tried best first, according to how reliable and fast
+// they have been so far.
+// It satisfies the store.BlobStore interface but cannot put or delete blobs.
+type PeerSwarmStore struct {
+	finder PeerFinder
+	opts   SwarmStoreOpts
+
+	// mu guards the scores of the peers seen in the last scoreExpiry, at most maxScores of them
+	mu     sync.Mutex
+	scores map[string]*peerScore
+
+	pool *Pool
+	grp  *stop.Group
+}
+
+// SwarmStoreOpts allows to set options for a new PeerSwarmStore.
+type SwarmStoreOpts struct {
+	// how long to wait for a single peer
+	Timeout time.Duration
+	// how many peers to download from at the same time
+	Parallelism int
+	// negotiate peer protocol v2 with peers that support it
+	UseV2 bool
+	// how many connections to each peer can be in use at once. DefaultMaxConnsPerHost if 0
+	MaxConnsPerPeer int
+	// how long an unused connection to a peer is kept open. DefaultIdleTimeout if 0
+	IdleTimeout time.Duration
+}
+
+// NewPeerSwarmStore makes a new swarm store that finds peers using finder
+func NewPeerSwarmStore(finder PeerFinder, opts SwarmStoreOpts) *PeerSwarmStore {
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = 3
+	}
+	pool := NewPool()
+	pool.Timeout = opts.Timeout
+	pool.UseV2 = opts.UseV2
+	if opts.MaxConnsPerPeer > 0 {
+		pool.MaxConnsPerHost = opts.MaxConnsPerPeer
+	}
+	if opts.IdleTimeout > 0 {
+		pool.IdleTimeout = opts.IdleTimeout
+	}
+	pool.Start()
+	return &PeerSwarmStore{
+		finder: finder,
+		opts:   opts,
+		scores: make(map[string]*peerScore),
+		pool:   pool,
+		grp:    stop.New(),
+	}
+}
+
+const nameSwarm = "swarm"
+
+const (
+	// scoreExpiry is how long the score of a peer is kept after it last served a request
+	scoreExpiry = time.Hour
+	// maxScores is how many peers scores are kept for. The least recently seen peers are forgotten first
+	maxScores = 10000
+)
+
+func (p *PeerSwarmStore) Name() string { return nameSwarm }
+
+// Has checks if any peer announced the blob
+func (p *PeerSwarmStore) Has(hash string) (bool, error) {
+	peers, err := p.findPeers(hash)
+	if err != nil {
+		return false, err
+	}
+	return len(peers) > 0, nil
+}
+
+// Get downloads the blob from the best peers that have it
+func (p *PeerSwarmStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
+	start := time.Now()
+	peers, err := p.findPeers(hash)
+	if err != nil {
+		return nil, shared.NewBlobTrace(time.Since(start), p.Name()), err
+	}
+	if len(peers) == 0 {
+		return nil, shared.NewBlobTrace(time.Since(start), p.Name()), store.ErrBlobNotFound
+	}
+
+	p.sortByScore(peers)
+
+	type result struct {
+		blob stream.Blob
+		err  error
+	}
+
+	lastErr := error(store.ErrBlobNotFound)
+	for len(peers) > 0 {
+		batch := peers
+		if len(batch) > p.opts.Parallelism {
+			batch = peers[:p.opts.Parallelism]
+		}
+		peers = peers[len(batch):]
+
+		// buffered so downloads that lose the race can still finish and update the peer's score
+		results := make(chan result, len(batch))
+		for _, addr := range batch {
+			addr := addr
+			p.grp.Add(1)
+			go func() {
+				defer p.grp.Done()
+				blob, err := p.download(addr, hash)
+				results <- result{blob: blob, err: err}
+			}()
+		}
+
+		for range batch {
+			r := <-results
+			if r.err == nil {
+				return r.blob, shared.NewBlobTrace(time.Since(start), p.Name()), nil
+			}
+			if !errors.Is(r.err, store.ErrBlobNotFound) {
+				lastErr = r.err
+			}
+		}
+	}
+
+	return nil, shared.NewBlobTrace(time.Since(start), p.Name()), lastErr
+}
+
+// Put is not supported
+func (p *PeerSwarmStore) Put(hash string, blob stream.Blob) error {
+	return errors.Err(shared.ErrNotImplemented)
+}
+
+// PutSD is not supported
+func (p *PeerSwarmStore) PutSD(hash string, blob stream.Blob) error {
+	return errors.Err(shared.ErrNotImplemented)
+}
+
+// Delete is not supported
+func (p *PeerSwarmStore) Delete(hash string) error {
+	return errors.Err(shared.ErrNotImplemented)
+}
+
+// Shutdown waits for downloads that are still running and closes the connections to peers
+func (p *PeerSwarmStore) Shutdown() {
+	p.grp.StopAndWait()
+	p.pool.Shutdown()
+}
+
+// findPeers returns the peer protocol addresses of the peers that announced the blob
+func (p *PeerSwarmStore) findPeers(hash string) ([]string, error) {
+	h, err := bits.FromHex(hash)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	contacts, err := p.finder.Get(h)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(contacts))
+	var peers []string
+	for _, c := range contacts {
+		if c.PeerPort == 0 {
+			continue
+		}
+		addr := net.JoinHostPort(c.IP.String(), strconv.Itoa(c.PeerPort))
+		if !seen[addr] {
+			seen[addr] = true
+			peers = append(peers, addr)
+		}
+	}
+	return peers, nil
+}
+
+func (p *PeerSwarmStore) download(addr, hash string) (stream.Blob, error) {
+	start := time.Now()
+	c, err := p.pool.Get(addr)
+	if err != nil {
+		p.record(addr, false, 0)
+		return nil, errors.Prefix("connection error", err)
+	}
+
+	blob, _, err := c.GetBlob(hash)
+	if err != nil {
+		log.Debugf("swarm: %s from %s: %s", hash[:8], addr, err.Error())
+		p.record(addr, false, 0)
+		if errors.Is(err, store.ErrBlobNotFound) {
+			p.pool.Put(addr, c, true)
+			return nil, store.ErrBlobNotFound
+		}
+		p.pool.Put(addr, c, false)
+		return nil, err
+	}
+	p.pool.Put(addr, c, true)
+	p.record(addr, true, time.Since(start))
+	return blob, nil
+}
+
+func (p *PeerSwarmStore) sortByScore(peers []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	values := make(map[string]float64, len(peers))
+	for _, addr := range peers {
+		values[addr] = p.scores[addr].value()
+	}
+	sort.SliceStable(peers, func(i, j int) bool { return values[peers[i]] > values[peers[j]] })
+}
+
+func (p *PeerSwarmStore) record(addr string, success bool, took time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.scores[addr]
+	if !ok {
+		if len(p.scores) >= maxScores {
+			p.expireScores()
+		}
+		s = &peerScore{}
+		p.scores[addr] = s
+	}
+	s.lastSeen = time.Now()
+	if !success {
+		s.failures++
+		return
+	}
+	s.successes++
+	if s.latency == 0 {
+		s.latency = took
+	} else {
+		s.latency = (s.latency*4 + took) / 5
+	}
+}
+
+// expireScores forgets the peers that were not seen in the last scoreExpiry, or the least recently seen one if all of
+// them were. p.mu must be held
+func (p *PeerSwarmStore) expireScores() {
+	cutoff := time.Now().Add(-scoreExpiry)
+	var oldest string
+	for addr, s := range p.scores {
+		if s.lastSeen.Before(cutoff) {
+			delete(p.scores, addr)
+		} else if oldest == "" || s.lastSeen.Before(p.scores[oldest].lastSeen) {
+			oldest = addr
+		}
+	}
+	if len(p.scores) >= maxScores {
+		delete(p.scores, oldest)
+	}
+}
+
+// peerScore tracks how well a peer has served blobs so far
+type peerScore struct {
+	successes int
+	failures  int
+	latency   time.Duration // moving average over successful downloads
+	lastSeen  time.Time
+}
+
+// value is higher for better peers. Unknown peers start with a 50% success rate and a latency of one second, so
+// they get a chance against peers that have been slow or unreliable.
+func (s *peerScore) value() float64 {
+	if s == nil {
+		s = &peerScore{}
+	}
+	rate := float64(s.successes+1) / float64(s.successes+s.failures+2)
+	latency := s.latency.Seconds()
+	if latency <= 0 {
+		latency = 1
+	}
+	return rate / latency
+}
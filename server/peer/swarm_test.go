@@ -0,0 +1,165 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/reflector"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/dht"
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/phayes/freeport"
+)
+
+// fakeFinder returns the same peers for every hash
+type fakeFinder []dht.Contact
+
+func (f fakeFinder) Get(hash bits.Bitmap) ([]dht.Contact, error) { return f, nil }
+
+// swarmPeer starts a peer server with the blobs and returns the contact that announced them
+func swarmPeer(t *testing.T, blobs ...[]byte) dht.Contact {
+	st := store.NewMemStore()
+	for _, b := range blobs {
+		err := st.Put(reflector.BlobHash(b), b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewServer(st)
+	port := freePort(t)
+	err := s.Start("127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Shutdown)
+	return dht.Contact{IP: net.IPv4(127, 0, 0, 1), PeerPort: port}
+}
+
+// hangingPeer accepts connections and never answers
+func hangingPeer(t *testing.T) dht.Contact {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+	return dht.Contact{IP: net.IPv4(127, 0, 0, 1), PeerPort: l.Addr().(*net.TCPAddr).Port}
+}
+
+func freePort(t *testing.T) int {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func addr(c dht.Contact) string {
+	return net.JoinHostPort(c.IP.String(), strconv.Itoa(c.PeerPort))
+}
+
+func TestPeerSwarmStore_Get(t *testing.T) {
+	blob := []byte("swarmed blob")
+	hash := reflector.BlobHash(blob)
+	good := swarmPeer(t, blob)
+	empty := swarmPeer(t)
+	hanging := hangingPeer(t)
+
+	p := NewPeerSwarmStore(fakeFinder{hanging, empty, good}, SwarmStoreOpts{Timeout: time.Second})
+	defer p.Shutdown()
+
+	// the peers are asked at once, so the one that hangs doesn't hold up the download
+	start := time.Now()
+	got, _, err := p.Get(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, blob) {
+		t.Error("received blob does not match")
+	}
+	if took := time.Since(start); took > p.opts.Timeout/2 {
+		t.Errorf("expected the download not to wait for the hanging peer, took %s", took)
+	}
+
+	// the peer that served the blob ranks first
+	peers := []string{addr(hanging), addr(empty), addr(good)}
+	p.sortByScore(peers)
+	if peers[0] != addr(good) {
+		t.Errorf("expected %s to rank first, got %v", addr(good), peers)
+	}
+
+	// a blob is only missing if all the peers answered that they don't have it
+	p = NewPeerSwarmStore(fakeFinder{empty, good}, SwarmStoreOpts{Timeout: time.Second})
+	defer p.Shutdown()
+	_, _, err = p.Get(reflector.BlobHash([]byte("missing")))
+	if !errors.Is(err, store.ErrBlobNotFound) {
+		t.Errorf("expected blob not found, got %v", err)
+	}
+}
+
+func TestPeerSwarmStore_Failover(t *testing.T) {
+	blob := []byte("swarmed blob")
+	hash := reflector.BlobHash(blob)
+	good := swarmPeer(t, blob)
+	dead := dht.Contact{IP: net.IPv4(127, 0, 0, 1), PeerPort: freePort(t)}
+
+	// one peer at a time, so the next batch is only tried after the first one failed
+	p := NewPeerSwarmStore(fakeFinder{dead, swarmPeer(t), good}, SwarmStoreOpts{Timeout: time.Second, Parallelism: 1})
+	defer p.Shutdown()
+
+	got, _, err := p.Get(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, blob) {
+		t.Error("received blob does not match")
+	}
+
+	// a peer that can't be reached is a failure, not a missing blob
+	p = NewPeerSwarmStore(fakeFinder{dead}, SwarmStoreOpts{Timeout: time.Second})
+	defer p.Shutdown()
+	_, _, err = p.Get(hash)
+	if err == nil || errors.Is(err, store.ErrBlobNotFound) {
+		t.Errorf("expected a connection error, got %v", err)
+	}
+}
+
+func TestPeerSwarmStore_ExpireScores(t *testing.T) {
+	p := &PeerSwarmStore{scores: make(map[string]*peerScore)}
+	for i := 0; i < maxScores; i++ {
+		p.record("10.0.0.1:"+strconv.Itoa(i), true, time.Second)
+	}
+	p.scores["10.0.0.1:0"].lastSeen = time.Now().Add(-2 * time.Minute)
+	p.scores["10.0.0.1:1"].lastSeen = time.Now().Add(-time.Minute)
+
+	// the least recently seen peer makes room
+	p.record("10.0.0.2:1", true, time.Second)
+	if len(p.scores) != maxScores {
+		t.Errorf("expected %d scores, got %d", maxScores, len(p.scores))
+	}
+	if _, ok := p.scores["10.0.0.1:0"]; ok {
+		t.Error("expected the least recently seen peer to be forgotten")
+	}
+
+	// peers that were not seen for a while are all forgotten
+	p.scores["10.0.0.1:1"].lastSeen = time.Now().Add(-2 * scoreExpiry)
+	p.scores["10.0.0.1:2"].lastSeen = time.Now().Add(-2 * scoreExpiry)
+	p.record("10.0.0.2:2", true, time.Second)
+	if len(p.scores) != maxScores-1 {
+		t.Errorf("expected %d scores, got %d", maxScores-1, len(p.scores))
+	}
+}
@@ -0,0 +1,427 @@
+package peer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/internal/admission"
+	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/reflector"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// Peer protocol v2
+//
+// A v2 client opens the connection with a json handshake, same as any v1 request:
+//   {"protocol_version":2,"compression":["zstd"]}
+// A v2 server answers with {"protocol_version":2,"compression":"zstd"} (compression is empty if none of the offered
+// methods is supported) and from then on both sides exchange binary frames. A v1 server treats the handshake as an
+// empty composite request and answers without a protocol_version, so the client knows to keep speaking v1. v1
+// clients never send a protocol_version and are served exactly as before.
+//
+// After the handshake every message is a frame. All integers are big endian.
+//   request:  length uint32 | id uint32 | type uint8 | payload
+//   response: length uint32 | id uint32 | status uint8 | flags uint8 | payload
+// length counts the bytes after the length field. A client may send several requests without waiting for the
+// responses. Each response carries the id of the request it answers, and responses may come back in any order.
+//
+// Servers that authorize downloads read the client's token from auth_token in the handshake. v1 clients send it in
+// auth_token with each blob request. v2 has and availability requests are authorized per hash too, so a client can't
+// learn which blobs it may not download are there: a has request for one is forbidden, and an availability request
+// reports it as unavailable.
+
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+
+	CompressionZstd = "zstd"
+
+	requestTypeBlob = 1 // payload is the hex blob hash. response payload is the blob
+	requestTypeHas  = 2 // payload is the hex blob hash. response payload is a single byte, 1 if the blob is available
+	// payload is a list of up to maxAvailabilityHashes raw (not hex) blob hashes, one after the other. response payload
+	// is a bitmap with one bit per requested hash, most significant bit first, set if the blob is available
+	requestTypeAvailability = 3
+
+	flagCompressed = 1 << 0
+
+	requestHeaderLength  = 4 + 1
+	responseHeaderLength = 4 + 1 + 1
+
+	maxV2RequestSize = 64 * 1024
+	// how many hashes an availability request may ask about by default. They're looked up in one batch
+	maxAvailabilityHashes = 256
+	maxV2ResponseSize     = stream.MaxBlobSize + 1024
+
+	// how many authorization decisions a v2 connection remembers
+	connAuthCacheSize = 4096
+
+	// how many requests from one connection are handled at the same time
+	maxPipelinedRequests = 8
+)
+
+// Status is the result of a v2 request
+type Status uint8
+
+const (
+	StatusOK Status = iota
+	StatusNotFound
+	StatusBadRequest
+	StatusServerError
+	StatusForbidden
+	StatusOverloaded
+	// StatusUnavailable means the blob can't be read right now. The payload is how many seconds to wait
+	StatusUnavailable
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusNotFound:
+		return "not found"
+	case StatusBadRequest:
+		return "bad request"
+	case StatusServerError:
+		return "server error"
+	case StatusForbidden:
+		return "forbidden"
+	case StatusOverloaded:
+		return "overloaded, retry later"
+	case StatusUnavailable:
+		return "temporarily unavailable"
+	default:
+		return "unknown status"
+	}
+}
+
+// supportedCompression is in order of preference
+var supportedCompression = []string{CompressionZstd}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxV2ResponseSize))
+)
+
+type handshakeRequest struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Compression     []string `json:"compression,omitempty"`
+	AuthToken       string   `json:"auth_token,omitempty"`
+}
+
+type handshakeResponse struct {
+	ProtocolVersion int    `json:"protocol_version"`
+	Compression     string `json:"compression,omitempty"`
+	// MaxAvailabilityHashes is how many hashes an availability request may ask about. maxAvailabilityHashes if it's 0
+	MaxAvailabilityHashes int `json:"max_availability_hashes,omitempty"`
+}
+
+type v2Response struct {
+	status  Status
+	flags   uint8
+	payload []byte
+}
+
+// parseHandshake returns the handshake if the message is a v2 handshake, or nil if it's a regular v1 request
+func parseHandshake(msg []byte) *handshakeRequest {
+	var h handshakeRequest
+	if json.Unmarshal(msg, &h) != nil || h.ProtocolVersion < ProtocolV2 {
+		return nil
+	}
+	return &h
+}
+
+func (s *Server) handleHandshake(conn net.Conn, h *handshakeRequest) (string, error) {
+	response := handshakeResponse{ProtocolVersion: ProtocolV2}
+	if s.maxAvailabilityHashes() != maxAvailabilityHashes {
+		response.MaxAvailabilityHashes = s.maxAvailabilityHashes()
+	}
+	for _, supported := range supportedCompression {
+		for _, offered := range h.Compression {
+			if offered == supported && response.Compression == "" {
+				response.Compression = supported
+			}
+		}
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return "", errors.Err(err)
+	}
+	err = conn.SetWriteDeadline(time.Now().Add(timeoutDuration))
+	if err != nil {
+		return "", errors.Err(err)
+	}
+	_, err = conn.Write(data)
+	return response.Compression, errors.Err(err)
+}
+
+// serveV2 reads frames from the connection until it is closed, handling up to maxPipelinedRequests at a time
+func (s *Server) serveV2(conn net.Conn, out io.Writer, buf *bufio.Reader, compression string, client auth.Request) {
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	sem := make(chan struct{}, maxPipelinedRequests)
+
+	// the token can't change after the handshake, so each blob only has to be authorized once per connection
+	var authorizer auth.Authorizer
+	if s.Authorizer != nil {
+		authorizer = auth.NewCache(s.Authorizer, connAuthCacheSize)
+	}
+
+	for {
+		err := conn.SetReadDeadline(time.Now().Add(timeoutDuration))
+		if err != nil {
+			log.Error(errors.FullTrace(err))
+		}
+
+		frame, err := readFrame(buf, maxV2RequestSize)
+		if err != nil {
+			if err != io.EOF {
+				s.logError(err)
+			}
+			return
+		}
+		if len(frame) < requestHeaderLength {
+			s.logError(errors.Err("v2 request frame too short"))
+			return
+		}
+
+		id := binary.BigEndian.Uint32(frame[0:4])
+		reqType := frame[4]
+		payload := frame[requestHeaderLength:]
+
+		select {
+		case <-s.grp.Ch():
+			return
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			res := s.handleV2Request(authorizer, client, reqType, payload, compression)
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			err := conn.SetWriteDeadline(time.Now().Add(timeoutDuration))
+			if err != nil {
+				log.Error(errors.FullTrace(err))
+			}
+			err = writeResponseFrame(out, id, res)
+			if err != nil {
+				s.logError(err)
+			}
+		}()
+	}
+}
+
+// handleV2Request handles one request, asking a whether the client may have the blobs
+func (s *Server) handleV2Request(a auth.Authorizer, client auth.Request, reqType uint8, payload []byte, compression string) v2Response {
+	if reqType == requestTypeAvailability {
+		return s.handleAvailabilityBitmap(a, client, payload)
+	}
+
+	hash := string(payload)
+	if len(hash) != stream.BlobHashHexLength {
+		return v2Response{status: StatusBadRequest, payload: []byte("invalid blob hash length")}
+	}
+
+	switch reqType {
+	case requestTypeHas:
+		err := s.authorize(a, client, hash)
+		if errors.Is(err, auth.ErrForbidden) {
+			return v2Response{status: StatusForbidden, payload: []byte(err.Error())}
+		} else if err != nil {
+			return v2Response{status: StatusServerError, payload: []byte(err.Error())}
+		}
+		has, err := s.store.Has(hash)
+		if err != nil {
+			return v2Response{status: StatusServerError, payload: []byte(err.Error())}
+		}
+		if has {
+			return v2Response{status: StatusOK, payload: []byte{1}}
+		}
+		return v2Response{status: StatusOK, payload: []byte{0}}
+
+	case requestTypeBlob:
+		err := s.authorize(a, client, hash)
+		if errors.Is(err, auth.ErrForbidden) {
+			return v2Response{status: StatusForbidden, payload: []byte(err.Error())}
+		} else if err != nil {
+			return v2Response{status: StatusServerError, payload: []byte(err.Error())}
+		}
+
+		log.Debugln("Sending blob " + hash[:8])
+		blob, trace, err := s.getBlob(hash)
+		log.Debug(trace.String())
+		if errors.Is(err, store.ErrBlobNotFound) {
+			return v2Response{status: StatusNotFound}
+		} else if errors.Is(err, admission.ErrOverloaded) {
+			return v2Response{status: StatusOverloaded, payload: []byte(err.Error())}
+		} else if retryAfter, ok := store.RetryAfter(err); ok {
+			return v2Response{status: StatusUnavailable, payload: []byte(strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))}
+		} else if err != nil {
+			return v2Response{status: StatusServerError, payload: []byte(err.Error())}
+		}
+		metrics.MtrOutBytesTcp.Add(float64(len(blob)))
+		metrics.BlobDownloadCount.Inc()
+		metrics.PeerDownloadCount.Inc()
+		if s.GeoIP != nil {
+			s.GeoIP.Count(auth.ProtocolPeer, client.RemoteAddr, len(blob))
+		}
+		if s.Capture != nil {
+			s.Capture.Record(auth.ProtocolPeer, client.RemoteAddr, hash, len(blob))
+		}
+
+		// blobs are encrypted, so most of them won't compress. only send the compressed version if it's smaller
+		if compression == CompressionZstd {
+			compressed := zstdEncoder.EncodeAll(blob, nil)
+			if len(compressed) < len(blob) {
+				return v2Response{status: StatusOK, flags: flagCompressed, payload: compressed}
+			}
+		}
+		return v2Response{status: StatusOK, payload: blob}
+
+	default:
+		return v2Response{status: StatusBadRequest, payload: []byte("unknown request type")}
+	}
+}
+
+// handleAvailabilityBitmap looks up the hashes the client may download. The ones it may not are reported as unavailable
+func (s *Server) handleAvailabilityBitmap(a auth.Authorizer, client auth.Request, payload []byte) v2Response {
+	if len(payload)%stream.BlobHashSize != 0 {
+		return v2Response{status: StatusBadRequest, payload: []byte("payload is not a list of blob hashes")}
+	}
+	count := len(payload) / stream.BlobHashSize
+	if count > s.maxAvailabilityHashes() {
+		return v2Response{status: StatusBadRequest, payload: []byte("at most " + strconv.Itoa(s.maxAvailabilityHashes()) + " hashes per request")}
+	}
+
+	hashes := make([]string, count)
+	allowed := make([]string, 0, count)
+	for i := range hashes {
+		hashes[i] = hex.EncodeToString(payload[i*stream.BlobHashSize : (i+1)*stream.BlobHashSize])
+		err := s.authorize(a, client, hashes[i])
+		if errors.Is(err, auth.ErrForbidden) {
+			continue
+		} else if err != nil {
+			return v2Response{status: StatusServerError, payload: []byte(err.Error())}
+		}
+		allowed = append(allowed, hashes[i])
+	}
+	exists, err := store.HasMany(s.store, allowed)
+	if err != nil {
+		return v2Response{status: StatusServerError, payload: []byte(err.Error())}
+	}
+
+	bitmap := make([]byte, (count+7)/8)
+	for i, hash := range hashes {
+		if exists[hash] {
+			bitmap[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return v2Response{status: StatusOK, payload: bitmap}
+}
+
+// maxAvailabilityHashes is how many hashes an availability request may ask about
+func (s *Server) maxAvailabilityHashes() int {
+	if s.MaxAvailabilityHashes <= 0 || s.MaxAvailabilityHashes > maxAvailabilityHashes {
+		return maxAvailabilityHashes
+	}
+	return s.MaxAvailabilityHashes
+}
+
+// readFrame reads one length-prefixed frame and returns everything after the length
+func readFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var lenBuf [4]byte
+	_, err := io.ReadFull(r, lenBuf[:])
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lenBuf[:])
+	if length > uint32(maxSize) {
+		return nil, errRequestTooLarge
+	}
+	frame := make([]byte, length)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	return frame, nil
+}
+
+func requestFrame(id uint32, reqType uint8, payload []byte) []byte {
+	frame := make([]byte, 4+requestHeaderLength+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(requestHeaderLength+len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], id)
+	frame[8] = reqType
+	copy(frame[4+requestHeaderLength:], payload)
+	return frame
+}
+
+func writeResponseFrame(w io.Writer, id uint32, res v2Response) error {
+	frame := make([]byte, 4+responseHeaderLength+len(res.payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(responseHeaderLength+len(res.payload)))
+	binary.BigEndian.PutUint32(frame[4:8], id)
+	frame[8] = uint8(res.status)
+	frame[9] = res.flags
+	copy(frame[4+responseHeaderLength:], res.payload)
+
+	n, err := w.Write(frame)
+	if err == nil && n != len(frame) {
+		err = io.ErrShortWrite
+	}
+	return errors.Err(err)
+}
+
+// blobFromResponse decompresses the payload if needed and checks that it is the blob that was requested
+func blobFromResponse(hash string, res *v2Response) (stream.Blob, error) {
+	switch res.status {
+	case StatusOK:
+	case StatusNotFound:
+		return nil, errors.Prefix(hash[:8], store.ErrBlobNotFound)
+	case StatusUnavailable:
+		seconds, err := strconv.Atoi(string(res.payload))
+		if err != nil {
+			return nil, errors.Prefix(hash[:8], errors.Err("invalid retry time %q", string(res.payload)))
+		}
+		return nil, errors.Prefix(hash[:8], &store.UnavailableError{
+			Reason:     "the peer can't read the blob right now",
+			RetryAfter: time.Duration(seconds) * time.Second,
+		})
+	default:
+		return nil, errors.Prefix(hash[:8], errors.Err("%s: %s", res.status, string(res.payload)))
+	}
+
+	blob := res.payload
+	if res.flags&flagCompressed != 0 {
+		var err error
+		blob, err = zstdDecoder.DecodeAll(res.payload, nil)
+		if err != nil {
+			return nil, errors.Prefix(hash[:8], err)
+		}
+	}
+
+	if reflector.BlobHash(blob) != hash {
+		return nil, errors.Prefix(hash[:8], "blob hash in response does not match requested hash")
+	}
+	return blob, nil
+}
@@ -0,0 +1,333 @@
+// Package s3gw serves a blob store over a subset of the S3 API, so S3 tools like the aws cli and rclone can read and
+// write blobs. The store is exposed as a single bucket whose keys are blob hashes. Objects can be fetched (GET), checked
+// (HEAD) and uploaded (PUT). Listing and multipart uploads are not supported.
+package s3gw
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lbryio/reflector.go/auth"
+	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/reflector"
+	"github.com/lbryio/reflector.go/shared"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultBucket is the name of the bucket, unless Bucket is changed
+const DefaultBucket = "blobs"
+
+// blobs never change, so they all get the same modification time
+var lastModified = time.Unix(0, 0).UTC().Format(http.TimeFormat)
+
+// Server serves a blob store over the S3 API
+type Server struct {
+	// Bucket is the name of the bucket the blobs are in
+	Bucket string
+	// AccessKey and SecretKey are the credentials clients sign their requests with. If they're not set, requests are
+	// not checked: anyone can read, and uploads are turned away
+	AccessKey string
+	SecretKey string
+	// ReadOnly turns uploads away
+	ReadOnly bool
+	// Authorizer decides whether each blob may be read, after the signature is checked, and written if Upload is not
+	// set. Everything is allowed if it's nil
+	Authorizer auth.Authorizer
+	// Upload, if set, takes the blobs clients put instead of the underlying store, like reflector.Server.Accept does,
+	// so they get the same checks and limits as uploads over the reflector protocol. The client's auth token is the
+	// session token it signs with (x-amz-security-token), which is where clients put their api key
+	Upload func(client auth.Request, blob []byte) error
+
+	store  store.BlobStore // blobs are read from here
+	upload store.BlobStore // and written here
+	grp    *stop.Group
+}
+
+// NewServer returns a server that reads blobs from outer and writes them to underlying, like the reflector server
+func NewServer(underlying, outer store.BlobStore) *Server {
+	return &Server{
+		Bucket: DefaultBucket,
+		store:  outer,
+		upload: underlying,
+		grp:    stop.New(),
+	}
+}
+
+// Start starts serving on the address
+func (s *Server) Start(address string) error {
+	srv := &http.Server{Addr: address, Handler: s}
+	s.grp.Add(1)
+	go func() {
+		defer s.grp.Done()
+		<-s.grp.Ch()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Errorf("shutting down s3 gateway: %s", err.Error())
+		}
+	}()
+	s.grp.Add(1)
+	go func() {
+		defer s.grp.Done()
+		log.Println("s3 gateway listening on " + address)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("s3 gateway: %s", err.Error())
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops the server
+func (s *Server) Shutdown() {
+	log.Debug("shutting down s3 gateway")
+	s.grp.StopAndWait()
+}
+
+// ServeHTTP handles an S3 request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqID := shared.NewRequestID()
+	w.Header().Set("x-amz-request-id", reqID)
+	w.Header().Set("Server", "reflector")
+
+	bucket, key := s.parsePath(r)
+	fail := func(e *s3Error) {
+		// the errors are shared, so the resource and request id are set on a copy
+		resp := *e
+		resp.Resource = r.URL.Path
+		resp.RequestID = reqID
+		writeXML(w, resp.Status, resp)
+		metrics.S3GatewayRequestCount.WithLabelValues(strings.ToLower(r.Method), e.Code).Inc()
+	}
+
+	if s.AccessKey != "" {
+		if e := s.checkSignature(r); e != nil {
+			fail(e)
+			return
+		}
+	}
+
+	switch {
+	case bucket == "" && r.Method == http.MethodGet:
+		s.listBuckets(w)
+	case bucket != s.Bucket:
+		fail(errNoSuchBucket)
+	case key == "":
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		fail(errNotImplemented)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		if e := s.getObject(w, r, key); e != nil {
+			fail(e)
+			return
+		}
+	case r.Method == http.MethodPut:
+		if e := s.putObject(w, r, key); e != nil {
+			fail(e)
+			return
+		}
+	default:
+		fail(errNotImplemented)
+		return
+	}
+	metrics.S3GatewayRequestCount.WithLabelValues(strings.ToLower(r.Method), "ok").Inc()
+}
+
+// parsePath returns the bucket and key of a request, for both path style (/bucket/key) and virtual host style
+// (bucket.host/key) requests
+func (s *Server) parsePath(r *http.Request) (string, string) {
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	if strings.HasPrefix(r.Host, s.Bucket+".") {
+		return s.Bucket, p
+	}
+	parts := strings.SplitN(p, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func (s *Server) authorize(r *http.Request, action auth.Action, hash string) *s3Error {
+	err := auth.Check(s.Authorizer, auth.Request{
+		Action:     action,
+		Hash:       hash,
+		RemoteAddr: r.RemoteAddr,
+		Protocol:   auth.ProtocolS3,
+		Header:     r.Header,
+	})
+	if errors.Is(err, auth.ErrForbidden) {
+		return errAccessDenied
+	} else if err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, key string) *s3Error {
+	if len(key) != stream.BlobHashHexLength {
+		return errNoSuchKey
+	}
+	if e := s.authorize(r, auth.ActionDownload, key); e != nil {
+		return e
+	}
+	blob, _, err := s.store.Get(key)
+	if errors.Is(err, store.ErrBlobNotFound) {
+		return errNoSuchKey
+	} else if retryAfter, ok := store.RetryAfter(err); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		return errSlowDown
+	} else if err != nil {
+		return internalError(err)
+	}
+
+	sum := md5.Sum(blob)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	w.Header().Set("Last-Modified", lastModified)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(blob)
+		metrics.MtrOutBytesS3Gateway.Add(float64(len(blob)))
+	}
+	return nil
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, key string) *s3Error {
+	if s.ReadOnly || s.AccessKey == "" {
+		return errAccessDenied
+	}
+	if len(key) != stream.BlobHashHexLength {
+		return &s3Error{Code: "InvalidArgument", Message: "keys must be blob hashes", Status: http.StatusBadRequest}
+	}
+	if r.ContentLength > stream.MaxBlobSize {
+		return errEntityTooLarge
+	}
+
+	blob, err := ioutil.ReadAll(io.LimitReader(r.Body, stream.MaxBlobSize+1))
+	if err != nil {
+		return internalError(err)
+	}
+	if len(blob) > stream.MaxBlobSize {
+		return errEntityTooLarge
+	}
+	if e := checkPayload(r, blob); e != nil {
+		return e
+	}
+
+	client := auth.Request{
+		Action:     auth.ActionUpload,
+		Hash:       key,
+		Token:      r.Header.Get("x-amz-security-token"),
+		RemoteAddr: r.RemoteAddr,
+		Protocol:   auth.ProtocolS3,
+		Header:     r.Header,
+	}
+	if s.Upload != nil {
+		err = s.Upload(client, blob)
+	} else {
+		err = s.put(client, blob)
+	}
+	if errors.Is(err, auth.ErrForbidden) {
+		return errAccessDenied
+	} else if errors.Is(err, reflector.ErrHashMismatch) {
+		return errBadDigest
+	} else if errors.Is(err, reflector.ErrBlobTooBig) {
+		return errEntityTooLarge
+	} else if errors.Is(err, reflector.ErrRejected) {
+		return &s3Error{Code: "AccessDenied", Message: err.Error(), Status: http.StatusForbidden}
+	} else if err != nil {
+		return internalError(err)
+	}
+	metrics.MtrInBytesS3Gateway.Add(float64(len(blob)))
+
+	md5sum := md5.Sum(blob)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(md5sum[:])+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// put stores a blob in the underlying store, if the Authorizer allows it
+func (s *Server) put(client auth.Request, blob []byte) error {
+	err := auth.Check(s.Authorizer, client)
+	if err != nil {
+		return err
+	}
+	if reflector.BlobHash(blob) != client.Hash {
+		return errors.Err(reflector.ErrHashMismatch)
+	}
+	if _, sdErr := shared.ParseSDBlob(blob); sdErr == nil {
+		return s.upload.PutSD(client.Hash, blob)
+	}
+	return s.upload.Put(client.Hash, blob)
+}
+
+func (s *Server) listBuckets(w http.ResponseWriter) {
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	result := struct {
+		XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+		Owner   struct{ ID, DisplayName string }
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{Buckets: []bucket{{Name: s.Bucket, CreationDate: time.Unix(0, 0).UTC().Format(time.RFC3339)}}}
+	result.Owner.ID = "reflector"
+	result.Owner.DisplayName = "reflector"
+	writeXML(w, http.StatusOK, result)
+}
+
+// s3Error is an error response in the format S3 clients understand
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestID string `xml:"RequestId"`
+	Status    int    `xml:"-"`
+}
+
+var (
+	errNoSuchBucket   = &s3Error{Code: "NoSuchBucket", Message: "the bucket does not exist", Status: http.StatusNotFound}
+	errNoSuchKey      = &s3Error{Code: "NoSuchKey", Message: "the blob does not exist", Status: http.StatusNotFound}
+	errNotImplemented = &s3Error{Code: "NotImplemented", Message: "only getting and putting blobs is supported", Status: http.StatusNotImplemented}
+	errAccessDenied   = &s3Error{Code: "AccessDenied", Message: "access denied", Status: http.StatusForbidden}
+	errEntityTooLarge = &s3Error{Code: "EntityTooLarge", Message: "blobs can be at most " + strconv.Itoa(stream.MaxBlobSize) + " bytes", Status: http.StatusBadRequest}
+	errBadDigest      = &s3Error{Code: "BadDigest", Message: "the blob does not match its hash", Status: http.StatusBadRequest}
+	errSlowDown       = &s3Error{Code: "SlowDown", Message: "the blob is temporarily unavailable", Status: http.StatusServiceUnavailable}
+)
+
+func internalError(err error) *s3Error {
+	log.Errorf("s3 gateway: %s", errors.FullTrace(err))
+	return &s3Error{Code: "InternalError", Message: err.Error(), Status: http.StatusInternalServerError}
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	err := xml.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
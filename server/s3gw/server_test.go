@@ -0,0 +1,197 @@
+package s3gw
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/apikey"
+	"github.com/lbryio/reflector.go/db"
+	"github.com/lbryio/reflector.go/reflector"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func s3Client(t *testing.T, endpoint, secret string) *s3.S3 {
+	return s3ClientWithToken(t, endpoint, secret, "")
+}
+
+func s3ClientWithToken(t *testing.T, endpoint, secret, token string) *s3.S3 {
+	sess, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("key", secret, token),
+		Endpoint:         aws.String(endpoint),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	require.NoError(t, err)
+	return s3.New(sess)
+}
+
+func TestServer_PutGetHead(t *testing.T) {
+	mem := store.NewMemStore()
+	s := NewServer(mem, mem)
+	s.AccessKey, s.SecretKey = "key", "secret"
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	client := s3Client(t, ts.URL, "secret")
+
+	blob := []byte("this is a blob")
+	sum := sha512.Sum384(blob)
+	hash := hex.EncodeToString(sum[:])
+
+	_, err := client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(DefaultBucket),
+		Key:    aws.String(hash),
+		Body:   bytes.NewReader(blob),
+	})
+	require.NoError(t, err)
+	has, err := mem.Has(hash)
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	head, err := client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(DefaultBucket), Key: aws.String(hash)})
+	require.NoError(t, err)
+	assert.EqualValues(t, len(blob), *head.ContentLength)
+
+	got, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String(DefaultBucket), Key: aws.String(hash)})
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(got.Body)
+	require.NoError(t, err)
+	assert.Equal(t, blob, data)
+
+	_, err = client.GetObject(&s3.GetObjectInput{Bucket: aws.String(DefaultBucket), Key: aws.String(hash[:95] + "0")})
+	require.Error(t, err)
+	assert.Equal(t, s3.ErrCodeNoSuchKey, err.(awserr.Error).Code())
+
+	// a blob that doesn't match its key
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(DefaultBucket),
+		Key:    aws.String(hash[:95] + "0"),
+		Body:   bytes.NewReader(blob),
+	})
+	require.Error(t, err)
+	assert.Equal(t, "BadDigest", err.(awserr.Error).Code())
+}
+
+func TestServer_Signature(t *testing.T) {
+	mem := store.NewMemStore()
+	s := NewServer(mem, mem)
+	s.AccessKey, s.SecretKey = "key", "secret"
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	_, err := s3Client(t, ts.URL, "wrong").HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(DefaultBucket),
+		Key:    aws.String("abc"),
+	})
+	require.Error(t, err)
+	assert.Equal(t, 403, err.(awserr.RequestFailure).StatusCode())
+
+	_, err = s3Client(t, ts.URL, "secret").ListBuckets(&s3.ListBucketsInput{})
+	require.NoError(t, err)
+}
+
+func putBlob(client *s3.S3, blob []byte) error {
+	sum := sha512.Sum384(blob)
+	_, err := client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(DefaultBucket),
+		Key:    aws.String(hex.EncodeToString(sum[:])),
+		Body:   bytes.NewReader(blob),
+	})
+	return err
+}
+
+func TestServer_Uploads(t *testing.T) {
+	mem := store.NewMemStore()
+
+	// anyone could upload if there were no credentials
+	open := httptest.NewServer(NewServer(mem, mem))
+	defer open.Close()
+	err := putBlob(s3Client(t, open.URL, "secret"), []byte("blob"))
+	require.Error(t, err)
+	assert.Equal(t, "AccessDenied", err.(awserr.Error).Code())
+
+	// uploads go through the same checks as reflector uploads
+	uploads := reflector.NewServer(mem, mem)
+	uploads.MaxDailyUpload = 10
+	uploads.Offenders = reflector.NewOffenders(2, time.Hour, time.Hour)
+	var received []string
+	uploads.OnBlobReceived = func(hash string, _ bool) { received = append(received, hash) }
+	s := NewServer(mem, mem)
+	s.AccessKey, s.SecretKey = "key", "secret"
+	s.Upload = uploads.Accept
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	client := s3Client(t, ts.URL, "secret")
+
+	require.NoError(t, putBlob(client, []byte("8 bytes!")))
+	assert.Len(t, received, 1)
+	err = putBlob(client, []byte("over the limit"))
+	require.Error(t, err)
+	assert.Equal(t, "AccessDenied", err.(awserr.Error).Code())
+
+	// corrupt blobs get the client banned
+	for i := 0; i < 2; i++ {
+		_, err = client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(DefaultBucket),
+			Key:    aws.String(strings.Repeat("0", 96)),
+			Body:   bytes.NewReader([]byte("a")),
+		})
+		require.Error(t, err)
+		assert.Equal(t, "BadDigest", err.(awserr.Error).Code())
+	}
+	assert.Len(t, uploads.Offenders.List(), 1)
+	err = putBlob(client, []byte("b"))
+	require.Error(t, err)
+	assert.Equal(t, "AccessDenied", err.(awserr.Error).Code())
+}
+
+func TestServer_APIKeys(t *testing.T) {
+	if !db.SQLiteSupported {
+		t.Skip("sqlite needs cgo")
+	}
+	sqlDB := &db.SQL{}
+	require.NoError(t, sqlDB.Connect(db.SQLitePrefix+filepath.Join(t.TempDir(), "reflector.db")))
+	keys := apikey.New(sqlDB)
+	require.NoError(t, keys.Start())
+	defer keys.Shutdown()
+	token, _, err := keys.Create("publisher", 10, 0)
+	require.NoError(t, err)
+
+	mem := store.NewMemStore()
+	uploads := reflector.NewServer(mem, mem)
+	uploads.APIKeys = keys
+	s := NewServer(mem, mem)
+	s.AccessKey, s.SecretKey = "key", "secret"
+	s.Upload = uploads.Accept
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	err = putBlob(s3Client(t, ts.URL, "secret"), []byte("no key"))
+	require.Error(t, err)
+	assert.Equal(t, "AccessDenied", err.(awserr.Error).Code())
+	err = putBlob(s3ClientWithToken(t, ts.URL, "secret", "wrong"), []byte("wrong key"))
+	require.Error(t, err)
+	assert.Equal(t, "AccessDenied", err.(awserr.Error).Code())
+
+	client := s3ClientWithToken(t, ts.URL, "secret", token)
+	require.NoError(t, putBlob(client, []byte("8 bytes!")))
+	assert.EqualValues(t, 8, keys.List()[0].BytesToday)
+	err = putBlob(client, []byte("over the quota"))
+	require.Error(t, err)
+	assert.Equal(t, "AccessDenied", err.(awserr.Error).Code())
+}
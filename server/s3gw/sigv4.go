@@ -0,0 +1,179 @@
+package s3gw
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// requests signed longer ago than this, or this far in the future, are turned away
+const maxClockSkew = 15 * time.Minute
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	amzDateFormat   = "20060102T150405Z"
+)
+
+var (
+	errSignature       = &s3Error{Code: "SignatureDoesNotMatch", Message: "the request signature does not match", Status: http.StatusForbidden}
+	errInvalidKey      = &s3Error{Code: "InvalidAccessKeyId", Message: "unknown access key", Status: http.StatusForbidden}
+	errMissingAuth     = &s3Error{Code: "AccessDenied", Message: "requests must be signed with aws signature v4 in the Authorization header", Status: http.StatusForbidden}
+	errSkewed          = &s3Error{Code: "RequestTimeTooSkewed", Message: "the request time is too far from the server time", Status: http.StatusForbidden}
+	errContentSHA256   = &s3Error{Code: "XAmzContentSHA256Mismatch", Message: "the body does not match x-amz-content-sha256", Status: http.StatusBadRequest}
+	errStreamingUpload = &s3Error{Code: "NotImplemented", Message: "streaming uploads are not supported", Status: http.StatusNotImplemented}
+)
+
+// sigV4Auth is the parsed Authorization header of a request signed with aws signature v4
+type sigV4Auth struct {
+	accessKey     string
+	scope         string // date/region/service/aws4_request
+	signedHeaders []string
+	signature     string
+}
+
+// parseSigV4Auth parses a header like
+// AWS4-HMAC-SHA256 Credential=AKID/20130524/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-date, Signature=abc
+func parseSigV4Auth(header string) (sigV4Auth, bool) {
+	var a sigV4Auth
+	if !strings.HasPrefix(header, sigV4Algorithm+" ") {
+		return a, false
+	}
+	for _, field := range strings.Split(strings.TrimPrefix(header, sigV4Algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return a, false
+		}
+		switch kv[0] {
+		case "Credential":
+			cred := strings.SplitN(kv[1], "/", 2)
+			if len(cred) != 2 {
+				return a, false
+			}
+			a.accessKey, a.scope = cred[0], cred[1]
+		case "SignedHeaders":
+			a.signedHeaders = strings.Split(kv[1], ";")
+		case "Signature":
+			a.signature = kv[1]
+		}
+	}
+	ok := a.accessKey != "" && len(strings.Split(a.scope, "/")) == 4 && len(a.signedHeaders) > 0 && a.signature != ""
+	return a, ok
+}
+
+// checkSignature checks that the request was signed with the server's credentials
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *Server) checkSignature(r *http.Request) *s3Error {
+	a, ok := parseSigV4Auth(r.Header.Get("Authorization"))
+	if !ok {
+		return errMissingAuth
+	}
+	if a.accessKey != s.AccessKey {
+		return errInvalidKey
+	}
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return errStreamingUpload
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	signedAt, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil {
+		return errMissingAuth
+	}
+	if skew := time.Since(signedAt); skew > maxClockSkew || skew < -maxClockSkew {
+		return errSkewed
+	}
+	if !strings.HasPrefix(a.scope, signedAt.Format("20060102")+"/") {
+		return errSignature
+	}
+
+	stringToSign := sigV4Algorithm + "\n" + amzDate + "\n" + a.scope + "\n" + sha256Hex([]byte(canonicalRequest(r, a.signedHeaders)))
+	scope := strings.Split(a.scope, "/")
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range scope {
+		key = hmacSHA256(key, part)
+	}
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(a.signature)) {
+		return errSignature
+	}
+	return nil
+}
+
+// canonicalRequest is what the signature of a request is computed over
+func canonicalRequest(r *http.Request, signedHeaders []string) string {
+	var b strings.Builder
+	b.WriteString(r.Method + "\n")
+	b.WriteString(r.URL.EscapedPath() + "\n")
+	b.WriteString(canonicalQuery(r.URL.Query()) + "\n")
+	for _, name := range signedHeaders {
+		var value string
+		if name == "host" {
+			value = r.Host
+		} else {
+			values := r.Header.Values(name)
+			for i := range values {
+				values[i] = strings.Join(strings.Fields(values[i]), " ")
+			}
+			value = strings.Join(values, ",")
+		}
+		b.WriteString(name + ":" + value + "\n")
+	}
+	b.WriteString("\n" + strings.Join(signedHeaders, ";") + "\n")
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = unsignedPayload
+	}
+	b.WriteString(payload)
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode encodes everything but unreserved characters, the way aws signatures want it
+func uriEncode(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// checkPayload checks the body of a signed upload against the hash it was signed with
+func checkPayload(r *http.Request, body []byte) *s3Error {
+	signed := r.Header.Get("X-Amz-Content-Sha256")
+	if signed == "" || signed == unsignedPayload {
+		return nil
+	}
+	if sha256Hex(body) != signed {
+		return errContentSHA256
+	}
+	return nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
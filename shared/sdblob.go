@@ -0,0 +1,131 @@
+package shared
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+)
+
+// ErrInvalidSDBlob is returned when a blob can't be parsed as an sd blob or describes an invalid stream
+var ErrInvalidSDBlob = errors.Base("invalid sd blob")
+
+// SDBlob is a parsed and validated sd blob
+type SDBlob struct {
+	stream.SDBlob
+	hash string
+}
+
+// StreamInfo describes a stream as listed in its sd blob
+type StreamInfo struct {
+	SDHash            string       `json:"sd_hash"`
+	StreamHash        string       `json:"stream_hash"`
+	StreamName        string       `json:"stream_name"`
+	SuggestedFileName string       `json:"suggested_file_name"`
+	StreamType        string       `json:"stream_type"`
+	Blobs             []StreamBlob `json:"blobs"`
+	// sum of the lengths of the content blobs. the decrypted file is up to 16 bytes per blob shorter than this
+	TotalLength int64 `json:"total_length"`
+}
+
+// StreamBlob is one content blob of a stream
+type StreamBlob struct {
+	BlobNum  int    `json:"blob_num"`
+	BlobHash string `json:"blob_hash"`
+	Length   int    `json:"length"`
+	IV       string `json:"iv"`
+}
+
+// ParseSDBlob parses an sd blob and checks that the stream it describes is consistent: the stream hash matches, the
+// blobs are in order, the list ends with the 0-length terminating blob, and the blob hashes and IVs have the right
+// size.
+func ParseSDBlob(data []byte) (*SDBlob, error) {
+	sd := &SDBlob{hash: stream.Blob(data).HashHex()}
+	err := sd.FromBlob(data)
+	if err != nil {
+		return nil, errors.Prefix(err.Error(), ErrInvalidSDBlob)
+	}
+	if !sd.IsValid() {
+		return nil, errors.Prefix("stream hash does not match", ErrInvalidSDBlob)
+	}
+	if len(sd.BlobInfos) < 1 || sd.BlobInfos[len(sd.BlobInfos)-1].Length != 0 {
+		return nil, errors.Prefix("missing the terminating 0-length blob", ErrInvalidSDBlob)
+	}
+	for i, info := range sd.BlobInfos {
+		if info.BlobNum != i {
+			return nil, errors.Prefix("blobs are out of order", ErrInvalidSDBlob)
+		}
+		if info.Length == 0 && i != len(sd.BlobInfos)-1 {
+			return nil, errors.Prefix("0-length blob before the end of the stream", ErrInvalidSDBlob)
+		}
+		if info.Length > stream.MaxBlobSize {
+			return nil, errors.Prefix("blob is too large", ErrInvalidSDBlob)
+		}
+		if info.Length > 0 && len(info.BlobHash) != stream.BlobHashSize {
+			return nil, errors.Prefix("blob hash has the wrong size", ErrInvalidSDBlob)
+		}
+		if len(info.IV) != aes.BlockSize {
+			return nil, errors.Prefix("iv has the wrong size", ErrInvalidSDBlob)
+		}
+	}
+	return sd, nil
+}
+
+// DecryptBlob decrypts a content blob of a stream. Unlike stream.Blob.Plaintext, which panics on a blob that isn't a
+// whole number of AES blocks or has a padding length larger than the blob, it returns an error for any blob, since
+// blobs and sd blobs come from uploaders.
+func DecryptBlob(b stream.Blob, key, iv []byte) ([]byte, error) {
+	if len(iv) != aes.BlockSize {
+		return nil, errors.Err("iv is %d bytes instead of %d", len(iv), aes.BlockSize)
+	}
+	if len(b) == 0 || len(b)%aes.BlockSize != 0 {
+		return nil, errors.Err("blob length %d is not a multiple of the aes block size", len(b))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	data := make([]byte, len(b))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, b)
+
+	padLen := int(data[len(data)-1])
+	if padLen == 0 || padLen > aes.BlockSize || !bytes.Equal(data[len(data)-padLen:], bytes.Repeat([]byte{byte(padLen)}, padLen)) {
+		return nil, errors.Err("invalid padding")
+	}
+	return data[:len(data)-padLen], nil
+}
+
+// SDHash returns the hex hash of the sd blob
+func (s *SDBlob) SDHash() string {
+	return s.hash
+}
+
+// ContentBlobs returns the blobs that hold the stream's data, in order, without the terminating 0-length blob
+func (s *SDBlob) ContentBlobs() []stream.BlobInfo {
+	return s.BlobInfos[:len(s.BlobInfos)-1]
+}
+
+// Info summarizes the stream
+func (s *SDBlob) Info() StreamInfo {
+	info := StreamInfo{
+		SDHash:            s.hash,
+		StreamHash:        hex.EncodeToString(s.StreamHash),
+		StreamName:        s.StreamName,
+		SuggestedFileName: s.SuggestedFileName,
+		StreamType:        s.StreamType,
+		Blobs:             make([]StreamBlob, 0, len(s.BlobInfos)-1),
+	}
+	for _, b := range s.ContentBlobs() {
+		info.Blobs = append(info.Blobs, StreamBlob{
+			BlobNum:  b.BlobNum,
+			BlobHash: hex.EncodeToString(b.BlobHash),
+			Length:   b.Length,
+			IV:       hex.EncodeToString(b.IV),
+		})
+		info.TotalLength += int64(b.Length)
+	}
+	return info
+}
@@ -0,0 +1,124 @@
+package shared
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSDBlob(t *testing.T) {
+	data := make([]byte, stream.MaxBlobSize+100)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	s, err := stream.New(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	sd, err := ParseSDBlob(s[0])
+	require.NoError(t, err)
+	assert.Equal(t, s[0].HashHex(), sd.SDHash())
+
+	info := sd.Info()
+	require.Len(t, info.Blobs, len(s)-1)
+	var total int64
+	for i, b := range info.Blobs {
+		assert.Equal(t, i, b.BlobNum)
+		assert.Equal(t, s[i+1].HashHex(), b.BlobHash)
+		assert.Equal(t, s[i+1].Size(), b.Length)
+		total += int64(b.Length)
+	}
+	assert.Equal(t, total, info.TotalLength)
+	assert.Equal(t, hex.EncodeToString(sd.StreamHash), info.StreamHash)
+}
+
+func TestParseSDBlob_Invalid(t *testing.T) {
+	_, err := ParseSDBlob([]byte("not json"))
+	assert.True(t, errors.Is(err, ErrInvalidSDBlob))
+
+	_, err = ParseSDBlob([]byte(`{"blobs":[],"stream_type":"lbryfile"}`))
+	assert.True(t, errors.Is(err, ErrInvalidSDBlob))
+}
+
+func TestParseSDBlob_BadSizes(t *testing.T) {
+	data := make([]byte, 1000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	s, err := stream.New(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		modify func(sd *stream.SDBlob)
+	}{
+		{"short blob hash", func(sd *stream.SDBlob) { sd.BlobInfos[0].BlobHash = sd.BlobInfos[0].BlobHash[:8] }},
+		{"empty blob hash", func(sd *stream.SDBlob) { sd.BlobInfos[0].BlobHash = nil }},
+		{"short iv", func(sd *stream.SDBlob) { sd.BlobInfos[0].IV = sd.BlobInfos[0].IV[:4] }},
+		{"empty iv", func(sd *stream.SDBlob) { sd.BlobInfos[0].IV = nil }},
+		{"short terminator iv", func(sd *stream.SDBlob) { sd.BlobInfos[1].IV = sd.BlobInfos[1].IV[:4] }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sd := &stream.SDBlob{}
+			require.NoError(t, sd.FromBlob(s[0]))
+			tt.modify(sd)
+			sd.StreamHash = streamHash(sd)
+
+			_, err := ParseSDBlob(sd.ToBlob())
+			assert.True(t, errors.Is(err, ErrInvalidSDBlob), "got %v", err)
+			assert.Contains(t, err.Error(), "wrong size")
+		})
+	}
+}
+
+// streamHash computes the stream hash like lbry.go does, so that a modified sd blob still passes the stream hash check
+func streamHash(sd *stream.SDBlob) []byte {
+	blobSum := sha512.New384()
+	for _, b := range sd.BlobInfos {
+		blobSum.Write(b.Hash())
+	}
+	sum := sha512.New384()
+	sum.Write([]byte(hex.EncodeToString([]byte(sd.StreamName))))
+	sum.Write([]byte(hex.EncodeToString(sd.Key)))
+	sum.Write([]byte(hex.EncodeToString([]byte(sd.SuggestedFileName))))
+	sum.Write(blobSum.Sum(nil))
+	return sum.Sum(nil)
+}
+
+func TestDecryptBlob(t *testing.T) {
+	data := make([]byte, 1000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	s, err := stream.New(bytes.NewReader(data))
+	require.NoError(t, err)
+	sd, err := ParseSDBlob(s[0])
+	require.NoError(t, err)
+
+	info := sd.BlobInfos[0]
+	plain, err := DecryptBlob(s[1], sd.Key, info.IV)
+	require.NoError(t, err)
+	assert.Equal(t, data, plain)
+
+	_, err = DecryptBlob(s[1][:len(s[1])-1], sd.Key, info.IV)
+	assert.Error(t, err, "misaligned blob")
+	_, err = DecryptBlob(stream.Blob{}, sd.Key, info.IV)
+	assert.Error(t, err, "empty blob")
+	_, err = DecryptBlob(s[1], sd.Key, info.IV[:8])
+	assert.Error(t, err, "short iv")
+
+	// a last block that decrypts to a padding length larger than the block
+	block, err := aes.NewCipher(sd.Key)
+	require.NoError(t, err)
+	badPad := bytes.Repeat([]byte{0xff}, aes.BlockSize)
+	cipher.NewCBCEncrypter(block, info.IV).CryptBlocks(badPad, badPad)
+	_, err = DecryptBlob(badPad, sd.Key, info.IV)
+	assert.Error(t, err, "bad padding")
+}
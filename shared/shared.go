@@ -1,25 +1,61 @@
 package shared
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
 )
 
+// BlobStack is one hop of a blob request: a store the request went through. Timing is the time spent in the store,
+// including the stores below it
 type BlobStack struct {
 	Timing     time.Duration `json:"timing"`
 	OriginName string        `json:"origin_name"`
 	HostName   string        `json:"host_name"`
+	Cache      CacheResult   `json:"cache,omitempty"`
+	// RequestID is the id of the request on the host that served this hop, to find it in that host's logs
+	RequestID string `json:"request_id,omitempty"`
 }
+
+// CacheResult says whether a caching store had the blob. It's empty for stores that don't cache
+type CacheResult string
+
+const (
+	CacheHit  CacheResult = "hit"
+	CacheMiss CacheResult = "miss"
+)
+
+// CacheResultOf returns CacheHit if hit is true and CacheMiss otherwise
+func CacheResultOf(hit bool) CacheResult {
+	if hit {
+		return CacheHit
+	}
+	return CacheMiss
+}
+
 type BlobTrace struct {
 	Stacks []BlobStack `json:"stacks"`
 }
 
 var hostName *string
 
+// SetHostName sets the name this host goes by in traces. It defaults to the hostname, and must be set before any
+// traces are made
+func SetHostName(name string) {
+	hostName = &name
+}
+
+// HostName returns the name this host goes by in traces
+func HostName() string {
+	return getHostName()
+}
+
 func getHostName() string {
 	if hostName == nil {
 		hn, err := os.Hostname()
@@ -38,6 +74,52 @@ func (b *BlobTrace) Stack(timing time.Duration, originName string) BlobTrace {
 	})
 	return *b
 }
+
+// StackCache adds a hop for a caching store, recording whether the blob came from the cache
+func (b *BlobTrace) StackCache(timing time.Duration, originName string, cache CacheResult) BlobTrace {
+	b.Stacks = append(b.Stacks, BlobStack{
+		Timing:     timing,
+		OriginName: originName,
+		HostName:   getHostName(),
+		Cache:      cache,
+	})
+	return *b
+}
+
+// Served stamps the hops this host added to the trace with the id of the request it's serving. Hops of other hosts
+// keep the ids they were stamped with there
+func (b *BlobTrace) Served(requestID string) BlobTrace {
+	host := getHostName()
+	for i := range b.Stacks {
+		if b.Stacks[i].HostName == host && b.Stacks[i].RequestID == "" {
+			b.Stacks[i].RequestID = requestID
+		}
+	}
+	return *b
+}
+
+// RequestIDHeader is the http header a request id is passed in. A server uses the id it's given, and makes one up
+// otherwise
+const RequestIDHeader = "X-Request-Id"
+
+// NewRequestID returns a random id for a request
+func NewRequestID() string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+// RequestIDOrNew returns the request id a client sent, or a new one if it didn't send a usable one
+func RequestIDOrNew(id string) string {
+	if id == "" || len(id) > 64 {
+		return NewRequestID()
+	}
+	return id
+}
+
 func (b *BlobTrace) Merge(otherTrance BlobTrace) BlobTrace {
 	b.Stacks = append(b.Stacks, otherTrance.Stacks...)
 	return *b
@@ -59,24 +141,76 @@ func (b BlobTrace) String() string {
 		if i > 0 {
 			delta = stack.Timing - b.Stacks[i-1].Timing
 		}
-		fullTrace += fmt.Sprintf("[%d](%s) origin: %s - timing: %s - delta: %s\n", i, stack.HostName, stack.OriginName, stack.Timing.String(), delta.String())
+		fullTrace += fmt.Sprintf("[%d](%s) origin: %s - timing: %s - delta: %s", i, stack.HostName, stack.OriginName, stack.Timing.String(), delta.String())
+		if stack.Cache != "" {
+			fullTrace += " - cache: " + string(stack.Cache)
+		}
+		if stack.RequestID != "" {
+			fullTrace += " - request: " + stack.RequestID
+		}
+		fullTrace += "\n"
 	}
 	return fullTrace
 }
 
+// wireTrace is the compact form of a trace that is sent in the Via header. Durations are in microseconds. The long
+// field names of older servers are still read
+type wireTrace struct {
+	Hops   []wireHop   `json:"h,omitempty"`
+	Stacks []BlobStack `json:"stacks,omitempty"`
+}
+
+type wireHop struct {
+	Store  string `json:"s"`
+	Host   string `json:"n,omitempty"`
+	Cache  *bool  `json:"c,omitempty"`
+	Micros int64  `json:"d"`
+	ReqID  string `json:"r,omitempty"`
+}
+
+// Serialize returns the trace as compact json, to be sent in the Via header
 func (b BlobTrace) Serialize() (string, error) {
-	t, err := json.Marshal(b)
+	w := wireTrace{Hops: make([]wireHop, len(b.Stacks))}
+	for i, stack := range b.Stacks {
+		w.Hops[i] = wireHop{
+			Store:  stack.OriginName,
+			Host:   stack.HostName,
+			Micros: stack.Timing.Microseconds(),
+			ReqID:  stack.RequestID,
+		}
+		if stack.Cache != "" {
+			hit := stack.Cache == CacheHit
+			w.Hops[i].Cache = &hit
+		}
+	}
+	t, err := json.Marshal(w)
 	if err != nil {
 		return "", errors.Err(err)
 	}
 	return string(t), nil
 }
 
+// Deserialize parses a trace from a Via header
 func Deserialize(serializedData string) (*BlobTrace, error) {
-	var trace BlobTrace
-	err := json.Unmarshal([]byte(serializedData), &trace)
+	var w wireTrace
+	err := json.Unmarshal([]byte(serializedData), &w)
 	if err != nil {
 		return nil, errors.Err(err)
 	}
+	if len(w.Hops) == 0 {
+		return &BlobTrace{Stacks: w.Stacks}, nil
+	}
+	trace := BlobTrace{Stacks: make([]BlobStack, len(w.Hops))}
+	for i, hop := range w.Hops {
+		trace.Stacks[i] = BlobStack{
+			Timing:     time.Duration(hop.Micros) * time.Microsecond,
+			OriginName: hop.Store,
+			HostName:   hop.Host,
+			RequestID:  hop.ReqID,
+		}
+		if hop.Cache != nil {
+			trace.Stacks[i].Cache = CacheResultOf(*hop.Cache)
+		}
+	}
 	return &trace, nil
 }
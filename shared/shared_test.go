@@ -1,6 +1,7 @@
 package shared
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -14,10 +15,11 @@ func TestBlobTrace_Serialize(t *testing.T) {
 	stack := NewBlobTrace(10*time.Second, "test")
 	stack.Stack(20*time.Second, "test2")
 	stack.Stack(30*time.Second, "test3")
+	stack.StackCache(40*time.Second, "test4", CacheMiss)
 	serialized, err := stack.Serialize()
 	assert.NoError(t, err)
 	t.Log(serialized)
-	expected := "{\"stacks\":[{\"timing\":10000000000,\"origin_name\":\"test\",\"host_name\":\"test_machine\"},{\"timing\":20000000000,\"origin_name\":\"test2\",\"host_name\":\"test_machine\"},{\"timing\":30000000000,\"origin_name\":\"test3\",\"host_name\":\"test_machine\"}]}"
+	expected := `{"h":[{"s":"test","n":"test_machine","d":10000000},{"s":"test2","n":"test_machine","d":20000000},{"s":"test3","n":"test_machine","d":30000000},{"s":"test4","n":"test_machine","c":false,"d":40000000}]}`
 	assert.Equal(t, expected, serialized)
 }
 
@@ -34,3 +36,51 @@ func TestBlobTrace_Deserialize(t *testing.T) {
 	assert.Equal(t, stack.Stacks[1].OriginName, "test2")
 	assert.Equal(t, stack.Stacks[2].OriginName, "test3")
 }
+
+func TestBlobTrace_RoundTrip(t *testing.T) {
+	hostName = util.PtrToString("test_machine")
+	trace := NewBlobTrace(10*time.Millisecond, "disk")
+	trace.StackCache(12*time.Millisecond, "caching", CacheHit)
+	serialized, err := trace.Serialize()
+	assert.NoError(t, err)
+	parsed, err := Deserialize(serialized)
+	assert.NoError(t, err)
+	assert.Equal(t, trace, *parsed)
+}
+
+func TestBlobTrace_Hops(t *testing.T) {
+	hostName = util.PtrToString("test_machine")
+	trace := NewBlobTrace(80*time.Millisecond, "s3")
+	trace.Stack(90*time.Millisecond, "http")
+	trace.StackCache(100*time.Millisecond, "caching", CacheMiss)
+
+	hops := trace.Hops()
+	assert.Equal(t, []Hop{
+		{Store: "caching", Host: "test_machine", Cache: CacheMiss, Total: 100 * time.Millisecond, Self: 10 * time.Millisecond},
+		{Store: "http", Host: "test_machine", Total: 90 * time.Millisecond, Self: 10 * time.Millisecond},
+		{Store: "s3", Host: "test_machine", Total: 80 * time.Millisecond, Self: 80 * time.Millisecond},
+	}, hops)
+
+	waterfall := trace.Waterfall()
+	t.Log("\n" + waterfall)
+	lines := strings.Split(strings.TrimSpace(waterfall), "\n")
+	assert.Len(t, lines, 4)
+	assert.Contains(t, lines[1], "|####------------------------------------|")
+	assert.Contains(t, lines[3], "|        ################################|")
+}
+
+func TestBlobTrace_Served(t *testing.T) {
+	hostName = util.PtrToString("test_machine")
+	upstream := BlobTrace{Stacks: []BlobStack{{OriginName: "s3", HostName: "origin", RequestID: "abc"}}}
+	upstream.Stack(time.Second, "http")
+	upstream.Served("def")
+	assert.Equal(t, "abc", upstream.Stacks[0].RequestID)
+	assert.Equal(t, "def", upstream.Stacks[1].RequestID)
+
+	serialized, err := upstream.Serialize()
+	assert.NoError(t, err)
+	parsed, err := Deserialize(serialized)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", parsed.Stacks[0].RequestID)
+	assert.Equal(t, "origin", parsed.Stacks[0].HostName)
+}
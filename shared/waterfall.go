@@ -0,0 +1,105 @@
+package shared
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Hop is the timing of one store a blob request went through
+type Hop struct {
+	Store string      `json:"store"`
+	Host  string      `json:"host"`
+	Cache CacheResult `json:"cache,omitempty"`
+	// RequestID is the id of the request on the host
+	RequestID string `json:"request_id,omitempty"`
+	// Total is the time spent in the store, including the stores below it
+	Total time.Duration `json:"total"`
+	// Self is the time spent in the store itself
+	Self time.Duration `json:"self"`
+}
+
+// Hops breaks the trace down into the time spent in each store, from the store the request came in through to the one
+// that had the blob
+func (b BlobTrace) Hops() []Hop {
+	hops := make([]Hop, len(b.Stacks))
+	for i, stack := range b.Stacks {
+		self := stack.Timing
+		if i > 0 {
+			self -= b.Stacks[i-1].Timing
+		}
+		if self < 0 {
+			// clocks of different hosts, or stores that did things in parallel
+			self = 0
+		}
+		hops[len(b.Stacks)-1-i] = Hop{
+			Store:     stack.OriginName,
+			Host:      stack.HostName,
+			Cache:     stack.Cache,
+			RequestID: stack.RequestID,
+			Total:     stack.Timing,
+			Self:      self,
+		}
+	}
+	return hops
+}
+
+// waterfallWidth is how many characters the bars of a waterfall take up
+const waterfallWidth = 40
+
+// Waterfall renders the trace as a text chart for debugging slow requests. Each line is a store, from the one the
+// request came in through to the one that had the blob. The bar of a store spans the time spent in it, with the time
+// spent in the store itself drawn as # and the time spent in the stores below it as -
+func (b BlobTrace) Waterfall() string {
+	hops := b.Hops()
+	if len(hops) == 0 {
+		return ""
+	}
+	total := hops[0].Total
+	for _, hop := range hops {
+		if hop.Total > total {
+			total = hop.Total
+		}
+	}
+	scale := func(d time.Duration) int {
+		if total <= 0 {
+			return 0
+		}
+		return int(float64(d) / float64(total) * waterfallWidth)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%-3s %-20s %-20s %-5s %10s %10s\n", "#", "store", "host", "cache", "total", "self")
+	offset := 0
+	for i, hop := range hops {
+		width := scale(hop.Total)
+		if width == 0 && hop.Total > 0 {
+			width = 1
+		}
+		if offset+width > waterfallWidth {
+			width = waterfallWidth - offset
+		}
+		self := scale(hop.Self)
+		if self > width {
+			self = width
+		}
+		bar := strings.Repeat(" ", offset) + strings.Repeat("#", self) + strings.Repeat("-", width-self)
+		fmt.Fprintf(&sb, "%-3d %-20s %-20s %-5s %10s %10s |%-*s|\n", i, hop.Store, hop.Host, hop.Cache,
+			round(hop.Total), round(hop.Self), waterfallWidth, bar)
+		// the stores below start after the time this one spent before calling them. it's not known how the self time
+		// is split up, so it's all put before
+		offset += self
+	}
+	return sb.String()
+}
+
+// round shortens durations for display
+func round(d time.Duration) time.Duration {
+	switch {
+	case d > time.Second:
+		return d.Round(time.Millisecond)
+	case d > time.Millisecond:
+		return d.Round(time.Microsecond)
+	}
+	return d
+}
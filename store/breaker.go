@@ -0,0 +1,206 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrCircuitOpen is returned instead of calling the origin while its circuit breaker is open
+var ErrCircuitOpen = errors.Base("circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+// CircuitBreakerStore stops sending requests to an origin that keeps failing.
+//
+// While closed, requests go through and their outcome is remembered. When more than ErrorRate of the last Window
+// requests failed, the breaker opens and Get and Has calls fail immediately with ErrCircuitOpen, so a dead origin
+// doesn't make every request wait for its full timeout. After OpenTimeout the breaker goes half-open and lets one
+// request through as a probe. If it succeeds the breaker closes again, otherwise it stays open for another
+// OpenTimeout. A blob that is not found is not an error. Puts and deletes are always passed through.
+type CircuitBreakerStore struct {
+	// fraction of failed requests in the window above which the breaker opens
+	ErrorRate float64
+	// number of recent requests to look at. the breaker doesn't open before this many requests were made
+	Window int
+	// how long the breaker stays open before letting a probe through
+	OpenTimeout time.Duration
+
+	origin    BlobStore
+	component string
+
+	mu       sync.Mutex
+	state    breakerState
+	results  []bool // ring buffer of recent outcomes, true means failure
+	next     int
+	count    int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreakerStore wraps origin with a circuit breaker. component identifies the breaker in metrics and logs.
+func NewCircuitBreakerStore(component string, origin BlobStore) *CircuitBreakerStore {
+	c := &CircuitBreakerStore{
+		ErrorRate:   0.5,
+		Window:      20,
+		OpenTimeout: 30 * time.Second,
+		origin:      origin,
+		component:   component,
+	}
+	c.setState(breakerClosed)
+	return c
+}
+
+const nameCircuitBreaker = "circuit-breaker"
+
+// Name is the cache type name
+func (c *CircuitBreakerStore) Name() string { return nameCircuitBreaker }
+
+// Has checks the origin, unless the breaker is open
+func (c *CircuitBreakerStore) Has(hash string) (bool, error) {
+	if !c.allow() {
+		return false, errors.Err(ErrCircuitOpen)
+	}
+	has, err := c.origin.Has(hash)
+	c.record(err)
+	return has, err
+}
+
+// Get gets the blob from the origin, unless the breaker is open
+func (c *CircuitBreakerStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
+	start := time.Now()
+	if !c.allow() {
+		return nil, shared.NewBlobTrace(time.Since(start), c.Name()), errors.Err(ErrCircuitOpen)
+	}
+	blob, trace, err := c.origin.Get(hash)
+	c.record(err)
+	return blob, trace.Stack(time.Since(start), c.Name()), err
+}
+
+// Put stores the blob in the origin
+func (c *CircuitBreakerStore) Put(hash string, blob stream.Blob) error {
+	return c.origin.Put(hash, blob)
+}
+
+// PutSD stores the sd blob in the origin
+func (c *CircuitBreakerStore) PutSD(hash string, blob stream.Blob) error {
+	return c.origin.PutSD(hash, blob)
+}
+
+// Delete deletes the blob from the origin
+func (c *CircuitBreakerStore) Delete(hash string) error {
+	return c.origin.Delete(hash)
+}
+
+// Shutdown shuts down the origin
+func (c *CircuitBreakerStore) Shutdown() {
+	c.origin.Shutdown()
+}
+
+// allow returns true if a request may be sent to the origin
+func (c *CircuitBreakerStore) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case breakerOpen:
+		if time.Since(c.openedAt) < c.OpenTimeout {
+			metrics.CircuitBreakerRejectedCount.WithLabelValues(c.component).Inc()
+			return false
+		}
+		c.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if c.probing {
+			metrics.CircuitBreakerRejectedCount.WithLabelValues(c.component).Inc()
+			return false
+		}
+		c.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (c *CircuitBreakerStore) record(err error) {
+	failed := err != nil && !errors.Is(err, ErrBlobNotFound)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == breakerHalfOpen {
+		c.probing = false
+		if failed {
+			c.open()
+		} else {
+			c.setState(breakerClosed)
+			c.next, c.count = 0, 0
+		}
+		return
+	}
+	if c.state == breakerOpen {
+		// a request that started before the breaker opened
+		return
+	}
+
+	if len(c.results) != c.Window {
+		c.results = make([]bool, c.Window)
+		c.next, c.count = 0, 0
+	}
+	c.results[c.next] = failed
+	c.next = (c.next + 1) % c.Window
+	if c.count < c.Window {
+		c.count++
+	}
+	if c.count < c.Window {
+		return
+	}
+
+	failures := 0
+	for _, f := range c.results {
+		if f {
+			failures++
+		}
+	}
+	if float64(failures)/float64(c.Window) > c.ErrorRate {
+		log.Warnf("%s: %d of the last %d requests failed, opening circuit breaker for %s", c.component, failures, c.Window, c.OpenTimeout)
+		c.open()
+	}
+}
+
+func (c *CircuitBreakerStore) open() {
+	c.openedAt = time.Now()
+	c.setState(breakerOpen)
+}
+
+func (c *CircuitBreakerStore) setState(s breakerState) {
+	if c.state != s {
+		log.Debugf("%s: circuit breaker is now %s", c.component, s)
+	}
+	c.state = s
+	metrics.CircuitBreakerState.WithLabelValues(c.component).Set(float64(s))
+}
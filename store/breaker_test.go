@@ -0,0 +1,61 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyStore is a MemStore whose Get and Has fail while failing is set
+type flakyStore struct {
+	*MemStore
+	failing bool
+}
+
+func (f *flakyStore) Has(hash string) (bool, error) {
+	if f.failing {
+		return false, errors.Err("origin is down")
+	}
+	return f.MemStore.Has(hash)
+}
+
+func TestCircuitBreakerStore_OpensAndRecovers(t *testing.T) {
+	origin := &flakyStore{MemStore: NewMemStore(), failing: true}
+	require.NoError(t, origin.Put("hash", []byte("blob")))
+
+	s := NewCircuitBreakerStore("test", origin)
+	s.Window = 4
+	s.OpenTimeout = 50 * time.Millisecond
+
+	for i := 0; i < s.Window; i++ {
+		_, err := s.Has("hash")
+		assert.Error(t, err)
+		assert.False(t, errors.Is(err, ErrCircuitOpen))
+	}
+
+	_, err := s.Has("hash")
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+
+	origin.failing = false
+	time.Sleep(s.OpenTimeout)
+
+	has, err := s.Has("hash")
+	require.NoError(t, err)
+	assert.True(t, has)
+	assert.Equal(t, breakerClosed, s.state)
+}
+
+func TestCircuitBreakerStore_NotFoundIsNotAFailure(t *testing.T) {
+	s := NewCircuitBreakerStore("test", NewMemStore())
+	s.Window = 2
+
+	for i := 0; i < 2*s.Window; i++ {
+		_, _, err := s.Get("missing")
+		assert.True(t, errors.Is(err, ErrBlobNotFound))
+	}
+	assert.Equal(t, breakerClosed, s.state)
+}
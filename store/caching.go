@@ -1,9 +1,12 @@
 package store
 
 import (
+	"os"
 	"time"
 
 	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/internal/shadow"
+	"github.com/lbryio/reflector.go/internal/tinylfu"
 	"github.com/lbryio/reflector.go/shared"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
@@ -16,6 +19,15 @@ import (
 // Accessed blobs are stored in and retrieved from the cache. If they are not in the cache, they
 // are retrieved from the origin and cached. Puts are cached and also forwarded to the origin.
 type CachingStore struct {
+	// Policy decides whether a get that fails in the cache goes on to the origin. If it's nil, only blobs that are not
+	// in the cache are fetched from the origin and other errors are returned
+	Policy *TierPolicy
+	// Admission, if set, decides which blobs fetched from the origin are kept in the cache, so blobs that are only
+	// requested once don't push out popular ones. Puts are always cached
+	Admission *tinylfu.Filter
+	// Shadow, if set, simulates other caches on the requests of this one
+	Shadow *shadow.Simulator
+
 	origin, cache BlobStore
 	component     string
 }
@@ -29,6 +41,16 @@ func NewCachingStore(component string, origin, cache BlobStore) *CachingStore {
 	}
 }
 
+// EnableAdmission sets an Admission filter for a cache that holds about size blobs. The estimated hit rate gain of
+// each of its windows goes to the metrics
+func (c *CachingStore) EnableAdmission(size int) {
+	f := tinylfu.New(size)
+	f.OnWindow = func(s tinylfu.Stats) {
+		metrics.CacheAdmissionHitRateGain.With(metrics.CacheLabels(c.cache.Name(), c.component)).Set(s.HitRateGain())
+	}
+	c.Admission = f
+}
+
 const nameCaching = "caching"
 
 // Name is the cache type name
@@ -43,12 +65,38 @@ func (c *CachingStore) Has(hash string) (bool, error) {
 	return c.origin.Has(hash)
 }
 
+// hasMany looks up the hashes in the cache, and the ones it doesn't have in the origin
+func (c *CachingStore) hasMany(hashes []string) (map[string]bool, error) {
+	exists, err := HasMany(c.cache, hashes)
+	if err != nil || len(exists) == len(hashes) {
+		return exists, err
+	}
+	var missing []string
+	for _, h := range hashes {
+		if !exists[h] {
+			missing = append(missing, h)
+		}
+	}
+	inOrigin, err := HasMany(c.origin, missing)
+	if err != nil {
+		return nil, err
+	}
+	for h := range inOrigin {
+		exists[h] = true
+	}
+	return exists, nil
+}
+
 // Get tries to get the blob from the cache first, falling back to the origin. If the blob comes
 // from the origin, it is also stored in the cache.
 func (c *CachingStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
 	start := time.Now()
-	blob, trace, err := c.cache.Get(hash)
-	if err == nil || !errors.Is(err, ErrBlobNotFound) {
+	policy := policyOr(c.Policy, fallbackOnMiss)
+	blob, trace, next, err := policy.get(c.component, c.cache, hash)
+	if c.Admission != nil && c.Admission.Record(hash, !next) {
+		metrics.CacheAdmissionRegretCount.With(metrics.CacheLabels(c.cache.Name(), c.component)).Inc()
+	}
+	if !next {
 		metrics.CacheHitCount.With(metrics.CacheLabels(c.cache.Name(), c.component)).Inc()
 		rate := float64(len(blob)) / 1024 / 1024 / time.Since(start).Seconds()
 		metrics.CacheRetrievalSpeed.With(map[string]string{
@@ -56,21 +104,36 @@ func (c *CachingStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
 			metrics.LabelComponent: c.component,
 			metrics.LabelSource:    "cache",
 		}).Set(rate)
-		return blob, trace.Stack(time.Since(start), c.Name()), err
+		metrics.CacheRetrievalSeconds.With(map[string]string{
+			metrics.LabelCacheType: c.cache.Name(),
+			metrics.LabelComponent: c.component,
+			metrics.LabelSource:    "cache",
+		}).Observe(time.Since(start).Seconds())
+		if c.Shadow != nil && err == nil {
+			c.Shadow.Record(hash, len(blob))
+		}
+		return blob, trace.StackCache(time.Since(start), c.Name(), shared.CacheHit), err
 	}
 
 	metrics.CacheMissCount.With(metrics.CacheLabels(c.cache.Name(), c.component)).Inc()
 
-	blob, trace, err = c.origin.Get(hash)
+	blob, trace, _, err = policy.get(c.component, c.origin, hash)
 	if err != nil {
-		return nil, trace.Stack(time.Since(start), c.Name()), err
+		return nil, trace.StackCache(time.Since(start), c.Name(), shared.CacheMiss), err
+	}
+	if c.Shadow != nil {
+		c.Shadow.Record(hash, len(blob))
+	}
+	if c.Admission != nil && !c.Admission.Admit(hash) {
+		metrics.CacheAdmissionRejectedCount.With(metrics.CacheLabels(c.cache.Name(), c.component)).Inc()
+		return blob, trace.StackCache(time.Since(start), c.Name(), shared.CacheMiss), nil
 	}
 	// do not do this async unless you're prepared to deal with mayhem
 	err = c.cache.Put(hash, blob)
 	if err != nil {
 		log.Errorf("error saving blob to underlying cache: %s", errors.FullTrace(err))
 	}
-	return blob, trace.Stack(time.Since(start), c.Name()), nil
+	return blob, trace.StackCache(time.Since(start), c.Name(), shared.CacheMiss), nil
 }
 
 // Put stores the blob in the origin and the cache
@@ -100,6 +163,34 @@ func (c *CachingStore) Delete(hash string) error {
 	return c.cache.Delete(hash)
 }
 
+// list returns the blobs in the cache
+func (c *CachingStore) list() ([]string, error) {
+	return List(c.cache)
+}
+
+func (c *CachingStore) listPage(after string, limit int) ([]string, error) {
+	return ListPage(c.cache, after, limit)
+}
+
+// openFile opens the blob from the cache. A miss is ErrNotFile, so the blob is fetched from the origin and cached by Get
+func (c *CachingStore) openFile(hash string) (*os.File, shared.BlobTrace, error) {
+	start := time.Now()
+	f, trace, err := OpenFile(c.cache, hash)
+	if err != nil {
+		return nil, trace.Stack(time.Since(start), c.Name()), err
+	}
+	metrics.CacheHitCount.With(metrics.CacheLabels(c.cache.Name(), c.component)).Inc()
+	if c.Admission != nil {
+		c.Admission.Record(hash, true)
+	}
+	if c.Shadow != nil {
+		if info, err := f.Stat(); err == nil {
+			c.Shadow.Record(hash, int(info.Size()))
+		}
+	}
+	return f, trace.StackCache(time.Since(start), c.Name(), shared.CacheHit), nil
+}
+
 // Shutdown shuts down the store gracefully
 func (c *CachingStore) Shutdown() {
 	c.origin.Shutdown()
@@ -176,3 +176,54 @@ func (s *SlowBlobStore) Delete(hash string) error {
 func (s *SlowBlobStore) Shutdown() {
 	return
 }
+
+func TestCachingStore_Admission(t *testing.T) {
+	origin := NewMemStore()
+	cache := NewMemStore()
+	s := NewCachingStore("test", origin, cache)
+	s.EnableAdmission(100)
+
+	err := origin.Put("popular", []byte("popular blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = origin.Put("once", []byte("blob requested once"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hash := range []string{"once", "popular", "popular"} {
+		if _, _, err := s.Get(hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if has, _ := cache.Has("once"); has {
+		t.Error("expected a blob requested once not to be cached")
+	}
+	if has, _ := cache.Has("popular"); !has {
+		t.Error("expected a blob requested twice to be cached")
+	}
+}
+
+func TestCachingStore_HasMany(t *testing.T) {
+	origin := NewMemStore()
+	cache := NewMemStore()
+	s := NewCachingStore("test", origin, cache)
+
+	err := origin.Put("origin", []byte("blob in the origin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.Put("cache", []byte("blob in the cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := HasMany(s, []string{"origin", "cache", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists["origin"] || !exists["cache"] || exists["missing"] {
+		t.Errorf("expected origin and cache to exist and missing not to, got %v", exists)
+	}
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -45,7 +46,7 @@ func (c *CloudFrontROStore) Has(hash string) (bool, error) {
 	case http.StatusOK:
 		return true, nil
 	default:
-		return false, errors.Err("unexpected status %d", status)
+		return false, statusErr(status, fmt.Sprintf("unexpected status %d", status))
 	}
 }
 
@@ -73,7 +74,8 @@ func (c *CloudFrontROStore) Get(hash string) (stream.Blob, shared.BlobTrace, err
 		metrics.MtrInBytesS3.Add(float64(len(b)))
 		return b, shared.NewBlobTrace(time.Since(start), c.Name()), nil
 	default:
-		return nil, shared.NewBlobTrace(time.Since(start), c.Name()), errors.Err("unexpected status %d", status)
+		return nil, shared.NewBlobTrace(time.Since(start), c.Name()),
+			statusErr(status, fmt.Sprintf("unexpected status %d", status))
 	}
 }
 
@@ -2,6 +2,7 @@ package store
 
 import (
 	"encoding/json"
+	"os"
 	"sync"
 	"time"
 
@@ -16,6 +17,11 @@ import (
 
 // DBBackedStore is a store that's backed by a DB. The DB contains data about what's in the store.
 type DBBackedStore struct {
+	// OnDelete is called after a blob was deleted, if it's set
+	OnDelete func(hash string)
+	// OnBlocklistHit is called when Wants turns a blob away because it's blocked, if it's set
+	OnBlocklistHit func(hash string)
+
 	blobs        BlobStore
 	db           *db.SQL
 	blockedMu    sync.RWMutex
@@ -38,6 +44,11 @@ func (d *DBBackedStore) Has(hash string) (bool, error) {
 	return d.db.HasBlob(hash, false)
 }
 
+// hasMany looks up which of the hashes are in the store with one query
+func (d *DBBackedStore) hasMany(hashes []string) (map[string]bool, error) {
+	return d.db.HasBlobs(hashes, false)
+}
+
 // Get gets the blob
 func (d *DBBackedStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
 	start := time.Now()
@@ -70,11 +81,16 @@ func (d *DBBackedStore) Put(hash string, blob stream.Blob) error {
 	return d.db.AddBlob(hash, len(blob), true)
 }
 
-// PutSD stores the SDBlob in the S3 store. It will return an error if the sd blob is missing the stream hash or if
-// there is an error storing the blob information in the DB.
+// PutSD stores the SDBlob in the S3 store. It will return an error if the sd blob is not valid or if there is an
+// error storing the blob information in the DB. The stream stays pending in the DB, and is not served, until all
+// of its blobs are stored.
 func (d *DBBackedStore) PutSD(hash string, blob stream.Blob) error {
+	_, err := shared.ParseSDBlob(blob)
+	if err != nil {
+		return err
+	}
 	var blobContents db.SdBlob
-	err := json.Unmarshal(blob, &blobContents)
+	err = json.Unmarshal(blob, &blobContents)
 	if err != nil {
 		return errors.Err(err)
 	}
@@ -96,7 +112,56 @@ func (d *DBBackedStore) Delete(hash string) error {
 		return err
 	}
 
-	return d.db.Delete(hash)
+	err = d.db.Delete(hash)
+	if err != nil {
+		return err
+	}
+	d.deleted(hash)
+	return nil
+}
+
+// DeleteStream deletes the stream of an sd blob, with the sd blob and the content blobs no other stream has. It returns
+// the blobs that were deleted. A blob that another stream took in the meantime is kept
+func (d *DBBackedStore) DeleteStream(sdHash string) ([]string, error) {
+	unreferenced, err := d.db.DeleteStream(sdHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, hash := range unreferenced {
+		ok, err := d.DeleteIfUnreferenced(hash)
+		if err != nil {
+			return deleted, err
+		}
+		if !ok {
+			log.Debugf("keeping %s, another stream has it", hash)
+			continue
+		}
+		deleted = append(deleted, hash)
+	}
+	return deleted, nil
+}
+
+// DeleteIfUnreferenced deletes the blob, unless a stream has it. It returns whether the blob was deleted
+func (d *DBBackedStore) DeleteIfUnreferenced(hash string) (bool, error) {
+	// the blob leaves the db first, so it's never in the db without being in the store
+	ok, err := d.db.DeleteIfUnreferenced(hash)
+	if err != nil || !ok {
+		return false, err
+	}
+	err = d.blobs.Delete(hash)
+	if err != nil {
+		return false, err
+	}
+	d.deleted(hash)
+	return true, nil
+}
+
+func (d *DBBackedStore) deleted(hash string) {
+	if d.OnDelete != nil {
+		d.OnDelete(hash)
+	}
 }
 
 // Block deletes the blob and prevents it from being uploaded in the future
@@ -127,6 +192,7 @@ func (d *DBBackedStore) Block(hash string) error {
 		if err != nil {
 			return err
 		}
+		d.deleted(hash)
 	}
 
 	return d.markBlocked(hash)
@@ -135,6 +201,9 @@ func (d *DBBackedStore) Block(hash string) error {
 // Wants returns false if the hash exists or is blocked, true otherwise
 func (d *DBBackedStore) Wants(hash string) (bool, error) {
 	blocked, err := d.isBlocked(hash)
+	if blocked && d.OnBlocklistHit != nil {
+		d.OnBlocklistHit(hash)
+	}
 	if blocked || err != nil {
 		return false, err
 	}
@@ -195,7 +264,30 @@ func (d *DBBackedStore) initBlocked() error {
 	return err
 }
 
+func (d *DBBackedStore) list() ([]string, error) {
+	return List(d.blobs)
+}
+
+func (d *DBBackedStore) listPage(after string, limit int) ([]string, error) {
+	return ListPage(d.blobs, after, limit)
+}
+
+// openFile opens the file of the blob if the db says it's stored, like Get
+func (d *DBBackedStore) openFile(hash string) (*os.File, shared.BlobTrace, error) {
+	start := time.Now()
+	has, err := d.db.HasBlob(hash, true)
+	if err != nil {
+		return nil, shared.NewBlobTrace(time.Since(start), d.Name()), err
+	}
+	if !has {
+		return nil, shared.NewBlobTrace(time.Since(start), d.Name()), errors.Err(ErrNotFile)
+	}
+	f, trace, err := OpenFile(d.blobs, hash)
+	return f, trace.Stack(time.Since(start), d.Name()), err
+}
+
 // Shutdown shuts down the store gracefully
 func (d *DBBackedStore) Shutdown() {
 	d.blobs.Shutdown()
+	d.db.Shutdown()
 }
@@ -9,6 +9,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/lbryio/reflector.go/shared"
@@ -28,11 +31,28 @@ type DiskStore struct {
 	blobDir string
 	// store files in subdirectories based on the first N chars in the filename. 0 = don't create subdirectories.
 	prefixLength int
+	// where blobs are written before they are moved into place. empty for the tmp dir in the blob dir
+	tmpRoot string
+	// keep a tmp dir in each prefix dir instead
+	shardTmp bool
+	// checks the blobs against their hash after they're served, if set
+	verifier *Verifier
 
 	// true if initOnce ran, false otherwise
 	initialized bool
 
 	concurrentChecks atomic.Int32
+
+	// persistent list of the blobs, if enabled
+	index        *diskIndex
+	indexLoad    sync.Once
+	indexErr     error
+	reconcileRun sync.Once
+
+	// log of the writes in progress, to clean up after crashes
+	journal        *diskJournal
+	journalRecover sync.Once
+	journalErr     error
 }
 
 const maxConcurrentChecks = 30
@@ -42,9 +62,41 @@ func NewDiskStore(dir string, prefixLength int) *DiskStore {
 	return &DiskStore{
 		blobDir:      dir,
 		prefixLength: prefixLength,
+		journal:      newDiskJournal(dir),
 	}
 }
 
+// NewIndexedDiskStore returns a disk store that keeps a persistent index of its blobs, so listing them on startup
+// doesn't have to walk the whole blob dir. The index is checked against the blob dir in the background after it is
+// first listed. If there is no index yet, it is built by walking the blob dir when the store is first used.
+func NewIndexedDiskStore(dir string, prefixLength int) *DiskStore {
+	d := NewDiskStore(dir, prefixLength)
+	d.index = newDiskIndex(dir)
+	return d
+}
+
+// WithTmpDir makes the store write blobs to dir before moving them into place, instead of to the tmp dir in the blob
+// dir. If dir is on another filesystem than the blobs, blobs are copied into place instead of renamed. It must be
+// called before the store is used.
+func (d *DiskStore) WithTmpDir(dir string) *DiskStore {
+	d.tmpRoot = dir
+	return d
+}
+
+// WithShardTmpDirs makes the store keep a tmp dir in each prefix dir, so blobs are written on the filesystem they end
+// up on even if the prefix dirs are mounted from different disks. It must be called before the store is used.
+func (d *DiskStore) WithShardTmpDirs() *DiskStore {
+	d.shardTmp = true
+	return d
+}
+
+// WithVerifier makes the store check the blobs it serves against their hash in v's workers, after they were served,
+// instead of before. Blobs that don't match are quarantined. It must be called before the store is used.
+func (d *DiskStore) WithVerifier(v *Verifier) *DiskStore {
+	d.verifier = v
+	return d
+}
+
 const nameDisk = "disk"
 
 // Name is the cache type name
@@ -83,6 +135,11 @@ func (d *DiskStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
 		return nil, shared.NewBlobTrace(time.Since(start), d.Name()), errors.Err(err)
 	}
 
+	if d.verifier != nil {
+		d.verifier.enqueue(verifyJob{store: d, hash: hash})
+		return blob, shared.NewBlobTrace(time.Since(start), d.Name()), nil
+	}
+
 	// this is a rather poor yet effective way of throttling how many blobs can be checked concurrently
 	// poor because there is a possible race condition between the check and the actual +1
 	if d.concurrentChecks.Load() < maxConcurrentChecks {
@@ -97,13 +154,34 @@ func (d *DiskStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
 			if err != nil {
 				return nil, shared.NewBlobTrace(time.Since(start), d.Name()), err
 			}
-			return nil, shared.NewBlobTrace(time.Since(start), d.Name()), errors.Err(message)
+			return nil, shared.NewBlobTrace(time.Since(start), d.Name()), errors.Prefix(message, ErrBlobCorrupt)
 		}
 	}
 
 	return blob, shared.NewBlobTrace(time.Since(start), d.Name()), nil
 }
 
+// openFile opens the file of the blob. It's only checked against its hash afterwards, and only with a verifier, since
+// checking it first would mean reading it
+func (d *DiskStore) openFile(hash string) (*os.File, shared.BlobTrace, error) {
+	start := time.Now()
+	err := d.initOnce()
+	if err != nil {
+		return nil, shared.NewBlobTrace(time.Since(start), d.Name()), err
+	}
+	f, err := os.Open(d.path(hash))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, shared.NewBlobTrace(time.Since(start), d.Name()), errors.Err(ErrNotFile)
+		}
+		return nil, shared.NewBlobTrace(time.Since(start), d.Name()), errors.Err(err)
+	}
+	if d.verifier != nil {
+		d.verifier.enqueue(verifyJob{store: d, hash: hash})
+	}
+	return f, shared.NewBlobTrace(time.Since(start), d.Name()), nil
+}
+
 // Put stores the blob on disk
 func (d *DiskStore) Put(hash string, blob stream.Blob) error {
 	err := d.initOnce()
@@ -115,7 +193,32 @@ func (d *DiskStore) Put(hash string, blob stream.Blob) error {
 	if err != nil {
 		return err
 	}
+	if d.shardTmp {
+		err = d.ensureDirExists(d.tmpDir(hash))
+		if err != nil {
+			return err
+		}
+	}
 
+	d.journal.begin(hash, journalPut)
+	defer d.journal.done(hash)
+
+	err = d.writeTmp(hash, blob)
+	if err == nil {
+		err = d.moveIntoPlace(hash)
+	}
+	if err != nil {
+		_ = os.Remove(d.tmpPath(hash))
+		return err
+	}
+	if d.index != nil {
+		d.index.add(hash)
+	}
+	return nil
+}
+
+// writeTmp writes the blob to its tmp file
+func (d *DiskStore) writeTmp(hash string, blob stream.Blob) error {
 	// Open file with O_DIRECT
 	f, err := os.OpenFile(d.tmpPath(hash), openFileFlags, 0644)
 	if err != nil {
@@ -128,16 +231,79 @@ func (d *DiskStore) Put(hash string, blob stream.Blob) error {
 	if err != nil {
 		return errors.Err(err)
 	}
-	defer dio.Flush()
 	// Write the body to file
 	_, err = io.Copy(dio, bytes.NewReader(blob))
 	if err != nil {
 		return errors.Err(err)
 	}
-	err = os.Rename(d.tmpPath(hash), d.path(hash))
+	err = dio.Flush()
+	if err != nil {
+		return errors.Err(err)
+	}
+	return errors.Err(f.Sync())
+}
+
+// moveIntoPlace moves the tmp file of a blob to where the blob belongs. If they're on different filesystems, the blob
+// is copied next to where it belongs and renamed from there, so it's never seen half written
+func (d *DiskStore) moveIntoPlace(hash string) error {
+	err := os.Rename(d.tmpPath(hash), d.path(hash))
+	if errors.Is(err, syscall.EXDEV) {
+		err = d.copyIntoPlace(hash)
+	}
+	if err != nil {
+		return errors.Err(err)
+	}
+	return syncDir(d.dir(hash))
+}
+
+// copyIntoPlace is the fallback of moveIntoPlace when the tmp dir is on another filesystem
+func (d *DiskStore) copyIntoPlace(hash string) error {
+	partial := d.partialPath(hash)
+	err := copyFile(d.tmpPath(hash), partial)
+	if err != nil {
+		_ = os.Remove(partial)
+		return err
+	}
+	err = os.Rename(partial, d.path(hash))
+	if err != nil {
+		_ = os.Remove(partial)
+		return errors.Err(err)
+	}
+	return errors.Err(os.Remove(d.tmpPath(hash)))
+}
+
+// copyFile copies src to a new file at dst and syncs it
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Err(err)
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
 	return errors.Err(err)
 }
 
+// syncDir makes a rename in dir survive a crash
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer f.Close()
+	return errors.Err(f.Sync())
+}
+
 // PutSD stores the sd blob on the disk
 func (d *DiskStore) PutSD(hash string, blob stream.Blob) error {
 	return d.Put(hash, blob)
@@ -158,8 +324,17 @@ func (d *DiskStore) Delete(hash string) error {
 		return nil
 	}
 
+	d.journal.begin(hash, journalDelete)
+	defer d.journal.done(hash)
+
 	err = os.Remove(d.path(hash))
-	return errors.Err(err)
+	if err != nil {
+		return errors.Err(err)
+	}
+	if d.index != nil {
+		d.index.remove(hash)
+	}
+	return nil
 }
 
 // list returns the hashes of blobs that already exist in the blobDir
@@ -169,7 +344,84 @@ func (d *DiskStore) list() ([]string, error) {
 		return nil, err
 	}
 
-	return speedwalk.AllFiles(d.blobDir, true)
+	if d.index != nil {
+		if d.indexErr == nil {
+			d.reconcileRun.Do(func() {
+				go func() {
+					err := d.index.reconcile(d)
+					if err != nil {
+						log.Errorf("checking the disk index: %s", errors.FullTrace(err))
+					}
+				}()
+			})
+			return d.index.list(), nil
+		}
+		log.Warnf("disk index is broken, walking the blob dir instead: %s", d.indexErr.Error())
+	}
+	files, err := speedwalk.AllFiles(d.blobDir, true)
+	if err != nil {
+		return nil, err
+	}
+	hashes := files[:0]
+	for _, f := range files {
+		if !isStoreFile(f) && !strings.HasSuffix(f, quarantineSuffix) {
+			hashes = append(hashes, f)
+		}
+	}
+	return hashes, nil
+}
+
+// listPage lists from the index if there is one. Otherwise only the blob dirs the page can be in are read, in order
+func (d *DiskStore) listPage(after string, limit int) ([]string, error) {
+	err := d.initOnce()
+	if err != nil {
+		return nil, err
+	}
+	if d.index != nil {
+		hashes, err := d.list()
+		if err != nil {
+			return nil, err
+		}
+		return pageOf(hashes, after, limit), nil
+	}
+
+	dirs := []string{d.blobDir}
+	if d.prefixLength > 0 {
+		entries, err := ioutil.ReadDir(d.blobDir)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		firstDir := after
+		if len(firstDir) > d.prefixLength {
+			firstDir = firstDir[:d.prefixLength]
+		}
+		dirs = dirs[:0]
+		for _, e := range entries {
+			if e.IsDir() && len(e.Name()) == d.prefixLength && e.Name() >= firstDir {
+				dirs = append(dirs, path.Join(d.blobDir, e.Name()))
+			}
+		}
+	}
+
+	var page []string
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.Err(err)
+		}
+		for _, e := range entries {
+			if e.IsDir() || e.Name() <= after || !isBlobHash(e.Name()) {
+				continue
+			}
+			page = append(page, e.Name())
+			if len(page) == limit {
+				return page, nil
+			}
+		}
+	}
+	return page, nil
 }
 
 func (d *DiskStore) dir(hash string) string {
@@ -179,6 +431,12 @@ func (d *DiskStore) dir(hash string) string {
 	return path.Join(d.blobDir, hash[:d.prefixLength])
 }
 func (d *DiskStore) tmpDir(hash string) string {
+	if d.shardTmp {
+		return path.Join(d.dir(hash), "tmp")
+	}
+	if d.tmpRoot != "" {
+		return d.tmpRoot
+	}
 	return path.Join(d.blobDir, "tmp")
 }
 func (d *DiskStore) path(hash string) string {
@@ -187,6 +445,14 @@ func (d *DiskStore) path(hash string) string {
 func (d *DiskStore) tmpPath(hash string) string {
 	return path.Join(d.tmpDir(hash), hash)
 }
+
+// partialPath is where a blob is copied to when the tmp dir is on another filesystem
+func (d *DiskStore) partialPath(hash string) string {
+	return d.path(hash) + partialSuffix
+}
+
+const partialSuffix = ".partial"
+
 func (d *DiskStore) ensureDirExists(dir string) error {
 	return errors.Err(os.MkdirAll(dir, 0755))
 }
@@ -200,9 +466,32 @@ func (d *DiskStore) initOnce() error {
 	if err != nil {
 		return err
 	}
-	err = d.ensureDirExists(path.Join(d.blobDir, "tmp"))
-	if err != nil {
-		return err
+	if !d.shardTmp {
+		err = d.ensureDirExists(d.tmpDir(""))
+		if err != nil {
+			return err
+		}
+	}
+	if d.index != nil {
+		d.indexLoad.Do(func() {
+			var walked bool
+			walked, d.indexErr = d.index.load(d)
+			if walked {
+				// the index was just built from the blob dir, there is nothing to check it against
+				d.reconcileRun.Do(func() {})
+			}
+		})
+	}
+	d.journalRecover.Do(func() {
+		var r journalRecovery
+		r, d.journalErr = d.journal.recover(d)
+		if r.Interrupted > 0 {
+			log.Warnf("cleaned up %d writes to %s that were cut off: %d tmp files removed, %d blobs kept, %d blobs removed",
+				r.Interrupted, d.blobDir, r.TmpRemoved, r.Kept, r.Removed)
+		}
+	})
+	if d.journalErr != nil {
+		return d.journalErr
 	}
 	d.initialized = true
 	return nil
@@ -210,4 +499,8 @@ func (d *DiskStore) initOnce() error {
 
 // Shutdown shuts down the store gracefully
 func (d *DiskStore) Shutdown() {
+	if d.index != nil {
+		d.index.close()
+	}
+	d.journal.close()
 }
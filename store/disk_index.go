@@ -0,0 +1,326 @@
+package store
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/store/speedwalk"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// name of the index file in the blob dir
+const diskIndexFile = "index"
+
+// diskIndex is a persistent list of the blobs in a DiskStore, so they don't have to be found by walking the blob dir
+// on startup. It is a log of "+hash" and "-hash" lines that Put and Delete append to. The log is compacted when it
+// is loaded and when it grows too long, and checked against the blob dir by a walk in the background, which fixes
+// drift from crashes or from blobs that were added or removed by hand.
+type diskIndex struct {
+	file string
+
+	mu      sync.Mutex
+	hashes  map[string]struct{}
+	log     *os.File
+	entries int // lines in the log
+
+	// blobs added or removed while a reconciliation walk runs. the walk may have missed them
+	touched map[string]struct{}
+	// lines appended and blobs fixed by a reconciliation while the log is compacted, which the compacted log needs too
+	compacting bool
+	pending    []string
+	closed     bool
+
+	// compactions that run in the background
+	wg sync.WaitGroup
+}
+
+func newDiskIndex(blobDir string) *diskIndex {
+	return &diskIndex{file: path.Join(blobDir, diskIndexFile)}
+}
+
+// load reads the log, compacts it and opens it for appending. If there is no log yet, the index is built by walking
+// the blob dir of d first, so the blobs that are already there are listed too. It returns whether it walked
+func (i *diskIndex) load(d *DiskStore) (bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.hashes = make(map[string]struct{})
+	f, err := os.Open(i.file)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errors.Err(err)
+	}
+	walked := false
+	if err != nil {
+		start := time.Now()
+		// nothing can be listed until this is done, so the walk doesn't hold back
+		i.hashes, _, err = walkBlobs(d, speedwalk.Opts{ProgressInterval: time.Minute})
+		if err != nil {
+			return false, err
+		}
+		walked = true
+		log.Infof("built the disk index from %d blobs in %s in %s", len(i.hashes), d.blobDir,
+			time.Since(start).Round(time.Second))
+	} else {
+		entries := 0
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if len(line) < 2 {
+				continue
+			}
+			entries++
+			switch line[0] {
+			case '+':
+				i.hashes[line[1:]] = struct{}{}
+			case '-':
+				delete(i.hashes, line[1:])
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return false, errors.Err(err)
+		}
+		log.Debugf("loaded %d blobs from the disk index (%d entries)", len(i.hashes), entries)
+	}
+
+	return walked, i.rewrite()
+}
+
+// rewrite replaces the log with one line per blob. It must be called with the lock held
+func (i *diskIndex) rewrite() error {
+	f, err := i.writeCompacted(i.hashes)
+	if err != nil {
+		return err
+	}
+	return i.swap(f, len(i.hashes), nil)
+}
+
+// compact replaces the log with one line per blob, like rewrite. The new log is written and synced without holding
+// the lock, so adds and removes don't wait for it. They go to the old log until the new one replaces it
+func (i *diskIndex) compact() error {
+	i.mu.Lock()
+	if i.compacting || i.closed {
+		i.mu.Unlock()
+		return nil
+	}
+	i.compacting = true
+	hashes := make(map[string]struct{}, len(i.hashes))
+	for h := range i.hashes {
+		hashes[h] = struct{}{}
+	}
+	i.mu.Unlock()
+
+	f, err := i.writeCompacted(hashes)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	pending := i.pending
+	i.compacting = false
+	i.pending = nil
+	if err != nil {
+		return err
+	}
+	if i.closed {
+		f.Close()
+		os.Remove(f.Name())
+		return nil
+	}
+	return i.swap(f, len(hashes), pending)
+}
+
+// writeCompacted writes one line per blob to a new log next to the index and syncs it. The new log is returned open
+// for appending
+func (i *diskIndex) writeCompacted(hashes map[string]struct{}) (*os.File, error) {
+	f, err := os.OpenFile(i.file+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	w := bufio.NewWriter(f)
+	for h := range hashes {
+		_, err = w.WriteString("+" + h + "\n")
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errors.Err(err)
+	}
+	return f, nil
+}
+
+// swap appends the pending lines to the new log f, which has entries lines, and replaces the log with it. It must be
+// called with the lock held
+func (i *diskIndex) swap(f *os.File, entries int, pending []string) error {
+	var err error
+	for _, line := range pending {
+		_, err = f.WriteString(line)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), i.file)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Err(err)
+	}
+
+	if i.log != nil {
+		i.log.Close()
+	}
+	i.log = f
+	i.entries = entries + len(pending)
+	return nil
+}
+
+func (i *diskIndex) add(hash string) {
+	i.append(hash, '+')
+}
+
+func (i *diskIndex) remove(hash string) {
+	i.append(hash, '-')
+}
+
+func (i *diskIndex) append(hash string, op byte) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.hashes == nil || i.closed {
+		return
+	}
+	if op == '+' {
+		i.hashes[hash] = struct{}{}
+	} else {
+		delete(i.hashes, hash)
+	}
+	if i.touched != nil {
+		i.touched[hash] = struct{}{}
+	}
+
+	line := string(op) + hash + "\n"
+	if i.compacting {
+		i.pending = append(i.pending, line)
+	}
+	_, err := i.log.WriteString(line)
+	if err != nil {
+		// the reconciliation walk will fix the index
+		log.Errorf("writing to the disk index: %s", err.Error())
+		return
+	}
+	i.entries++
+	if i.entries > 2*len(i.hashes)+10000 && !i.compacting {
+		i.wg.Add(1)
+		go func() {
+			defer i.wg.Done()
+			err := i.compact()
+			if err != nil {
+				log.Errorf("compacting the disk index: %s", errors.FullTrace(err))
+			}
+		}()
+	}
+}
+
+func (i *diskIndex) list() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	hashes := make([]string, 0, len(i.hashes))
+	for h := range i.hashes {
+		hashes = append(hashes, h)
+	}
+	return hashes
+}
+
+// reconcile walks the blob dir and fixes the index where it doesn't match
+func (i *diskIndex) reconcile(d *DiskStore) error {
+	i.mu.Lock()
+	i.touched = make(map[string]struct{})
+	expected := len(i.hashes)
+	i.mu.Unlock()
+
+	start := time.Now()
+	onDisk, files, err := walkBlobs(d, speedwalk.Opts{Nice: true, ProgressInterval: time.Minute, Total: expected})
+
+	i.mu.Lock()
+	touched := i.touched
+	i.touched = nil
+	if err != nil || i.closed {
+		i.mu.Unlock()
+		return err
+	}
+
+	added, removed := 0, 0
+	for h := range onDisk {
+		if _, ok := i.hashes[h]; !ok {
+			if _, ok := touched[h]; !ok {
+				i.hashes[h] = struct{}{}
+				if i.compacting {
+					i.pending = append(i.pending, "+"+h+"\n")
+				}
+				added++
+			}
+		}
+	}
+	for h := range i.hashes {
+		if _, ok := onDisk[h]; !ok {
+			if _, ok := touched[h]; !ok {
+				delete(i.hashes, h)
+				if i.compacting {
+					i.pending = append(i.pending, "-"+h+"\n")
+				}
+				removed++
+			}
+		}
+	}
+
+	i.mu.Unlock()
+
+	log.Infof("disk index checked against %d files in %s: %d blobs were missing from it, %d were gone", files,
+		time.Since(start).Round(time.Second), added, removed)
+	if added > 0 || removed > 0 {
+		return i.compact()
+	}
+	return nil
+}
+
+// walkBlobs returns the blobs in the blob dir of d and how many files it walked
+func walkBlobs(d *DiskStore, opts speedwalk.Opts) (map[string]struct{}, int, error) {
+	files := 0
+	onDisk := make(map[string]struct{}, opts.Total)
+	err := speedwalk.Walk(d.blobDir, opts, func(f string) error {
+		files++
+		hash := path.Base(f)
+		if isBlobHash(hash) && f == d.path(hash) { // skips tmp files and the index itself
+			onDisk[hash] = struct{}{}
+		}
+		return nil
+	})
+	return onDisk, files, err
+}
+
+// close closes the log, and waits for a compaction that is running to give up
+func (i *diskIndex) close() {
+	i.mu.Lock()
+	i.closed = true
+	if i.log != nil {
+		i.log.Close()
+		i.log = nil
+	}
+	i.mu.Unlock()
+	i.wg.Wait()
+}
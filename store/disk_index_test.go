@@ -0,0 +1,122 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexedDiskStore_reload(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	d := NewIndexedDiskStore(tmpDir, 2)
+	kept := stream.Blob("a blob that stays")
+	deleted := stream.Blob("a blob that is deleted")
+	require.NoError(t, d.Put(kept.HashHex(), kept))
+	require.NoError(t, d.Put(deleted.HashHex(), deleted))
+	require.NoError(t, d.Delete(deleted.HashHex()))
+	d.Shutdown()
+
+	d = NewIndexedDiskStore(tmpDir, 2)
+	require.NoError(t, d.initOnce())
+	defer d.Shutdown()
+	assert.Equal(t, []string{kept.HashHex()}, d.index.list())
+}
+
+func TestIndexedDiskStore_build(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// blobs stored before the index was turned on
+	d := NewDiskStore(tmpDir, 2)
+	var hashes []string
+	for n := 0; n < 10; n++ {
+		b := stream.Blob("a blob from before the index " + strconv.Itoa(n))
+		require.NoError(t, d.Put(b.HashHex(), b))
+		hashes = append(hashes, b.HashHex())
+	}
+
+	d = NewIndexedDiskStore(tmpDir, 2)
+	listed, err := d.list()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, hashes, listed)
+	d.Shutdown()
+
+	log, err := ioutil.ReadFile(d.index.file)
+	require.NoError(t, err)
+	assert.Equal(t, len(hashes), strings.Count(string(log), "\n"))
+}
+
+func TestIndexedDiskStore_reconcile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	d := NewIndexedDiskStore(tmpDir, 2)
+	defer d.Shutdown()
+	gone := stream.Blob("a blob removed by hand")
+	require.NoError(t, d.Put(gone.HashHex(), gone))
+	require.NoError(t, os.Remove(d.path(gone.HashHex())))
+
+	added := stream.Blob("a blob added by hand")
+	require.NoError(t, os.MkdirAll(d.dir(added.HashHex()), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(d.path(added.HashHex()), added, 0644))
+
+	require.NoError(t, d.index.reconcile(d))
+	assert.Equal(t, []string{added.HashHex()}, d.index.list())
+}
+
+func TestDiskIndex_compact(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	i := newDiskIndex(tmpDir)
+	_, err = i.load(NewDiskStore(tmpDir, 2))
+	require.NoError(t, err)
+
+	// blobs come and go while the log is compacted, so some of them are added to the pending lines
+	var kept []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; n < 20000; n++ {
+			hash := stream.Blob(strconv.Itoa(n)).HashHex()
+			i.add(hash)
+			if n%100 == 0 {
+				kept = append(kept, hash)
+			} else {
+				i.remove(hash)
+			}
+		}
+	}()
+	for compacting := true; compacting; {
+		select {
+		case <-done:
+			compacting = false
+		default:
+			require.NoError(t, i.compact())
+		}
+	}
+	i.close()
+
+	i = newDiskIndex(tmpDir)
+	_, err = i.load(NewDiskStore(tmpDir, 2))
+	require.NoError(t, err)
+	defer i.close()
+	assert.ElementsMatch(t, kept, i.list())
+
+	log, err := ioutil.ReadFile(i.file)
+	require.NoError(t, err)
+	assert.Equal(t, len(kept), strings.Count(string(log), "\n"))
+}
@@ -0,0 +1,232 @@
+package store
+
+import (
+	"bufio"
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// name of the journal file in the blob dir
+const diskJournalFile = "journal"
+
+// journal entries. an operation is started with its op, and finished with journalDone
+const (
+	journalPut    = 'p'
+	journalDelete = 'd'
+	journalDone   = 'c'
+)
+
+// diskJournal is a write-ahead log of the Puts and Deletes in progress on a DiskStore. Each operation is logged before
+// it touches the disk and marked done after, so after a crash the operations that were cut off are known, and their
+// tmp files and half-finished renames can be cleaned up when the store starts instead of leaking. The journal is
+// emptied whenever no operations are in progress and it has grown.
+type diskJournal struct {
+	file string
+
+	mu      sync.Mutex
+	log     *os.File
+	pending map[string]byte
+	entries int
+
+	// begin entries are synced to disk in groups: one goroutine syncs the log for all the entries written so far,
+	// and the ones that begin meanwhile wait for it and sync the next group
+	written   uint64 // entries ever written
+	synced    uint64 // entries ever written that are known to be on disk
+	syncing   bool
+	syncedSig *sync.Cond
+}
+
+func newDiskJournal(blobDir string) *diskJournal {
+	j := &diskJournal{file: path.Join(blobDir, diskJournalFile), pending: make(map[string]byte)}
+	j.syncedSig = sync.NewCond(&j.mu)
+	return j
+}
+
+// journalRecovery counts what was cleaned up after a crash
+type journalRecovery struct {
+	Interrupted int // operations that were cut off
+	TmpRemoved  int // tmp and partly copied files of interrupted puts
+	Kept        int // blobs of interrupted puts that were renamed into place and are complete
+	Removed     int // blobs of interrupted puts that are broken, and blobs of interrupted deletes
+}
+
+// recover finishes or rolls back the operations that were in progress when the store last stopped, then empties the
+// journal and opens it for appending. Interrupted puts are kept if the blob made it into place intact and removed
+// otherwise, and interrupted deletes are finished.
+func (j *diskJournal) recover(d *DiskStore) (journalRecovery, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var result journalRecovery
+	interrupted, err := j.read()
+	if err != nil {
+		return result, err
+	}
+
+	for hash, op := range interrupted {
+		result.Interrupted++
+		for _, tmp := range []string{d.tmpPath(hash), d.partialPath(hash)} {
+			err := os.Remove(tmp)
+			if err == nil {
+				result.TmpRemoved++
+			} else if !os.IsNotExist(err) {
+				return result, errors.Err(err)
+			}
+		}
+
+		keep := false
+		if op == journalPut {
+			keep, err = blobIntact(d.path(hash), hash)
+			if err != nil {
+				return result, err
+			}
+		}
+		if keep {
+			result.Kept++
+			if d.index != nil {
+				d.index.add(hash)
+			}
+			continue
+		}
+		err = os.Remove(d.path(hash))
+		if err == nil {
+			result.Removed++
+		} else if !os.IsNotExist(err) {
+			return result, errors.Err(err)
+		}
+		if d.index != nil {
+			d.index.remove(hash)
+		}
+	}
+
+	if j.log != nil {
+		j.log.Close()
+	}
+	j.log, err = os.OpenFile(j.file, os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_WRONLY, 0644)
+	j.entries = 0
+	return result, errors.Err(err)
+}
+
+// read returns the operations in the journal that were started but not finished
+func (j *diskJournal) read() (map[string]byte, error) {
+	interrupted := make(map[string]byte)
+	f, err := os.Open(j.file)
+	if os.IsNotExist(err) {
+		return interrupted, nil
+	} else if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 2 {
+			continue // a line cut off by the crash
+		}
+		hash := line[1:]
+		switch line[0] {
+		case journalPut, journalDelete:
+			interrupted[hash] = line[0]
+		case journalDone:
+			delete(interrupted, hash)
+		}
+	}
+	return interrupted, errors.Err(scanner.Err())
+}
+
+// blobIntact returns whether the file exists and holds the blob
+func blobIntact(file, hash string) (bool, error) {
+	blob, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Err(err)
+	}
+	sum := sha512.Sum384(blob)
+	return len(blob) > 0 && hex.EncodeToString(sum[:]) == hash, nil
+}
+
+// begin logs that an operation on the blob is starting. It returns once the entry is on disk, so the operation can't
+// outlive a crash without the journal knowing about it
+func (j *diskJournal) begin(hash string, op byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.pending[hash] = op
+	if j.write(op, hash) {
+		j.sync(j.written)
+	}
+}
+
+// sync returns once the first upTo entries ever written are on disk. It must be called with the lock held, which it
+// gives up while the log is synced
+func (j *diskJournal) sync(upTo uint64) {
+	for j.synced < upTo {
+		if j.syncing {
+			j.syncedSig.Wait()
+			continue
+		}
+		j.syncing = true
+		f, target := j.log, j.written
+		j.mu.Unlock()
+		err := f.Sync()
+		j.mu.Lock()
+		j.syncing = false
+		if err != nil {
+			// the operation goes ahead anyway. if it's cut off, it leaves a tmp file behind, which fsck removes
+			log.Errorf("syncing the disk journal: %s", err.Error())
+		}
+		j.synced = target
+		j.syncedSig.Broadcast()
+	}
+}
+
+// done logs that the operation on the blob finished, whether it worked or not
+func (j *diskJournal) done(hash string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.pending, hash)
+	j.write(journalDone, hash)
+
+	if len(j.pending) == 0 && j.entries > 10000 && j.log != nil {
+		err := j.log.Truncate(0)
+		if err != nil {
+			log.Errorf("emptying the disk journal: %s", err.Error())
+			return
+		}
+		j.entries = 0
+	}
+}
+
+// write appends the entry to the log and returns whether it did. It must be called with the lock held
+func (j *diskJournal) write(op byte, hash string) bool {
+	if j.log == nil {
+		return false
+	}
+	_, err := j.log.WriteString(string(op) + hash + "\n")
+	if err != nil {
+		// an interrupted operation that is missing from the journal leaves a tmp file behind, which fsck removes
+		log.Errorf("writing to the disk journal: %s", err.Error())
+		return false
+	}
+	j.entries++
+	j.written++
+	return true
+}
+
+func (j *diskJournal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.log != nil {
+		j.log.Close()
+		j.log = nil
+	}
+}
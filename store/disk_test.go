@@ -1,10 +1,15 @@
 package store
 
 import (
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"sync"
 	"testing"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
@@ -43,3 +48,178 @@ func TestDiskStore_GetNonexistentBlob(t *testing.T) {
 	assert.Nil(t, blob)
 	assert.True(t, errors.Is(err, ErrBlobNotFound))
 }
+
+func TestDiskStore_JournalRecovery(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	d := NewDiskStore(tmpDir, 2)
+
+	blobs := make([][]byte, 5)
+	hashes := make([]string, 5)
+	for i := range blobs {
+		blobs[i] = []byte(fmt.Sprintf("blob number %d", i))
+		sum := sha512.Sum384(blobs[i])
+		hashes[i] = hex.EncodeToString(sum[:])
+		require.NoError(t, os.MkdirAll(d.dir(hashes[i]), 0755))
+	}
+	require.NoError(t, os.MkdirAll(d.tmpDir(""), 0755))
+	write := func(file string, data []byte) { require.NoError(t, ioutil.WriteFile(file, data, 0644)) }
+
+	// a put that was cut off while writing the tmp file
+	write(d.tmpPath(hashes[0]), blobs[0][:4])
+	// a put that was cut off after the rename
+	write(d.path(hashes[1]), blobs[1])
+	// a put that left a broken blob in place
+	write(d.path(hashes[2]), blobs[2][:4])
+	// a delete that was cut off
+	write(d.path(hashes[3]), blobs[3])
+	// a put that finished, but left a tmp file that isn't the journal's business
+	write(d.tmpPath(hashes[4]), blobs[4])
+	write(path.Join(tmpDir, diskJournalFile), []byte("p"+hashes[0]+"\np"+hashes[1]+"\np"+hashes[2]+"\nd"+hashes[3]+
+		"\np"+hashes[4]+"\nc"+hashes[4]+"\np"))
+
+	for i, expected := range []bool{false, true, false, false, false} {
+		has, err := d.Has(hashes[i])
+		require.NoError(t, err)
+		assert.Equal(t, expected, has, "blob %d", i)
+	}
+	_, err = os.Stat(d.tmpPath(hashes[0]))
+	assert.True(t, os.IsNotExist(err), "the tmp file of the interrupted put should be removed")
+	_, err = os.Stat(d.tmpPath(hashes[4]))
+	assert.NoError(t, err, "the tmp file of the finished put should be left alone")
+
+	journal, err := ioutil.ReadFile(path.Join(tmpDir, diskJournalFile))
+	require.NoError(t, err)
+	assert.Empty(t, journal)
+
+	// the journal keeps track of new writes
+	require.NoError(t, d.Put(hashes[0], blobs[0]))
+	journal, err = ioutil.ReadFile(path.Join(tmpDir, diskJournalFile))
+	require.NoError(t, err)
+	assert.Equal(t, "p"+hashes[0]+"\nc"+hashes[0]+"\n", string(journal))
+
+	list, err := d.list()
+	require.NoError(t, err)
+	assert.NotContains(t, list, diskJournalFile)
+}
+
+func TestDiskJournal_Sync(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	d := NewDiskStore(tmpDir, 2)
+	require.NoError(t, d.initOnce())
+	defer d.Shutdown()
+
+	// begins that come in while the log is synced wait for it, and are synced together after it
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d.journal.begin(fmt.Sprintf("%096d", i), journalPut)
+		}(i)
+	}
+	wg.Wait()
+
+	d.journal.mu.Lock()
+	defer d.journal.mu.Unlock()
+	assert.Equal(t, uint64(50), d.journal.written)
+	assert.Equal(t, d.journal.written, d.journal.synced)
+	assert.False(t, d.journal.syncing)
+}
+
+func TestDiskStore_TmpLocations(t *testing.T) {
+	hash := "f428b8265d65dad7f8ffa52922bba836404cbd62f3ecfe10adba6b444f8f658938e54f5981ac4de39644d5b93d89a94b"
+	data := []byte("oyuntyausntoyaunpdoyruoyduanrstjwfjyuwf")
+
+	tmpRoot, err := ioutil.TempDir("", "reflector_test_tmp_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpRoot)
+
+	stores := map[string]func(dir string) *DiskStore{
+		"default":  func(dir string) *DiskStore { return NewDiskStore(dir, 2) },
+		"tmp dir":  func(dir string) *DiskStore { return NewDiskStore(dir, 2).WithTmpDir(tmpRoot) },
+		"sharded":  func(dir string) *DiskStore { return NewDiskStore(dir, 2).WithShardTmpDirs() },
+		"no shard": func(dir string) *DiskStore { return NewDiskStore(dir, 0).WithShardTmpDirs() },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "reflector_test_*")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			d := newStore(dir)
+
+			require.NoError(t, d.Put(hash, data))
+			blob, _, err := d.Get(hash)
+			require.NoError(t, err)
+			assert.EqualValues(t, data, blob)
+
+			tmps, err := ioutil.ReadDir(d.tmpDir(hash))
+			require.NoError(t, err)
+			assert.Empty(t, tmps)
+		})
+	}
+}
+
+func TestDiskStore_CopyIntoPlace(t *testing.T) {
+	hash := "f428b8265d65dad7f8ffa52922bba836404cbd62f3ecfe10adba6b444f8f658938e54f5981ac4de39644d5b93d89a94b"
+	data := []byte("oyuntyausntoyaunpdoyruoyduanrstjwfjyuwf")
+
+	dir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	d := NewDiskStore(dir, 2)
+	require.NoError(t, d.initOnce())
+	require.NoError(t, os.MkdirAll(d.dir(hash), 0755))
+	require.NoError(t, ioutil.WriteFile(d.tmpPath(hash), data, 0644))
+
+	// what Put falls back to when the tmp dir is on another filesystem
+	require.NoError(t, d.copyIntoPlace(hash))
+	stored, err := ioutil.ReadFile(d.path(hash))
+	require.NoError(t, err)
+	assert.EqualValues(t, data, stored)
+	assert.NoFileExists(t, d.tmpPath(hash))
+	assert.NoFileExists(t, d.partialPath(hash))
+}
+
+func TestDiskStore_ListPage(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	d := NewDiskStore(tmpDir, 2)
+	mem := NewMemStore()
+
+	var hashes []string
+	for i := 0; i < 50; i++ {
+		blob := []byte(fmt.Sprintf("blob %d", i))
+		sum := sha512.Sum384(blob)
+		hash := hex.EncodeToString(sum[:])
+		require.NoError(t, d.Put(hash, blob))
+		require.NoError(t, mem.Put(hash, blob))
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	// the disk store reads its dirs, the mem store is listed whole. both page the same way
+	for _, s := range []BlobStore{d, mem} {
+		var listed []string
+		after := ""
+		for {
+			page, err := ListPage(s, after, 7)
+			require.NoError(t, err)
+			assert.LessOrEqual(t, len(page), 7)
+			if len(page) == 0 {
+				break
+			}
+			listed = append(listed, page...)
+			after = page[len(page)-1]
+		}
+		assert.Equal(t, hashes, listed, s.Name())
+
+		page, err := ListPage(s, hashes[9][:5], 3)
+		require.NoError(t, err)
+		assert.Equal(t, hashes[9:12], page, "after a prefix")
+	}
+}
@@ -0,0 +1,208 @@
+package store
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+)
+
+// ErrInjectedFault is returned by a FaultyStore for the operations it fails on purpose
+var ErrInjectedFault = errors.Base("injected fault")
+
+// FaultyOpts are the faults a FaultyStore injects. Rates are the share of operations that get the fault, from 0 to 1
+type FaultyOpts struct {
+	// Latency is added to every operation
+	Latency time.Duration
+	// Jitter is a random extra latency, up to this
+	Jitter time.Duration
+	// ErrorRate is how many operations fail with ErrInjectedFault, without reaching the store
+	ErrorRate float64
+	// CorruptRate is how many gets return the blob with a byte flipped, like a bad disk would
+	CorruptRate float64
+	// PartialRate is how many gets return only the first part of the blob, like a connection that broke off
+	PartialRate float64
+	// Seed makes the same operations get the same faults in each run. A random seed is used if it's 0
+	Seed int64
+}
+
+// Faults a FaultyStore injects, as they're counted in the metrics
+const (
+	faultError   = "error"
+	faultCorrupt = "corrupt"
+	faultPartial = "partial"
+)
+
+// FaultyStore injects latency, errors, corrupt blobs and partial reads into the operations on a store, so retries and
+// fallbacks can be tried out in tests and staging. It has the name of the store it wraps
+type FaultyStore struct {
+	BlobStore
+	opts      FaultyOpts
+	component string
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// NewFaultyStore returns a store that injects the faults of opts into s. component names it in the metrics
+func NewFaultyStore(component string, s BlobStore, opts FaultyOpts) *FaultyStore {
+	seed := opts.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &FaultyStore{BlobStore: s, opts: opts, component: component, rnd: rand.New(rand.NewSource(seed))}
+}
+
+// FaultyMiddleware wraps stores in a FaultyStore
+func FaultyMiddleware(component string, opts FaultyOpts) Middleware {
+	return func(s BlobStore) BlobStore { return NewFaultyStore(component, s, opts) }
+}
+
+// roll returns true rate of the time
+func (f *FaultyStore) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rnd.Float64() < rate
+}
+
+// before waits out the latency of an operation, and returns the error to fail it with, if it's failed
+func (f *FaultyStore) before(op string) error {
+	delay := f.opts.Latency
+	if f.opts.Jitter > 0 {
+		f.mu.Lock()
+		delay += time.Duration(f.rnd.Int63n(int64(f.opts.Jitter)))
+		f.mu.Unlock()
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if f.roll(f.opts.ErrorRate) {
+		metrics.StoreInjectedFaultCount.WithLabelValues(f.component, op, faultError).Inc()
+		return errors.Prefix(f.component+" "+op, ErrInjectedFault)
+	}
+	return nil
+}
+
+// Has checks the store, unless it fails
+func (f *FaultyStore) Has(hash string) (bool, error) {
+	if err := f.before(opHas); err != nil {
+		return false, err
+	}
+	return f.BlobStore.Has(hash)
+}
+
+// Get gets the blob from the store, unless it fails, and may corrupt or cut off the blob
+func (f *FaultyStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
+	start := time.Now()
+	if err := f.before(opGet); err != nil {
+		return nil, shared.NewBlobTrace(time.Since(start), f.Name()), err
+	}
+	blob, trace, err := f.BlobStore.Get(hash)
+	if err != nil || len(blob) == 0 {
+		return blob, trace, err
+	}
+	if f.roll(f.opts.CorruptRate) {
+		metrics.StoreInjectedFaultCount.WithLabelValues(f.component, opGet, faultCorrupt).Inc()
+		// the blob may be shared with a cache, so it's copied before it's changed
+		corrupt := make(stream.Blob, len(blob))
+		copy(corrupt, blob)
+		f.mu.Lock()
+		corrupt[f.rnd.Intn(len(corrupt))] ^= 0xff
+		f.mu.Unlock()
+		blob = corrupt
+	}
+	if f.roll(f.opts.PartialRate) {
+		metrics.StoreInjectedFaultCount.WithLabelValues(f.component, opGet, faultPartial).Inc()
+		f.mu.Lock()
+		blob = blob[:f.rnd.Intn(len(blob))]
+		f.mu.Unlock()
+	}
+	return blob, trace, nil
+}
+
+// Put puts the blob in the store, unless it fails
+func (f *FaultyStore) Put(hash string, blob stream.Blob) error {
+	if err := f.before(opPut); err != nil {
+		return err
+	}
+	return f.BlobStore.Put(hash, blob)
+}
+
+// PutSD puts the sd blob in the store, unless it fails
+func (f *FaultyStore) PutSD(hash string, blob stream.Blob) error {
+	if err := f.before(opPutSD); err != nil {
+		return err
+	}
+	return f.BlobStore.PutSD(hash, blob)
+}
+
+// Delete deletes the blob from the store, unless it fails
+func (f *FaultyStore) Delete(hash string) error {
+	if err := f.before(opDelete); err != nil {
+		return err
+	}
+	return f.BlobStore.Delete(hash)
+}
+
+// ParseFaultyOpts parses a comma separated list of faults given as NAME=VALUE, like
+// "latency=50ms,jitter=20ms,errors=0.05,corrupt=0.01,partial=0.01,seed=1"
+func ParseFaultyOpts(spec string) (FaultyOpts, error) {
+	var opts FaultyOpts
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return opts, errors.Err("faults look like NAME=VALUE, not '%s'", part)
+		}
+		name, value := kv[0], kv[1]
+		var err error
+		switch name {
+		case "latency", "jitter":
+			var d time.Duration
+			d, err = time.ParseDuration(value)
+			if err == nil && d < 0 {
+				err = errors.Err("negative")
+			}
+			if name == "latency" {
+				opts.Latency = d
+			} else {
+				opts.Jitter = d
+			}
+		case "errors", "corrupt", "partial":
+			var rate float64
+			rate, err = strconv.ParseFloat(value, 64)
+			if err == nil && (rate < 0 || rate > 1) {
+				err = errors.Err("out of range")
+			}
+			switch name {
+			case "errors":
+				opts.ErrorRate = rate
+			case "corrupt":
+				opts.CorruptRate = rate
+			default:
+				opts.PartialRate = rate
+			}
+		case "seed":
+			opts.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return opts, errors.Err("unknown fault '%s'", name)
+		}
+		if err != nil {
+			return opts, errors.Err("bad value for fault '%s': '%s'", name, value)
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultyStore_Errors(t *testing.T) {
+	origin := NewMemStore()
+	s := NewFaultyStore("test", origin, FaultyOpts{ErrorRate: 1})
+	assert.True(t, errors.Is(s.Put("hash", []byte("blob")), ErrInjectedFault))
+	has, _ := origin.Has("hash")
+	assert.False(t, has, "failed operations don't reach the store")
+	_, _, err := s.Get("hash")
+	assert.True(t, errors.Is(err, ErrInjectedFault))
+	assert.Equal(t, nameMem, s.Name())
+
+	// the retry middleware gets through faults that don't always happen
+	s = NewFaultyStore("test", origin, FaultyOpts{ErrorRate: 0.5, Seed: 1})
+	retried := RetryMiddleware("test", 20, time.Microsecond)(s)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, retried.Put("hash", []byte("blob")))
+	}
+}
+
+func TestFaultyStore_Seed(t *testing.T) {
+	outcomes := func() []bool {
+		s := NewFaultyStore("test", NewMemStore(), FaultyOpts{ErrorRate: 0.5, Seed: 42})
+		var failed []bool
+		for i := 0; i < 20; i++ {
+			_, err := s.Has("hash")
+			failed = append(failed, err != nil)
+		}
+		return failed
+	}
+	assert.Equal(t, outcomes(), outcomes(), "the same seed injects the same faults")
+}
+
+func TestFaultyStore_CorruptAndPartial(t *testing.T) {
+	blob := stream.Blob("a blob that's long enough to be cut off")
+	origin := NewMemStore()
+	require.NoError(t, origin.Put(blob.HashHex(), blob))
+
+	s := NewFaultyStore("test", origin, FaultyOpts{CorruptRate: 1})
+	got, _, err := s.Get(blob.HashHex())
+	require.NoError(t, err)
+	assert.Len(t, got, len(blob))
+	assert.NotEqual(t, blob.HashHex(), got.HashHex())
+	stored, _, _ := origin.Get(blob.HashHex())
+	assert.Equal(t, blob, stored, "the blob in the store is not changed")
+
+	s = NewFaultyStore("test", origin, FaultyOpts{PartialRate: 1})
+	got, _, err = s.Get(blob.HashHex())
+	require.NoError(t, err)
+	assert.Less(t, len(got), len(blob))
+	assert.Equal(t, blob[:len(got)], got)
+}
+
+func TestParseFaultyOpts(t *testing.T) {
+	opts, err := ParseFaultyOpts("latency=50ms, jitter=20ms,errors=0.05,corrupt=0.01,partial=1,seed=7")
+	require.NoError(t, err)
+	assert.Equal(t, FaultyOpts{Latency: 50 * time.Millisecond, Jitter: 20 * time.Millisecond, ErrorRate: 0.05,
+		CorruptRate: 0.01, PartialRate: 1, Seed: 7}, opts)
+
+	for _, spec := range []string{"latency", "latency=-1s", "errors=2", "corrupt=lots", "seed=x", "fire=1"} {
+		_, err := ParseFaultyOpts(spec)
+		assert.Error(t, err, spec)
+	}
+
+	chain, err := ParseMiddlewares("retry,faults:errors=0.1:latency=1ms", "test")
+	require.NoError(t, err)
+	assert.Len(t, chain, 2)
+}
@@ -0,0 +1,30 @@
+package store
+
+import (
+	"os"
+
+	"github.com/lbryio/reflector.go/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// ErrNotFile is returned by OpenFile when a blob can't be opened as a file, because the store doesn't keep blobs in
+// files or doesn't have this one in a file. The blob should be read with Get instead
+var ErrNotFile = errors.Base("blob is not in a file")
+
+// fileOpener is a store that keeps blobs in files
+type fileOpener interface {
+	// openFile opens the file of a blob. It returns ErrNotFile if the blob is not in a file of this store
+	openFile(hash string) (*os.File, shared.BlobTrace, error)
+}
+
+// OpenFile opens the file a blob is kept in, so a server can send it straight from the file, with sendfile, instead of
+// reading it into memory first. It returns ErrNotFile if the store doesn't have the blob in a file. Unlike Get, the
+// blob is not checked against its hash. Caching stores only open blobs that are in their cache, so misses go through
+// Get and are cached as usual
+func OpenFile(s BlobStore, hash string) (*os.File, shared.BlobTrace, error) {
+	if o, ok := s.(fileOpener); ok {
+		return o.openFile(hash)
+	}
+	return nil, shared.NewBlobTrace(0, s.Name()), errors.Err(ErrNotFile)
+}
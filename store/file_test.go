@@ -0,0 +1,37 @@
+package store
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenFile(t *testing.T) {
+	origin := NewMemStore()
+	s := NewCachingStore("test", origin, NewDiskStore(t.TempDir(), 2))
+
+	hash := "f428b8265d65dad7f8ffa52922bba836404cbd62f3ecfe10adba6b444f8f658938e54f5981ac4de39644d5b93d89a94b"
+	data := []byte("oyuntyausntoyaunpdoyruoyduanrstjwfjyuwf")
+	require.NoError(t, origin.Put(hash, data))
+
+	// a miss goes through Get, which caches the blob on disk
+	_, _, err := OpenFile(s, hash)
+	assert.True(t, errors.Is(err, ErrNotFile))
+	_, _, err = s.Get(hash)
+	require.NoError(t, err)
+
+	f, _, err := OpenFile(s, hash)
+	require.NoError(t, err)
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// blobs in memory are not in files
+	_, _, err = OpenFile(origin, hash)
+	assert.True(t, errors.Is(err, ErrNotFile))
+}
@@ -0,0 +1,293 @@
+package store
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FsckOpts configures a DiskStore check
+type FsckOpts struct {
+	// Repair, if set, is where corrupt blobs are downloaded from again. Otherwise they are only removed
+	Repair BlobStore
+	// Files in the tmp dir older than this are left over from interrupted writes and are removed
+	TmpMaxAge time.Duration
+	// How many blobs are read and hashed at once
+	Workers int
+	// Report problems without changing anything
+	DryRun bool
+}
+
+// FsckResult counts what a check found and fixed
+type FsckResult struct {
+	Checked      int
+	Corrupt      int // the content doesn't match the name, or the file is empty
+	Removed      int // corrupt blobs that were removed
+	Repaired     int // corrupt blobs that were downloaded again
+	Moved        int // good blobs that were in the wrong prefix dir
+	Unreadable   int // files that could not be read or removed
+	UnknownFiles int // files that aren't blobs. they are left alone
+	TmpRemoved   int
+	DirsRemoved  int
+}
+
+// Unfixed returns how many problems are left on disk
+func (r FsckResult) Unfixed() int {
+	return r.Corrupt - r.Removed + r.Unreadable
+}
+
+// Fsck checks every blob in the store against its hash, removes or repairs the corrupt ones, and cleans up stale tmp
+// files and empty prefix dirs. It must not run while the store is in use, or it may remove a blob being written. If
+// blobs were removed or moved, the index of the store is removed, so it is built again the next time the store starts.
+func (d *DiskStore) Fsck(opts FsckOpts) (FsckResult, error) {
+	var result FsckResult
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+
+	_, err := os.Stat(d.blobDir)
+	if err != nil {
+		return result, errors.Err(err)
+	}
+
+	var mu sync.Mutex
+	count := func(f func(r *FsckResult)) {
+		mu.Lock()
+		defer mu.Unlock()
+		f(&result)
+	}
+
+	files := make(chan string, opts.Workers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range files {
+				d.fsckBlob(file, opts, count)
+			}
+		}()
+	}
+
+	dirs, err := d.fsckDirs()
+	if err != nil {
+		close(files)
+		wg.Wait()
+		return result, err
+	}
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			close(files)
+			wg.Wait()
+			return result, errors.Err(err)
+		}
+		for _, e := range entries {
+			if e.IsDir() || (dir == d.blobDir && isStoreFile(e.Name())) {
+				continue
+			}
+			if strings.HasSuffix(e.Name(), partialSuffix) && isBlobHash(strings.TrimSuffix(e.Name(), partialSuffix)) {
+				if d.fsckStaleTmp(path.Join(dir, e.Name()), e, opts) {
+					count(func(r *FsckResult) { r.TmpRemoved++ })
+				}
+				continue
+			}
+			if !isBlobHash(e.Name()) {
+				log.Warnf("%s is not a blob, leaving it alone", path.Join(dir, e.Name()))
+				count(func(r *FsckResult) { r.UnknownFiles++ })
+				continue
+			}
+			files <- path.Join(dir, e.Name())
+		}
+	}
+	close(files)
+	wg.Wait()
+
+	// the index of an indexed store doesn't know about blobs that were removed or moved here. without it, the store
+	// builds a new one from the blob dir the next time it starts
+	if !opts.DryRun && (result.Removed > 0 || result.Moved > 0) {
+		err = os.Remove(path.Join(d.blobDir, diskIndexFile))
+		if err != nil && !os.IsNotExist(err) {
+			return result, errors.Err(err)
+		}
+	}
+
+	tmpRemoved, err := d.fsckTmp(opts)
+	result.TmpRemoved = tmpRemoved
+	if err != nil {
+		return result, err
+	}
+
+	if d.prefixLength > 0 {
+		for _, dir := range dirs {
+			if dir == d.blobDir {
+				continue
+			}
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil || len(entries) > 0 {
+				continue
+			}
+			if opts.DryRun {
+				log.Infof("would remove empty dir %s", dir)
+				result.DirsRemoved++
+				continue
+			}
+			if os.Remove(dir) == nil {
+				result.DirsRemoved++
+			}
+		}
+	}
+	return result, nil
+}
+
+// fsckDirs returns the dirs that hold blobs
+func (d *DiskStore) fsckDirs() ([]string, error) {
+	if d.prefixLength <= 0 {
+		return []string{d.blobDir}, nil
+	}
+	entries, err := ioutil.ReadDir(d.blobDir)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	var dirs []string
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != "tmp" && e.Name() != quarantineDir {
+			dirs = append(dirs, path.Join(d.blobDir, e.Name()))
+		}
+	}
+	return dirs, nil
+}
+
+func (d *DiskStore) fsckBlob(file string, opts FsckOpts, count func(func(r *FsckResult))) {
+	hash := path.Base(file)
+	count(func(r *FsckResult) { r.Checked++ })
+
+	blob, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Errorf("reading %s: %s", file, err.Error())
+		count(func(r *FsckResult) { r.Unreadable++ })
+		return
+	}
+	sum := sha512.Sum384(blob)
+	if len(blob) > 0 && hex.EncodeToString(sum[:]) == hash {
+		if file != d.path(hash) {
+			d.fsckMove(file, hash, opts, count)
+		}
+		return
+	}
+
+	log.Warnf("%s is corrupt", file)
+	count(func(r *FsckResult) { r.Corrupt++ })
+	if opts.DryRun {
+		return
+	}
+
+	err = os.Remove(file)
+	if err != nil {
+		log.Errorf("removing %s: %s", file, err.Error())
+		return
+	}
+	count(func(r *FsckResult) { r.Removed++ })
+
+	if opts.Repair == nil {
+		return
+	}
+	blob, _, err = opts.Repair.Get(hash)
+	if err == nil && stream.Blob(blob).HashHex() != hash {
+		err = errors.Err("%s sent a blob with the wrong hash", opts.Repair.Name())
+	}
+	if err == nil {
+		err = d.Put(hash, blob)
+	}
+	if err != nil {
+		log.Errorf("repairing %s: %s", hash, err.Error())
+		return
+	}
+	count(func(r *FsckResult) { r.Repaired++ })
+}
+
+// fsckMove puts a good blob that is in the wrong prefix dir where the store looks for it
+func (d *DiskStore) fsckMove(file, hash string, opts FsckOpts, count func(func(r *FsckResult))) {
+	log.Warnf("%s is in the wrong dir", file)
+	if opts.DryRun {
+		count(func(r *FsckResult) { r.Moved++ })
+		return
+	}
+	err := d.ensureDirExists(d.dir(hash))
+	if err == nil {
+		err = errors.Err(os.Rename(file, d.path(hash)))
+	}
+	if err != nil {
+		log.Errorf("moving %s: %s", file, err.Error())
+		count(func(r *FsckResult) { r.Unreadable++ })
+		return
+	}
+	count(func(r *FsckResult) { r.Moved++ })
+}
+
+func (d *DiskStore) fsckTmp(opts FsckOpts) (int, error) {
+	tmpDirs := []string{d.tmpDir("")}
+	if d.shardTmp {
+		dirs, err := d.fsckDirs()
+		if err != nil {
+			return 0, err
+		}
+		tmpDirs = tmpDirs[:0]
+		for _, dir := range dirs {
+			tmpDirs = append(tmpDirs, path.Join(dir, "tmp"))
+		}
+	}
+
+	removed := 0
+	for _, tmpDir := range tmpDirs {
+		entries, err := ioutil.ReadDir(tmpDir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return removed, errors.Err(err)
+		}
+		for _, e := range entries {
+			if !e.IsDir() && d.fsckStaleTmp(path.Join(tmpDir, e.Name()), e, opts) {
+				removed++
+			}
+		}
+	}
+	return removed, nil
+}
+
+// fsckStaleTmp removes a file left over from an interrupted write if it's older than the max age, and returns whether
+// it did
+func (d *DiskStore) fsckStaleTmp(file string, info os.FileInfo, opts FsckOpts) bool {
+	if time.Since(info.ModTime()) < opts.TmpMaxAge {
+		return false
+	}
+	if opts.DryRun {
+		log.Infof("would remove stale tmp file %s", file)
+		return true
+	}
+	return os.Remove(file) == nil
+}
+
+// isStoreFile returns whether a file in the blob dir is one the store keeps next to the blobs
+func isStoreFile(name string) bool {
+	return name == diskIndexFile || name == diskIndexFile+".tmp" || name == diskJournalFile
+}
+
+func isBlobHash(name string) bool {
+	if len(name) != stream.BlobHashHexLength {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
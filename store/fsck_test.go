@@ -0,0 +1,76 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskStore_Fsck(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	d := NewDiskStore(tmpDir, 2)
+
+	write := func(file string, data []byte) {
+		require.NoError(t, os.MkdirAll(path.Dir(file), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(file, data, 0644))
+	}
+
+	good := stream.Blob("a good blob")
+	write(d.path(good.HashHex()), good)
+
+	corrupt := stream.Blob("a blob that will be corrupted")
+	write(d.path(corrupt.HashHex()), []byte("bit rot"))
+
+	misplaced := stream.Blob("a blob in the wrong dir")
+	wrongDir := "00"
+	if misplaced.HashHex()[:2] == wrongDir {
+		wrongDir = "11"
+	}
+	write(path.Join(tmpDir, wrongDir, misplaced.HashHex()), misplaced)
+
+	write(path.Join(tmpDir, "ab", "notes.txt"), []byte("not a blob"))
+	require.NoError(t, os.MkdirAll(path.Join(tmpDir, "ff"), os.ModePerm))
+
+	stale := path.Join(tmpDir, "tmp", good.HashHex())
+	write(stale, []byte("half a blob"))
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(stale, old, old))
+
+	index := path.Join(tmpDir, diskIndexFile)
+	write(index, []byte("+"+good.HashHex()+"\n+"+corrupt.HashHex()+"\n"))
+
+	repair := NewMemStore()
+	require.NoError(t, repair.Put(corrupt.HashHex(), corrupt))
+
+	result, err := d.Fsck(FsckOpts{Repair: repair, TmpMaxAge: time.Hour, Workers: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 3, result.Checked)
+	assert.Equal(t, 1, result.Corrupt)
+	assert.Equal(t, 1, result.Removed)
+	assert.Equal(t, 1, result.Repaired)
+	assert.Equal(t, 1, result.Moved)
+	assert.Equal(t, 1, result.UnknownFiles)
+	assert.Equal(t, 1, result.TmpRemoved)
+	assert.Equal(t, 0, result.Unfixed())
+
+	for _, b := range []stream.Blob{good, corrupt, misplaced} {
+		got, err := ioutil.ReadFile(d.path(b.HashHex()))
+		require.NoError(t, err)
+		assert.EqualValues(t, b, got)
+	}
+	_, err = os.Stat(path.Join(tmpDir, "ff"))
+	assert.True(t, os.IsNotExist(err), "empty prefix dir should be removed")
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err), "stale tmp file should be removed")
+	_, err = os.Stat(index)
+	assert.True(t, os.IsNotExist(err), "the index doesn't know about the moved blob and should be removed")
+}
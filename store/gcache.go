@@ -1,6 +1,7 @@
 package store
 
 import (
+	"os"
 	"time"
 
 	"github.com/lbryio/reflector.go/internal/metrics"
@@ -158,6 +159,28 @@ func (l *GcacheStore) loadExisting(store lister, maxItems int) error {
 	return nil
 }
 
+// list returns the blobs that the cache is tracking
+func (l *GcacheStore) list() ([]string, error) {
+	keys := l.cache.Keys(false)
+	hashes := make([]string, 0, len(keys))
+	for _, k := range keys {
+		hashes = append(hashes, k.(string))
+	}
+	return hashes, nil
+}
+
+// openFile opens the file of the blob if the cache is tracking it. The blob counts as used, like in Get
+func (l *GcacheStore) openFile(hash string) (*os.File, shared.BlobTrace, error) {
+	start := time.Now()
+	_, err := l.cache.Get(hash)
+	if err != nil {
+		return nil, shared.NewBlobTrace(time.Since(start), l.Name()), errors.Err(ErrNotFile)
+	}
+	f, trace, err := OpenFile(l.store, hash)
+	return f, trace.Stack(time.Since(start), l.Name()), err
+}
+
 // Shutdown shuts down the store gracefully
 func (l *GcacheStore) Shutdown() {
+	l.store.Shutdown()
 }
@@ -1,11 +1,17 @@
 package store
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,6 +24,11 @@ import (
 
 // HttpStore is a store that works on top of the HTTP protocol
 type HttpStore struct {
+	// Header is added to every request
+	Header http.Header
+	// Sign, if set, is called on every request before it's sent
+	Sign func(req *http.Request)
+
 	upstream   string
 	httpClient *http.Client
 }
@@ -39,6 +50,7 @@ func (n *HttpStore) Has(hash string) (bool, error) {
 	if err != nil {
 		return false, errors.Err(err)
 	}
+	n.addHeader(req)
 
 	res, err := n.httpClient.Do(req)
 	if err != nil {
@@ -55,7 +67,8 @@ func (n *HttpStore) Has(hash string) (bool, error) {
 	if res.Body != nil {
 		body, _ = ioutil.ReadAll(res.Body)
 	}
-	return false, errors.Err("upstream error. Status code: %d (%s)", res.StatusCode, string(body))
+	return false, statusErr(res.StatusCode,
+		fmt.Sprintf("upstream error. Status code: %d (%s)", res.StatusCode, string(body)))
 }
 
 func (n *HttpStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
@@ -66,6 +79,7 @@ func (n *HttpStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
 	if err != nil {
 		return nil, shared.NewBlobTrace(time.Since(start), n.Name()), errors.Err(err)
 	}
+	n.addHeader(req)
 
 	res, err := n.httpClient.Do(req)
 	if err != nil {
@@ -103,7 +117,120 @@ func (n *HttpStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
 		body, _ = ioutil.ReadAll(res.Body)
 	}
 
-	return nil, trace.Stack(time.Since(start), n.Name()), errors.Err("upstream error. Status code: %d (%s)", res.StatusCode, string(body))
+	return nil, trace.Stack(time.Since(start), n.Name()),
+		statusErr(res.StatusCode, fmt.Sprintf("upstream error. Status code: %d (%s)", res.StatusCode, string(body)))
+}
+
+// statusErr is the error for a response with an unexpected status. Server errors are ErrServerError
+func statusErr(status int, msg string) error {
+	if status >= http.StatusInternalServerError {
+		return errors.Prefix(msg, ErrServerError)
+	}
+	return errors.Err(msg)
+}
+
+const (
+	// InventoryPath is where the http server lists its blobs, if it's allowed to
+	InventoryPath = "/inventory"
+	// InventoryCountHeader says how many hashes the inventory has
+	InventoryCountHeader = "X-Blob-Count"
+	// BlobsPath is where the http server lists its blobs a page at a time, if it's allowed to
+	BlobsPath = "/blobs"
+)
+
+// BlobsPage is a page of the blobs a server has, as listed at BlobsPath
+type BlobsPage struct {
+	Blobs []string `json:"blobs"`
+	// Next is what to pass as after to get the next page. It's empty on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// Inventory returns the hashes of the blobs the upstream server has that start with prefix, or all of them if prefix
+// is empty. The server must serve its inventory
+func (n *HttpStore) Inventory(prefix string) ([]string, error) {
+	req, err := http.NewRequest("GET", n.upstream+InventoryPath+"?prefix="+url.QueryEscape(prefix), nil)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	n.addHeader(req)
+
+	res, err := n.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, errors.Err("upstream error listing blobs. Status code: %d (%s)", res.StatusCode, string(body))
+	}
+
+	var hashes []string
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		h := strings.TrimSpace(scanner.Text())
+		if h == "" {
+			continue
+		}
+		if len(h) != stream.BlobHashHexLength {
+			return nil, errors.Err("upstream listed an invalid hash: %s", h)
+		}
+		hashes = append(hashes, h)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Err(err)
+	}
+	return hashes, nil
+}
+
+func (n *HttpStore) list() ([]string, error) {
+	return n.Inventory("")
+}
+
+func (n *HttpStore) listPage(after string, limit int) ([]string, error) {
+	var hashes []string
+	for len(hashes) < limit {
+		query := url.Values{"after": {after}, "limit": {strconv.Itoa(limit - len(hashes))}}
+		req, err := http.NewRequest("GET", n.upstream+BlobsPath+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		n.addHeader(req)
+
+		res, err := n.httpClient.Do(req)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		var page BlobsPage
+		if res.StatusCode == http.StatusOK {
+			err = json.NewDecoder(res.Body).Decode(&page)
+		} else {
+			body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+			err = errors.Err("upstream error listing blobs. Status code: %d (%s)", res.StatusCode, string(body))
+		}
+		res.Body.Close()
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		// the server may return smaller pages than asked for
+		hashes = append(hashes, page.Blobs...)
+		if page.Next == "" {
+			break
+		}
+		after = page.Next
+	}
+	if len(hashes) > limit {
+		hashes = hashes[:limit]
+	}
+	return hashes, nil
+}
+
+func (n *HttpStore) addHeader(req *http.Request) {
+	for k, v := range n.Header {
+		req.Header[k] = v
+	}
+	if n.Sign != nil {
+		n.Sign(req)
+	}
 }
 
 func (n *HttpStore) Put(string, stream.Blob) error {
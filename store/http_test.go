@@ -0,0 +1,71 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHttpStore_Inventory(t *testing.T) {
+	hashes := []string{stream.Blob("a").HashHex(), stream.Blob("b").HashHex()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, InventoryPath, r.URL.Path)
+		assert.Equal(t, "Bearer tok", r.Header.Get("Authorization"))
+		if r.URL.Query().Get("prefix") == "bad" {
+			_, _ = w.Write([]byte("not a hash\n"))
+			return
+		}
+		_, _ = w.Write([]byte(strings.Join(hashes, "\n") + "\n"))
+	}))
+	defer srv.Close()
+
+	s := NewHttpStore(strings.TrimPrefix(srv.URL, "http://"))
+	s.Header = http.Header{"Authorization": []string{"Bearer tok"}}
+	listed, err := List(s)
+	require.NoError(t, err)
+	assert.Equal(t, hashes, listed)
+
+	_, err = s.Inventory("bad")
+	assert.Error(t, err)
+}
+
+func TestHttpStore_ListPage(t *testing.T) {
+	mem := NewMemStore()
+	for i := 0; i < 10; i++ {
+		b := stream.Blob(fmt.Sprintf("blob %d", i))
+		require.NoError(t, mem.Put(b.HashHex(), b))
+	}
+	all, err := ListPage(mem, "", 100)
+	require.NoError(t, err)
+
+	// a server that returns at most 3 hashes at a time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, BlobsPath, r.URL.Path)
+		hashes, err := ListPage(mem, r.URL.Query().Get("after"), 4)
+		require.NoError(t, err)
+		page := BlobsPage{Blobs: hashes}
+		if len(hashes) > 3 {
+			page.Blobs = hashes[:3]
+			page.Next = hashes[2]
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(page))
+	}))
+	defer srv.Close()
+
+	s := NewHttpStore(strings.TrimPrefix(srv.URL, "http://"))
+	listed, err := ListPage(s, "", 8)
+	require.NoError(t, err)
+	assert.Equal(t, all[:8], listed)
+
+	listed, err = ListPage(s, all[7], 8)
+	require.NoError(t, err)
+	assert.Equal(t, all[8:], listed)
+}
@@ -12,6 +12,9 @@ import (
 
 // ITTTStore performs an operation on this storage, if this fails, it attempts to run it on that
 type ITTTStore struct {
+	// Policy decides whether a get that fails on this goes on to that. If it's nil, every error does
+	Policy *TierPolicy
+
 	this, that BlobStore
 }
 
@@ -37,16 +40,20 @@ func (c *ITTTStore) Has(hash string) (bool, error) {
 	return has, err
 }
 
-// Get tries to get the blob from this first, falling back to that.
+// Get tries to get the blob from this first, falling back to that as the Policy says.
 func (c *ITTTStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
 	start := time.Now()
-	blob, trace, err := c.this.Get(hash)
+	policy := policyOr(c.Policy, fallbackOnError)
+	blob, trace, next, err := policy.get(nameIttt, c.this, hash)
 	if err == nil {
 		metrics.ThisHitCount.Inc()
 		return blob, trace.Stack(time.Since(start), c.Name()), err
 	}
+	if !next {
+		return nil, trace.Stack(time.Since(start), c.Name()), err
+	}
 
-	blob, trace, err = c.that.Get(hash)
+	blob, trace, _, err = policy.get(nameIttt, c.that, hash)
 	if err != nil {
 		return nil, trace.Stack(time.Since(start), c.Name()), err
 	}
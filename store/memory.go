@@ -1,26 +1,70 @@
 package store
 
 import (
+	"container/list"
+	"hash/fnv"
 	"sync"
 	"time"
 
+	"github.com/lbryio/reflector.go/internal/metrics"
 	"github.com/lbryio/reflector.go/shared"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
 	"github.com/lbryio/lbry.go/v2/stream"
 )
 
-// MemStore is an in memory only blob store with no persistence.
+// MemStore is an in memory only blob store with no persistence. With a size cap, it's an LRU cache that evicts the
+// least recently used blobs once the blobs take up more than the cap, so it can be used as a hot cache in front of
+// slower stores.
 type MemStore struct {
-	blobs map[string]stream.Blob
-	mu    *sync.RWMutex
+	opts   MemStoreOpts
+	shards []*memShard
 }
 
+// MemStoreOpts configures a MemStore
+type MemStoreOpts struct {
+	// MaxBytes is how many bytes of blobs the store holds before it evicts the least recently used ones. 0 for no limit
+	MaxBytes int64
+	// Shards splits the store into this many parts, each with its own lock and its share of MaxBytes, so concurrent
+	// requests don't wait on each other. Blobs are evicted from the least recently used of each shard, which is close
+	// enough to the least recently used overall once there are many blobs
+	Shards int
+	// Component names the store in metrics. Metrics are only reported if it's set
+	Component string
+}
+
+type memShard struct {
+	mu       sync.Mutex
+	blobs    map[string]*list.Element
+	lru      *list.List // of *memEntry, most recently used first
+	bytes    int64
+	maxBytes int64
+}
+
+type memEntry struct {
+	hash string
+	blob stream.Blob
+}
+
+// NewMemStore returns a MemStore with no size cap
 func NewMemStore() *MemStore {
-	return &MemStore{
-		blobs: make(map[string]stream.Blob),
-		mu:    &sync.RWMutex{},
+	return NewMemStoreWithOpts(MemStoreOpts{})
+}
+
+// NewMemStoreWithOpts returns a MemStore configured with opts
+func NewMemStoreWithOpts(opts MemStoreOpts) *MemStore {
+	if opts.Shards < 1 {
+		opts.Shards = 1
+	}
+	m := &MemStore{opts: opts, shards: make([]*memShard, opts.Shards)}
+	for i := range m.shards {
+		m.shards[i] = &memShard{
+			blobs:    make(map[string]*list.Element),
+			lru:      list.New(),
+			maxBytes: opts.MaxBytes / int64(opts.Shards),
+		}
 	}
+	return m
 }
 
 const nameMem = "mem"
@@ -28,34 +72,95 @@ const nameMem = "mem"
 // Name is the cache type name
 func (m *MemStore) Name() string { return nameMem }
 
+func (m *MemStore) shard(hash string) *memShard {
+	if len(m.shards) == 1 {
+		return m.shards[0]
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(hash))
+	return m.shards[h.Sum32()%uint32(len(m.shards))]
+}
+
 // Has returns T/F if the blob is currently stored. It will never error.
 func (m *MemStore) Has(hash string) (bool, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	_, ok := m.blobs[hash]
+	s := m.shard(hash)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.blobs[hash]
 	return ok, nil
 }
 
 // Get returns the blob byte slice if present and errors if the blob is not found.
 func (m *MemStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
 	start := time.Now()
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	blob, ok := m.blobs[hash]
+	s := m.shard(hash)
+	var blob stream.Blob
+	s.mu.Lock()
+	e, ok := s.blobs[hash]
+	if ok {
+		s.lru.MoveToFront(e)
+		blob = e.Value.(*memEntry).blob
+	}
+	s.mu.Unlock()
+
 	if !ok {
+		if m.opts.Component != "" {
+			metrics.MemStoreMissCount.WithLabelValues(m.opts.Component).Inc()
+		}
 		return nil, shared.NewBlobTrace(time.Since(start), m.Name()), errors.Err(ErrBlobNotFound)
 	}
+	if m.opts.Component != "" {
+		metrics.MemStoreHitCount.WithLabelValues(m.opts.Component).Inc()
+	}
 	return blob, shared.NewBlobTrace(time.Since(start), m.Name()), nil
 }
 
-// Put stores the blob in memory
+// Put stores the blob in memory, evicting the least recently used blobs if it goes over the size cap. Blobs bigger than
+// the cap of a shard are not stored
 func (m *MemStore) Put(hash string, blob stream.Blob) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.blobs[hash] = blob
+	s := m.shard(hash)
+	size := int64(len(blob))
+	if s.maxBytes > 0 && size > s.maxBytes {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	added := size
+	if e, ok := s.blobs[hash]; ok {
+		entry := e.Value.(*memEntry)
+		added -= int64(len(entry.blob))
+		entry.blob = blob
+		s.lru.MoveToFront(e)
+	} else {
+		s.blobs[hash] = s.lru.PushFront(&memEntry{hash: hash, blob: blob})
+	}
+	s.bytes += added
+
+	evicted := 0
+	for s.maxBytes > 0 && s.bytes > s.maxBytes {
+		oldest := s.lru.Back()
+		added -= s.remove(oldest)
+		evicted++
+	}
+	if m.opts.Component != "" {
+		metrics.MemStoreBytes.WithLabelValues(m.opts.Component).Add(float64(added))
+		if evicted > 0 {
+			metrics.CacheLRUEvictCount.With(metrics.CacheLabels(m.Name(), m.opts.Component)).Add(float64(evicted))
+		}
+	}
 	return nil
 }
 
+// remove must be called with the lock held. It returns the size of the removed blob
+func (s *memShard) remove(e *list.Element) int64 {
+	entry := s.lru.Remove(e).(*memEntry)
+	delete(s.blobs, entry.hash)
+	size := int64(len(entry.blob))
+	s.bytes -= size
+	return size
+}
+
 // PutSD stores the sd blob in memory
 func (m *MemStore) PutSD(hash string, blob stream.Blob) error {
 	return m.Put(hash, blob)
@@ -63,17 +168,54 @@ func (m *MemStore) PutSD(hash string, blob stream.Blob) error {
 
 // Delete deletes the blob from the store
 func (m *MemStore) Delete(hash string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	delete(m.blobs, hash)
+	s := m.shard(hash)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.blobs[hash]
+	if !ok {
+		return nil
+	}
+	size := s.remove(e)
+	if m.opts.Component != "" {
+		metrics.MemStoreBytes.WithLabelValues(m.opts.Component).Sub(float64(size))
+	}
 	return nil
 }
 
+// Size returns how many bytes of blobs are stored
+func (m *MemStore) Size() int64 {
+	var size int64
+	for _, s := range m.shards {
+		s.mu.Lock()
+		size += s.bytes
+		s.mu.Unlock()
+	}
+	return size
+}
+
+func (m *MemStore) list() ([]string, error) {
+	hashes := make([]string, 0)
+	for _, s := range m.shards {
+		s.mu.Lock()
+		for h := range s.blobs {
+			hashes = append(hashes, h)
+		}
+		s.mu.Unlock()
+	}
+	return hashes, nil
+}
+
 // Debug returns the blobs in memory. It's useful for testing and debugging.
 func (m *MemStore) Debug() map[string]stream.Blob {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return m.blobs
+	blobs := make(map[string]stream.Blob)
+	for _, s := range m.shards {
+		s.mu.Lock()
+		for h, e := range s.blobs {
+			blobs[h] = e.Value.(*memEntry).blob
+		}
+		s.mu.Unlock()
+	}
+	return blobs
 }
 
 // Shutdown shuts down the store gracefully
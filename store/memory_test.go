@@ -44,3 +44,70 @@ func TestMemStore_Get(t *testing.T) {
 		t.Error("Got blob that is not empty")
 	}
 }
+
+func TestMemStore_Eviction(t *testing.T) {
+	s := NewMemStoreWithOpts(MemStoreOpts{MaxBytes: 10})
+	for _, hash := range []string{"a", "b", "c"} {
+		err := s.Put(hash, []byte("abc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a is used, so b is the least recently used
+	_, _, err := s.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Put("d", []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if has, _ := s.Has("b"); has {
+		t.Error("Expected the least recently used blob to be evicted")
+	}
+	for _, hash := range []string{"a", "c", "d"} {
+		if has, _ := s.Has(hash); !has {
+			t.Errorf("Expected %s to be kept", hash)
+		}
+	}
+	if s.Size() != 9 {
+		t.Errorf("Expected 9 bytes, got %d", s.Size())
+	}
+
+	err = s.Put("big", []byte("abcdefghijk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := s.Has("big"); has {
+		t.Error("Expected a blob bigger than the cap to not be stored")
+	}
+
+	err = s.Delete("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Size() != 6 {
+		t.Errorf("Expected 6 bytes, got %d", s.Size())
+	}
+}
+
+func TestMemStore_Shards(t *testing.T) {
+	s := NewMemStoreWithOpts(MemStoreOpts{Shards: 4, Component: "test"})
+	hashes := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, hash := range hashes {
+		err := s.Put(hash, []byte(hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.Debug()) != len(hashes) {
+		t.Errorf("Expected %d blobs, got %d", len(hashes), len(s.Debug()))
+	}
+	for _, hash := range hashes {
+		blob, _, err := s.Get(hash)
+		if err != nil || string(blob) != hash {
+			t.Errorf("Expected to get %s, got %s (%v)", hash, blob, err)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package store
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Middleware wraps a store to add a behavior to it, the way http middleware wraps a handler. Behaviors that every
+// store could use, like metrics or retries, are written once as a middleware instead of in each store.
+type Middleware func(BlobStore) BlobStore
+
+// Chain wraps s in the middlewares. The first middleware is the outermost one, so it sees each call first
+func Chain(s BlobStore, middlewares ...Middleware) BlobStore {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		s = middlewares[i](s)
+	}
+	return s
+}
+
+// ErrTimeout is returned by the timeout middleware when the store takes too long
+var ErrTimeout = errors.Base("store operation timed out")
+
+// operations on a store, used in metrics and logs
+const (
+	opHas    = "has"
+	opGet    = "get"
+	opPut    = "put"
+	opPutSD  = "put_sd"
+	opDelete = "delete"
+)
+
+// opResult is what a store operation returns besides its error
+type opResult struct {
+	blob  stream.Blob
+	trace shared.BlobTrace
+	has   bool
+}
+
+// aroundFunc runs a store operation, adding a behavior around it. call may be run any number of times, or keep running
+// after the aroundFunc returned
+type aroundFunc func(op string, call func() (opResult, error)) (opResult, error)
+
+// middlewareStore passes every operation on the store through an aroundFunc. It's what the built-in middlewares are
+// made of. It has the name of the store it wraps, so it doesn't show up in traces and metrics of its own
+type middlewareStore struct {
+	BlobStore
+	around aroundFunc
+}
+
+func wrapAround(around aroundFunc) Middleware {
+	return func(s BlobStore) BlobStore {
+		return &middlewareStore{BlobStore: s, around: around}
+	}
+}
+
+// Has passes the call through the middleware
+func (m *middlewareStore) Has(hash string) (bool, error) {
+	res, err := m.around(opHas, func() (opResult, error) {
+		has, err := m.BlobStore.Has(hash)
+		return opResult{has: has}, err
+	})
+	return res.has, err
+}
+
+// Get passes the call through the middleware
+func (m *middlewareStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
+	res, err := m.around(opGet, func() (opResult, error) {
+		blob, trace, err := m.BlobStore.Get(hash)
+		return opResult{blob: blob, trace: trace}, err
+	})
+	return res.blob, res.trace, err
+}
+
+// Put passes the call through the middleware
+func (m *middlewareStore) Put(hash string, blob stream.Blob) error {
+	_, err := m.around(opPut, func() (opResult, error) {
+		return opResult{}, m.BlobStore.Put(hash, blob)
+	})
+	return err
+}
+
+// PutSD passes the call through the middleware
+func (m *middlewareStore) PutSD(hash string, blob stream.Blob) error {
+	_, err := m.around(opPutSD, func() (opResult, error) {
+		return opResult{}, m.BlobStore.PutSD(hash, blob)
+	})
+	return err
+}
+
+// Delete passes the call through the middleware
+func (m *middlewareStore) Delete(hash string) error {
+	_, err := m.around(opDelete, func() (opResult, error) {
+		return opResult{}, m.BlobStore.Delete(hash)
+	})
+	return err
+}
+
+// opOutcome sorts the error of an operation for metrics and logs
+func opOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrBlobNotFound):
+		return "not_found"
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	}
+	return "error"
+}
+
+// MetricsMiddleware reports how long the operations on the store take, and how they turn out
+func MetricsMiddleware(component string) Middleware {
+	return wrapAround(func(op string, call func() (opResult, error)) (opResult, error) {
+		start := time.Now()
+		res, err := call()
+		metrics.StoreOperationSeconds.WithLabelValues(component, op, opOutcome(err)).Observe(time.Since(start).Seconds())
+		return res, err
+	})
+}
+
+// LoggingMiddleware logs every operation on the store at debug level, and the ones that fail at warning level. Blobs
+// that are not found are not failures
+func LoggingMiddleware(component string) Middleware {
+	return wrapAround(func(op string, call func() (opResult, error)) (opResult, error) {
+		start := time.Now()
+		res, err := call()
+		outcome := opOutcome(err)
+		if outcome == "ok" || outcome == "not_found" {
+			log.Debugf("%s: %s took %s (%s)", component, op, time.Since(start), outcome)
+		} else {
+			log.Warnf("%s: %s failed after %s: %s", component, op, time.Since(start), err.Error())
+		}
+		return res, err
+	})
+}
+
+// RetryMiddleware tries failed operations again, up to attempts times in all, waiting a random time up to a backoff
+// that starts at minBackoff and doubles. Blobs that are not found, are unavailable or are behind an open circuit
+// breaker are not retried
+func RetryMiddleware(component string, attempts int, minBackoff time.Duration) Middleware {
+	policy := S3RetryPolicy{MaxAttempts: attempts, MinBackoff: minBackoff, MaxBackoff: 100 * minBackoff}.withDefaults()
+	return wrapAround(func(op string, call func() (opResult, error)) (opResult, error) {
+		res, err := call()
+		for retry := 0; retry+1 < policy.MaxAttempts && retryable(err); retry++ {
+			metrics.StoreRetryCount.WithLabelValues(component, op).Inc()
+			time.Sleep(backoff(policy, retry))
+			res, err = call()
+		}
+		return res, err
+	})
+}
+
+func retryable(err error) bool {
+	return err != nil && !errors.Is(err, ErrBlobNotFound) && !errors.Is(err, ErrBlobUnavailable) &&
+		!errors.Is(err, ErrCircuitOpen)
+}
+
+// TimeoutMiddleware fails operations that take longer than timeout with ErrTimeout. The store has no way to be told to
+// stop, so the operation keeps running in the background and its result is thrown away
+func TimeoutMiddleware(component string, timeout time.Duration) Middleware {
+	return wrapAround(func(op string, call func() (opResult, error)) (opResult, error) {
+		type result struct {
+			res opResult
+			err error
+		}
+		done := make(chan result, 1)
+		go func() {
+			res, err := call()
+			done <- result{res, err}
+		}()
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case r := <-done:
+			return r.res, r.err
+		case <-timer.C:
+			metrics.StoreTimeoutCount.WithLabelValues(component, op).Inc()
+			return opResult{trace: shared.NewBlobTrace(timeout, component)},
+				errors.Prefix(component+" "+op+" after "+timeout.String(), ErrTimeout)
+		}
+	})
+}
+
+// SingleflightMiddleware makes concurrent gets of the same blob share one request to the store
+func SingleflightMiddleware(component string) Middleware {
+	return func(s BlobStore) BlobStore { return WithSingleFlight(component, s) }
+}
+
+// CircuitBreakerMiddleware stops calling the store while it keeps failing. See CircuitBreakerStore
+func CircuitBreakerMiddleware(component string) Middleware {
+	return func(s BlobStore) BlobStore { return NewCircuitBreakerStore(component, s) }
+}
+
+// ParseMiddlewares builds a chain of middlewares from a comma separated list, like "metrics,retry:3,timeout:10s". The
+// middlewares are metrics, logging, retry[:ATTEMPTS[:MIN_BACKOFF]] (3 attempts and 100ms by default),
+// timeout:DURATION, singleflight, breaker and faults[:NAME=VALUE...] (see ParseFaultyOpts). component names the chain in
+// metrics and logs.
+func ParseMiddlewares(spec, component string) ([]Middleware, error) {
+	var chain []Middleware
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		args := strings.Split(part, ":")
+		name, args := args[0], args[1:]
+		maxArgs := 0
+		switch name {
+		case "metrics":
+			chain = append(chain, MetricsMiddleware(component))
+		case "logging":
+			chain = append(chain, LoggingMiddleware(component))
+		case "singleflight":
+			chain = append(chain, SingleflightMiddleware(component))
+		case "breaker":
+			chain = append(chain, CircuitBreakerMiddleware(component))
+		case "retry":
+			maxArgs = 2
+			attempts, minBackoff := 3, 100*time.Millisecond
+			var err error
+			if len(args) > 0 {
+				attempts, err = strconv.Atoi(args[0])
+				if err != nil || attempts < 1 {
+					return nil, errors.Err("retry attempts must be a positive number, not '%s'", args[0])
+				}
+			}
+			if len(args) > 1 {
+				minBackoff, err = time.ParseDuration(args[1])
+				if err != nil || minBackoff <= 0 {
+					return nil, errors.Err("retry backoff must be a positive duration, not '%s'", args[1])
+				}
+			}
+			chain = append(chain, RetryMiddleware(component, attempts, minBackoff))
+		case "timeout":
+			maxArgs = 1
+			if len(args) == 0 {
+				return nil, errors.Err("timeout middleware needs a duration, like timeout:10s")
+			}
+			timeout, err := time.ParseDuration(args[0])
+			if err != nil || timeout <= 0 {
+				return nil, errors.Err("timeout must be a positive duration, not '%s'", args[0])
+			}
+			chain = append(chain, TimeoutMiddleware(component, timeout))
+		case "faults":
+			maxArgs = len(args)
+			opts, err := ParseFaultyOpts(strings.Join(args, ","))
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, FaultyMiddleware(component, opts))
+		default:
+			return nil, errors.Err("unknown store middleware '%s'", name)
+		}
+		if len(args) > maxArgs {
+			return nil, errors.Err("too many arguments for store middleware '%s'", name)
+		}
+	}
+	return chain, nil
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore is a MemStore whose Puts fail the first failures times
+type countingStore struct {
+	*MemStore
+	failures int
+	puts     int
+}
+
+func (c *countingStore) Put(hash string, blob stream.Blob) error {
+	c.puts++
+	if c.puts <= c.failures {
+		return errors.Err("origin is down")
+	}
+	return c.MemStore.Put(hash, blob)
+}
+
+func TestChain_Order(t *testing.T) {
+	var calls []string
+	mark := func(name string) Middleware {
+		return wrapAround(func(op string, call func() (opResult, error)) (opResult, error) {
+			calls = append(calls, name)
+			return call()
+		})
+	}
+	s := Chain(NewMemStore(), mark("outer"), mark("inner"))
+	_, _ = s.Has("hash")
+	assert.Equal(t, []string{"outer", "inner"}, calls)
+	assert.Equal(t, nameMem, s.Name())
+}
+
+func TestRetryMiddleware(t *testing.T) {
+	origin := &countingStore{MemStore: NewMemStore(), failures: 2}
+	s := RetryMiddleware("test", 3, time.Millisecond)(origin)
+	require.NoError(t, s.Put("hash", []byte("blob")))
+	assert.Equal(t, 3, origin.puts)
+
+	// not found is an answer, not a failure
+	_, _, err := s.Get("missing")
+	assert.True(t, errors.Is(err, ErrBlobNotFound))
+
+	origin = &countingStore{MemStore: NewMemStore(), failures: 5}
+	s = RetryMiddleware("test", 3, time.Millisecond)(origin)
+	assert.Error(t, s.Put("hash", []byte("blob")))
+	assert.Equal(t, 3, origin.puts)
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	origin := &slowStore{MemStore: NewMemStore(), delay: 200 * time.Millisecond}
+	require.NoError(t, origin.Put("hash", []byte("blob")))
+	s := TimeoutMiddleware("test", 20*time.Millisecond)(origin)
+
+	start := time.Now()
+	_, _, err := s.Get("hash")
+	assert.True(t, errors.Is(err, ErrTimeout))
+	assert.Less(t, int64(time.Since(start)), int64(150*time.Millisecond))
+
+	blob, _, err := TimeoutMiddleware("test", time.Second)(origin).Get("hash")
+	require.NoError(t, err)
+	assert.EqualValues(t, "blob", blob)
+}
+
+func TestParseMiddlewares(t *testing.T) {
+	chain, err := ParseMiddlewares("metrics, logging,retry:2:10ms,timeout:5s,singleflight,breaker", "test")
+	require.NoError(t, err)
+	assert.Len(t, chain, 6)
+
+	chain, err = ParseMiddlewares("", "test")
+	require.NoError(t, err)
+	assert.Empty(t, chain)
+
+	for _, spec := range []string{"nope", "timeout", "timeout:soon", "retry:0", "metrics:1", "retry:1:1s:1"} {
+		_, err := ParseMiddlewares(spec, "test")
+		assert.Error(t, err, spec)
+	}
+}
+
+// slowStore is a MemStore whose Gets take delay
+type slowStore struct {
+	*MemStore
+	delay time.Duration
+}
+
+func (s *slowStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
+	time.Sleep(s.delay)
+	return s.MemStore.Get(hash)
+}
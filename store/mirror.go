@@ -0,0 +1,231 @@
+package store
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MirrorStore writes every blob to two stores, and reads from the primary with a fallback to the secondary. It's
+// used to move to another storage provider without downtime: mirror new uploads to the new store while the old blobs
+// are copied over, then switch. The store keeps track of blobs that are missing from one side (the drift), so they can
+// be copied over later.
+type MirrorStore struct {
+	// Policy decides whether a get that fails on the primary goes on to the secondary. If it's nil, every error does
+	Policy *TierPolicy
+
+	primary, secondary BlobStore
+
+	mu                 sync.Mutex
+	missingOnSecondary map[string]struct{}
+	missingOnPrimary   map[string]struct{}
+	secondaryFailures  int
+	fallbacks          int
+}
+
+// maxDriftHashes is how many hashes are kept for each side of the drift. Counts keep going past it
+const maxDriftHashes = 100000
+
+// reasons for drift, used in metrics
+const (
+	driftSecondaryWrite = "secondary_write_failed"
+	driftPrimaryMissing = "primary_missing"
+)
+
+// NewMirrorStore returns a store that mirrors writes from primary to secondary
+func NewMirrorStore(primary, secondary BlobStore) *MirrorStore {
+	return &MirrorStore{
+		primary:            primary,
+		secondary:          secondary,
+		missingOnSecondary: make(map[string]struct{}),
+		missingOnPrimary:   make(map[string]struct{}),
+	}
+}
+
+const nameMirror = "mirror"
+
+// Name is the cache type name
+func (m *MirrorStore) Name() string { return nameMirror }
+
+// Has checks the primary and then the secondary. It returns true if either store has the blob
+func (m *MirrorStore) Has(hash string) (bool, error) {
+	has, err := m.primary.Has(hash)
+	if has && err == nil {
+		return true, nil
+	}
+	has2, err2 := m.secondary.Has(hash)
+	if has2 && err2 == nil {
+		return true, nil
+	}
+	return has, err
+}
+
+// Get gets the blob from the primary, falling back to the secondary if the primary doesn't have it or fails, as the
+// Policy says
+func (m *MirrorStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
+	start := time.Now()
+	policy := policyOr(m.Policy, fallbackOnError)
+	blob, trace, next, err := policy.get(nameMirror, m.primary, hash)
+	if err == nil {
+		return blob, trace.Stack(time.Since(start), m.Name()), nil
+	}
+	if !next {
+		return nil, trace.Stack(time.Since(start), m.Name()), err
+	}
+
+	blob, trace2, _, err2 := policy.get(nameMirror, m.secondary, hash)
+	if err2 != nil {
+		// the primary's error is the one that matters
+		return nil, trace.Stack(time.Since(start), m.Name()), err
+	}
+	if errors.Is(err, ErrBlobNotFound) {
+		m.drift(hash, driftPrimaryMissing)
+	}
+	m.mu.Lock()
+	m.fallbacks++
+	m.mu.Unlock()
+	return blob, trace2.Stack(time.Since(start), m.Name()), nil
+}
+
+// Put stores the blob in the primary and then the secondary. It only fails if the primary does. Blobs that the
+// secondary fails to store are counted as drift
+func (m *MirrorStore) Put(hash string, blob stream.Blob) error {
+	return m.put(hash, func(s BlobStore) error { return s.Put(hash, blob) })
+}
+
+// PutSD stores the sd blob in the primary and then the secondary, like Put
+func (m *MirrorStore) PutSD(hash string, blob stream.Blob) error {
+	return m.put(hash, func(s BlobStore) error { return s.PutSD(hash, blob) })
+}
+
+func (m *MirrorStore) put(hash string, put func(BlobStore) error) error {
+	err := put(m.primary)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	delete(m.missingOnPrimary, hash)
+	m.mu.Unlock()
+
+	err = put(m.secondary)
+	if err != nil {
+		log.Warnf("mirroring %s to %s failed: %s", hash[:8], m.secondary.Name(), err.Error())
+		m.drift(hash, driftSecondaryWrite)
+		return nil
+	}
+	m.mu.Lock()
+	delete(m.missingOnSecondary, hash)
+	m.mu.Unlock()
+	return nil
+}
+
+// Delete deletes the blob from both stores
+func (m *MirrorStore) Delete(hash string) error {
+	err := m.primary.Delete(hash)
+	err2 := m.secondary.Delete(hash)
+	m.mu.Lock()
+	delete(m.missingOnPrimary, hash)
+	delete(m.missingOnSecondary, hash)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return err2
+}
+
+// Shutdown shuts down both stores
+func (m *MirrorStore) Shutdown() {
+	m.primary.Shutdown()
+	m.secondary.Shutdown()
+}
+
+func (m *MirrorStore) drift(hash, reason string) {
+	metrics.MirrorDriftCount.WithLabelValues(reason).Inc()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	missing := m.missingOnPrimary
+	if reason == driftSecondaryWrite {
+		m.secondaryFailures++
+		missing = m.missingOnSecondary
+	}
+	if len(missing) < maxDriftHashes {
+		missing[hash] = struct{}{}
+	}
+}
+
+// DriftReport says which blobs are known to be missing from one of the mirrored stores
+type DriftReport struct {
+	Primary   string `json:"primary"`
+	Secondary string `json:"secondary"`
+	// SecondaryWriteFailures is how many writes the secondary failed
+	SecondaryWriteFailures int `json:"secondary_write_failures"`
+	// Fallbacks is how many reads were served by the secondary
+	Fallbacks int `json:"fallbacks"`
+	// MissingOnSecondary are the blobs the secondary failed to store, and didn't store later
+	MissingOnSecondary []string `json:"missing_on_secondary"`
+	// MissingOnPrimary are the blobs that the primary didn't have when they were read
+	MissingOnPrimary []string `json:"missing_on_primary"`
+}
+
+// Drift returns the drift since the store was created
+func (m *MirrorStore) Drift() DriftReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return DriftReport{
+		Primary:                m.primary.Name(),
+		Secondary:              m.secondary.Name(),
+		SecondaryWriteFailures: m.secondaryFailures,
+		Fallbacks:              m.fallbacks,
+		MissingOnSecondary:     sortedHashes(m.missingOnSecondary),
+		MissingOnPrimary:       sortedHashes(m.missingOnPrimary),
+	}
+}
+
+// ServeHTTP shows the drift report as json. With ?missing=secondary or ?missing=primary, it lists the hashes missing
+// from that side one per line instead, which can be used as the hashes file of a migration
+func (m *MirrorStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := m.Drift()
+	var hashes []string
+	switch r.URL.Query().Get("missing") {
+	case "":
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(report)
+		if err != nil {
+			log.Error(err)
+		}
+		return
+	case "secondary":
+		hashes = report.MissingOnSecondary
+	case "primary":
+		hashes = report.MissingOnPrimary
+	default:
+		http.Error(w, "missing should be primary or secondary", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	for _, hash := range hashes {
+		_, err := w.Write([]byte(hash + "\n"))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func sortedHashes(set map[string]struct{}) []string {
+	hashes := make([]string, 0, len(set))
+	for hash := range set {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+)
+
+var (
+	hashA = strings.Repeat("a", stream.BlobHashHexLength)
+	hashB = strings.Repeat("b", stream.BlobHashHexLength)
+	hashC = strings.Repeat("c", stream.BlobHashHexLength)
+)
+
+// failingPutStore is a MemStore that can't store blobs
+type failingPutStore struct {
+	*MemStore
+}
+
+func (f failingPutStore) Put(hash string, blob stream.Blob) error {
+	return errors.Err("disk is full")
+}
+
+func TestMirrorStore(t *testing.T) {
+	primary, secondary := NewMemStore(), NewMemStore()
+	m := NewMirrorStore(primary, secondary)
+
+	blob := []byte("abcdefg")
+	err := m.Put(hashA, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []BlobStore{primary, secondary} {
+		if has, _ := s.Has(hashA); !has {
+			t.Errorf("expected the blob to be written to %s", s.Name())
+		}
+	}
+
+	// blobs the primary doesn't have are read from the secondary
+	err = secondary.Put(hashB, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, _, err := m.Get(hashB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, blob) {
+		t.Error("got the wrong blob")
+	}
+	_, _, err = m.Get(hashC)
+	if !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("expected a missing blob to be not found, got %v", err)
+	}
+
+	drift := m.Drift()
+	if drift.Fallbacks != 1 || len(drift.MissingOnPrimary) != 1 || drift.MissingOnPrimary[0] != hashB {
+		t.Errorf("expected b to be missing on the primary, got %+v", drift)
+	}
+}
+
+func TestMirrorStore_SecondaryFails(t *testing.T) {
+	primary := NewMemStore()
+	m := NewMirrorStore(primary, failingPutStore{NewMemStore()})
+
+	err := m.Put(hashA, []byte("abcdefg"))
+	if err != nil {
+		t.Errorf("a failed write to the secondary should not fail the put, got %v", err)
+	}
+	if has, _ := primary.Has(hashA); !has {
+		t.Error("expected the blob to be written to the primary")
+	}
+	drift := m.Drift()
+	if drift.SecondaryWriteFailures != 1 || len(drift.MissingOnSecondary) != 1 || drift.MissingOnSecondary[0] != hashA {
+		t.Errorf("expected a to be missing on the secondary, got %+v", drift)
+	}
+
+	err = NewMirrorStore(failingPutStore{NewMemStore()}, primary).Put(hashB, []byte("abcdefg"))
+	if err == nil {
+		t.Error("expected a failed write to the primary to fail the put")
+	}
+}
@@ -0,0 +1,193 @@
+package store
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// ErrorClass is a kind of error a store can fail a read with, that a TierPolicy decides about
+type ErrorClass string
+
+// Error classes
+const (
+	ClassTimeout     ErrorClass = "timeout"
+	ClassServerError ErrorClass = "5xx"
+	ClassNotFound    ErrorClass = "not_found"
+	ClassCorrupt     ErrorClass = "corrupt"
+	ClassOther       ErrorClass = "other"
+)
+
+var errorClasses = []ErrorClass{ClassTimeout, ClassServerError, ClassNotFound, ClassCorrupt, ClassOther}
+
+// Action is what a TierPolicy does about a failed read
+type Action string
+
+// Actions
+const (
+	// ActionRetry tries the same store again, up to Attempts times in all, and then goes on to the next tier
+	ActionRetry Action = "retry"
+	// ActionNext goes on to the next tier right away
+	ActionNext Action = "next"
+	// ActionFail returns the error without trying the next tier
+	ActionFail Action = "fail"
+)
+
+// TierPolicy decides what a store made of tiers, like a cache in front of an origin, does when a read from one of them
+// fails: retry the same tier, go on to the next one or fail. Each error class has its own action. Once the last tier
+// fails, its error is returned whatever the action.
+type TierPolicy struct {
+	// Actions is the action for each error class. Classes that are missing fail
+	Actions map[ErrorClass]Action
+	// Attempts is how many times a tier is tried in all when the action is retry
+	Attempts int
+	// Backoff is the longest wait before the first retry. It doubles with every retry
+	Backoff time.Duration
+}
+
+// the fallbacks the stores made of tiers had before they had policies
+var (
+	// fallbackOnMiss goes to the next tier only if the blob isn't there
+	fallbackOnMiss = &TierPolicy{Actions: map[ErrorClass]Action{ClassNotFound: ActionNext}}
+	// fallbackOnError goes to the next tier whatever the error
+	fallbackOnError = &TierPolicy{Actions: map[ErrorClass]Action{
+		ClassTimeout:     ActionNext,
+		ClassServerError: ActionNext,
+		ClassNotFound:    ActionNext,
+		ClassCorrupt:     ActionNext,
+		ClassOther:       ActionNext,
+	}}
+)
+
+// ParseTierPolicy parses a policy from a comma separated list of CLASS=ACTION, like
+// "timeout=retry,5xx=next,not_found=next,corrupt=next,other=fail". The classes are timeout, 5xx, not_found, corrupt
+// and other, and the actions retry, next and fail. attempts=N and backoff=DURATION set how retries are done, 3 and
+// 100ms by default. Classes that aren't given fail
+func ParseTierPolicy(spec string) (*TierPolicy, error) {
+	p := &TierPolicy{Actions: make(map[ErrorClass]Action), Attempts: 3, Backoff: 100 * time.Millisecond}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Err("tier policy entries look like CLASS=ACTION, not '%s'", part)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "attempts":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, errors.Err("tier policy attempts must be a positive number, not '%s'", value)
+			}
+			p.Attempts = n
+			continue
+		case "backoff":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, errors.Err("tier policy backoff must be a positive duration, not '%s'", value)
+			}
+			p.Backoff = d
+			continue
+		}
+
+		class := ErrorClass(key)
+		if !validClass(class) {
+			return nil, errors.Err("unknown error class '%s'", key)
+		}
+		switch action := Action(value); action {
+		case ActionRetry, ActionNext, ActionFail:
+			p.Actions[class] = action
+		default:
+			return nil, errors.Err("unknown tier policy action '%s'", value)
+		}
+	}
+	return p, nil
+}
+
+func validClass(c ErrorClass) bool {
+	for _, class := range errorClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Classify sorts the error of a store read into an error class
+func Classify(err error) ErrorClass {
+	switch {
+	case errors.Is(err, ErrBlobNotFound):
+		return ClassNotFound
+	case errors.Is(err, ErrBlobCorrupt):
+		return ClassCorrupt
+	case errors.Is(err, ErrServerError):
+		return ClassServerError
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return ClassTimeout
+	}
+	switch e := errors.Unwrap(err).(type) {
+	case awserr.RequestFailure:
+		if e.StatusCode() >= 500 {
+			return ClassServerError
+		}
+	case net.Error:
+		if e.Timeout() {
+			return ClassTimeout
+		}
+	}
+	return ClassOther
+}
+
+// policyOr returns p, or def if p is nil
+func policyOr(p, def *TierPolicy) *TierPolicy {
+	if p == nil {
+		return def
+	}
+	return p
+}
+
+func (p *TierPolicy) action(class ErrorClass) Action {
+	if a, ok := p.Actions[class]; ok {
+		return a
+	}
+	return ActionFail
+}
+
+// get gets the blob from one tier. It retries the get as the policy says, and returns whether the next tier should be
+// tried if it still failed
+func (p *TierPolicy) get(component string, tier BlobStore, hash string) (stream.Blob, shared.BlobTrace, bool, error) {
+	retries := S3RetryPolicy{MaxAttempts: p.Attempts, MinBackoff: p.Backoff, MaxBackoff: 100 * p.Backoff}.withDefaults()
+	for attempt := 1; ; attempt++ {
+		blob, trace, err := tier.Get(hash)
+		if err == nil {
+			return blob, trace, false, nil
+		}
+		class := Classify(err)
+		action := p.action(class)
+		if action == ActionRetry && attempt >= retries.MaxAttempts {
+			action = ActionNext
+		}
+		metrics.StorePolicyDecisionCount.WithLabelValues(component, string(class), string(action)).Inc()
+		switch action {
+		case ActionRetry:
+			time.Sleep(backoff(retries, attempt-1))
+		case ActionNext:
+			return blob, trace, true, err
+		default:
+			return blob, trace, false, err
+		}
+	}
+}
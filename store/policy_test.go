@@ -0,0 +1,103 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingGetStore is a MemStore whose Gets fail with err the first failures times
+type failingGetStore struct {
+	*MemStore
+	err      error
+	failures int
+	gets     int
+}
+
+func (f *failingGetStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
+	f.gets++
+	if f.gets <= f.failures {
+		return nil, shared.NewBlobTrace(0, nameMem), f.err
+	}
+	return f.MemStore.Get(hash)
+}
+
+func TestClassify(t *testing.T) {
+	assert.Equal(t, ClassNotFound, Classify(errors.Err(ErrBlobNotFound)))
+	assert.Equal(t, ClassCorrupt, Classify(errors.Prefix("[abc] broken", ErrBlobCorrupt)))
+	assert.Equal(t, ClassServerError, Classify(statusErr(502, "bad gateway")))
+	assert.Equal(t, ClassOther, Classify(statusErr(400, "bad request")))
+	assert.Equal(t, ClassTimeout, Classify(errors.Prefix("origin get after 1s", ErrTimeout)))
+	assert.Equal(t, ClassOther, Classify(errors.Err("something")))
+}
+
+func TestParseTierPolicy(t *testing.T) {
+	p, err := ParseTierPolicy("timeout=retry, 5xx=next,attempts=5,backoff=1s")
+	require.NoError(t, err)
+	assert.Equal(t, ActionRetry, p.action(ClassTimeout))
+	assert.Equal(t, ActionNext, p.action(ClassServerError))
+	assert.Equal(t, ActionFail, p.action(ClassNotFound))
+	assert.Equal(t, 5, p.Attempts)
+	assert.Equal(t, time.Second, p.Backoff)
+
+	for _, spec := range []string{"timeout", "slow=retry", "timeout=wait", "attempts=0", "backoff=soon"} {
+		_, err = ParseTierPolicy(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestCachingStore_Policy(t *testing.T) {
+	origin := NewMemStore()
+	require.NoError(t, origin.Put("hash", []byte("blob")))
+
+	// by default, a cache that fails with anything but a miss fails the get
+	cache := &failingGetStore{MemStore: NewMemStore(), err: errors.Err("disk is gone"), failures: 1}
+	s := NewCachingStore("test", origin, cache)
+	_, _, err := s.Get("hash")
+	assert.Error(t, err)
+
+	cache = &failingGetStore{MemStore: NewMemStore(), err: errors.Err("disk is gone"), failures: 1}
+	s = NewCachingStore("test", origin, cache)
+	s.Policy, err = ParseTierPolicy("not_found=next,other=next")
+	require.NoError(t, err)
+	blob, _, err := s.Get("hash")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("blob"), []byte(blob))
+}
+
+func TestITTTStore_Policy(t *testing.T) {
+	that := NewMemStore()
+	require.NoError(t, that.Put("hash", []byte("that")))
+
+	this := &failingGetStore{MemStore: NewMemStore(), err: errors.Prefix("get", ErrTimeout), failures: 2}
+	require.NoError(t, this.MemStore.Put("hash", []byte("this")))
+	s := NewITTTStore(this, that)
+	s.Policy = &TierPolicy{Actions: map[ErrorClass]Action{ClassTimeout: ActionRetry}, Attempts: 3, Backoff: time.Millisecond}
+	blob, _, err := s.Get("hash")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("this"), []byte(blob))
+	assert.Equal(t, 3, this.gets)
+
+	// out of attempts, it goes on to that
+	this = &failingGetStore{MemStore: NewMemStore(), err: errors.Prefix("get", ErrTimeout), failures: 5}
+	s = NewITTTStore(this, that)
+	s.Policy = &TierPolicy{Actions: map[ErrorClass]Action{ClassTimeout: ActionRetry}, Attempts: 2, Backoff: time.Millisecond}
+	blob, _, err = s.Get("hash")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("that"), []byte(blob))
+	assert.Equal(t, 2, this.gets)
+
+	// fail fast doesn't touch that
+	this = &failingGetStore{MemStore: NewMemStore(), err: errors.Prefix("broken", ErrBlobCorrupt), failures: 1}
+	s = NewITTTStore(this, that)
+	s.Policy = &TierPolicy{Actions: map[ErrorClass]Action{ClassCorrupt: ActionFail}}
+	_, _, err = s.Get("hash")
+	assert.True(t, errors.Is(err, ErrBlobCorrupt))
+}
@@ -0,0 +1,170 @@
+package store
+
+import (
+	"encoding/hex"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/bluele/gcache"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how many streams' blob orders are remembered
+	readAheadStreams = 10000
+	// blobs prefetched this recently are not prefetched again
+	readAheadMemory = 10 * time.Minute
+	// max number of blobs being prefetched at once. when all are busy, new prefetches are skipped
+	readAheadWorkers = 8
+)
+
+// ReadAheadStore prefetches the next blobs of a stream when one of its blobs is requested, so they are in the cache
+// by the time a player asks for them. It learns the order of the blobs from the sd blobs that go through it, so a
+// stream is only read ahead after its sd blob was requested.
+type ReadAheadStore struct {
+	BlobStore
+
+	blobs      int
+	positions  gcache.Cache // content blob hash -> blobPosition
+	prefetched gcache.Cache // hash -> true, for blobs prefetched recently
+	inFlight   sync.Map
+	workers    chan struct{}
+	grp        *stop.Group
+}
+
+type blobPosition struct {
+	stream []string
+	index  int
+}
+
+// NewReadAheadStore returns a store that prefetches the next blobs blobs of a stream through origin. Origin should
+// be a caching store, otherwise the prefetched blobs are thrown away.
+func NewReadAheadStore(origin BlobStore, blobs int) *ReadAheadStore {
+	return &ReadAheadStore{
+		BlobStore:  origin,
+		blobs:      blobs,
+		positions:  gcache.New(readAheadStreams * 100).LRU().Build(),
+		prefetched: gcache.New(readAheadStreams).LRU().Expiration(readAheadMemory).Build(),
+		workers:    make(chan struct{}, readAheadWorkers),
+		grp:        stop.New(),
+	}
+}
+
+const nameReadAhead = "read-ahead"
+
+// Name is the cache type name
+func (r *ReadAheadStore) Name() string { return nameReadAhead }
+
+// Get gets the blob from the origin, and starts prefetching the blobs that come after it
+func (r *ReadAheadStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
+	start := time.Now()
+	blob, trace, err := r.BlobStore.Get(hash)
+	if err != nil {
+		return nil, trace.Stack(time.Since(start), r.Name()), err
+	}
+
+	if p, err := r.positions.Get(hash); err == nil {
+		pos := p.(blobPosition)
+		r.prefetch(pos.stream[pos.index+1:])
+	} else if sd, err := shared.ParseSDBlob(blob); err == nil {
+		r.prefetch(r.learn(sd))
+	}
+
+	return blob, trace.Stack(time.Since(start), r.Name()), nil
+}
+
+// learn remembers the order of the stream's blobs and returns their hashes
+func (r *ReadAheadStore) learn(sd *shared.SDBlob) []string {
+	contentBlobs := sd.ContentBlobs()
+	hashes := make([]string, len(contentBlobs))
+	for i, b := range contentBlobs {
+		hashes[i] = hex.EncodeToString(b.BlobHash)
+	}
+	for i, h := range hashes {
+		_ = r.positions.Set(h, blobPosition{stream: hashes, index: i})
+	}
+	return hashes
+}
+
+func (r *ReadAheadStore) prefetch(next []string) {
+	if len(next) > r.blobs {
+		next = next[:r.blobs]
+	}
+	for _, hash := range next {
+		if r.prefetched.Has(hash) {
+			continue
+		}
+		if _, loaded := r.inFlight.LoadOrStore(hash, true); loaded {
+			continue
+		}
+
+		select {
+		case r.workers <- struct{}{}:
+		default:
+			r.inFlight.Delete(hash)
+			return // too busy. the client will ask for these blobs itself
+		}
+
+		r.grp.Add(1)
+		go func(hash string) {
+			defer r.grp.Done()
+			defer func() { <-r.workers }()
+			defer r.inFlight.Delete(hash)
+
+			select {
+			case <-r.grp.Ch():
+				return
+			default:
+			}
+
+			_, _, err := r.BlobStore.Get(hash)
+			if err != nil {
+				if !errors.Is(err, ErrBlobNotFound) {
+					log.Debugf("prefetching %s failed: %s", hash, err.Error())
+				}
+				return
+			}
+			_ = r.prefetched.Set(hash, true)
+			metrics.ReadAheadCount.Inc()
+		}(hash)
+	}
+}
+
+func (r *ReadAheadStore) list() ([]string, error) {
+	return List(r.BlobStore)
+}
+
+func (r *ReadAheadStore) listPage(after string, limit int) ([]string, error) {
+	return ListPage(r.BlobStore, after, limit)
+}
+
+// openFile opens the file of a content blob of a stream whose order is known, and reads ahead like Get. Other blobs are
+// ErrNotFile, so sd blobs go through Get and their streams are learned
+func (r *ReadAheadStore) openFile(hash string) (*os.File, shared.BlobTrace, error) {
+	start := time.Now()
+	p, err := r.positions.Get(hash)
+	if err != nil {
+		return nil, shared.NewBlobTrace(time.Since(start), r.Name()), errors.Err(ErrNotFile)
+	}
+	f, trace, err := OpenFile(r.BlobStore, hash)
+	if err != nil {
+		return nil, trace.Stack(time.Since(start), r.Name()), err
+	}
+	pos := p.(blobPosition)
+	r.prefetch(pos.stream[pos.index+1:])
+	return f, trace.Stack(time.Since(start), r.Name()), nil
+}
+
+// Shutdown waits for running prefetches and shuts down the origin
+func (r *ReadAheadStore) Shutdown() {
+	r.grp.StopAndWait()
+	r.BlobStore.Shutdown()
+}
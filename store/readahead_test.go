@@ -0,0 +1,59 @@
+package store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadAheadStore_PrefetchesNextBlobs(t *testing.T) {
+	data := make([]byte, 4*stream.MaxBlobSize)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	s, err := stream.New(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.True(t, len(s) >= 5)
+
+	origin := NewMemStore()
+	for _, b := range s {
+		require.NoError(t, origin.Put(b.HashHex(), b))
+	}
+	cache := NewMemStore()
+	r := NewReadAheadStore(NewCachingStore("test", origin, cache), 2)
+
+	_, _, err = r.Get(s[0].HashHex())
+	require.NoError(t, err)
+	waitForBlobs(t, cache, s[1].HashHex(), s[2].HashHex())
+	has, err := cache.Has(s[3].HashHex())
+	require.NoError(t, err)
+	assert.False(t, has, "only the first 2 blobs should be prefetched")
+
+	_, _, err = r.Get(s[2].HashHex())
+	require.NoError(t, err)
+	waitForBlobs(t, cache, s[3].HashHex(), s[4].HashHex())
+
+	r.Shutdown()
+}
+
+func waitForBlobs(t *testing.T, s BlobStore, hashes ...string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, h := range hashes {
+		for {
+			has, err := s.Has(h)
+			require.NoError(t, err)
+			if has {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("blob %s was not prefetched", h)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
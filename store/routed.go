@@ -0,0 +1,109 @@
+package store
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RoutedHeader marks a blob request that was already routed to its owner. The owner serves it from its own stores
+// even if it thinks another member owns the blob, so requests don't bounce between members while their views of
+// the cluster differ. It carries the signature of the member that sent the request, since anyone can set it.
+const RoutedHeader = "X-Reflector-Routed"
+
+// MemberAuth signs the requests cluster members send each other in RoutedHeader, and checks those signatures, so
+// members can tell them from client requests
+type MemberAuth interface {
+	SignRequest(req *http.Request)
+	VerifyRequest(req *http.Request) bool
+}
+
+// BlobRouter decides which cluster members serve a blob
+type BlobRouter interface {
+	// BlobOwners returns the http addresses of the other members that hold a blob, in order of preference, and
+	// whether this member holds it too
+	BlobOwners(hash string) (addrs []string, local bool)
+}
+
+// RegionRouter finds the members of other regions that hold a blob
+type RegionRouter interface {
+	// RegionOwner returns the http address of the member of region that holds a blob, or false if the region has no
+	// members that serve blobs
+	RegionOwner(region, hash string) (addr string, ok bool)
+}
+
+// RoutedStore partitions blobs between cluster members. Blobs that belong to this member are served by the wrapped
+// store. Other blobs are fetched from their owners over http, so each blob is only cached by the members that hold
+// it. If none of the owners can be reached, the wrapped store is used.
+type RoutedStore struct {
+	BlobStore
+
+	router  BlobRouter
+	auth    MemberAuth
+	remotes sync.Map // addr -> *HttpStore
+}
+
+// NewRoutedStore returns a store that sends requests for other members' blobs to them, signed with auth
+func NewRoutedStore(local BlobStore, router BlobRouter, auth MemberAuth) *RoutedStore {
+	return &RoutedStore{BlobStore: local, router: router, auth: auth}
+}
+
+const nameRouted = "routed"
+
+// Name is the cache type name
+func (r *RoutedStore) Name() string { return nameRouted }
+
+// Has asks the owners of the blob whether they have it
+func (r *RoutedStore) Has(hash string) (bool, error) {
+	addrs, local := r.router.BlobOwners(hash)
+	if local {
+		return r.BlobStore.Has(hash)
+	}
+	for _, addr := range addrs {
+		has, err := r.Remote(addr).Has(hash)
+		if err == nil {
+			return has, nil
+		}
+		log.Warnf("routing has-blob to %s failed: %s", addr, err.Error())
+	}
+	return r.BlobStore.Has(hash)
+}
+
+// Get gets the blob from the first owner that answers
+func (r *RoutedStore) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
+	start := time.Now()
+	addrs, local := r.router.BlobOwners(hash)
+	if local {
+		blob, trace, err := r.BlobStore.Get(hash)
+		return blob, trace.Stack(time.Since(start), r.Name()), err
+	}
+
+	for _, addr := range addrs {
+		blob, trace, err := r.Remote(addr).Get(hash)
+		if err == nil || errors.Is(err, ErrBlobNotFound) {
+			return blob, trace.Stack(time.Since(start), r.Name()), err
+		}
+		log.Warnf("routing blob to %s failed: %s", addr, err.Error())
+	}
+	blob, trace, err := r.BlobStore.Get(hash)
+	return blob, trace.Stack(time.Since(start), r.Name()), err
+}
+
+// Remote returns the store for the blobs of the member at addr. Its requests are signed in RoutedHeader, so the
+// member serves them itself
+func (r *RoutedStore) Remote(addr string) *HttpStore {
+	if s, ok := r.remotes.Load(addr); ok {
+		return s.(*HttpStore)
+	}
+	s := NewHttpStore(addr)
+	s.Sign = r.auth.SignRequest
+	actual, _ := r.remotes.LoadOrStore(addr, s)
+	return actual.(*HttpStore)
+}
@@ -3,6 +3,8 @@ package store
 import (
 	"bytes"
 	"net/http"
+	"net/url"
+	"sort"
 	"time"
 
 	"github.com/lbryio/reflector.go/internal/metrics"
@@ -15,6 +17,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	log "github.com/sirupsen/logrus"
@@ -26,17 +29,125 @@ type S3Store struct {
 	awsSecret string
 	region    string
 	bucket    string
+	opts      S3Opts
 
-	session *session.Session
+	client *s3.S3
+}
+
+// defaultS3Endpoint is where the store connects if no endpoint is set
+const defaultS3Endpoint = "https://s3.wasabisys.com"
+
+// S3Opts are settings for the connection to S3 and for the objects the store uploads. The zero value connects to
+// Wasabi and uses the bucket's defaults
+type S3Opts struct {
+	// Endpoint is the url of the S3 api, like https://nyc3.digitaloceanspaces.com or http://minio:9000
+	Endpoint string
+	// Region overrides the region the store was created with. MinIO and Ceph RGW usually want us-east-1
+	Region string
+	// PathStyle puts the bucket in the url path instead of the host name, which MinIO and Ceph RGW usually need
+	PathStyle bool
+	// SignatureVersion is v4 (the default) or v2, for old servers that don't support v4
+	SignatureVersion string
+
+	// SSE is the server-side encryption: AES256 for SSE-S3, aws:kms for SSE-KMS, or empty for the bucket's default
+	SSE string
+	// KMSKeyID is the KMS key used with SSE-KMS. If it's empty, the account's default key is used
+	KMSKeyID string
+	// StorageClass of uploaded objects, like STANDARD_IA or INTELLIGENT_TIERING
+	StorageClass string
+	// Tags are set on each uploaded object
+	Tags map[string]string
+	// RestoreDays is how long objects that were archived to Glacier stay readable after Get restores them. 0 turns
+	// restores off
+	RestoreDays int
+	// RestoreTier is the Glacier retrieval tier used for restores: Expedited, Standard (the default) or Bulk
+	RestoreTier string
+	// Retry is how failed requests are retried
+	Retry S3RetryPolicy
+}
+
+// Validate returns an error if S3 would not accept the options
+func (o S3Opts) Validate() error {
+	if o.Endpoint != "" {
+		u, err := url.Parse(o.Endpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.Err("endpoint %q should be a url like https://s3.example.com", o.Endpoint)
+		}
+	}
+	switch o.SignatureVersion {
+	case "", signatureV2, signatureV4:
+	default:
+		return errors.Err("unknown signature version %q, use %s or %s", o.SignatureVersion, signatureV4, signatureV2)
+	}
+	switch o.SSE {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		return errors.Err("unknown server-side encryption %q, use %s or %s", o.SSE, s3.ServerSideEncryptionAes256,
+			s3.ServerSideEncryptionAwsKms)
+	}
+	if o.KMSKeyID != "" && o.SSE != s3.ServerSideEncryptionAwsKms {
+		return errors.Err("a KMS key is only used with %s encryption", s3.ServerSideEncryptionAwsKms)
+	}
+	switch o.StorageClass {
+	case "", s3.StorageClassStandard, s3.StorageClassReducedRedundancy, s3.StorageClassStandardIa,
+		s3.StorageClassOnezoneIa, s3.StorageClassIntelligentTiering, s3.StorageClassGlacier, s3.StorageClassDeepArchive:
+	default:
+		return errors.Err("unknown storage class %q", o.StorageClass)
+	}
+	switch o.RestoreTier {
+	case "", s3.TierExpedited, s3.TierStandard, s3.TierBulk:
+	default:
+		return errors.Err("unknown restore tier %q, use %s, %s or %s", o.RestoreTier, s3.TierExpedited, s3.TierStandard,
+			s3.TierBulk)
+	}
+	if o.RestoreDays < 0 {
+		return errors.Err("restore days can't be negative")
+	}
+	if o.Retry.MaxAttempts < 0 || o.Retry.MinBackoff < 0 || o.Retry.MaxBackoff < 0 {
+		return errors.Err("retry attempts and backoffs can't be negative")
+	}
+	// https://docs.aws.amazon.com/AmazonS3/latest/dev/object-tagging.html
+	if len(o.Tags) > 10 {
+		return errors.Err("objects can have at most 10 tags, got %d", len(o.Tags))
+	}
+	for k, v := range o.Tags {
+		if k == "" || len(k) > 128 || len(v) > 256 {
+			return errors.Err("tag keys must be 1 to 128 characters and values up to 256, got %q=%q", k, v)
+		}
+	}
+	return nil
+}
+
+// tagging returns the tags the way S3 takes them in an upload, or nil if there are none
+func (o S3Opts) tagging() *string {
+	if len(o.Tags) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(o.Tags))
+	for k := range o.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	q := url.Values{}
+	for _, k := range keys {
+		q.Set(k, o.Tags[k])
+	}
+	return aws.String(q.Encode())
 }
 
 // NewS3Store returns an initialized S3 store pointer.
 func NewS3Store(awsID, awsSecret, region, bucket string) *S3Store {
+	return NewS3StoreWithOpts(awsID, awsSecret, region, bucket, S3Opts{})
+}
+
+// NewS3StoreWithOpts returns an S3 store that uploads objects with the given encryption, storage class and tags
+func NewS3StoreWithOpts(awsID, awsSecret, region, bucket string, opts S3Opts) *S3Store {
 	return &S3Store{
 		awsID:     awsID,
 		awsSecret: awsSecret,
 		region:    region,
 		bucket:    bucket,
+		opts:      opts,
 	}
 }
 
@@ -52,7 +163,7 @@ func (s *S3Store) Has(hash string) (bool, error) {
 		return false, err
 	}
 
-	_, err = s3.New(s.session).HeadObject(&s3.HeadObjectInput{
+	_, err = s.client.HeadObject(&s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(hash),
 	})
@@ -81,7 +192,7 @@ func (s *S3Store) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
 	}(start)
 
 	buf := &aws.WriteAtBuffer{}
-	_, err = s3manager.NewDownloader(s.session).Download(buf, &s3.GetObjectInput{
+	_, err = s3manager.NewDownloaderWithClient(s.client).Download(buf, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(hash),
 	})
@@ -92,6 +203,8 @@ func (s *S3Store) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
 				return nil, shared.NewBlobTrace(time.Since(start), s.Name()), errors.Err("bucket %s does not exist", s.bucket)
 			case s3.ErrCodeNoSuchKey:
 				return nil, shared.NewBlobTrace(time.Since(start), s.Name()), errors.Err(ErrBlobNotFound)
+			case errCodeInvalidObjectState:
+				return nil, shared.NewBlobTrace(time.Since(start), s.Name()), s.archived(hash)
 			}
 		}
 		return buf.Bytes(), shared.NewBlobTrace(time.Since(start), s.Name()), err
@@ -100,6 +213,55 @@ func (s *S3Store) Get(hash string) (stream.Blob, shared.BlobTrace, error) {
 	return buf.Bytes(), shared.NewBlobTrace(time.Since(start), s.Name()), nil
 }
 
+// error codes S3 uses for archived objects, which the sdk has no constants for
+const (
+	errCodeInvalidObjectState       = "InvalidObjectState"
+	errCodeRestoreAlreadyInProgress = "RestoreAlreadyInProgress"
+)
+
+// archived is called when a blob can't be read because it was archived to Glacier. It starts restoring the blob if
+// restores are on, and returns an UnavailableError that says when the blob should be readable
+func (s *S3Store) archived(hash string) error {
+	tier := s.opts.RestoreTier
+	if tier == "" {
+		tier = s3.TierStandard
+	}
+	retryAfter := restoreTime(tier)
+
+	if s.opts.RestoreDays <= 0 {
+		return errors.Err(&UnavailableError{Reason: "blob is archived and restores are off", RetryAfter: retryAfter})
+	}
+
+	_, err := s.client.RestoreObject(&s3.RestoreObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(hash),
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(int64(s.opts.RestoreDays)),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(tier)},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == errCodeRestoreAlreadyInProgress {
+		return errors.Err(&UnavailableError{Reason: "blob is being restored from the archive", RetryAfter: retryAfter})
+	} else if err != nil {
+		return errors.Prefix("restoring "+hash[:8], err)
+	}
+
+	log.Infof("restoring %s from the archive with the %s tier", hash[:8], tier)
+	return errors.Err(&UnavailableError{Reason: "started restoring the blob from the archive", RetryAfter: retryAfter})
+}
+
+// restoreTime is about the longest a Glacier restore takes with the tier
+func restoreTime(tier string) time.Duration {
+	switch tier {
+	case s3.TierExpedited:
+		return 5 * time.Minute
+	case s3.TierBulk:
+		return 12 * time.Hour
+	default:
+		return 5 * time.Hour
+	}
+}
+
 // Put stores the blob on S3 or errors if S3 connection errors.
 func (s *S3Store) Put(hash string, blob stream.Blob) error {
 	err := s.initOnce()
@@ -112,18 +274,32 @@ func (s *S3Store) Put(hash string, blob stream.Blob) error {
 		log.Debugf("Uploading %s took %s", hash[:8], time.Since(t).String())
 	}(time.Now())
 
-	_, err = s3manager.NewUploader(s.session).Upload(&s3manager.UploadInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(hash),
-		Body:   bytes.NewBuffer(blob),
-		ACL:    aws.String("public-read"),
-		//StorageClass: aws.String(s3.StorageClassIntelligentTiering),
-	})
+	_, err = s3manager.NewUploaderWithClient(s.client).Upload(s.uploadInput(hash, blob))
 	metrics.MtrOutBytesReflector.Add(float64(blob.Size()))
 
 	return err
 }
 
+func (s *S3Store) uploadInput(hash string, blob stream.Blob) *s3manager.UploadInput {
+	input := &s3manager.UploadInput{
+		Bucket:  aws.String(s.bucket),
+		Key:     aws.String(hash),
+		Body:    bytes.NewBuffer(blob),
+		ACL:     aws.String("public-read"),
+		Tagging: s.opts.tagging(),
+	}
+	if s.opts.SSE != "" {
+		input.ServerSideEncryption = aws.String(s.opts.SSE)
+	}
+	if s.opts.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.opts.KMSKeyID)
+	}
+	if s.opts.StorageClass != "" {
+		input.StorageClass = aws.String(s.opts.StorageClass)
+	}
+	return input
+}
+
 // PutSD stores the sd blob on S3 or errors if S3 connection errors.
 func (s *S3Store) PutSD(hash string, blob stream.Blob) error {
 	//Todo - handle missing stream for consistency
@@ -138,7 +314,7 @@ func (s *S3Store) Delete(hash string) error {
 
 	log.Debugf("Deleting %s from S3", hash[:8])
 
-	_, err = s3.New(s.session).DeleteObject(&s3.DeleteObjectInput{
+	_, err = s.client.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(hash),
 	})
@@ -146,22 +322,94 @@ func (s *S3Store) Delete(hash string) error {
 	return err
 }
 
+// list returns the keys in the bucket
+func (s *S3Store) list() ([]string, error) {
+	err := s.initOnce()
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []string
+	err = s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			hashes = append(hashes, aws.StringValue(o.Key))
+		}
+		return true
+	})
+	return hashes, errors.Err(err)
+}
+
+// listPage lists the keys after the hash with StartAfter, so only the page is fetched
+func (s *S3Store) listPage(after string, limit int) ([]string, error) {
+	err := s.initOnce()
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []string
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket)}
+	if after != "" {
+		input.StartAfter = aws.String(after)
+	}
+	if limit < 1000 {
+		input.MaxKeys = aws.Int64(int64(limit))
+	}
+	err = s.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			hashes = append(hashes, aws.StringValue(o.Key))
+			if len(hashes) == limit {
+				return false
+			}
+		}
+		return true
+	})
+	return hashes, errors.Err(err)
+}
+
 func (s *S3Store) initOnce() error {
-	if s.session != nil {
+	if s.client != nil {
 		return nil
 	}
 
+	client, err := NewS3Client(s.awsID, s.awsSecret, s.region, s.bucket, s.opts)
+	if err != nil {
+		return err
+	}
+	s.client = client
+	return nil
+}
+
+// NewS3Client returns a client for the bucket that connects the way the options say, and retries and tracks requests
+// like the store does
+func NewS3Client(awsID, awsSecret, region, bucket string, opts S3Opts) (*s3.S3, error) {
+	if opts.Region != "" {
+		region = opts.Region
+	}
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = defaultS3Endpoint
+	}
+
 	sess, err := session.NewSession(&aws.Config{
-		Credentials: credentials.NewStaticCredentials(s.awsID, s.awsSecret, ""),
-		Region:      aws.String(s.region),
-		Endpoint:    aws.String("https://s3.wasabisys.com"),
+		Credentials:      credentials.NewStaticCredentials(awsID, awsSecret, ""),
+		Region:           aws.String(region),
+		Endpoint:         aws.String(endpoint),
+		S3ForcePathStyle: aws.Bool(opts.PathStyle),
+		Retryer:          s3Retryer{policy: opts.Retry.withDefaults()},
 	})
 	if err != nil {
-		return err
+		return nil, errors.Err(err)
 	}
 
-	s.session = sess
-	return nil
+	client := s3.New(sess)
+	if opts.SignatureVersion == signatureV2 {
+		client.Handlers.Sign.Swap(v4.SignRequestHandler.Name, s3SignV2Handler(bucket, opts.PathStyle))
+	}
+	client.Handlers.CompleteAttempt.PushBack(trackS3Attempt)
+	client.Handlers.Complete.PushBack(trackS3Request)
+	return client, nil
 }
 
 // Shutdown shuts down the store gracefully
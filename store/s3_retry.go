@@ -0,0 +1,123 @@
+package store
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/lbryio/reflector.go/internal/metrics"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// S3RetryPolicy says how failed S3 requests are retried. Requests that failed because S3 is busy, had an internal
+// error or couldn't be reached are retried after an exponential backoff with full jitter. Other errors are returned
+// right away. Zero fields use the defaults
+type S3RetryPolicy struct {
+	// MaxAttempts is how many times a request is tried, counting the first attempt
+	MaxAttempts int
+	// MinBackoff is the longest wait before the first retry. It doubles with every retry
+	MinBackoff time.Duration
+	// MaxBackoff is the longest wait before any retry
+	MaxBackoff time.Duration
+}
+
+const (
+	defaultS3MaxAttempts = 4
+	defaultS3MinBackoff  = 100 * time.Millisecond
+	defaultS3MaxBackoff  = 10 * time.Second
+)
+
+func (p S3RetryPolicy) withDefaults() S3RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultS3MaxAttempts
+	}
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = defaultS3MinBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultS3MaxBackoff
+	}
+	if p.MaxBackoff < p.MinBackoff {
+		p.MaxBackoff = p.MinBackoff
+	}
+	return p
+}
+
+// reasons for retrying s3 requests, used in metrics
+const (
+	retryThrottled   = "throttled"
+	retryServerError = "server_error"
+	retryTransient   = "transient"
+)
+
+// s3RetryReason classifies a failed request. It returns why the request should be retried, or "" if it shouldn't be
+func s3RetryReason(r *request.Request) string {
+	if r.Error == nil {
+		return ""
+	}
+	if aerr, ok := r.Error.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+		return ""
+	}
+	if r.IsErrorThrottle() {
+		return retryThrottled
+	}
+	if r.HTTPResponse != nil {
+		status := r.HTTPResponse.StatusCode
+		if status >= http.StatusInternalServerError && status != http.StatusNotImplemented {
+			return retryServerError
+		}
+	}
+	if r.IsErrorRetryable() {
+		return retryTransient
+	}
+	return ""
+}
+
+// s3Retryer is the sdk's request.Retryer for a policy
+type s3Retryer struct {
+	policy S3RetryPolicy
+}
+
+func (s s3Retryer) MaxRetries() int { return s.policy.MaxAttempts - 1 }
+
+func (s s3Retryer) ShouldRetry(r *request.Request) bool { return s3RetryReason(r) != "" }
+
+// RetryRules waits a random time up to the backoff, which doubles with every retry. It's only called for requests that
+// will be retried
+func (s s3Retryer) RetryRules(r *request.Request) time.Duration {
+	metrics.S3RetryCount.WithLabelValues(r.Operation.Name, s3RetryReason(r)).Inc()
+	return backoff(s.policy, r.RetryCount)
+}
+
+func backoff(p S3RetryPolicy, retries int) time.Duration {
+	ceiling := p.MaxBackoff
+	if retries < 32 {
+		if b := p.MinBackoff << uint(retries); b > 0 && b < ceiling {
+			ceiling = b
+		}
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// trackS3Attempt records the result of each attempt of a request
+func trackS3Attempt(r *request.Request) {
+	op := r.Operation.Name
+	metrics.S3AttemptDurationSeconds.WithLabelValues(op).Observe(time.Since(r.AttemptTime).Seconds())
+	result := "ok"
+	if r.Error != nil {
+		result = s3RetryReason(r)
+		if result == "" {
+			result = "error"
+		}
+	}
+	metrics.S3AttemptCount.WithLabelValues(op, result).Inc()
+}
+
+// trackS3Request records requests that failed after all their attempts
+func trackS3Request(r *request.Request) {
+	if r.Error != nil {
+		metrics.S3ErrorCount.WithLabelValues(r.Operation.Name).Inc()
+	}
+}
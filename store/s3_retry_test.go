@@ -0,0 +1,56 @@
+package store
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestS3RetryReason(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		err    error
+		reason string
+	}{
+		{"ok", http.StatusOK, nil, ""},
+		{"slow down", http.StatusServiceUnavailable, awserr.New("SlowDown", "reduce your request rate", nil), retryThrottled},
+		{"too many requests", http.StatusTooManyRequests, awserr.New("TooManyRequests", "", nil), retryThrottled},
+		{"internal error", http.StatusInternalServerError, awserr.New("InternalError", "", nil), retryServerError},
+		{"not implemented", http.StatusNotImplemented, awserr.New("NotImplemented", "", nil), ""},
+		{"timeout", http.StatusBadRequest, awserr.New("RequestTimeout", "", nil), retryTransient},
+		{"not found", http.StatusNotFound, awserr.New("NoSuchKey", "", nil), ""},
+		{"forbidden", http.StatusForbidden, awserr.New("AccessDenied", "", nil), ""},
+		{"canceled", 0, awserr.New(request.CanceledErrorCode, "", nil), ""},
+	}
+	for _, c := range cases {
+		r := &request.Request{Error: c.err}
+		if c.status != 0 {
+			r.HTTPResponse = &http.Response{StatusCode: c.status}
+		}
+		if reason := s3RetryReason(r); reason != c.reason {
+			t.Errorf("%s: expected reason %q, got %q", c.name, c.reason, reason)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := S3RetryPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}.withDefaults()
+	if p.MaxAttempts != defaultS3MaxAttempts {
+		t.Errorf("expected the default attempts, got %d", p.MaxAttempts)
+	}
+	for retries, ceiling := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+		800 * time.Millisecond, time.Second, time.Second} {
+		for i := 0; i < 100; i++ {
+			if b := backoff(p, retries); b < 0 || b > ceiling {
+				t.Fatalf("backoff after %d retries should be up to %s, got %s", retries, ceiling, b)
+			}
+		}
+	}
+	if b := backoff(p, 100); b > time.Second {
+		t.Errorf("backoff should be capped at the max, got %s", b)
+	}
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// signature versions the S3 store can sign requests with
+const (
+	signatureV2 = "v2"
+	signatureV4 = "v4"
+)
+
+// s3V2SubResources are the query params that are part of the signed resource in v2 signatures
+var s3V2SubResources = map[string]bool{
+	"acl": true, "cors": true, "delete": true, "lifecycle": true, "location": true, "logging": true,
+	"notification": true, "partNumber": true, "policy": true, "requestPayment": true, "restore": true,
+	"tagging": true, "torrent": true, "uploadId": true, "uploads": true, "versionId": true, "versioning": true,
+	"versions": true, "website": true,
+	"response-cache-control": true, "response-content-disposition": true, "response-content-encoding": true,
+	"response-content-language": true, "response-content-type": true, "response-expires": true,
+}
+
+// s3SignV2Handler signs requests with the legacy S3 v2 signature, for servers that don't support v4. bucket is needed
+// to build the signed resource when the bucket is in the host name
+// https://docs.aws.amazon.com/AmazonS3/latest/dev/RESTAuthentication.html
+func s3SignV2Handler(bucket string, pathStyle bool) request.NamedHandler {
+	return request.NamedHandler{Name: "reflector.s3.SignV2", Fn: func(r *request.Request) {
+		creds, err := r.Config.Credentials.Get()
+		if err != nil {
+			r.Error = err
+			return
+		}
+		req := r.HTTPRequest
+		req.Header.Del("Authorization")
+		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		if creds.SessionToken != "" {
+			req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+		}
+
+		resource := req.URL.EscapedPath()
+		if !pathStyle {
+			resource = "/" + bucket + resource
+		}
+		req.Header.Set("Authorization", "AWS "+creds.AccessKeyID+":"+signV2(creds.SecretAccessKey, stringToSignV2(req, resource)))
+	}}
+}
+
+func signV2(secret, stringToSign string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// stringToSignV2 is what a v2 signature signs. resource is the bucket and key, like /bucket/key
+func stringToSignV2(req *http.Request, resource string) string {
+	var b strings.Builder
+	b.WriteString(req.Method + "\n")
+	b.WriteString(req.Header.Get("Content-MD5") + "\n")
+	b.WriteString(req.Header.Get("Content-Type") + "\n")
+	if req.Header.Get("X-Amz-Date") == "" {
+		b.WriteString(req.Header.Get("Date"))
+	}
+	b.WriteString("\n")
+
+	var amzHeaders []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			amzHeaders = append(amzHeaders, lower)
+		}
+	}
+	sort.Strings(amzHeaders)
+	for _, name := range amzHeaders {
+		b.WriteString(name + ":" + strings.Join(req.Header.Values(name), ",") + "\n")
+	}
+
+	b.WriteString(resource)
+	b.WriteString(subResourcesV2(req.URL.Query()))
+	return b.String()
+}
+
+// subResourcesV2 returns the signed query params, like ?tagging or ?partNumber=1&uploadId=abc
+func subResourcesV2(query url.Values) string {
+	var params []string
+	for k, values := range query {
+		if !s3V2SubResources[k] {
+			continue
+		}
+		if len(values) == 0 || values[0] == "" {
+			params = append(params, k)
+		} else {
+			params = append(params, k+"="+values[0])
+		}
+	}
+	if len(params) == 0 {
+		return ""
+	}
+	sort.Strings(params)
+	return "?" + strings.Join(params, "&")
+}
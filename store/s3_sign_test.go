@@ -0,0 +1,41 @@
+package store
+
+import (
+	"net/http"
+	"testing"
+)
+
+// examples from https://docs.aws.amazon.com/AmazonS3/latest/dev/RESTAuthentication.html
+func TestSignV2(t *testing.T) {
+	const secret = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+	cases := []struct {
+		method, contentType, date, signature string
+	}{
+		{http.MethodGet, "", "Tue, 27 Mar 2007 19:36:42 +0000", "bWq2s1WEIj+Ydj0vQ697zp+IXMU="},
+		{http.MethodPut, "image/jpeg", "Tue, 27 Mar 2007 21:15:45 +0000", "MyyxeRY7whkBe+bq8fHCL/2kKUg="},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Date", c.date)
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		signature := signV2(secret, stringToSignV2(req, "/johnsmith"+req.URL.EscapedPath()))
+		if signature != c.signature {
+			t.Errorf("%s: expected signature %s, got %s", c.method, c.signature, signature)
+		}
+	}
+}
+
+func TestSubResourcesV2(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPut, "https://s3.example.com/bucket/key?uploadId=abc&partNumber=2&x-id=PutObject&tagging", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := subResourcesV2(req.URL.Query()); got != "?partNumber=2&tagging&uploadId=abc" {
+		t.Errorf("unexpected sub resources %s", got)
+	}
+}
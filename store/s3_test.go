@@ -0,0 +1,82 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestS3Opts_Validate(t *testing.T) {
+	valid := []S3Opts{
+		{},
+		{SSE: "AES256", StorageClass: "STANDARD_IA"},
+		{SSE: "aws:kms", KMSKeyID: "alias/blobs", StorageClass: "INTELLIGENT_TIERING"},
+		{Tags: map[string]string{"team": "blobs", "env": ""}},
+		{Endpoint: "http://minio:9000", Region: "us-east-1", PathStyle: true, SignatureVersion: "v2"},
+	}
+	for _, o := range valid {
+		if err := o.Validate(); err != nil {
+			t.Errorf("expected %+v to be valid, got %v", o, err)
+		}
+	}
+
+	invalid := []S3Opts{
+		{SSE: "aes256"},
+		{KMSKeyID: "alias/blobs"},
+		{SSE: "AES256", KMSKeyID: "alias/blobs"},
+		{StorageClass: "CHEAP"},
+		{Tags: map[string]string{"": "empty key"}},
+		{RestoreDays: 1, RestoreTier: "Fast"},
+		{Endpoint: "minio:9000"},
+		{SignatureVersion: "v3"},
+	}
+	for _, o := range invalid {
+		if err := o.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", o)
+		}
+	}
+}
+
+func TestS3Store_UploadInput(t *testing.T) {
+	s := NewS3Store("", "", "", "bucket")
+	input := s.uploadInput("abc", []byte("blob"))
+	if input.ServerSideEncryption != nil || input.StorageClass != nil || input.Tagging != nil {
+		t.Errorf("expected the bucket's defaults to be used, got %+v", input)
+	}
+
+	s = NewS3StoreWithOpts("", "", "", "bucket", S3Opts{
+		SSE:          "aws:kms",
+		KMSKeyID:     "alias/blobs",
+		StorageClass: "STANDARD_IA",
+		Tags:         map[string]string{"team": "blobs", "cost center": "a&b"},
+	})
+	input = s.uploadInput("abc", []byte("blob"))
+	if aws.StringValue(input.ServerSideEncryption) != "aws:kms" || aws.StringValue(input.SSEKMSKeyId) != "alias/blobs" {
+		t.Errorf("expected SSE-KMS with the key, got %+v", input)
+	}
+	if aws.StringValue(input.StorageClass) != "STANDARD_IA" {
+		t.Errorf("expected the STANDARD_IA storage class, got %s", aws.StringValue(input.StorageClass))
+	}
+	if tagging := aws.StringValue(input.Tagging); tagging != "cost+center=a%26b&team=blobs" {
+		t.Errorf("unexpected tagging %s", tagging)
+	}
+}
+
+func TestS3Store_Archived(t *testing.T) {
+	s := NewS3StoreWithOpts("", "", "", "bucket", S3Opts{RestoreTier: "Expedited"})
+	err := errors.Prefix("getting blob", s.archived("abcdefgh"))
+	if !errors.Is(err, ErrBlobUnavailable) {
+		t.Fatalf("expected an unavailable error, got %v", err)
+	}
+	retryAfter, ok := RetryAfter(err)
+	if !ok || retryAfter != 5*time.Minute {
+		t.Errorf("expected to retry after the expedited restore time, got %s", retryAfter)
+	}
+
+	if _, ok := RetryAfter(errors.Err(ErrBlobNotFound)); ok {
+		t.Error("a missing blob should not be retried")
+	}
+}
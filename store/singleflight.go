@@ -1,6 +1,7 @@
 package store
 
 import (
+	"os"
 	"time"
 
 	"github.com/lbryio/reflector.go/internal/metrics"
@@ -76,6 +77,11 @@ func (s *singleflightStore) getter(hash string) func() (interface{}, error) {
 			metrics.LabelComponent: s.component,
 			metrics.LabelSource:    "origin",
 		}).Set(rate)
+		metrics.CacheRetrievalSeconds.With(map[string]string{
+			metrics.LabelCacheType: s.Name(),
+			metrics.LabelComponent: s.component,
+			metrics.LabelSource:    "origin",
+		}).Observe(time.Since(start).Seconds())
 
 		return getterResponse{
 			blob:  blob,
@@ -126,3 +132,15 @@ func (s *singleflightStore) Shutdown() {
 	s.BlobStore.Shutdown()
 	return
 }
+
+func (s *singleflightStore) list() ([]string, error) {
+	return List(s.BlobStore)
+}
+
+func (s *singleflightStore) listPage(after string, limit int) ([]string, error) {
+	return ListPage(s.BlobStore, after, limit)
+}
+
+func (s *singleflightStore) openFile(hash string) (*os.File, shared.BlobTrace, error) {
+	return OpenFile(s.BlobStore, hash)
+}
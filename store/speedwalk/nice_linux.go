@@ -0,0 +1,24 @@
+// +build linux
+
+package speedwalk
+
+import (
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// from linux/ioprio.h
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// lowerIOPriority puts the current thread in the idle IO scheduling class
+func lowerIOPriority() {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(syscall.Gettid()), ioprioClassIdle<<ioprioClassShift)
+	if errno != 0 {
+		logrus.Debugf("could not lower the io priority of the walk: %s", errno.Error())
+	}
+}
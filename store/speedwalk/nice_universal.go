@@ -0,0 +1,6 @@
+// +build !linux
+
+package speedwalk
+
+// lowerIOPriority does nothing where IO priorities aren't supported
+func lowerIOPriority() {}
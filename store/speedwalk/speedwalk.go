@@ -1,44 +1,156 @@
 package speedwalk
 
 import (
+	"fmt"
 	"io/ioutil"
 	"path/filepath"
 	"runtime"
 	"sync"
+	"time"
 
 	"github.com/lbryio/reflector.go/internal/metrics"
+	"github.com/lbryio/reflector.go/internal/ratelimit"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
 
 	"github.com/karrick/godirwalk"
 	"github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
 )
 
+// how often AllFiles logs its progress
+const allFilesProgressInterval = 30 * time.Second
+
+// Opts configures a walk
+type Opts struct {
+	// Visit the basename of each file instead of the full path starting at the start dir
+	Basename bool
+	// How many subdirectories are walked at once. Defaults to one less than the number of CPUs, and at least 1
+	Workers int
+	// Limit on files visited per second, so a walk doesn't keep the disk from serving blobs. 0 means no limit
+	MaxFilesPerSec int
+	// Walk with idle IO priority, so the walk only gets the disk when nothing else wants it (linux only)
+	Nice bool
+	// How often progress is reported. 0 means never
+	ProgressInterval time.Duration
+	// Progress is called with the progress so far. If it is nil, progress is logged
+	Progress func(Progress)
+	// The number of files expected, used for the ETA. 0 if it isn't known
+	Total int
+}
+
+// Progress describes how far along a walk is
+type Progress struct {
+	Dir     string
+	Files   int
+	Elapsed time.Duration
+	Rate    float64       // files per second
+	ETA     time.Duration // 0 if the total isn't known
+}
+
+func (p Progress) String() string {
+	s := fmt.Sprintf("walked %d files in %s in %s (%.0f files/sec)", p.Files, p.Dir, p.Elapsed.Round(time.Second), p.Rate)
+	if p.ETA > 0 {
+		s += fmt.Sprintf(", about %s left", p.ETA.Round(time.Second))
+	}
+	return s
+}
+
 // AllFiles recursively lists every file in every subdirectory of a given directory
 // If basename is true, return the basename of each file. Otherwise return the full path starting at startDir.
 func AllFiles(startDir string, basename bool) ([]string, error) {
-	items, err := ioutil.ReadDir(startDir)
+	paths := make([]string, 0, 1000)
+	err := Walk(startDir, Opts{Basename: basename, ProgressInterval: allFilesProgressInterval}, func(path string) error {
+		paths = append(paths, path)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return paths, nil
+}
+
+// errStopped ends the dir walks after fn failed
+var errStopped = errors.Base("walk stopped")
+
+// Walk recursively visits every file in every subdirectory of startDir and calls fn with each one. The subdirectories
+// are walked in parallel, but fn is only called from one goroutine at a time. If fn returns an error, the walk stops
+// and Walk returns that error.
+func Walk(startDir string, opts Opts, fn func(path string) error) error {
+	items, err := ioutil.ReadDir(startDir)
+	if err != nil {
+		return err
+	}
+
+	maxThreads := opts.Workers
+	if maxThreads < 1 {
+		maxThreads = runtime.NumCPU() - 1
+	}
+	if maxThreads < 1 {
+		maxThreads = 1
+	}
+
+	stopper := stop.New()
+	defer stopper.StopAndWait()
+	limiter := ratelimit.New(int64(opts.MaxFilesPerSec), stopper.Ch())
+
+	var files atomic.Int64
+	start := time.Now()
+	if opts.ProgressInterval > 0 {
+		report := opts.Progress
+		if report == nil {
+			report = func(p Progress) { logrus.Infoln(p.String()) }
+		}
+		stopper.Add(1)
+		go func() {
+			defer stopper.Done()
+			ticker := time.NewTicker(opts.ProgressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stopper.Ch():
+					return
+				case <-ticker.C:
+					report(progress(startDir, int(files.Load()), opts.Total, time.Since(start)))
+				}
+			}
+		}()
+	}
 
 	pathChan := make(chan string)
-	paths := make([]string, 0, 1000)
+	var fnErr error
 	pathWG := &sync.WaitGroup{}
 	pathWG.Add(1)
 	metrics.RoutinesQueue.WithLabelValues("speedwalk", "worker").Inc()
 	go func() {
+		defer metrics.RoutinesQueue.WithLabelValues("speedwalk", "worker").Dec()
 		defer pathWG.Done()
-		for {
-			path, ok := <-pathChan
-			if !ok {
-				return
+		for path := range pathChan {
+			if fnErr != nil {
+				continue // let the walkers that are still sending finish
 			}
-			paths = append(paths, path)
+			fnErr = fn(path)
+			if fnErr != nil {
+				stopper.Stop()
+			}
+			files.Inc()
 		}
 	}()
 
-	maxThreads := runtime.NumCPU() - 1
+	// send returns errStopped once the walk should end
+	send := func(path string) error {
+		if limiter.Wait(1) != nil {
+			return errors.Err(errStopped)
+		}
+		select {
+		case pathChan <- path:
+			return nil
+		case <-stopper.Ch():
+			return errors.Err(errStopped)
+		}
+	}
+
 	goroutineLimiter := make(chan struct{}, maxThreads)
 	for i := 0; i < maxThreads; i++ {
 		goroutineLimiter <- struct{}{}
@@ -46,11 +158,16 @@ func AllFiles(startDir string, basename bool) ([]string, error) {
 
 	walkerWG := &sync.WaitGroup{}
 	for _, item := range items {
+		if stopped(stopper) {
+			break
+		}
 		if !item.IsDir() {
-			if basename {
-				pathChan <- item.Name()
-			} else {
-				pathChan <- filepath.Join(startDir, item.Name())
+			path := filepath.Join(startDir, item.Name())
+			if opts.Basename {
+				path = item.Name()
+			}
+			if send(path) != nil {
+				break
 			}
 			continue
 		}
@@ -63,20 +180,25 @@ func AllFiles(startDir string, basename bool) ([]string, error) {
 				walkerWG.Done()
 				goroutineLimiter <- struct{}{}
 			}()
-			err = godirwalk.Walk(filepath.Join(startDir, dir), &godirwalk.Options{
+			if opts.Nice {
+				// the priority is set on the thread. it's not unlocked, so the thread exits with the goroutine instead
+				// of running other goroutines at idle priority
+				runtime.LockOSThread()
+				lowerIOPriority()
+			}
+			err := godirwalk.Walk(filepath.Join(startDir, dir), &godirwalk.Options{
 				Unsorted: true, // faster this way
 				Callback: func(osPathname string, de *godirwalk.Dirent) error {
-					if de.IsRegular() {
-						if basename {
-							pathChan <- de.Name()
-						} else {
-							pathChan <- osPathname
-						}
+					if !de.IsRegular() {
+						return nil
 					}
-					return nil
+					if opts.Basename {
+						return send(de.Name())
+					}
+					return send(osPathname)
 				},
 			})
-			if err != nil {
+			if err != nil && !errors.Is(err, errStopped) {
 				logrus.Errorf(errors.FullTrace(err))
 			}
 		}(item.Name())
@@ -86,5 +208,31 @@ func AllFiles(startDir string, basename bool) ([]string, error) {
 
 	close(pathChan)
 	pathWG.Wait()
-	return paths, nil
+	if fnErr != nil {
+		return fnErr
+	}
+	if opts.ProgressInterval > 0 {
+		logrus.Debugln(progress(startDir, int(files.Load()), opts.Total, time.Since(start)).String())
+	}
+	return nil
+}
+
+func stopped(s *stop.Group) bool {
+	select {
+	case <-s.Ch():
+		return true
+	default:
+		return false
+	}
+}
+
+func progress(dir string, files, total int, elapsed time.Duration) Progress {
+	p := Progress{Dir: dir, Files: files, Elapsed: elapsed}
+	if elapsed > 0 {
+		p.Rate = float64(files) / elapsed.Seconds()
+	}
+	if total > files && p.Rate > 0 {
+		p.ETA = time.Duration(float64(total-files) / p.Rate * float64(time.Second))
+	}
+	return p
 }
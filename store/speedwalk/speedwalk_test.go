@@ -0,0 +1,54 @@
+package speedwalk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalk(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "speedwalk_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	var want []string
+	for _, f := range []string{"top", "aa/one", "aa/two", "bb/three", "cc/dd/four"} {
+		file := filepath.Join(tmpDir, f)
+		require.NoError(t, os.MkdirAll(filepath.Dir(file), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(file, []byte(f), 0644))
+		want = append(want, filepath.Base(f))
+	}
+	sort.Strings(want)
+
+	got, err := AllFiles(tmpDir, true)
+	require.NoError(t, err)
+	sort.Strings(got)
+	assert.Equal(t, want, got)
+
+	files := 0
+	err = Walk(tmpDir, Opts{Workers: 1, MaxFilesPerSec: 1000}, func(path string) error {
+		files++
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, len(want), files)
+
+	stop := errors.Base("enough")
+	visited := 0
+	err = Walk(tmpDir, Opts{Workers: 2, Nice: true}, func(path string) error {
+		visited++
+		if visited == 2 {
+			return stop
+		}
+		return nil
+	})
+	assert.True(t, errors.Is(err, stop))
+	assert.Equal(t, 2, visited)
+}
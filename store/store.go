@@ -1,6 +1,10 @@
 package store
 
 import (
+	"fmt"
+	"sort"
+	"time"
+
 	"github.com/lbryio/reflector.go/shared"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
@@ -39,5 +43,139 @@ type lister interface {
 	list() ([]string, error)
 }
 
+// List returns the hashes of the blobs in a store, or an error if the store can't list its blobs
+func List(s BlobStore) ([]string, error) {
+	if l, ok := s.(lister); ok {
+		return l.list()
+	}
+	return nil, errors.Err("%s store can't list its blobs", s.Name())
+}
+
+// pageLister is a store that can list its blobs a page at a time, without listing all of them
+type pageLister interface {
+	// listPage returns up to limit hashes that sort after the hash after, in order
+	listPage(after string, limit int) ([]string, error)
+}
+
+// ListPage returns up to limit hashes of the blobs in a store that sort after the hash after, in order. Start with an
+// empty after, and pass the last hash of each page to get the next one. Stores that can't list a page at a time are
+// listed whole for every page
+func ListPage(s BlobStore, after string, limit int) ([]string, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	if l, ok := s.(pageLister); ok {
+		return l.listPage(after, limit)
+	}
+	hashes, err := List(s)
+	if err != nil {
+		return nil, err
+	}
+	return pageOf(hashes, after, limit), nil
+}
+
+// hasManyer is a store that can look up whether many blobs exist at once
+type hasManyer interface {
+	hasMany(hashes []string) (map[string]bool, error)
+}
+
+// HasMany returns which of the hashes are in a store. Stores that can look them all up at once do, the others are asked
+// about each hash in turn
+func HasMany(s BlobStore, hashes []string) (map[string]bool, error) {
+	if h, ok := s.(hasManyer); ok {
+		return h.hasMany(hashes)
+	}
+	exists := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		has, err := s.Has(hash)
+		if err != nil {
+			return nil, err
+		}
+		if has {
+			exists[hash] = true
+		}
+	}
+	return exists, nil
+}
+
+// walkPageSize is how many hashes Walk lists at a time
+const walkPageSize = 10000
+
+// Walk calls fn with the hash of each blob in a store, in order, and stops at the first error fn returns. Stores that
+// can list a page at a time are walked that way, so their hashes are never all in memory at once
+func Walk(s BlobStore, fn func(hash string) error) error {
+	if _, ok := s.(pageLister); !ok {
+		hashes, err := List(s)
+		if err != nil {
+			return err
+		}
+		sort.Strings(hashes)
+		return walkHashes(hashes, fn)
+	}
+	after := ""
+	for {
+		page, err := ListPage(s, after, walkPageSize)
+		if err != nil {
+			return err
+		}
+		err = walkHashes(page, fn)
+		if err != nil || len(page) < walkPageSize {
+			return err
+		}
+		after = page[len(page)-1]
+	}
+}
+
+func walkHashes(hashes []string, fn func(hash string) error) error {
+	for _, h := range hashes {
+		if err := fn(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pageOf returns up to limit of the hashes that sort after the hash after, in order. It sorts hashes
+func pageOf(hashes []string, after string, limit int) []string {
+	sort.Strings(hashes)
+	i := sort.Search(len(hashes), func(i int) bool { return hashes[i] > after })
+	hashes = hashes[i:]
+	if len(hashes) > limit {
+		hashes = hashes[:limit]
+	}
+	return hashes
+}
+
 //ErrBlobNotFound is a standard error when a blob is not found in the store.
 var ErrBlobNotFound = errors.Base("blob not found")
+
+// ErrBlobCorrupt is returned when the data of a blob doesn't match its hash
+var ErrBlobCorrupt = errors.Base("blob data does not match its hash")
+
+// ErrServerError is returned when a remote store answers with a server error, like an http 5xx
+var ErrServerError = errors.Base("upstream server error")
+
+// ErrBlobUnavailable is returned when a blob is in the store but can't be read right now, like while it's restored
+// from an archive. The error is an *UnavailableError, and RetryAfter says when to try again
+var ErrBlobUnavailable = errors.Base("blob is temporarily unavailable")
+
+// UnavailableError is an ErrBlobUnavailable that says when the blob is expected to be readable
+type UnavailableError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("%s: %s, retry after %s", ErrBlobUnavailable, e.Reason, e.RetryAfter)
+}
+
+// Is makes errors.Is(err, ErrBlobUnavailable) true
+func (e *UnavailableError) Is(target error) bool { return target == ErrBlobUnavailable }
+
+// RetryAfter returns how long to wait before getting the blob again, if err is an ErrBlobUnavailable
+func RetryAfter(err error) (time.Duration, bool) {
+	if e, ok := errors.Unwrap(err).(*UnavailableError); ok {
+		return e.RetryAfter, true
+	}
+	return 0, false
+}
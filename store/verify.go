@@ -0,0 +1,143 @@
+package store
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/lbryio/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultVerifyQueue is how many blobs can wait to be verified. More are not verified
+	DefaultVerifyQueue = 1000
+
+	// quarantineDir is where corrupt blobs are moved, in the blob dir. They're named HASH.corrupt so they're not
+	// listed as blobs
+	quarantineDir    = "quarantine"
+	quarantineSuffix = ".corrupt"
+
+	verifyOK      = "ok"
+	verifyCorrupt = "corrupt"
+	verifySkipped = "skipped"
+	verifyError   = "error"
+)
+
+// verifyJob is a blob to verify. It only holds the hash, and the file is read again by the worker, so a full queue
+// doesn't keep the contents of every blob in it in memory
+type verifyJob struct {
+	store *DiskStore
+	hash  string
+}
+
+// Verifier checks the blobs that disk stores serve against their hash in a pool of workers, after they were served,
+// so reads don't wait for the hashing. Blobs that don't match are moved out of the store into its quarantine dir, to
+// be looked at or removed by hand. If the workers can't keep up, blobs are served without being verified.
+//
+// crypto/sha512 hashes with the SIMD instructions of the cpu (AVX2 on amd64, the SHA-512 extension on arm64) when it
+// has them, so the workers need no hashing code of their own
+type Verifier struct {
+	workers int
+	queue   chan verifyJob
+	grp     *stop.Group
+}
+
+// NewVerifier returns a verifier with the given number of workers and queue size
+func NewVerifier(workers, queueSize int) *Verifier {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Verifier{
+		workers: workers,
+		queue:   make(chan verifyJob, queueSize),
+		grp:     stop.New(),
+	}
+}
+
+// Start starts the workers
+func (v *Verifier) Start() {
+	for i := 0; i < v.workers; i++ {
+		v.grp.Add(1)
+		go func() {
+			defer v.grp.Done()
+			for {
+				select {
+				case <-v.grp.Ch():
+					return
+				case j := <-v.queue:
+					j.store.verify(j.hash)
+				}
+			}
+		}()
+	}
+}
+
+// Shutdown stops the workers. Blobs waiting to be verified are not
+func (v *Verifier) Shutdown() {
+	v.grp.StopAndWait()
+}
+
+// enqueue has the blob verified in the background, unless the queue is full
+func (v *Verifier) enqueue(j verifyJob) {
+	select {
+	case v.queue <- j:
+	default:
+		metrics.VerifyCount.WithLabelValues(verifySkipped).Inc()
+	}
+}
+
+// verify reads the blob, checks it against its hash and quarantines it if it doesn't match
+func (d *DiskStore) verify(hash string) {
+	blob, err := ioutil.ReadFile(d.path(hash))
+	if os.IsNotExist(err) {
+		return // deleted since
+	} else if err != nil {
+		metrics.VerifyCount.WithLabelValues(verifyError).Inc()
+		log.Errorf("verifying blob %s: %s", hash, err.Error())
+		return
+	}
+	sum := sha512.Sum384(blob)
+	actual := hex.EncodeToString(sum[:])
+	if actual == hash {
+		metrics.VerifyCount.WithLabelValues(verifyOK).Inc()
+		return
+	}
+	metrics.VerifyCount.WithLabelValues(verifyCorrupt).Inc()
+	log.Errorf("[%s] found a broken blob after serving it from disk. Actual hash: %s. Quarantining it", hash, actual)
+	err = d.quarantine(hash)
+	if err != nil {
+		log.Errorf("quarantining blob %s: %s", hash, errors.FullTrace(err))
+	}
+}
+
+// quarantine moves the blob out of the store into the quarantine dir
+func (d *DiskStore) quarantine(hash string) error {
+	err := d.ensureDirExists(d.quarantineDir())
+	if err != nil {
+		return err
+	}
+	d.journal.begin(hash, journalDelete)
+	defer d.journal.done(hash)
+
+	err = os.Rename(d.path(hash), path.Join(d.quarantineDir(), hash+quarantineSuffix))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Err(err)
+	}
+	if d.index != nil {
+		d.index.remove(hash)
+	}
+	return nil
+}
+
+func (d *DiskStore) quarantineDir() string {
+	return path.Join(d.blobDir, quarantineDir)
+}
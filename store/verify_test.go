@@ -0,0 +1,52 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifier_Quarantine(t *testing.T) {
+	dir := t.TempDir()
+	v := NewVerifier(2, 10)
+	v.Start()
+	defer v.Shutdown()
+	d := NewDiskStore(dir, 2).WithVerifier(v)
+
+	good := []byte("oyuntyausntoyaunpdoyruoyduanrstjwfjyuwf")
+	goodHash := "f428b8265d65dad7f8ffa52922bba836404cbd62f3ecfe10adba6b444f8f658938e54f5981ac4de39644d5b93d89a94b"
+	badHash := "f428b8265d65dad7f8ffa52922bba836404cbd62f3ecfe10adba6b444f8f658938e54f5981ac4de39644d5b93d89a94c"
+	for _, hash := range []string{goodHash, badHash} {
+		require.NoError(t, os.MkdirAll(path.Join(dir, hash[:2]), 0755))
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, hash[:2], hash), good, 0644))
+	}
+
+	// the corrupt blob is served, and quarantined afterwards
+	blob, _, err := d.Get(badHash)
+	require.NoError(t, err)
+	assert.EqualValues(t, good, blob)
+	_, _, err = d.Get(goodHash)
+	require.NoError(t, err)
+	f, _, err := d.openFile(goodHash)
+	require.NoError(t, err)
+	_ = f.Close()
+
+	require.Eventually(t, func() bool {
+		has, err := d.Has(badHash)
+		return err == nil && !has
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = os.Stat(path.Join(d.quarantineDir(), badHash+quarantineSuffix))
+	assert.NoError(t, err)
+
+	has, err := d.Has(goodHash)
+	require.NoError(t, err)
+	assert.True(t, has)
+	hashes, err := d.list()
+	require.NoError(t, err)
+	assert.Equal(t, []string{goodHash}, hashes)
+}
@@ -0,0 +1,225 @@
+// Package streamhook tells an external program, like a transcoder, about streams once all of their blobs have arrived,
+// so video pipelines can be driven straight from the reflector. A Tracker notices when the blobs of a stream are all
+// stored. The Hook reassembles the stream into a file, and the program gets the sd hash and the path of the file,
+// either in an http POST to a webhook or as the arguments of a command.
+package streamhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lbryio/reflector.go/shared"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultTimeout is how long the webhook or command may take, unless Timeout is changed
+	DefaultTimeout = 30 * time.Minute
+
+	queueSize = 1000
+)
+
+// Notification is what the webhook is sent, as json
+type Notification struct {
+	SDHash string `json:"sd_hash"`
+	// Path is the reassembled file. It's deleted after the hook returns unless KeepFiles is set
+	Path string `json:"path"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Hook runs a webhook or a command for each stream whose blobs have all arrived
+type Hook struct {
+	// URL is POSTed a Notification for each stream
+	URL string
+	// Command is run for each stream with the sd hash and the path of the file appended to its arguments. It's split
+	// on spaces
+	Command string
+	// Dir is where streams are reassembled. The temp dir is used if it's empty
+	Dir string
+	// KeepFiles leaves the reassembled files for the program to clean up, instead of deleting them once it returns
+	KeepFiles bool
+	// Timeout is how long the webhook or command may take
+	Timeout time.Duration
+
+	store  store.BlobStore
+	client *http.Client
+	queue  chan string
+	grp    *stop.Group
+}
+
+// New returns a hook that reassembles streams from the blobs in st. A Tracker tells it when streams are complete
+func New(st store.BlobStore) *Hook {
+	return &Hook{
+		Timeout: DefaultTimeout,
+		store:   st,
+		client:  &http.Client{},
+		queue:   make(chan string, queueSize),
+		grp:     stop.New(),
+	}
+}
+
+// Start starts running the hook for the streams that complete
+func (h *Hook) Start() error {
+	if h.URL == "" && h.Command == "" {
+		return errors.Err("stream hook needs a url or a command")
+	}
+	h.grp.Add(1)
+	go func() {
+		defer h.grp.Done()
+		for {
+			select {
+			case <-h.grp.Ch():
+				return
+			case sdHash := <-h.queue:
+				err := h.Run(sdHash)
+				if err != nil {
+					log.Errorf("stream hook for %s: %s", sdHash, errors.FullTrace(err))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops the hook. Streams that were waiting to be handed to it are dropped
+func (h *Hook) Shutdown() {
+	h.grp.StopAndWait()
+}
+
+// Enqueue has the hook run for the stream in the background. It's meant for a Tracker's OnComplete
+func (h *Hook) Enqueue(sdHash string) {
+	select {
+	case h.queue <- sdHash:
+	case <-h.grp.Ch():
+	default:
+		log.Errorf("stream hook: queue is full, dropping stream %s", sdHash)
+	}
+}
+
+// Run reassembles the stream and runs the webhook or command for it right away
+func (h *Hook) Run(sdHash string) error {
+	n, err := h.reassemble(sdHash)
+	if err != nil {
+		return err
+	}
+	if !h.KeepFiles {
+		defer func() {
+			if err := os.RemoveAll(filepath.Dir(n.Path)); err != nil {
+				log.Errorf("stream hook: removing %s: %s", n.Path, err.Error())
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	if h.URL != "" {
+		err = h.post(ctx, n)
+		if err != nil {
+			return err
+		}
+	}
+	if h.Command != "" {
+		err = h.exec(ctx, n)
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("stream hook ran for %s (%s)", sdHash, n.Name)
+	return nil
+}
+
+// reassemble writes the file of the stream to a dir of its own, a blob at a time
+func (h *Hook) reassemble(sdHash string) (Notification, error) {
+	n := Notification{SDHash: sdHash}
+	blob, _, err := h.store.Get(sdHash)
+	if err != nil {
+		return n, err
+	}
+	sd, err := shared.ParseSDBlob(blob)
+	if err != nil {
+		return n, err
+	}
+
+	n.Name = filepath.Base(sd.SuggestedFileName)
+	if n.Name == "." || n.Name == "/" || n.Name == "" {
+		n.Name = sdHash
+	}
+	dir, err := ioutil.TempDir(h.Dir, "stream-"+sdHash[:8]+"-")
+	if err != nil {
+		return n, errors.Err(err)
+	}
+	n.Path = filepath.Join(dir, n.Name)
+	f, err := os.Create(n.Path)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return n, errors.Err(err)
+	}
+	defer f.Close()
+
+	for _, info := range sd.ContentBlobs() {
+		hash := hex.EncodeToString(info.BlobHash)
+		b, _, err := h.store.Get(hash)
+		if err == nil && b.HashHex() != hash {
+			err = errors.Err("blob does not match its hash")
+		}
+		var data []byte
+		if err == nil {
+			data, err = shared.DecryptBlob(b, sd.Key, info.IV)
+		}
+		if err == nil {
+			_, err = f.Write(data)
+		}
+		if err != nil {
+			_ = os.RemoveAll(dir)
+			return n, errors.Prefix("blob "+hash, err)
+		}
+		n.Size += int64(len(data))
+	}
+	return n, nil
+}
+
+func (h *Hook) post(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return errors.Err(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Err(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := h.client.Do(req)
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.Err("webhook answered with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (h *Hook) exec(ctx context.Context, n Notification) error {
+	parts := strings.Fields(h.Command)
+	cmd := exec.CommandContext(ctx, parts[0], append(parts[1:], n.SDHash, n.Path)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Err("%s: %s", err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package streamhook
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/publish"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHook_Tracker(t *testing.T) {
+	data := make([]byte, stream.MaxBlobSize+100)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	src := store.NewMemStore()
+	ingested, err := publish.Ingest(bytes.NewReader(data), "cat.mp4", src)
+	require.NoError(t, err)
+
+	got := make(chan Notification, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+		file, err := ioutil.ReadFile(n.Path)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data, file), "reassembled file is different")
+		got <- n
+	}))
+	defer ts.Close()
+
+	st := store.NewMemStore()
+	h := New(st)
+	h.URL = ts.URL
+	h.Dir = t.TempDir()
+	require.NoError(t, h.Start())
+	defer h.Shutdown()
+	tracker := NewTracker(st)
+	tracker.OnComplete = h.Enqueue
+	defer tracker.Shutdown()
+
+	// the sd blob arrives between the content blobs, like it can from several uploaders
+	receive := func(hash string, sd bool) {
+		blob, _, err := src.Get(hash)
+		require.NoError(t, err)
+		require.NoError(t, st.Put(hash, blob))
+		tracker.BlobReceived(hash, sd)
+	}
+	receive(ingested.Blobs[0], false)
+	receive(ingested.SDHash, true)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-got:
+		t.Fatal("hook ran before the stream was complete")
+	default:
+	}
+	receive(ingested.Blobs[1], false)
+
+	select {
+	case n := <-got:
+		assert.Equal(t, ingested.SDHash, n.SDHash)
+		assert.Equal(t, "cat.mp4", n.Name)
+		assert.Equal(t, int64(len(data)), n.Size)
+		time.Sleep(50 * time.Millisecond)
+		_, err := os.Stat(filepath.Dir(n.Path))
+		assert.True(t, os.IsNotExist(err), "reassembled file was not removed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("hook did not run")
+	}
+}
+
+func TestHook_Command(t *testing.T) {
+	st := store.NewMemStore()
+	ingested, err := publish.Ingest(bytes.NewReader([]byte("hello")), "hello.txt", st)
+	require.NoError(t, err)
+
+	out := filepath.Join(t.TempDir(), "out")
+	script := filepath.Join(t.TempDir(), "hook.sh")
+	require.NoError(t, ioutil.WriteFile(script, []byte("#!/bin/sh\ncp \"$2\" "+out+"\n"), 0755))
+	h := New(st)
+	h.Command = script
+	h.Dir = t.TempDir()
+
+	require.NoError(t, h.Run(ingested.SDHash))
+	file, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(file))
+}
@@ -0,0 +1,183 @@
+package streamhook
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/shared"
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultPendingTTL is how long a stream waits for its blobs, unless PendingTTL is changed
+const DefaultPendingTTL = 24 * time.Hour
+
+// Tracker follows the blobs as they're stored, and tells OnComplete about each stream once all of its blobs are. The
+// blobs may arrive in any order
+type Tracker struct {
+	// OnComplete is called with the sd hash of each stream whose blobs are all stored
+	OnComplete func(sdHash string)
+	// PendingTTL is how long a stream is waited on after its sd blob arrived. Streams whose blobs don't all arrive in
+	// that time are forgotten
+	PendingTTL time.Duration
+
+	store store.BlobStore
+	grp   *stop.Group
+
+	mu      sync.Mutex
+	pending map[string]*pendingStream // by sd hash
+	byBlob  map[string][]string       // sd hashes of the pending streams each missing blob is in
+}
+
+type pendingStream struct {
+	missing map[string]bool
+	since   time.Time
+}
+
+// NewTracker returns a tracker that checks st for the blobs that arrived before the sd blob
+func NewTracker(st store.BlobStore) *Tracker {
+	return &Tracker{
+		PendingTTL: DefaultPendingTTL,
+		store:      st,
+		grp:        stop.New(),
+		pending:    make(map[string]*pendingStream),
+		byBlob:     make(map[string][]string),
+	}
+}
+
+// Shutdown waits for the sd blobs that are being looked at
+func (t *Tracker) Shutdown() {
+	t.grp.StopAndWait()
+}
+
+// BlobReceived tells the tracker that a blob was stored. It's meant for the reflector server's OnBlobReceived
+func (t *Tracker) BlobReceived(hash string, isSdBlob bool) {
+	if isSdBlob {
+		t.grp.Add(1)
+		go func() {
+			defer t.grp.Done()
+			err := t.track(hash)
+			if err != nil {
+				log.Errorf("tracking stream %s: %s", hash, err.Error())
+			}
+		}()
+		return
+	}
+	t.stored(hash)
+}
+
+// track starts waiting for the blobs of the stream. The stream is registered before the store is checked for its
+// blobs, so blobs that arrive during the check are not missed
+func (t *Tracker) track(sdHash string) error {
+	blob, _, err := t.store.Get(sdHash)
+	if err != nil {
+		return err
+	}
+	sd, err := shared.ParseSDBlob(blob)
+	if err != nil {
+		return err
+	}
+
+	p := &pendingStream{missing: make(map[string]bool), since: time.Now()}
+	var hashes []string
+	for _, info := range sd.ContentBlobs() {
+		hashes = append(hashes, hex.EncodeToString(info.BlobHash))
+	}
+	t.mu.Lock()
+	t.expire()
+	if _, ok := t.pending[sdHash]; ok {
+		t.mu.Unlock()
+		return nil
+	}
+	t.pending[sdHash] = p
+	for _, hash := range hashes {
+		p.missing[hash] = true
+		t.byBlob[hash] = append(t.byBlob[hash], sdHash)
+	}
+	t.mu.Unlock()
+
+	for _, hash := range hashes {
+		has, err := t.store.Has(hash)
+		if err != nil {
+			log.Warnf("tracking stream %s: checking blob %s: %s", sdHash, hash, err.Error())
+			continue
+		}
+		if has {
+			t.stored(hash)
+		}
+	}
+
+	// a stream with no content blobs is complete right away
+	t.mu.Lock()
+	empty := t.pending[sdHash] == p && len(p.missing) == 0
+	if empty {
+		t.forget(sdHash, p)
+	}
+	t.mu.Unlock()
+	if empty {
+		t.complete(sdHash)
+	}
+	return nil
+}
+
+// stored marks a blob as arrived in the streams that were waiting for it
+func (t *Tracker) stored(hash string) {
+	var complete []string
+	t.mu.Lock()
+	for _, sdHash := range t.byBlob[hash] {
+		p, ok := t.pending[sdHash]
+		if !ok {
+			continue
+		}
+		delete(p.missing, hash)
+		if len(p.missing) == 0 {
+			t.forget(sdHash, p)
+			complete = append(complete, sdHash)
+		}
+	}
+	delete(t.byBlob, hash)
+	t.mu.Unlock()
+
+	for _, sdHash := range complete {
+		t.complete(sdHash)
+	}
+}
+
+func (t *Tracker) complete(sdHash string) {
+	if t.OnComplete != nil {
+		t.OnComplete(sdHash)
+	}
+}
+
+// forget stops waiting on a stream. It must be called with the lock held
+func (t *Tracker) forget(sdHash string, p *pendingStream) {
+	delete(t.pending, sdHash)
+	for hash := range p.missing {
+		streams := t.byBlob[hash]
+		for i := range streams {
+			if streams[i] == sdHash {
+				streams = append(streams[:i], streams[i+1:]...)
+				break
+			}
+		}
+		if len(streams) == 0 {
+			delete(t.byBlob, hash)
+		} else {
+			t.byBlob[hash] = streams
+		}
+	}
+}
+
+// expire forgets the streams that waited longer than PendingTTL. It must be called with the lock held
+func (t *Tracker) expire() {
+	for sdHash, p := range t.pending {
+		if time.Since(p.since) > t.PendingTTL {
+			log.Debugf("gave up on stream %s, %d blobs never arrived", sdHash, len(p.missing))
+			t.forget(sdHash, p)
+		}
+	}
+}
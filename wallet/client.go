@@ -1,6 +1,7 @@
 package wallet
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 
@@ -14,18 +15,28 @@ import (
 	"github.com/spf13/cast"
 )
 
+// requester sends a request to a wallet server, or to several
+type requester interface {
+	request(ctx context.Context, method string, params []interface{}, v interface{}) error
+}
+
+// client implements the wallet server methods on top of a requester. Node and NodePool embed it
+type client struct {
+	r requester
+}
+
 // Raw makes a raw wallet server request
-func (n *Node) Raw(method string, params []string, v interface{}) error {
-	return n.request(method, params, v)
+func (c client) Raw(ctx context.Context, method string, params []string, v interface{}) error {
+	return c.r.request(ctx, method, stringParams(params), v)
 }
 
 // ServerVersion returns the server's version.
 // https://electrumx.readthedocs.io/en/latest/protocol-methods.html#server-version
-func (n *Node) ServerVersion() (string, error) {
+func (c client) ServerVersion(ctx context.Context) (string, error) {
 	resp := &struct {
 		Result []string `json:"result"`
 	}{}
-	err := n.request("server.version", []string{"reflector.go", ProtocolVersion}, resp)
+	err := c.r.request(ctx, "server.version", []interface{}{"reflector.go", ProtocolVersion}, resp)
 
 	var v string
 	if len(resp.Result) >= 2 {
@@ -35,13 +46,42 @@ func (n *Node) ServerVersion() (string, error) {
 	return v, err
 }
 
-func (n *Node) Resolve(url string) (*types.Output, error) {
-	outputs := &types.Outputs{}
+// Resolve resolves a single url
+func (c client) Resolve(ctx context.Context, url string) (*types.Output, error) {
+	outputs, err := c.ResolveURLs(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(outputs) != 1 {
+		return nil, errors.Err("expected 1 output, got " + cast.ToString(len(outputs)))
+	}
+
+	if e := outputs[0].GetError(); e != nil {
+		return nil, errors.Err("%s: %s", e.GetCode(), e.GetText())
+	}
+
+	return outputs[0], nil
+}
+
+// ResolveURLs resolves several urls at once. There is one output per url, in the same order. Urls that could not be
+// resolved have an output with only the error set.
+func (c client) ResolveURLs(ctx context.Context, urls ...string) ([]*types.Output, error) {
+	return c.outputs(ctx, "blockchain.claimtrie.resolve", urls)
+}
+
+// GetClaimsByIds returns the claims with the given ids
+func (c client) GetClaimsByIds(ctx context.Context, claimIDs ...string) ([]*types.Output, error) {
+	return c.outputs(ctx, "blockchain.claimtrie.getclaimsbyids", claimIDs)
+}
+
+// outputs makes a request whose result is a base64 encoded Outputs protobuf
+func (c client) outputs(ctx context.Context, method string, params []string) ([]*types.Output, error) {
 	resp := &struct {
 		Result string `json:"result"`
 	}{}
 
-	err := n.request("blockchain.claimtrie.resolve", []string{url}, resp)
+	err := c.r.request(ctx, method, stringParams(params), resp)
 	if err != nil {
 		return nil, err
 	}
@@ -51,54 +91,57 @@ func (n *Node) Resolve(url string) (*types.Output, error) {
 		return nil, errors.Err(err)
 	}
 
+	outputs := &types.Outputs{}
 	err = proto.Unmarshal(b, outputs)
 	if err != nil {
 		return nil, errors.Err(err)
 	}
 
-	if len(outputs.GetTxos()) != 1 {
-		return nil, errors.Err("expected 1 output, got " + cast.ToString(len(outputs.GetTxos())))
-	}
+	return outputs.GetTxos(), nil
+}
 
-	if e := outputs.GetTxos()[0].GetError(); e != nil {
-		return nil, errors.Err("%s: %s", e.GetCode(), e.GetText())
-	}
+// ClaimInTx is a claim in a transaction, as returned by GetClaimsInTx
+type ClaimInTx struct {
+	Name            string    `json:"name"`
+	ClaimID         string    `json:"claim_id"`
+	Txid            string    `json:"txid"`
+	Nout            int       `json:"nout"`
+	Amount          int       `json:"amount"`
+	Depth           int       `json:"depth"`
+	Height          int       `json:"height"`
+	Value           string    `json:"value"`
+	ClaimSequence   int       `json:"claim_sequence"`
+	Address         string    `json:"address"`
+	Supports        []Support `json:"supports"`
+	EffectiveAmount int       `json:"effective_amount"`
+	ValidAtHeight   int       `json:"valid_at_height"`
+}
 
-	return outputs.GetTxos()[0], nil
+// Support is a support for a claim
+type Support struct {
+	Txid   string `json:"txid"`
+	Nout   int    `json:"nout"`
+	Amount int    `json:"amount"`
 }
 
 type GetClaimsInTxResp struct {
-	Jsonrpc string `json:"jsonrpc"`
-	ID      int    `json:"id"`
-	Result  []struct {
-		Name            string        `json:"name"`
-		ClaimID         string        `json:"claim_id"`
-		Txid            string        `json:"txid"`
-		Nout            int           `json:"nout"`
-		Amount          int           `json:"amount"`
-		Depth           int           `json:"depth"`
-		Height          int           `json:"height"`
-		Value           string        `json:"value"`
-		ClaimSequence   int           `json:"claim_sequence"`
-		Address         string        `json:"address"`
-		Supports        []interface{} `json:"supports"` // TODO: finish me
-		EffectiveAmount int           `json:"effective_amount"`
-		ValidAtHeight   int           `json:"valid_at_height"`
-	} `json:"result"`
-}
-
-func (n *Node) GetClaimsInTx(txid string) (*GetClaimsInTxResp, error) {
+	Jsonrpc string      `json:"jsonrpc"`
+	ID      int         `json:"id"`
+	Result  []ClaimInTx `json:"result"`
+}
+
+func (c client) GetClaimsInTx(ctx context.Context, txid string) (*GetClaimsInTxResp, error) {
 	var resp GetClaimsInTxResp
-	err := n.request("blockchain.claimtrie.getclaimsintx", []string{txid}, &resp)
+	err := c.r.request(ctx, "blockchain.claimtrie.getclaimsintx", []interface{}{txid}, &resp)
 	return &resp, err
 }
 
-func (n *Node) GetTx(txid string) (string, error) {
+func (c client) GetTx(ctx context.Context, txid string) (string, error) {
 	resp := &struct {
 		Result string `json:"result"`
 	}{}
 
-	err := n.request("blockchain.transaction.get", []string{txid}, resp)
+	err := c.r.request(ctx, "blockchain.transaction.get", []interface{}{txid}, resp)
 	if err != nil {
 		return "", err
 	}
@@ -106,8 +149,16 @@ func (n *Node) GetTx(txid string) (string, error) {
 	return resp.Result, nil
 }
 
-func (n *Node) GetClaimInTx(txid string, nout int) (*types.Claim, error) {
-	hexTx, err := n.GetTx(txid)
+// Transaction is a transaction returned by the wallet server
+type Transaction struct {
+	Txid string
+	Raw  []byte
+	Tx   *btcutil.Tx
+}
+
+// GetTransaction returns the decoded transaction
+func (c client) GetTransaction(ctx context.Context, txid string) (*Transaction, error) {
+	hexTx, err := c.GetTx(ctx, txid)
 	if err != nil {
 		return nil, errors.Err(err)
 	}
@@ -122,13 +173,19 @@ func (n *Node) GetClaimInTx(txid string, nout int) (*types.Claim, error) {
 		return nil, errors.Err(err)
 	}
 
-	if len(tx.MsgTx().TxOut) <= nout {
+	return &Transaction{Txid: txid, Raw: rawTx, Tx: tx}, nil
+}
+
+// Claim returns the claim in an output of the transaction
+func (t *Transaction) Claim(nout int) (*types.Claim, error) {
+	if len(t.Tx.MsgTx().TxOut) <= nout {
 		return nil, errors.Err("nout not found")
 	}
 
-	script := tx.MsgTx().TxOut[nout].PkScript
+	script := t.Tx.MsgTx().TxOut[nout].PkScript
 
 	var value []byte
+	var err error
 	if lbrycrd.IsClaimNameScript(script) {
 		_, value, _, err = lbrycrd.ParseClaimNameScript(script)
 	} else if lbrycrd.IsClaimUpdateScript(script) {
@@ -147,3 +204,19 @@ func (n *Node) GetClaimInTx(txid string, nout int) (*types.Claim, error) {
 
 	return ch.Claim, nil
 }
+
+func (c client) GetClaimInTx(ctx context.Context, txid string, nout int) (*types.Claim, error) {
+	tx, err := c.GetTransaction(ctx, txid)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Claim(nout)
+}
+
+func stringParams(params []string) []interface{} {
+	p := make([]interface{}, len(params))
+	for i := range params {
+		p[i] = params[i]
+	}
+	return p
+}
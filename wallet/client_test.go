@@ -0,0 +1,50 @@
+package wallet
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	types "github.com/lbryio/types/v2/go"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestClient_ResolveURLs(t *testing.T) {
+	s := newFakeHandlerServer(t, func(method string, params json.RawMessage) interface{} {
+		var urls []string
+		_ = json.Unmarshal(params, &urls)
+		outputs := &types.Outputs{}
+		for _, url := range urls {
+			if url == "lbry://missing" {
+				outputs.Txos = append(outputs.Txos, &types.Output{Meta: &types.Output_Error{Error: &types.Error{Code: types.Error_NOT_FOUND, Text: "not found"}}})
+				continue
+			}
+			outputs.Txos = append(outputs.Txos, &types.Output{Nout: uint32(len(url))})
+		}
+		b, _ := proto.Marshal(outputs)
+		return base64.StdEncoding.EncodeToString(b)
+	})
+	defer s.close()
+
+	n := NewNode()
+	err := n.Connect([]string{s.addr()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Shutdown()
+
+	outputs, err := n.ResolveURLs(context.Background(), "lbry://a", "lbry://missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 2 || outputs[0].GetNout() != uint32(len("lbry://a")) || outputs[1].GetError() == nil {
+		t.Errorf("unexpected outputs %v", outputs)
+	}
+
+	_, err = n.Resolve(context.Background(), "lbry://missing")
+	if err == nil {
+		t.Error("expected resolving a missing url to fail")
+	}
+}
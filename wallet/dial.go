@@ -0,0 +1,189 @@
+package wallet
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"golang.org/x/net/proxy"
+)
+
+var ErrCertNotPinned = errors.Base("server certificate does not match any pinned key")
+
+// ParseProxy checks a proxy url. socks5://host:port and http://host:port proxies are supported
+func ParseProxy(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, errors.Err("unsupported proxy scheme '%s', use socks5:// or http://", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.Err("proxy url %s has no host", proxyURL)
+	}
+	return u, nil
+}
+
+// dial connects to addr, through the proxy if there is one, and starts TLS if config is set
+func dial(addr string, config *tls.Config, proxyURL *url.URL, timeout time.Duration) (net.Conn, error) {
+	if proxyURL == nil {
+		if config != nil {
+			return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, config)
+		}
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+
+	var conn net.Conn
+	var err error
+	switch proxyURL.Scheme {
+	case "socks5":
+		var d proxy.Dialer
+		d, err = proxy.FromURL(proxyURL, &net.Dialer{Timeout: timeout})
+		if err == nil {
+			conn, err = d.Dial("tcp", addr)
+		}
+	case "http":
+		conn, err = dialHTTPProxy(addr, proxyURL, timeout)
+	default:
+		err = errors.Err("unsupported proxy scheme '%s'", proxyURL.Scheme)
+	}
+	if err != nil {
+		return nil, errors.Prefix("proxy "+proxyURL.Host, err)
+	}
+
+	if config == nil {
+		return conn, nil
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, config)
+	_ = tlsConn.SetDeadline(time.Now().Add(timeout))
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// dialHTTPProxy opens a tunnel to addr with an http CONNECT request
+func dialHTTPProxy(addr string, proxyURL *url.URL, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxyURL.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		req.SetBasicAuth(proxyURL.User.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Err(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Err(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Err("CONNECT to %s failed: %s", addr, resp.Status)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection that had some of its data read into a buffer already
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.reader.Read(b) }
+
+// PinnedTLSConfig returns a tls config for connecting to wallet servers. If caFile is set, server certificates must be
+// signed by one of the CAs in it instead of the system ones. If pins are set, the server's certificate must have one
+// of the pinned public keys, given as hex sha256 hashes of the certificate's SubjectPublicKeyInfo. Pins alone are
+// enough to trust a self-signed certificate.
+func PinnedTLSConfig(pins []string, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Err("no certificates found in %s", caFile)
+		}
+	}
+
+	if len(pins) == 0 {
+		return config, nil
+	}
+
+	pinned := make(map[string]bool, len(pins))
+	for _, p := range pins {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if b, err := hex.DecodeString(p); err != nil || len(b) != sha256.Size {
+			return nil, errors.Err("pin %s is not a hex sha256 hash", p)
+		}
+		pinned[p] = true
+	}
+
+	// the pin is the trust anchor, so the usual chain check is skipped unless there is a CA to check against
+	config.InsecureSkipVerify = caFile == ""
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.Err(ErrCertNotPinned)
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return errors.Err(err)
+		}
+		if !pinned[SPKIPin(cert)] {
+			return errors.Err(ErrCertNotPinned)
+		}
+		return nil
+	}
+	return config, nil
+}
+
+// SPKIPin returns the pin of a certificate's public key
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
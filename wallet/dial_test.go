@@ -0,0 +1,117 @@
+package wallet
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// selfSigned returns a certificate for 127.0.0.1
+func selfSigned(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "wallet"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+// connectProxy is an http proxy that only does CONNECT
+func connectProxy(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer target.Close()
+				_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+				go func() { _, _ = io.Copy(target, conn) }()
+				_, _ = io.Copy(conn, target)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTransport_PinnedThroughProxy(t *testing.T) {
+	tlsCert, cert := selfSigned(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{t: t, listener: tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{tlsCert}}),
+		handler: func(string, json.RawMessage) interface{} { return "ok" }}
+	go s.accept()
+	defer s.close()
+
+	p := connectProxy(t)
+	defer p.Close()
+	proxy, err := ParseProxy("http://" + p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := PinnedTLSConfig([]string{SPKIPin(cert)}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := NewTransport(s.addr(), config, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Shutdown()
+
+	otherCert, _ := selfSigned(t)
+	other, _ := x509.ParseCertificate(otherCert.Certificate[0])
+	config, err = PinnedTLSConfig([]string{SPKIPin(other)}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewTransport(s.addr(), config, proxy)
+	if !errors.Is(err, ErrCertNotPinned) {
+		t.Errorf("expected the unpinned certificate to be rejected, got %v", err)
+	}
+}
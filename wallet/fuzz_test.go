@@ -0,0 +1,63 @@
+//go:build go1.18
+// +build go1.18
+
+package wallet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+// FuzzParseMessage decodes messages the way the node does with everything the wallet server sends
+func FuzzParseMessage(f *testing.F) {
+	f.Add([]byte(`{"jsonrpc":"2.0","id":1,"result":"0.94.0"}`))
+	f.Add([]byte(`{"jsonrpc":"2.0","id":2,"error":{"code":1,"message":"unknown method"}}`))
+	f.Add([]byte(`{"jsonrpc":"2.0","id":3,"error":{"code":-32603,"message":{"code":-5,"message":"No such transaction"}}}`))
+	f.Add([]byte(`{"jsonrpc":"2.0","method":"blockchain.headers.subscribe","params":[{"hex":"00","height":1}]}`))
+	f.Add([]byte(`{"id":"4"}`))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg, err := parseMessage(b)
+		if err != nil && msg.res.err == nil {
+			t.Error("a message that can't be decoded must fail its request")
+		}
+		if msg.res.err == nil && !bytes.Equal(msg.res.data, b) {
+			t.Errorf("the response data is %q instead of the message", msg.res.data)
+		}
+		if msg.res.err == nil && msg.method == "" {
+			// what requests do with the data
+			var resp GetClaimsInTxResp
+			_ = json.Unmarshal(msg.res.data, &resp)
+		}
+	})
+}
+
+// FuzzHeaderNotification decodes the tips the server pushes, and checks their proof of work
+func FuzzHeaderNotification(f *testing.F) {
+	raw := make([]byte, HeaderSize)
+	binary.LittleEndian.PutUint32(raw[104:108], easyBits)
+	f.Add([]byte(`[{"hex":"` + hex.EncodeToString(raw) + `","height":1}]`))
+	f.Add([]byte(`[{"hex":"zz","height":-1}]`))
+	f.Add([]byte(`{"hex":"00"}`))
+
+	f.Fuzz(func(t *testing.T, params []byte) {
+		var tips []headerNotification
+		if json.Unmarshal(params, &tips) != nil {
+			return
+		}
+		for _, n := range tips {
+			h, err := n.header()
+			if err != nil {
+				continue
+			}
+			if len(h.raw) != HeaderSize {
+				t.Errorf("parsed a header of %d bytes", len(h.raw))
+			}
+			_ = h.CheckPoW()
+			_ = h.HashHex()
+		}
+	})
+}
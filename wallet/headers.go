@@ -0,0 +1,433 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ripemd160"
+)
+
+const (
+	// HeaderSize is the size of a serialized lbrycrd block header
+	HeaderSize = 112
+
+	// how many of the most recent headers are kept and checked. reorgs deeper than this can't be followed
+	headerWindow = 100
+
+	headersSubscribeMethod = "blockchain.headers.subscribe"
+)
+
+var ErrBadHeader = errors.Base("invalid header")
+
+// ChainParams are the consensus rules that headers are checked against
+type ChainParams struct {
+	// PowLimit is the easiest target a header may have
+	PowLimit *big.Int
+	// MaxTargetRise and TargetTimespan bound how much easier the target may get from one block to the next: at most
+	// MaxTargetRise/TargetTimespan times the target of the block before
+	MaxTargetRise  int64
+	TargetTimespan int64
+}
+
+// MainNet are the rules of the lbrycrd main net. The difficulty is adjusted every block, by the time the block before
+// took, damped and capped at 1.5 times easier
+var MainNet = ChainParams{
+	PowLimit:       compactToBig(0x1f00ffff),
+	MaxTargetRise:  150 + 150/2,
+	TargetTimespan: 150,
+}
+
+// CheckHeader returns an error if the header's proof of work doesn't meet its target, or if the target is easier than
+// the rules allow after prev. Without prev, only the pow limit is checked. Servers pick the targets of the headers
+// they send, so a target is only trusted as far as the rules go
+func (p ChainParams) CheckHeader(prev, h *Header) error {
+	err := h.CheckPoW()
+	if err != nil {
+		return err
+	}
+	target := compactToBig(h.Bits)
+	if target.Cmp(p.PowLimit) > 0 {
+		return errors.Prefix(fmt.Sprintf("target is above the pow limit at height %d", h.Height), ErrBadHeader)
+	}
+	if prev == nil {
+		return nil
+	}
+	max := new(big.Int).Mul(compactToBig(prev.Bits), big.NewInt(p.MaxTargetRise))
+	if new(big.Int).Mul(target, big.NewInt(p.TargetTimespan)).Cmp(max) > 0 {
+		return errors.Prefix(fmt.Sprintf("target rose faster than the difficulty adjustment allows at height %d", h.Height), ErrBadHeader)
+	}
+	return nil
+}
+
+// Header is a lbrycrd block header
+type Header struct {
+	Height        int
+	Version       int32
+	PrevBlock     []byte
+	MerkleRoot    []byte
+	ClaimTrieRoot []byte
+	Timestamp     uint32
+	Bits          uint32
+	Nonce         uint32
+
+	raw []byte
+}
+
+// ParseHeader decodes a serialized header
+func ParseHeader(height int, raw []byte) (*Header, error) {
+	if len(raw) != HeaderSize {
+		return nil, errors.Prefix(fmt.Sprintf("header is %d bytes", len(raw)), ErrBadHeader)
+	}
+	return &Header{
+		Height:        height,
+		Version:       int32(binary.LittleEndian.Uint32(raw[0:4])),
+		PrevBlock:     raw[4:36],
+		MerkleRoot:    raw[36:68],
+		ClaimTrieRoot: raw[68:100],
+		Timestamp:     binary.LittleEndian.Uint32(raw[100:104]),
+		Bits:          binary.LittleEndian.Uint32(raw[104:108]),
+		Nonce:         binary.LittleEndian.Uint32(raw[108:112]),
+		raw:           raw,
+	}, nil
+}
+
+// Hash returns the block hash, in the byte order used in headers
+func (h *Header) Hash() []byte {
+	return doubleSha256(h.raw)
+}
+
+// HashHex returns the block hash the way block explorers show it
+func (h *Header) HashHex() string {
+	return hex.EncodeToString(reverse(h.Hash()))
+}
+
+// CheckPoW returns an error if the proof of work doesn't meet the header's own difficulty target. The server picks that
+// target, so use ChainParams.CheckHeader to check it against the rules too
+func (h *Header) CheckPoW() error {
+	target := compactToBig(h.Bits)
+	if target.Sign() <= 0 {
+		return errors.Prefix("target is not positive", ErrBadHeader)
+	}
+	if new(big.Int).SetBytes(reverse(h.powHash())).Cmp(target) > 0 {
+		return errors.Prefix(fmt.Sprintf("proof of work is above the target at height %d", h.Height), ErrBadHeader)
+	}
+	return nil
+}
+
+// powHash is lbrycrd's proof of work hash: sha256d(ripemd160(left) + ripemd160(right)), where left and right are the
+// halves of sha512(sha256d(header))
+func (h *Header) powHash() []byte {
+	intermediate := sha512.Sum512(doubleSha256(h.raw))
+	left := ripemd160.New()
+	left.Write(intermediate[:32])
+	right := ripemd160.New()
+	right.Write(intermediate[32:])
+	return doubleSha256(append(left.Sum(nil), right.Sum(nil)...))
+}
+
+// checkChain checks the proof of work and the target of each header, and that each header follows the one before it
+func checkChain(params ChainParams, headers []*Header) error {
+	for i, h := range headers {
+		var prev *Header
+		if i > 0 {
+			prev = headers[i-1]
+		}
+		err := params.CheckHeader(prev, h)
+		if err != nil {
+			return err
+		}
+		if prev != nil && !bytes.Equal(h.PrevBlock, prev.Hash()) {
+			return errors.Prefix(fmt.Sprintf("header does not follow the one before it at height %d", h.Height), ErrBadHeader)
+		}
+	}
+	return nil
+}
+
+// Headers returns count headers starting at the start height
+func (c client) Headers(ctx context.Context, start, count int) ([]*Header, error) {
+	resp := &struct {
+		Result struct {
+			Hex   string `json:"hex"`
+			Count int    `json:"count"`
+		} `json:"result"`
+	}{}
+	err := c.r.request(ctx, "blockchain.block.headers", []interface{}{start, count}, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := hex.DecodeString(resp.Result.Hex)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	if len(raw) != resp.Result.Count*HeaderSize {
+		return nil, errors.Prefix(fmt.Sprintf("got %d bytes for %d headers", len(raw), resp.Result.Count), ErrBadHeader)
+	}
+	headers := make([]*Header, resp.Result.Count)
+	for i := range headers {
+		headers[i], err = ParseHeader(start+i, raw[i*HeaderSize:(i+1)*HeaderSize])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return headers, nil
+}
+
+// headerNotification is the tip the server sends when subscribing to headers, and with every new block after that
+type headerNotification struct {
+	Hex    string `json:"hex"`
+	Height int    `json:"height"`
+}
+
+func (n headerNotification) header() (*Header, error) {
+	raw, err := hex.DecodeString(n.Hex)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	return ParseHeader(n.Height, raw)
+}
+
+// Reorg describes a change of the chain tip to a different branch
+type Reorg struct {
+	// the first height where the old and new branches differ
+	ForkHeight int
+	OldTip     int
+	NewTip     int
+}
+
+// HeaderChain follows the chain tip of a wallet server. It checks the proof of work, the targets and the linkage of the
+// recent headers instead of trusting the server, and reports reorgs.
+type HeaderChain struct {
+	// Params are the rules the headers are checked against. MainNet by default
+	Params ChainParams
+
+	node        *Node
+	grp         *stop.Group
+	unsubscribe func()
+
+	mu      sync.RWMutex
+	headers map[int]*Header
+	tip     int
+
+	reorgs chan Reorg
+}
+
+// NewHeaderChain creates a header chain that follows the node's server
+func NewHeaderChain(node *Node) *HeaderChain {
+	return &HeaderChain{
+		Params:  MainNet,
+		node:    node,
+		grp:     stop.New(),
+		headers: make(map[int]*Header),
+		tip:     -1,
+		reorgs:  make(chan Reorg, 10),
+	}
+}
+
+// Start subscribes to new headers and loads the recent ones
+func (c *HeaderChain) Start() error {
+	pushes, unsubscribe := c.node.Subscribe(headersSubscribeMethod)
+	c.unsubscribe = unsubscribe
+
+	resp := &struct {
+		Result headerNotification `json:"result"`
+	}{}
+	err := c.node.request(context.Background(), headersSubscribeMethod, []interface{}{true}, resp)
+	if err == nil {
+		var tip *Header
+		tip, err = resp.Result.header()
+		if err == nil {
+			err = c.update(tip)
+		}
+	}
+	if err != nil {
+		unsubscribe()
+		return err
+	}
+
+	c.grp.Add(1)
+	go func() {
+		defer c.grp.Done()
+		for {
+			select {
+			case <-c.grp.Ch():
+				return
+			case params := <-pushes:
+				err := c.handlePush(params)
+				if err != nil {
+					log.Errorf("wallet headers: %s", errors.FullTrace(err))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops following the tip
+func (c *HeaderChain) Shutdown() {
+	c.grp.StopAndWait()
+	if c.unsubscribe != nil {
+		c.unsubscribe()
+	}
+}
+
+// Height returns the height of the tip, or -1 before the chain is loaded
+func (c *HeaderChain) Height() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tip
+}
+
+// Tip returns the header at the tip, or nil before the chain is loaded
+func (c *HeaderChain) Tip() *Header {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.headers[c.tip]
+}
+
+// Reorgs returns a channel that gets every reorg. Reorgs are dropped if nobody reads them
+func (c *HeaderChain) Reorgs() <-chan Reorg {
+	return c.reorgs
+}
+
+func (c *HeaderChain) handlePush(params json.RawMessage) error {
+	var tips []headerNotification
+	err := json.Unmarshal(params, &tips)
+	if err != nil {
+		return errors.Err(err)
+	}
+	for _, n := range tips {
+		tip, err := n.header()
+		if err != nil {
+			return err
+		}
+		err = c.update(tip)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update moves the chain to a new tip. A tip that follows the current one is added after checking it. Otherwise the
+// recent headers are fetched again and compared with the ones we had, to find where the chains forked.
+func (c *HeaderChain) update(tip *Header) error {
+	err := c.Params.CheckHeader(nil, tip)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	prev, ok := c.headers[tip.Height-1]
+	if ok && tip.Height == c.tip+1 && bytes.Equal(tip.PrevBlock, prev.Hash()) {
+		err = c.Params.CheckHeader(prev, tip)
+		if err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		c.headers[tip.Height] = tip
+		delete(c.headers, tip.Height-headerWindow)
+		c.tip = tip.Height
+		c.mu.Unlock()
+		return nil
+	}
+	if cur, ok := c.headers[tip.Height]; ok && bytes.Equal(cur.Hash(), tip.Hash()) {
+		c.mu.Unlock()
+		return nil // already have it
+	}
+	c.mu.Unlock()
+
+	start := tip.Height - headerWindow + 1
+	if start < 0 {
+		start = 0
+	}
+	headers, err := c.node.Headers(context.Background(), start, tip.Height-start+1)
+	if err != nil {
+		return err
+	}
+	if len(headers) == 0 || !bytes.Equal(headers[len(headers)-1].Hash(), tip.Hash()) {
+		return errors.Prefix("headers don't end at the tip the server sent", ErrBadHeader)
+	}
+	err = checkChain(c.Params, headers)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	oldTip := c.tip
+	fork := -1
+	for _, h := range headers {
+		if old, ok := c.headers[h.Height]; ok && !bytes.Equal(old.Hash(), h.Hash()) {
+			fork = h.Height
+			break
+		}
+	}
+	if old, ok := c.headers[start-1]; ok && !bytes.Equal(old.Hash(), headers[0].PrevBlock) {
+		log.Errorf("wallet headers: the chain forked more than %d blocks ago", headerWindow)
+		fork = start
+	}
+	if fork < 0 && oldTip > tip.Height {
+		fork = tip.Height + 1 // the new chain is shorter
+	}
+
+	c.headers = make(map[int]*Header, len(headers))
+	for _, h := range headers {
+		c.headers[h.Height] = h
+	}
+	c.tip = tip.Height
+
+	if fork >= 0 && oldTip >= 0 {
+		log.Warnf("wallet headers: reorg at height %d, tip went from %d to %d", fork, oldTip, c.tip)
+		select {
+		case c.reorgs <- Reorg{ForkHeight: fork, OldTip: oldTip, NewTip: c.tip}:
+		default:
+		}
+	}
+	return nil
+}
+
+func doubleSha256(b []byte) []byte {
+	first := sha256.Sum256(b)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+// compactToBig converts the compact difficulty target in a header to the full number
+func compactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	negative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var n *big.Int
+	if exponent <= 3 {
+		n = big.NewInt(int64(mantissa >> (8 * (3 - exponent))))
+	} else {
+		n = big.NewInt(int64(mantissa))
+		n.Lsh(n, 8*(exponent-3))
+	}
+	if negative {
+		n = n.Neg(n)
+	}
+	return n
+}
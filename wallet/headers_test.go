@@ -0,0 +1,191 @@
+package wallet
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// an easy target, so the tests can find a valid nonce quickly
+const easyBits = 0x2100ffff
+
+// testParams allow the easy target
+var testParams = ChainParams{PowLimit: compactToBig(easyBits), MaxTargetRise: 225, TargetTimespan: 150}
+
+// mine returns a header after prev with a valid proof of work. salt makes headers on different branches differ
+func mine(t *testing.T, prev *Header, salt byte) *Header {
+	return mineBits(t, prev, salt, easyBits)
+}
+
+// mineBits returns a header after prev with a valid proof of work for the target in bits
+func mineBits(t *testing.T, prev *Header, salt byte, bits uint32) *Header {
+	raw := make([]byte, HeaderSize)
+	binary.LittleEndian.PutUint32(raw[0:4], 1)
+	height := 0
+	if prev != nil {
+		copy(raw[4:36], prev.Hash())
+		height = prev.Height + 1
+	}
+	for i := 36; i < 100; i++ {
+		raw[i] = salt
+	}
+	binary.LittleEndian.PutUint32(raw[104:108], bits)
+	for nonce := uint32(0); ; nonce++ {
+		binary.LittleEndian.PutUint32(raw[108:112], nonce)
+		h, err := ParseHeader(height, append([]byte{}, raw...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.CheckPoW() == nil {
+			return h
+		}
+	}
+}
+
+func extend(t *testing.T, chain []*Header, n int, salt byte) []*Header {
+	for i := 0; i < n; i++ {
+		var prev *Header
+		if len(chain) > 0 {
+			prev = chain[len(chain)-1]
+		}
+		chain = append(chain, mine(t, prev, salt))
+	}
+	return chain
+}
+
+func TestHeader_CheckPoW(t *testing.T) {
+	h := mine(t, nil, 0)
+	if err := checkChain(testParams, []*Header{h, mine(t, h, 0)}); err != nil {
+		t.Error(err)
+	}
+	if err := checkChain(testParams, []*Header{h, mine(t, nil, 1)}); !errors.Is(err, ErrBadHeader) {
+		t.Errorf("expected headers that don't link up to fail, got %v", err)
+	}
+
+	hard := append([]byte{}, h.raw...)
+	binary.LittleEndian.PutUint32(hard[104:108], 0x1d00ffff)
+	h, err := ParseHeader(0, hard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.CheckPoW(); !errors.Is(err, ErrBadHeader) {
+		t.Errorf("expected the proof of work to be too weak, got %v", err)
+	}
+}
+
+func TestChainParams_CheckHeader(t *testing.T) {
+	prev := mineBits(t, nil, 0, 0x2000ffff)
+	if err := testParams.CheckHeader(nil, prev); err != nil {
+		t.Fatal(err)
+	}
+
+	// the target may get at most 1.5 times easier from one block to the next
+	if err := testParams.CheckHeader(prev, mineBits(t, prev, 0, 0x20017ffe)); err != nil {
+		t.Errorf("expected a target 1.5 times easier to be allowed, got %v", err)
+	}
+	if err := testParams.CheckHeader(prev, mineBits(t, prev, 0, 0x20018000)); !errors.Is(err, ErrBadHeader) {
+		t.Errorf("expected a target more than 1.5 times easier to fail, got %v", err)
+	}
+
+	// a server can't make up a chain of easy headers
+	forged := mineBits(t, prev, 0, easyBits)
+	if err := checkChain(testParams, []*Header{prev, forged}); !errors.Is(err, ErrBadHeader) {
+		t.Errorf("expected a forged easy target to fail, got %v", err)
+	}
+	if err := testParams.CheckHeader(nil, mineBits(t, nil, 0, 0x2200ffff)); !errors.Is(err, ErrBadHeader) {
+		t.Errorf("expected a target above the pow limit to fail, got %v", err)
+	}
+	if err := MainNet.CheckHeader(nil, prev); !errors.Is(err, ErrBadHeader) {
+		t.Errorf("expected a target above the main net pow limit to fail, got %v", err)
+	}
+}
+
+func TestHeaderChain(t *testing.T) {
+	var mu sync.Mutex
+	chain := extend(t, nil, 6, 0)
+	tip := func() map[string]interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		h := chain[len(chain)-1]
+		return map[string]interface{}{"hex": hex.EncodeToString(h.raw), "height": h.Height}
+	}
+
+	s := newFakeHandlerServer(t, func(method string, params json.RawMessage) interface{} {
+		switch method {
+		case headersSubscribeMethod:
+			return tip()
+		case "blockchain.block.headers":
+			var p []int
+			_ = json.Unmarshal(params, &p)
+			mu.Lock()
+			defer mu.Unlock()
+			var raw []byte
+			count := 0
+			for h := p[0]; h < p[0]+p[1] && h < len(chain); h++ {
+				raw = append(raw, chain[h].raw...)
+				count++
+			}
+			return map[string]interface{}{"hex": hex.EncodeToString(raw), "count": count}
+		default:
+			return ""
+		}
+	})
+	defer s.close()
+
+	n := NewNode()
+	err := n.Connect([]string{s.addr()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Shutdown()
+
+	c := NewHeaderChain(n)
+	c.Params = testParams
+	err = c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	if c.Height() != 5 {
+		t.Fatalf("expected height 5, got %d", c.Height())
+	}
+
+	waitFor := func(height int) {
+		for i := 0; i < 100 && c.Height() != height; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if c.Height() != height {
+			t.Fatalf("expected height %d, got %d", height, c.Height())
+		}
+	}
+
+	mu.Lock()
+	chain = extend(t, chain, 1, 0)
+	mu.Unlock()
+	s.push(headersSubscribeMethod, tip())
+	waitFor(6)
+
+	// a longer branch that forks after height 3
+	mu.Lock()
+	chain = extend(t, append([]*Header{}, chain[:4]...), 4, 1)
+	mu.Unlock()
+	s.push(headersSubscribeMethod, tip())
+	waitFor(7)
+
+	select {
+	case r := <-c.Reorgs():
+		if r != (Reorg{ForkHeight: 4, OldTip: 6, NewTip: 7}) {
+			t.Errorf("unexpected reorg %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected a reorg")
+	}
+	if c.Tip().HashHex() != hex.EncodeToString(reverse(chain[7].Hash())) {
+		t.Error("the tip should be on the new branch")
+	}
+}
@@ -3,10 +3,14 @@ package wallet
 // copied from https://github.com/d4l3k/go-electrum
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"math/rand"
 	"net"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -27,110 +31,227 @@ var (
 	ErrNodeConnected  = errors.Base("node already connected")
 	ErrConnectFailed  = errors.Base("failed to connect")
 	ErrTimeout        = errors.Base("timeout")
+	ErrCanceled       = errors.Base("canceled")
 )
 
+// DefaultTimeout is how long a request waits for its response, unless its context has a deadline
+const DefaultTimeout = 1 * time.Second
+
 type response struct {
 	data []byte
 	err  error
 }
 
+// a request waiting for its response. the message is kept so it can be sent again after a reconnect
+type pending struct {
+	c   chan response
+	msg []byte
+}
+
 type Node struct {
-	transport *TCPTransport
-	nextId    atomic.Uint32
-	grp       *stop.Group
+	client
+
+	transport   *TCPTransport
+	transportMu *sync.RWMutex
+	connected   atomic.Bool
+	nextId      atomic.Uint32
+	grp         *stop.Group
+
+	// the servers to connect to, and which one is in use
+	addrs   []string
+	addrIdx int
+	config  *tls.Config
+	proxy   *url.URL
 
 	handlersMu *sync.RWMutex
-	handlers   map[uint32]chan response
+	handlers   map[uint32]*pending
 
 	pushHandlersMu *sync.RWMutex
-	pushHandlers   map[string][]chan response
+	pushHandlers   map[string][]chan json.RawMessage
+
+	// subscription requests, keyed by method and params. they are sent again after a reconnect
+	subscriptionsMu *sync.Mutex
+	subscriptions   map[string][]byte
 
 	timeout time.Duration
+
+	// how long to wait before trying all the servers again after losing the connection. doubles after every round
+	// that fails, up to maxBackoff
+	minBackoff time.Duration
+	maxBackoff time.Duration
 }
 
 // NewNode creates a new node.
 func NewNode() *Node {
-	return &Node{
-		handlers:       make(map[uint32]chan response),
-		pushHandlers:   make(map[string][]chan response),
-		handlersMu:     &sync.RWMutex{},
-		pushHandlersMu: &sync.RWMutex{},
-		grp:            stop.New(),
-		timeout:        1 * time.Second,
+	n := &Node{
+		transportMu:     &sync.RWMutex{},
+		handlers:        make(map[uint32]*pending),
+		pushHandlers:    make(map[string][]chan json.RawMessage),
+		subscriptions:   make(map[string][]byte),
+		handlersMu:      &sync.RWMutex{},
+		pushHandlersMu:  &sync.RWMutex{},
+		subscriptionsMu: &sync.Mutex{},
+		grp:             stop.New(),
+		timeout:         DefaultTimeout,
+		minBackoff:      1 * time.Second,
+		maxBackoff:      1 * time.Minute,
 	}
+	n.client = client{r: n}
+	return n
 }
 
-// Connect creates a new connection to the specified address.
+// Connect creates a new connection to the specified address. If the connection is lost later, the node reconnects on
+// its own, trying the other addresses too.
 func (n *Node) Connect(addrs []string, config *tls.Config) error {
 	if n.transport != nil {
 		return errors.Err(ErrNodeConnected)
 	}
 
 	// shuffle addresses for load balancing
-	rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	n.addrs = append([]string{}, addrs...)
+	rand.Shuffle(len(n.addrs), func(i, j int) { n.addrs[i], n.addrs[j] = n.addrs[j], n.addrs[i] })
+	n.config = config
 
+	var t *TCPTransport
 	var err error
 
-	for _, addr := range addrs {
-		n.transport, err = NewTransport(addr, config)
+	for i, addr := range n.addrs {
+		t, err = NewTransport(addr, config, n.proxy)
 		if err == nil {
+			n.addrIdx = i
 			break
 		}
-		if errors.Is(err, ErrTimeout) {
-			continue
-		}
-		if e, ok := err.(*net.OpError); ok && e.Err.Error() == "no such host" {
-			// net.errNoSuchHost is not exported, so we have to string-match
+		if skippable(err) {
 			continue
 		}
 		return errors.Err(err)
 	}
 
-	if n.transport == nil {
+	if t == nil {
 		return errors.Err(ErrConnectFailed)
 	}
+	n.setTransport(t)
+	n.connected.Store(true)
 
-	log.Debugf("wallet connected to %s", n.transport.conn.RemoteAddr())
+	log.Debugf("wallet connected to %s", t.conn.RemoteAddr())
 
 	n.grp.Add(1)
 	go func() {
 		defer n.grp.Done()
-		<-n.grp.Ch()
-		n.transport.Shutdown()
+		n.listen(t)
 	}()
 
-	n.grp.Add(1)
-	go func() {
-		defer n.grp.Done()
-		n.handleErrors()
-	}()
+	return nil
+}
 
-	n.grp.Add(1)
-	go func() {
-		defer n.grp.Done()
-		n.listen()
-	}()
+// skippable returns true if the error means another server should be tried
+func skippable(err error) bool {
+	if errors.Is(err, ErrTimeout) {
+		return true
+	}
+	if e, ok := err.(*net.OpError); ok && e.Err.Error() == "no such host" {
+		// net.errNoSuchHost is not exported, so we have to string-match
+		return true
+	}
+	return false
+}
+
+// SetTimeout sets how long requests wait for their response, unless their context has a deadline
+func (n *Node) SetTimeout(timeout time.Duration) {
+	n.timeout = timeout
+}
 
+// SetProxy makes the node connect through a socks5:// or http:// proxy. It must be called before Connect
+func (n *Node) SetProxy(proxyURL string) error {
+	u, err := ParseProxy(proxyURL)
+	if err != nil {
+		return err
+	}
+	n.proxy = u
 	return nil
 }
 
+// Connected returns false while the node is reconnecting after losing its connection
+func (n *Node) Connected() bool {
+	return n.connected.Load()
+}
+
 func (n *Node) Shutdown() {
 	var addr net.Addr
-	if n.transport != nil {
-		addr = n.transport.conn.RemoteAddr()
+	if t := n.getTransport(); t != nil {
+		addr = t.conn.RemoteAddr()
 	}
 	log.Debugf("shutting down wallet %s", addr)
 	n.grp.StopAndWait()
+	n.connected.Store(false)
 	log.Debugf("wallet stopped")
 }
 
-func (n *Node) handleErrors() {
+func (n *Node) getTransport() *TCPTransport {
+	n.transportMu.RLock()
+	defer n.transportMu.RUnlock()
+	return n.transport
+}
+
+func (n *Node) setTransport(t *TCPTransport) {
+	n.transportMu.Lock()
+	defer n.transportMu.Unlock()
+	n.transport = t
+}
+
+// reconnect connects to the next server that works, backing off between rounds of tries. It returns nil if the node
+// is shut down first.
+func (n *Node) reconnect() *TCPTransport {
+	backoff := n.minBackoff
 	for {
+		for range n.addrs {
+			n.addrIdx = (n.addrIdx + 1) % len(n.addrs)
+			addr := n.addrs[n.addrIdx]
+			t, err := NewTransport(addr, n.config, n.proxy)
+			if err != nil {
+				log.Warnf("wallet reconnect to %s failed: %s", addr, err.Error())
+				continue
+			}
+			n.setTransport(t)
+			n.connected.Store(true)
+			log.Infof("wallet reconnected to %s", addr)
+			n.resend()
+			return t
+		}
+
+		log.Warnf("no wallet server is reachable, trying again in %s", backoff)
 		select {
 		case <-n.grp.Ch():
-			return
-		case err := <-n.transport.Errors():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > n.maxBackoff {
+			backoff = n.maxBackoff
+		}
+	}
+}
+
+// resend sends the subscriptions and the requests that were waiting for a response again, on a new connection
+func (n *Node) resend() {
+	var msgs [][]byte
+	n.subscriptionsMu.Lock()
+	for _, msg := range n.subscriptions {
+		msgs = append(msgs, msg)
+	}
+	n.subscriptionsMu.Unlock()
+	n.handlersMu.RLock()
+	for _, p := range n.handlers {
+		msgs = append(msgs, p.msg)
+	}
+	n.handlersMu.RUnlock()
+
+	t := n.getTransport()
+	for _, msg := range msgs {
+		err := t.Send(msg)
+		if err != nil {
 			n.err(errors.Err(err))
+			return // the listener will notice the connection is gone and reconnect again
 		}
 	}
 }
@@ -141,8 +262,9 @@ func (n *Node) err(err error) {
 	log.Error(errors.FullTrace(err))
 }
 
-// listen processes messages from the server.
-func (n *Node) listen() {
+// listen processes messages from the server, and reconnects when the connection is lost.
+func (n *Node) listen(t *TCPTransport) {
+	defer func() { n.getTransport().Shutdown() }()
 	for {
 		select {
 		case <-n.grp.Ch():
@@ -153,93 +275,166 @@ func (n *Node) listen() {
 		select {
 		case <-n.grp.Ch():
 			return
-		case bytes := <-n.transport.Responses():
-			msg := &struct {
-				Id     uint32 `json:"id"`
-				Method string `json:"method"`
-				Error  struct {
-					Code    int    `json:"code"`
-					Message string `json:"message"`
-				} `json:"error"`
-			}{}
-			msg2 := &struct {
-				Id     uint32 `json:"id"`
-				Method string `json:"method"`
-				Error  struct {
-					Code    int `json:"code"`
-					Message struct {
-						Code    int    `json:"code"`
-						Message string `json:"message"`
-					} `json:"message"`
-				} `json:"error"`
-			}{}
-			r := response{}
-
-			err := json.Unmarshal(bytes, msg)
-			if err != nil {
-				// try msg2, a hack around the weird error-in-error response we sometimes get from wallet server
-				// maybe that happens because the wallet server passes a lbrycrd error through to us?
-				if err2 := json.Unmarshal(bytes, msg2); err2 == nil {
-					err = nil
-					msg.Id = msg2.Id
-					msg.Method = msg2.Method
-					msg.Error = msg2.Error.Message
-				}
+		case err := <-t.Errors():
+			n.connected.Store(false)
+			n.err(errors.Prefix("wallet connection to "+t.conn.RemoteAddr().String()+" lost", err))
+			t.Shutdown()
+			t = n.reconnect()
+			if t == nil {
+				return
 			}
-
+		case bytes := <-t.Responses():
+			msg, err := parseMessage(bytes)
 			if err != nil {
-				r.err = errors.Err(err)
-				n.err(r.err)
-			} else if len(msg.Error.Message) > 0 {
-				r.err = errors.Err("%d: %s", msg.Error.Code, msg.Error.Message)
-			} else {
-				r.data = bytes
+				n.err(err)
 			}
 
-			if len(msg.Method) > 0 {
-				n.pushHandlersMu.RLock()
-				handlers := n.pushHandlers[msg.Method]
-				n.pushHandlersMu.RUnlock()
-
-				for _, handler := range handlers {
-					select {
-					case handler <- r:
-					default:
-					}
+			if len(msg.method) > 0 {
+				// notifications have no id, so they can't be a response
+				if msg.res.err == nil {
+					n.push(msg.method, msg.params)
 				}
+				continue
 			}
 
 			n.handlersMu.RLock()
-			c, ok := n.handlers[msg.Id]
+			p, ok := n.handlers[msg.id]
 			n.handlersMu.RUnlock()
 			if ok {
-				c <- r
+				select {
+				case p.c <- msg.res:
+				default: // a replayed request can get a second response
+				}
 			}
 		}
 	}
 }
 
-// listenPush returns a channel of messages matching the method.
-//func (n *Node) listenPush(method string) <-chan []byte {
-//	c := make(chan []byte, 1)
-//	n.pushHandlersMu.Lock()
-//	defer n.pushHandlersMu.Unlock()
-//	n.pushHandlers[method] = append(n.pushHandlers[method], c)
-//	return c
-//}
-
-// request makes a request to the server and unmarshals the response into v.
-func (n *Node) request(method string, params []string, v interface{}) error {
+// message is a response or a notification from the server
+type message struct {
+	id     uint32
+	method string
+	params json.RawMessage
+	res    response
+}
+
+// parseMessage decodes a message from the server. Error responses have res.err set. So do messages that can't be
+// decoded, and their error is returned too
+func parseMessage(bytes []byte) (message, error) {
+	msg := &struct {
+		Id     uint32          `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+		Error  struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	msg2 := &struct {
+		Id     uint32 `json:"id"`
+		Method string `json:"method"`
+		Error  struct {
+			Code    int `json:"code"`
+			Message struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			} `json:"message"`
+		} `json:"error"`
+	}{}
+	r := response{}
+
+	err := json.Unmarshal(bytes, msg)
+	if err != nil {
+		// try msg2, a hack around the weird error-in-error response we sometimes get from wallet server
+		// maybe that happens because the wallet server passes a lbrycrd error through to us?
+		if err2 := json.Unmarshal(bytes, msg2); err2 == nil {
+			err = nil
+			msg.Id = msg2.Id
+			msg.Method = msg2.Method
+			msg.Error = msg2.Error.Message
+		}
+	}
+
+	if err != nil {
+		r.err = errors.Err(err)
+	} else if len(msg.Error.Message) > 0 {
+		r.err = errors.Err("%d: %s", msg.Error.Code, msg.Error.Message)
+	} else {
+		r.data = bytes
+	}
+
+	m := message{id: msg.Id, method: msg.Method, params: msg.Params, res: r}
+	if err != nil {
+		return m, r.err
+	}
+	return m, nil
+}
+
+// how many notifications a subscriber can fall behind before new ones are dropped
+const pushBuffer = 100
+
+// Subscribe returns a channel that gets the params of every notification the server pushes for the method, and a
+// function that ends the subscription and closes the channel. It only listens. The server must also be asked to send
+// the notifications, usually with a Raw request to the same method, which is sent again after reconnecting.
+// Notifications are dropped when the channel's buffer is full.
+func (n *Node) Subscribe(method string) (<-chan json.RawMessage, func()) {
+	c := make(chan json.RawMessage, pushBuffer)
+	n.pushHandlersMu.Lock()
+	n.pushHandlers[method] = append(n.pushHandlers[method], c)
+	n.pushHandlersMu.Unlock()
+
+	once := sync.Once{}
+	return c, func() {
+		once.Do(func() {
+			n.pushHandlersMu.Lock()
+			defer n.pushHandlersMu.Unlock()
+			handlers := n.pushHandlers[method]
+			for i, h := range handlers {
+				if h == c {
+					n.pushHandlers[method] = append(handlers[:i:i], handlers[i+1:]...)
+					break
+				}
+			}
+			if len(n.pushHandlers[method]) == 0 {
+				delete(n.pushHandlers, method)
+			}
+			close(c)
+		})
+	}
+}
+
+// push delivers a notification to the method's subscribers
+func (n *Node) push(method string, params json.RawMessage) {
+	n.pushHandlersMu.RLock()
+	defer n.pushHandlersMu.RUnlock()
+	for _, c := range n.pushHandlers[method] {
+		select {
+		case c <- params:
+		default:
+			log.Warnf("wallet: a %s subscriber is falling behind, dropping a notification", method)
+		}
+	}
+}
+
+// request makes a request to the server and unmarshals the response into v. It returns ErrTimeout if the response
+// doesn't arrive before the context's deadline, or the node's timeout if the context has none, and ErrCanceled if the
+// context is canceled first.
+func (n *Node) request(ctx context.Context, method string, params []interface{}, v interface{}) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.timeout)
+		defer cancel()
+	}
+
 	msg := struct {
-		Id     uint32   `json:"id"`
-		Method string   `json:"method"`
-		Params []string `json:"params"`
+		Id     uint32        `json:"id"`
+		Method string        `json:"method"`
+		Params []interface{} `json:"params"`
 	}{
-		Id:     n.nextId.Load(),
+		Id:     n.nextId.Inc() - 1,
 		Method: method,
 		Params: params,
 	}
-	n.nextId.Inc()
 
 	bytes, err := json.Marshal(msg)
 	if err != nil {
@@ -247,15 +442,22 @@ func (n *Node) request(method string, params []string, v interface{}) error {
 	}
 	bytes = append(bytes, delimiter)
 
+	if strings.HasSuffix(method, ".subscribe") {
+		n.subscriptionsMu.Lock()
+		n.subscriptions[method+fmt.Sprint(params)] = bytes
+		n.subscriptionsMu.Unlock()
+	}
+
 	c := make(chan response, 1)
 
 	n.handlersMu.Lock()
-	n.handlers[msg.Id] = c
+	n.handlers[msg.Id] = &pending{c: c, msg: bytes}
 	n.handlersMu.Unlock()
 
-	err = n.transport.Send(bytes)
+	err = n.getTransport().Send(bytes)
 	if err != nil {
-		return errors.Err(err)
+		// the connection is gone. the request is sent again after reconnecting, if that happens before the timeout
+		log.Debugf("wallet request %d will be sent after reconnecting: %s", msg.Id, err.Error())
 	}
 
 	var r response
@@ -263,8 +465,12 @@ func (n *Node) request(method string, params []string, v interface{}) error {
 	case <-n.grp.Ch():
 		return nil
 	case r = <-c:
-	case <-time.After(n.timeout):
-		r = response{err: errors.Err(ErrTimeout)}
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			r = response{err: errors.Err(ErrTimeout)}
+		} else {
+			r = response{err: errors.Err(ErrCanceled)}
+		}
 	}
 
 	n.handlersMu.Lock()
@@ -0,0 +1,224 @@
+package wallet
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// fakeServer answers requests with what its handler returns
+type fakeServer struct {
+	t        *testing.T
+	listener net.Listener
+	handler  func(method string, params json.RawMessage) interface{}
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// newFakeServer returns a server that answers every request with the same result, or with its own address if result
+// is empty
+func newFakeServer(t *testing.T, result string) *fakeServer {
+	var s *fakeServer
+	s = newFakeHandlerServer(t, func(string, json.RawMessage) interface{} {
+		if result == "" {
+			return s.addr()
+		}
+		return result
+	})
+	return s
+}
+
+func newFakeHandlerServer(t *testing.T, handler func(method string, params json.RawMessage) interface{}) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{t: t, listener: l, handler: handler}
+	go s.accept()
+	return s
+}
+
+func (s *fakeServer) addr() string { return s.listener.Addr().String() }
+
+func (s *fakeServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes(delimiter)
+		if err != nil {
+			return
+		}
+		var req struct {
+			Id     uint32          `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if json.Unmarshal(line, &req) != nil {
+			return
+		}
+		resp, _ := json.Marshal(map[string]interface{}{"id": req.Id, "result": s.handler(req.Method, req.Params)})
+		_, err = conn.Write(append(resp, delimiter))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// push sends a notification to every client
+func (s *fakeServer) push(method string, params ...interface{}) {
+	msg, _ := json.Marshal(map[string]interface{}{"method": method, "params": params})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		_, _ = c.Write(append(msg, delimiter))
+	}
+}
+
+func (s *fakeServer) close() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+func TestNode_Reconnect(t *testing.T) {
+	servers := map[string]*fakeServer{}
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		s := newFakeServer(t, "")
+		defer s.close()
+		servers[s.addr()] = s
+		addrs = append(addrs, s.addr())
+	}
+
+	n := NewNode()
+	n.minBackoff = 10 * time.Millisecond
+	err := n.Connect(addrs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Shutdown()
+
+	var first string
+	err = n.Raw(context.Background(), "server.version", nil, &struct{ Result *string }{&first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers[first].close()
+
+	var second string
+	for i := 0; i < 20 && second == ""; i++ {
+		err = n.Raw(context.Background(), "server.version", nil, &struct{ Result *string }{&second})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Errorf("expected the node to move off %s after it went away", first)
+	}
+}
+
+func TestNode_RequestContext(t *testing.T) {
+	// accepts connections and answers only the version check, so requests hang
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				reader := bufio.NewReader(conn)
+				_, _ = reader.ReadBytes(delimiter)
+				_, _ = conn.Write([]byte(`{"id":1,"result":["x","1.0"]}` + "\n"))
+				_, _ = reader.ReadBytes(0)
+			}()
+		}
+	}()
+
+	n := NewNode()
+	n.SetTimeout(50 * time.Millisecond)
+	err = n.Connect([]string{l.Addr().String()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Shutdown()
+
+	err = n.Raw(context.Background(), "server.version", nil, nil)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err = n.Raw(ctx, "server.version", nil, nil)
+	if !errors.Is(err, ErrCanceled) {
+		t.Errorf("expected the request to be canceled, got %v", err)
+	}
+}
+
+func TestNode_Subscribe(t *testing.T) {
+	s := newFakeServer(t, "ok")
+	defer s.close()
+
+	n := NewNode()
+	err := n.Connect([]string{s.addr()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Shutdown()
+
+	c, unsubscribe := n.Subscribe("blockchain.address.subscribe")
+	other, unsubscribeOther := n.Subscribe("blockchain.address.subscribe")
+	defer unsubscribeOther()
+
+	s.push("blockchain.address.subscribe", "addr", "status")
+	for _, ch := range []<-chan json.RawMessage{c, other} {
+		select {
+		case params := <-ch:
+			if string(params) != `["addr","status"]` {
+				t.Errorf("unexpected params %s", params)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected a notification")
+		}
+	}
+
+	unsubscribe()
+	unsubscribe()
+	if _, ok := <-c; ok {
+		t.Error("expected the channel to be closed")
+	}
+
+	s.push("blockchain.address.subscribe", "addr", "status2")
+	select {
+	case <-other:
+	case <-time.After(time.Second):
+		t.Fatal("expected the other subscriber to keep getting notifications")
+	}
+}
@@ -0,0 +1,248 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	types "github.com/lbryio/types/v2/go"
+
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
+)
+
+var (
+	ErrNoNodes  = errors.Base("no wallet server is connected")
+	ErrNoQuorum = errors.Base("wallet servers did not agree")
+)
+
+// NodePool keeps connections to several wallet servers. Requests go to the servers in turn, and move on to the next
+// one if a server fails. Resolving claims can require several servers to return the same result, so one misbehaving
+// server can't feed us a wrong claim.
+type NodePool struct {
+	client
+
+	nodes  []*Node
+	next   atomic.Uint32
+	quorum int
+	proxy  string
+}
+
+// NewNodePool creates a pool. Claim resolution needs the same answer from quorum servers. 0 or 1 means any single
+// server is trusted.
+func NewNodePool(quorum int) *NodePool {
+	p := &NodePool{quorum: quorum}
+	p.client = client{r: p}
+	return p
+}
+
+// Connect connects to each of the addresses. It fails only if none of them can be reached, or if fewer can be
+// reached than the quorum needs. Nodes that can't be reached are left out.
+func (p *NodePool) Connect(addrs []string, config *tls.Config) error {
+	if len(p.nodes) > 0 {
+		return errors.Err(ErrNodeConnected)
+	}
+
+	type connectResult struct {
+		node *Node
+		err  error
+	}
+	results := make(chan connectResult, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			n := NewNode()
+			var err error
+			if p.proxy != "" {
+				err = n.SetProxy(p.proxy)
+			}
+			if err == nil {
+				err = n.Connect([]string{addr}, config)
+			}
+			if err != nil {
+				n.Shutdown()
+				results <- connectResult{err: errors.Prefix(addr, err)}
+				return
+			}
+			results <- connectResult{node: n}
+		}(addr)
+	}
+	for range addrs {
+		r := <-results
+		if r.err != nil {
+			log.Warnf("wallet pool: %s", r.err.Error())
+			continue
+		}
+		p.nodes = append(p.nodes, r.node)
+	}
+
+	if len(p.nodes) == 0 {
+		return errors.Err(ErrConnectFailed)
+	}
+	if len(p.nodes) < p.quorum {
+		p.Shutdown()
+		return errors.Err("only %d wallet servers are reachable, the quorum needs %d", len(p.nodes), p.quorum)
+	}
+	return nil
+}
+
+// SetProxy makes the nodes connect through a socks5:// or http:// proxy. It must be called before Connect
+func (p *NodePool) SetProxy(proxyURL string) error {
+	_, err := ParseProxy(proxyURL)
+	if err != nil {
+		return err
+	}
+	p.proxy = proxyURL
+	return nil
+}
+
+// SetTimeout sets the request timeout of every node
+func (p *NodePool) SetTimeout(timeout time.Duration) {
+	for _, n := range p.nodes {
+		n.SetTimeout(timeout)
+	}
+}
+
+// Shutdown disconnects from all the servers
+func (p *NodePool) Shutdown() {
+	wg := sync.WaitGroup{}
+	for _, n := range p.nodes {
+		wg.Add(1)
+		go func(n *Node) {
+			defer wg.Done()
+			n.Shutdown()
+		}(n)
+	}
+	wg.Wait()
+	p.nodes = nil
+}
+
+// connected returns the nodes that are connected, starting with the next one in turn
+func (p *NodePool) connected() []*Node {
+	if len(p.nodes) == 0 {
+		return nil
+	}
+	start := int(p.next.Inc()) % len(p.nodes)
+	var nodes []*Node
+	for i := range p.nodes {
+		n := p.nodes[(start+i)%len(p.nodes)]
+		if n.Connected() {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// request sends the request to the connected nodes in turn, until one of them answers
+func (p *NodePool) request(ctx context.Context, method string, params []interface{}, v interface{}) error {
+	nodes := p.connected()
+	if len(nodes) == 0 {
+		return errors.Err(ErrNoNodes)
+	}
+	var err error
+	for _, n := range nodes {
+		err = n.request(ctx, method, params, v)
+		if err == nil || errors.Is(err, ErrCanceled) {
+			return err
+		}
+		log.Debugf("wallet pool: %s failed, trying the next server: %s", method, err.Error())
+	}
+	return err
+}
+
+// Resolve resolves a url, with the quorum if the pool has one
+func (p *NodePool) Resolve(ctx context.Context, url string) (*types.Output, error) {
+	return client{r: quorumRequester{p}}.Resolve(ctx, url)
+}
+
+// ResolveURLs resolves several urls, with the quorum if the pool has one
+func (p *NodePool) ResolveURLs(ctx context.Context, urls ...string) ([]*types.Output, error) {
+	return client{r: quorumRequester{p}}.ResolveURLs(ctx, urls...)
+}
+
+// GetClaimsByIds returns the claims with the given ids, with the quorum if the pool has one
+func (p *NodePool) GetClaimsByIds(ctx context.Context, claimIDs ...string) ([]*types.Output, error) {
+	return client{r: quorumRequester{p}}.GetClaimsByIds(ctx, claimIDs...)
+}
+
+// GetClaimInTx returns the claim in a transaction output, with the quorum if the pool has one
+func (p *NodePool) GetClaimInTx(ctx context.Context, txid string, nout int) (*types.Claim, error) {
+	return client{r: quorumRequester{p}}.GetClaimInTx(ctx, txid, nout)
+}
+
+// QuorumRaw makes a raw wallet server request and only succeeds if enough servers agree on the result
+func (p *NodePool) QuorumRaw(ctx context.Context, method string, params []string, v interface{}) error {
+	return quorumRequester{p}.request(ctx, method, stringParams(params), v)
+}
+
+// quorumRequester sends a request to all the connected nodes, and returns the result once quorum of them agree on it
+type quorumRequester struct {
+	p *NodePool
+}
+
+func (q quorumRequester) request(ctx context.Context, method string, params []interface{}, v interface{}) error {
+	if q.p.quorum <= 1 {
+		return q.p.request(ctx, method, params, v)
+	}
+	nodes := q.p.connected()
+	if len(nodes) < q.p.quorum {
+		return errors.Prefix(fmt.Sprintf("%d wallet servers are connected, the quorum needs %d", len(nodes), q.p.quorum), ErrNoQuorum)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		raw json.RawMessage
+		err error
+	}
+	results := make(chan result, len(nodes))
+	for _, n := range nodes {
+		go func(n *Node) {
+			// the id differs between servers, so only the result is compared
+			var resp struct {
+				Result json.RawMessage `json:"result"`
+			}
+			err := n.request(ctx, method, params, &resp)
+			results <- result{raw: resp.Result, err: err}
+		}(n)
+	}
+
+	var agreed [][]byte
+	var votes []int
+	var lastErr error
+	for range nodes {
+		r := <-results
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		found := false
+		for i, a := range agreed {
+			if bytes.Equal(a, r.raw) {
+				votes[i]++
+				found = true
+				if votes[i] >= q.p.quorum {
+					return errors.Err(json.Unmarshal([]byte(`{"result":`+string(a)+`}`), v))
+				}
+			}
+		}
+		if !found {
+			agreed = append(agreed, r.raw)
+			votes = append(votes, 1)
+		}
+	}
+
+	if len(agreed) > 1 {
+		log.Warnf("wallet servers returned %d different results for %s %v", len(agreed), method, params)
+	}
+	if lastErr != nil {
+		log.Debugf("wallet pool: %s failed on some servers: %s", method, lastErr.Error())
+	}
+	return errors.Prefix(method, ErrNoQuorum)
+}
@@ -0,0 +1,44 @@
+package wallet
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+func TestNodePool_Quorum(t *testing.T) {
+	var addrs []string
+	for _, result := range []string{"honest", "honest", "liar"} {
+		s := newFakeServer(t, result)
+		defer s.close()
+		addrs = append(addrs, s.addr())
+	}
+
+	p := NewNodePool(2)
+	err := p.Connect(addrs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	var result string
+	err = p.QuorumRaw(context.Background(), "blockchain.claimtrie.resolve", []string{"lbry://x"}, &struct{ Result *string }{&result})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "honest" {
+		t.Errorf("expected the result most servers agree on, got %s", result)
+	}
+
+	strict := NewNodePool(3)
+	err = strict.Connect(addrs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer strict.Shutdown()
+	err = strict.QuorumRaw(context.Background(), "blockchain.claimtrie.resolve", []string{"lbry://x"}, &struct{ Result *string }{&result})
+	if !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("expected no quorum, got %v", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/url"
 	"time"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
@@ -23,16 +24,10 @@ type TCPTransport struct {
 	grp       *stop.Group
 }
 
-func NewTransport(addr string, config *tls.Config) (*TCPTransport, error) {
-	var conn net.Conn
-	var err error
-
-	timeout := 5 * time.Second
-	if config != nil {
-		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, config)
-	} else {
-		conn, err = net.DialTimeout("tcp", addr, timeout)
-	}
+// NewTransport connects to a wallet server. The connection uses TLS if config is set, and goes through the proxy if
+// there is one.
+func NewTransport(addr string, config *tls.Config, proxy *url.URL) (*TCPTransport, error) {
+	conn, err := dial(addr, config, proxy, 5*time.Second)
 	if err != nil {
 		return nil, err
 	}
@@ -40,7 +35,7 @@ func NewTransport(addr string, config *tls.Config) (*TCPTransport, error) {
 	t := &TCPTransport{
 		conn:      conn,
 		responses: make(chan []byte),
-		errors:    make(chan error),
+		errors:    make(chan error, 1),
 		grp:       stop.New(),
 	}
 
@@ -89,7 +84,11 @@ func (t *TCPTransport) listen() {
 
 		log.Debugf("%s -> %s", t.conn.RemoteAddr(), line)
 
-		t.responses <- line
+		select {
+		case t.responses <- line:
+		case <-t.grp.Ch():
+			return
+		}
 	}
 }
 
@@ -0,0 +1,228 @@
+// Package webhook tells an external service about what happens to the blobs, so indexers can stay in sync without
+// polling the db. Each event is POSTed as json to a url, signed with a shared secret, and retried if it fails.
+//
+// The signature is in the X-Reflector-Signature header as sha256=HEX, the hex HMAC-SHA256 of the body with the secret.
+// X-Reflector-Event has the event type and X-Reflector-Delivery the event id, which stays the same across retries.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lbryio/reflector.go/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EventType is what happened
+type EventType string
+
+const (
+	// EventStreamIngested is sent when all the blobs of a stream are stored. Hash is the sd hash
+	EventStreamIngested EventType = "stream.ingested"
+	// EventBlobDeleted is sent when a blob is deleted from the store
+	EventBlobDeleted EventType = "blob.deleted"
+	// EventBlocklistHit is sent when an upload of a blocked blob is turned away
+	EventBlocklistHit EventType = "blocklist.hit"
+)
+
+// Valid returns whether t is one of the event types
+func (t EventType) Valid() bool {
+	return t == EventStreamIngested || t == EventBlobDeleted || t == EventBlocklistHit
+}
+
+// Headers of the webhook requests
+const (
+	SignatureHeader = "X-Reflector-Signature"
+	EventHeader     = "X-Reflector-Event"
+	DeliveryHeader  = "X-Reflector-Delivery"
+)
+
+const (
+	// DefaultAttempts is how many times an event is tried, unless Attempts is changed
+	DefaultAttempts = 5
+	// DefaultTimeout is how long a request may take, unless Timeout is changed
+	DefaultTimeout = 10 * time.Second
+
+	queueSize  = 10000
+	minBackoff = time.Second
+)
+
+// Event is what the webhook is sent, as json
+type Event struct {
+	ID   string    `json:"id"`
+	Type EventType `json:"type"`
+	Hash string    `json:"hash"`
+	Time time.Time `json:"time"`
+}
+
+// Dispatcher sends events to a webhook in the background, one at a time and in order
+type Dispatcher struct {
+	// Events are the types of events that are sent. All of them are sent if it's empty
+	Events []EventType
+	// Attempts is how many times an event is tried before it's dropped. The wait between them starts at a second and
+	// doubles
+	Attempts int
+	// Timeout is how long a request may take
+	Timeout time.Duration
+
+	url    string
+	secret string
+	client *http.Client
+	queue  chan Event
+	grp    *stop.Group
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+// NewDispatcher returns a dispatcher that sends events to url, signed with secret. Events are not signed if the secret
+// is empty
+func NewDispatcher(url, secret string) *Dispatcher {
+	return &Dispatcher{
+		Attempts: DefaultAttempts,
+		Timeout:  DefaultTimeout,
+		url:      url,
+		secret:   secret,
+		client:   &http.Client{},
+		queue:    make(chan Event, queueSize),
+		grp:      stop.New(),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start starts sending events
+func (d *Dispatcher) Start() {
+	d.client.Timeout = d.Timeout
+	go func() {
+		defer close(d.done)
+		for e := range d.queue {
+			d.deliver(e)
+		}
+	}()
+}
+
+// Shutdown sends the events that are queued, each tried once more at most, and stops the dispatcher. Events sent after
+// it are dropped
+func (d *Dispatcher) Shutdown() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	close(d.queue)
+	d.mu.Unlock()
+	d.grp.Stop()
+	<-d.done
+}
+
+// Send queues an event for the blob with the given hash. Events are dropped if the queue is full
+func (d *Dispatcher) Send(t EventType, hash string) {
+	if !d.wants(t) {
+		return
+	}
+	e := Event{ID: shared.NewRequestID(), Type: t, Hash: hash, Time: time.Now().UTC()}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	select {
+	case d.queue <- e:
+	default:
+		log.Errorf("webhook queue is full, dropping %s event for %s", t, hash)
+	}
+}
+
+func (d *Dispatcher) wants(t EventType) bool {
+	if len(d.Events) == 0 {
+		return true
+	}
+	for _, w := range d.Events {
+		if w == t {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver sends the event until it's accepted or it ran out of attempts. Once the dispatcher is shutting down, there
+// are no more waits between attempts
+func (d *Dispatcher) deliver(e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("webhook: %s", err.Error())
+		return
+	}
+	backoff := minBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := d.post(e, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= d.Attempts {
+			log.Errorf("webhook: dropping %s event for %s after %d attempts: %s", e.Type, e.Hash, attempt, err.Error())
+			return
+		}
+		log.Warnf("webhook: %s event for %s failed, trying again: %s", e.Type, e.Hash, err.Error())
+		select {
+		case <-time.After(backoff):
+		case <-d.grp.Ch():
+			// one last try when shutting down
+			attempt = d.Attempts - 1
+		}
+		backoff *= 2
+	}
+}
+
+// post sends the event once. It returns whether a failure is worth trying again
+func (d *Dispatcher) post(e Event, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Err(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(e.Type))
+	req.Header.Set(DeliveryHeader, e.ID)
+	if d.secret != "" {
+		req.Header.Set(SignatureHeader, Sign(d.secret, body))
+	}
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return true, errors.Err(err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return false, nil
+	}
+	// other client errors won't go away by trying again
+	retry := res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusRequestTimeout
+	return retry, errors.Err("status %d", res.StatusCode)
+}
+
+// Sign returns the signature of a body, the way it's set in the signature header
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature header of a webhook request against its body. It's for the services that receive them
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
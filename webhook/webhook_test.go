@@ -0,0 +1,72 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatcher(t *testing.T) {
+	var mu sync.Mutex
+	var got []Event
+	var attempts int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.True(t, Verify("secret", body, r.Header.Get(SignatureHeader)), "bad signature")
+
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			// the first try fails and is retried
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e Event
+		assert.NoError(t, json.Unmarshal(body, &e))
+		assert.Equal(t, string(e.Type), r.Header.Get(EventHeader))
+		assert.Equal(t, e.ID, r.Header.Get(DeliveryHeader))
+		got = append(got, e)
+	}))
+	defer ts.Close()
+
+	d := NewDispatcher(ts.URL, "secret")
+	d.Events = []EventType{EventBlobDeleted, EventStreamIngested}
+	d.Start()
+	d.Send(EventStreamIngested, "sd")
+	d.Send(EventBlocklistHit, "blocked")
+	d.Send(EventBlobDeleted, "blob")
+	d.Shutdown()
+	d.Send(EventBlobDeleted, "after shutdown")
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, got, 2)
+	assert.Equal(t, EventStreamIngested, got[0].Type)
+	assert.Equal(t, "sd", got[0].Hash)
+	assert.Equal(t, EventBlobDeleted, got[1].Type)
+	assert.Equal(t, "blob", got[1].Hash)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestDispatcher_ClientErrorNotRetried(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	d := NewDispatcher(ts.URL, "")
+	d.Start()
+	d.Send(EventBlobDeleted, "blob")
+	d.Shutdown()
+	assert.Equal(t, 1, attempts)
+}